@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+)
+
+// All-day events are floating dates: they are stored as midnight UTC of their first day with an
+// exclusive end date, and take place on the same dates in every timezone.
+
+// allDayMargin widens time range queries so they find the all-day events of every timezone
+const allDayMargin = 24 * time.Hour
+
+// allDayDate returns the date of t's wall clock as midnight UTC
+func allDayDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// normalizeAllDay turns the event times into dates. An end with a time of day includes that day,
+// an end that isn't after the start makes a one day event.
+func normalizeAllDay(event *Event) {
+	start := allDayDate(event.Start)
+	end := allDayDate(event.End)
+	if event.End.Hour() != 0 || event.End.Minute() != 0 || event.End.Second() != 0 {
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(start) {
+		end = start.AddDate(0, 0, 1)
+	}
+
+	event.Start = start
+	event.End = end
+}
+
+// allDayDays returns the number of days an all-day event lasts
+func allDayDays(event *Event) int {
+	days := int(allDayDate(event.End).Sub(allDayDate(event.Start)).Hours()+12) / 24
+	if days < 1 {
+		return 1
+	}
+	return days
+}
+
+// allDayInLocation returns the midnight starting the date in the location
+func allDayInLocation(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// localizeAllDay presents the event dates as midnights in the location
+func localizeAllDay(event *Event, loc *time.Location) {
+	days := allDayDays(event)
+	event.Start = allDayInLocation(event.Start, loc)
+	event.End = event.Start.AddDate(0, 0, days)
+}
+
+// allDayNotifyTime returns when an all-day event on the date is notified, in the morning of the owner's timezone
+func allDayNotifyTime(date time.Time, loc *time.Location) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), AllDayNotifyHour, 0, 0, 0, loc).UTC()
+}
+
+// allDayAlertTime returns when the alert of an all-day event starting on the date fires, nil without alert
+func allDayAlertTime(date time.Time, alert EventAlert, loc *time.Location) *time.Time {
+	if alert == EventAlertNone {
+		return nil
+	}
+	alertTime := allDayNotifyTime(date, loc).Add(-1 * EventAlertDurationMap[alert])
+	return &alertTime
+}
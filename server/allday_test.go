@@ -0,0 +1,217 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNormalizeAllDay(t *testing.T) {
+	assert := assert.New(t)
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+
+	tests := []struct {
+		name       string
+		start, end time.Time
+		wantStart  time.Time
+		wantEnd    time.Time
+	}{
+		{
+			name:      "exclusive end date",
+			start:     time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "end with a time of day includes the day",
+			start:     time.Date(2024, 3, 10, 8, 0, 0, 0, tokyo),
+			end:       time.Date(2024, 3, 11, 17, 30, 0, 0, tokyo),
+			wantStart: time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "wall-clock date, not the UTC one",
+			start:     time.Date(2024, 3, 10, 0, 0, 0, 0, tokyo),
+			end:       time.Date(2024, 3, 10, 0, 0, 0, 0, tokyo),
+			wantStart: time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		event := &Event{Start: test.start, End: test.end}
+		normalizeAllDay(event)
+		assert.Equal(test.wantStart, event.Start, test.name)
+		assert.Equal(test.wantEnd, event.End, test.name)
+	}
+}
+
+func TestLocalizeAllDay(t *testing.T) {
+	assert := assert.New(t)
+	newYork, _ := time.LoadLocation("America/New_York")
+
+	// the clocks change on March 10 2024, the event still ends at midnight
+	event := &Event{
+		Start:  time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC),
+		End:    time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+		AllDay: true,
+	}
+	localizeAllDay(event, newYork)
+
+	assert.Equal(time.Date(2024, 3, 9, 0, 0, 0, 0, newYork), event.Start)
+	assert.Equal(time.Date(2024, 3, 11, 0, 0, 0, 0, newYork), event.End)
+}
+
+func TestAllDayAlertTime(t *testing.T) {
+	assert := assert.New(t)
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	date := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(time.Date(2024, 7, 1, 7, 0, 0, 0, time.UTC), allDayNotifyTime(date, berlin))
+	assert.Nil(allDayAlertTime(date, EventAlertNone, berlin))
+	assert.Equal(time.Date(2024, 6, 30, 7, 0, 0, 0, time.UTC), *allDayAlertTime(date, EventAlert1DayBefore, berlin))
+}
+
+func TestFormatEventTime(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("2024-03-10 all day", formatEventTime(Event{
+		Start:  time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+		End:    time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+		AllDay: true,
+	}))
+	assert.Equal("2024-03-10 - 2024-03-12 all day", formatEventTime(Event{
+		Start:  time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+		End:    time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC),
+		AllDay: true,
+	}))
+	assert.Equal("2024-03-10T22:00:00 - 2024-03-11T02:00:00", formatEventTime(Event{
+		Start: time.Date(2024, 3, 10, 22, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 3, 11, 2, 0, 0, 0, time.UTC),
+	}))
+	assert.Equal("2024-03-10T22:00:00", formatEventTime(Event{
+		Start: time.Date(2024, 3, 10, 22, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+	}))
+}
+
+func TestGetUserEventsUTCAllDay(t *testing.T) {
+	assert := assert.New(t)
+
+	api := plugintest.API{}
+	api.On("GetTeamsForUser", "test-user").Return([]*model.Team{}, nil)
+
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbMock.MatchExpectationsInOrder(false)
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ChannelId FROM ChannelMembers")).
+		WillReturnRows(sqlmock.NewRows([]string{"channelid"}))
+
+	columns := []string{"id", "title", "dt_start", "dt_end", "all_day", "owner", "visibility", "recurrent", "recurrence", "alert"}
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows(columns).
+			// the day before the range in New York, the margin finds it
+			AddRow("before", "Before", time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC), true, "test-user", "private", false, "", "").
+			AddRow("holiday", "Holiday", time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), true, "test-user", "private", false, "", "").
+			// started before the range and still runs
+			AddRow("conference", "Conference", time.Date(2024, 3, 8, 14, 0, 0, 0, time.UTC), time.Date(2024, 3, 9, 20, 0, 0, 0, time.UTC), false, "test-user", "private", false, "", "").
+			AddRow("weekly", "Weekly", time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), true, "test-user", "private", true, "RRULE:FREQ=WEEKLY", ""))
+
+	calPlugin := Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+		DB: sqlx.NewDb(db, "sqlmock"),
+	}
+
+	newYork, _ := time.LoadLocation("America/New_York")
+	start := time.Date(2024, 3, 9, 0, 0, 0, 0, newYork)
+
+	events, appErr := calPlugin.GetUserEventsUTC("test-user", newYork, start.UTC(), start.AddDate(0, 0, 1).UTC())
+	assert.Nil(appErr)
+
+	byId := map[string]Event{}
+	for _, event := range events {
+		byId[event.Id] = event
+	}
+	assert.Len(byId, 3)
+	assert.NotContains(byId, "before")
+
+	assert.True(byId["holiday"].AllDay)
+	assert.Equal(start, byId["holiday"].Start)
+	assert.Equal(start.AddDate(0, 0, 1), byId["holiday"].End)
+
+	assert.Equal(time.Date(2024, 3, 8, 9, 0, 0, 0, newYork), byId["conference"].Start)
+
+	assert.Equal(start, byId["weekly"].Start)
+	assert.Equal(start.AddDate(0, 0, 1), byId["weekly"].End)
+}
+
+func TestProcessAllDayEvent(t *testing.T) {
+	botId := "bot-id"
+	channelId := "channel-id"
+	api := plugintest.API{}
+
+	pluginT := &Plugin{
+		BotId: botId,
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+	}
+
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	pluginT.SetDB(sqlx.NewDb(db, "sqlmock"))
+
+	api.On("GetUser", "owner-id").Return(&model.User{
+		Id:       "owner-id",
+		Username: "owner",
+		Timezone: model.StringMap{"useAutomaticTimezone": "false", "manualTimezone": "Europe/Berlin"},
+	}, nil)
+	api.On("PublishWebSocketEvent", wsEventOccur, mock.Anything, mock.Anything).Return()
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == channelId
+	})).Return(nil, nil).Once()
+
+	columns := []string{"id", "title", "dt_start", "dt_end", "all_day", "owner", "channel", "member", "recurrent", "recurrence", "alert", "alert_time"}
+	date := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).
+			AddRow("holiday", "Holiday", date, date.AddDate(0, 0, 1), true, "owner-id", channelId, nil, false, "", "", nil).
+			AddRow("birthday", "Birthday", time.Date(2020, 6, 30, 0, 0, 0, 0, time.UTC), time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC), true, "owner-id", channelId, nil, true, "RRULE:FREQ=YEARLY", "", nil)
+	}
+
+	background := &Background{plugin: pluginT}
+
+	// midnight UTC is not the morning in Berlin
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce")).WillReturnRows(rows())
+	background.process(date)
+
+	// 09:00 in Berlin
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce")).WillReturnRows(rows())
+	dbMock.ExpectQuery(regexp.QuoteMeta("UPDATE calendar_events SET processed = $1 WHERE id = $2")).
+		WithArgs(date.Add(7*time.Hour), "holiday").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	background.process(date.Add(7 * time.Hour))
+
+	if err := dbMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	api.AssertExpectations(t)
+}
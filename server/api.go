@@ -8,24 +8,81 @@ import (
 
 func (p *Plugin) InitAPI() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(p.apiTokensOnlyOnAPIv1)
+
 	r.HandleFunc("/events", p.GetEvents).Methods("GET")
 	r.HandleFunc("/events/{eventId}", p.GetEvent).Methods("GET")
 	r.HandleFunc("/events/{eventId}", p.RemoveEvent).Methods("DELETE")
 	r.HandleFunc("/events", p.CreateEvent).Methods("POST")
 	r.HandleFunc("/events", p.UpdateEvent).Methods("PUT")
 
+	r.HandleFunc("/channels/{channelId}/events", p.GetChannelEvents).Methods("GET")
+	r.HandleFunc("/teams/{teamId}/events", p.GetTeamEvents).Methods("GET")
+
+	r.HandleFunc("/templates", p.GetTemplates).Methods("GET")
+	r.HandleFunc("/templates/{templateId}", p.GetTemplate).Methods("GET")
+	r.HandleFunc("/templates/{templateId}", p.RemoveTemplate).Methods("DELETE")
+	r.HandleFunc("/templates", p.CreateTemplate).Methods("POST")
+	r.HandleFunc("/templates", p.UpdateTemplate).Methods("PUT")
+
+	r.HandleFunc("/tasks", p.GetTasks).Methods("GET")
+	r.HandleFunc("/tasks/{taskId}", p.GetTaskById).Methods("GET")
+	r.HandleFunc("/tasks/{taskId}", p.RemoveTask).Methods("DELETE")
+	r.HandleFunc("/tasks", p.CreateTask).Methods("POST")
+	r.HandleFunc("/tasks", p.UpdateTask).Methods("PUT")
+
 	r.HandleFunc("/settings", p.GetSettings).Methods("GET")
 	r.HandleFunc("/settings", p.UpdateSettings).Methods("PUT")
 
 	r.HandleFunc("/schedule", p.GetSchedule).Methods("GET")
 
+	r.HandleFunc("/webhooks/deliveries", p.GetWebhookDeliveries).Methods("GET")
+
+	// two-way sync with a calendar on an external CalDAV server
+	r.HandleFunc("/external/caldav", p.GetExternalAccount).Methods("GET")
+	r.HandleFunc("/external/caldav", p.ConnectExternalAccount).Methods("PUT")
+	r.HandleFunc("/external/caldav", p.DisconnectExternalAccount).Methods("DELETE")
+
+	// Google Calendar and Microsoft 365 calendars imported with OAuth
+	r.HandleFunc("/providers", p.GetProviders).Methods("GET")
+	r.HandleFunc("/providers/{provider}/connect", p.ConnectProvider).Methods("POST")
+	r.HandleFunc("/providers/{provider}/callback", p.ProviderCallback).Methods("GET")
+	r.HandleFunc("/providers/{provider}", p.DisconnectProvider).Methods("DELETE")
+
 	// iCal token management
 	r.HandleFunc("/ical/token", p.GetICalToken).Methods("GET")
 	r.HandleFunc("/ical/token", p.GenerateICalToken).Methods("POST")
 	r.HandleFunc("/ical/token", p.RevokeICalToken).Methods("DELETE")
+	r.HandleFunc("/ical/tokens", p.GetICalTokens).Methods("GET")
+	r.HandleFunc("/ical/tokens", p.CreateICalToken).Methods("POST")
+	r.HandleFunc("/ical/tokens/{tokenId}", p.RevokeICalTokenById).Methods("DELETE")
+	r.HandleFunc("/ical/tokens/{tokenId}/access", p.GetICalTokenAccess).Methods("GET")
 	// iCal feed endpoint (token is 64-char hex string)
 	r.HandleFunc("/ical/feed/{token}", p.ServeICalFeed).Methods("GET")
 
+	// channel iCal feeds
+	r.HandleFunc("/channels/{channelId}/ical/token", p.GetChannelICalToken).Methods("GET")
+	r.HandleFunc("/channels/{channelId}/ical/token", p.GenerateChannelICalToken).Methods("POST")
+	r.HandleFunc("/channels/{channelId}/ical/token", p.RevokeChannelICalToken).Methods("DELETE")
+	r.HandleFunc("/ical/channel/{token}", p.ServeChannelICalFeed).Methods("GET")
+
+	// iMIP replies of the guests, forwarded by the mail server
+	r.HandleFunc("/imip/reply", p.HandleInvitationReply).Methods("POST")
+
+	// versioned API of scripts and bots
+	p.initAPIv1(r)
+
+	// API of the other plugins, reached with PluginHTTP
+	p.initInterPluginAPI(r)
+
+	// CalDAV discovery and the calendars of the users signed in with app passwords
+	r.HandleFunc("/.well-known/caldav", p.ServeCalDAVWellKnown)
+	r.HandleFunc("/.well-known/carddav", p.ServeCalDAVWellKnown)
+	r.HandleFunc("/caldav/", p.ServeCalDAVContext)
+	r.HandleFunc("/caldav", p.ServeCalDAVContext)
+	r.PathPrefix("/caldav/users/{username}/").HandlerFunc(p.ServeCalDAVUser)
+	r.HandleFunc("/caldav/users/{username}", p.ServeCalDAVUser)
+
 	// CalDAV endpoints (use PathPrefix for all CalDAV requests)
 	// Handle both with and without trailing slash
 	r.PathPrefix("/caldav/{token}/").HandlerFunc(p.ServeCalDAV)
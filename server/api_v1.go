@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// The scopes of the API tokens
+const (
+	ScopeEventsRead   = "events:read"
+	ScopeEventsWrite  = "events:write"
+	ScopeFreeBusyRead = "freebusy:read"
+)
+
+var apiScopes = []string{ScopeEventsRead, ScopeEventsWrite, ScopeFreeBusyRead}
+
+const rateLimitWindow = time.Minute
+
+// rateLimiter counts the requests of every token in fixed windows of rateLimitWindow
+type rateLimiter struct {
+	lock    sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// allow counts a request of key, it returns false and the time until the next window once the
+// limit is reached
+func (l *rateLimiter) allow(key string, limit int, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.windows == nil {
+		l.windows = map[string]*rateWindow{}
+	}
+	// forget the tokens of the past windows from time to time
+	if len(l.windows) > 1000 {
+		for windowKey, window := range l.windows {
+			if now.Sub(window.start) >= rateLimitWindow {
+				delete(l.windows, windowKey)
+			}
+		}
+	}
+
+	window, ok := l.windows[key]
+	if !ok || now.Sub(window.start) >= rateLimitWindow {
+		window = &rateWindow{start: now}
+		l.windows[key] = window
+	}
+	if window.count >= limit {
+		return false, window.start.Add(rateLimitWindow).Sub(now)
+	}
+	window.count++
+	return true, 0
+}
+
+// isTokenSession reports whether the session is the one of a personal access token or a bot token
+func isTokenSession(session *model.Session) bool {
+	return session.Props[model.SessionPropType] == model.SessionTypeUserAccessToken
+}
+
+// scoped serves the API requests of browser sessions and of the tokens granted the scope, counting
+// them against the rate limit
+func (p *Plugin) scoped(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pluginContext := p.FromContext(r.Context())
+		session, err := p.API.GetSession(pluginContext.SessionId)
+		if err != nil {
+			errorResponse(w, NotAuthorizedError)
+			return
+		}
+
+		key := session.UserId
+		if isTokenSession(session) {
+			key = session.Props[model.SessionPropUserAccessTokenId]
+			scopes, appErr := p.getAPITokenScopes(key)
+			if appErr != nil {
+				errorResponse(w, appErr)
+				return
+			}
+			if !contains(scopes, scope) {
+				errorResponse(w, InsufficientScope)
+				return
+			}
+		}
+
+		if limit := p.getConfiguration().APIRateLimit; limit > 0 {
+			allowed, retryAfter := p.rateLimiter.allow(key, limit, time.Now())
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				errorResponse(w, TooManyRequests)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// apiTokensOnlyOnAPIv1 rejects the requests of access tokens outside of /api/v1, only its routes
+// check the scopes of the tokens
+func (p *Plugin) apiTokensOnlyOnAPIv1(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pluginContext := p.FromContext(r.Context())
+		if pluginContext != nil && pluginContext.SessionId != "" && !strings.HasPrefix(r.URL.Path, "/api/v1/") {
+			if session, err := p.API.GetSession(pluginContext.SessionId); err == nil && isTokenSession(session) {
+				errorResponse(w, APITokenOutsideAPIv1)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// initAPIv1 routes the versioned API of scripts and bots, see docs/api/v1
+func (p *Plugin) initAPIv1(r *mux.Router) {
+	s := r.PathPrefix("/api/v1").Subrouter()
+	s.HandleFunc("/events", p.scoped(ScopeEventsRead, p.GetEvents)).Methods("GET")
+	s.HandleFunc("/events/{eventId}", p.scoped(ScopeEventsRead, p.GetEvent)).Methods("GET")
+	s.HandleFunc("/events", p.scoped(ScopeEventsWrite, p.CreateEvent)).Methods("POST")
+	s.HandleFunc("/events", p.scoped(ScopeEventsWrite, p.UpdateEvent)).Methods("PUT")
+	s.HandleFunc("/events/{eventId}", p.scoped(ScopeEventsWrite, p.RemoveEvent)).Methods("DELETE")
+	s.HandleFunc("/freebusy", p.scoped(ScopeFreeBusyRead, p.GetAvailability)).Methods("GET")
+	s.HandleFunc("/schedule", p.scoped(ScopeFreeBusyRead, p.GetSchedule)).Methods("GET")
+
+	s.HandleFunc("/tokens", p.GetAPITokens).Methods("GET")
+	s.HandleFunc("/tokens", p.CreateAPIToken).Methods("POST")
+	s.HandleFunc("/tokens/{tokenId}", p.RevokeAPIToken).Methods("DELETE")
+}
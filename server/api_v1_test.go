@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// mockUserAccessTokens enables the access tokens, test-user may create them
+func mockUserAccessTokens(api *plugintest.API, enabled bool) {
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{EnableUserAccessTokens: model.NewBool(enabled)}})
+	api.On("HasPermissionTo", "test-user", model.PermissionCreateUserAccessToken).Return(true)
+}
+
+// mockTokenSession adds the session of an access token of test-user
+func mockTokenSession(api *plugintest.API) {
+	api.On("GetSession", "token-session").Return(&model.Session{
+		UserId: "test-user",
+		Props: model.StringMap{
+			model.SessionPropType:              model.SessionTypeUserAccessToken,
+			model.SessionPropUserAccessTokenId: "token-1",
+		},
+	}, nil)
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := &rateLimiter{}
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.allow("token-1", 3, now.Add(time.Duration(i)*time.Second))
+		assert.True(allowed)
+	}
+	allowed, retryAfter := limiter.allow("token-1", 3, now.Add(20*time.Second))
+	assert.False(allowed)
+	assert.Equal(40*time.Second, retryAfter)
+
+	allowed, _ = limiter.allow("token-2", 3, now.Add(20*time.Second))
+	assert.True(allowed)
+	allowed, _ = limiter.allow("token-1", 3, now.Add(time.Minute))
+	assert.True(allowed)
+}
+
+func TestScoped_InsufficientScope(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/api/v1/freebusy"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	mockTokenSession(api)
+	calPlugin.setConfiguration(&configuration{})
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT scopes FROM calendar_api_tokens WHERE token_id = $1")).
+		WithArgs("token-1").
+		WillReturnRows(sqlmock.NewRows([]string{"scopes"}).AddRow(`["events:read"]`))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "token-session"}, w, r)
+
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestAPITokenOnLegacyRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	// the token is granted events:read, the routes of the webapp don't check scopes
+	path := "/events"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodDelete, path+"/event-1")
+	defer closeDB()
+	mockTokenSession(api)
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, path},
+		{http.MethodDelete, path + "/event-1"},
+		{http.MethodPost, "/ical/tokens"},
+	} {
+		api.On("LogDebug", "Plugin HTTP request", "method", route.method, "path", route.path, "user-agent", "").Return().Maybe()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(route.method, route.path, nil)
+		calPlugin.ServeHTTP(&plugin.Context{SessionId: "token-session"}, w, r)
+		assert.Equal(http.StatusForbidden, w.Code, route.path)
+	}
+
+	// a browser session still can
+	api.On("LogDebug", "Plugin HTTP request", "method", http.MethodGet, "path", "/ical/token", "user-agent", "").Return()
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_ical_tokens")).
+		WillReturnRows(sqlmock.NewRows(icalTokenColumns))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/ical/token", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestScoped_RateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/api/v1/freebusy"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	mockTokenSession(api)
+	calPlugin.setConfiguration(&configuration{APIRateLimit: 1})
+
+	for i := 0; i < 2; i++ {
+		dbMock.ExpectQuery(regexp.QuoteMeta("SELECT scopes FROM calendar_api_tokens WHERE token_id = $1")).
+			WithArgs("token-1").
+			WillReturnRows(sqlmock.NewRows([]string{"scopes"}).AddRow(`["freebusy:read"]`))
+	}
+
+	// the first request reaches the handler, which rejects the missing range
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "token-session"}, w, r)
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "token-session"}, w, r)
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(w.Header().Get("Retry-After"))
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCreateAPIToken(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/api/v1/tokens"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, path)
+	defer closeDB()
+	mockUserAccessTokens(api, true)
+	api.On("GetBot", "bot-1", false).Return(&model.Bot{UserId: "bot-1", OwnerId: "test-user"}, nil)
+	api.On("CreateUserAccessToken", &model.UserAccessToken{UserId: "bot-1", Description: "Calendar: CI"}).
+		Return(&model.UserAccessToken{Id: "token-1", Token: "secret-token", UserId: "bot-1"}, nil)
+
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_api_tokens (token_id,user_id,created_by,description,scopes,created) VALUES ($1,$2,$3,$4,$5,$6)")).
+		WithArgs("token-1", "bot-1", "test-user", "CI", `["events:read","events:write"]`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"user_id":"bot-1","description":"CI","scopes":["events:read","events:write"]}`))
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"token":"secret-token"`)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCreateAPIToken_Invalid(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/api/v1/tokens"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, path)
+	defer closeDB()
+	mockTokenSession(api)
+	mockUserAccessTokens(api, true)
+	api.On("GetBot", "bot-2", false).Return(&model.Bot{UserId: "bot-2", OwnerId: "other-user"}, nil)
+	api.On("HasPermissionTo", "test-user", model.PermissionManageSystem).Return(false)
+
+	for _, test := range []struct {
+		session string
+		body    string
+		code    int
+	}{
+		{"token-session", `{"scopes":["events:read"]}`, http.StatusUnauthorized},
+		{"session-id", `{"scopes":[]}`, http.StatusBadRequest},
+		{"session-id", `{"scopes":["events:delete"]}`, http.StatusBadRequest},
+		{"session-id", `{"user_id":"bot-2","scopes":["events:read"]}`, http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(test.body))
+		calPlugin.ServeHTTP(&plugin.Context{SessionId: test.session}, w, r)
+		assert.Equal(test.code, w.Code, test.body)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCreateAPIToken_NotAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/api/v1/tokens"
+	body := `{"description":"CI","scopes":["events:read"]}`
+
+	// access tokens disabled in the System Console
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, path)
+	defer closeDB()
+	mockUserAccessTokens(api, false)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	// the user doesn't have the permission to create access tokens
+	calPlugin, api, dbMock, closeDB = newTemplateTestPlugin(t, http.MethodPost, path)
+	defer closeDB()
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{EnableUserAccessTokens: model.NewBool(true)}})
+	api.On("HasPermissionTo", "test-user", model.PermissionCreateUserAccessToken).Return(false)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	api.AssertNotCalled(t, "CreateUserAccessToken", mock.Anything)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRevokeAPIToken(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/api/v1/tokens/token-1"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodDelete, path)
+	defer closeDB()
+	api.On("RevokeUserAccessToken", "token-1").Return(nil)
+
+	deleteSql := regexp.QuoteMeta("DELETE FROM calendar_api_tokens WHERE created_by = $1 AND token_id = $2")
+	dbMock.ExpectExec(deleteSql).
+		WithArgs("test-user", "token-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(deleteSql).
+		WithArgs("test-user", "token-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodDelete, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	api.AssertNumberOfCalls(t, "RevokeUserAccessToken", 1)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// APIToken is a Mattermost personal access token or bot token granted scopes of the calendar API
+type APIToken struct {
+	Id          string     `json:"id" db:"token_id"`
+	UserId      string     `json:"user_id" db:"user_id"`
+	CreatedBy   string     `json:"created_by" db:"created_by"`
+	Description string     `json:"description" db:"description"`
+	Scopes      StringList `json:"scopes" db:"scopes"`
+	Created     time.Time  `json:"created" db:"created"`
+
+	// Token is only returned when the token is created
+	Token string `json:"token,omitempty" db:"-"`
+}
+
+var apiTokenColumns = []string{
+	"token_id",
+	"user_id",
+	"created_by",
+	"description",
+	"scopes",
+	"created",
+}
+
+// CreateAPITokenRequest is the body of a new token, for the user or one of their bots
+type CreateAPITokenRequest struct {
+	UserId      string   `json:"user_id"`
+	Description string   `json:"description"`
+	Scopes      []string `json:"scopes"`
+}
+
+// getAPITokenScopes returns the scopes granted to the token, none when it wasn't created by the plugin
+func (p *Plugin) getAPITokenScopes(tokenId string) ([]string, *model.AppError) {
+	queryBuilder := sq.Select("scopes").
+		From("calendar_api_tokens").
+		Where(sq.Eq{"token_id": tokenId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	var scopes StringList
+	if errSelect := p.DB.Get(&scopes, querySql, args...); errSelect != nil {
+		if errors.Is(errSelect, sql.ErrNoRows) {
+			return nil, nil
+		}
+		p.API.LogError("getAPITokenScopes: " + errSelect.Error())
+		return nil, SomethingWentWrong
+	}
+	return scopes, nil
+}
+
+// browserSessionUser returns the user of the request, tokens can't manage tokens
+func (p *Plugin) browserSessionUser(r *http.Request) (*model.User, *model.AppError) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil || isTokenSession(session) {
+		return nil, NotAuthorizedError
+	}
+
+	user, err := p.API.GetUser(session.UserId)
+	if err != nil {
+		p.API.LogError("can't get user")
+		return nil, UserNotFound
+	}
+	return user, nil
+}
+
+// GetAPITokens returns the tokens the user created
+func (p *Plugin) GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.browserSessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	queryBuilder := sq.Select(apiTokenColumns...).
+		From("calendar_api_tokens").
+		Where(sq.Eq{"created_by": user.Id}).
+		OrderBy("created").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	tokens := []APIToken{}
+	if errSelect := p.DB.Select(&tokens, querySql, args...); errSelect != nil {
+		p.API.LogError(errSelect.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	apiResponse(w, &tokens)
+}
+
+// CreateAPIToken creates a Mattermost access token of the user or of a bot they own, granted the
+// scopes. The token is only returned now.
+func (p *Plugin) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.browserSessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	// the same checks as the token page of Mattermost
+	enabled := p.API.GetConfig().ServiceSettings.EnableUserAccessTokens
+	if enabled == nil || !*enabled || !p.API.HasPermissionTo(user.Id, model.PermissionCreateUserAccessToken) {
+		errorResponse(w, CantCreateAPIToken)
+		return
+	}
+
+	var request CreateAPITokenRequest
+	if errDecode := json.NewDecoder(r.Body).Decode(&request); errDecode != nil {
+		p.API.LogError(errDecode.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	if len(request.Scopes) == 0 || len(request.Description) > 200 {
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+	for _, scope := range request.Scopes {
+		if !contains(apiScopes, scope) {
+			errorResponse(w, InvalidRequestParams)
+			return
+		}
+	}
+
+	tokenUserId := user.Id
+	if request.UserId != "" && request.UserId != user.Id {
+		bot, err := p.API.GetBot(request.UserId, false)
+		if err != nil {
+			errorResponse(w, UserNotFound)
+			return
+		}
+		if bot.OwnerId != user.Id && !p.API.HasPermissionTo(user.Id, model.PermissionManageSystem) {
+			errorResponse(w, NotAuthorizedError)
+			return
+		}
+		tokenUserId = bot.UserId
+	}
+
+	accessToken, err := p.API.CreateUserAccessToken(&model.UserAccessToken{
+		UserId:      tokenUserId,
+		Description: "Calendar: " + request.Description,
+	})
+	if err != nil {
+		p.API.LogError("CreateAPIToken: " + err.Error())
+		errorResponse(w, err)
+		return
+	}
+
+	token := APIToken{
+		Id:          accessToken.Id,
+		UserId:      tokenUserId,
+		CreatedBy:   user.Id,
+		Description: request.Description,
+		Scopes:      request.Scopes,
+		Created:     time.Now().UTC().Truncate(time.Second),
+	}
+
+	insertBuilder := sq.Insert("calendar_api_tokens").
+		Columns(apiTokenColumns...).
+		Values(token.Id, token.UserId, token.CreatedBy, token.Description, token.Scopes, token.Created).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	insertSql, insertArgs, _ := insertBuilder.ToSql()
+
+	if _, errInsert := p.DB.Exec(insertSql, insertArgs...); errInsert != nil {
+		p.API.LogError("CreateAPIToken: can't save token: " + errInsert.Error())
+		_ = p.API.RevokeUserAccessToken(accessToken.Id)
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	token.Token = accessToken.Token
+	apiResponse(w, &token)
+}
+
+// RevokeAPIToken revokes a token the user created
+func (p *Plugin) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.browserSessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+	tokenId := mux.Vars(r)["tokenId"]
+
+	deleteBuilder := sq.Delete("calendar_api_tokens").
+		Where(sq.Eq{"token_id": tokenId, "created_by": user.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
+
+	result, errDelete := p.DB.Exec(deleteSql, deleteArgs...)
+	if errDelete != nil {
+		p.API.LogError("RevokeAPIToken: " + errDelete.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		errorResponse(w, APITokenNotFound)
+		return
+	}
+
+	// the token may already be revoked in the profile of the user
+	if err := p.API.RevokeUserAccessToken(tokenId); err != nil {
+		p.API.LogWarn("Can't revoke access token", "token", tokenId, "error", err.Error())
+	}
+
+	apiResponse(w, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -6,7 +6,6 @@ import (
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/mattermost/mattermost-server/v6/model"
-	"github.com/teambition/rrule-go"
 )
 
 const wsEventOccur = "event_occur"
@@ -15,19 +14,69 @@ type Background struct {
 	Ticker *time.Ticker
 	Done   chan bool
 	plugin *Plugin
+
+	// Deliveries drives webhook and e-mail delivery and the account syncs,
+	// which block on the network and must never delay the reminder ticker
+	Deliveries *time.Ticker
+
+	widgetsRefreshed time.Time
+	pruned           time.Time
 }
 
 func (b *Background) Start() {
+	stop := make(chan struct{})
+	defer close(stop)
+	go b.deliver(stop)
+
 	for {
 		select {
 		case <-b.Done:
 			return
 		case t := <-b.Ticker.C:
 			b.process(t)
+			b.refreshWidgets(t)
+			b.plugin.remindDueTasks(t.In(time.UTC))
 		}
 	}
 }
 
+// deliver runs the outgoing deliveries and syncs on their own ticker until stop is closed
+func (b *Background) deliver(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case t := <-b.Deliveries.C:
+			b.plugin.deliverWebhooks(t.In(time.UTC))
+			b.plugin.deliverGuestMessages(t.In(time.UTC))
+			b.plugin.syncExternalAccounts(t.In(time.UTC))
+			b.plugin.syncProviderAccounts(t.In(time.UTC))
+			b.prune(t.In(time.UTC))
+		}
+	}
+}
+
+// refreshWidgets brings the channel widgets up to date once a minute
+func (b *Background) refreshWidgets(t time.Time) {
+	minute := t.In(time.UTC).Truncate(time.Minute)
+	if minute.Equal(b.widgetsRefreshed) {
+		return
+	}
+	b.widgetsRefreshed = minute
+	b.plugin.refreshChannelWidgets(t.In(time.UTC))
+}
+
+// prune prunes the CalDAV change log and the webhook and invitation queues once every syncChangesPruneEvery
+func (b *Background) prune(t time.Time) {
+	if t.Sub(b.pruned) < syncChangesPruneEvery {
+		return
+	}
+	b.pruned = t
+	b.plugin.pruneSyncChanges(t)
+	b.plugin.pruneWebhookDeliveries(t)
+	b.plugin.pruneGuestMessages(t)
+}
+
 func (b *Background) Stop() {
 	b.Done <- true
 }
@@ -131,41 +180,14 @@ func (b *Background) process(t time.Time) {
 		time.UTC,
 	)
 
-	// different queries for different databases because of different time format
-	var recurrentTimeQuery sq.And
-	switch b.plugin.DB.DriverName() {
-	case POSTGRES:
-		recurrentTimeQuery = sq.And{
-			sq.Eq{"ce.recurrent": true},
-			sq.Or{
-				sq.Eq{"ce.dt_start::time": tickWithZone},
-				sq.Eq{"ce.alert_time::time": tickWithZone},
-			},
-		}
-	case MYSQL:
-		recurrentTimeQuery = sq.And{
-			sq.Eq{"ce.recurrent": true},
-			sq.Or{
-				sq.Eq{"TIME(ce.dt_start)": tickWithZone},
-				sq.Eq{"TIME(ce.alert_time)": tickWithZone},
-			},
-		}
-	default:
-		recurrentTimeQuery = sq.And{
-			sq.Eq{"ce.recurrent": true},
-			sq.Or{
-				sq.Eq{"ce.dt_start::time": tickWithZone},
-				sq.Eq{"ce.alert_time::time": tickWithZone},
-			},
-		}
-	}
-
 	queryBuilder := sq.Select().
 		Columns(
 			"ce.id",
 			"ce.title",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -183,9 +205,31 @@ func (b *Background) process(t time.Time) {
 		LeftJoin("calendar_members cm ON ce.id = cm.event").
 		Where(sq.And{
 			sq.Or{
-				sq.Eq{"ce.dt_start": tickWithZone},
-				sq.Eq{"ce.alert_time": tickWithZone},
-				recurrentTimeQuery,
+				sq.And{
+					sq.Eq{"ce.all_day": false},
+					// recurrent events keep their wall-clock time across DST changes, only the
+					// ones due to notify are expanded below
+					sq.Or{
+						sq.Eq{"ce.dt_start": tickWithZone},
+						sq.Eq{"ce.alert_time": tickWithZone},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.LtOrEq{"ce.next_notification": tickWithZone},
+						},
+					},
+				},
+				// all-day events are notified in the morning of the owner's timezone, their
+				// notification and alert times are computed for the candidates below
+				sq.And{
+					sq.Eq{"ce.all_day": true},
+					sq.Or{
+						sq.And{
+							sq.GtOrEq{"ce.dt_start": tickWithZone.Add(-allDayMargin)},
+							sq.LtOrEq{"ce.dt_start": tickWithZone.Add(allDayMargin + EventAlertDurationMap[EventAlert1WeekBefore])},
+						},
+						recurringSince(tickWithZone.Add(-allDayMargin)),
+					},
+				},
 			},
 			sq.Or{
 				sq.Eq{"ce.processed": nil},
@@ -213,6 +257,9 @@ func (b *Background) process(t time.Time) {
 		User *string `json:"user" db:"member"`
 	}
 	events := map[string]*Event{}
+	ownerLocations := map[string]*time.Location{}
+	// the next notification of the recurrent events checked at this tick
+	nextNotifications := map[string]*time.Time{}
 
 	for rows.Next() {
 		var eventDb EventFromDb
@@ -226,63 +273,16 @@ func (b *Background) process(t time.Time) {
 		if events[eventDb.Id] != nil && eventDb.User != nil {
 			events[eventDb.Id].Attendees = append(events[eventDb.Id].Attendees, *eventDb.User)
 		} else {
-			if eventDb.Recurrent {
-				eventRule, errRrule := rrule.StrToRRule(eventDb.Recurrence)
-				if errRrule != nil {
-					b.plugin.API.LogError(errRrule.Error())
+			if eventDb.AllDay {
+				if !b.allDayOccurs(&eventDb.Event, tickWithZone, ownerLocations) {
 					continue
 				}
-				eventTime := eventDb.End.Sub(eventDb.Start)
-				eventEnd := tickWithZone.Add(eventTime)
-				eventRule.DTStart(time.Date(
-					eventDb.Start.Year(),
-					eventDb.Start.Month(),
-					eventDb.Start.Day(),
-					0,
-					0,
-					0,
-					0,
-					time.UTC,
-				))
-				eventDates := eventRule.Between(
-					time.Date(
-						tickWithZone.Year(),
-						tickWithZone.Month(),
-						tickWithZone.Day(),
-						0,
-						0,
-						0,
-						0,
-						time.UTC,
-					),
-					eventEnd,
-					true)
-				// Skip this event if recurrent event doesn't exist between two dates
-				if len(eventDates) < 1 {
-					continue
+			} else if eventDb.Recurrent {
+				if _, ok := nextNotifications[eventDb.Id]; !ok {
+					nextNotifications[eventDb.Id] = nextNotification(&eventDb.Event, tickWithZone.Add(time.Minute))
 				}
-				recEventTime := eventDb.End.Sub(eventDb.Start)
-				eventDb.Start = time.Date(
-					tickWithZone.Year(),
-					tickWithZone.Month(),
-					tickWithZone.Day(),
-					eventDb.Start.Hour(),
-					eventDb.Start.Minute(),
-					eventDb.Start.Second(),
-					eventDb.Start.Nanosecond(),
-					eventDb.Start.Location(),
-				)
-
-				eventDb.End = eventDb.Start.Add(recEventTime)
-
-				//	calc alert time for recurrent event with alert name
-				if eventDb.Alert != EventAlertNone {
-					alertDuration, ok := EventAlertDurationMap[eventDb.Alert]
-					if !ok {
-						alertDuration = 0
-					}
-					alertTime := eventDb.Start.Add(-1 * alertDuration)
-					eventDb.AlertTime = &alertTime
+				if !b.recurrenceOccurs(&eventDb.Event, tickWithZone) {
+					continue
 				}
 			}
 
@@ -295,6 +295,8 @@ func (b *Background) process(t time.Time) {
 				Title:       eventDb.Title,
 				Start:       eventDb.Start,
 				End:         eventDb.End,
+				AllDay:      eventDb.AllDay,
+				Timezone:    eventDb.Timezone,
 				Attendees:   att,
 				Created:     eventDb.Created,
 				Owner:       eventDb.Owner,
@@ -314,6 +316,11 @@ func (b *Background) process(t time.Time) {
 	// send notifications, create posts and update processed field
 	for _, value := range events {
 		b.sendWsNotification(value, tickWithZone)
+		if value.AlertTime != nil && value.AlertTime.Equal(tickWithZone) {
+			b.plugin.enqueueWebhook(WebhookEventReminder, value)
+		} else {
+			b.plugin.enqueueWebhook(WebhookEventStarted, value)
+		}
 		if value.Channel != nil {
 			postModel := &model.Post{
 				ChannelId: *value.Channel,
@@ -350,6 +357,87 @@ func (b *Background) process(t time.Time) {
 
 	}
 
+	for id, next := range nextNotifications {
+		updateBuilder := sq.Update("calendar_events").
+			Set("next_notification", next).
+			Where(sq.Eq{"id": id}).
+			PlaceholderFormat(b.plugin.GetDBPlaceholderFormat())
+		updateSql, updateArgs, _ := updateBuilder.ToSql()
+
+		if _, errUpdate := b.plugin.DB.Exec(updateSql, updateArgs...); errUpdate != nil {
+			b.plugin.API.LogError(errUpdate.Error())
+		}
+	}
+}
+
+// allDayOccurs reports whether the all-day event is notified at the tick, in the morning of one of
+// its dates or at its alert before, and moves the event to that date
+func (b *Background) allDayOccurs(event *Event, tick time.Time, ownerLocations map[string]*time.Location) bool {
+	loc, ok := ownerLocations[event.Owner]
+	if !ok {
+		loc = time.UTC
+		if owner, err := b.plugin.API.GetUser(event.Owner); err == nil {
+			loc = b.plugin.GetUserLocation(owner)
+		} else {
+			b.plugin.API.LogError(err.Error())
+		}
+		ownerLocations[event.Owner] = loc
+	}
+
+	days := allDayDays(event)
+	dates := []time.Time{allDayDate(event.Start)}
+	if event.Recurrent {
+		var errRrule error
+		dates, errRrule = b.plugin.recurrences.Occurrences(
+			event,
+			time.UTC,
+			allDayDate(tick).Add(-allDayMargin),
+			allDayDate(tick).Add(allDayMargin+EventAlertDurationMap[EventAlert1WeekBefore]),
+		)
+		if errRrule != nil {
+			b.plugin.API.LogError(errRrule.Error())
+			return false
+		}
+	}
+
+	for _, date := range dates {
+		alertTime := allDayAlertTime(date, event.Alert, loc)
+		if !allDayNotifyTime(date, loc).Equal(tick) && (alertTime == nil || !alertTime.Equal(tick)) {
+			continue
+		}
+		event.Start = allDayInLocation(date, loc)
+		event.End = event.Start.AddDate(0, 0, days)
+		event.AlertTime = alertTime
+		return true
+	}
+	return false
+}
+
+// recurrenceOccurs reports whether an occurrence of the recurrent event starts at the tick or has
+// its alert then, and moves the event to that occurrence.
+func (b *Background) recurrenceOccurs(event *Event, tick time.Time) bool {
+	alertDuration := EventAlertDurationMap[event.Alert]
+	occurrences, errRrule := b.plugin.recurrences.Occurrences(event, eventLocation(event), tick, tick.Add(alertDuration))
+	if errRrule != nil {
+		b.plugin.API.LogError(errRrule.Error())
+		return false
+	}
+
+	eventTime := event.End.Sub(event.Start)
+	for _, occurrence := range occurrences {
+		alertTime := occurrence.Add(-alertDuration)
+		if !occurrence.Equal(tick) && (event.Alert == EventAlertNone || !alertTime.Equal(tick)) {
+			continue
+		}
+		event.Start = occurrence
+		event.End = occurrence.Add(eventTime)
+		event.AlertTime = nil
+		if event.Alert != EventAlertNone {
+			event.AlertTime = &alertTime
+		}
+		return true
+	}
+	return false
 }
 
 func (b *Background) sendWsNotification(event *Event, processTime time.Time) {
@@ -392,9 +480,10 @@ var bgJob *Background
 func NewBackgroundJob(plugin *Plugin) *Background {
 	if bgJob == nil {
 		bgJob = &Background{
-			Ticker: time.NewTicker(15 * time.Second),
-			Done:   make(chan bool),
-			plugin: plugin,
+			Ticker:     time.NewTicker(15 * time.Second),
+			Done:       make(chan bool),
+			plugin:     plugin,
+			Deliveries: time.NewTicker(15 * time.Second),
 		}
 	}
 	return bgJob
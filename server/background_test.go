@@ -214,19 +214,14 @@ func TestProcessEventWithChannel(t *testing.T) {
 
 	postForSendChannel.SetProps(background.getMessageProps(testEvent, time.Now()))
 
-	recurrentTimeQuery := sq.And{
-		sq.Eq{"ce.recurrent": true},
-		sq.Or{
-			sq.Eq{"ce.dt_start::time": sqlQueryTime},
-			sq.Eq{"ce.alert_time::time": sqlQueryTime},
-		},
-	}
 	queryBuilder := sq.Select().
 		Columns(
 			"ce.id",
 			"ce.title",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -244,9 +239,33 @@ func TestProcessEventWithChannel(t *testing.T) {
 		LeftJoin("calendar_members cm ON ce.id = cm.event").
 		Where(sq.And{
 			sq.Or{
-				sq.Eq{"ce.dt_start": sqlQueryTime},
-				sq.Eq{"ce.alert_time": sqlQueryTime},
-				recurrentTimeQuery,
+				sq.And{
+					sq.Eq{"ce.all_day": false},
+					sq.Or{
+						sq.Eq{"ce.dt_start": sqlQueryTime},
+						sq.Eq{"ce.alert_time": sqlQueryTime},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.LtOrEq{"ce.next_notification": sqlQueryTime},
+						},
+					},
+				},
+				sq.And{
+					sq.Eq{"ce.all_day": true},
+					sq.Or{
+						sq.And{
+							sq.GtOrEq{"ce.dt_start": sqlQueryTime.Add(-24 * time.Hour)},
+							sq.LtOrEq{"ce.dt_start": sqlQueryTime.Add(8 * 24 * time.Hour)},
+						},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.Or{
+								sq.Eq{"ce.recurrence_end": nil},
+								sq.GtOrEq{"ce.recurrence_end": sqlQueryTime.Add(-24 * time.Hour)},
+							},
+						},
+					},
+				},
 			},
 			sq.Or{
 				sq.Eq{"ce.processed": nil},
@@ -257,7 +276,8 @@ func TestProcessEventWithChannel(t *testing.T) {
 
 	querySql, _, _ := queryBuilder.ToSql()
 	expectedQuery := dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(sqlQueryTime, sqlQueryTime, true, sqlQueryTime, sqlQueryTime, sqlQueryTime)
+		WithArgs(false, sqlQueryTime, sqlQueryTime, true, sqlQueryTime,
+			true, sqlQueryTime.Add(-24*time.Hour), sqlQueryTime.Add(8*24*time.Hour), true, sqlQueryTime.Add(-24*time.Hour), sqlQueryTime)
 
 	eventsRow := sqlmock.NewRows([]string{
 		"id",
@@ -337,26 +357,18 @@ func TestProcessEventWithChannelRecurrent(t *testing.T) {
 
 	featureTime := sqlQueryTime.Add(time.Hour * 24 * 4)
 
+	// the occurrences are matched against the tick by their time of day
 	recurrentEventTimeStart := time.Date(
 		2023,
 		time.February,
 		26,
-		21,
-		0,
-		0,
-		0,
-		time.UTC,
-	)
-	recurrentEventTimeEnd := time.Date(
-		2023,
-		time.February,
-		26,
-		22,
-		0,
+		sqlQueryTime.Hour(),
+		sqlQueryTime.Minute(),
 		0,
 		0,
 		time.UTC,
 	)
+	recurrentEventTimeEnd := recurrentEventTimeStart.Add(time.Hour)
 
 	postForSendChannel := &model.Post{
 		UserId:    botId,
@@ -402,19 +414,14 @@ func TestProcessEventWithChannelRecurrent(t *testing.T) {
 
 	postForSendChannel.SetProps(background.getMessageProps(testEvent, time.Now()))
 
-	recurrentTimeQuery := sq.And{
-		sq.Eq{"ce.recurrent": true},
-		sq.Or{
-			sq.Eq{"ce.dt_start::time": sqlQueryTime},
-			sq.Eq{"ce.alert_time::time": sqlQueryTime},
-		},
-	}
 	queryBuilder := sq.Select().
 		Columns(
 			"ce.id",
 			"ce.title",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -432,9 +439,33 @@ func TestProcessEventWithChannelRecurrent(t *testing.T) {
 		LeftJoin("calendar_members cm ON ce.id = cm.event").
 		Where(sq.And{
 			sq.Or{
-				sq.Eq{"ce.dt_start": sqlQueryTime},
-				sq.Eq{"ce.alert_time": sqlQueryTime},
-				recurrentTimeQuery,
+				sq.And{
+					sq.Eq{"ce.all_day": false},
+					sq.Or{
+						sq.Eq{"ce.dt_start": sqlQueryTime},
+						sq.Eq{"ce.alert_time": sqlQueryTime},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.LtOrEq{"ce.next_notification": sqlQueryTime},
+						},
+					},
+				},
+				sq.And{
+					sq.Eq{"ce.all_day": true},
+					sq.Or{
+						sq.And{
+							sq.GtOrEq{"ce.dt_start": sqlQueryTime.Add(-24 * time.Hour)},
+							sq.LtOrEq{"ce.dt_start": sqlQueryTime.Add(8 * 24 * time.Hour)},
+						},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.Or{
+								sq.Eq{"ce.recurrence_end": nil},
+								sq.GtOrEq{"ce.recurrence_end": sqlQueryTime.Add(-24 * time.Hour)},
+							},
+						},
+					},
+				},
 			},
 			sq.Or{
 				sq.Eq{"ce.processed": nil},
@@ -445,7 +476,8 @@ func TestProcessEventWithChannelRecurrent(t *testing.T) {
 
 	querySql, _, _ := queryBuilder.ToSql()
 	expectedQuery := dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(sqlQueryTime, sqlQueryTime, true, sqlQueryTime, sqlQueryTime, sqlQueryTime)
+		WithArgs(false, sqlQueryTime, sqlQueryTime, true, sqlQueryTime,
+			true, sqlQueryTime.Add(-24*time.Hour), sqlQueryTime.Add(8*24*time.Hour), true, sqlQueryTime.Add(-24*time.Hour), sqlQueryTime)
 
 	eventsRow := sqlmock.NewRows([]string{
 		"id",
@@ -479,6 +511,10 @@ func TestProcessEventWithChannelRecurrent(t *testing.T) {
 	updateSql, _, _ := updateBuilder.ToSql()
 	expectedQueryUpdate := dbMock.ExpectQuery(regexp.QuoteMeta(updateSql)).WithArgs(sqlQueryTime, "rec-ev")
 	expectedQueryUpdate.WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("rec-ev"))
+	// the next occurrence is checked tomorrow
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET next_notification = $1 WHERE id = $2")).
+		WithArgs(sqlQueryTime.Add(24*time.Hour), "rec-ev").
+		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	background.process(processingTime)
 	if err := dbMock.ExpectationsWereMet(); err != nil {
@@ -589,19 +625,14 @@ func TestProcessCornerEventWithChannelRecurrent(t *testing.T) {
 
 	postForSendChannel.SetProps(background.getMessageProps(testEvent, time.Now()))
 
-	recurrentTimeQuery := sq.And{
-		sq.Eq{"ce.recurrent": true},
-		sq.Or{
-			sq.Eq{"ce.dt_start::time": sqlQueryTime},
-			sq.Eq{"ce.alert_time::time": sqlQueryTime},
-		},
-	}
 	queryBuilder := sq.Select().
 		Columns(
 			"ce.id",
 			"ce.title",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -619,9 +650,33 @@ func TestProcessCornerEventWithChannelRecurrent(t *testing.T) {
 		LeftJoin("calendar_members cm ON ce.id = cm.event").
 		Where(sq.And{
 			sq.Or{
-				sq.Eq{"ce.dt_start": sqlQueryTime},
-				sq.Eq{"ce.alert_time": sqlQueryTime},
-				recurrentTimeQuery,
+				sq.And{
+					sq.Eq{"ce.all_day": false},
+					sq.Or{
+						sq.Eq{"ce.dt_start": sqlQueryTime},
+						sq.Eq{"ce.alert_time": sqlQueryTime},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.LtOrEq{"ce.next_notification": sqlQueryTime},
+						},
+					},
+				},
+				sq.And{
+					sq.Eq{"ce.all_day": true},
+					sq.Or{
+						sq.And{
+							sq.GtOrEq{"ce.dt_start": sqlQueryTime.Add(-24 * time.Hour)},
+							sq.LtOrEq{"ce.dt_start": sqlQueryTime.Add(8 * 24 * time.Hour)},
+						},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.Or{
+								sq.Eq{"ce.recurrence_end": nil},
+								sq.GtOrEq{"ce.recurrence_end": sqlQueryTime.Add(-24 * time.Hour)},
+							},
+						},
+					},
+				},
 			},
 			sq.Or{
 				sq.Eq{"ce.processed": nil},
@@ -632,7 +687,8 @@ func TestProcessCornerEventWithChannelRecurrent(t *testing.T) {
 
 	querySql, _, _ := queryBuilder.ToSql()
 	expectedQuery := dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(sqlQueryTime, sqlQueryTime, true, sqlQueryTime, sqlQueryTime, sqlQueryTime)
+		WithArgs(false, sqlQueryTime, sqlQueryTime, true, sqlQueryTime,
+			true, sqlQueryTime.Add(-24*time.Hour), sqlQueryTime.Add(8*24*time.Hour), true, sqlQueryTime.Add(-24*time.Hour), sqlQueryTime)
 
 	eventsRow := sqlmock.NewRows([]string{
 		"id",
@@ -666,6 +722,9 @@ func TestProcessCornerEventWithChannelRecurrent(t *testing.T) {
 	updateSql, _, _ := updateBuilder.ToSql()
 	dbMock.ExpectQuery(regexp.QuoteMeta(updateSql)).WithArgs(sqlQueryTime, "rec-ev").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("rec-ev"))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET next_notification = $1 WHERE id = $2")).
+		WithArgs(sqlQueryTime.Add(24*time.Hour), "rec-ev").
+		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	background.process(processingTime)
 
@@ -759,19 +818,14 @@ func TestProcessEventWithoutChannel(t *testing.T) {
 
 	api.On("CreatePost", postForSendGroup).Return(nil, nil)
 
-	recurrentTimeQuery := sq.And{
-		sq.Eq{"ce.recurrent": true},
-		sq.Or{
-			sq.Eq{"ce.dt_start::time": sqlQueryTime},
-			sq.Eq{"ce.alert_time::time": sqlQueryTime},
-		},
-	}
 	queryBuilder := sq.Select().
 		Columns(
 			"ce.id",
 			"ce.title",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -789,9 +843,33 @@ func TestProcessEventWithoutChannel(t *testing.T) {
 		LeftJoin("calendar_members cm ON ce.id = cm.event").
 		Where(sq.And{
 			sq.Or{
-				sq.Eq{"ce.dt_start": sqlQueryTime},
-				sq.Eq{"ce.alert_time": sqlQueryTime},
-				recurrentTimeQuery,
+				sq.And{
+					sq.Eq{"ce.all_day": false},
+					sq.Or{
+						sq.Eq{"ce.dt_start": sqlQueryTime},
+						sq.Eq{"ce.alert_time": sqlQueryTime},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.LtOrEq{"ce.next_notification": sqlQueryTime},
+						},
+					},
+				},
+				sq.And{
+					sq.Eq{"ce.all_day": true},
+					sq.Or{
+						sq.And{
+							sq.GtOrEq{"ce.dt_start": sqlQueryTime.Add(-24 * time.Hour)},
+							sq.LtOrEq{"ce.dt_start": sqlQueryTime.Add(8 * 24 * time.Hour)},
+						},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.Or{
+								sq.Eq{"ce.recurrence_end": nil},
+								sq.GtOrEq{"ce.recurrence_end": sqlQueryTime.Add(-24 * time.Hour)},
+							},
+						},
+					},
+				},
 			},
 			sq.Or{
 				sq.Eq{"ce.processed": nil},
@@ -803,11 +881,16 @@ func TestProcessEventWithoutChannel(t *testing.T) {
 	querySql, _, _ := queryBuilder.ToSql()
 	expectedQuery := dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
 		WithArgs(
+			false,
 			sqlQueryTime,
 			sqlQueryTime,
 			true,
 			sqlQueryTime,
-			sqlQueryTime,
+			true,
+			sqlQueryTime.Add(-24*time.Hour),
+			sqlQueryTime.Add(8*24*time.Hour),
+			true,
+			sqlQueryTime.Add(-24*time.Hour),
 			sqlQueryTime,
 		)
 
@@ -941,19 +1024,14 @@ func TestProcessEventWithChannelRecurrentNotDay(t *testing.T) {
 
 	postForSendChannel.SetProps(background.getMessageProps(testEvent, time.Now()))
 
-	recurrentTimeQuery := sq.And{
-		sq.Eq{"ce.recurrent": true},
-		sq.Or{
-			sq.Eq{"ce.dt_start::time": sqlQueryTime},
-			sq.Eq{"ce.alert_time::time": sqlQueryTime},
-		},
-	}
 	queryBuilder := sq.Select().
 		Columns(
 			"ce.id",
 			"ce.title",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -971,9 +1049,33 @@ func TestProcessEventWithChannelRecurrentNotDay(t *testing.T) {
 		LeftJoin("calendar_members cm ON ce.id = cm.event").
 		Where(sq.And{
 			sq.Or{
-				sq.Eq{"ce.dt_start": sqlQueryTime},
-				sq.Eq{"ce.alert_time": sqlQueryTime},
-				recurrentTimeQuery,
+				sq.And{
+					sq.Eq{"ce.all_day": false},
+					sq.Or{
+						sq.Eq{"ce.dt_start": sqlQueryTime},
+						sq.Eq{"ce.alert_time": sqlQueryTime},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.LtOrEq{"ce.next_notification": sqlQueryTime},
+						},
+					},
+				},
+				sq.And{
+					sq.Eq{"ce.all_day": true},
+					sq.Or{
+						sq.And{
+							sq.GtOrEq{"ce.dt_start": sqlQueryTime.Add(-24 * time.Hour)},
+							sq.LtOrEq{"ce.dt_start": sqlQueryTime.Add(8 * 24 * time.Hour)},
+						},
+						sq.And{
+							sq.Eq{"ce.recurrent": true},
+							sq.Or{
+								sq.Eq{"ce.recurrence_end": nil},
+								sq.GtOrEq{"ce.recurrence_end": sqlQueryTime.Add(-24 * time.Hour)},
+							},
+						},
+					},
+				},
 			},
 			sq.Or{
 				sq.Eq{"ce.processed": nil},
@@ -986,11 +1088,16 @@ func TestProcessEventWithChannelRecurrentNotDay(t *testing.T) {
 	expectedQuery := dbMock.ExpectQuery(
 		regexp.QuoteMeta(querySql)).
 		WithArgs(
+			false,
 			sqlQueryTime,
 			sqlQueryTime,
 			true,
 			sqlQueryTime,
-			sqlQueryTime,
+			true,
+			sqlQueryTime.Add(-24*time.Hour),
+			sqlQueryTime.Add(8*24*time.Hour),
+			true,
+			sqlQueryTime.Add(-24*time.Hour),
 			sqlQueryTime,
 		)
 
@@ -1017,6 +1124,10 @@ func TestProcessEventWithChannelRecurrentNotDay(t *testing.T) {
 	)
 
 	expectedQuery.WillReturnRows(eventsRow)
+	// not notified, checked again on Sunday
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET next_notification = $1 WHERE id = $2")).
+		WithArgs(time.Date(2023, 4, 16, 0, 0, 0, 0, time.UTC), "rec-ev").
+		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	background.process(processingTime)
 
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +18,7 @@ import (
 	ics "github.com/arran4/golang-ical"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 	"github.com/mattermost/mattermost-server/v6/model"
 )
 
@@ -20,9 +26,16 @@ import (
 type CalDAVBackend struct {
 	plugin        *Plugin
 	userID        string
-	token         string
+	tokenId       string
 	basePath      string
 	calendarColor string
+
+	// users caches the users looked up while serving the request
+	users map[string]*model.User
+	// addresses caches the users looked up by email, nil for addresses of unknown users
+	addresses map[string]*model.User
+	// timezones holds the VTIMEZONE definitions of the calendars parsed while serving the request
+	timezones map[string]*icalTimezone
 }
 
 // NewCalDAVBackend creates a new CalDAV backend for a specific user
@@ -30,7 +43,6 @@ func NewCalDAVBackend(plugin *Plugin, userID, token, calendarColor string) *CalD
 	return &CalDAVBackend{
 		plugin:        plugin,
 		userID:        userID,
-		token:         token,
 		basePath:      "/plugins/" + PluginId + "/caldav/" + token,
 		calendarColor: calendarColor,
 	}
@@ -56,51 +68,26 @@ func (p *Plugin) ServeCalDAV(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Set DAV headers early for discovery (Apple Calendar needs this)
-	w.Header().Set("DAV", "1, 2, 3, calendar-access, addressbook")
-	w.Header().Set("Server", "Mattermost-Calendar-CalDAV/1.0")
+	setCalDAVHeaders(w)
 
 	// Allow OPTIONS without authentication for CalDAV discovery (required by Apple Calendar)
 	if r.Method == "OPTIONS" {
-		w.Header().Set("Allow", "OPTIONS, PROPFIND, PROPPATCH, REPORT, GET, PUT, DELETE, MKCALENDAR")
-		w.WriteHeader(http.StatusOK)
+		serveCalDAVOptions(w)
 		return
 	}
 
 	// Authentication is via token in URL - no Basic Auth required
 	// This allows Apple Calendar to work over HTTP (it refuses to send passwords over HTTP)
-	// The 64-char token in the URL is the secret that authenticates the user
-
-	// Look up the token and get the user ID
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
-		From("calendar_ical_tokens").
-		Where(sq.Eq{"token": token}).
-		PlaceholderFormat(p.GetDBPlaceholderFormat())
-
-	querySql, args, sqlErr := queryBuilder.ToSql()
-	if sqlErr != nil {
-		p.API.LogError("ServeCalDAV: SQL build error: " + sqlErr.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
+	// The 64-char token in the URL is the secret that authenticates the user, the app
+	// passwords of ServeCalDAVUser keep it out of the URLs
 
-	var icalToken ICalToken
-	err := p.DB.Get(&icalToken, querySql, args...)
+	icalToken, err := p.authenticateICalToken(token, r, ICalTokenScopeCalDAV)
 	if err != nil {
-		p.API.LogError("ServeCalDAV: token not found: " + err.Error())
+		p.API.LogError("ServeCalDAV: " + err.Error())
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
-	// Update last_used timestamp
-	go func() {
-		updateBuilder := sq.Update("calendar_ical_tokens").
-			Set("last_used", time.Now().UTC()).
-			Where(sq.Eq{"token": token}).
-			PlaceholderFormat(p.GetDBPlaceholderFormat())
-		updateSql, updateArgs, _ := updateBuilder.ToSql()
-		_, _ = p.DB.Exec(updateSql, updateArgs...)
-	}()
-
 	// Verify user exists
 	_, userErr := p.API.GetUser(icalToken.UserID)
 	if userErr != nil {
@@ -115,6 +102,7 @@ func (p *Plugin) ServeCalDAV(w http.ResponseWriter, r *http.Request) {
 		calendarColor = *icalToken.CalendarColor
 	}
 	backend := NewCalDAVBackend(p, icalToken.UserID, token, calendarColor)
+	backend.tokenId = icalToken.Id
 	backend.ServeHTTP(w, r)
 }
 
@@ -123,7 +111,13 @@ func (b *CalDAVBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	b.plugin.API.LogInfo("CalDAV request", "method", r.Method, "path", r.URL.Path)
 
 	// Set DAV header for all responses (required by Apple Calendar)
-	w.Header().Set("DAV", "1, 2, 3, calendar-access")
+	setCalDAVHeaders(w)
+
+	// the address book is read-only
+	if b.isAddressBookPath(r.URL.Path) && (r.Method == "PUT" || r.Method == "DELETE" || r.Method == "PROPPATCH" || r.Method == "POST") {
+		b.handleAddressBookWrite(w, r)
+		return
+	}
 
 	switch r.Method {
 	case "OPTIONS":
@@ -135,11 +129,37 @@ func (b *CalDAVBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "REPORT":
 		b.handleReport(w, r)
 	case "GET":
+		if b.isAddressBookPath(r.URL.Path) {
+			b.handleContactGet(w, r)
+			return
+		}
+		if b.isTasksPath(r.URL.Path) {
+			b.handleTaskGet(w, r)
+			return
+		}
+		if b.isInboxPath(r.URL.Path) {
+			b.handleInboxGet(w, r)
+			return
+		}
 		b.handleGet(w, r)
 	case "PUT":
+		if b.isTasksPath(r.URL.Path) {
+			b.handleTaskPut(w, r)
+			return
+		}
 		b.handlePut(w, r)
 	case "DELETE":
+		if b.isInboxPath(r.URL.Path) {
+			b.handleInboxDelete(w, r)
+			return
+		}
+		if b.isTasksPath(r.URL.Path) {
+			b.handleTaskDelete(w, r)
+			return
+		}
 		b.handleDelete(w, r)
+	case "POST":
+		b.handleOutboxPost(w, r)
 	case "MKCALENDAR":
 		// We don't support creating additional calendars
 		http.Error(w, "Calendar already exists", http.StatusMethodNotAllowed)
@@ -149,8 +169,7 @@ func (b *CalDAVBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (b *CalDAVBackend) handleOptions(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Allow", "OPTIONS, PROPFIND, PROPPATCH, REPORT, GET, PUT, DELETE")
-	w.Header().Set("DAV", "1, 2, 3, calendar-access")
+	w.Header().Set("Allow", "OPTIONS, PROPFIND, PROPPATCH, REPORT, GET, PUT, DELETE, POST")
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -166,7 +185,7 @@ func (b *CalDAVBackend) handleProppatch(w http.ResponseWriter, r *http.Request)
 
 		updateBuilder := sq.Update("calendar_ical_tokens").
 			Set("calendar_color", color).
-			Where(sq.Eq{"token": b.token}).
+			Where(sq.Eq{"id": b.tokenId}).
 			PlaceholderFormat(b.plugin.GetDBPlaceholderFormat())
 
 		updateSql, updateArgs, sqlErr := updateBuilder.ToSql()
@@ -239,9 +258,18 @@ func (b *CalDAVBackend) handlePropfind(w http.ResponseWriter, r *http.Request) {
 	body, _ := io.ReadAll(r.Body)
 	b.plugin.API.LogInfo("CalDAV PROPFIND", "path", path, "depth", depth, "body", string(body))
 
+	if b.isAddressBookPath(path) {
+		b.handleAddressBookPropfind(w, depth)
+		return
+	}
+	if b.isTasksPath(path) {
+		b.handleTasksPropfind(w, depth)
+		return
+	}
+
 	// Determine what we're querying
-	isRoot := strings.HasSuffix(path, b.token+"/") || strings.HasSuffix(path, b.token)
-	isCalendar := strings.Contains(path, "/calendar")
+	isRoot := strings.TrimSuffix(b.resourcePath(path), "/") == ""
+	isCalendar := b.isCalendarPath(path)
 
 	b.plugin.API.LogInfo("CalDAV PROPFIND routing", "isRoot", isRoot, "isCalendar", isCalendar, "depth", depth)
 
@@ -249,7 +277,9 @@ func (b *CalDAVBackend) handlePropfind(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusMultiStatus)
 
 	var response string
-	if isCalendar && depth == "1" {
+	if b.isInboxPath(path) || b.isOutboxPath(path) {
+		response = b.schedulePropfindResponse(path, depth)
+	} else if isCalendar && depth == "1" {
 		// Depth 1 on calendar - return calendar info + list of events
 		response = b.calendarPropfindWithEvents()
 	} else if isCalendar {
@@ -288,15 +318,17 @@ func (b *CalDAVBackend) rootPropfindResponse() string {
         </D:principal-URL>
         <C:calendar-home-set>
           <D:href>%s/</D:href>
-        </C:calendar-home-set>
+        </C:calendar-home-set>%s%s
       </D:prop>
       <D:status>HTTP/1.1 200 OK</D:status>
     </D:propstat>
   </D:response>
-</D:multistatus>`, b.basePath, b.basePath, b.basePath, b.basePath)
+</D:multistatus>`, b.basePath, b.basePath, b.basePath, b.basePath, b.principalScheduleProps(), b.principalAddressBookProps())
 }
 
 func (b *CalDAVBackend) rootPropfindWithCalendars() string {
+	syncToken := formatSyncToken(b.syncPosition())
+
 	// Return root + calendar collection for Depth: 1 requests (Apple Calendar needs this)
 	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/" xmlns:I="http://apple.com/ns/ical/">
@@ -310,11 +342,11 @@ func (b *CalDAVBackend) rootPropfindWithCalendars() string {
         <D:current-user-principal>
           <D:href>%s/</D:href>
         </D:current-user-principal>
-        <D:displayname>Mattermost Calendar</D:displayname>
+        <D:displayname>Mattermost Calendar</D:displayname>%s%s
       </D:prop>
       <D:status>HTTP/1.1 200 OK</D:status>
     </D:propstat>
-  </D:response>
+  </D:response>%s%s%s
   <D:response>
     <D:href>%s/calendar/</D:href>
     <D:propstat>
@@ -329,7 +361,8 @@ func (b *CalDAVBackend) rootPropfindWithCalendars() string {
         <C:supported-calendar-component-set>
           <C:comp name="VEVENT"/>
         </C:supported-calendar-component-set>
-        <CS:getctag>%d</CS:getctag>
+        <CS:getctag>%s</CS:getctag>
+        <D:sync-token>%s</D:sync-token>
         <D:current-user-privilege-set>
           <D:privilege><D:read/></D:privilege>
           <D:privilege><D:write/></D:privilege>
@@ -339,10 +372,12 @@ func (b *CalDAVBackend) rootPropfindWithCalendars() string {
       <D:status>HTTP/1.1 200 OK</D:status>
     </D:propstat>
   </D:response>
-</D:multistatus>`, b.basePath, b.basePath, b.basePath, b.calendarColor, time.Now().Unix())
+</D:multistatus>`, b.basePath, b.basePath, b.principalScheduleProps(), b.principalAddressBookProps(), b.scheduleCollectionResponses(), b.addressBookCollectionResponse(), b.tasksCollectionResponse(), b.basePath, b.calendarColor, syncToken, syncToken)
 }
 
 func (b *CalDAVBackend) calendarPropfindResponse() string {
+	syncToken := formatSyncToken(b.syncPosition())
+
 	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <d:multistatus xmlns:d="DAV:" xmlns:cal="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/" xmlns:ical="http://apple.com/ns/ical/">
   <d:response>
@@ -357,8 +392,13 @@ func (b *CalDAVBackend) calendarPropfindResponse() string {
         <cal:supported-calendar-component-set>
           <cal:comp name="VEVENT"/>
         </cal:supported-calendar-component-set>
-        <cs:getctag>%d</cs:getctag>
-        <d:sync-token>%d</d:sync-token>
+        <cs:getctag>%s</cs:getctag>
+        <d:sync-token>%s</d:sync-token>
+        <d:supported-report-set>
+          <d:supported-report><d:report><d:sync-collection/></d:report></d:supported-report>
+          <d:supported-report><d:report><cal:calendar-multiget/></d:report></d:supported-report>
+          <d:supported-report><d:report><cal:calendar-query/></d:report></d:supported-report>
+        </d:supported-report-set>
         <ical:calendar-color>%s</ical:calendar-color>
         <ical:calendar-order>1</ical:calendar-order>
         <d:current-user-privilege-set>
@@ -370,22 +410,43 @@ func (b *CalDAVBackend) calendarPropfindResponse() string {
       <d:status>HTTP/1.1 200 OK</d:status>
     </d:propstat>
   </d:response>
-</d:multistatus>`, b.basePath, time.Now().Unix(), time.Now().Unix(), b.calendarColor)
+</d:multistatus>`, b.basePath, syncToken, syncToken, b.calendarColor)
 }
 
-func (b *CalDAVBackend) calendarPropfindWithEvents() string {
-	user, _ := b.plugin.API.GetUser(b.userID)
-
-	// Get events
+// collectionWindow returns the range of the calendar collection: one year back to two years ahead
+func (b *CalDAVBackend) collectionWindow() (time.Time, time.Time) {
 	now := time.Now().UTC()
-	start := now.AddDate(-1, 0, 0)
-	end := now.AddDate(2, 0, 0)
+	return now.AddDate(-1, 0, 0), now.AddDate(2, 0, 0)
+}
+
+// collectionEvents returns the events of the calendar collection
+func (b *CalDAVBackend) collectionEvents(user *model.User) ([]Event, *model.AppError) {
+	start, end := b.collectionWindow()
 
 	var userLoc *time.Location
 	if user != nil {
 		userLoc = b.plugin.GetUserLocation(user)
 	}
-	events, _ := b.plugin.GetUserEventsForICalUTC(b.userID, userLoc, start, end)
+	events, err := b.plugin.GetUserEventsForICalUTC(b.userID, userLoc, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return b.attachMembers(events), nil
+}
+
+// syncPosition returns the user's change log position used for CS:getctag and DAV:sync-token
+func (b *CalDAVBackend) syncPosition() int64 {
+	position, err := b.plugin.GetUserSyncPosition(b.userID)
+	if err != nil {
+		b.plugin.API.LogError("CalDAV: can't get sync position: " + err.Error())
+	}
+	return position
+}
+
+func (b *CalDAVBackend) calendarPropfindWithEvents() string {
+	user, _ := b.plugin.API.GetUser(b.userID)
+
+	events, _ := b.collectionEvents(user)
 
 	// Log events for debugging
 	var eventIDs []string
@@ -394,6 +455,8 @@ func (b *CalDAVBackend) calendarPropfindWithEvents() string {
 	}
 	b.plugin.API.LogInfo("CalDAV PROPFIND events", "count", len(events), "ids", strings.Join(eventIDs, ","))
 
+	syncToken := formatSyncToken(b.syncPosition())
+
 	var buf bytes.Buffer
 	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
 	buf.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:cal="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/" xmlns:ical="http://apple.com/ns/ical/">`)
@@ -409,11 +472,12 @@ func (b *CalDAVBackend) calendarPropfindWithEvents() string {
           <cal:calendar/>
         </d:resourcetype>
         <d:displayname>Mattermost Calendar</d:displayname>
-        <cs:getctag>%d</cs:getctag>
+        <cs:getctag>%s</cs:getctag>
+        <d:sync-token>%s</d:sync-token>
       </d:prop>
       <d:status>HTTP/1.1 200 OK</d:status>
     </d:propstat>
-  </d:response>`, b.basePath, time.Now().Unix()))
+  </d:response>`, b.basePath, syncToken, syncToken))
 
 	// Then each event
 	for _, event := range events {
@@ -442,113 +506,281 @@ func (b *CalDAVBackend) handleReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read and parse the REPORT body to see what's being requested
 	body, _ := io.ReadAll(r.Body)
 	b.plugin.API.LogInfo("CalDAV REPORT body", "body", string(body))
 
-	// Check if this is a calendar-multiget (requesting specific events)
-	var requestedEventIDs []string
-	if strings.Contains(string(body), "calendar-multiget") {
-		// Parse hrefs from the request using regex
-		// Looking for href tags like <D:href>...</D:href>
-		bodyStr := string(body)
-		// Find all href values - they end with .ics
-		idx := 0
-		for {
-			// Find href opening tag (case insensitive)
-			hrefStart := strings.Index(strings.ToLower(bodyStr[idx:]), "<d:href>")
-			if hrefStart == -1 {
-				hrefStart = strings.Index(strings.ToLower(bodyStr[idx:]), "<href>")
-			}
-			if hrefStart == -1 {
-				break
+	var request reportRequest
+	if err := xml.Unmarshal(body, &request); err != nil {
+		b.plugin.API.LogError("CalDAV REPORT: invalid body: " + err.Error())
+		http.Error(w, "Invalid REPORT body", http.StatusBadRequest)
+		return
+	}
+
+	if b.isAddressBookPath(r.URL.Path) {
+		b.handleAddressBookReport(w, &request)
+		return
+	}
+	if b.isTasksPath(r.URL.Path) {
+		b.handleTasksReport(w, &request)
+		return
+	}
+
+	switch request.XMLName {
+	case xml.Name{Space: nsDAV, Local: "sync-collection"}:
+		b.handleSyncCollection(w, &request, user)
+	case xml.Name{Space: nsCalDAV, Local: "calendar-multiget"}:
+		if b.isInboxPath(r.URL.Path) {
+			b.handleInboxMultiget(w, &request)
+			return
+		}
+		b.handleCalendarMultiget(w, &request, user)
+	case xml.Name{Space: nsCalDAV, Local: "calendar-query"}:
+		b.handleCalendarQuery(w, &request, user)
+	default:
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<d:error xmlns:d="DAV:"><d:supported-report/></d:error>`))
+	}
+}
+
+// handleCalendarMultiget implements the calendar-multiget REPORT (RFC 4791 7.9).
+// Hrefs that aren't in the collection get a 404 response.
+func (b *CalDAVBackend) handleCalendarMultiget(w http.ResponseWriter, request *reportRequest, user *model.User) {
+	events, eventsErr := b.collectionEvents(user)
+	if eventsErr != nil {
+		http.Error(w, "Failed to get events", http.StatusInternalServerError)
+		return
+	}
+
+	visible := make(map[string]*Event, len(events))
+	for i := range events {
+		visible[events[i].Id] = &events[i]
+	}
+
+	names := request.propNames(propGetETag, propCalendarData)
+
+	var buf bytes.Buffer
+	writeMultistatusStart(&buf)
+	for _, href := range request.Hrefs {
+		event, ok := visible[b.extractEventID(strings.TrimSpace(href))]
+		if !ok {
+			writeNotFoundResponse(&buf, strings.TrimSpace(href))
+			continue
+		}
+		b.writeEventResponse(&buf, event, user, names, request.Prop)
+	}
+	buf.WriteString(`</d:multistatus>`)
+
+	b.plugin.API.LogInfo("CalDAV REPORT multiget", "requested", len(request.Hrefs))
+	writeMultistatus(w, buf.Bytes())
+}
+
+// handleCalendarQuery implements the calendar-query REPORT (RFC 4791 7.8)
+func (b *CalDAVBackend) handleCalendarQuery(w http.ResponseWriter, request *reportRequest, user *model.User) {
+	start, end := b.collectionWindow()
+	if request.Filter != nil && request.Filter.CompFilter != nil {
+		// widen the collection to the queried range so old and far future events match too
+		for _, filter := range request.Filter.CompFilter.CompFilters {
+			if filter.TimeRange == nil {
+				continue
 			}
-			hrefStart += idx
-
-			// Find the closing tag
-			var hrefEnd int
-			if strings.Contains(bodyStr[hrefStart:hrefStart+10], "<D:href>") || strings.Contains(bodyStr[hrefStart:hrefStart+10], "<d:href>") {
-				hrefEnd = strings.Index(bodyStr[hrefStart:], "</D:href>")
-				if hrefEnd == -1 {
-					hrefEnd = strings.Index(bodyStr[hrefStart:], "</d:href>")
-				}
-			} else {
-				hrefEnd = strings.Index(bodyStr[hrefStart:], "</href>")
+			rangeStart, rangeEnd, err := filter.TimeRange.bounds()
+			if err != nil {
+				http.Error(w, "Invalid time-range", http.StatusBadRequest)
+				return
 			}
-			if hrefEnd == -1 {
-				break
+			if !rangeStart.IsZero() && rangeStart.Before(start) {
+				start = rangeStart
 			}
-			hrefEnd += hrefStart
-
-			// Extract href content
-			tagEnd := strings.Index(bodyStr[hrefStart:], ">") + hrefStart + 1
-			href := bodyStr[tagEnd:hrefEnd]
-
-			// Extract event ID from href (last part before .ics)
-			if strings.HasSuffix(href, ".ics") {
-				parts := strings.Split(href, "/")
-				if len(parts) > 0 {
-					eventID := strings.TrimSuffix(parts[len(parts)-1], ".ics")
-					requestedEventIDs = append(requestedEventIDs, eventID)
-				}
+			if rangeEnd.After(end) {
+				end = rangeEnd
 			}
+		}
+	}
 
-			idx = hrefEnd + 1
+	var userLoc *time.Location
+	if user != nil {
+		userLoc = b.plugin.GetUserLocation(user)
+	}
+	events, eventsErr := b.plugin.GetUserEventsForICalUTC(b.userID, userLoc, start, end)
+	if eventsErr != nil {
+		http.Error(w, "Failed to get events", http.StatusInternalServerError)
+		return
+	}
+	events = b.attachMembers(events)
+
+	names := request.propNames(propGetETag, propCalendarData)
+
+	var buf bytes.Buffer
+	writeMultistatusStart(&buf)
+	matched := 0
+	for i := range events {
+		if !b.matchCalendarFilter(b.eventToICalendar(&events[i], user), request.Filter) {
+			continue
 		}
-		b.plugin.API.LogInfo("CalDAV REPORT multiget", "requestedEventIDs", strings.Join(requestedEventIDs, ","))
+		matched++
+		b.writeEventResponse(&buf, &events[i], user, names, request.Prop)
 	}
+	buf.WriteString(`</d:multistatus>`)
 
-	// Get events
-	now := time.Now().UTC()
-	start := now.AddDate(-1, 0, 0)
-	end := now.AddDate(2, 0, 0)
+	b.plugin.API.LogInfo("CalDAV REPORT calendar-query", "events", len(events), "matched", matched)
+	writeMultistatus(w, buf.Bytes())
+}
 
-	userLoc := b.plugin.GetUserLocation(user)
-	events, eventsErr := b.plugin.GetUserEventsForICalUTC(b.userID, userLoc, start, end)
+// handleSyncCollection implements the RFC 6578 sync-collection REPORT.
+// An empty sync-token returns every event of the collection, otherwise only events
+// changed after the token; events that were deleted or are no longer visible get 404.
+func (b *CalDAVBackend) handleSyncCollection(w http.ResponseWriter, request *reportRequest, user *model.User) {
+	start, position, err := b.plugin.GetUserSyncRange(b.userID)
+	if err != nil {
+		b.plugin.API.LogError("CalDAV sync-collection: " + err.Error())
+		http.Error(w, "Failed to get changes", http.StatusInternalServerError)
+		return
+	}
+
+	var since int64
+	initialSync := strings.TrimSpace(request.SyncToken) == ""
+	if !initialSync {
+		var valid bool
+		since, valid = parseSyncToken(request.SyncToken)
+		// a token before start may have missed pruned changes, the client syncs again from scratch
+		if !valid || since > position || since < start {
+			b.plugin.API.LogInfo("CalDAV sync-collection invalid token", "token", request.SyncToken)
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<d:error xmlns:d="DAV:"><d:valid-sync-token/></d:error>`))
+			return
+		}
+	}
+
+	events, eventsErr := b.collectionEvents(user)
 	if eventsErr != nil {
 		http.Error(w, "Failed to get events", http.StatusInternalServerError)
 		return
 	}
 
-	// If specific event IDs were requested, filter events
-	if len(requestedEventIDs) > 0 {
-		var filteredEvents []Event
-		for _, event := range events {
-			for _, reqID := range requestedEventIDs {
-				if event.Id == reqID {
-					filteredEvents = append(filteredEvents, event)
-					break
-				}
+	var changed []*Event
+	var removed []string
+	if initialSync {
+		for i := range events {
+			changed = append(changed, &events[i])
+		}
+	} else {
+		changes, changesErr := b.plugin.GetUserSyncChanges(b.userID, since)
+		if changesErr != nil {
+			b.plugin.API.LogError("CalDAV sync-collection: " + changesErr.Error())
+			http.Error(w, "Failed to get changes", http.StatusInternalServerError)
+			return
+		}
+
+		visible := make(map[string]*Event, len(events))
+		for i := range events {
+			visible[events[i].Id] = &events[i]
+		}
+
+		for _, change := range changes {
+			event, ok := visible[change.EventId]
+			if change.Deleted || !ok {
+				removed = append(removed, change.EventId)
+				continue
 			}
+			changed = append(changed, event)
 		}
-		b.plugin.API.LogInfo("CalDAV REPORT filtered", "requested", len(requestedEventIDs), "found", len(filteredEvents))
-		events = filteredEvents
 	}
 
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-	w.WriteHeader(http.StatusMultiStatus)
+	b.plugin.API.LogInfo("CalDAV sync-collection", "since", fmt.Sprintf("%d", since), "changed", len(changed), "removed", len(removed))
+
+	names := request.propNames(propGetETag, propGetContentType)
 
 	var buf bytes.Buffer
+	writeMultistatusStart(&buf)
+	for _, event := range changed {
+		b.writeEventResponse(&buf, event, user, names, request.Prop)
+	}
+	for _, eventID := range removed {
+		writeNotFoundResponse(&buf, fmt.Sprintf("%s/calendar/%s.ics", b.basePath, eventID))
+	}
+	buf.WriteString(fmt.Sprintf(`
+  <d:sync-token>%s</d:sync-token>
+</d:multistatus>`, formatSyncToken(position)))
+
+	writeMultistatus(w, buf.Bytes())
+}
+
+func writeMultistatusStart(buf *bytes.Buffer) {
 	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
 	buf.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:cal="urn:ietf:params:xml:ns:caldav">`)
+}
 
-	for _, event := range events {
-		icalData := b.eventToICalendarString(&event, user)
-		buf.WriteString(fmt.Sprintf(`
+func writeMultistatus(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(body)
+}
+
+func writeNotFoundResponse(buf *bytes.Buffer, href string) {
+	buf.WriteString(fmt.Sprintf(`
   <d:response>
-    <d:href>%s/calendar/%s.ics</d:href>
+    <d:href>%s</d:href>
+    <d:status>HTTP/1.1 404 Not Found</d:status>
+  </d:response>`, xmlEscape(href)))
+}
+
+// writeEventResponse writes a DAV:response with the requested properties of the event.
+// Properties we don't know are reported in a separate 404 propstat.
+func (b *CalDAVBackend) writeEventResponse(buf *bytes.Buffer, event *Event, user *model.User, names []xml.Name, prop *reportProp) {
+	var found, missing bytes.Buffer
+
+	for _, name := range names {
+		switch name {
+		case propGetETag:
+			found.WriteString(fmt.Sprintf(`
+        <d:getetag>"%s"</d:getetag>`, eventETag(event)))
+		case propGetContentType:
+			found.WriteString(`
+        <d:getcontenttype>text/calendar; charset=utf-8</d:getcontenttype>`)
+		case propResourceType:
+			found.WriteString(`
+        <d:resourcetype/>`)
+		case propCalendarData:
+			cal := b.eventToICalendar(event, user)
+			if prop != nil && prop.CalendarData != nil {
+				if prop.CalendarData.Expand != nil {
+					cal = b.expandCalendar(cal, prop.CalendarData.Expand)
+				}
+				cal = selectCalendarData(cal, prop.CalendarData.Comp)
+			}
+			found.WriteString(fmt.Sprintf(`
+        <cal:calendar-data>%s</cal:calendar-data>`, xmlEscape(cal.Serialize())))
+		default:
+			missing.WriteString(fmt.Sprintf(`
+        <%s xmlns="%s"/>`, name.Local, xmlEscape(name.Space)))
+		}
+	}
+
+	buf.WriteString(fmt.Sprintf(`
+  <d:response>
+    <d:href>%s/calendar/%s.ics</d:href>`, b.basePath, event.Id))
+	if found.Len() > 0 {
+		buf.WriteString(fmt.Sprintf(`
     <d:propstat>
-      <d:prop>
-        <d:getetag>"%s"</d:getetag>
-        <cal:calendar-data>%s</cal:calendar-data>
+      <d:prop>%s
       </d:prop>
       <d:status>HTTP/1.1 200 OK</d:status>
-    </d:propstat>
-  </d:response>`, b.basePath, event.Id, eventETag(&event), xmlEscape(icalData)))
+    </d:propstat>`, found.String()))
 	}
-
-	buf.WriteString(`</d:multistatus>`)
-	w.Write(buf.Bytes())
+	if missing.Len() > 0 {
+		buf.WriteString(fmt.Sprintf(`
+    <d:propstat>
+      <d:prop>%s
+      </d:prop>
+      <d:status>HTTP/1.1 404 Not Found</d:status>
+    </d:propstat>`, missing.String()))
+	}
+	buf.WriteString(`
+  </d:response>`)
 }
 
 func (b *CalDAVBackend) handleGet(w http.ResponseWriter, r *http.Request) {
@@ -564,11 +796,20 @@ func (b *CalDAVBackend) handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag := fmt.Sprintf(`"%s"`, eventETag(event))
+	w.Header().Set("ETag", etag)
+	if !event.Updated.IsZero() {
+		w.Header().Set("Last-Modified", event.Updated.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, event.Updated.UTC()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	user, _ := b.plugin.API.GetUser(b.userID)
 	icalData := b.eventToICalendarString(event, user)
 
 	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
-	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, eventETag(event)))
 	w.Write([]byte(icalData))
 }
 
@@ -590,9 +831,14 @@ func (b *CalDAVBackend) handlePut(w http.ResponseWriter, r *http.Request) {
 
 	// Extract UID from iCal data
 	icalUID := ""
-	events := cal.Events()
-	if len(events) > 0 {
-		if uid := events[0].GetProperty(ics.ComponentPropertyUniqueId); uid != nil {
+	vevent := masterEvent(cal)
+	if vevent == nil && len(cal.Todos()) > 0 {
+		// tasks are stored in the tasks collection
+		writeScheduleError(w, "supported-calendar-component")
+		return
+	}
+	if vevent != nil {
+		if uid := vevent.GetProperty(ics.ComponentPropertyUniqueId); uid != nil {
 			icalUID = uid.Value
 		}
 	}
@@ -624,7 +870,14 @@ func (b *CalDAVBackend) handlePut(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if !preconditionsMet(r, existingEvent) {
+		b.plugin.API.LogInfo("CalDAV PUT precondition failed", "eventID", eventID)
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
 	isUpdate := existingEvent != nil
+	var previousRecipients []string
 	b.plugin.API.LogInfo("CalDAV PUT decision", "isUpdate", isUpdate, "finalEventID", eventID)
 
 	if isUpdate {
@@ -632,13 +885,19 @@ func (b *CalDAVBackend) handlePut(w http.ResponseWriter, r *http.Request) {
 		event.Owner = existingEvent.Owner
 		event.Created = existingEvent.Created
 
-		// Check if user owns the event
+		// Attendees can only reply, everything else belongs to the organizer
 		if existingEvent.Owner != b.userID {
-			http.Error(w, "Unauthorized", http.StatusForbidden)
+			partStat := b.ownPartStat(vevent)
+			if !contains(existingEvent.Attendees, b.userID) || partStat == "" {
+				http.Error(w, "Unauthorized", http.StatusForbidden)
+				return
+			}
+			b.handleAttendeeChange(w, existingEvent, partStat)
 			return
 		}
 
-		err = b.updateEvent(event)
+		previousRecipients, _ = b.plugin.GetEventSyncRecipients(eventID)
+		err = b.updateEventIfMatch(r, event)
 		b.plugin.API.LogInfo("CalDAV PUT update", "eventID", eventID, "title", event.Title, "error", fmt.Sprintf("%v", err))
 	} else {
 		event.Id = eventID
@@ -648,15 +907,28 @@ func (b *CalDAVBackend) handlePut(w http.ResponseWriter, r *http.Request) {
 		b.plugin.API.LogInfo("CalDAV PUT create", "eventID", eventID, "title", event.Title, "error", fmt.Sprintf("%v", err))
 	}
 
+	if errors.Is(err, errPreconditionFailed) {
+		b.plugin.API.LogInfo("CalDAV PUT precondition failed", "eventID", eventID)
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
 		b.plugin.API.LogError("CalDAV PUT error: " + err.Error())
 		http.Error(w, "Failed to save event", http.StatusInternalServerError)
 		return
 	}
 
+	b.scheduleOrganizerChange(existingEvent, vevent, eventID)
+	b.plugin.RecordEventChange(eventID, previousRecipients)
+
 	// Get the saved event to return correct ETag
 	savedEvent, _ := b.getEventByID(eventID)
 	if savedEvent != nil {
+		if isUpdate {
+			b.plugin.enqueueWebhook(WebhookEventUpdated, savedEvent)
+		} else {
+			b.plugin.enqueueWebhook(WebhookEventCreated, savedEvent)
+		}
 		etag := eventETag(savedEvent)
 		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, etag))
 		b.plugin.API.LogInfo("CalDAV PUT response", "eventID", eventID, "etag", etag, "isUpdate", isUpdate)
@@ -682,26 +954,47 @@ func (b *CalDAVBackend) handleDelete(w http.ResponseWriter, r *http.Request) {
 	// Check if user owns the event
 	event, err := b.getEventByID(eventID)
 	if err != nil {
+		if !preconditionsMet(r, nil) {
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
 		http.Error(w, "Event not found", http.StatusNotFound)
 		return
 	}
 
+	if !preconditionsMet(r, event) {
+		b.plugin.API.LogInfo("CalDAV DELETE precondition failed", "eventID", eventID)
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	// an attendee deleting the event declines it
 	if event.Owner != b.userID {
-		http.Error(w, "Unauthorized", http.StatusForbidden)
+		if !contains(event.Attendees, b.userID) {
+			http.Error(w, "Unauthorized", http.StatusForbidden)
+			return
+		}
+		b.handleAttendeeChange(w, event, string(ics.ParticipationStatusDeclined))
 		return
 	}
 
-	deleteBuilder := sq.Delete("calendar_events").
-		Where(sq.Eq{"id": eventID}).
-		PlaceholderFormat(b.plugin.GetDBPlaceholderFormat())
+	previousRecipients, _ := b.plugin.GetEventSyncRecipients(eventID)
 
-	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
-	_, dbErr := b.plugin.DB.Exec(deleteSql, deleteArgs...)
-	if dbErr != nil {
+	if dbErr := b.deleteEventIfMatch(r, eventID); dbErr != nil {
+		if errors.Is(dbErr, errPreconditionFailed) {
+			b.plugin.API.LogInfo("CalDAV DELETE precondition failed", "eventID", eventID)
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
 		http.Error(w, "Failed to delete event", http.StatusInternalServerError)
 		return
 	}
 
+	b.deliverEventMessage(event, ics.MethodCancel, event.Attendees)
+
+	b.plugin.RecordEventChange(eventID, previousRecipients)
+	b.plugin.enqueueWebhook(WebhookEventDeleted, event)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -722,9 +1015,9 @@ func (b *CalDAVBackend) extractEventID(path string) string {
 
 func (b *CalDAVBackend) getEventByID(eventID string) (*Event, error) {
 	queryBuilder := sq.Select(
-		"id", "title", "description", "dt_start", "dt_end",
-		"created", "owner", "channel", "recurrent", "recurrence",
-		"color", "team", "visibility", "alert", "alert_time",
+		"id", "title", "description", "dt_start", "dt_end", "all_day", "timezone",
+		"created", "updated", "owner", "channel", "recurrent", "recurrence",
+		"color", "team", "visibility", "alert", "alert_time", "ical_data",
 	).
 		From("calendar_events").
 		Where(sq.Eq{"id": eventID}).
@@ -741,50 +1034,119 @@ func (b *CalDAVBackend) getEventByID(eventID string) (*Event, error) {
 		return nil, fmt.Errorf("event not found: %w", err)
 	}
 
-	return &event, nil
+	events := []Event{event}
+	b.plugin.AttachEventMembers(events)
+
+	return &events[0], nil
 }
 
 func (b *CalDAVBackend) eventToICalendarString(event *Event, user *model.User) string {
-	cal := ics.NewCalendar()
-	cal.SetMethod(ics.MethodPublish)
-	cal.SetProductId("-//Mattermost Calendar Plugin//EN")
-	cal.SetVersion("2.0")
+	return b.eventToICalendar(event, user).Serialize()
+}
+
+func (b *CalDAVBackend) eventToICalendar(event *Event, user *model.User) *ics.Calendar {
+	organizer := user
+	if user != nil && event.Owner != "" && event.Owner != user.Id {
+		organizer = b.lookupUser(event.Owner)
+	}
+
+	// the calendar object the client saved keeps the properties the plugin doesn't know,
+	// only the fields stored in the event are written over it
+	cal := b.storedCalendar(event)
+	var icsEvent *ics.VEvent
+	if cal != nil {
+		icsEvent = masterEvent(cal)
+		icsEvent.SetProperty(ics.ComponentPropertyUniqueId, event.Id)
+		b.applyTiming(icsEvent, event)
+		b.applyRecurrence(cal, icsEvent, event)
+		applyAlert(icsEvent, event)
+		b.keepStoredAttendees(icsEvent, event, organizer)
+	} else {
+		// calendar object resources must not have a METHOD (RFC 4791 4.1), iTIP messages set it
+		cal = ics.NewCalendar()
+		cal.SetProductId("-//Mattermost Calendar Plugin//EN")
+		cal.SetVersion("2.0")
+
+		icsEvent = cal.AddEvent(event.Id)
+		setEventTiming(icsEvent, event)
+		addAlertAlarm(icsEvent, event)
+	}
 
-	icsEvent := cal.AddEvent(event.Id)
 	icsEvent.SetDtStampTime(event.Created)
 	icsEvent.SetCreatedTime(event.Created)
-	icsEvent.SetStartAt(event.Start)
-	icsEvent.SetEndAt(event.End)
 	icsEvent.SetSummary(event.Title)
 
 	if event.Description != "" {
 		icsEvent.SetDescription(event.Description)
+	} else {
+		removeProperties(&icsEvent.ComponentBase, ics.ComponentPropertyDescription)
+	}
+
+	applyColor(icsEvent, event)
+
+	if len(componentRecurrenceLines(&icsEvent.ComponentBase)) == 0 && event.Recurrent && event.Recurrence != "" {
+		addRecurrenceProperties(&icsEvent.ComponentBase, event.Recurrence)
 	}
 
-	if user != nil && user.Email != "" {
-		icsEvent.SetOrganizer(user.Email, ics.WithCN(user.GetDisplayName("")))
+	if icsEvent.GetProperty(ics.ComponentPropertyStatus) == nil {
+		icsEvent.SetStatus(ics.ObjectStatusConfirmed)
 	}
 
-	if event.Recurrent && event.Recurrence != "" {
-		rruleStr := event.Recurrence
-		if strings.HasPrefix(rruleStr, "RRULE:") {
-			rruleStr = rruleStr[6:]
+	// written last, so serializing a stored calendar again gives the same result
+	if organizer != nil && organizer.Email != "" {
+		icsEvent.SetOrganizer(organizer.Email, ics.WithCN(organizer.GetDisplayName("")))
+	}
+
+	for _, member := range event.Attendees {
+		attendee := b.lookupUser(member)
+		if attendee == nil || attendee.Email == "" {
+			continue
 		}
-		icsEvent.AddRrule(rruleStr)
+
+		partStat := ics.ParticipationStatus(event.AttendeeStatus[member])
+		if partStat == "" {
+			partStat = ics.ParticipationStatusNeedsAction
+		}
+
+		icsEvent.AddAttendee(attendee.Email,
+			ics.WithCN(attendee.GetDisplayName("")),
+			ics.CalendarUserTypeIndividual,
+			ics.ParticipationRoleReqParticipant,
+			partStat,
+			ics.WithRSVP(partStat == ics.ParticipationStatusNeedsAction),
+		)
 	}
 
-	icsEvent.SetStatus(ics.ObjectStatusConfirmed)
+	for _, guest := range event.Guests {
+		partStat := ics.ParticipationStatus(guest.PartStat)
+		if partStat == "" {
+			partStat = ics.ParticipationStatusNeedsAction
+		}
 
-	return cal.Serialize()
+		params := []ics.PropertyParameter{
+			ics.CalendarUserTypeIndividual,
+			ics.ParticipationRoleReqParticipant,
+			partStat,
+			ics.WithRSVP(partStat == ics.ParticipationStatusNeedsAction),
+		}
+		if guest.Name != "" {
+			params = append([]ics.PropertyParameter{ics.WithCN(guest.Name)}, params...)
+		}
+		icsEvent.AddAttendee(guest.Email, params...)
+	}
+
+	addTimezones(cal)
+
+	return cal
 }
 
 func (b *CalDAVBackend) icalendarToEvent(cal *ics.Calendar, eventID string) (*Event, error) {
-	events := cal.Events()
-	if len(events) == 0 {
+	vevent := masterEvent(cal)
+	if vevent == nil {
 		return nil, fmt.Errorf("no VEVENT found in calendar")
 	}
 
-	vevent := events[0]
+	b.loadTimezones(cal)
 
 	event := &Event{
 		Id:         eventID,
@@ -799,29 +1161,63 @@ func (b *CalDAVBackend) icalendarToEvent(cal *ics.Calendar, eventID string) (*Ev
 		event.Description = desc.Value
 	}
 
-	if dtstart := vevent.GetProperty(ics.ComponentPropertyDtStart); dtstart != nil {
-		start := b.parseICalTime(dtstart)
-		if !start.IsZero() {
-			event.Start = start
-		}
+	// DTEND, DURATION or the default length of a DATE event
+	if start, duration, ok := b.componentTiming(vevent); ok {
+		event.Start = start
+		event.End = start.Add(duration)
 	}
 
-	if dtend := vevent.GetProperty(ics.ComponentPropertyDtEnd); dtend != nil {
-		end := b.parseICalTime(dtend)
-		if !end.IsZero() {
-			event.End = end
-		}
+	// a DATE start makes an all-day event, its dates are floating
+	dtstart := vevent.GetProperty(ics.ComponentPropertyDtStart)
+	if dtstart != nil && isDateValue(dtstart) {
+		event.AllDay = true
+		normalizeAllDay(event)
 	}
+	event.Timezone = b.propertyTimezone(dtstart)
 
-	if rrule := vevent.GetProperty(ics.ComponentPropertyRrule); rrule != nil {
-		event.Recurrence = "RRULE:" + rrule.Value
+	if recurrence := b.recurrenceLines(&vevent.ComponentBase); recurrence != "" {
+		event.Recurrence = recurrence
 		event.Recurrent = true
 	}
 
+	event.Alert = veventAlert(vevent)
+	if event.AllDay {
+		loc := time.UTC
+		if user := b.lookupUser(b.userID); user != nil {
+			loc = b.plugin.GetUserLocation(user)
+		}
+		event.AlertTime = allDayAlertTime(event.Start, event.Alert, loc)
+	} else if event.Alert != EventAlertNone {
+		alertTime := event.Start.Add(-1 * EventAlertDurationMap[event.Alert])
+		event.AlertTime = &alertTime
+	}
+
+	color := ""
+	if colorProperty := vevent.GetProperty(ics.ComponentPropertyColor); colorProperty != nil {
+		color = parseEventColor(colorProperty.Value)
+	}
+	if color == "" {
+		color = categoriesColor(vevent)
+	}
+	if color != "" {
+		event.Color = &color
+	}
+
+	for _, attendee := range vevent.Attendees() {
+		user := b.lookupAddress(attendee.Value)
+		if user != nil && user.Id != b.userID && !contains(event.Attendees, user.Id) {
+			event.Attendees = append(event.Attendees, user.Id)
+		}
+	}
+
 	if event.Id == "" {
 		event.Id = uuid.New().String()
 	}
 
+	// the whole calendar object is kept, so properties the plugin doesn't know survive the round trip
+	data := calendarObjectData(cal)
+	event.ICalData = &data
+
 	return event, nil
 }
 
@@ -847,25 +1243,27 @@ func (b *CalDAVBackend) parseICalTime(prop *ics.IANAProperty) time.Time {
 		tzid = tzidValues[0]
 	}
 
-	// Parse the time value
-	t, err := time.Parse("20060102T150405", value)
-	if err != nil {
-		// Try date-only format
-		t, err = time.Parse("20060102", value)
+	// DATE values are floating, a TZID doesn't apply to them
+	if isDateValue(prop) {
+		t, err := time.Parse(iCalDateLayout, value)
 		if err != nil {
 			return time.Time{}
 		}
+		return t
+	}
+
+	// Parse the time value
+	t, err := time.Parse(iCalLocalDateTimeLayout, value)
+	if err != nil {
+		return time.Time{}
 	}
 
 	// If we have a TZID, parse in that timezone and convert to UTC
 	if tzid != "" {
-		loc, err := time.LoadLocation(tzid)
-		if err == nil {
-			// Create time in the specified timezone
-			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
-			return t.UTC()
+		if utc, ok := b.zoneToUTC(tzid, t); ok {
+			return utc
 		}
-		b.plugin.API.LogWarn("Unknown timezone", "tzid", tzid, "error", err.Error())
+		b.plugin.API.LogWarn("Unknown timezone", "tzid", tzid)
 	}
 
 	// No timezone info - assume it's already in user's local time, treat as UTC
@@ -881,20 +1279,20 @@ func (b *CalDAVBackend) createEvent(event *Event) error {
 		}
 	}
 
-	now := time.Now().UTC()
+	now := time.Now().UTC().Truncate(time.Second)
 	event.Created = now
 	event.Updated = now
 
 	queryBuilder := sq.Insert("calendar_events").
 		Columns(
-			"id", "title", "description", "dt_start", "dt_end",
-			"created", "updated", "owner", "channel", "recurrent", "recurrence",
-			"color", "visibility", "team", "alert", "alert_time",
+			"id", "title", "description", "dt_start", "dt_end", "all_day", "timezone",
+			"created", "updated", "owner", "channel", "recurrent", "recurrence", "recurrence_end",
+			"next_notification", "color", "visibility", "team", "alert", "alert_time", "ical_data",
 		).
 		Values(
-			event.Id, event.Title, event.Description, event.Start, event.End,
-			event.Created, event.Updated, event.Owner, event.Channel, event.Recurrent, event.Recurrence,
-			event.Color, event.Visibility, event.Team, event.Alert, event.AlertTime,
+			event.Id, event.Title, event.Description, event.Start, event.End, event.AllDay, event.Timezone,
+			event.Created, event.Updated, event.Owner, event.Channel, event.Recurrent, event.Recurrence, seriesEnd(event),
+			nextNotification(event, now.Truncate(time.Minute)), event.Color, event.Visibility, event.Team, event.Alert, event.AlertTime, event.ICalData,
 		).
 		PlaceholderFormat(b.plugin.GetDBPlaceholderFormat())
 
@@ -912,16 +1310,105 @@ func (b *CalDAVBackend) createEvent(event *Event) error {
 }
 
 func (b *CalDAVBackend) updateEvent(event *Event) error {
-	event.Updated = time.Now().UTC()
+	return b.updateEventWith(b.plugin.DB, event)
+}
+
+// updateEventIfMatch updates the event if the request preconditions still hold once the
+// stored event is locked, so that two clients with the same ETag can't both write
+func (b *CalDAVBackend) updateEventIfMatch(r *http.Request, event *Event) error {
+	tx, err := b.plugin.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("transaction error: %w", err)
+	}
+
+	if err = b.lockEvent(tx, r, event.Id); err == nil {
+		err = b.updateEventWith(tx, event)
+	}
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			b.plugin.API.LogError(rollbackErr.Error())
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteEventIfMatch deletes the event if the request preconditions still hold once the
+// stored event is locked
+func (b *CalDAVBackend) deleteEventIfMatch(r *http.Request, eventID string) error {
+	tx, err := b.plugin.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("transaction error: %w", err)
+	}
+
+	if err = b.lockEvent(tx, r, eventID); err == nil {
+		deleteBuilder := sq.Delete("calendar_events").
+			Where(sq.Eq{"id": eventID}).
+			PlaceholderFormat(b.plugin.GetDBPlaceholderFormat())
+		deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
+		_, err = tx.Exec(deleteSql, deleteArgs...)
+	}
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			b.plugin.API.LogError(rollbackErr.Error())
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// errPreconditionFailed is returned when If-Match or If-None-Match doesn't hold for the locked event
+var errPreconditionFailed = errors.New("precondition failed")
+
+// lockEvent reads the event FOR UPDATE in tx, like the REST update does, and checks the request
+// preconditions against it
+func (b *CalDAVBackend) lockEvent(tx *sqlx.Tx, r *http.Request, eventID string) error {
+	queryBuilder := sq.Select(
+		"id", "title", "description", "dt_start", "dt_end", "all_day", "timezone",
+		"created", "updated", "owner", "channel", "recurrent", "recurrence",
+		"color", "team", "visibility", "alert", "alert_time", "ical_data",
+	).
+		From("calendar_events").
+		Where(sq.Eq{"id": eventID}).
+		Suffix("FOR UPDATE").
+		PlaceholderFormat(b.plugin.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	var current Event
+	if err := tx.Get(&current, querySql, args...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) && !preconditionsMet(r, nil) {
+			return errPreconditionFailed
+		}
+		return fmt.Errorf("event not found: %w", err)
+	}
+
+	if !preconditionsMet(r, &current) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+func (b *CalDAVBackend) updateEventWith(db sqlx.Execer, event *Event) error {
+	event.Updated = time.Now().UTC().Truncate(time.Second)
 
 	updateFields := map[string]interface{}{
-		"title":       event.Title,
-		"description": event.Description,
-		"dt_start":    event.Start,
-		"dt_end":      event.End,
-		"recurrence":  event.Recurrence,
-		"recurrent":   event.Recurrent,
-		"updated":     event.Updated,
+		"title":             event.Title,
+		"description":       event.Description,
+		"dt_start":          event.Start,
+		"dt_end":            event.End,
+		"all_day":           event.AllDay,
+		"timezone":          event.Timezone,
+		"recurrence":        event.Recurrence,
+		"recurrent":         event.Recurrent,
+		"recurrence_end":    seriesEnd(event),
+		"next_notification": nextNotification(event, event.Updated.Truncate(time.Minute)),
+		"color":             event.Color,
+		"alert":             event.Alert,
+		"alert_time":        event.AlertTime,
+		"ical_data":         event.ICalData,
+		"updated":           event.Updated,
 	}
 
 	updateQueryBuilder := sq.Update("calendar_events").
@@ -934,7 +1421,7 @@ func (b *CalDAVBackend) updateEvent(event *Event) error {
 		return fmt.Errorf("SQL build error: %w", err)
 	}
 
-	_, dbErr := b.plugin.DB.Exec(updateSql, updateArgs...)
+	_, dbErr := db.Exec(updateSql, updateArgs...)
 	if dbErr != nil {
 		return fmt.Errorf("update error: %w", dbErr)
 	}
@@ -948,8 +1435,94 @@ func xmlEscape(s string) string {
 	return buf.String()
 }
 
-// eventETag generates a deterministic ETag based on event's Updated timestamp
+// eventETag generates a deterministic ETag from the event content and its Updated timestamp.
+// Times are hashed with second precision, the precision every supported database keeps,
+// so the value is the same for an event in memory and the one read back.
 func eventETag(event *Event) string {
-	// Use Updated timestamp for ETag - changes every time event is modified
-	return fmt.Sprintf("%x", event.Updated.UnixNano())
+	hash := sha256.New()
+
+	channel := ""
+	if event.Channel != nil {
+		channel = *event.Channel
+	}
+	color := ""
+	if event.Color != nil {
+		color = *event.Color
+	}
+	icalData := ""
+	if event.ICalData != nil {
+		icalData = *event.ICalData
+	}
+
+	for _, field := range []string{
+		event.Id,
+		event.Title,
+		event.Description,
+		strconv.FormatInt(event.Start.Unix(), 10),
+		strconv.FormatInt(event.End.Unix(), 10),
+		strconv.FormatInt(event.Updated.Unix(), 10),
+		event.Owner,
+		event.Team,
+		channel,
+		event.Recurrence,
+		color,
+		string(event.Visibility),
+		string(event.Alert),
+		icalData,
+	} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	// only hashed when set, so the ETags of older events stay the same
+	if event.AllDay {
+		hash.Write([]byte("all-day"))
+	}
+	if event.Timezone != "" {
+		hash.Write([]byte(event.Timezone))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// etagListMatches reports whether an If-Match / If-None-Match header value matches the etag.
+// Weak validators are compared as strong ones: the plugin never generates weak ETags.
+func etagListMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.Trim(strings.TrimPrefix(candidate, "W/"), `"`)
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditionsMet evaluates If-Match and If-None-Match against the current event,
+// nil if the resource doesn't exist (RFC 7232 3.1, 3.2)
+func preconditionsMet(r *http.Request, event *Event) bool {
+	etag := ""
+	if event != nil {
+		etag = eventETag(event)
+	}
+	return resourcePreconditionsMet(r, etag, event != nil)
+}
+
+// resourcePreconditionsMet evaluates If-Match and If-None-Match against the ETag of a resource
+func resourcePreconditionsMet(r *http.Request, etag string, exists bool) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !exists || !etagListMatches(ifMatch, etag) {
+			return false
+		}
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if exists && etagListMatches(ifNoneMatch, etag) {
+			return false
+		}
+	}
+
+	return true
 }
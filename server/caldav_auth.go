@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+const caldavRealm = "Mattermost Calendar"
+
+var errNoCredentials = errors.New("no credentials")
+
+// caldavContextPath is the CalDAV entry point of RFC 6764, the clients find the principal of the
+// user there
+func caldavContextPath() string {
+	return "/plugins/" + PluginId + "/caldav/"
+}
+
+// caldavUserPath returns the principal and calendar home of a user signed in with an app password
+func caldavUserPath(username string) string {
+	return "/plugins/" + PluginId + "/caldav/users/" + username
+}
+
+// setCalDAVHeaders sets the headers of every CalDAV response, Apple Calendar needs them for the
+// discovery
+func setCalDAVHeaders(w http.ResponseWriter) {
+	w.Header().Set("DAV", "1, 2, 3, calendar-access, calendar-auto-schedule, addressbook")
+	w.Header().Set("Server", "Mattermost-Calendar-CalDAV/1.0")
+}
+
+// serveCalDAVOptions answers OPTIONS without authentication, clients send it before their
+// credentials
+func serveCalDAVOptions(w http.ResponseWriter) {
+	w.Header().Set("Allow", "OPTIONS, PROPFIND, PROPPATCH, REPORT, GET, PUT, DELETE, POST, MKCALENDAR")
+	w.WriteHeader(http.StatusOK)
+}
+
+// requireBasicAuth asks the client for the username and the app password
+func requireBasicAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, caldavRealm))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// authenticateCalDAVBasic returns the user of a request with Basic auth. The username is the
+// Mattermost username and the password one of their iCal tokens of the caldav scope, an app
+// password.
+func (p *Plugin) authenticateCalDAVBasic(r *http.Request) (*model.User, *ICalToken, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username == "" {
+		return nil, nil, errNoCredentials
+	}
+	if len(password) != 64 {
+		return nil, nil, fmt.Errorf("invalid app password of %s", username)
+	}
+
+	user, appErr := p.API.GetUserByUsername(username)
+	if appErr != nil {
+		return nil, nil, fmt.Errorf("user %s not found", username)
+	}
+
+	icalToken, err := p.authenticateICalToken(password, r, ICalTokenScopeCalDAV)
+	if err != nil {
+		return nil, nil, err
+	}
+	if icalToken.UserID != user.Id {
+		return nil, nil, fmt.Errorf("app password isn't one of %s", username)
+	}
+	return user, icalToken, nil
+}
+
+// ServeCalDAVWellKnown redirects /.well-known/caldav and /.well-known/carddav to the context path. The Mattermost server
+// doesn't route /.well-known to plugins, a reverse proxy in front of it can redirect there.
+func (p *Plugin) ServeCalDAVWellKnown(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, caldavContextPath(), http.StatusMovedPermanently)
+}
+
+// ServeCalDAVContext serves the context path: it returns the principal, calendar home and address
+// book home of the user signed in
+func (p *Plugin) ServeCalDAVContext(w http.ResponseWriter, r *http.Request) {
+	setCalDAVHeaders(w)
+	if r.Method == http.MethodOptions {
+		serveCalDAVOptions(w)
+		return
+	}
+
+	user, _, err := p.authenticateCalDAVBasic(r)
+	if err != nil {
+		if !errors.Is(err, errNoCredentials) {
+			p.API.LogError("ServeCalDAVContext: " + err.Error())
+		}
+		requireBasicAuth(w)
+		return
+	}
+
+	userPath := caldavUserPath(user.Username) + "/"
+	if r.Method != "PROPFIND" {
+		http.Redirect(w, r, userPath, http.StatusMovedPermanently)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = w.Write([]byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:response>
+    <D:href>%s</D:href>
+    <D:propstat>
+      <D:prop>
+        <D:resourcetype>
+          <D:collection/>
+        </D:resourcetype>
+        <D:current-user-principal>
+          <D:href>%s</D:href>
+        </D:current-user-principal>
+        <C:calendar-home-set>
+          <D:href>%s</D:href>
+        </C:calendar-home-set>
+        <CR:addressbook-home-set xmlns:CR="urn:ietf:params:xml:ns:carddav">
+          <D:href>%s</D:href>
+        </CR:addressbook-home-set>
+      </D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>
+</D:multistatus>`, caldavContextPath(), userPath, userPath, userPath)))
+}
+
+// ServeCalDAVUser serves the calendars of the user signed in with an app password
+func (p *Plugin) ServeCalDAVUser(w http.ResponseWriter, r *http.Request) {
+	setCalDAVHeaders(w)
+	if r.Method == http.MethodOptions {
+		serveCalDAVOptions(w)
+		return
+	}
+
+	user, icalToken, err := p.authenticateCalDAVBasic(r)
+	if err != nil {
+		if !errors.Is(err, errNoCredentials) {
+			p.API.LogError("ServeCalDAVUser: " + err.Error())
+		}
+		requireBasicAuth(w)
+		return
+	}
+	if user.Username != mux.Vars(r)["username"] {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	calendarColor := "#1E90FFFF"
+	if icalToken.CalendarColor != nil {
+		calendarColor = *icalToken.CalendarColor
+	}
+	backend := NewCalDAVBackend(p, user.Id, "", calendarColor)
+	backend.basePath = caldavUserPath(user.Username)
+	backend.tokenId = icalToken.Id
+	backend.ServeHTTP(w, r)
+}
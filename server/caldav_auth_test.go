@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectAppPassword expects the lookup of the app password, a CalDAV token of test-user
+func expectAppPassword(dbMock sqlmock.Sqlmock, password string) {
+	prefix, salt, hash := hashedICalToken(password)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_ical_tokens WHERE token_prefix = $1")).
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_prefix", "token_salt", "token_hash", "user_id", "label", "scope", "created"}).
+			AddRow("token-1", prefix, salt, hash, "test-user", "Phone", ICalTokenScopeCalDAV, time.Now().UTC()))
+}
+
+func TestServeCalDAVWellKnown(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/.well-known/caldav"
+	calPlugin, _, _, closeDB := newTemplateTestPlugin(t, "PROPFIND", path)
+	defer closeDB()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusMovedPermanently, w.Code)
+	assert.Equal("/plugins/"+PluginId+"/caldav/", w.Header().Get("Location"))
+}
+
+func TestServeCalDAVContext(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/caldav/"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, "PROPFIND", path)
+	defer closeDB()
+	api.On("GetUserByUsername", "alice").Return(&model.User{Id: "test-user", Username: "alice"}, nil)
+
+	password := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+
+	// clients send their credentials once asked for them
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Contains(w.Header().Get("WWW-Authenticate"), "Basic realm=")
+
+	expectAppPassword(dbMock, password)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PROPFIND", path, strings.NewReader(`<d:propfind xmlns:d="DAV:"><d:prop><d:current-user-principal/></d:prop></d:propfind>`))
+	r.SetBasicAuth("alice", password)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusMultiStatus, w.Code)
+	userPath := "/plugins/" + PluginId + "/caldav/users/alice/"
+	assert.Contains(w.Body.String(), "<D:current-user-principal>\n          <D:href>"+userPath+"</D:href>")
+	assert.Contains(w.Body.String(), "<C:calendar-home-set>\n          <D:href>"+userPath+"</D:href>")
+}
+
+func TestServeCalDAVUser_OtherUser(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/caldav/users/bob/calendar/"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, "PROPFIND", path)
+	defer closeDB()
+	api.On("GetUserByUsername", "alice").Return(&model.User{Id: "test-user", Username: "alice"}, nil)
+
+	password := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	expectAppPassword(dbMock, password)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", path, nil)
+	r.SetBasicAuth("alice", password)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestAuthenticateCalDAVBasic(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	api.On("GetUserByUsername", "bob").Return(&model.User{Id: "bob-id", Username: "bob"}, nil)
+	api.On("GetUserByUsername", "nobody").Return(nil, &model.AppError{Message: "not found"})
+
+	password := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, _, err := calPlugin.authenticateCalDAVBasic(r)
+	assert.Equal(errNoCredentials, err)
+
+	r.SetBasicAuth("bob", "short")
+	_, _, err = calPlugin.authenticateCalDAVBasic(r)
+	assert.EqualError(err, "invalid app password of bob")
+
+	r.SetBasicAuth("nobody", password)
+	_, _, err = calPlugin.authenticateCalDAVBasic(r)
+	assert.EqualError(err, "user nobody not found")
+
+	// the token of test-user isn't a password of bob
+	expectAppPassword(dbMock, password)
+	r.SetBasicAuth("bob", password)
+	_, _, err = calPlugin.authenticateCalDAVBasic(r)
+	assert.EqualError(err, "app password isn't one of bob")
+}
+
+func TestCalDAVBackendResourcePath(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := NewCalDAVBackend(&Plugin{}, "test-user", "", "#1E90FFFF")
+	backend.basePath = caldavUserPath("inbox")
+
+	// the username isn't taken for a collection
+	assert.False(backend.isInboxPath("/caldav/users/inbox/"))
+	assert.False(backend.isCalendarPath("/caldav/users/inbox/"))
+	assert.True(backend.isInboxPath("/caldav/users/inbox/inbox/"))
+	assert.True(backend.isCalendarPath("/plugins/" + PluginId + "/caldav/users/inbox/calendar/event-1.ics"))
+	assert.Equal("/outbox/", backend.resourcePath("/caldav/users/inbox/outbox/"))
+}
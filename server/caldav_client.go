@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// caldavClientMaxBody bounds the responses read from an external server
+	caldavClientMaxBody = 10 << 20
+	// caldavMultigetSize is how many objects a calendar-multiget REPORT asks for at once
+	caldavMultigetSize = 50
+)
+
+const caldavClientTimeout = 30 * time.Second
+
+var (
+	// caldavHTTPClients are the clients of the external servers by the allowed internal connections
+	// they were made for, they keep their connections between the syncs
+	caldavHTTPClients     = map[string]*http.Client{}
+	caldavHTTPClientsLock sync.Mutex
+)
+
+var (
+	// errSyncTokenInvalid is returned when the server doesn't know the sync token or doesn't
+	// support sync-collection, the collection has to be listed
+	errSyncTokenInvalid = errors.New("sync token not accepted")
+	// errRemoteChanged is returned when an If-Match or If-None-Match of a write failed
+	errRemoteChanged = errors.New("remote object changed")
+	// errInternalDestination is returned for the addresses of the internal network the admin didn't
+	// allow, the calendar URLs are chosen by the users
+	errInternalDestination = errors.New("address on an internal network")
+)
+
+// internalIP reports whether the address is a loopback, link-local, private or unspecified one
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// allowedInternal are the hosts and networks of ServiceSettings.AllowedUntrustedInternalConnections,
+// the internal destinations the requests of the users may reach
+type allowedInternal struct {
+	hosts    []string
+	networks []*net.IPNet
+}
+
+// parseAllowedInternal reads the space or comma separated hostnames, addresses and CIDR ranges
+func parseAllowedInternal(allowed string) *allowedInternal {
+	a := &allowedInternal{}
+	for _, entry := range strings.FieldsFunc(allowed, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			a.networks = append(a.networks, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			a.networks = append(a.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			a.hosts = append(a.hosts, strings.ToLower(entry))
+		}
+	}
+	return a
+}
+
+// allowsHost reports whether the hostname is allowed whatever it resolves to
+func (a *allowedInternal) allowsHost(host string) bool {
+	return contains(a.hosts, strings.ToLower(host))
+}
+
+// allowsIP reports whether the address may be connected to
+func (a *allowedInternal) allowsIP(ip net.IP) bool {
+	if !internalIP(ip) {
+		return true
+	}
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// caldavHTTPClient returns the client of the external servers. The addresses are checked once
+// resolved, right before connecting, so a hostname can't point to the internal network either.
+func caldavHTTPClient(allowed string) *http.Client {
+	caldavHTTPClientsLock.Lock()
+	defer caldavHTTPClientsLock.Unlock()
+	if client, ok := caldavHTTPClients[allowed]; ok {
+		return client
+	}
+
+	filter := parseAllowedInternal(allowed)
+	trusted := &net.Dialer{Timeout: caldavClientTimeout}
+	untrusted := &net.Dialer{
+		Timeout: caldavClientTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !filter.allowsIP(ip) {
+				return fmt.Errorf("%s: %w", host, errInternalDestination)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(address); err == nil && filter.allowsHost(host) {
+			return trusted.DialContext(ctx, network, address)
+		}
+		return untrusted.DialContext(ctx, network, address)
+	}
+
+	client := &http.Client{Timeout: caldavClientTimeout, Transport: transport}
+	caldavHTTPClients[allowed] = client
+	return client
+}
+
+// caldavClient talks to a calendar collection on an external CalDAV server
+type caldavClient struct {
+	collection *url.URL
+	username   string
+	password   string
+	http       *http.Client
+}
+
+// remoteObject is a calendar object resource of the external collection, Data is only set by
+// multiget
+type remoteObject struct {
+	Href string
+	ETag string
+	Data string
+}
+
+// remoteCollection are the properties of the external calendar collection
+type remoteCollection struct {
+	IsCalendar bool
+	CTag       string
+	SyncToken  string
+}
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+	SyncToken string        `xml:"DAV: sync-token"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Status    string        `xml:"DAV: status"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+type davProp struct {
+	ResourceType *struct {
+		Calendar *struct{} `xml:"urn:ietf:params:xml:ns:caldav calendar"`
+	} `xml:"DAV: resourcetype"`
+	GetETag      string `xml:"DAV: getetag"`
+	GetCTag      string `xml:"http://calendarserver.org/ns/ getctag"`
+	SyncToken    string `xml:"DAV: sync-token"`
+	CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+}
+
+// found returns the properties of the response with a 200 status
+func (r *davResponse) found() *davProp {
+	for i := range r.Propstats {
+		if strings.Contains(r.Propstats[i].Status, " 200 ") {
+			return &r.Propstats[i].Prop
+		}
+	}
+	return nil
+}
+
+// newCalDAVClient returns the client of the collection, allowed are the internal destinations it may
+// reach, see allowedInternal
+func newCalDAVClient(collectionURL, username, password, allowed string) (*caldavClient, error) {
+	collection, err := url.Parse(collectionURL)
+	if err != nil {
+		return nil, err
+	}
+	if (collection.Scheme != "https" && collection.Scheme != "http") || collection.Host == "" {
+		return nil, fmt.Errorf("invalid calendar URL: %s", collectionURL)
+	}
+	filter := parseAllowedInternal(allowed)
+	if ip := net.ParseIP(collection.Hostname()); ip != nil && !filter.allowsIP(ip) {
+		return nil, fmt.Errorf("%s: %w", collection.Hostname(), errInternalDestination)
+	}
+	if !strings.HasSuffix(collection.Path, "/") {
+		collection.Path += "/"
+	}
+
+	return &caldavClient{
+		collection: collection,
+		username:   username,
+		password:   password,
+		http:       caldavHTTPClient(allowed),
+	}, nil
+}
+
+// href normalizes an href of the server to the escaped path used as key of the objects
+func (c *caldavClient) href(href string) string {
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return href
+	}
+	return c.collection.ResolveReference(ref).EscapedPath()
+}
+
+// isCollection reports whether the href is the collection itself or a collection in it
+func (c *caldavClient) isCollection(href string) bool {
+	return strings.HasSuffix(href, "/") || href == strings.TrimSuffix(c.collection.EscapedPath(), "/")
+}
+
+// objectHref returns the href of a new calendar object in the collection
+func (c *caldavClient) objectHref(name string) string {
+	return c.collection.EscapedPath() + url.PathEscape(name) + ".ics"
+}
+
+func (c *caldavClient) do(method, href string, body []byte, headers map[string]string) (*http.Response, []byte, error) {
+	target := *c.collection
+	if href != "" {
+		ref, err := url.Parse(href)
+		if err != nil {
+			return nil, nil, err
+		}
+		target = *c.collection.ResolveReference(ref)
+	}
+
+	request, err := http.NewRequest(method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.username != "" || c.password != "" {
+		request.SetBasicAuth(c.username, c.password)
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, caldavClientMaxBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	return response, responseBody, nil
+}
+
+// multistatus sends a PROPFIND or REPORT and parses its 207 response
+func (c *caldavClient) multistatus(method, depth, body string) (*davMultistatus, int, error) {
+	response, responseBody, err := c.do(method, "", []byte(body), map[string]string{
+		"Content-Type": "application/xml; charset=utf-8",
+		"Depth":        depth,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.StatusCode != http.StatusMultiStatus {
+		return nil, response.StatusCode, fmt.Errorf("%s: unexpected status %s", method, response.Status)
+	}
+
+	var result davMultistatus
+	if err = xml.Unmarshal(responseBody, &result); err != nil {
+		return nil, response.StatusCode, fmt.Errorf("%s: invalid response: %w", method, err)
+	}
+	return &result, response.StatusCode, nil
+}
+
+// properties returns the resource type, getctag and sync-token of the collection
+func (c *caldavClient) properties() (*remoteCollection, error) {
+	result, _, err := c.multistatus("PROPFIND", "0", `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:CS="http://calendarserver.org/ns/">
+  <D:prop><D:resourcetype/><CS:getctag/><D:sync-token/></D:prop>
+</D:propfind>`)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := &remoteCollection{}
+	for i := range result.Responses {
+		prop := result.Responses[i].found()
+		if prop == nil {
+			continue
+		}
+		collection.IsCalendar = prop.ResourceType != nil && prop.ResourceType.Calendar != nil
+		collection.CTag = strings.TrimSpace(prop.GetCTag)
+		collection.SyncToken = strings.TrimSpace(prop.SyncToken)
+	}
+	return collection, nil
+}
+
+// list returns the href and ETag of every object of the collection
+func (c *caldavClient) list() ([]remoteObject, error) {
+	result, _, err := c.multistatus("PROPFIND", "1", `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop><D:resourcetype/><D:getetag/></D:prop>
+</D:propfind>`)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []remoteObject
+	for i := range result.Responses {
+		href := c.href(result.Responses[i].Href)
+		prop := result.Responses[i].found()
+		if prop == nil || c.isCollection(href) {
+			continue
+		}
+		objects = append(objects, remoteObject{Href: href, ETag: prop.GetETag})
+	}
+	return objects, nil
+}
+
+// syncCollection returns the objects changed and the hrefs removed since the token (RFC 6578)
+func (c *caldavClient) syncCollection(token string) ([]remoteObject, []string, string, error) {
+	result, status, err := c.multistatus("REPORT", "0", fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<D:sync-collection xmlns:D="DAV:">
+  <D:sync-token>%s</D:sync-token>
+  <D:sync-level>1</D:sync-level>
+  <D:prop><D:getetag/></D:prop>
+</D:sync-collection>`, xmlEscape(token)))
+	if err != nil {
+		if status >= 400 && status < 600 && status != http.StatusUnauthorized {
+			return nil, nil, "", errSyncTokenInvalid
+		}
+		return nil, nil, "", err
+	}
+
+	var changed []remoteObject
+	var removed []string
+	for i := range result.Responses {
+		href := c.href(result.Responses[i].Href)
+		if c.isCollection(href) {
+			continue
+		}
+		if strings.Contains(result.Responses[i].Status, " 404 ") {
+			removed = append(removed, href)
+			continue
+		}
+		if prop := result.Responses[i].found(); prop != nil {
+			changed = append(changed, remoteObject{Href: href, ETag: prop.GetETag})
+		}
+	}
+	return changed, removed, result.SyncToken, nil
+}
+
+// multiget returns the calendar data of the objects, the missing ones are left out
+func (c *caldavClient) multiget(hrefs []string) ([]remoteObject, error) {
+	var objects []remoteObject
+	for start := 0; start < len(hrefs); start += caldavMultigetSize {
+		end := start + caldavMultigetSize
+		if end > len(hrefs) {
+			end = len(hrefs)
+		}
+
+		var body strings.Builder
+		body.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><D:getetag/><C:calendar-data/></D:prop>`)
+		for _, href := range hrefs[start:end] {
+			body.WriteString("\n  <D:href>" + xmlEscape(href) + "</D:href>")
+		}
+		body.WriteString("\n</C:calendar-multiget>")
+
+		result, _, err := c.multistatus("REPORT", "1", body.String())
+		if err != nil {
+			return nil, err
+		}
+		for i := range result.Responses {
+			if prop := result.Responses[i].found(); prop != nil && prop.CalendarData != "" {
+				objects = append(objects, remoteObject{
+					Href: c.href(result.Responses[i].Href),
+					ETag: prop.GetETag,
+					Data: prop.CalendarData,
+				})
+			}
+		}
+	}
+	return objects, nil
+}
+
+// put writes a calendar object. An empty etag creates it, otherwise the object must still have
+// that ETag. The new ETag is returned when the server sends it.
+func (c *caldavClient) put(href, data, etag string) (string, error) {
+	headers := map[string]string{"Content-Type": "text/calendar; charset=utf-8"}
+	if etag == "" {
+		headers["If-None-Match"] = "*"
+	} else {
+		headers["If-Match"] = etag
+	}
+
+	response, _, err := c.do(http.MethodPut, href, []byte(data), headers)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case response.StatusCode == http.StatusPreconditionFailed:
+		return "", errRemoteChanged
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return "", fmt.Errorf("PUT %s: unexpected status %s", href, response.Status)
+	}
+	return response.Header.Get("ETag"), nil
+}
+
+// delete removes a calendar object if it still has the ETag, a missing object isn't an error
+func (c *caldavClient) delete(href, etag string) error {
+	headers := map[string]string{}
+	if etag != "" {
+		headers["If-Match"] = etag
+	}
+
+	response, _, err := c.do(http.MethodDelete, href, nil, headers)
+	if err != nil {
+		return err
+	}
+	switch {
+	case response.StatusCode == http.StatusPreconditionFailed:
+		return errRemoteChanged
+	case response.StatusCode == http.StatusNotFound:
+		return nil
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return fmt.Errorf("DELETE %s: unexpected status %s", href, response.Status)
+	}
+	return nil
+}
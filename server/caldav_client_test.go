@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCollectionPath = "/calendars/alice/work/"
+
+type testRemoteObject struct {
+	etag string
+	data string
+}
+
+type testRemoteChange struct {
+	version int
+	href    string
+}
+
+// testCalDAVServer is a stand-in for an external CalDAV server with one calendar collection
+type testCalDAVServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string]testRemoteObject
+	changes  []testRemoteChange
+	version  int
+	noSync   bool
+	requests []string
+}
+
+var testHrefPattern = regexp.MustCompile(`<D:href>([^<]*)</D:href>`)
+
+func newTestCalDAVServer() *testCalDAVServer {
+	s := &testCalDAVServer{objects: map[string]testRemoteObject{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// testAllowedInternal allows the test servers, they listen on the loopback
+const testAllowedInternal = "127.0.0.1"
+
+func (s *testCalDAVServer) collectionURL() string {
+	return s.URL + testCollectionPath
+}
+
+// store writes an object as a client of the server would
+func (s *testCalDAVServer) store(name, data string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(testCollectionPath+name, data)
+}
+
+func (s *testCalDAVServer) write(href, data string) string {
+	s.version++
+	etag := `"v` + strconv.Itoa(s.version) + `"`
+	s.objects[href] = testRemoteObject{etag: etag, data: data}
+	s.changes = append(s.changes, testRemoteChange{version: s.version, href: href})
+	return etag
+}
+
+func (s *testCalDAVServer) remove(href string) {
+	s.version++
+	delete(s.objects, href)
+	s.changes = append(s.changes, testRemoteChange{version: s.version, href: href})
+}
+
+func (s *testCalDAVServer) object(name string) (testRemoteObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[testCollectionPath+name]
+	return object, ok
+}
+
+func (s *testCalDAVServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	if username, password, ok := r.BasicAuth(); !ok || username != "alice" || password != "app-password" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if r.URL.Path == testCollectionPath {
+		switch {
+		case r.Method == "PROPFIND" && r.Header.Get("Depth") == "0":
+			s.writeMultistatus(w, fmt.Sprintf(`<D:response><D:href>%s</D:href><D:propstat><D:prop>`+
+				`<D:resourcetype><D:collection/><C:calendar/></D:resourcetype>`+
+				`<CS:getctag>ctag-%d</CS:getctag><D:sync-token>sync-%d</D:sync-token>`+
+				`</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`, testCollectionPath, s.version, s.version), "")
+		case r.Method == "PROPFIND":
+			responses := fmt.Sprintf(`<D:response><D:href>%s</D:href><D:propstat><D:prop>`+
+				`<D:resourcetype><D:collection/><C:calendar/></D:resourcetype>`+
+				`</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`, testCollectionPath)
+			for href, object := range s.objects {
+				responses += s.etagResponse(href, object.etag)
+			}
+			s.writeMultistatus(w, responses, "")
+		case r.Method == "REPORT" && strings.Contains(string(body), "sync-collection"):
+			s.syncCollection(w, string(body))
+		case r.Method == "REPORT":
+			responses := ""
+			for _, match := range testHrefPattern.FindAllStringSubmatch(string(body), -1) {
+				if object, ok := s.objects[match[1]]; ok {
+					responses += fmt.Sprintf(`<D:response><D:href>%s</D:href><D:propstat><D:prop>`+
+						`<D:getetag>%s</D:getetag><C:calendar-data>%s</C:calendar-data>`+
+						`</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`,
+						match[1], xmlEscape(object.etag), xmlEscape(object.data))
+				}
+			}
+			s.writeMultistatus(w, responses, "")
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	current, exists := s.objects[r.URL.Path]
+	switch r.Method {
+	case http.MethodPut:
+		if (r.Header.Get("If-None-Match") == "*" && exists) ||
+			(r.Header.Get("If-Match") != "" && (!exists || r.Header.Get("If-Match") != current.etag)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("ETag", s.write(r.URL.Path, string(body)))
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodDelete:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != current.etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		s.remove(r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// syncCollection reports the objects changed since the token, the removed ones with a 404
+func (s *testCalDAVServer) syncCollection(w http.ResponseWriter, body string) {
+	match := regexp.MustCompile(`<D:sync-token>sync-(\d+)</D:sync-token>`).FindStringSubmatch(body)
+	if s.noSync || match == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	since, _ := strconv.Atoi(match[1])
+
+	reported := map[string]bool{}
+	responses := ""
+	for _, change := range s.changes {
+		if change.version <= since || reported[change.href] {
+			continue
+		}
+		reported[change.href] = true
+		if object, ok := s.objects[change.href]; ok {
+			responses += s.etagResponse(change.href, object.etag)
+		} else {
+			responses += fmt.Sprintf(`<D:response><D:href>%s</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>`, change.href)
+		}
+	}
+	s.writeMultistatus(w, responses, fmt.Sprintf("sync-%d", s.version))
+}
+
+func (s *testCalDAVServer) etagResponse(href, etag string) string {
+	return fmt.Sprintf(`<D:response><D:href>%s</D:href><D:propstat><D:prop><D:getetag>%s</D:getetag>`+
+		`</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`, href, xmlEscape(etag))
+}
+
+func (s *testCalDAVServer) writeMultistatus(w http.ResponseWriter, responses, syncToken string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	token := ""
+	if syncToken != "" {
+		token = "<D:sync-token>" + syncToken + "</D:sync-token>"
+	}
+	_, _ = io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+
+		`<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/">`+
+		responses+token+`</D:multistatus>`)
+}
+
+func TestNewCalDAVClient(t *testing.T) {
+	assert := assert.New(t)
+
+	client, err := newCalDAVClient("https://dav.example.com/calendars/alice/work", "alice", "secret", "")
+	assert.Nil(err)
+	assert.Equal("/calendars/alice/work/", client.collection.Path)
+	assert.Equal("/calendars/alice/work/event%201.ics", client.objectHref("event 1"))
+	assert.Equal("/calendars/alice/work/a.ics", client.href("https://dav.example.com/calendars/alice/work/a.ics"))
+	assert.Equal("/calendars/alice/work/a.ics", client.href("a.ics"))
+	assert.True(client.isCollection("/calendars/alice/work/"))
+	assert.True(client.isCollection("/calendars/alice/work"))
+
+	_, err = newCalDAVClient("ftp://dav.example.com/calendars/", "alice", "secret", "")
+	assert.NotNil(err)
+	_, err = newCalDAVClient("/calendars/", "alice", "secret", "")
+	assert.NotNil(err)
+}
+
+func TestCalDAVClient_InternalDestination(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestCalDAVServer()
+	defer server.Close()
+
+	// addresses of the internal network aren't reached unless the admin allows them
+	for _, calendarURL := range []string{
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.1.2.3/calendars/",
+		"http://[::1]:8065/calendars/",
+		server.collectionURL(),
+	} {
+		_, err := newCalDAVClient(calendarURL, "alice", "secret", "")
+		assert.ErrorIs(err, errInternalDestination, calendarURL)
+	}
+
+	// checked again once resolved, a hostname can point to the loopback
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	localhostURL := fmt.Sprintf("http://localhost:%d%s", port, testCollectionPath)
+	client, err := newCalDAVClient(localhostURL, "alice", "app-password", "")
+	assert.Nil(err)
+	_, err = client.properties()
+	assert.ErrorIs(err, errInternalDestination)
+
+	// allowed by hostname, address or range
+	for _, allowed := range []string{"localhost", "127.0.0.1", "10.0.0.0/8 127.0.0.0/8"} {
+		client, err = newCalDAVClient(localhostURL, "alice", "app-password", allowed)
+		assert.Nil(err)
+		_, err = client.properties()
+		assert.Nil(err, allowed)
+	}
+}
+
+func TestCalDAVClient_Properties(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestCalDAVServer()
+	defer server.Close()
+	server.store("a.ics", testExternalEventICal)
+
+	client, _ := newCalDAVClient(server.collectionURL(), "alice", "app-password", testAllowedInternal)
+	collection, err := client.properties()
+	assert.Nil(err)
+	assert.True(collection.IsCalendar)
+	assert.Equal("ctag-1", collection.CTag)
+	assert.Equal("sync-1", collection.SyncToken)
+
+	unauthorized, _ := newCalDAVClient(server.collectionURL(), "alice", "wrong", testAllowedInternal)
+	_, err = unauthorized.properties()
+	assert.NotNil(err)
+}
+
+func TestCalDAVClient_ListAndMultiget(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestCalDAVServer()
+	defer server.Close()
+	etag := server.store("a.ics", testExternalEventICal)
+
+	client, _ := newCalDAVClient(server.collectionURL(), "alice", "app-password", testAllowedInternal)
+	listed, err := client.list()
+	assert.Nil(err)
+	assert.Equal([]remoteObject{{Href: testCollectionPath + "a.ics", ETag: etag}}, listed)
+
+	fetched, err := client.multiget([]string{testCollectionPath + "a.ics", testCollectionPath + "missing.ics"})
+	assert.Nil(err)
+	assert.Len(fetched, 1)
+	assert.Equal(etag, fetched[0].ETag)
+	assert.Contains(fetched[0].Data, "SUMMARY:Dentist")
+}
+
+func TestCalDAVClient_SyncCollection(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestCalDAVServer()
+	defer server.Close()
+	server.store("a.ics", testExternalEventICal)
+	server.store("b.ics", testExternalEventICal)
+
+	client, _ := newCalDAVClient(server.collectionURL(), "alice", "app-password", testAllowedInternal)
+	changed, removed, token, err := client.syncCollection("sync-1")
+	assert.Nil(err)
+	assert.Len(changed, 1)
+	assert.Equal(testCollectionPath+"b.ics", changed[0].Href)
+	assert.Empty(removed)
+	assert.Equal("sync-2", token)
+
+	assert.Nil(client.delete(testCollectionPath+"a.ics", ""))
+	changed, removed, token, err = client.syncCollection(token)
+	assert.Nil(err)
+	assert.Empty(changed)
+	assert.Equal([]string{testCollectionPath + "a.ics"}, removed)
+	assert.Equal("sync-3", token)
+
+	server.noSync = true
+	_, _, _, err = client.syncCollection(token)
+	assert.ErrorIs(err, errSyncTokenInvalid)
+}
+
+func TestCalDAVClient_WritePreconditions(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestCalDAVServer()
+	defer server.Close()
+
+	client, _ := newCalDAVClient(server.collectionURL(), "alice", "app-password", testAllowedInternal)
+	href := client.objectHref("event-1")
+
+	etag, err := client.put(href, testExternalEventICal, "")
+	assert.Nil(err)
+	assert.NotEmpty(etag)
+
+	_, err = client.put(href, testExternalEventICal, "")
+	assert.ErrorIs(err, errRemoteChanged)
+
+	updated, err := client.put(href, testExternalEventICal, etag)
+	assert.Nil(err)
+	assert.NotEqual(etag, updated)
+
+	_, err = client.put(href, testExternalEventICal, etag)
+	assert.ErrorIs(err, errRemoteChanged)
+	assert.ErrorIs(client.delete(href, etag), errRemoteChanged)
+
+	assert.Nil(client.delete(href, updated))
+	assert.Nil(client.delete(href, ""))
+}
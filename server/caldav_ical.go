@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// eventColors maps the CSS3 color names of the iCalendar COLOR property (RFC 7986 5.9)
+// to the colors offered by the event dialog
+var eventColors = map[string]string{
+	"red":    "#F2B3B3",
+	"yellow": "#FCECBE",
+	"green":  "#B6D9C7",
+	"blue":   "#B3E1F7",
+	"silver": "#D0D0D0",
+}
+
+var hexColorRegexp = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// parseEventColor returns the event color of a COLOR value, "" if it has none
+func parseEventColor(value string) string {
+	value = strings.TrimSpace(value)
+	if hexColorRegexp.MatchString(value) {
+		return strings.ToUpper(value)
+	}
+	return eventColors[strings.ToLower(value)]
+}
+
+// formatEventColor returns the COLOR value of an event color, its CSS3 name when there is one
+func formatEventColor(color string) string {
+	for name, hex := range eventColors {
+		if strings.EqualFold(hex, color) {
+			return name
+		}
+	}
+	return color
+}
+
+// categoriesColor returns the color of an Outlook style color category, e.g. "Red Category"
+func categoriesColor(vevent *ics.VEvent) string {
+	for _, property := range vevent.Properties {
+		if !strings.EqualFold(property.IANAToken, string(ics.ComponentPropertyCategories)) {
+			continue
+		}
+		for _, category := range strings.Split(property.Value, ",") {
+			name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(category)), " category")
+			if color, ok := eventColors[name]; ok {
+				return color
+			}
+		}
+	}
+	return ""
+}
+
+// alarmAlert returns the alert a VALARM corresponds to, EventAlertNone if there is no exact equivalent
+func alarmAlert(alarm ics.Component) EventAlert {
+	trigger := componentProperty(alarm, ics.ComponentPropertyTrigger)
+	if trigger == nil {
+		return EventAlertNone
+	}
+	if value := trigger.ICalParameters[string(ics.ParameterValue)]; len(value) > 0 && !strings.EqualFold(value[0], "DURATION") {
+		return EventAlertNone
+	}
+	if related := trigger.ICalParameters[string(ics.ParameterRelated)]; len(related) > 0 && strings.EqualFold(related[0], "END") {
+		return EventAlertNone
+	}
+
+	before, err := parseICalDuration(trigger.Value)
+	if err != nil || before >= 0 {
+		return EventAlertNone
+	}
+
+	for alert, duration := range EventAlertDurationMap {
+		if alert != EventAlertNone && duration == -before {
+			return alert
+		}
+	}
+	return EventAlertNone
+}
+
+// veventAlert returns the alert of the first VALARM that has one
+func veventAlert(vevent *ics.VEvent) EventAlert {
+	for _, alarm := range vevent.Alarms() {
+		if alert := alarmAlert(alarm); alert != EventAlertNone {
+			return alert
+		}
+	}
+	return EventAlertNone
+}
+
+// formatICalDuration formats a duration as an RFC 5545 DURATION value such as -PT15M or P1W
+func formatICalDuration(d time.Duration) string {
+	var buf strings.Builder
+	if d < 0 {
+		buf.WriteByte('-')
+		d = -d
+	}
+	buf.WriteByte('P')
+
+	day := 24 * time.Hour
+	if d >= day && d%(7*day) == 0 {
+		fmt.Fprintf(&buf, "%dW", d/(7*day))
+		return buf.String()
+	}
+	if d >= day {
+		fmt.Fprintf(&buf, "%dD", d/day)
+		d %= day
+	}
+	if d == 0 && buf.Len() > 2 {
+		return buf.String()
+	}
+
+	buf.WriteByte('T')
+	if d >= time.Hour {
+		fmt.Fprintf(&buf, "%dH", d/time.Hour)
+		d %= time.Hour
+	}
+	if d >= time.Minute {
+		fmt.Fprintf(&buf, "%dM", d/time.Minute)
+		d %= time.Minute
+	}
+	if d > 0 || strings.HasSuffix(buf.String(), "T") {
+		fmt.Fprintf(&buf, "%dS", d/time.Second)
+	}
+	return buf.String()
+}
+
+// removeProperties drops every property with one of the names from the component
+func removeProperties(component *ics.ComponentBase, names ...ics.ComponentProperty) {
+	properties := component.Properties[:0]
+	for _, property := range component.Properties {
+		remove := false
+		for _, name := range names {
+			if strings.EqualFold(property.IANAToken, string(name)) {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			properties = append(properties, property)
+		}
+	}
+	component.Properties = properties
+}
+
+// masterEvent returns the VEVENT that isn't a recurrence override, nil if there is none
+func masterEvent(cal *ics.Calendar) *ics.VEvent {
+	for _, vevent := range cal.Events() {
+		if vevent.GetProperty(componentPropertyRecurrenceId) == nil {
+			return vevent
+		}
+	}
+	return nil
+}
+
+// splitListProperties writes every CATEGORIES and RESOURCES value as a property of its own.
+// The ics package unescapes list values when parsing and escapes the separating commas when
+// serializing, which would turn a list into a single value.
+func splitListProperties(cal *ics.Calendar) {
+	for _, component := range cal.Components {
+		var base *ics.ComponentBase
+		switch c := component.(type) {
+		case *ics.VEvent:
+			base = &c.ComponentBase
+		case *ics.VTodo:
+			base = &c.ComponentBase
+		case *ics.VJournal:
+			base = &c.ComponentBase
+		default:
+			continue
+		}
+
+		var properties []ics.IANAProperty
+		for _, property := range base.Properties {
+			token := strings.ToUpper(property.IANAToken)
+			if token != string(ics.ComponentPropertyCategories) && token != string(ics.ComponentPropertyResources) {
+				properties = append(properties, property)
+				continue
+			}
+			for _, value := range strings.Split(property.Value, ",") {
+				single := property
+				single.Value = value
+				properties = append(properties, single)
+			}
+		}
+		base.Properties = properties
+	}
+}
+
+// calendarObjectData serializes a calendar for storage, without the iTIP METHOD
+func calendarObjectData(cal *ics.Calendar) string {
+	splitListProperties(cal)
+
+	properties := cal.CalendarProperties[:0]
+	for _, property := range cal.CalendarProperties {
+		if !strings.EqualFold(property.IANAToken, string(ics.PropertyMethod)) {
+			properties = append(properties, property)
+		}
+	}
+	cal.CalendarProperties = properties
+
+	return cal.Serialize()
+}
+
+// storedCalendar parses the calendar object the client saved with the event, nil if there is none
+func (b *CalDAVBackend) storedCalendar(event *Event) *ics.Calendar {
+	if event.ICalData == nil || *event.ICalData == "" {
+		return nil
+	}
+
+	cal, err := ics.ParseCalendar(strings.NewReader(*event.ICalData))
+	if err != nil || masterEvent(cal) == nil {
+		b.plugin.API.LogWarn("CalDAV: can't parse stored calendar data", "eventID", event.Id)
+		return nil
+	}
+
+	b.loadTimezones(cal)
+	return cal
+}
+
+// isDateValue reports whether a property holds a DATE rather than a DATE-TIME
+func isDateValue(property *ics.IANAProperty) bool {
+	if value := property.ICalParameters[string(ics.ParameterValue)]; len(value) > 0 {
+		return strings.EqualFold(value[0], "DATE")
+	}
+	return len(property.Value) == len(iCalDateLayout)
+}
+
+// setEventTiming writes DTSTART and DTEND, as DATE values for all-day events and in the event's
+// timezone for the others, so clients expand its recurrence in that zone too
+func setEventTiming(vevent *ics.VEvent, event *Event) {
+	if event.AllDay {
+		vevent.SetAllDayStartAt(event.Start)
+		vevent.SetAllDayEndAt(event.End)
+		return
+	}
+
+	if loc := loadLocation(event.Timezone); loc != nil && !isUTC(loc) {
+		tzid := &ics.KeyValues{Key: string(ics.ParameterTzid), Value: []string{loc.String()}}
+		vevent.SetProperty(ics.ComponentPropertyDtStart, event.Start.In(loc).Format(iCalLocalDateTimeLayout), tzid)
+		vevent.SetProperty(ics.ComponentPropertyDtEnd, event.End.In(loc).Format(iCalLocalDateTimeLayout), tzid)
+		return
+	}
+
+	vevent.SetStartAt(event.Start)
+	vevent.SetEndAt(event.End)
+}
+
+// applyTiming writes the event times unless the stored DTSTART and DTEND/DURATION still match,
+// keeping TZID, DATE values and DURATION the client used
+func (b *CalDAVBackend) applyTiming(vevent *ics.VEvent, event *Event) {
+	dtstart := vevent.GetProperty(ics.ComponentPropertyDtStart)
+	isDate := dtstart != nil && isDateValue(dtstart)
+
+	start, duration, ok := b.componentTiming(vevent)
+	startMatches := ok && start.Equal(event.Start) && isDate == event.AllDay
+	if startMatches && start.Add(duration).Equal(event.End) {
+		return
+	}
+
+	removeProperties(&vevent.ComponentBase, componentPropertyDuration)
+
+	// DTSTART and DTEND must have the same value type
+	if !startMatches || isDate {
+		setEventTiming(vevent, event)
+		return
+	}
+	vevent.SetEndAt(event.End)
+}
+
+// recurrenceLines returns the recurrence of a component the way it is stored. Dates in a TZID
+// that isn't an IANA zone are moved to the zone it stands for or to UTC.
+func (b *CalDAVBackend) recurrenceLines(component *ics.ComponentBase) string {
+	lines := componentRecurrenceLines(component)
+	for i, line := range lines {
+		tzid, ok := line.params[string(ics.ParameterTzid)]
+		if !ok || loadLocation(tzid) != nil {
+			continue
+		}
+		if location := b.timezoneLocation(tzid); location != nil {
+			line.params[string(ics.ParameterTzid)] = location.String()
+			continue
+		}
+
+		values := strings.Split(line.value, ",")
+		converted := make([]string, 0, len(values))
+		for _, value := range values {
+			local, err := time.Parse(iCalLocalDateTimeLayout, value)
+			if err != nil {
+				break
+			}
+			utc, ok := b.zoneToUTC(tzid, local)
+			if !ok {
+				break
+			}
+			converted = append(converted, utc.Format(iCalDateTimeLayout))
+		}
+		if len(converted) == len(values) {
+			delete(line.params, string(ics.ParameterTzid))
+			lines[i].value = strings.Join(converted, ",")
+		}
+	}
+	return joinRecurrence(lines)
+}
+
+// applyRecurrence writes the event's RRULEs, EXRULEs, RDATEs and EXDATEs unless the stored ones are the same
+func (b *CalDAVBackend) applyRecurrence(cal *ics.Calendar, vevent *ics.VEvent, event *Event) {
+	recurrence := ""
+	if event.Recurrent {
+		recurrence, _ = normalizeRecurrence(event.Recurrence)
+	}
+	if b.recurrenceLines(&vevent.ComponentBase) == recurrence {
+		markRecurValues(&vevent.ComponentBase)
+		return
+	}
+
+	removeProperties(&vevent.ComponentBase, recurrenceProperties...)
+	if recurrence != "" {
+		addRecurrenceProperties(&vevent.ComponentBase, recurrence)
+		return
+	}
+
+	// the event no longer recurs, drop its overridden occurrences too
+	components := cal.Components[:0]
+	for _, component := range cal.Components {
+		if override, ok := component.(*ics.VEvent); ok && override.GetProperty(componentPropertyRecurrenceId) != nil {
+			continue
+		}
+		components = append(components, component)
+	}
+	cal.Components = components
+}
+
+// applyAlert replaces the VALARM standing for the stored alert when the event's alert changed.
+// Alarms without an alert equivalent are kept as they are.
+func applyAlert(vevent *ics.VEvent, event *Event) {
+	stored := veventAlert(vevent)
+	if stored == event.Alert {
+		return
+	}
+
+	if stored != EventAlertNone {
+		components := vevent.Components[:0]
+		for _, component := range vevent.Components {
+			if alarm, ok := component.(*ics.VAlarm); ok && alarmAlert(alarm) == stored {
+				continue
+			}
+			components = append(components, component)
+		}
+		vevent.Components = components
+	}
+
+	addAlertAlarm(vevent, event)
+}
+
+// addAlertAlarm adds a display VALARM for the event's alert
+func addAlertAlarm(vevent *ics.VEvent, event *Event) {
+	duration, ok := EventAlertDurationMap[event.Alert]
+	if !ok || event.Alert == EventAlertNone {
+		return
+	}
+
+	alarm := vevent.AddAlarm()
+	alarm.SetAction(ics.ActionDisplay)
+	alarm.SetTrigger(formatICalDuration(-duration))
+	alarm.SetProperty(ics.ComponentPropertyDescription, event.Title)
+}
+
+// applyColor writes the event color unless the stored COLOR is the same
+func applyColor(vevent *ics.VEvent, event *Event) {
+	if event.Color == nil || *event.Color == "" {
+		return
+	}
+	if color := vevent.GetProperty(ics.ComponentPropertyColor); color != nil && strings.EqualFold(parseEventColor(color.Value), *event.Color) {
+		return
+	}
+	vevent.SetColor(formatEventColor(*event.Color))
+}
+
+// keepStoredAttendees drops the ORGANIZER and the ATTENDEEs that are Mattermost users or guests,
+// these are written from the event members. Other attendees and the organizer's own entry stay.
+func (b *CalDAVBackend) keepStoredAttendees(vevent *ics.VEvent, event *Event, organizer *model.User) {
+	properties := vevent.Properties[:0]
+	for _, property := range vevent.Properties {
+		switch strings.ToUpper(property.IANAToken) {
+		case string(ics.ComponentPropertyOrganizer):
+			if organizer != nil {
+				continue
+			}
+		case string(ics.ComponentPropertyAttendee):
+			if containsGuest(event.Guests, calendarAddressEmail(property.Value)) {
+				continue
+			}
+			if user := b.lookupAddress(property.Value); user != nil && user.Id != event.Owner {
+				continue
+			}
+		}
+		properties = append(properties, property)
+	}
+	vevent.Properties = properties
+}
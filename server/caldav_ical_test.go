@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	ics "github.com/arran4/golang-ical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestCalDAVBackend_RoundTrip(t *testing.T) {
+	created := time.Date(2024, 1, 10, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		start      time.Time
+		end        time.Time
+		alert      EventAlert
+		color      string
+		recurrence string
+		attendees  []string
+	}{
+		{
+			name:      "apple_timezone_alarm",
+			start:     time.Date(2024, 7, 15, 8, 0, 0, 0, time.UTC),
+			end:       time.Date(2024, 7, 15, 9, 0, 0, 0, time.UTC),
+			alert:     EventAlert15MinutesBefore,
+			attendees: []string{"alice-id"},
+		},
+		{
+			name:  "outlook_windows_zone",
+			start: time.Date(2024, 1, 18, 13, 0, 0, 0, time.UTC),
+			end:   time.Date(2024, 1, 18, 14, 30, 0, 0, time.UTC),
+			alert: EventAlert1HourBefore,
+			color: "#F2B3B3",
+		},
+		{
+			name:       "thunderbird_all_day_recurring",
+			start:      time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC),
+			end:        time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC),
+			alert:      EventAlert1DayBefore,
+			color:      "#B6D9C7",
+			recurrence: "RRULE:FREQ=WEEKLY;COUNT=4",
+		},
+		{
+			name:       "custom_vtimezone",
+			start:      time.Date(2024, 6, 10, 13, 0, 0, 0, time.UTC),
+			end:        time.Date(2024, 6, 10, 13, 30, 0, 0, time.UTC),
+			recurrence: "RRULE:FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR\nEXDATE:20240612T130000Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+			defer closeDB()
+			backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+			input, err := os.ReadFile(filepath.Join("testdata", "roundtrip", tt.name+".ics"))
+			require.NoError(t, err)
+			cal, err := ics.ParseCalendar(strings.NewReader(string(input)))
+			require.NoError(t, err)
+
+			event, err := backend.icalendarToEvent(cal, "")
+			require.NoError(t, err)
+			event.Id = masterEvent(cal).Id()
+			event.Owner = "test-user"
+			event.Created = created
+
+			assert.Equal(tt.start, event.Start)
+			assert.Equal(tt.end, event.End)
+			assert.Equal(tt.alert, event.Alert)
+			assert.Equal(tt.recurrence, event.Recurrence)
+			assert.Equal(tt.attendees, event.Attendees)
+			if tt.color == "" {
+				assert.Nil(event.Color)
+			} else if assert.NotNil(event.Color) {
+				assert.Equal(tt.color, *event.Color)
+			}
+
+			output := backend.eventToICalendarString(event, backend.lookupUser("test-user"))
+
+			golden := filepath.Join("testdata", "roundtrip", tt.name+".golden")
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(golden, []byte(output), 0644))
+			}
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(string(expected), output)
+
+			// parsing the output again gives the same event and the same output
+			cal, err = ics.ParseCalendar(strings.NewReader(output))
+			require.NoError(t, err)
+			again, err := backend.icalendarToEvent(cal, event.Id)
+			require.NoError(t, err)
+			again.Owner = event.Owner
+			again.Created = event.Created
+
+			assert.Equal(event.Start, again.Start)
+			assert.Equal(event.End, again.End)
+			assert.Equal(event.Title, again.Title)
+			assert.Equal(event.Description, again.Description)
+			assert.Equal(event.Recurrence, again.Recurrence)
+			assert.Equal(event.Alert, again.Alert)
+			assert.Equal(event.Color, again.Color)
+			assert.Equal(event.Attendees, again.Attendees)
+			assert.Equal(output, backend.eventToICalendarString(again, backend.lookupUser("test-user")))
+		})
+	}
+}
+
+func TestCalDAVBackend_StoredCalendarOverlay(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	input, err := os.ReadFile(filepath.Join("testdata", "roundtrip", "apple_timezone_alarm.ics"))
+	assert.NoError(err)
+	cal, err := ics.ParseCalendar(strings.NewReader(string(input)))
+	assert.NoError(err)
+	event, err := backend.icalendarToEvent(cal, "apple-1")
+	assert.NoError(err)
+	event.Owner = "test-user"
+
+	// the event is edited in Mattermost: moved, retitled, new alert and color, alice removed
+	event.Title = "Design review (moved)"
+	event.Start = time.Date(2024, 7, 16, 12, 0, 0, 0, time.UTC)
+	event.End = time.Date(2024, 7, 16, 13, 0, 0, 0, time.UTC)
+	event.Alert = EventAlert1HourBefore
+	color := "#B3E1F7"
+	event.Color = &color
+	event.Attendees = nil
+
+	output := backend.eventToICalendarString(event, backend.lookupUser("test-user"))
+	unfolded := strings.ReplaceAll(output, "\r\n ", "")
+
+	assert.Contains(unfolded, "SUMMARY:Design review (moved)")
+	// the event stays in its timezone
+	assert.Contains(unfolded, "DTSTART;TZID=Europe/Berlin:20240716T140000")
+	assert.Contains(unfolded, "DTEND;TZID=Europe/Berlin:20240716T150000")
+	assert.Equal(1, strings.Count(unfolded, "BEGIN:VTIMEZONE"))
+	assert.Contains(unfolded, "COLOR:blue")
+	assert.Contains(unfolded, "TRIGGER:-PT1H")
+	assert.NotContains(unfolded, "TRIGGER:-PT15M")
+	assert.NotContains(unfolded, "alice@example.com")
+
+	// what the plugin doesn't manage is untouched
+	assert.Contains(unfolded, "LOCATION:Room 4")
+	assert.Contains(unfolded, "X-APPLE-TRAVEL-ADVISORY-BEHAVIOR:AUTOMATIC")
+	assert.Contains(unfolded, "X-APPLE-DEFAULT-ALARM:TRUE")
+	assert.Contains(unfolded, "mailto:bob@elsewhere.example")
+	assert.Contains(unfolded, "ATTENDEE;CN=testuser;PARTSTAT=ACCEPTED;ROLE=CHAIR:mailto:test@example.com")
+	assert.Contains(unfolded, "TZID:Europe/Berlin")
+}
+
+func TestCalDAVBackend_StoredCalendarRecurrenceRemoved(t *testing.T) {
+	calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	input, err := os.ReadFile(filepath.Join("testdata", "roundtrip", "thunderbird_all_day_recurring.ics"))
+	require.NoError(t, err)
+	cal, err := ics.ParseCalendar(strings.NewReader(string(input)))
+	require.NoError(t, err)
+	event, err := backend.icalendarToEvent(cal, "thunderbird-1")
+	require.NoError(t, err)
+
+	event.Recurrent = false
+	event.Recurrence = ""
+
+	output := backend.eventToICalendarString(event, nil)
+
+	assert.NotContains(t, output, "RRULE")
+	assert.NotContains(t, output, "RECURRENCE-ID")
+	assert.Equal(t, 1, strings.Count(output, "BEGIN:VEVENT"))
+	assert.Contains(t, output, "DTSTART;VALUE=DATE:20240108")
+}
+
+func TestCalDAVBackend_EventWithoutStoredCalendar(t *testing.T) {
+	calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	color := "#F2B3B3"
+	event := &Event{
+		Id:    "event-1",
+		Title: "Created in Mattermost",
+		Start: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC),
+		Owner: "test-user",
+		Alert: EventAlert30MinutesBefore,
+		Color: &color,
+	}
+
+	output := backend.eventToICalendarString(event, backend.lookupUser("test-user"))
+
+	assert.Contains(t, output, "COLOR:red")
+	assert.Contains(t, output, "BEGIN:VALARM\r\nACTION:DISPLAY\r\nTRIGGER:-PT30M\r\nDESCRIPTION:Created in Mattermost\r\nEND:VALARM")
+}
+
+func TestCalDAVBackend_AllDayEvent(t *testing.T) {
+	assert := assert.New(t)
+	calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	// a TZID on a DATE doesn't move the date
+	cal, err := ics.ParseCalendar(strings.NewReader("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Test//EN\r\n" +
+		"BEGIN:VEVENT\r\nUID:trip\r\nDTSTART;VALUE=DATE;TZID=Asia/Tokyo:20240310\r\nDTEND;VALUE=DATE:20240313\r\nSUMMARY:Trip\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"))
+	assert.NoError(err)
+
+	event, err := backend.icalendarToEvent(cal, "trip")
+	assert.NoError(err)
+	assert.True(event.AllDay)
+	assert.Equal(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), event.Start)
+	assert.Equal(time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC), event.End)
+
+	// moved in Mattermost, the DATE values stay
+	event.Start = event.Start.AddDate(0, 0, 1)
+	event.End = event.End.AddDate(0, 0, 1)
+	output := backend.eventToICalendarString(event, backend.lookupUser("test-user"))
+	assert.Contains(output, "DTSTART;VALUE=DATE:20240311\r\n")
+	assert.Contains(output, "DTEND;VALUE=DATE:20240314\r\n")
+
+	// no longer all-day
+	event.AllDay = false
+	event.Start = time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC)
+	event.End = time.Date(2024, 3, 11, 10, 0, 0, 0, time.UTC)
+	output = backend.eventToICalendarString(event, backend.lookupUser("test-user"))
+	assert.Contains(output, "DTSTART:20240311T090000Z\r\n")
+	assert.Contains(output, "DTEND:20240311T100000Z\r\n")
+
+	created := backend.eventToICalendarString(&Event{
+		Id:     "holiday",
+		Title:  "Holiday",
+		Start:  time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		End:    time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC),
+		AllDay: true,
+		Owner:  "test-user",
+	}, backend.lookupUser("test-user"))
+	assert.Contains(created, "DTSTART;VALUE=DATE:20240501\r\n")
+	assert.Contains(created, "DTEND;VALUE=DATE:20240502\r\n")
+}
+
+func TestCalDAVBackend_TimezoneLocation(t *testing.T) {
+	calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	for tzid, expected := range map[string]string{
+		"Europe/Berlin":                            "Europe/Berlin",
+		"W. Europe Standard Time":                  "Europe/Berlin",
+		"/mozilla.org/20050126_1/Europe/Berlin":    "Europe/Berlin",
+		"/citadel.org/20190914_1/America/New_York": "America/New_York",
+	} {
+		location := backend.timezoneLocation(tzid)
+		if assert.NotNil(t, location, tzid) {
+			assert.Equal(t, expected, location.String(), tzid)
+		}
+	}
+
+	assert.Nil(t, backend.timezoneLocation("Custom Eastern"))
+}
+
+func TestICalTimezone_ToUTC(t *testing.T) {
+	input, err := os.ReadFile(filepath.Join("testdata", "roundtrip", "custom_vtimezone.ics"))
+	require.NoError(t, err)
+	cal, err := ics.ParseCalendar(strings.NewReader(string(input)))
+	require.NoError(t, err)
+
+	timezone := parseVTimezone(cal.Timezones()[0])
+
+	tests := []struct {
+		local    time.Time
+		expected time.Time
+	}{
+		// EST
+		{time.Date(2024, 1, 10, 9, 0, 0, 0, time.UTC), time.Date(2024, 1, 10, 14, 0, 0, 0, time.UTC)},
+		// EDT starts 2024-03-10 02:00
+		{time.Date(2024, 3, 10, 1, 59, 0, 0, time.UTC), time.Date(2024, 3, 10, 6, 59, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 10, 3, 0, 0, 0, time.UTC), time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC)},
+		// EST again after 2024-11-03 02:00
+		{time.Date(2024, 11, 3, 3, 0, 0, 0, time.UTC), time.Date(2024, 11, 3, 8, 0, 0, 0, time.UTC)},
+		// before the first onset
+		{time.Date(1960, 6, 1, 12, 0, 0, 0, time.UTC), time.Date(1960, 6, 1, 16, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, timezone.toUTC(tt.local), tt.local.String())
+	}
+}
+
+func TestParseUTCOffset(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"+0200":   2 * time.Hour,
+		"-0500":   -5 * time.Hour,
+		"+0530":   5*time.Hour + 30*time.Minute,
+		"-003015": -(30*time.Minute + 15*time.Second),
+	} {
+		offset, ok := parseUTCOffset(value)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, offset, value)
+	}
+
+	for _, value := range []string{"", "0200", "+2", "+02:00"} {
+		_, ok := parseUTCOffset(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestFormatICalDuration(t *testing.T) {
+	for expected, duration := range map[string]time.Duration{
+		"-PT5M":   -5 * time.Minute,
+		"-PT1H":   -time.Hour,
+		"-P1D":    -24 * time.Hour,
+		"-P1W":    -7 * 24 * time.Hour,
+		"P1DT2H":  26 * time.Hour,
+		"PT1H30M": 90 * time.Minute,
+		"PT0S":    0,
+		"PT1M30S": 90 * time.Second,
+		"-P2D":    -48 * time.Hour,
+		"P8DT1M":  8*24*time.Hour + time.Minute,
+	} {
+		assert.Equal(t, expected, formatICalDuration(duration))
+
+		parsed, err := parseICalDuration(formatICalDuration(duration))
+		assert.NoError(t, err)
+		assert.Equal(t, duration, parsed)
+	}
+}
+
+func TestAlarmAlert(t *testing.T) {
+	alarm := func(trigger string, params ...ics.PropertyParameter) *ics.VAlarm {
+		a := &ics.VAlarm{}
+		a.SetTrigger(trigger, params...)
+		return a
+	}
+
+	assert.Equal(t, EventAlert15MinutesBefore, alarmAlert(alarm("-PT15M")))
+	assert.Equal(t, EventAlert1WeekBefore, alarmAlert(alarm("-P1W")))
+	assert.Equal(t, EventAlert1DayBefore, alarmAlert(alarm("-PT24H")))
+	assert.Equal(t, EventAlertNone, alarmAlert(alarm("-PT10M")))
+	assert.Equal(t, EventAlertNone, alarmAlert(alarm("PT15M")))
+	assert.Equal(t, EventAlertNone, alarmAlert(alarm("-PT15M", &ics.KeyValues{Key: "RELATED", Value: []string{"END"}})))
+	assert.Equal(t, EventAlertNone, alarmAlert(alarm("20240101T100000Z", &ics.KeyValues{Key: "VALUE", Value: []string{"DATE-TIME"}})))
+}
+
+func TestParseEventColor(t *testing.T) {
+	assert.Equal(t, "#F2B3B3", parseEventColor("red"))
+	assert.Equal(t, "#F2B3B3", parseEventColor("Red"))
+	assert.Equal(t, "#ABCDEF", parseEventColor("#abcdef"))
+	assert.Equal(t, "", parseEventColor("turquoise"))
+
+	assert.Equal(t, "green", formatEventColor("#B6D9C7"))
+	assert.Equal(t, "#ABCDEF", formatEventColor("#ABCDEF"))
+}
+
+func TestCalDAVBackend_PutStoresCalendarData(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnError(sql.ErrNoRows)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_events (id,title,description,dt_start,dt_end,all_day,timezone,created,updated,owner,channel,recurrent,recurrence,recurrence_end,next_notification,color,visibility,team,alert,alert_time,ical_data)")).
+		WithArgs("event-1", "Planning", "", time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), false, "Europe/Berlin",
+			sqlmock.AnyArg(), sqlmock.AnyArg(), "test-user", nil, false, "", nil, nil,
+			"#FCECBE", VisibilityPrivate, "", EventAlert30MinutesBefore, time.Date(2024, 1, 15, 8, 30, 0, 0, time.UTC),
+			containsArg("X-CUSTOM-FIELD:kept")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ce.owner, ce.visibility, ce.channel, ce.team, cm.member FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnRows(scheduleEventRow("event-1", "test-user", time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/caldav/token/calendar/event-1.ics", strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VTIMEZONE
+TZID:Europe/Berlin
+BEGIN:STANDARD
+DTSTART:19961027T030000
+RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:event-1
+DTSTART;TZID=Europe/Berlin:20240115T100000
+DURATION:PT1H
+SUMMARY:Planning
+COLOR:yellow
+X-CUSTOM-FIELD:kept
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER:-PT30M
+END:VALARM
+END:VEVENT
+END:VCALENDAR
+`))
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
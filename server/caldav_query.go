@@ -0,0 +1,758 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/teambition/rrule-go"
+)
+
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+)
+
+// iCalDateTimeLayout is the UTC DATE-TIME form used in time-range and expand attributes
+const iCalDateTimeLayout = "20060102T150405Z"
+
+// floating and TZID-relative DATE-TIME and DATE layouts
+const (
+	iCalLocalDateTimeLayout = "20060102T150405"
+	iCalDateLayout          = "20060102"
+)
+
+// component properties missing from the ics package
+const (
+	componentPropertyDuration     = ics.ComponentProperty(ics.PropertyDuration)
+	componentPropertyRecurrenceId = ics.ComponentProperty(ics.PropertyRecurrenceId)
+	componentPropertyTzOffsetTo   = ics.ComponentProperty(ics.PropertyTzoffsetto)
+	componentPropertyTzOffsetFrom = ics.ComponentProperty(ics.PropertyTzoffsetfrom)
+	componentPropertyTzName       = ics.ComponentProperty(ics.PropertyTzname)
+	componentPropertyXLicLocation = ics.ComponentProperty("X-LIC-LOCATION")
+)
+
+// maxOccurrenceIterations bounds recurrence iteration for open-ended rules and ranges
+const maxOccurrenceIterations = 100000
+
+var (
+	propGetETag        = xml.Name{Space: nsDAV, Local: "getetag"}
+	propGetContentType = xml.Name{Space: nsDAV, Local: "getcontenttype"}
+	propResourceType   = xml.Name{Space: nsDAV, Local: "resourcetype"}
+	propCalendarData   = xml.Name{Space: nsCalDAV, Local: "calendar-data"}
+)
+
+// reportRequest is the body of a REPORT request. It covers calendar-query,
+// calendar-multiget (RFC 4791), sync-collection (RFC 6578), addressbook-query and
+// addressbook-multiget (RFC 6352).
+type reportRequest struct {
+	XMLName   xml.Name
+	AllProp   *struct{}       `xml:"DAV: allprop"`
+	Prop      *reportProp     `xml:"DAV: prop"`
+	Hrefs     []string        `xml:"DAV: href"`
+	Filter    *calendarFilter `xml:"urn:ietf:params:xml:ns:caldav filter"`
+	SyncToken string          `xml:"DAV: sync-token"`
+	SyncLevel string          `xml:"DAV: sync-level"`
+
+	AddressFilter *addressBookFilter `xml:"urn:ietf:params:xml:ns:carddav filter"`
+	Limit         *addressBookLimit  `xml:"urn:ietf:params:xml:ns:carddav limit"`
+}
+
+// propNames returns the requested properties, or defaults for allprop and missing DAV:prop
+func (r *reportRequest) propNames(defaults ...xml.Name) []xml.Name {
+	if r.Prop == nil || r.AllProp != nil {
+		return defaults
+	}
+	return r.Prop.Names
+}
+
+// reportProp is a DAV:prop element: the names of the requested properties, in request order.
+// calendar-data is additionally decoded because it carries expand and comp selection.
+type reportProp struct {
+	Names        []xml.Name
+	CalendarData *calendarDataRequest
+}
+
+func (p *reportProp) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			p.Names = append(p.Names, element.Name)
+			if element.Name == propCalendarData {
+				var data calendarDataRequest
+				if err = d.DecodeElement(&data, &element); err != nil {
+					return err
+				}
+				p.CalendarData = &data
+				continue
+			}
+			if err = d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+type calendarDataRequest struct {
+	Comp   *calendarDataComp `xml:"urn:ietf:params:xml:ns:caldav comp"`
+	Expand *timeRange        `xml:"urn:ietf:params:xml:ns:caldav expand"`
+}
+
+// calendarDataComp selects the components and properties returned in calendar-data (RFC 4791 9.6.1)
+type calendarDataComp struct {
+	Name    string             `xml:"name,attr"`
+	AllProp *struct{}          `xml:"urn:ietf:params:xml:ns:caldav allprop"`
+	Props   []calendarDataProp `xml:"urn:ietf:params:xml:ns:caldav prop"`
+	AllComp *struct{}          `xml:"urn:ietf:params:xml:ns:caldav allcomp"`
+	Comps   []calendarDataComp `xml:"urn:ietf:params:xml:ns:caldav comp"`
+}
+
+type calendarDataProp struct {
+	Name string `xml:"name,attr"`
+}
+
+type calendarFilter struct {
+	CompFilter *compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+type compFilter struct {
+	Name         string       `xml:"name,attr"`
+	IsNotDefined *struct{}    `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+	TimeRange    *timeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	PropFilters  []propFilter `xml:"urn:ietf:params:xml:ns:caldav prop-filter"`
+	CompFilters  []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+type propFilter struct {
+	Name         string        `xml:"name,attr"`
+	IsNotDefined *struct{}     `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+	TimeRange    *timeRange    `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	TextMatch    *textMatch    `xml:"urn:ietf:params:xml:ns:caldav text-match"`
+	ParamFilters []paramFilter `xml:"urn:ietf:params:xml:ns:caldav param-filter"`
+}
+
+type paramFilter struct {
+	Name         string     `xml:"name,attr"`
+	IsNotDefined *struct{}  `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+	TextMatch    *textMatch `xml:"urn:ietf:params:xml:ns:caldav text-match"`
+}
+
+type textMatch struct {
+	Collation       string `xml:"collation,attr"`
+	NegateCondition string `xml:"negate-condition,attr"`
+	Value           string `xml:",chardata"`
+}
+
+// matches implements the i;octet and i;ascii-casemap (default) substring collations
+func (t *textMatch) matches(value string) bool {
+	var found bool
+	if t.Collation == "i;octet" {
+		found = strings.Contains(value, t.Value)
+	} else {
+		found = strings.Contains(strings.ToLower(value), strings.ToLower(t.Value))
+	}
+
+	if t.NegateCondition == "yes" {
+		return !found
+	}
+	return found
+}
+
+type timeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+// bounds parses the range. A missing start or end is returned as the zero time and means unbounded.
+func (t *timeRange) bounds() (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+
+	if t.Start != "" {
+		if start, err = time.Parse(iCalDateTimeLayout, t.Start); err != nil {
+			return start, end, fmt.Errorf("invalid time-range start: %w", err)
+		}
+	}
+	if t.End != "" {
+		if end, err = time.Parse(iCalDateTimeLayout, t.End); err != nil {
+			return start, end, fmt.Errorf("invalid time-range end: %w", err)
+		}
+	}
+
+	return start, end, nil
+}
+
+// overlaps implements the RFC 4791 9.9 overlap test for an interval starting at start
+// with the given duration (zero for instantaneous components)
+func overlaps(start time.Time, duration time.Duration, rangeStart, rangeEnd time.Time) bool {
+	if duration > 0 {
+		return (rangeEnd.IsZero() || start.Before(rangeEnd)) &&
+			(rangeStart.IsZero() || start.Add(duration).After(rangeStart))
+	}
+	return (rangeEnd.IsZero() || start.Before(rangeEnd)) &&
+		(rangeStart.IsZero() || !start.Before(rangeStart))
+}
+
+var iCalDurationRegexp = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICalDuration parses an RFC 5545 DURATION value such as -PT15M or P1DT2H
+func parseICalDuration(value string) (time.Duration, error) {
+	match := iCalDurationRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var duration time.Duration
+	for i, unit := range units {
+		if match[i+2] == "" {
+			continue
+		}
+		n, _ := strconv.Atoi(match[i+2])
+		duration += time.Duration(n) * unit
+	}
+
+	if match[1] == "-" {
+		duration = -duration
+	}
+	return duration, nil
+}
+
+// componentName returns the iCalendar name of a component, e.g. VEVENT
+func componentName(component ics.Component) string {
+	switch c := component.(type) {
+	case *ics.VEvent:
+		return "VEVENT"
+	case *ics.VTodo:
+		return "VTODO"
+	case *ics.VJournal:
+		return "VJOURNAL"
+	case *ics.VBusy:
+		return "VFREEBUSY"
+	case *ics.VTimezone:
+		return "VTIMEZONE"
+	case *ics.VAlarm:
+		return "VALARM"
+	case *ics.Standard:
+		return "STANDARD"
+	case *ics.Daylight:
+		return "DAYLIGHT"
+	case *ics.GeneralComponent:
+		return strings.ToUpper(c.Token)
+	default:
+		return ""
+	}
+}
+
+func componentProperty(component ics.Component, name ics.ComponentProperty) *ics.IANAProperty {
+	properties := component.UnknownPropertiesIANAProperties()
+	for i := range properties {
+		if strings.EqualFold(properties[i].IANAToken, string(name)) {
+			return &properties[i]
+		}
+	}
+	return nil
+}
+
+// componentTiming returns the start and duration of the first instance of a component.
+// A DATE DTSTART without DTEND or DURATION lasts one day, otherwise zero (RFC 5545 3.6.1).
+func (b *CalDAVBackend) componentTiming(component ics.Component) (time.Time, time.Duration, bool) {
+	dtstart := componentProperty(component, ics.ComponentPropertyDtStart)
+	if dtstart == nil {
+		return time.Time{}, 0, false
+	}
+
+	start := b.parseICalTime(dtstart)
+	if start.IsZero() {
+		return start, 0, false
+	}
+
+	endProperty := componentProperty(component, ics.ComponentPropertyDtEnd)
+	if endProperty == nil {
+		endProperty = componentProperty(component, ics.ComponentPropertyDue)
+	}
+	if endProperty != nil {
+		if end := b.parseICalTime(endProperty); !end.IsZero() && end.After(start) {
+			return start, end.Sub(start), true
+		}
+	}
+
+	if durationProperty := componentProperty(component, componentPropertyDuration); durationProperty != nil {
+		if duration, err := parseICalDuration(durationProperty.Value); err == nil && duration > 0 {
+			return start, duration, true
+		}
+	}
+
+	if len(dtstart.Value) == len("20060102") {
+		return start, 24 * time.Hour, true
+	}
+
+	return start, 0, true
+}
+
+// componentRecurrence builds the recurrence set of a component from RRULE, RDATE and EXDATE,
+// nil if the component doesn't recur
+func (b *CalDAVBackend) componentRecurrence(component ics.Component, start time.Time) *rrule.Set {
+	var set *rrule.Set
+
+	for _, property := range component.UnknownPropertiesIANAProperties() {
+		token := strings.ToUpper(property.IANAToken)
+		if token != string(ics.ComponentPropertyRrule) &&
+			token != string(ics.ComponentPropertyRdate) &&
+			token != string(ics.ComponentPropertyExdate) {
+			continue
+		}
+
+		if set == nil {
+			set = &rrule.Set{}
+			set.DTStart(start)
+		}
+
+		if token == string(ics.ComponentPropertyRrule) {
+			rule, err := rrule.StrToRRule(property.Value)
+			if err != nil {
+				b.plugin.API.LogWarn("CalDAV: invalid RRULE", "rrule", property.Value, "error", err.Error())
+				continue
+			}
+			set.RRule(rule)
+			continue
+		}
+
+		for _, value := range strings.Split(property.Value, ",") {
+			single := property
+			single.Value = value
+			date := b.parseICalTime(&single)
+			if date.IsZero() {
+				continue
+			}
+			if token == string(ics.ComponentPropertyRdate) {
+				set.RDate(date)
+			} else {
+				set.ExDate(date)
+			}
+		}
+	}
+
+	if set != nil {
+		// the first instance is always part of the set
+		set.RDate(start)
+	}
+
+	return set
+}
+
+// eachOccurrence calls fn with the start of every instance of the component overlapping the
+// range until fn returns false
+func (b *CalDAVBackend) eachOccurrence(component ics.Component, rangeStart, rangeEnd time.Time, fn func(time.Time, time.Duration) bool) {
+	start, duration, ok := b.componentTiming(component)
+	if !ok {
+		return
+	}
+
+	set := b.componentRecurrence(component, start)
+	if set == nil {
+		if overlaps(start, duration, rangeStart, rangeEnd) {
+			fn(start, duration)
+		}
+		return
+	}
+
+	next := set.Iterator()
+	for i := 0; i < maxOccurrenceIterations; i++ {
+		occurrence, more := next()
+		if !more {
+			return
+		}
+		if !rangeEnd.IsZero() && !occurrence.Before(rangeEnd) {
+			return
+		}
+		if overlaps(occurrence, duration, rangeStart, rangeEnd) && !fn(occurrence, duration) {
+			return
+		}
+	}
+}
+
+// matchCalendarFilter reports whether the calendar object matches the calendar-query filter
+func (b *CalDAVBackend) matchCalendarFilter(cal *ics.Calendar, filter *calendarFilter) bool {
+	if filter == nil || filter.CompFilter == nil {
+		return true
+	}
+
+	root := filter.CompFilter
+	if !strings.EqualFold(root.Name, "VCALENDAR") {
+		return root.IsNotDefined != nil
+	}
+	if root.IsNotDefined != nil {
+		return false
+	}
+
+	calendarProperties := make([]ics.IANAProperty, len(cal.CalendarProperties))
+	for i, property := range cal.CalendarProperties {
+		calendarProperties[i] = ics.IANAProperty{BaseProperty: property.BaseProperty}
+	}
+
+	for _, filter := range root.PropFilters {
+		if !b.matchPropFilter(calendarProperties, &filter) {
+			return false
+		}
+	}
+
+	for _, filter := range root.CompFilters {
+		if !b.matchComponents(cal.Components, &filter, nil) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *CalDAVBackend) matchComponents(components []ics.Component, filter *compFilter, parent ics.Component) bool {
+	name := strings.ToUpper(filter.Name)
+	found := false
+
+	for _, component := range components {
+		if componentName(component) != name {
+			continue
+		}
+		found = true
+
+		if filter.IsNotDefined == nil && b.matchComponent(component, filter, parent) {
+			return true
+		}
+	}
+
+	if filter.IsNotDefined != nil {
+		return !found
+	}
+	return false
+}
+
+func (b *CalDAVBackend) matchComponent(component ics.Component, filter *compFilter, parent ics.Component) bool {
+	if filter.TimeRange != nil && !b.componentInTimeRange(component, parent, filter.TimeRange) {
+		return false
+	}
+
+	for _, propFilter := range filter.PropFilters {
+		if !b.matchPropFilter(component.UnknownPropertiesIANAProperties(), &propFilter) {
+			return false
+		}
+	}
+
+	for _, compFilter := range filter.CompFilters {
+		if !b.matchComponents(component.SubComponents(), &compFilter, component) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// componentInTimeRange implements time-range for components: any instance of a VEVENT,
+// VTODO or VJOURNAL overlapping the range, or any VALARM trigger inside it
+func (b *CalDAVBackend) componentInTimeRange(component ics.Component, parent ics.Component, tr *timeRange) bool {
+	rangeStart, rangeEnd, err := tr.bounds()
+	if err != nil {
+		return false
+	}
+
+	if _, isAlarm := component.(*ics.VAlarm); isAlarm {
+		return b.alarmInTimeRange(component, parent, rangeStart, rangeEnd)
+	}
+	if _, isTodo := component.(*ics.VTodo); isTodo && componentProperty(component, ics.ComponentPropertyDtStart) == nil {
+		return b.todoInTimeRange(component, rangeStart, rangeEnd)
+	}
+
+	found := false
+	b.eachOccurrence(component, rangeStart, rangeEnd, func(time.Time, time.Duration) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// todoInTimeRange matches a VTODO without DTSTART on its due, completion or creation
+// time (RFC 4791 9.9)
+func (b *CalDAVBackend) todoInTimeRange(todo ics.Component, rangeStart, rangeEnd time.Time) bool {
+	if due := b.parseICalTime(componentProperty(todo, ics.ComponentPropertyDue)); !due.IsZero() {
+		return (rangeStart.IsZero() || rangeStart.Before(due)) && (rangeEnd.IsZero() || !rangeEnd.Before(due))
+	}
+	if completed := b.parseICalTime(componentProperty(todo, ics.ComponentPropertyCompleted)); !completed.IsZero() {
+		return (rangeStart.IsZero() || !rangeStart.After(completed)) && (rangeEnd.IsZero() || !rangeEnd.Before(completed))
+	}
+	if created := b.parseICalTime(componentProperty(todo, ics.ComponentPropertyCreated)); !created.IsZero() {
+		return rangeEnd.IsZero() || rangeEnd.After(created)
+	}
+	return true
+}
+
+func (b *CalDAVBackend) alarmInTimeRange(alarm ics.Component, parent ics.Component, rangeStart, rangeEnd time.Time) bool {
+	trigger := componentProperty(alarm, ics.ComponentPropertyTrigger)
+	if trigger == nil {
+		return false
+	}
+
+	if values, ok := trigger.ICalParameters["VALUE"]; ok && len(values) > 0 && strings.EqualFold(values[0], "DATE-TIME") {
+		triggerTime := b.parseICalTime(trigger)
+		return !triggerTime.IsZero() && overlaps(triggerTime, 0, rangeStart, rangeEnd)
+	}
+
+	offset, err := parseICalDuration(trigger.Value)
+	if err != nil || parent == nil {
+		return false
+	}
+
+	relatedToEnd := false
+	if values, ok := trigger.ICalParameters["RELATED"]; ok && len(values) > 0 {
+		relatedToEnd = strings.EqualFold(values[0], "END")
+	}
+
+	// shift the range by the trigger offset and look for a parent instance in it
+	if !rangeStart.IsZero() {
+		rangeStart = rangeStart.Add(-offset)
+	}
+	if !rangeEnd.IsZero() {
+		rangeEnd = rangeEnd.Add(-offset)
+	}
+
+	found := false
+	b.eachOccurrence(parent, time.Time{}, rangeEnd, func(occurrence time.Time, duration time.Duration) bool {
+		anchor := occurrence
+		if relatedToEnd {
+			anchor = occurrence.Add(duration)
+		}
+		if overlaps(anchor, 0, rangeStart, rangeEnd) {
+			found = true
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func (b *CalDAVBackend) matchPropFilter(properties []ics.IANAProperty, filter *propFilter) bool {
+	found := false
+
+	for i := range properties {
+		if !strings.EqualFold(properties[i].IANAToken, filter.Name) {
+			continue
+		}
+		found = true
+
+		if filter.IsNotDefined == nil && b.matchProperty(&properties[i], filter) {
+			return true
+		}
+	}
+
+	if filter.IsNotDefined != nil {
+		return !found
+	}
+	return false
+}
+
+func (b *CalDAVBackend) matchProperty(property *ics.IANAProperty, filter *propFilter) bool {
+	if filter.TimeRange != nil {
+		rangeStart, rangeEnd, err := filter.TimeRange.bounds()
+		if err != nil {
+			return false
+		}
+		value := b.parseICalTime(property)
+		if value.IsZero() || !overlaps(value, 0, rangeStart, rangeEnd) {
+			return false
+		}
+	}
+
+	if filter.TextMatch != nil && !filter.TextMatch.matches(ics.FromText(property.Value)) {
+		return false
+	}
+
+	for _, paramFilter := range filter.ParamFilters {
+		if !matchParamFilter(property.ICalParameters, &paramFilter) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchParamFilter(parameters map[string][]string, filter *paramFilter) bool {
+	var values []string
+	found := false
+	for name, parameterValues := range parameters {
+		if strings.EqualFold(name, filter.Name) {
+			values = parameterValues
+			found = true
+			break
+		}
+	}
+
+	if filter.IsNotDefined != nil {
+		return !found
+	}
+	if !found {
+		return false
+	}
+	if filter.TextMatch == nil {
+		return true
+	}
+
+	for _, value := range values {
+		if filter.TextMatch.matches(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandCalendar replaces recurring components with one component per instance overlapping
+// the range, each with a RECURRENCE-ID and UTC times (RFC 4791 9.6.5)
+func (b *CalDAVBackend) expandCalendar(cal *ics.Calendar, tr *timeRange) *ics.Calendar {
+	rangeStart, rangeEnd, err := tr.bounds()
+	if err != nil {
+		return cal
+	}
+
+	expanded := &ics.Calendar{CalendarProperties: cal.CalendarProperties}
+
+	for _, component := range cal.Components {
+		switch component.(type) {
+		case *ics.VTimezone:
+			// expanded instances are in UTC
+			continue
+		case *ics.VEvent, *ics.VTodo, *ics.VJournal:
+		default:
+			expanded.Components = append(expanded.Components, component)
+			continue
+		}
+
+		start, _, ok := b.componentTiming(component)
+		if !ok {
+			expanded.Components = append(expanded.Components, component)
+			continue
+		}
+		recurring := b.componentRecurrence(component, start) != nil
+		endProperty := ics.ComponentPropertyDtEnd
+		if componentProperty(component, ics.ComponentPropertyDue) != nil {
+			endProperty = ics.ComponentPropertyDue
+		}
+
+		b.eachOccurrence(component, rangeStart, rangeEnd, func(occurrence time.Time, duration time.Duration) bool {
+			instance := ics.ComponentBase{Components: component.SubComponents()}
+			for _, property := range component.UnknownPropertiesIANAProperties() {
+				switch strings.ToUpper(property.IANAToken) {
+				case string(ics.ComponentPropertyDtStart), string(ics.ComponentPropertyDtEnd),
+					string(ics.ComponentPropertyDue), string(componentPropertyDuration),
+					string(ics.ComponentPropertyRrule), string(ics.ComponentPropertyRdate),
+					string(ics.ComponentPropertyExdate), string(ics.ComponentPropertyExrule):
+					continue
+				}
+				instance.Properties = append(instance.Properties, property)
+			}
+
+			if recurring {
+				instance.SetProperty(componentPropertyRecurrenceId, occurrence.UTC().Format(iCalDateTimeLayout))
+			}
+			instance.SetProperty(ics.ComponentPropertyDtStart, occurrence.UTC().Format(iCalDateTimeLayout))
+			if duration > 0 {
+				instance.SetProperty(endProperty, occurrence.Add(duration).UTC().Format(iCalDateTimeLayout))
+			}
+
+			expanded.Components = append(expanded.Components, componentWithBase(component, instance))
+			return true
+		})
+	}
+
+	return expanded
+}
+
+// selectCalendarData keeps only the components and properties selected by a calendar-data comp element
+func selectCalendarData(cal *ics.Calendar, selection *calendarDataComp) *ics.Calendar {
+	if selection == nil || (selection.AllProp != nil && selection.AllComp != nil) {
+		return cal
+	}
+
+	selected := &ics.Calendar{}
+	for _, property := range cal.CalendarProperties {
+		if selection.AllProp != nil || selection.hasProp(property.IANAToken) {
+			selected.CalendarProperties = append(selected.CalendarProperties, property)
+		}
+	}
+
+	selected.Components = selectComponents(cal.Components, selection)
+	return selected
+}
+
+func (s *calendarDataComp) hasProp(name string) bool {
+	for _, prop := range s.Props {
+		if strings.EqualFold(prop.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func selectComponents(components []ics.Component, parent *calendarDataComp) []ics.Component {
+	if parent.AllComp != nil {
+		return components
+	}
+
+	var selected []ics.Component
+	for _, component := range components {
+		name := componentName(component)
+		for i := range parent.Comps {
+			if strings.EqualFold(parent.Comps[i].Name, name) {
+				selected = append(selected, selectComponent(component, &parent.Comps[i]))
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func selectComponent(component ics.Component, selection *calendarDataComp) ics.Component {
+	base := ics.ComponentBase{}
+	for _, property := range component.UnknownPropertiesIANAProperties() {
+		if selection.AllProp != nil || selection.hasProp(property.IANAToken) {
+			base.Properties = append(base.Properties, property)
+		}
+	}
+	base.Components = selectComponents(component.SubComponents(), selection)
+
+	return componentWithBase(component, base)
+}
+
+// componentWithBase returns a component of the same type with the given properties and subcomponents
+func componentWithBase(component ics.Component, base ics.ComponentBase) ics.Component {
+	switch c := component.(type) {
+	case *ics.VEvent:
+		return &ics.VEvent{ComponentBase: base}
+	case *ics.VTodo:
+		return &ics.VTodo{ComponentBase: base}
+	case *ics.VJournal:
+		return &ics.VJournal{ComponentBase: base}
+	case *ics.VBusy:
+		return &ics.VBusy{ComponentBase: base}
+	case *ics.VTimezone:
+		return &ics.VTimezone{ComponentBase: base}
+	case *ics.VAlarm:
+		return &ics.VAlarm{ComponentBase: base}
+	case *ics.Standard:
+		return &ics.Standard{ComponentBase: base}
+	case *ics.Daylight:
+		return &ics.Daylight{ComponentBase: base}
+	case *ics.GeneralComponent:
+		return &ics.GeneralComponent{ComponentBase: base, Token: c.Token}
+	default:
+		return component
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	ics "github.com/arran4/golang-ical"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// Calendar objects and queries below follow the examples of RFC 4791 7.8 and Appendix B
+const (
+	queryEventAbcd1 = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+UID:74855313FA803DA593CD579A@example.com
+DTSTAMP:20060206T001102Z
+DTSTART:20060102T150000Z
+DURATION:PT1H
+SUMMARY:Event #1
+END:VEVENT
+END:VCALENDAR
+`
+
+	queryEventAbcd2 = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+UID:00959BC664CA650E933C892C@example.com
+DTSTAMP:20060206T001121Z
+DTSTART:20060102T170000Z
+DURATION:PT1H
+RRULE:FREQ=DAILY;COUNT=5
+SUMMARY:Event #2
+END:VEVENT
+BEGIN:VEVENT
+UID:00959BC664CA650E933C892C@example.com
+DTSTAMP:20060206T001121Z
+DTSTART:20060104T160000Z
+DURATION:PT1H
+RECURRENCE-ID:20060104T170000Z
+SUMMARY:Event #2 bis
+END:VEVENT
+END:VCALENDAR
+`
+
+	queryEventAbcd3 = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+ATTENDEE;PARTSTAT=ACCEPTED;ROLE=CHAIR:mailto:cyrus@example.com
+ATTENDEE;PARTSTAT=NEEDS-ACTION:mailto:lisa@example.com
+DTSTAMP:20060206T001220Z
+DTSTART:20060104T150000Z
+DURATION:PT1H
+SUMMARY:Event #3
+UID:DC6C50A017428C5216A2F1CD@example.com
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER:-PT15M
+DESCRIPTION:Reminder
+END:VALARM
+END:VEVENT
+END:VCALENDAR
+`
+
+	queryTodo = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VTODO
+DTSTAMP:20060205T235335Z
+DUE:20060104T000000Z
+STATUS:NEEDS-ACTION
+SUMMARY:Task #1
+UID:DDDEEB7915FA61233B861457@example.com
+END:VTODO
+END:VCALENDAR
+`
+)
+
+func parseQueryFilter(t *testing.T, body string) *calendarFilter {
+	var request reportRequest
+	if err := xml.Unmarshal([]byte(body), &request); err != nil {
+		t.Fatalf("invalid query: %s", err)
+	}
+	return request.Filter
+}
+
+func parseQueryCalendar(t *testing.T, data string) *ics.Calendar {
+	cal, err := ics.ParseCalendar(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid calendar: %s", err)
+	}
+	return cal
+}
+
+// matchingObjects returns the names of the calendar objects matching the query
+func matchingObjects(t *testing.T, backend *CalDAVBackend, query string) []string {
+	objects := []struct {
+		name string
+		data string
+	}{
+		{"abcd1", queryEventAbcd1},
+		{"abcd2", queryEventAbcd2},
+		{"abcd3", queryEventAbcd3},
+		{"todo", queryTodo},
+	}
+
+	filter := parseQueryFilter(t, query)
+	var matched []string
+	for _, object := range objects {
+		if backend.matchCalendarFilter(parseQueryCalendar(t, object.data), filter) {
+			matched = append(matched, object.name)
+		}
+	}
+	return matched
+}
+
+func TestCalendarQuery_Filters(t *testing.T) {
+	calPlugin, _, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{
+			name: "time-range on events (7.8.1)",
+			query: `<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">
+    <C:time-range start="20060104T000000Z" end="20060105T000000Z"/>
+  </C:comp-filter></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			expected: []string{"abcd2", "abcd3"},
+		},
+		{
+			name: "alarm time-range (7.8.5)",
+			query: `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT"><C:comp-filter name="VALARM">
+    <C:time-range start="20060104T144000Z" end="20060104T145000Z"/>
+  </C:comp-filter></C:comp-filter></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			expected: []string{"abcd3"},
+		},
+		{
+			name: "UID text-match (7.8.6)",
+			query: `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">
+    <C:prop-filter name="UID">
+      <C:text-match collation="i;octet">DC6C50A017428C5216A2F1CD@example.com</C:text-match>
+    </C:prop-filter>
+  </C:comp-filter></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			expected: []string{"abcd3"},
+		},
+		{
+			name: "attendee PARTSTAT param-filter (7.8.7)",
+			query: `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">
+    <C:prop-filter name="ATTENDEE">
+      <C:text-match collation="i;ascii-casemap">mailto:lisa@example.com</C:text-match>
+      <C:param-filter name="PARTSTAT">
+        <C:text-match collation="i;ascii-casemap">NEEDS-ACTION</C:text-match>
+      </C:param-filter>
+    </C:prop-filter>
+  </C:comp-filter></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			expected: []string{"abcd3"},
+		},
+		{
+			name: "events only (7.8.8)",
+			query: `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT"/></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			expected: []string{"abcd1", "abcd2", "abcd3"},
+		},
+		{
+			name: "todos only",
+			query: `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VTODO"/></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			expected: []string{"todo"},
+		},
+		{
+			name: "is-not-defined",
+			query: `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">
+    <C:prop-filter name="RRULE"><C:is-not-defined/></C:prop-filter>
+  </C:comp-filter></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			// the overridden instance of abcd2 has no RRULE either
+			expected: []string{"abcd1", "abcd2", "abcd3"},
+		},
+		{
+			name: "negated case-insensitive summary",
+			query: `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">
+    <C:prop-filter name="SUMMARY">
+      <C:text-match negate-condition="yes">event #1</C:text-match>
+    </C:prop-filter>
+  </C:comp-filter></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			expected: []string{"abcd2", "abcd3"},
+		},
+		{
+			name: "recurrence instance in range",
+			query: `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">
+    <C:time-range start="20060106T000000Z"/>
+  </C:comp-filter></C:comp-filter></C:filter>
+</C:calendar-query>`,
+			expected: []string{"abcd2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, matchingObjects(t, backend, test.query))
+		})
+	}
+}
+
+func TestParseICalDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	duration, err := parseICalDuration("-PT15M")
+	assert.Nil(err)
+	assert.Equal(-15*time.Minute, duration)
+
+	duration, err = parseICalDuration("P1W2DT3H4M5S")
+	assert.Nil(err)
+	assert.Equal(9*24*time.Hour+3*time.Hour+4*time.Minute+5*time.Second, duration)
+
+	_, err = parseICalDuration("P")
+	assert.NotNil(err)
+
+	_, err = parseICalDuration("PT")
+	assert.NotNil(err)
+
+	_, err = parseICalDuration("1H")
+	assert.NotNil(err)
+}
+
+func TestCalDAVBackend_ExpandCalendar(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	cal := parseQueryCalendar(t, `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+UID:00959BC664CA650E933C892C@example.com
+DTSTAMP:20060206T001121Z
+DTSTART:20060102T170000Z
+DURATION:PT1H
+RRULE:FREQ=DAILY;COUNT=5
+SUMMARY:Event #2
+END:VEVENT
+END:VCALENDAR
+`)
+
+	expanded := backend.expandCalendar(cal, &timeRange{Start: "20060103T000000Z", End: "20060105T000000Z"})
+	assert.Len(expanded.Components, 2)
+
+	data := expanded.Serialize()
+	assert.Contains(data, "RECURRENCE-ID:20060103T170000Z")
+	assert.Contains(data, "DTSTART:20060103T170000Z")
+	assert.Contains(data, "DTEND:20060103T180000Z")
+	assert.Contains(data, "RECURRENCE-ID:20060104T170000Z")
+	assert.NotContains(data, "RRULE")
+	assert.NotContains(data, "DURATION")
+}
+
+func TestSelectCalendarData(t *testing.T) {
+	assert := assert.New(t)
+
+	var request reportRequest
+	assert.Nil(xml.Unmarshal([]byte(`<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <C:calendar-data>
+      <C:comp name="VCALENDAR">
+        <C:prop name="VERSION"/>
+        <C:comp name="VEVENT">
+          <C:prop name="SUMMARY"/>
+          <C:prop name="UID"/>
+        </C:comp>
+      </C:comp>
+    </C:calendar-data>
+  </D:prop>
+</C:calendar-query>`), &request))
+
+	selected := selectCalendarData(parseQueryCalendar(t, queryEventAbcd3), request.Prop.CalendarData.Comp)
+	data := selected.Serialize()
+
+	assert.Contains(data, "VERSION:2.0")
+	assert.NotContains(data, "PRODID")
+	assert.Contains(data, "SUMMARY:Event #3")
+	assert.Contains(data, "UID:DC6C50A017428C5216A2F1CD@example.com")
+	assert.NotContains(data, "ATTENDEE")
+	assert.NotContains(data, "VALARM")
+}
+
+func TestCalDAVBackend_CalendarQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	start := time.Date(2006, 1, 4, 15, 0, 0, 0, time.UTC)
+	expectCollectionEvents(dbMock, sqlmock.NewRows(syncEventColumns).
+		AddRow("event-1", "in range", "", start, start.Add(time.Hour), start, start, "test-user", nil, false, "", nil, "", "private", "", nil).
+		AddRow("event-2", "out of range", "", start.AddDate(0, 0, 7), start.AddDate(0, 0, 7).Add(time.Hour), start, start, "test-user", nil, false, "", nil, "", "private", "", nil))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/caldav/token/calendar/", strings.NewReader(`<?xml version="1.0" encoding="utf-8" ?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <D:getetag/>
+    <D:displayname/>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="20060104T000000Z" end="20060105T000000Z"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`))
+	backend.ServeHTTP(w, r)
+
+	result := w.Result()
+	defer result.Body.Close()
+	bodyBytes, _ := io.ReadAll(result.Body)
+	body := string(bodyBytes)
+
+	assert.Equal(http.StatusMultiStatus, result.StatusCode)
+	assert.Contains(body, "/calendar/event-1.ics")
+	assert.NotContains(body, "/calendar/event-2.ics")
+	assert.Contains(body, "<d:getetag>")
+	assert.NotContains(body, "calendar-data")
+	assert.Contains(body, `<displayname xmlns="DAV:"/>`)
+	assert.Contains(body, "HTTP/1.1 404 Not Found")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_CalendarMultiget(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	now := time.Now().UTC()
+	expectCollectionEvents(dbMock, sqlmock.NewRows(syncEventColumns).
+		AddRow("event-1", "first", "", now, now.Add(time.Hour), now, now, "test-user", nil, false, "", nil, "", "private", "", nil))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/caldav/token/calendar/", strings.NewReader(`<?xml version="1.0" encoding="utf-8" ?>
+<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <D:getetag/>
+    <C:calendar-data/>
+  </D:prop>
+  <D:href>/plugins/com.dmkir.calendar/caldav/token/calendar/event-1.ics</D:href>
+  <D:href>/plugins/com.dmkir.calendar/caldav/token/calendar/missing.ics</D:href>
+</C:calendar-multiget>`))
+	backend.ServeHTTP(w, r)
+
+	result := w.Result()
+	defer result.Body.Close()
+	bodyBytes, _ := io.ReadAll(result.Body)
+	body := string(bodyBytes)
+
+	assert.Equal(http.StatusMultiStatus, result.StatusCode)
+	assert.Contains(body, "/calendar/event-1.ics")
+	assert.Contains(body, "<cal:calendar-data>BEGIN:VCALENDAR")
+	assert.Contains(body, "<d:href>/plugins/com.dmkir.calendar/caldav/token/calendar/missing.ics</d:href>\n    <d:status>HTTP/1.1 404 Not Found</d:status>")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_UnsupportedReport(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	calPlugin.API.(*plugintest.API).On("LogError", mock.Anything).Return()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/caldav/token/calendar/", strings.NewReader(`<C:free-busy-query xmlns:C="urn:ietf:params:xml:ns:caldav"/>`))
+	backend.ServeHTTP(w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Contains(w.Body.String(), "supported-report")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("REPORT", "/caldav/token/calendar/", strings.NewReader("not xml"))
+	backend.ServeHTTP(w, r)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// iTIP request statuses returned in CALDAV:schedule-response (RFC 5546 3.6)
+const (
+	scheduleStatusSuccess     = "2.0;Success"
+	scheduleStatusInvalidUser = "3.7;Invalid calendar user"
+	scheduleStatusNoAuthority = "3.8;No authority"
+	scheduleStatusFailed      = "5.1;Could not complete delivery"
+)
+
+// scheduleResponse is the delivery result for one recipient of an outbox POST
+type scheduleResponse struct {
+	recipient    string
+	status       string
+	calendarData string
+}
+
+func (b *CalDAVBackend) inboxPath() string {
+	return b.basePath + "/inbox/"
+}
+
+func (b *CalDAVBackend) outboxPath() string {
+	return b.basePath + "/outbox/"
+}
+
+// resourcePath returns the part of a request path below the base path, the base path contains the
+// token or the username
+func (b *CalDAVBackend) resourcePath(path string) string {
+	path = strings.TrimPrefix(path, "/plugins/"+PluginId)
+	return strings.TrimPrefix(path, strings.TrimPrefix(b.basePath, "/plugins/"+PluginId))
+}
+
+func (b *CalDAVBackend) isInboxPath(path string) bool {
+	return strings.HasPrefix(b.resourcePath(path), "/inbox")
+}
+
+func (b *CalDAVBackend) isOutboxPath(path string) bool {
+	return strings.HasPrefix(b.resourcePath(path), "/outbox")
+}
+
+func (b *CalDAVBackend) isCalendarPath(path string) bool {
+	return strings.HasPrefix(b.resourcePath(path), "/calendar")
+}
+
+// userAddress returns the calendar user address of a Mattermost user
+func userAddress(user *model.User) string {
+	return "mailto:" + strings.ToLower(user.Email)
+}
+
+// lookupUser returns a user by id, caching the result for the rest of the request
+func (b *CalDAVBackend) lookupUser(userId string) *model.User {
+	if user, ok := b.users[userId]; ok {
+		return user
+	}
+
+	user, err := b.plugin.API.GetUser(userId)
+	if err != nil {
+		user = nil
+	}
+
+	if b.users == nil {
+		b.users = map[string]*model.User{}
+	}
+	b.users[userId] = user
+	return user
+}
+
+// lookupAddress returns the Mattermost user owning a mailto: calendar user address
+func (b *CalDAVBackend) lookupAddress(address string) *model.User {
+	email := calendarAddressEmail(address)
+	if email == "" {
+		return nil
+	}
+
+	if user, ok := b.addresses[email]; ok {
+		return user
+	}
+	if b.addresses == nil {
+		b.addresses = map[string]*model.User{}
+	}
+
+	user, err := b.plugin.API.GetUserByEmail(email)
+	if err != nil {
+		b.addresses[email] = nil
+		return nil
+	}
+
+	if b.users == nil {
+		b.users = map[string]*model.User{}
+	}
+	b.users[user.Id] = user
+	b.addresses[email] = user
+	return user
+}
+
+// isOwnAddress reports whether the calendar user address belongs to the CalDAV user
+func (b *CalDAVBackend) isOwnAddress(address string) bool {
+	user := b.lookupUser(b.userID)
+	return user != nil && user.Email != "" && calendarAddressEmail(address) == strings.ToLower(user.Email)
+}
+
+// attachMembers loads the attendees of the events and drops private events the user declined
+func (b *CalDAVBackend) attachMembers(events []Event) []Event {
+	b.plugin.AttachEventMembers(events)
+
+	visible := events[:0]
+	for _, event := range events {
+		declined := event.AttendeeStatus[b.userID] == string(ics.ParticipationStatusDeclined)
+		if declined && event.Owner != b.userID && event.Visibility == VisibilityPrivate {
+			continue
+		}
+		visible = append(visible, event)
+	}
+	return visible
+}
+
+// principalScheduleProps returns the RFC 6638 principal properties, D: and C: prefixed
+func (b *CalDAVBackend) principalScheduleProps() string {
+	var addresses string
+	if user := b.lookupUser(b.userID); user != nil && user.Email != "" {
+		addresses = fmt.Sprintf(`
+          <D:href>%s</D:href>`, xmlEscape(userAddress(user)))
+	}
+
+	return fmt.Sprintf(`
+        <C:calendar-user-address-set>%s
+          <D:href>%s/</D:href>
+        </C:calendar-user-address-set>
+        <C:calendar-user-type>INDIVIDUAL</C:calendar-user-type>
+        <C:schedule-inbox-URL>
+          <D:href>%s</D:href>
+        </C:schedule-inbox-URL>
+        <C:schedule-outbox-URL>
+          <D:href>%s</D:href>
+        </C:schedule-outbox-URL>`, addresses, b.basePath, b.inboxPath(), b.outboxPath())
+}
+
+// scheduleCollectionResponses returns the D:response elements of the inbox and the outbox
+func (b *CalDAVBackend) scheduleCollectionResponses() string {
+	return fmt.Sprintf(`
+  <D:response>
+    <D:href>%s</D:href>
+    <D:propstat>
+      <D:prop>
+        <D:resourcetype>
+          <D:collection/>
+          <C:schedule-inbox/>
+        </D:resourcetype>
+        <D:displayname>Inbox</D:displayname>
+        <C:schedule-default-calendar-URL>
+          <D:href>%s/calendar/</D:href>
+        </C:schedule-default-calendar-URL>
+      </D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>
+  <D:response>
+    <D:href>%s</D:href>
+    <D:propstat>
+      <D:prop>
+        <D:resourcetype>
+          <D:collection/>
+          <C:schedule-outbox/>
+        </D:resourcetype>
+        <D:displayname>Outbox</D:displayname>
+      </D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>`, b.inboxPath(), b.basePath, b.outboxPath())
+}
+
+func (b *CalDAVBackend) schedulePropfindResponse(path, depth string) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">`)
+
+	collections := b.scheduleCollectionResponses()
+	inboxEnd := strings.Index(collections, "</D:response>") + len("</D:response>")
+	if b.isInboxPath(path) {
+		buf.WriteString(collections[:inboxEnd])
+	} else {
+		buf.WriteString(collections[inboxEnd:])
+	}
+
+	if b.isInboxPath(path) && depth == "1" {
+		messages, err := b.plugin.GetScheduleMessages(b.userID)
+		if err != nil {
+			b.plugin.API.LogError("CalDAV inbox: " + err.Error())
+		}
+		for _, message := range messages {
+			buf.WriteString(fmt.Sprintf(`
+  <D:response>
+    <D:href>%s%s.ics</D:href>
+    <D:propstat>
+      <D:prop>
+        <D:getetag>"%s"</D:getetag>
+        <D:getcontenttype>text/calendar; charset=utf-8; method=%s</D:getcontenttype>
+        <D:resourcetype/>
+      </D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>`, b.inboxPath(), message.Id, message.Id, message.Method))
+		}
+	}
+
+	buf.WriteString(`
+</D:multistatus>`)
+	return buf.String()
+}
+
+// findScheduleMessage returns the inbox message addressed by the path
+func (b *CalDAVBackend) findScheduleMessage(path string) *ScheduleMessage {
+	messageId := b.extractEventID(path)
+	if messageId == "" {
+		return nil
+	}
+
+	messages, err := b.plugin.GetScheduleMessages(b.userID)
+	if err != nil {
+		b.plugin.API.LogError("CalDAV inbox: " + err.Error())
+		return nil
+	}
+
+	for i := range messages {
+		if messages[i].Id == messageId {
+			return &messages[i]
+		}
+	}
+	return nil
+}
+
+func (b *CalDAVBackend) handleInboxGet(w http.ResponseWriter, r *http.Request) {
+	message := b.findScheduleMessage(r.URL.Path)
+	if message == nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8; method="+message.Method)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, message.Id))
+	w.Write([]byte(message.Data))
+}
+
+func (b *CalDAVBackend) handleInboxDelete(w http.ResponseWriter, r *http.Request) {
+	deleted, err := b.plugin.DeleteScheduleMessage(b.userID, b.extractEventID(r.URL.Path))
+	if err != nil {
+		b.plugin.API.LogError("CalDAV inbox DELETE: " + err.Error())
+		http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleInboxMultiget answers calendar-multiget REPORTs on the scheduling inbox
+func (b *CalDAVBackend) handleInboxMultiget(w http.ResponseWriter, request *reportRequest) {
+	messages, err := b.plugin.GetScheduleMessages(b.userID)
+	if err != nil {
+		b.plugin.API.LogError("CalDAV inbox: " + err.Error())
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	byId := make(map[string]*ScheduleMessage, len(messages))
+	for i := range messages {
+		byId[messages[i].Id] = &messages[i]
+	}
+
+	var buf bytes.Buffer
+	writeMultistatusStart(&buf)
+	for _, href := range request.Hrefs {
+		href = strings.TrimSpace(href)
+		message, ok := byId[b.extractEventID(href)]
+		if !ok {
+			writeNotFoundResponse(&buf, href)
+			continue
+		}
+		buf.WriteString(fmt.Sprintf(`
+  <d:response>
+    <d:href>%s</d:href>
+    <d:propstat>
+      <d:prop>
+        <d:getetag>"%s"</d:getetag>
+        <cal:calendar-data>%s</cal:calendar-data>
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>`, xmlEscape(href), message.Id, xmlEscape(message.Data)))
+	}
+	buf.WriteString(`</d:multistatus>`)
+
+	writeMultistatus(w, buf.Bytes())
+}
+
+// handleOutboxPost processes an iTIP message POSTed to the scheduling outbox (RFC 6638 5)
+func (b *CalDAVBackend) handleOutboxPost(w http.ResponseWriter, r *http.Request) {
+	if !b.isOutboxPath(r.URL.Path) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	cal, err := ics.ParseCalendar(bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "Failed to parse iCalendar data", http.StatusBadRequest)
+		return
+	}
+
+	method := ""
+	for _, property := range cal.CalendarProperties {
+		if property.IANAToken == string(ics.PropertyMethod) {
+			method = strings.ToUpper(property.Value)
+		}
+	}
+
+	var freeBusy *ics.VBusy
+	for _, component := range cal.Components {
+		if busy, ok := component.(*ics.VBusy); ok {
+			freeBusy = busy
+		}
+	}
+
+	b.plugin.API.LogInfo("CalDAV outbox POST", "method", method)
+
+	var responses []scheduleResponse
+	var allowed bool
+	switch {
+	case method == string(ics.MethodRequest) && freeBusy != nil:
+		responses, allowed = b.scheduleFreeBusy(freeBusy)
+	case method == string(ics.MethodRequest) || method == string(ics.MethodCancel):
+		responses, allowed = b.scheduleOrganizerMessage(cal, ics.Method(method), string(body))
+	case method == string(ics.MethodReply):
+		responses, allowed = b.scheduleAttendeeMessage(cal, string(body))
+	default:
+		writeScheduleError(w, "valid-scheduling-message")
+		return
+	}
+
+	if !allowed {
+		writeScheduleError(w, "organizer-allowed")
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<C:schedule-response xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">`)
+	for _, response := range responses {
+		buf.WriteString(fmt.Sprintf(`
+  <C:response>
+    <C:recipient><D:href>%s</D:href></C:recipient>
+    <C:request-status>%s</C:request-status>`, xmlEscape(response.recipient), response.status))
+		if response.calendarData != "" {
+			buf.WriteString(fmt.Sprintf(`
+    <C:calendar-data>%s</C:calendar-data>`, xmlEscape(response.calendarData)))
+		}
+		buf.WriteString(`
+  </C:response>`)
+	}
+	buf.WriteString(`
+</C:schedule-response>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func writeScheduleError(w http.ResponseWriter, precondition string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<D:error xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><C:%s/></D:error>`, precondition)))
+}
+
+// scheduleOrganizerMessage delivers a REQUEST or CANCEL sent by the organizer and adds or
+// removes the recipients as members of the organizer's event
+func (b *CalDAVBackend) scheduleOrganizerMessage(cal *ics.Calendar, method ics.Method, data string) ([]scheduleResponse, bool) {
+	events := cal.Events()
+	if len(events) == 0 {
+		return nil, false
+	}
+	vevent := events[0]
+
+	organizer := vevent.GetProperty(ics.ComponentPropertyOrganizer)
+	if organizer == nil || !b.isOwnAddress(organizer.Value) {
+		return nil, false
+	}
+
+	uid := ""
+	if property := vevent.GetProperty(ics.ComponentPropertyUniqueId); property != nil {
+		uid = property.Value
+	}
+
+	event, _ := b.getEventByID(uid)
+	owned := event != nil && event.Owner == b.userID
+
+	var members []string
+	if owned {
+		members = append(members, event.Attendees...)
+	}
+
+	var responses []scheduleResponse
+	for _, attendee := range vevent.Attendees() {
+		if b.isOwnAddress(attendee.Value) {
+			continue
+		}
+
+		recipient := b.lookupAddress(attendee.Value)
+		if recipient == nil {
+			responses = append(responses, scheduleResponse{recipient: attendee.Value, status: scheduleStatusInvalidUser})
+			continue
+		}
+
+		if err := b.plugin.DeliverScheduleMessage(recipient.Id, uid, method, data); err != nil {
+			b.plugin.API.LogError("CalDAV outbox: " + err.Error())
+			responses = append(responses, scheduleResponse{recipient: attendee.Value, status: scheduleStatusFailed})
+			continue
+		}
+		responses = append(responses, scheduleResponse{recipient: attendee.Value, status: scheduleStatusSuccess})
+
+		if method == ics.MethodCancel {
+			var remaining []string
+			for _, member := range members {
+				if member != recipient.Id {
+					remaining = append(remaining, member)
+				}
+			}
+			members = remaining
+		} else if !contains(members, recipient.Id) {
+			members = append(members, recipient.Id)
+		}
+	}
+
+	if owned {
+		previousRecipients, _ := b.plugin.GetEventSyncRecipients(event.Id)
+		added, removed, err := b.plugin.SyncEventMembers(event.Id, members)
+		if err != nil {
+			b.plugin.API.LogError("CalDAV outbox: can't update members: " + err.Error())
+		} else if len(added) > 0 || len(removed) > 0 {
+			if err = b.plugin.TouchEvent(event.Id); err != nil {
+				b.plugin.API.LogError("CalDAV outbox: " + err.Error())
+			}
+			b.plugin.RecordEventChange(event.Id, previousRecipients)
+		}
+	}
+
+	return responses, true
+}
+
+// scheduleAttendeeMessage stores the attendee's REPLY and delivers it to the organizer
+func (b *CalDAVBackend) scheduleAttendeeMessage(cal *ics.Calendar, data string) ([]scheduleResponse, bool) {
+	events := cal.Events()
+	if len(events) == 0 {
+		return nil, false
+	}
+	vevent := events[0]
+
+	partStat := ""
+	for _, attendee := range vevent.Attendees() {
+		if b.isOwnAddress(attendee.Value) {
+			partStat = string(attendee.ParticipationStatus())
+		}
+	}
+	if partStat == "" {
+		return nil, false
+	}
+
+	organizer := vevent.GetProperty(ics.ComponentPropertyOrganizer)
+	if organizer == nil {
+		return nil, false
+	}
+
+	uid := ""
+	if property := vevent.GetProperty(ics.ComponentPropertyUniqueId); property != nil {
+		uid = property.Value
+	}
+
+	if event, _ := b.getEventByID(uid); event != nil && contains(event.Attendees, b.userID) {
+		if err := b.plugin.SetMemberPartStat(event.Id, b.userID, partStat); err != nil {
+			b.plugin.API.LogError("CalDAV outbox: " + err.Error())
+		} else {
+			b.plugin.RecordEventChange(event.Id, nil)
+		}
+	}
+
+	recipient := b.lookupAddress(organizer.Value)
+	if recipient == nil {
+		return []scheduleResponse{{recipient: organizer.Value, status: scheduleStatusInvalidUser}}, true
+	}
+
+	if err := b.plugin.DeliverScheduleMessage(recipient.Id, uid, ics.MethodReply, data); err != nil {
+		b.plugin.API.LogError("CalDAV outbox: " + err.Error())
+		return []scheduleResponse{{recipient: organizer.Value, status: scheduleStatusFailed}}, true
+	}
+
+	return []scheduleResponse{{recipient: organizer.Value, status: scheduleStatusSuccess}}, true
+}
+
+// scheduleFreeBusy answers a VFREEBUSY REQUEST with the busy time of every attendee:
+// the events they own or attend and haven't declined
+func (b *CalDAVBackend) scheduleFreeBusy(request *ics.VBusy) ([]scheduleResponse, bool) {
+	organizer := request.GetProperty(ics.ComponentPropertyOrganizer)
+	if organizer == nil || !b.isOwnAddress(organizer.Value) {
+		return nil, false
+	}
+
+	start := b.parseICalTime(request.GetProperty(ics.ComponentPropertyDtStart))
+	end := b.parseICalTime(request.GetProperty(ics.ComponentPropertyDtEnd))
+	if start.IsZero() || !end.After(start) {
+		return nil, false
+	}
+
+	uid := model.NewId()
+	if property := request.GetProperty(ics.ComponentPropertyUniqueId); property != nil {
+		uid = property.Value
+	}
+
+	var responses []scheduleResponse
+	for _, attendee := range request.Attendees() {
+		recipient := b.lookupAddress(attendee.Value)
+		if recipient == nil {
+			responses = append(responses, scheduleResponse{recipient: attendee.Value, status: scheduleStatusInvalidUser})
+			continue
+		}
+
+		periods, appErr := b.plugin.GetUserBusyPeriods(recipient.Id, start, end)
+		if appErr != nil {
+			responses = append(responses, scheduleResponse{recipient: attendee.Value, status: scheduleStatusFailed})
+			continue
+		}
+
+		reply := ics.NewCalendar()
+		reply.SetMethod(ics.MethodReply)
+		reply.SetProductId("-//Mattermost Calendar Plugin//EN")
+		busy := reply.AddBusy(uid)
+		busy.SetDtStampTime(time.Now().UTC())
+		busy.SetStartAt(start)
+		busy.SetProperty(ics.ComponentPropertyDtEnd, end.UTC().Format(iCalDateTimeLayout))
+		busy.SetOrganizer(organizer.Value)
+		busy.AddAttendee(attendee.Value)
+
+		for _, period := range periods {
+			busy.AddProperty(ics.ComponentPropertyFreebusy,
+				period.Start.UTC().Format(iCalDateTimeLayout)+"/"+period.End.UTC().Format(iCalDateTimeLayout),
+				&ics.KeyValues{Key: "FBTYPE", Value: []string{"BUSY"}})
+		}
+
+		responses = append(responses, scheduleResponse{
+			recipient:    attendee.Value,
+			status:       scheduleStatusSuccess,
+			calendarData: reply.Serialize(),
+		})
+	}
+
+	return responses, true
+}
+
+// scheduleOrganizerChange implements implicit scheduling for an event the organizer PUT:
+// ATTENDEEs that are Mattermost users become members, new members get a REQUEST, removed
+// ones a CANCEL and the others a REQUEST when the time or the title changed
+func (b *CalDAVBackend) scheduleOrganizerChange(previous *Event, vevent *ics.VEvent, eventID string) {
+	// events without attendees aren't scheduled, unless the attendees were just removed
+	if vevent.GetProperty(ics.ComponentPropertyOrganizer) == nil && len(vevent.Attendees()) == 0 &&
+		(previous == nil || len(previous.Attendees) == 0) {
+		return
+	}
+
+	var attendees []string
+	for _, attendee := range vevent.Attendees() {
+		user := b.lookupAddress(attendee.Value)
+		if user == nil || user.Id == b.userID || contains(attendees, user.Id) {
+			continue
+		}
+		attendees = append(attendees, user.Id)
+	}
+
+	added, removed, err := b.plugin.SyncEventMembers(eventID, attendees)
+	if err != nil {
+		b.plugin.API.LogError("CalDAV scheduling: can't update members: " + err.Error())
+		return
+	}
+
+	saved, err := b.getEventByID(eventID)
+	if err != nil {
+		return
+	}
+
+	changed := previous != nil && (!previous.Start.Equal(saved.Start) || !previous.End.Equal(saved.End) || previous.AllDay != saved.AllDay ||
+		previous.Title != saved.Title || previous.Recurrence != saved.Recurrence)
+
+	var recipients []string
+	for _, member := range saved.Attendees {
+		if contains(added, member) || changed {
+			recipients = append(recipients, member)
+		}
+	}
+	b.deliverEventMessage(saved, ics.MethodRequest, recipients)
+
+	if len(removed) > 0 {
+		cancelled := *saved
+		cancelled.Attendees = removed
+		b.deliverEventMessage(&cancelled, ics.MethodCancel, removed)
+	}
+}
+
+// deliverEventMessage puts an iTIP REQUEST or CANCEL for the event into the recipients' inboxes
+func (b *CalDAVBackend) deliverEventMessage(event *Event, method ics.Method, recipients []string) {
+	if len(recipients) == 0 {
+		return
+	}
+
+	cal := b.eventToICalendar(event, b.lookupUser(event.Owner))
+	cal.SetMethod(method)
+	if method == ics.MethodCancel {
+		for _, vevent := range cal.Events() {
+			vevent.SetStatus(ics.ObjectStatusCancelled)
+		}
+	}
+	data := cal.Serialize()
+
+	for _, recipient := range recipients {
+		if err := b.plugin.DeliverScheduleMessage(recipient, event.Id, method, data); err != nil {
+			b.plugin.API.LogError("CalDAV scheduling: " + err.Error())
+		}
+	}
+}
+
+// deliverReply puts the attendee's iTIP REPLY into the organizer's inbox
+func (b *CalDAVBackend) deliverReply(event *Event, partStat string) {
+	attendee := b.lookupUser(b.userID)
+	organizer := b.lookupUser(event.Owner)
+	if attendee == nil || organizer == nil {
+		return
+	}
+
+	cal := ics.NewCalendar()
+	cal.SetMethod(ics.MethodReply)
+	cal.SetProductId("-//Mattermost Calendar Plugin//EN")
+	cal.SetVersion("2.0")
+
+	reply := cal.AddEvent(event.Id)
+	reply.SetDtStampTime(time.Now().UTC())
+	setEventTiming(reply, event)
+	reply.SetSummary(event.Title)
+	reply.SetOrganizer(organizer.Email, ics.WithCN(organizer.GetDisplayName("")))
+	reply.AddAttendee(attendee.Email, ics.WithCN(attendee.GetDisplayName("")), ics.ParticipationStatus(partStat))
+	addTimezones(cal)
+
+	if err := b.plugin.DeliverScheduleMessage(event.Owner, event.Id, ics.MethodReply, cal.Serialize()); err != nil {
+		b.plugin.API.LogError("CalDAV scheduling: " + err.Error())
+	}
+}
+
+// handleAttendeeChange handles a PUT or DELETE of an event by one of its attendees: only the
+// attendee's participation status is stored and sent to the organizer as a REPLY
+func (b *CalDAVBackend) handleAttendeeChange(w http.ResponseWriter, event *Event, partStat string) {
+	if partStat != event.AttendeeStatus[b.userID] {
+		if err := b.plugin.SetMemberPartStat(event.Id, b.userID, partStat); err != nil {
+			b.plugin.API.LogError("CalDAV scheduling: " + err.Error())
+			http.Error(w, "Failed to save reply", http.StatusInternalServerError)
+			return
+		}
+		b.plugin.RecordEventChange(event.Id, nil)
+		b.deliverReply(event, partStat)
+	}
+
+	if saved, _ := b.getEventByID(event.Id); saved != nil {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, eventETag(saved)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownPartStat returns the participation status of the CalDAV user's ATTENDEE, "" if absent
+func (b *CalDAVBackend) ownPartStat(vevent *ics.VEvent) string {
+	for _, attendee := range vevent.Attendees() {
+		if b.isOwnAddress(attendee.Value) {
+			if partStat := attendee.ParticipationStatus(); partStat != "" {
+				return string(partStat)
+			}
+			return string(ics.ParticipationStatusNeedsAction)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// containsArg matches a string query argument containing the substring
+type containsArg string
+
+func (c containsArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && strings.Contains(s, string(c))
+}
+
+var scheduleAlice = &model.User{Id: "alice-id", Username: "alice", Email: "alice@example.com"}
+
+func newScheduleTestPlugin(t *testing.T) (*Plugin, *plugintest.API, sqlmock.Sqlmock, func()) {
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	api := calPlugin.API.(*plugintest.API)
+	api.On("GetUser", "alice-id").Return(scheduleAlice, nil).Maybe()
+	api.On("GetUserByEmail", "alice@example.com").Return(scheduleAlice, nil).Maybe()
+	api.On("GetUserByEmail", "test@example.com").Return(&model.User{Id: "test-user", Username: "testuser", Email: "test@example.com"}, nil).Maybe()
+	api.On("GetUserByEmail", mock.Anything).Return(nil, model.NewAppError("GetUserByEmail", "not_found", nil, "", http.StatusNotFound)).Maybe()
+	return calPlugin, api, dbMock, closeDB
+}
+
+func scheduleEventRow(id, owner string, start time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows(caldavEventColumns).
+		AddRow(id, "Planning", "", start, start.Add(time.Hour), start, start, owner, nil, false, "", nil, "", "private", "", nil)
+}
+
+func TestCalDAVBackend_EventAttendees(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	now := time.Now().UTC()
+	event := &Event{
+		Id:             "event-1",
+		Title:          "Planning",
+		Start:          now,
+		End:            now.Add(time.Hour),
+		Owner:          "test-user",
+		Attendees:      []string{"alice-id"},
+		AttendeeStatus: map[string]string{"alice-id": "ACCEPTED"},
+	}
+
+	data := backend.eventToICalendarString(event, backend.lookupUser("test-user"))
+	unfolded := strings.ReplaceAll(data, "\r\n ", "")
+
+	assert.NotContains(data, "METHOD:")
+	assert.Contains(unfolded, "ORGANIZER;CN=testuser:mailto:test@example.com")
+	assert.Contains(unfolded, "ATTENDEE;CN=alice;CUTYPE=INDIVIDUAL;PARTSTAT=ACCEPTED;ROLE=REQ-PARTICIPANT;RSVP=false:mailto:alice@example.com")
+}
+
+func TestCalDAVBackend_PrincipalScheduleProps(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", "/plugins/com.dmkir.calendar/caldav/token/", nil)
+	r.Header.Set("Depth", "0")
+	backend.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	assert.Equal(http.StatusMultiStatus, w.Code)
+	assert.Contains(body, "<D:href>mailto:test@example.com</D:href>")
+	assert.Contains(body, "<C:schedule-inbox-URL>\n          <D:href>/plugins/com.dmkir.calendar/caldav/token/inbox/</D:href>")
+	assert.Contains(body, "<C:schedule-outbox-URL>\n          <D:href>/plugins/com.dmkir.calendar/caldav/token/outbox/</D:href>")
+	assert.Contains(w.Header().Get("DAV"), "calendar-auto-schedule")
+}
+
+func TestCalDAVBackend_OrganizerPutSchedulesAttendees(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+
+	start := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	// new event
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnError(sql.ErrNoRows)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_events")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// alice becomes a member and gets a REQUEST
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_members (event,member,partstat) VALUES ($1,$2,$3)")).
+		WithArgs("event-1", "alice-id", "NEEDS-ACTION").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnRows(scheduleEventRow("event-1", "test-user", start))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns).AddRow("event-1", "alice-id", "NEEDS-ACTION"))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_schedule_messages")).
+		WithArgs(sqlmock.AnyArg(), "alice-id", "event-1", "REQUEST", containsArg("METHOD:REQUEST"), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// change log
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ce.owner, ce.visibility, ce.channel, ce.team, cm.member FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", "alice-id"))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes")).
+		WillReturnResult(sqlmock.NewResult(1, 2))
+	// saved event for the ETag
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnRows(scheduleEventRow("event-1", "test-user", start))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns).AddRow("event-1", "alice-id", "NEEDS-ACTION"))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/caldav/token/calendar/event-1.ics", strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Apple Inc.//macOS 14.0//EN
+BEGIN:VEVENT
+UID:event-1
+DTSTART:20240115T100000Z
+DTEND:20240115T110000Z
+SUMMARY:Planning
+ORGANIZER;CN=testuser:mailto:test@example.com
+ATTENDEE;CN=testuser;PARTSTAT=ACCEPTED:mailto:test@example.com
+ATTENDEE;CN=alice;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:alice@example.com
+ATTENDEE;PARTSTAT=NEEDS-ACTION:mailto:someone@elsewhere.example
+END:VEVENT
+END:VCALENDAR
+`))
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_AttendeePutSendsReply(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	api.On("GetUser", "organizer-id").Return(&model.User{Id: "organizer-id", Username: "organizer", Email: "organizer@example.com"}, nil)
+
+	start := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnRows(scheduleEventRow("event-1", "organizer-id", start))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns).AddRow("event-1", "test-user", "NEEDS-ACTION"))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_members SET partstat = $1, accepted = $2 WHERE event = $3 AND member = $4")).
+		WithArgs("ACCEPTED", true, "event-1", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET updated = $1 WHERE id = $2")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ce.owner, ce.visibility, ce.channel, ce.team, cm.member FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("organizer-id", "private", nil, "", "test-user"))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes")).
+		WillReturnResult(sqlmock.NewResult(1, 2))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_schedule_messages")).
+		WithArgs(sqlmock.AnyArg(), "organizer-id", "event-1", "REPLY", containsArg("PARTSTAT=ACCEPTED"), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnRows(scheduleEventRow("event-1", "organizer-id", start))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns).AddRow("event-1", "test-user", "ACCEPTED"))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/caldav/token/calendar/event-1.ics", strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Mozilla.org/NONSGML Mozilla Calendar V1.1//EN
+BEGIN:VEVENT
+UID:event-1
+DTSTART:20240115T100000Z
+DTEND:20240115T110000Z
+SUMMARY:Planning
+ORGANIZER;CN=organizer:mailto:organizer@example.com
+ATTENDEE;CN=testuser;PARTSTAT=ACCEPTED:mailto:test@example.com
+END:VEVENT
+END:VCALENDAR
+`))
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusNoContent, w.Code)
+	assert.NotEmpty(w.Header().Get("ETag"))
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_OutboxRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnError(sql.ErrNoRows)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_schedule_messages")).
+		WithArgs(sqlmock.AnyArg(), "alice-id", "external-1", "REQUEST", containsArg("UID:external-1"), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/caldav/token/outbox/", strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+METHOD:REQUEST
+BEGIN:VEVENT
+UID:external-1
+DTSTAMP:20240110T120000Z
+DTSTART:20240115T100000Z
+DTEND:20240115T110000Z
+SUMMARY:Planning
+ORGANIZER:mailto:test@example.com
+ATTENDEE;PARTSTAT=NEEDS-ACTION:mailto:alice@example.com
+ATTENDEE;PARTSTAT=NEEDS-ACTION:mailto:bob@elsewhere.example
+END:VEVENT
+END:VCALENDAR
+`))
+	backend.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(body, "<C:recipient><D:href>mailto:alice@example.com</D:href></C:recipient>\n    <C:request-status>2.0;Success</C:request-status>")
+	assert.Contains(body, "<C:recipient><D:href>mailto:bob@elsewhere.example</D:href></C:recipient>\n    <C:request-status>3.7;Invalid calendar user</C:request-status>")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_OutboxRequestFromOtherOrganizer(t *testing.T) {
+	calPlugin, _, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/caldav/token/outbox/", strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+METHOD:REQUEST
+BEGIN:VEVENT
+UID:external-1
+DTSTART:20240115T100000Z
+ORGANIZER:mailto:alice@example.com
+ATTENDEE:mailto:test@example.com
+END:VEVENT
+END:VCALENDAR
+`))
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "organizer-allowed")
+}
+
+func TestCalDAVBackend_OutboxFreeBusy(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	api.On("GetTeamsForUser", "alice-id").Return([]*model.Team{}, nil)
+
+	start := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm ON ce.id = cm.event")).
+		WillReturnRows(sqlmock.NewRows(syncEventColumns).
+			AddRow("busy-1", "Alice's event", "", start, start.Add(time.Hour), start, start, "alice-id", nil, false, "", nil, "", "private", "", nil).
+			AddRow("public-1", "Someone else's team event", "", start, start.Add(time.Hour), start, start, "bob-id", nil, false, "", nil, "", "private", "", nil))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ChannelId FROM ChannelMembers")).
+		WillReturnRows(sqlmock.NewRows([]string{"ChannelId"}))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/caldav/token/outbox/", strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+METHOD:REQUEST
+BEGIN:VFREEBUSY
+UID:fb-1
+DTSTAMP:20240110T120000Z
+DTSTART:20240115T000000Z
+DTEND:20240116T000000Z
+ORGANIZER:mailto:test@example.com
+ATTENDEE:mailto:alice@example.com
+END:VFREEBUSY
+END:VCALENDAR
+`))
+	backend.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(body, "2.0;Success")
+	assert.Contains(body, "FREEBUSY;FBTYPE=BUSY:20240115T100000Z/20240115T110000Z")
+	assert.Equal(1, strings.Count(body, "FREEBUSY;"))
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_Inbox(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+
+	messageColumns := []string{"id", "user_id", "event_id", "method", "data", "created"}
+	for i := 0; i < 2; i++ {
+		dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, user_id, event_id, method, data, created FROM calendar_schedule_messages WHERE user_id = $1 ORDER BY created")).
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows(messageColumns).
+				AddRow("message-1", "test-user", "event-1", "REQUEST", "BEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nEND:VCALENDAR\r\n", time.Now()))
+	}
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_schedule_messages WHERE id = $1 AND user_id = $2")).
+		WithArgs("message-1", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", "/caldav/token/inbox/", nil)
+	r.Header.Set("Depth", "1")
+	backend.ServeHTTP(w, r)
+	assert.Equal(http.StatusMultiStatus, w.Code)
+	assert.Contains(w.Body.String(), "<C:schedule-inbox/>")
+	assert.Contains(w.Body.String(), fmt.Sprintf("<D:href>%s/inbox/message-1.ics</D:href>", backend.basePath))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/caldav/token/inbox/message-1.ics", nil)
+	backend.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "METHOD:REQUEST")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("DELETE", "/caldav/token/inbox/message-1.ics", nil)
+	backend.ServeHTTP(w, r)
+	assert.Equal(http.StatusNoContent, w.Code)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/google/uuid"
+)
+
+func (b *CalDAVBackend) tasksPath() string {
+	return b.basePath + "/tasks/"
+}
+
+func (b *CalDAVBackend) isTasksPath(path string) bool {
+	return strings.HasPrefix(b.resourcePath(path), "/tasks")
+}
+
+// taskId returns the id of a task path, empty for the tasks collection itself
+func (b *CalDAVBackend) taskId(path string) string {
+	parts := strings.Split(strings.TrimSuffix(b.resourcePath(path), ".ics"), "/")
+	taskId := parts[len(parts)-1]
+	if taskId == "tasks" {
+		return ""
+	}
+	return taskId
+}
+
+// taskETag generates a deterministic ETag from the task content and its Updated timestamp
+func taskETag(task *Task) string {
+	hash := sha256.New()
+
+	for _, field := range []string{
+		task.Id,
+		task.Title,
+		task.Description,
+		formatOptionalTime(task.Due),
+		string(task.Status),
+		strconv.Itoa(task.Priority),
+		formatOptionalTime(task.Completed),
+		task.Assignee,
+		task.Updated.UTC().Truncate(time.Second).Format(time.RFC3339),
+	} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	if task.ICalData != nil {
+		hash.Write([]byte(*task.ICalData))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+// tasksCTag returns the getctag of the tasks collection, it changes with any of its tasks
+func tasksCTag(tasks []Task) string {
+	hash := sha256.New()
+	for i := range tasks {
+		hash.Write([]byte(taskETag(&tasks[i])))
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// firstTodo returns the VTODO that isn't a recurrence override, nil if there is none
+func firstTodo(cal *ics.Calendar) *ics.VTodo {
+	for _, vtodo := range cal.Todos() {
+		if vtodo.GetProperty(componentPropertyRecurrenceId) == nil {
+			return vtodo
+		}
+	}
+	return nil
+}
+
+// storedTaskCalendar parses the calendar object the client saved with the task, nil if there is none
+func (b *CalDAVBackend) storedTaskCalendar(task *Task) *ics.Calendar {
+	if task.ICalData == nil || *task.ICalData == "" {
+		return nil
+	}
+
+	cal, err := ics.ParseCalendar(strings.NewReader(*task.ICalData))
+	if err != nil || firstTodo(cal) == nil {
+		b.plugin.API.LogWarn("CalDAV: can't parse stored task data", "taskID", task.Id)
+		return nil
+	}
+	return cal
+}
+
+// taskToICalendar returns the calendar object of a task. Like the events, the calendar object
+// the client saved keeps the properties the plugin doesn't know.
+func (b *CalDAVBackend) taskToICalendar(task *Task) *ics.Calendar {
+	cal := b.storedTaskCalendar(task)
+	var vtodo *ics.VTodo
+	if cal != nil {
+		vtodo = firstTodo(cal)
+		vtodo.SetProperty(ics.ComponentPropertyUniqueId, task.Id)
+		removeProperties(&vtodo.ComponentBase,
+			ics.ComponentPropertyDescription,
+			ics.ComponentPropertyDue,
+			ics.ComponentPropertyPriority,
+			ics.ComponentPropertyCompleted,
+			ics.ComponentPropertyPercentComplete,
+			ics.ComponentPropertyOrganizer,
+			ics.ComponentPropertyAttendee,
+		)
+	} else {
+		cal = ics.NewCalendar()
+		cal.SetProductId("-//Mattermost Calendar Plugin//EN")
+		cal.SetVersion("2.0")
+		vtodo = cal.AddTodo(task.Id)
+	}
+
+	vtodo.SetDtStampTime(task.Updated)
+	vtodo.SetCreatedTime(task.Created)
+	vtodo.SetModifiedAt(task.Updated)
+	vtodo.SetSummary(task.Title)
+	vtodo.SetStatus(ics.ObjectStatus(task.Status))
+
+	if task.Description != "" {
+		vtodo.SetDescription(task.Description)
+	}
+	if task.Due != nil {
+		vtodo.SetDueAt(*task.Due)
+	}
+	if task.Priority > 0 {
+		vtodo.SetPriority(task.Priority)
+	}
+	if task.Completed != nil {
+		vtodo.SetCompletedAt(*task.Completed)
+		vtodo.SetPercentComplete(100)
+	}
+
+	// a task assigned to someone else has them as attendee
+	if task.Assignee != "" && task.Assignee != task.Owner {
+		owner := b.lookupUser(task.Owner)
+		assignee := b.lookupUser(task.Assignee)
+		if owner != nil && owner.Email != "" && assignee != nil && assignee.Email != "" {
+			vtodo.SetOrganizer(owner.Email, ics.WithCN(owner.GetDisplayName("")))
+			vtodo.AddAttendee(assignee.Email, ics.WithCN(assignee.GetDisplayName("")), ics.CalendarUserTypeIndividual)
+		}
+	}
+
+	return cal
+}
+
+// icalendarToTask reads the VTODO of a calendar object, the owner is set by the caller
+func (b *CalDAVBackend) icalendarToTask(cal *ics.Calendar, taskId string) (*Task, error) {
+	vtodo := firstTodo(cal)
+	if vtodo == nil {
+		return nil, fmt.Errorf("no VTODO found in calendar")
+	}
+
+	b.loadTimezones(cal)
+
+	task := &Task{Id: taskId}
+
+	if summary := vtodo.GetProperty(ics.ComponentPropertySummary); summary != nil {
+		task.Title = summary.Value
+	}
+	if desc := vtodo.GetProperty(ics.ComponentPropertyDescription); desc != nil {
+		task.Description = desc.Value
+	}
+	if due := b.parseICalTime(vtodo.GetProperty(ics.ComponentPropertyDue)); !due.IsZero() {
+		task.Due = &due
+	}
+	if status := vtodo.GetProperty(ics.ComponentPropertyStatus); status != nil {
+		task.Status = TaskStatus(strings.ToUpper(status.Value))
+	}
+	if !task.Status.IsValid() {
+		task.Status = TaskStatusNeedsAction
+	}
+	if priority := vtodo.GetProperty(ics.ComponentPropertyPriority); priority != nil {
+		if value, err := strconv.Atoi(priority.Value); err == nil && value >= 0 && value <= 9 {
+			task.Priority = value
+		}
+	}
+	if completed := b.parseICalTime(vtodo.GetProperty(ics.ComponentPropertyCompleted)); !completed.IsZero() {
+		task.Completed = &completed
+		// clients that only set COMPLETED still complete the task
+		if vtodo.GetProperty(ics.ComponentPropertyStatus) == nil {
+			task.Status = TaskStatusCompleted
+		}
+	}
+
+	for _, attendee := range vtodo.Attendees() {
+		if user := b.lookupAddress(attendee.Value); user != nil {
+			task.Assignee = user.Id
+			break
+		}
+	}
+
+	if task.Id == "" {
+		task.Id = uuid.New().String()
+	}
+
+	data := calendarObjectData(cal)
+	task.ICalData = &data
+
+	return task, nil
+}
+
+// taskPreconditionsMet evaluates If-Match and If-None-Match against the current task, nil if
+// the resource doesn't exist
+func taskPreconditionsMet(r *http.Request, task *Task) bool {
+	etag := ""
+	if task != nil {
+		etag = taskETag(task)
+	}
+	return resourcePreconditionsMet(r, etag, task != nil)
+}
+
+// tasksCollectionResponse returns the D:response of the tasks collection listed in the home
+func (b *CalDAVBackend) tasksCollectionResponse() string {
+	return fmt.Sprintf(`
+  <D:response>
+    <D:href>%s</D:href>
+    <D:propstat>
+      <D:prop>
+        <D:resourcetype>
+          <D:collection/>
+          <C:calendar/>
+        </D:resourcetype>
+        <D:displayname>Mattermost Tasks</D:displayname>
+        <C:supported-calendar-component-set>
+          <C:comp name="VTODO"/>
+        </C:supported-calendar-component-set>
+      </D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>`, b.tasksPath())
+}
+
+func (b *CalDAVBackend) handleTasksPropfind(w http.ResponseWriter, depth string) {
+	tasks, err := b.plugin.GetUserTasks(b.userID, true)
+	if err != nil {
+		http.Error(w, "Failed to get tasks", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	buf.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:cal="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">`)
+	buf.WriteString(fmt.Sprintf(`
+  <d:response>
+    <d:href>%s</d:href>
+    <d:propstat>
+      <d:prop>
+        <d:resourcetype>
+          <d:collection/>
+          <cal:calendar/>
+        </d:resourcetype>
+        <d:displayname>Mattermost Tasks</d:displayname>
+        <cal:supported-calendar-component-set>
+          <cal:comp name="VTODO"/>
+        </cal:supported-calendar-component-set>
+        <cs:getctag>%s</cs:getctag>
+        <d:supported-report-set>
+          <d:supported-report><d:report><cal:calendar-multiget/></d:report></d:supported-report>
+          <d:supported-report><d:report><cal:calendar-query/></d:report></d:supported-report>
+        </d:supported-report-set>
+        <d:current-user-privilege-set>
+          <d:privilege><d:read/></d:privilege>
+          <d:privilege><d:write/></d:privilege>
+          <d:privilege><d:write-content/></d:privilege>
+        </d:current-user-privilege-set>
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>`, b.tasksPath(), tasksCTag(tasks)))
+
+	if depth == "1" {
+		for i := range tasks {
+			b.writeTaskResponse(&buf, &tasks[i], []xml.Name{propGetETag, propGetContentType, propResourceType}, nil)
+		}
+	}
+	buf.WriteString(`
+</d:multistatus>`)
+
+	writeMultistatus(w, buf.Bytes())
+}
+
+// writeTaskResponse writes a DAV:response with the requested properties of the task
+func (b *CalDAVBackend) writeTaskResponse(buf *bytes.Buffer, task *Task, names []xml.Name, prop *reportProp) {
+	var found, missing bytes.Buffer
+
+	for _, name := range names {
+		switch name {
+		case propGetETag:
+			found.WriteString(fmt.Sprintf(`
+        <d:getetag>"%s"</d:getetag>`, taskETag(task)))
+		case propGetContentType:
+			found.WriteString(`
+        <d:getcontenttype>text/calendar; charset=utf-8; component=VTODO</d:getcontenttype>`)
+		case propResourceType:
+			found.WriteString(`
+        <d:resourcetype/>`)
+		case propCalendarData:
+			cal := b.taskToICalendar(task)
+			if prop != nil && prop.CalendarData != nil {
+				cal = selectCalendarData(cal, prop.CalendarData.Comp)
+			}
+			found.WriteString(fmt.Sprintf(`
+        <cal:calendar-data>%s</cal:calendar-data>`, xmlEscape(cal.Serialize())))
+		default:
+			missing.WriteString(fmt.Sprintf(`
+        <%s xmlns="%s"/>`, name.Local, xmlEscape(name.Space)))
+		}
+	}
+
+	buf.WriteString(fmt.Sprintf(`
+  <d:response>
+    <d:href>%s%s.ics</d:href>`, b.tasksPath(), task.Id))
+	if found.Len() > 0 {
+		buf.WriteString(fmt.Sprintf(`
+    <d:propstat>
+      <d:prop>%s
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>`, found.String()))
+	}
+	if missing.Len() > 0 {
+		buf.WriteString(fmt.Sprintf(`
+    <d:propstat>
+      <d:prop>%s
+      </d:prop>
+      <d:status>HTTP/1.1 404 Not Found</d:status>
+    </d:propstat>`, missing.String()))
+	}
+	buf.WriteString(`
+  </d:response>`)
+}
+
+// handleTasksReport implements calendar-multiget and calendar-query on the tasks collection
+func (b *CalDAVBackend) handleTasksReport(w http.ResponseWriter, request *reportRequest) {
+	multiget := request.XMLName == xml.Name{Space: nsCalDAV, Local: "calendar-multiget"}
+	if !multiget && request.XMLName != (xml.Name{Space: nsCalDAV, Local: "calendar-query"}) {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<d:error xmlns:d="DAV:"><d:supported-report/></d:error>`))
+		return
+	}
+
+	tasks, err := b.plugin.GetUserTasks(b.userID, true)
+	if err != nil {
+		http.Error(w, "Failed to get tasks", http.StatusInternalServerError)
+		return
+	}
+	names := request.propNames(propGetETag, propCalendarData)
+
+	var buf bytes.Buffer
+	writeMultistatusStart(&buf)
+	if multiget {
+		visible := make(map[string]*Task, len(tasks))
+		for i := range tasks {
+			visible[tasks[i].Id] = &tasks[i]
+		}
+		for _, href := range request.Hrefs {
+			task, ok := visible[b.taskId(strings.TrimSpace(href))]
+			if !ok {
+				writeNotFoundResponse(&buf, strings.TrimSpace(href))
+				continue
+			}
+			b.writeTaskResponse(&buf, task, names, request.Prop)
+		}
+	} else {
+		for i := range tasks {
+			if !b.matchCalendarFilter(b.taskToICalendar(&tasks[i]), request.Filter) {
+				continue
+			}
+			b.writeTaskResponse(&buf, &tasks[i], names, request.Prop)
+		}
+	}
+	buf.WriteString(`</d:multistatus>`)
+
+	writeMultistatus(w, buf.Bytes())
+}
+
+func (b *CalDAVBackend) handleTaskGet(w http.ResponseWriter, r *http.Request) {
+	taskId := b.taskId(r.URL.Path)
+	if taskId == "" {
+		http.Error(w, "Invalid task path", http.StatusBadRequest)
+		return
+	}
+
+	task, err := b.plugin.GetTask(b.userID, taskId)
+	if err != nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%s"`, taskETag(task))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", task.Updated.UTC().Format(http.TimeFormat))
+	if notModified(r, etag, task.Updated.UTC()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.taskToICalendar(task).Serialize()))
+}
+
+func (b *CalDAVBackend) handleTaskPut(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	cal, err := ics.ParseCalendar(bytes.NewReader(body))
+	if err != nil {
+		b.plugin.API.LogError("CalDAV PUT: failed to parse iCal", "error", err.Error())
+		http.Error(w, "Failed to parse iCalendar data", http.StatusBadRequest)
+		return
+	}
+	if firstTodo(cal) == nil {
+		writeScheduleError(w, "supported-calendar-component")
+		return
+	}
+
+	taskId := b.taskId(r.URL.Path)
+	if taskId == "" {
+		if uid := firstTodo(cal).GetProperty(ics.ComponentPropertyUniqueId); uid != nil {
+			taskId = uid.Value
+		}
+	}
+
+	changed, err := b.icalendarToTask(cal, taskId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	taskId = changed.Id
+
+	current, appErr := b.plugin.GetTask(b.userID, taskId)
+	if appErr != nil && appErr != TaskNotFound {
+		http.Error(w, "Failed to get task", http.StatusInternalServerError)
+		return
+	}
+	if !taskPreconditionsMet(r, current) {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	var task *Task
+	if current != nil {
+		// clients without attendees leave the assignee as it was
+		if changed.Assignee == "" {
+			changed.Assignee = current.Assignee
+		}
+		task = applyTaskChanges(current, changed, b.userID)
+	} else {
+		now := time.Now().UTC().Truncate(time.Second)
+		task = changed
+		task.Owner = b.userID
+		task.Created = now
+		task.Updated = now
+	}
+
+	if validateErr := b.plugin.validateTask(task); validateErr != nil {
+		http.Error(w, validateErr.Message, validateErr.StatusCode)
+		return
+	}
+
+	if current != nil {
+		appErr = b.plugin.updateTask(task, current)
+	} else {
+		appErr = b.plugin.insertTask(task)
+	}
+	if appErr != nil {
+		http.Error(w, "Failed to save task", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, taskETag(task)))
+	if current != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s%s.ics", b.tasksPath(), task.Id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (b *CalDAVBackend) handleTaskDelete(w http.ResponseWriter, r *http.Request) {
+	taskId := b.taskId(r.URL.Path)
+	if taskId == "" {
+		http.Error(w, "Invalid task path", http.StatusBadRequest)
+		return
+	}
+
+	task, appErr := b.plugin.GetTask(b.userID, taskId)
+	if appErr != nil {
+		if !taskPreconditionsMet(r, nil) {
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if !taskPreconditionsMet(r, task) {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	// the owner removes the task, the assignee can only complete it
+	if task.Owner != b.userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	if removeErr := b.plugin.removeTask(b.userID, taskId); removeErr != nil {
+		http.Error(w, "Failed to delete task", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
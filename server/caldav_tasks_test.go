@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	ics "github.com/arran4/golang-ical"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTaskICal = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Test//EN\r\n" +
+	"BEGIN:VTODO\r\n" +
+	"UID:task-1\r\n" +
+	"DTSTAMP:20240301T000000Z\r\n" +
+	"SUMMARY:Write the report\r\n" +
+	"DUE:20240320T170000Z\r\n" +
+	"PRIORITY:1\r\n" +
+	"X-APPLE-SORT-ORDER:42\r\n" +
+	"END:VTODO\r\n" +
+	"END:VCALENDAR\r\n"
+
+func expectUserTasks(dbMock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_tasks WHERE ((owner = $1 OR assignee = $2)) ORDER BY due IS NULL, due, created")).
+		WithArgs("test-user", "test-user").
+		WillReturnRows(rows)
+}
+
+func TestTodoInTimeRange(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	todo := func(properties ...string) *ics.VTodo {
+		cal, err := ics.ParseCalendar(strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\nUID:task-1\r\n" +
+			strings.Join(properties, "\r\n") + "\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"))
+		assert.Nil(err)
+		return cal.Todos()[0]
+	}
+	march := &timeRange{Start: "20240301T000000Z", End: "20240401T000000Z"}
+	april := &timeRange{Start: "20240401T000000Z", End: "20240501T000000Z"}
+
+	assert.True(backend.componentInTimeRange(todo("DUE:20240320T170000Z"), nil, march))
+	assert.False(backend.componentInTimeRange(todo("DUE:20240320T170000Z"), nil, april))
+	assert.True(backend.componentInTimeRange(todo("COMPLETED:20240320T170000Z"), nil, march))
+	assert.False(backend.componentInTimeRange(todo("COMPLETED:20240320T170000Z"), nil, april))
+	assert.True(backend.componentInTimeRange(todo("CREATED:20240320T170000Z"), nil, april))
+	assert.False(backend.componentInTimeRange(todo("CREATED:20240420T170000Z"), nil, march))
+	assert.True(backend.componentInTimeRange(todo("SUMMARY:Someday"), nil, march))
+	assert.False(backend.componentInTimeRange(todo("DTSTART:20240420T170000Z"), nil, march))
+}
+
+func TestCalDAVBackend_TaskPut(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_tasks WHERE (id = $1 AND (owner = $2 OR assignee = $3))")).
+		WithArgs("task-1", "test-user", "test-user").
+		WillReturnRows(sqlmock.NewRows(taskRowColumns))
+	due := time.Date(2024, 3, 20, 17, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_tasks")).
+		WithArgs("task-1", "Write the report", "", due, TaskStatusNeedsAction, 1, nil, "test-user", "test-user",
+			sqlmock.AnyArg(), nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/plugins/com.dmkir.calendar/caldav/token/tasks/task-1.ics", strings.NewReader(testTaskICal))
+	r.Header.Set("If-None-Match", "*")
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.NotEmpty(w.Header().Get("ETag"))
+	assert.Equal("/plugins/com.dmkir.calendar/caldav/token/tasks/task-1.ics", w.Header().Get("Location"))
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_TaskPutToCalendar(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/plugins/com.dmkir.calendar/caldav/token/calendar/task-1.ics", strings.NewReader(testTaskICal))
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Contains(w.Body.String(), "<C:supported-calendar-component/>")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_TaskGet(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	completed := time.Date(2024, 3, 19, 12, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_tasks WHERE (id = $1 AND (owner = $2 OR assignee = $3))")).
+		WithArgs("task-1", "test-user", "test-user").
+		WillReturnRows(sqlmock.NewRows(taskRowColumns).
+			AddRow("task-1", "Write the report", "", nil, "COMPLETED", 1, completed, "test-user", "test-user", testTaskICal, nil, now, now))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/plugins/com.dmkir.calendar/caldav/token/tasks/task-1.ics", nil)
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(body, "BEGIN:VTODO")
+	assert.Contains(body, "SUMMARY:Write the report")
+	assert.Contains(body, "STATUS:COMPLETED")
+	assert.Contains(body, "COMPLETED:20240319T120000Z")
+	assert.Contains(body, "PERCENT-COMPLETE:100")
+	// the stored calendar object keeps the properties of the client, the due date was removed
+	assert.Contains(body, "X-APPLE-SORT-ORDER:42")
+	assert.NotContains(body, "DUE:")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_TaskDeleteAssignee(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_tasks WHERE (id = $1 AND (owner = $2 OR assignee = $3))")).
+		WithArgs("task-1", "test-user", "test-user").
+		WillReturnRows(sqlmock.NewRows(taskRowColumns).
+			AddRow("task-1", "Write the report", "", nil, "NEEDS-ACTION", 0, nil, "other-user", "test-user", nil, nil, now, now))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/plugins/com.dmkir.calendar/caldav/token/tasks/task-1.ics", nil)
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_TasksPropfind(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	expectUserTasks(dbMock, sqlmock.NewRows(taskRowColumns).
+		AddRow("task-1", "Write the report", "", nil, "NEEDS-ACTION", 0, nil, "test-user", "test-user", nil, nil, now, now))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", "/plugins/com.dmkir.calendar/caldav/token/tasks/", nil)
+	r.Header.Set("Depth", "1")
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusMultiStatus, w.Code)
+	body := w.Body.String()
+	assert.Contains(body, `<cal:comp name="VTODO"/>`)
+	assert.Contains(body, "<cs:getctag>")
+	assert.Contains(body, "<d:href>/plugins/com.dmkir.calendar/caldav/token/tasks/task-1.ics</d:href>")
+	assert.Contains(body, "component=VTODO")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_TasksQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	due := time.Date(2024, 3, 20, 17, 0, 0, 0, time.UTC)
+	later := time.Date(2024, 4, 20, 17, 0, 0, 0, time.UTC)
+	expectUserTasks(dbMock, sqlmock.NewRows(taskRowColumns).
+		AddRow("task-1", "Write the report", "", due, "NEEDS-ACTION", 0, nil, "test-user", "test-user", nil, nil, now, now).
+		AddRow("task-2", "Plan the offsite", "", later, "NEEDS-ACTION", 0, nil, "test-user", "test-user", nil, nil, now, now))
+
+	body := `<?xml version="1.0" encoding="utf-8" ?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><D:getetag/><C:calendar-data/></D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VTODO">
+        <C:time-range start="20240301T000000Z" end="20240401T000000Z"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/plugins/com.dmkir.calendar/caldav/token/tasks/", strings.NewReader(body))
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusMultiStatus, w.Code)
+	response := w.Body.String()
+	assert.Contains(response, "/tasks/task-1.ics</d:href>")
+	assert.Contains(response, "SUMMARY:Write the report")
+	assert.NotContains(response, "task-2")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
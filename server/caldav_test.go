@@ -80,6 +80,200 @@ func TestEventETag(t *testing.T) {
 	assert.NotEqual(etag3, etag4)
 }
 
+func TestEventETag_Content(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	event := &Event{
+		Id:      "event-123",
+		Title:   "Test Event",
+		Start:   now,
+		End:     now.Add(time.Hour),
+		Updated: now,
+	}
+	etag := eventETag(event)
+
+	// same Updated, different content
+	changed := *event
+	changed.Title = "Renamed"
+	assert.NotEqual(etag, eventETag(&changed))
+
+	// sub-second precision is lost by the database and must not change the ETag
+	roundTripped := *event
+	roundTripped.Updated = now.Add(300 * time.Millisecond)
+	roundTripped.Start = now.In(time.FixedZone("UTC+3", 3*3600))
+	assert.Equal(etag, eventETag(&roundTripped))
+}
+
+func TestEtagListMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(etagListMatches(`"abc"`, "abc"))
+	assert.True(etagListMatches(`"xyz", "abc"`, "abc"))
+	assert.True(etagListMatches(`W/"abc"`, "abc"))
+	assert.True(etagListMatches(`*`, "abc"))
+	assert.False(etagListMatches(`"xyz"`, "abc"))
+}
+
+var caldavEventColumns = []string{
+	"id", "title", "description", "dt_start", "dt_end", "created", "updated", "owner", "channel",
+	"recurrent", "recurrence", "color", "team", "visibility", "alert", "alert_time",
+}
+
+const caldavPutBody = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Test//EN
+BEGIN:VEVENT
+UID:event-1
+DTSTART:20240115T100000Z
+DTEND:20240115T110000Z
+SUMMARY:Changed
+END:VEVENT
+END:VCALENDAR
+`
+
+func expectCalDAVEvent(dbMock sqlmock.Sqlmock, event *Event) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WillReturnRows(sqlmock.NewRows(caldavEventColumns).
+			AddRow(event.Id, event.Title, event.Description, event.Start, event.End, event.Created, event.Updated,
+				event.Owner, nil, false, "", nil, "", "private", "", nil))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+}
+
+// expectLockedCalDAVEvent expects the event to be read again FOR UPDATE before a conditional write
+func expectLockedCalDAVEvent(dbMock sqlmock.Sqlmock, event *Event) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1 FOR UPDATE")).
+		WillReturnRows(sqlmock.NewRows(caldavEventColumns).
+			AddRow(event.Id, event.Title, event.Description, event.Start, event.End, event.Created, event.Updated,
+				event.Owner, nil, false, "", nil, "", "private", "", nil))
+}
+
+func TestCalDAVBackend_Preconditions(t *testing.T) {
+	now := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	existing := &Event{
+		Id:         "event-1",
+		Title:      "Original",
+		Start:      now,
+		End:        now.Add(time.Hour),
+		Created:    now,
+		Updated:    now,
+		Owner:      "test-user",
+		Visibility: VisibilityPrivate,
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		value  string
+	}{
+		{"create over existing", "PUT", "If-None-Match", "*"},
+		{"stale put", "PUT", "If-Match", `"stale"`},
+		{"stale delete", "DELETE", "If-Match", `"stale"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+			defer closeDB()
+			expectCalDAVEvent(dbMock, existing)
+
+			backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.method, "/caldav/token/calendar/event-1.ics", strings.NewReader(caldavPutBody))
+			r.Header.Set(test.header, test.value)
+			backend.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+			assert.Nil(t, dbMock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCalDAVBackend_PutIfMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	now := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	existing := &Event{
+		Id:         "event-1",
+		Title:      "Original",
+		Start:      now,
+		End:        now.Add(time.Hour),
+		Created:    now,
+		Updated:    now,
+		Owner:      "test-user",
+		Visibility: VisibilityPrivate,
+	}
+	expectCalDAVEvent(dbMock, existing)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+	dbMock.ExpectBegin()
+	expectLockedCalDAVEvent(dbMock, existing)
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectCommit()
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectCalDAVEvent(dbMock, existing)
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/caldav/token/calendar/event-1.ics", strings.NewReader(caldavPutBody))
+	r.Header.Set("If-Match", `"`+eventETag(existing)+`"`)
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusNoContent, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_ChangedMeanwhile(t *testing.T) {
+	now := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	existing := &Event{
+		Id:         "event-1",
+		Title:      "Original",
+		Start:      now,
+		End:        now.Add(time.Hour),
+		Created:    now,
+		Updated:    now,
+		Owner:      "test-user",
+		Visibility: VisibilityPrivate,
+	}
+	// another client wrote the event between the read and the write
+	changed := *existing
+	changed.Title = "Changed by another client"
+	changed.Updated = now.Add(time.Minute)
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		t.Run(method, func(t *testing.T) {
+			calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+			defer closeDB()
+			expectCalDAVEvent(dbMock, existing)
+			dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm")).
+				WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+			dbMock.ExpectBegin()
+			expectLockedCalDAVEvent(dbMock, &changed)
+			dbMock.ExpectRollback()
+
+			backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(method, "/caldav/token/calendar/event-1.ics", strings.NewReader(caldavPutBody))
+			r.Header.Set("If-Match", `"`+eventETag(existing)+`"`)
+			backend.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+			assert.Nil(t, dbMock.ExpectationsWereMet())
+		})
+	}
+}
+
 func TestCalDAVBackend_eventToICalendarString(t *testing.T) {
 	assert := assert.New(t)
 
@@ -307,7 +501,7 @@ func TestServeCalDAV_NoBasicAuth(t *testing.T) {
 	api := plugintest.API{}
 	api.On("LogDebug", "Plugin HTTP request", "method", "GET", "path", "/caldav/"+tokenValue+"/", "user-agent", "").Return()
 	api.On("LogInfo", "CalDAV incoming request", "method", "GET", "path", "/caldav/"+tokenValue+"/", "host", "example.com", "user-agent", "", "hasAuth", false).Return()
-	api.On("LogError", "ServeCalDAV: token not found: sql: no rows in result set").Return()
+	api.On("LogError", "ServeCalDAV: token not found").Return()
 
 	// DB mocks - token not found
 	db, dbMock, err := sqlmock.New()
@@ -319,15 +513,15 @@ func TestServeCalDAV_NoBasicAuth(t *testing.T) {
 	dbx := sqlx.NewDb(db, "sqlmock")
 
 	// Mock query for token - return empty result
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
+	queryBuilder := sq.Select(icalTokenColumns...).
 		From("calendar_ical_tokens").
-		Where(sq.Eq{"token": tokenValue}).
+		Where(sq.Eq{"token_prefix": tokenValue[:icalTokenPrefixSize]}).
 		PlaceholderFormat(sq.Dollar)
 
 	querySql, _, _ := queryBuilder.ToSql()
 	dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(tokenValue).
-		WillReturnRows(sqlmock.NewRows([]string{"token", "user_id", "created", "last_used", "calendar_color"}))
+		WithArgs(tokenValue[:icalTokenPrefixSize]).
+		WillReturnRows(sqlmock.NewRows(icalTokenColumns))
 
 	calPlugin := Plugin{
 		MattermostPlugin: plugin.MattermostPlugin{
@@ -361,7 +555,7 @@ func TestServeCalDAV_TokenNotFound(t *testing.T) {
 	api := plugintest.API{}
 	api.On("LogDebug", "Plugin HTTP request", "method", "GET", "path", "/caldav/"+tokenValue+"/", "user-agent", "").Return()
 	api.On("LogInfo", "CalDAV incoming request", "method", "GET", "path", "/caldav/"+tokenValue+"/", "host", "example.com", "user-agent", "", "hasAuth", true).Return()
-	api.On("LogError", "ServeCalDAV: token not found: sql: no rows in result set").Return()
+	api.On("LogError", "ServeCalDAV: token not found").Return()
 
 	// DB mocks
 	db, dbMock, err := sqlmock.New()
@@ -373,15 +567,15 @@ func TestServeCalDAV_TokenNotFound(t *testing.T) {
 	dbx := sqlx.NewDb(db, "sqlmock")
 
 	// Mock query for token - return empty result
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
+	queryBuilder := sq.Select(icalTokenColumns...).
 		From("calendar_ical_tokens").
-		Where(sq.Eq{"token": tokenValue}).
+		Where(sq.Eq{"token_prefix": tokenValue[:icalTokenPrefixSize]}).
 		PlaceholderFormat(sq.Dollar)
 
 	querySql, _, _ := queryBuilder.ToSql()
 	dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(tokenValue).
-		WillReturnRows(sqlmock.NewRows([]string{"token", "user_id", "created", "last_used", "calendar_color"}))
+		WithArgs(tokenValue[:icalTokenPrefixSize]).
+		WillReturnRows(sqlmock.NewRows(icalTokenColumns))
 
 	calPlugin := Plugin{
 		MattermostPlugin: plugin.MattermostPlugin{
@@ -445,28 +639,37 @@ func TestServeCalDAV_PROPFIND(t *testing.T) {
 	createdTime := time.Now().UTC()
 
 	// Mock query for token
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
+	queryBuilder := sq.Select(icalTokenColumns...).
 		From("calendar_ical_tokens").
-		Where(sq.Eq{"token": tokenValue}).
+		Where(sq.Eq{"token_prefix": tokenValue[:icalTokenPrefixSize]}).
 		PlaceholderFormat(sq.Dollar)
 
 	defaultColor := "#1E90FFFF"
 	querySql, _, _ := queryBuilder.ToSql()
+	prefix, salt, hash := hashedICalToken(tokenValue)
 	dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(tokenValue).
-		WillReturnRows(sqlmock.NewRows([]string{"token", "user_id", "created", "last_used", "calendar_color"}).
-			AddRow(tokenValue, "test-user", createdTime, nil, defaultColor))
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_prefix", "token_salt", "token_hash", "user_id", "scope", "created", "last_used", "calendar_color"}).
+			AddRow("token-1", prefix, salt, hash, "test-user", ICalTokenScopeCalDAV, createdTime, nil, defaultColor))
 
 	// Mock update last_used
 	updateBuilder := sq.Update("calendar_ical_tokens").
 		Set("last_used", sqlmock.AnyArg()).
-		Where(sq.Eq{"token": tokenValue}).
+		Set("last_used_agent", "").
+		Where(sq.Eq{"id": "token-1"}).
 		PlaceholderFormat(sq.Dollar)
 	updateSql, _, _ := updateBuilder.ToSql()
 	dbMock.ExpectExec(regexp.QuoteMeta(updateSql)).
-		WithArgs(sqlmock.AnyArg(), tokenValue).
+		WithArgs(sqlmock.AnyArg(), "", "token-1").
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
+	// Mock access log
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_ical_token_access")).
+		WithArgs(sqlmock.AnyArg(), "token-1", "192.0.2.1", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT accessed FROM calendar_ical_token_access")).
+		WillReturnRows(sqlmock.NewRows([]string{"accessed"}))
+
 	calPlugin := Plugin{
 		MattermostPlugin: plugin.MattermostPlugin{
 			API: &api,
@@ -497,7 +700,7 @@ func TestServeCalDAV_PROPFIND(t *testing.T) {
 	api.AssertExpectations(t)
 }
 
-func TestGetICalToken_WithCalDAVURL(t *testing.T) {
+func TestGetICalToken_HidesHashedToken(t *testing.T) {
 	assert := assert.New(t)
 
 	ctx := &plugin.Context{
@@ -511,14 +714,6 @@ func TestGetICalToken_WithCalDAVURL(t *testing.T) {
 	}
 	api.On("GetSession", ctx.SessionId).Return(session, nil)
 
-	siteURL := "https://mattermost.example.com"
-	config := &model.Config{
-		ServiceSettings: model.ServiceSettings{
-			SiteURL: &siteURL,
-		},
-	}
-	api.On("GetConfig").Return(config)
-
 	// DB mocks
 	db, dbMock, err := sqlmock.New()
 	if err != nil {
@@ -530,18 +725,19 @@ func TestGetICalToken_WithCalDAVURL(t *testing.T) {
 
 	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
 	createdTime := time.Now().UTC()
+	prefix, salt, hash := hashedICalToken(tokenValue)
 
 	// Mock query for token - return existing token
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
+	queryBuilder := sq.Select(icalTokenColumns...).
 		From("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(sq.Dollar)
 
 	querySql, _, _ := queryBuilder.ToSql()
 	dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(session.UserId).
-		WillReturnRows(sqlmock.NewRows([]string{"token", "user_id", "created", "last_used", "calendar_color"}).
-			AddRow(tokenValue, session.UserId, createdTime, nil, "#1E90FFFF"))
+		WithArgs("", session.UserId).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_prefix", "token_salt", "token_hash", "user_id", "created", "calendar_color"}).
+			AddRow("token-1", prefix, salt, hash, session.UserId, createdTime, "#1E90FFFF"))
 
 	calPlugin := Plugin{
 		MattermostPlugin: plugin.MattermostPlugin{
@@ -566,8 +762,9 @@ func TestGetICalToken_WithCalDAVURL(t *testing.T) {
 	assert.Equal(http.StatusOK, result.StatusCode)
 
 	bodyStr := string(bodyBytes)
-	assert.Contains(bodyStr, `"caldavUrl":`)
-	assert.Contains(bodyStr, "/caldav/"+tokenValue+"/")
+	assert.Contains(bodyStr, `"enabled":true`)
+	assert.NotContains(bodyStr, `"caldavUrl":`)
+	assert.NotContains(bodyStr, prefix)
 
 	api.AssertExpectations(t)
 }
@@ -605,16 +802,16 @@ func TestGenerateICalToken_WithCalDAVURL(t *testing.T) {
 
 	// Mock delete query (delete existing token)
 	deleteBuilder := sq.Delete("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(sq.Dollar)
 	deleteSql, _, _ := deleteBuilder.ToSql()
 	dbMock.ExpectExec(regexp.QuoteMeta(deleteSql)).
-		WithArgs(session.UserId).
+		WithArgs("", session.UserId).
 		WillReturnResult(sqlmock.NewResult(0, 0))
 
 	// Mock insert query
 	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_ical_tokens")).
-		WithArgs(sqlmock.AnyArg(), session.UserId, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), session.UserId, ICalTokenScopeCalDAV, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	calPlugin := Plugin{
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/teambition/rrule-go"
+)
+
+// windowsTimezones maps the Windows zone names Outlook and Exchange use as TZID to IANA zones
+var windowsTimezones = map[string]string{
+	"UTC":                            "UTC",
+	"GMT Standard Time":              "Europe/London",
+	"Greenwich Standard Time":        "Atlantic/Reykjavik",
+	"W. Europe Standard Time":        "Europe/Berlin",
+	"Romance Standard Time":          "Europe/Paris",
+	"Central Europe Standard Time":   "Europe/Budapest",
+	"Central European Standard Time": "Europe/Warsaw",
+	"E. Europe Standard Time":        "Europe/Chisinau",
+	"FLE Standard Time":              "Europe/Kiev",
+	"GTB Standard Time":              "Europe/Bucharest",
+	"Russian Standard Time":          "Europe/Moscow",
+	"Turkey Standard Time":           "Europe/Istanbul",
+	"Israel Standard Time":           "Asia/Jerusalem",
+	"Arabian Standard Time":          "Asia/Dubai",
+	"India Standard Time":            "Asia/Kolkata",
+	"China Standard Time":            "Asia/Shanghai",
+	"Singapore Standard Time":        "Asia/Singapore",
+	"Tokyo Standard Time":            "Asia/Tokyo",
+	"AUS Eastern Standard Time":      "Australia/Sydney",
+	"New Zealand Standard Time":      "Pacific/Auckland",
+	"Eastern Standard Time":          "America/New_York",
+	"Central Standard Time":          "America/Chicago",
+	"Mountain Standard Time":         "America/Denver",
+	"US Mountain Standard Time":      "America/Phoenix",
+	"Pacific Standard Time":          "America/Los_Angeles",
+	"Alaskan Standard Time":          "America/Anchorage",
+	"Hawaiian Standard Time":         "Pacific/Honolulu",
+	"E. South America Standard Time": "America/Sao_Paulo",
+}
+
+// icalTimezone is a VTIMEZONE definition, used for TZIDs that are not IANA zone names
+type icalTimezone struct {
+	// location is the IANA zone named by X-LIC-LOCATION, if any
+	location    string
+	transitions []tzTransition
+}
+
+// tzTransition is a STANDARD or DAYLIGHT observance of a VTIMEZONE
+type tzTransition struct {
+	// onset is the local wall-clock time of the first onset, stored as UTC
+	onset  time.Time
+	rule   *rrule.RRule
+	offset time.Duration
+}
+
+// parseVTimezone reads the observances of a VTIMEZONE component
+func parseVTimezone(vtimezone *ics.VTimezone) *icalTimezone {
+	timezone := &icalTimezone{}
+	if location := vtimezone.GetProperty(componentPropertyXLicLocation); location != nil {
+		timezone.location = location.Value
+	}
+
+	for _, component := range vtimezone.SubComponents() {
+		switch component.(type) {
+		case *ics.Standard, *ics.Daylight:
+		default:
+			continue
+		}
+
+		dtstart := componentProperty(component, ics.ComponentPropertyDtStart)
+		offsetTo := componentProperty(component, componentPropertyTzOffsetTo)
+		if dtstart == nil || offsetTo == nil {
+			continue
+		}
+
+		onset, err := time.Parse(iCalLocalDateTimeLayout, dtstart.Value)
+		if err != nil {
+			continue
+		}
+		offset, ok := parseUTCOffset(offsetTo.Value)
+		if !ok {
+			continue
+		}
+
+		transition := tzTransition{onset: onset, offset: offset}
+		if rruleProperty := componentProperty(component, ics.ComponentPropertyRrule); rruleProperty != nil {
+			if option, err := rrule.StrToROption(rruleProperty.Value); err == nil {
+				option.Dtstart = onset
+				transition.rule, _ = rrule.NewRRule(*option)
+			}
+		}
+		timezone.transitions = append(timezone.transitions, transition)
+	}
+
+	return timezone
+}
+
+// toUTC converts a wall-clock time, given as UTC, using the observance in effect at that time
+func (tz *icalTimezone) toUTC(local time.Time) time.Time {
+	var latest time.Time
+	var offset time.Duration
+	found := false
+
+	for _, transition := range tz.transitions {
+		onset := transition.onset
+		if transition.rule != nil {
+			onset = transition.rule.Before(local, true)
+		}
+		if onset.IsZero() || onset.After(local) {
+			continue
+		}
+		if !found || onset.After(latest) {
+			latest, offset, found = onset, transition.offset, true
+		}
+	}
+
+	// before the first onset the earliest observance applies
+	if !found {
+		for _, transition := range tz.transitions {
+			if !found || transition.onset.Before(latest) {
+				latest, offset, found = transition.onset, transition.offset, true
+			}
+		}
+	}
+
+	return local.Add(-offset)
+}
+
+// parseUTCOffset parses a UTC-OFFSET value such as +0200 or -053000
+func parseUTCOffset(value string) (time.Duration, bool) {
+	if len(value) != 5 && len(value) != 7 {
+		return 0, false
+	}
+
+	sign := time.Duration(1)
+	switch value[0] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, false
+	}
+
+	parsed, err := time.Parse("150405", (value[1:] + "00")[:6])
+	if err != nil {
+		return 0, false
+	}
+
+	return sign * time.Duration(parsed.Hour()*3600+parsed.Minute()*60+parsed.Second()) * time.Second, true
+}
+
+// loadTimezones remembers the VTIMEZONE definitions of the calendar for parsing its TZIDs
+func (b *CalDAVBackend) loadTimezones(cal *ics.Calendar) {
+	for _, vtimezone := range cal.Timezones() {
+		tzid := vtimezone.GetProperty(ics.ComponentPropertyTzid)
+		if tzid == nil || tzid.Value == "" {
+			continue
+		}
+		if b.timezones == nil {
+			b.timezones = map[string]*icalTimezone{}
+		}
+		b.timezones[tzid.Value] = parseVTimezone(vtimezone)
+	}
+}
+
+// timezoneLocation resolves a TZID to an IANA zone. Besides IANA names it understands
+// X-LIC-LOCATION, Windows zone names and prefixed ids like /mozilla.org/20050126_1/Europe/Berlin.
+func (b *CalDAVBackend) timezoneLocation(tzid string) *time.Location {
+	candidates := []string{tzid}
+	if timezone, ok := b.timezones[tzid]; ok && timezone.location != "" {
+		candidates = append(candidates, timezone.location)
+	}
+	if name, ok := windowsTimezones[tzid]; ok {
+		candidates = append(candidates, name)
+	}
+	parts := strings.Split(strings.Trim(tzid, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		candidates = append(candidates, strings.Join(parts[i:], "/"))
+	}
+
+	for _, candidate := range candidates {
+		if candidate == "" || candidate == "Local" {
+			continue
+		}
+		if location, err := time.LoadLocation(candidate); err == nil {
+			return location
+		}
+	}
+
+	return nil
+}
+
+// propertyTimezone returns the IANA zone a DATE-TIME property is anchored in, empty for DATE values.
+// UTC and floating times, and TZIDs that don't resolve to an IANA zone, are anchored in UTC.
+func (b *CalDAVBackend) propertyTimezone(prop *ics.IANAProperty) string {
+	if prop == nil || isDateValue(prop) {
+		return ""
+	}
+	if tzid, ok := prop.ICalParameters[string(ics.ParameterTzid)]; ok && len(tzid) > 0 && !strings.HasSuffix(prop.Value, "Z") {
+		if location := b.timezoneLocation(tzid[0]); location != nil {
+			return location.String()
+		}
+	}
+	return time.UTC.String()
+}
+
+// zoneToUTC converts a wall-clock time in the TZID, given as UTC, to UTC
+func (b *CalDAVBackend) zoneToUTC(tzid string, local time.Time) (time.Time, bool) {
+	if location := b.timezoneLocation(tzid); location != nil {
+		return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), location).UTC(), true
+	}
+
+	if timezone, ok := b.timezones[tzid]; ok && len(timezone.transitions) > 0 {
+		return timezone.toUTC(local), true
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+const nsCardDAV = "urn:ietf:params:xml:ns:carddav"
+
+// vcardLineSize is the length in octets from which the vCard lines are folded (RFC 6350 3.2)
+const vcardLineSize = 75
+
+var propAddressData = xml.Name{Space: nsCardDAV, Local: "address-data"}
+
+// Contact is a Mattermost user of the address book
+type Contact struct {
+	Id                string `db:"id"`
+	Username          string `db:"username"`
+	FirstName         string `db:"first_name"`
+	LastName          string `db:"last_name"`
+	Email             string `db:"email"`
+	Position          string `db:"position"`
+	UpdateAt          int64  `db:"update_at"`
+	LastPictureUpdate int64  `db:"last_picture_update"`
+}
+
+// addressBookFilter is the filter of an addressbook-query REPORT (RFC 6352 10.5)
+type addressBookFilter struct {
+	Test        string              `xml:"test,attr"`
+	PropFilters []addressPropFilter `xml:"urn:ietf:params:xml:ns:carddav prop-filter"`
+}
+
+type addressPropFilter struct {
+	Name         string             `xml:"name,attr"`
+	Test         string             `xml:"test,attr"`
+	IsNotDefined *struct{}          `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+	TextMatches  []addressTextMatch `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+}
+
+type addressTextMatch struct {
+	MatchType       string `xml:"match-type,attr"`
+	NegateCondition string `xml:"negate-condition,attr"`
+	Value           string `xml:",chardata"`
+}
+
+type addressBookLimit struct {
+	NResults int `xml:"urn:ietf:params:xml:ns:carddav nresults"`
+}
+
+// vcardOptions are the settings the vCards are rendered with
+type vcardOptions struct {
+	siteURL      string
+	showEmail    bool
+	showFullName bool
+}
+
+// GetContacts returns the active users sharing a team with the user, the bots left out
+func (p *Plugin) GetContacts(userId string) ([]Contact, *model.AppError) {
+	queryBuilder := sq.Select(
+		"u.Id AS id",
+		"u.Username AS username",
+		"u.FirstName AS first_name",
+		"u.LastName AS last_name",
+		"u.Email AS email",
+		"u.Position AS position",
+		"u.UpdateAt AS update_at",
+		"u.LastPictureUpdate AS last_picture_update",
+	).
+		Distinct().
+		From("Users u").
+		Join("TeamMembers tm ON tm.UserId = u.Id").
+		Where(sq.Expr("tm.TeamId IN (SELECT TeamId FROM TeamMembers WHERE UserId = ? AND DeleteAt = 0)", userId)).
+		Where(sq.Eq{"tm.DeleteAt": 0, "u.DeleteAt": 0}).
+		Where("u.Id NOT IN (SELECT UserId FROM Bots)").
+		OrderBy("username").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, err := queryBuilder.ToSql()
+	if err != nil {
+		p.API.LogError(err.Error())
+		return nil, SomethingWentWrong
+	}
+
+	var contacts []Contact
+	if err = p.DB.Select(&contacts, querySql, args...); err != nil {
+		p.API.LogError("GetContacts: " + err.Error())
+		return nil, SomethingWentWrong
+	}
+	return contacts, nil
+}
+
+// vcardOptions reads the site URL and the privacy settings, the vCards hide the emails and the
+// full names like the rest of Mattermost does
+func (p *Plugin) vcardOptions() vcardOptions {
+	options := vcardOptions{showEmail: true, showFullName: true}
+	config := p.API.GetConfig()
+	if config == nil {
+		return options
+	}
+	if config.ServiceSettings.SiteURL != nil {
+		options.siteURL = strings.TrimSuffix(*config.ServiceSettings.SiteURL, "/")
+	}
+	if config.PrivacySettings.ShowEmailAddress != nil {
+		options.showEmail = *config.PrivacySettings.ShowEmailAddress
+	}
+	if config.PrivacySettings.ShowFullName != nil {
+		options.showFullName = *config.PrivacySettings.ShowFullName
+	}
+	return options
+}
+
+// vcardEscape escapes a vCard text value (RFC 6350 3.4)
+func vcardEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// writeVCardLine writes a content line folded at vcardLineSize octets, without splitting characters
+func writeVCardLine(buf *strings.Builder, line string) {
+	size := vcardLineSize
+	for len(line) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// the space starting the continuation line counts
+		size = vcardLineSize - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// contactVCard renders the vCard 4.0 of a contact
+func contactVCard(contact *Contact, options vcardOptions) string {
+	var buf strings.Builder
+	writeVCardLine(&buf, "BEGIN:VCARD")
+	writeVCardLine(&buf, "VERSION:4.0")
+	writeVCardLine(&buf, "KIND:individual")
+	writeVCardLine(&buf, "UID:urn:mattermost:user:"+contact.Id)
+
+	fullName := contact.Username
+	if options.showFullName {
+		if name := strings.TrimSpace(contact.FirstName + " " + contact.LastName); name != "" {
+			fullName = name
+		}
+		writeVCardLine(&buf, "N:"+vcardEscape(contact.LastName)+";"+vcardEscape(contact.FirstName)+";;;")
+	} else {
+		writeVCardLine(&buf, "N:;;;;")
+	}
+	writeVCardLine(&buf, "FN:"+vcardEscape(fullName))
+	writeVCardLine(&buf, "NICKNAME:"+vcardEscape(contact.Username))
+
+	if options.showEmail && contact.Email != "" {
+		writeVCardLine(&buf, "EMAIL;TYPE=work:"+vcardEscape(contact.Email))
+	}
+	if contact.Position != "" {
+		writeVCardLine(&buf, "TITLE:"+vcardEscape(contact.Position))
+	}
+	if options.siteURL != "" {
+		writeVCardLine(&buf, fmt.Sprintf("PHOTO:%s/api/v4/users/%s/image?_=%d", options.siteURL, contact.Id, contact.LastPictureUpdate))
+	}
+	if contact.UpdateAt > 0 {
+		writeVCardLine(&buf, "REV:"+time.UnixMilli(contact.UpdateAt).UTC().Format(iCalDateTimeLayout))
+	}
+	writeVCardLine(&buf, "END:VCARD")
+	return buf.String()
+}
+
+// vcardETag returns the ETag of a rendered vCard
+func vcardETag(vcard string) string {
+	hash := sha256.Sum256([]byte(vcard))
+	return hex.EncodeToString(hash[:16])
+}
+
+// addressBookCTag returns the getctag of the address book, it changes with any of its vCards
+func addressBookCTag(vcards []string) string {
+	hash := sha256.New()
+	for _, vcard := range vcards {
+		hash.Write([]byte(vcardETag(vcard)))
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// vcardValues returns the values of the properties of a vCard by name, unfolded and unescaped
+func vcardValues(vcard string) map[string][]string {
+	values := map[string][]string{}
+	for _, line := range strings.Split(strings.ReplaceAll(vcard, "\r\n ", ""), "\r\n") {
+		separator := strings.Index(line, ":")
+		if separator < 0 {
+			continue
+		}
+		name := strings.ToUpper(strings.SplitN(line[:separator], ";", 2)[0])
+		value := strings.NewReplacer(`\n`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(line[separator+1:])
+		values[name] = append(values[name], value)
+	}
+	return values
+}
+
+// matches reports whether a value satisfies the text-match, with the i;unicode-casemap collation
+func (m *addressTextMatch) matches(value string) bool {
+	value = strings.ToLower(value)
+	text := strings.ToLower(strings.TrimSpace(m.Value))
+
+	var matched bool
+	switch m.MatchType {
+	case "equals":
+		matched = value == text
+	case "starts-with":
+		matched = strings.HasPrefix(value, text)
+	case "ends-with":
+		matched = strings.HasSuffix(value, text)
+	default:
+		matched = strings.Contains(value, text)
+	}
+	if m.NegateCondition == "yes" {
+		return !matched
+	}
+	return matched
+}
+
+// matches reports whether the vCard properties satisfy the prop-filter (RFC 6352 10.5.1)
+func (f *addressPropFilter) matches(values map[string][]string) bool {
+	propValues, defined := values[strings.ToUpper(f.Name)]
+	if f.IsNotDefined != nil {
+		return !defined
+	}
+	if !defined {
+		return false
+	}
+	if len(f.TextMatches) == 0 {
+		return true
+	}
+
+	allOf := f.Test == "allof"
+	for i := range f.TextMatches {
+		matched := false
+		for _, value := range propValues {
+			if f.TextMatches[i].matches(value) {
+				matched = true
+				break
+			}
+		}
+		if allOf && !matched {
+			return false
+		}
+		if !allOf && matched {
+			return true
+		}
+	}
+	return allOf
+}
+
+// matches reports whether a vCard satisfies the filter, anyof by default
+func (f *addressBookFilter) matches(vcard string) bool {
+	if f == nil || len(f.PropFilters) == 0 {
+		return true
+	}
+
+	values := vcardValues(vcard)
+	allOf := f.Test == "allof"
+	for i := range f.PropFilters {
+		matched := f.PropFilters[i].matches(values)
+		if allOf && !matched {
+			return false
+		}
+		if !allOf && matched {
+			return true
+		}
+	}
+	return allOf
+}
+
+func (b *CalDAVBackend) addressBookPath() string {
+	return b.basePath + "/contacts/"
+}
+
+func (b *CalDAVBackend) isAddressBookPath(path string) bool {
+	return strings.HasPrefix(b.resourcePath(path), "/contacts")
+}
+
+// contactId returns the user id of a vCard path, empty for the address book itself
+func (b *CalDAVBackend) contactId(path string) string {
+	parts := strings.Split(strings.TrimSuffix(b.resourcePath(path), ".vcf"), "/")
+	contactId := parts[len(parts)-1]
+	if contactId == "contacts" {
+		return ""
+	}
+	return contactId
+}
+
+// principalAddressBookProps returns the RFC 6352 principal properties, D: prefixed
+func (b *CalDAVBackend) principalAddressBookProps() string {
+	return fmt.Sprintf(`
+        <CR:addressbook-home-set xmlns:CR="%s">
+          <D:href>%s/</D:href>
+        </CR:addressbook-home-set>`, nsCardDAV, b.basePath)
+}
+
+// addressBookCollectionResponse returns the D:response of the address book listed in the home
+func (b *CalDAVBackend) addressBookCollectionResponse() string {
+	return fmt.Sprintf(`
+  <D:response>
+    <D:href>%s</D:href>
+    <D:propstat>
+      <D:prop>
+        <D:resourcetype>
+          <D:collection/>
+          <CR:addressbook xmlns:CR="%s"/>
+        </D:resourcetype>
+        <D:displayname>Mattermost Users</D:displayname>
+      </D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>`, b.addressBookPath(), nsCardDAV)
+}
+
+// addressBookVCards returns the contacts visible to the user with their vCards
+func (b *CalDAVBackend) addressBookVCards() ([]Contact, []string, *model.AppError) {
+	contacts, err := b.plugin.GetContacts(b.userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options := b.plugin.vcardOptions()
+	vcards := make([]string, len(contacts))
+	for i := range contacts {
+		vcards[i] = contactVCard(&contacts[i], options)
+	}
+	return contacts, vcards, nil
+}
+
+func writeAddressBookMultistatusStart(buf *bytes.Buffer) {
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	buf.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav" xmlns:cs="http://calendarserver.org/ns/">`)
+}
+
+func (b *CalDAVBackend) handleAddressBookPropfind(w http.ResponseWriter, depth string) {
+	contacts, vcards, err := b.addressBookVCards()
+	if err != nil {
+		http.Error(w, "Failed to get contacts", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	writeAddressBookMultistatusStart(&buf)
+	buf.WriteString(fmt.Sprintf(`
+  <d:response>
+    <d:href>%s</d:href>
+    <d:propstat>
+      <d:prop>
+        <d:resourcetype>
+          <d:collection/>
+          <card:addressbook/>
+        </d:resourcetype>
+        <d:displayname>Mattermost Users</d:displayname>
+        <card:addressbook-description>The members of your teams</card:addressbook-description>
+        <card:supported-address-data>
+          <card:address-data-type content-type="text/vcard" version="4.0"/>
+        </card:supported-address-data>
+        <cs:getctag>%s</cs:getctag>
+        <d:supported-report-set>
+          <d:supported-report><d:report><card:addressbook-multiget/></d:report></d:supported-report>
+          <d:supported-report><d:report><card:addressbook-query/></d:report></d:supported-report>
+        </d:supported-report-set>
+        <d:current-user-privilege-set>
+          <d:privilege><d:read/></d:privilege>
+        </d:current-user-privilege-set>
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>`, b.addressBookPath(), addressBookCTag(vcards)))
+
+	if depth == "1" {
+		for i := range contacts {
+			b.writeContactResponse(&buf, &contacts[i], vcards[i], []xml.Name{propGetETag, propGetContentType, propResourceType})
+		}
+	}
+	buf.WriteString(`
+</d:multistatus>`)
+
+	writeMultistatus(w, buf.Bytes())
+}
+
+// writeContactResponse writes a DAV:response with the requested properties of the contact
+func (b *CalDAVBackend) writeContactResponse(buf *bytes.Buffer, contact *Contact, vcard string, names []xml.Name) {
+	var found, missing bytes.Buffer
+
+	for _, name := range names {
+		switch name {
+		case propGetETag:
+			found.WriteString(fmt.Sprintf(`
+        <d:getetag>"%s"</d:getetag>`, vcardETag(vcard)))
+		case propGetContentType:
+			found.WriteString(`
+        <d:getcontenttype>text/vcard; charset=utf-8</d:getcontenttype>`)
+		case propResourceType:
+			found.WriteString(`
+        <d:resourcetype/>`)
+		case propAddressData:
+			found.WriteString(fmt.Sprintf(`
+        <card:address-data>%s</card:address-data>`, xmlEscape(vcard)))
+		default:
+			missing.WriteString(fmt.Sprintf(`
+        <%s xmlns="%s"/>`, name.Local, xmlEscape(name.Space)))
+		}
+	}
+
+	buf.WriteString(fmt.Sprintf(`
+  <d:response>
+    <d:href>%s%s.vcf</d:href>`, b.addressBookPath(), contact.Id))
+	if found.Len() > 0 {
+		buf.WriteString(fmt.Sprintf(`
+    <d:propstat>
+      <d:prop>%s
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>`, found.String()))
+	}
+	if missing.Len() > 0 {
+		buf.WriteString(fmt.Sprintf(`
+    <d:propstat>
+      <d:prop>%s
+      </d:prop>
+      <d:status>HTTP/1.1 404 Not Found</d:status>
+    </d:propstat>`, missing.String()))
+	}
+	buf.WriteString(`
+  </d:response>`)
+}
+
+// handleAddressBookReport implements the addressbook-multiget and addressbook-query REPORTs
+// (RFC 6352 8.6 and 8.7)
+func (b *CalDAVBackend) handleAddressBookReport(w http.ResponseWriter, request *reportRequest) {
+	multiget := request.XMLName == xml.Name{Space: nsCardDAV, Local: "addressbook-multiget"}
+	if !multiget && request.XMLName != (xml.Name{Space: nsCardDAV, Local: "addressbook-query"}) {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<d:error xmlns:d="DAV:"><d:supported-report/></d:error>`))
+		return
+	}
+
+	contacts, vcards, err := b.addressBookVCards()
+	if err != nil {
+		http.Error(w, "Failed to get contacts", http.StatusInternalServerError)
+		return
+	}
+	names := request.propNames(propGetETag, propAddressData)
+
+	var buf bytes.Buffer
+	writeAddressBookMultistatusStart(&buf)
+	if multiget {
+		visible := make(map[string]int, len(contacts))
+		for i := range contacts {
+			visible[contacts[i].Id] = i
+		}
+		for _, href := range request.Hrefs {
+			i, ok := visible[b.contactId(strings.TrimSpace(href))]
+			if !ok {
+				writeNotFoundResponse(&buf, strings.TrimSpace(href))
+				continue
+			}
+			b.writeContactResponse(&buf, &contacts[i], vcards[i], names)
+		}
+	} else {
+		count := 0
+		for i := range contacts {
+			if !request.AddressFilter.matches(vcards[i]) {
+				continue
+			}
+			if request.Limit != nil && request.Limit.NResults > 0 && count >= request.Limit.NResults {
+				break
+			}
+			b.writeContactResponse(&buf, &contacts[i], vcards[i], names)
+			count++
+		}
+	}
+	buf.WriteString(`
+</d:multistatus>`)
+
+	writeMultistatus(w, buf.Bytes())
+}
+
+func (b *CalDAVBackend) handleContactGet(w http.ResponseWriter, r *http.Request) {
+	contactId := b.contactId(r.URL.Path)
+	if contactId == "" {
+		http.Error(w, "Invalid contact path", http.StatusBadRequest)
+		return
+	}
+
+	contacts, vcards, err := b.addressBookVCards()
+	if err != nil {
+		http.Error(w, "Failed to get contacts", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range contacts {
+		if contacts[i].Id != contactId {
+			continue
+		}
+
+		etag := fmt.Sprintf(`"%s"`, vcardETag(vcards[i]))
+		lastModified := time.UnixMilli(contacts[i].UpdateAt).UTC()
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		if notModified(r, etag, lastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Write([]byte(vcards[i]))
+		return
+	}
+	http.Error(w, "Contact not found", http.StatusNotFound)
+}
+
+// handleAddressBookWrite refuses the changes of the address book, the users are managed in
+// Mattermost
+func (b *CalDAVBackend) handleAddressBookWrite(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.Copy(io.Discard, r.Body)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<d:error xmlns:d="DAV:"><d:need-privileges/></d:error>`))
+}
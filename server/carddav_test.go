@@ -0,0 +1,272 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+)
+
+var contactColumns = []string{"id", "username", "first_name", "last_name", "email", "position", "update_at", "last_picture_update"}
+
+func newCardDAVTestPlugin(t *testing.T) (*Plugin, *plugintest.API, sqlmock.Sqlmock, func()) {
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	api := calPlugin.API.(*plugintest.API)
+	siteURL := "https://mattermost.example.com"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}}).Maybe()
+	return calPlugin, api, dbMock, closeDB
+}
+
+func expectContacts(dbMock sqlmock.Sqlmock) {
+	updated := time.Date(2024, 3, 20, 9, 30, 0, 0, time.UTC).UnixMilli()
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT DISTINCT u.Id AS id")).
+		WithArgs("test-user", 0, 0).
+		WillReturnRows(sqlmock.NewRows(contactColumns).
+			AddRow("alice-id", "alice", "Alice", "Martin", "alice@example.com", "Engineer, Platform", updated, int64(0)).
+			AddRow("bob-id", "bob", "", "", "bob@example.com", "", updated, int64(0)))
+}
+
+func TestContactVCard(t *testing.T) {
+	assert := assert.New(t)
+
+	contact := &Contact{
+		Id:                "alice-id",
+		Username:          "alice",
+		FirstName:         "Alice",
+		LastName:          "Martin",
+		Email:             "alice@example.com",
+		Position:          "Engineer, Platform; Berlin",
+		UpdateAt:          time.Date(2024, 3, 20, 9, 30, 0, 0, time.UTC).UnixMilli(),
+		LastPictureUpdate: 1710927000000,
+	}
+	options := vcardOptions{siteURL: "https://mattermost.example.com", showEmail: true, showFullName: true}
+
+	vcard := contactVCard(contact, options)
+	assert.True(strings.HasPrefix(vcard, "BEGIN:VCARD\r\nVERSION:4.0\r\n"))
+	assert.Contains(vcard, "\r\nUID:urn:mattermost:user:alice-id\r\n")
+	assert.Contains(vcard, "\r\nN:Martin;Alice;;;\r\n")
+	assert.Contains(vcard, "\r\nFN:Alice Martin\r\n")
+	assert.Contains(vcard, "\r\nNICKNAME:alice\r\n")
+	assert.Contains(vcard, "\r\nEMAIL;TYPE=work:alice@example.com\r\n")
+	assert.Contains(vcard, `TITLE:Engineer\, Platform\; Berlin`)
+	assert.Contains(strings.ReplaceAll(vcard, "\r\n ", ""), "\r\nPHOTO:https://mattermost.example.com/api/v4/users/alice-id/image?_=1710927000000\r\n")
+	assert.Contains(vcard, "\r\nREV:20240320T093000Z\r\n")
+	assert.True(strings.HasSuffix(vcard, "END:VCARD\r\n"))
+	for _, line := range strings.Split(vcard, "\r\n") {
+		assert.LessOrEqual(len(line), vcardLineSize)
+	}
+
+	// the privacy settings hide the email and the full name
+	vcard = contactVCard(contact, vcardOptions{})
+	assert.NotContains(vcard, "EMAIL")
+	assert.NotContains(vcard, "Martin")
+	assert.NotContains(vcard, "PHOTO")
+	assert.Contains(vcard, "\r\nFN:alice\r\n")
+}
+
+func TestWriteVCardLine(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf strings.Builder
+	writeVCardLine(&buf, "NOTE:"+strings.Repeat("ä", 100))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+
+	assert.Len(lines, 3)
+	for i, line := range lines {
+		assert.LessOrEqual(len(line), vcardLineSize)
+		if i > 0 {
+			assert.True(strings.HasPrefix(line, " "))
+		}
+	}
+	assert.Equal("NOTE:"+strings.Repeat("ä", 100), strings.ReplaceAll(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n ", ""))
+}
+
+func TestAddressBookFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	vcard := contactVCard(&Contact{Id: "alice-id", Username: "alice", FirstName: "Alice", Email: "alice@example.com"}, vcardOptions{showEmail: true, showFullName: true})
+
+	var filter *addressBookFilter
+	assert.True(filter.matches(vcard))
+
+	filter = &addressBookFilter{PropFilters: []addressPropFilter{
+		{Name: "EMAIL", TextMatches: []addressTextMatch{{Value: "ALICE@"}}},
+		{Name: "FN", TextMatches: []addressTextMatch{{Value: "bob"}}},
+	}}
+	assert.True(filter.matches(vcard))
+
+	filter.Test = "allof"
+	assert.False(filter.matches(vcard))
+
+	filter = &addressBookFilter{PropFilters: []addressPropFilter{
+		{Name: "fn", TextMatches: []addressTextMatch{{Value: "ali", MatchType: "starts-with"}}},
+		{Name: "TITLE", IsNotDefined: &struct{}{}},
+		{Name: "NICKNAME", TextMatches: []addressTextMatch{{Value: "bob", MatchType: "equals", NegateCondition: "yes"}}},
+	}, Test: "allof"}
+	assert.True(filter.matches(vcard))
+}
+
+func TestGetContacts(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newCardDAVTestPlugin(t)
+	defer closeDB()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT DISTINCT u.Id AS id, u.Username AS username, u.FirstName AS first_name, u.LastName AS last_name, u.Email AS email, u.Position AS position, u.UpdateAt AS update_at, u.LastPictureUpdate AS last_picture_update "+
+		"FROM Users u JOIN TeamMembers tm ON tm.UserId = u.Id "+
+		"WHERE tm.TeamId IN (SELECT TeamId FROM TeamMembers WHERE UserId = $1 AND DeleteAt = 0) AND tm.DeleteAt = $2 AND u.DeleteAt = $3 AND u.Id NOT IN (SELECT UserId FROM Bots) "+
+		"ORDER BY username")).
+		WithArgs("test-user", 0, 0).
+		WillReturnRows(sqlmock.NewRows(contactColumns).
+			AddRow("alice-id", "alice", "Alice", "Martin", "alice@example.com", "", int64(1), int64(0)))
+
+	contacts, err := calPlugin.GetContacts("test-user")
+	assert.Nil(err)
+	assert.Equal([]Contact{{Id: "alice-id", Username: "alice", FirstName: "Alice", LastName: "Martin", Email: "alice@example.com", UpdateAt: 1}}, contacts)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_AddressBookHome(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newCardDAVTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM calendar_sync_changes")).
+		WillReturnRows(sqlmock.NewRows([]string{"position"}).AddRow(3))
+	expectSyncStart(dbMock, 0)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", "/plugins/com.dmkir.calendar/caldav/token/", nil)
+	r.Header.Set("Depth", "1")
+	backend.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	assert.Contains(w.Header().Get("DAV"), "addressbook")
+	assert.Contains(body, "<CR:addressbook-home-set xmlns:CR=\"urn:ietf:params:xml:ns:carddav\">\n          <D:href>/plugins/com.dmkir.calendar/caldav/token/</D:href>")
+	assert.Contains(body, "<D:href>/plugins/com.dmkir.calendar/caldav/token/contacts/</D:href>")
+	assert.Contains(body, "<CR:addressbook xmlns:CR=\"urn:ietf:params:xml:ns:carddav\"/>")
+}
+
+func TestCalDAVBackend_AddressBookPropfind(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newCardDAVTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+	expectContacts(dbMock)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", "/plugins/com.dmkir.calendar/caldav/token/contacts/", nil)
+	r.Header.Set("Depth", "1")
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusMultiStatus, w.Code)
+	body := w.Body.String()
+	assert.Contains(body, "<card:addressbook/>")
+	assert.Contains(body, `<card:address-data-type content-type="text/vcard" version="4.0"/>`)
+	assert.Contains(body, "<cs:getctag>")
+	assert.Contains(body, "<d:href>/plugins/com.dmkir.calendar/caldav/token/contacts/alice-id.vcf</d:href>")
+	assert.Contains(body, "<d:href>/plugins/com.dmkir.calendar/caldav/token/contacts/bob-id.vcf</d:href>")
+	assert.Contains(body, "<d:getcontenttype>text/vcard; charset=utf-8</d:getcontenttype>")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_AddressBookReport(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newCardDAVTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	expectContacts(dbMock)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/plugins/com.dmkir.calendar/caldav/token/contacts/", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<card:addressbook-multiget xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+  <d:prop><d:getetag/><card:address-data/></d:prop>
+  <d:href>/plugins/com.dmkir.calendar/caldav/token/contacts/alice-id.vcf</d:href>
+  <d:href>/plugins/com.dmkir.calendar/caldav/token/contacts/carol-id.vcf</d:href>
+</card:addressbook-multiget>`))
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusMultiStatus, w.Code)
+	body := w.Body.String()
+	assert.Contains(body, "<card:address-data>BEGIN:VCARD")
+	assert.Contains(body, "EMAIL;TYPE=work:alice@example.com")
+	assert.NotContains(body, "bob@example.com")
+	assert.Contains(body, "<d:href>/plugins/com.dmkir.calendar/caldav/token/contacts/carol-id.vcf</d:href>\n    <d:status>HTTP/1.1 404 Not Found</d:status>")
+
+	// the query autocompletes the attendees
+	expectContacts(dbMock)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("REPORT", "/plugins/com.dmkir.calendar/caldav/token/contacts/", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<card:addressbook-query xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+  <d:prop><d:getetag/><card:address-data/></d:prop>
+  <card:filter test="anyof">
+    <card:prop-filter name="EMAIL"><card:text-match match-type="starts-with">bo</card:text-match></card:prop-filter>
+    <card:prop-filter name="FN"><card:text-match>bo</card:text-match></card:prop-filter>
+  </card:filter>
+</card:addressbook-query>`))
+	backend.ServeHTTP(w, r)
+
+	body = w.Body.String()
+	assert.Contains(body, "bob-id.vcf")
+	assert.NotContains(body, "alice-id.vcf")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_ContactGet(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newCardDAVTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	expectContacts(dbMock)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/plugins/com.dmkir.calendar/caldav/token/contacts/alice-id.vcf", nil)
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("text/vcard; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(w.Body.String(), "FN:Alice Martin")
+	etag := w.Header().Get("ETag")
+
+	expectContacts(dbMock)
+	w = httptest.NewRecorder()
+	r.Header.Set("If-None-Match", etag)
+	backend.ServeHTTP(w, r)
+	assert.Equal(http.StatusNotModified, w.Code)
+
+	expectContacts(dbMock)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/plugins/com.dmkir.calendar/caldav/token/contacts/carol-id.vcf", nil)
+	backend.ServeHTTP(w, r)
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_AddressBookReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newCardDAVTestPlugin(t)
+	defer closeDB()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/plugins/com.dmkir.calendar/caldav/token/contacts/alice-id.vcf", strings.NewReader("BEGIN:VCARD\r\nEND:VCARD\r\n"))
+		backend.ServeHTTP(w, r)
+
+		assert.Equal(http.StatusForbidden, w.Code, method)
+		assert.Contains(w.Body.String(), "<d:need-privileges/>")
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,219 @@
+// Package client is the Go client of the calendar plugin for other Mattermost plugins. Requests go
+// through the plugin API's PluginHTTP, the server authenticates the calling plugin.
+//
+//	calendar := client.NewClient(p.API)
+//	busy, err := calendar.GetAvailability(userId, start, end)
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// PluginID is the ID of the calendar plugin
+const PluginID = "com.dmkir.calendar"
+
+// The changes a subscription is notified of
+const (
+	EventCreated  = "created"
+	EventUpdated  = "updated"
+	EventDeleted  = "deleted"
+	EventStarted  = "started"
+	EventReminder = "reminder"
+)
+
+// PluginAPI is the part of the plugin API the client uses, plugin.API implements it
+type PluginAPI interface {
+	PluginHTTP(request *http.Request) *http.Response
+}
+
+// Event is a calendar event. The events returned start and end in UTC, CreateEvent reads the wall
+// clock of Start and End in Timezone, or in the user's timezone when it is empty. Recurrence holds
+// iCalendar RRULE, EXRULE, RDATE and EXDATE lines.
+type Event struct {
+	Id          string    `json:"id,omitempty"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	AllDay      bool      `json:"allDay,omitempty"`
+	Timezone    string    `json:"timezone,omitempty"`
+	Attendees   []string  `json:"attendees,omitempty"`
+	Created     time.Time `json:"created,omitempty"`
+	Updated     time.Time `json:"updated,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Team        string    `json:"team,omitempty"`
+	Channel     *string   `json:"channel,omitempty"`
+	Recurrence  string    `json:"recurrence,omitempty"`
+	Color       *string   `json:"color,omitempty"`
+	Visibility  string    `json:"visibility,omitempty"`
+	Alert       string    `json:"alert,omitempty"`
+}
+
+// BusyPeriod is a time a user is busy
+type BusyPeriod struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Availability is the busy time of a user, merged and sorted
+type Availability struct {
+	UserId string       `json:"user_id"`
+	Busy   []BusyPeriod `json:"busy"`
+}
+
+// Subscription is the path of the calling plugin notified of the changes
+type Subscription struct {
+	PluginId string    `json:"plugin_id"`
+	Path     string    `json:"path"`
+	Events   []string  `json:"events"`
+	Created  time.Time `json:"created"`
+}
+
+// Notification is the body POSTed to the path of a subscription
+type Notification struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Event     Event     `json:"event"`
+}
+
+// Error is an error answered by the calendar plugin
+type Error struct {
+	Id         string `json:"id"`
+	Message    string `json:"message"`
+	StatusCode int    `json:"status_code"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("calendar: %s (%d)", e.Message, e.StatusCode)
+}
+
+// Client calls the calendar plugin
+type Client struct {
+	api PluginAPI
+}
+
+// NewClient returns a client calling the calendar plugin through the plugin API
+func NewClient(api PluginAPI) *Client {
+	return &Client{api: api}
+}
+
+// CreateEvent creates an event owned by the user, in the user's timezone unless the event has one
+func (c *Client) CreateEvent(userId string, event *Event) (*Event, error) {
+	created := &Event{}
+	body := map[string]interface{}{"user_id": userId, "event": event}
+	if err := c.do(http.MethodPost, "/interplugin/events", nil, body, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// GetEvents returns the events the user sees between start and end, recurring events expanded
+func (c *Client) GetEvents(userId string, start, end time.Time) ([]Event, error) {
+	events := []Event{}
+	if err := c.do(http.MethodGet, "/interplugin/events", rangeQuery(userId, start, end), nil, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// GetAvailability returns the time the user is busy between start and end
+func (c *Client) GetAvailability(userId string, start, end time.Time) (*Availability, error) {
+	availability := &Availability{}
+	if err := c.do(http.MethodGet, "/interplugin/availability", rangeQuery(userId, start, end), nil, availability); err != nil {
+		return nil, err
+	}
+	return availability, nil
+}
+
+// Subscribe notifies the calling plugin of the changes at path of its ServeHTTP, of every change
+// when no event is given. It replaces the previous subscription of the plugin.
+func (c *Client) Subscribe(path string, events ...string) (*Subscription, error) {
+	subscription := &Subscription{}
+	body := &Subscription{Path: path, Events: events}
+	if err := c.do(http.MethodPut, "/interplugin/subscription", nil, body, subscription); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// GetSubscription returns the subscription of the calling plugin
+func (c *Client) GetSubscription() (*Subscription, error) {
+	subscription := &Subscription{}
+	if err := c.do(http.MethodGet, "/interplugin/subscription", nil, nil, subscription); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// Unsubscribe stops the notifications of the calling plugin
+func (c *Client) Unsubscribe() error {
+	return c.do(http.MethodDelete, "/interplugin/subscription", nil, nil, nil)
+}
+
+// ParseNotification reads a notification POSTed to the path of the subscription
+func ParseNotification(r *http.Request) (*Notification, error) {
+	notification := &Notification{}
+	if err := json.NewDecoder(r.Body).Decode(notification); err != nil {
+		return nil, err
+	}
+	return notification, nil
+}
+
+func rangeQuery(userId string, start, end time.Time) url.Values {
+	return url.Values{
+		"user_id": {userId},
+		"start":   {start.UTC().Format(time.RFC3339)},
+		"end":     {end.UTC().Format(time.RFC3339)},
+	}
+}
+
+// do sends the request and decodes the data of the response into result
+func (c *Client) do(method, path string, query url.Values, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	target := "/" + PluginID + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response := c.api.PluginHTTP(request)
+	if response == nil {
+		return fmt.Errorf("calendar: plugin %s not reachable", PluginID)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		appErr := &Error{StatusCode: response.StatusCode}
+		if err := json.NewDecoder(response.Body).Decode(appErr); err != nil || appErr.Message == "" {
+			appErr.Message = http.StatusText(response.StatusCode)
+		}
+		return appErr
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(&struct {
+		Data interface{} `json:"data"`
+	}{Data: result})
+}
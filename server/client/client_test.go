@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// handlerAPI serves PluginHTTP with a handler, as the calendar plugin would
+type handlerAPI struct {
+	handler http.HandlerFunc
+}
+
+func (a *handlerAPI) PluginHTTP(request *http.Request) *http.Response {
+	w := httptest.NewRecorder()
+	a.handler(w, request)
+	return w.Result()
+}
+
+func TestGetAvailability(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &handlerAPI{handler: func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(http.MethodGet, r.Method)
+		assert.Equal("/com.dmkir.calendar/interplugin/availability", r.URL.Path)
+		assert.Equal("user-1", r.URL.Query().Get("user_id"))
+		assert.Equal("2024-03-20T08:00:00Z", r.URL.Query().Get("start"))
+		assert.Equal("2024-03-21T08:00:00Z", r.URL.Query().Get("end"))
+		_, _ = w.Write([]byte(`{"data":{"user_id":"user-1","busy":[{"start":"2024-03-20T09:00:00Z","end":"2024-03-20T10:00:00Z"}]}}`))
+	}}
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	start := time.Date(2024, 3, 20, 9, 0, 0, 0, berlin)
+	availability, err := NewClient(api).GetAvailability("user-1", start, start.Add(24*time.Hour))
+
+	assert.Nil(err)
+	assert.Equal("user-1", availability.UserId)
+	assert.Equal([]BusyPeriod{{
+		Start: time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 3, 20, 10, 0, 0, 0, time.UTC),
+	}}, availability.Busy)
+}
+
+func TestCreateEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &handlerAPI{handler: func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(http.MethodPost, r.Method)
+		assert.Equal("/com.dmkir.calendar/interplugin/events", r.URL.Path)
+
+		var body struct {
+			UserId string                 `json:"user_id"`
+			Event  map[string]interface{} `json:"event"`
+		}
+		assert.Nil(json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal("user-1", body.UserId)
+		assert.Equal("Standup", body.Event["title"])
+		assert.NotContains(body.Event, "visibility")
+		_, _ = w.Write([]byte(`{"data":{"id":"event-1","title":"Standup","owner":"user-1","visibility":"private"}}`))
+	}}
+
+	start := time.Date(2024, 3, 20, 10, 0, 0, 0, time.UTC)
+	event, err := NewClient(api).CreateEvent("user-1", &Event{Title: "Standup", Start: start, End: start.Add(15 * time.Minute)})
+
+	assert.Nil(err)
+	assert.Equal("event-1", event.Id)
+	assert.Equal("private", event.Visibility)
+}
+
+func TestSubscribe_Error(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &handlerAPI{handler: func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(http.MethodPut, r.Method)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"id":"not_authorized","message":"Not authorized","status_code":401}`))
+	}}
+
+	subscription, err := NewClient(api).Subscribe("/calendar/notify", EventCreated)
+
+	assert.Nil(subscription)
+	assert.Equal(&Error{Id: "not_authorized", Message: "Not authorized", StatusCode: http.StatusUnauthorized}, err)
+}
+
+func TestParseNotification(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/calendar/notify", strings.NewReader(
+		`{"type":"event.created","timestamp":"2024-03-01T09:00:00Z","event":{"id":"event-1","title":"Deploy"}}`))
+	notification, err := ParseNotification(r)
+
+	assert.Nil(err)
+	assert.Equal("event.created", notification.Type)
+	assert.Equal("Deploy", notification.Event.Title)
+}
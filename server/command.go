@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/mattermost/mattermost-server/v6/plugin"
 	"sort"
 	"strings"
 	"time"
+	"unicode"
 )
 
 const calCommand = "cal"
@@ -16,7 +18,7 @@ func (p *Plugin) createCalCommand() (*model.Command, error) {
 		Trigger:          calCommand,
 		AutoComplete:     true,
 		AutoCompleteDesc: "Get calendar events.",
-		AutoCompleteHint: "[command]",
+		AutoCompleteHint: "[week | channel | channel-widget [on | off] | create --template <name> [YYYY-MM-DD] [HH:MM] | todo [list | add | done | remove]]",
 	}, nil
 }
 
@@ -37,6 +39,14 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		p.API.LogError("======help=======")
 	case "week":
 		return p.executeWeekCommand(c, args)
+	case "create":
+		return p.executeCreateCommand(c, args)
+	case "channel":
+		return p.executeChannelCommand(c, args)
+	case "channel-widget":
+		return p.executeChannelWidgetCommand(c, args)
+	case "todo":
+		return p.executeTodoCommand(c, args)
 	default:
 		return p.executeTodayCommand(c, args)
 	}
@@ -83,7 +93,7 @@ func (p *Plugin) executeTodayCommand(
 
 	message := "| time | title | channel |\n| -----| ------| ------- |\n"
 	for _, event := range events {
-		line := fmt.Sprintf("|%s|%s|", event.Start.Format(EventDateTimeLayout), event.Title)
+		line := fmt.Sprintf("|%s|%s|", formatEventTime(event), event.Title)
 		if event.Channel != nil {
 			eventChannel, eventChError := p.API.GetChannel(*event.Channel)
 			if eventChError != nil {
@@ -158,7 +168,7 @@ func (p *Plugin) executeWeekCommand(
 		return (events)[j].Start.After((events)[i].Start)
 	})
 	for _, event := range events {
-		line := fmt.Sprintf("|%s|%s|", event.Start.Format(EventDateTimeLayout), event.Title)
+		line := fmt.Sprintf("|%s|%s|", formatEventTime(event), event.Title)
 		if event.Channel != nil {
 			eventChannel, eventChError := p.API.GetChannel(*event.Channel)
 			if eventChError != nil {
@@ -188,3 +198,204 @@ func (p *Plugin) executeWeekCommand(
 	}
 	return &model.CommandResponse{}, nil
 }
+
+// channelCommandDays is how far ahead /cal channel lists the events of the channel
+const channelCommandDays = 7
+
+// executeChannelCommand posts the upcoming events of the channel's calendar to the channel
+func (p *Plugin) executeChannelCommand(
+	c *plugin.Context,
+	args *model.CommandArgs,
+) (*model.CommandResponse, *model.AppError) {
+	user, appErr := p.API.GetUser(args.UserId)
+	if appErr != nil {
+		return nil, NotAuthorizedError
+	}
+	if _, memberErr := p.API.GetChannelMember(args.ChannelId, user.Id); memberErr != nil {
+		return nil, NotAuthorizedError
+	}
+
+	userLoc := p.GetUserLocation(user)
+	start := time.Now().UTC()
+	end := start.AddDate(0, 0, channelCommandDays)
+
+	events, eventsError := p.GetSharedEventsUTC(channelCalendar(args.ChannelId), userLoc, start, end)
+	if eventsError != nil {
+		return nil, eventsError
+	}
+
+	if len(events) == 0 {
+		return ephemeralResponse(fmt.Sprintf("No events in this channel for the next %d days.", channelCommandDays)), nil
+	}
+
+	message := fmt.Sprintf("Events of this channel for the next %d days (%s)\n\n", channelCommandDays, userLoc.String())
+	message += "| time | title |\n| -----| ------|\n"
+	for _, event := range events {
+		message += fmt.Sprintf("|%s|%s|\n", formatEventTime(event), event.Title)
+	}
+
+	_, postCreateError := p.API.CreatePost(&model.Post{
+		UserId:    p.BotId,
+		Message:   message,
+		ChannelId: args.ChannelId,
+	})
+	if postCreateError != nil {
+		return nil, postCreateError
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// splitCommandArgs splits a command into its arguments, double quotes keep spaces in one
+func splitCommandArgs(command string) []string {
+	var args []string
+	var current strings.Builder
+	quoted, started := false, false
+	for _, r := range command {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case unicode.IsSpace(r) && !quoted:
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// parseCommandStart parses the [YYYY-MM-DD] [HH:MM] of a command in loc, the date defaults to
+// today and the time to the next full hour
+func parseCommandStart(args []string, now time.Time, loc *time.Location) (time.Time, bool) {
+	now = now.In(loc)
+	date := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	hour, minute := now.Hour()+1, 0
+	dateSet := false
+
+	for _, arg := range args {
+		if day, err := time.ParseInLocation(EventDateLayout, arg, loc); err == nil {
+			date = day
+			dateSet = true
+			continue
+		}
+		if clock, err := time.Parse(BusinessTimeLayout, arg); err == nil {
+			hour, minute = clock.Hour(), clock.Minute()
+			continue
+		}
+		return time.Time{}, false
+	}
+
+	// late in the evening the next full hour is midnight, of the next day unless the date is given
+	if dateSet {
+		hour %= 24
+	}
+	return time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, loc), true
+}
+
+// isCommandStart reports whether the argument is a date or a time of parseCommandStart
+func isCommandStart(arg string) bool {
+	if _, err := time.Parse(EventDateLayout, arg); err == nil {
+		return true
+	}
+	_, err := time.Parse(BusinessTimeLayout, arg)
+	return err == nil
+}
+
+// executeCreateCommand creates an event from a template:
+// /cal create --template <name> [YYYY-MM-DD] [HH:MM]
+func (p *Plugin) executeCreateCommand(
+	c *plugin.Context,
+	args *model.CommandArgs,
+) (*model.CommandResponse, *model.AppError) {
+	usage := "Usage: `/cal create --template <name> [YYYY-MM-DD] [HH:MM]`"
+
+	split := splitCommandArgs(args.Command)
+	if len(split) < 4 || split[2] != "--template" {
+		return ephemeralResponse(usage), nil
+	}
+
+	// an unquoted name runs until the date or the time
+	nameEnd := 4
+	for nameEnd < len(split) && !isCommandStart(split[nameEnd]) {
+		nameEnd++
+	}
+	name := strings.Join(split[3:nameEnd], " ")
+
+	user, appErr := p.API.GetUser(args.UserId)
+	if appErr != nil {
+		return nil, NotAuthorizedError
+	}
+	userLoc := p.GetUserLocation(user)
+
+	start, ok := parseCommandStart(split[nameEnd:], time.Now(), userLoc)
+	if !ok {
+		return ephemeralResponse(usage), nil
+	}
+
+	template, templateErr := p.findTemplate(user.Id, args.TeamId, name)
+	if templateErr == TemplateNotFound {
+		return ephemeralResponse(fmt.Sprintf("Template \"%s\" not found.", name)), nil
+	}
+	if templateErr != nil {
+		return nil, templateErr
+	}
+
+	event := instantiateTemplate(template, user, start, userLoc)
+	if event.Visibility == VisibilityChannel && event.Channel == nil {
+		event.Channel = &args.ChannelId
+	}
+	if event.Team == "" {
+		event.Team = args.TeamId
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	event.Id = uuid.New().String()
+	event.Created = now
+	event.Updated = now
+	event.Owner = user.Id
+	p.setEventTimes(&event, userLoc)
+
+	if insertErr := p.insertEvent(&event); insertErr != nil {
+		return nil, insertErr
+	}
+
+	return ephemeralResponse(fmt.Sprintf(
+		"Created **%s** at %s - %s.",
+		event.Title,
+		event.Start.In(userLoc).Format(EventDateLayout+" "+BusinessTimeLayout),
+		event.End.In(userLoc).Format(BusinessTimeLayout),
+	)), nil
+}
+
+// ephemeralResponse answers a command with a message only the user sees
+func ephemeralResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+// formatEventTime formats the time column of an event, all-day and multi-day events show their dates
+func formatEventTime(event Event) string {
+	if event.AllDay {
+		last := event.End.AddDate(0, 0, -1)
+		if !last.After(event.Start) {
+			return event.Start.Format(EventDateLayout) + " all day"
+		}
+		return event.Start.Format(EventDateLayout) + " - " + last.Format(EventDateLayout) + " all day"
+	}
+
+	// an event ending at midnight doesn't reach into the next day
+	if last := event.End.Add(-time.Nanosecond); last.After(event.Start) && last.Format(EventDateLayout) != event.Start.Format(EventDateLayout) {
+		return event.Start.Format(EventDateTimeLayout) + " - " + event.End.Format(EventDateTimeLayout)
+	}
+	return event.Start.Format(EventDateTimeLayout)
+}
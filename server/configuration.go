@@ -21,6 +21,34 @@ type configuration struct {
 	BusinessStartTime string
 	BusinessEndTime   string
 	BusinessDays      string
+
+	WebhookURLs   string
+	WebhookSecret string
+	WebhookEvents string
+
+	InterPluginAllowedIDs string
+
+	APIRateLimit int
+
+	ICalTokenInactiveDays int
+	TrustedProxyIPs       string
+
+	EncryptionKey string
+
+	GoogleClientID        string
+	GoogleClientSecret    string
+	MicrosoftClientID     string
+	MicrosoftClientSecret string
+	MicrosoftTenant       string
+
+	SMTPServer             string
+	SMTPPort               int
+	SMTPConnectionSecurity string
+	SMTPUsername           string
+	SMTPPassword           string
+	InvitationFromAddress  string
+	InvitationReplyAddress string
+	InvitationReplySecret  string
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
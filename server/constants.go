@@ -3,9 +3,12 @@ package main
 const (
 	PluginId            = "com.dmkir.calendar"
 	EventDateTimeLayout = "2006-01-02T15:04:05"
+	EventDateLayout     = "2006-01-02"
 	BusinessTimeLayout  = "15:04"
 	DefaultColor        = "#D0D0D0"
 	DefaultSlotTime     = 15
+	// AllDayNotifyHour is the hour in the owner's timezone all-day events are notified at
+	AllDayNotifyHour = 9
 )
 
 const (
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+var errEncryptionKeyMissing = errors.New("encryption key not configured")
+
+// encryptionKey derives the AES-256 key from the EncryptionKey setting
+func (c *configuration) encryptionKey() ([]byte, error) {
+	if c.EncryptionKey == "" {
+		return nil, errEncryptionKeyMissing
+	}
+	key := sha256.Sum256([]byte(c.EncryptionKey))
+	return key[:], nil
+}
+
+// encryptSecret seals a secret with AES-GCM, the nonce is prepended to the base64 result
+func encryptSecret(key []byte, secret string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret opens a secret sealed by encryptSecret
+func decryptSecret(key []byte, encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted secret too short")
+	}
+
+	secret, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
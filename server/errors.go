@@ -52,6 +52,223 @@ var (
 		Where:      PluginId,
 	}
 
+	EventVersionConflict = &model.AppError{
+		Id:         "event_version_conflict",
+		Message:    "Event was changed by someone else, reload it and try again",
+		StatusCode: 409,
+		Where:      PluginId,
+	}
+
+	TemplateNotFound = &model.AppError{
+		Id:         "template_not_found",
+		Message:    "Template not found",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
+	APITokenNotFound = &model.AppError{
+		Id:         "api_token_not_found",
+		Message:    "API token not found",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
+	InsufficientScope = &model.AppError{
+		Id:         "insufficient_scope",
+		Message:    "The token isn't granted the scope of this request",
+		StatusCode: 403,
+		Where:      PluginId,
+	}
+
+	APITokenOutsideAPIv1 = &model.AppError{
+		Id:         "api_token_outside_api_v1",
+		Message:    "Access tokens can only call /api/v1",
+		StatusCode: 403,
+		Where:      PluginId,
+	}
+
+	CantCreateAPIToken = &model.AppError{
+		Id:         "cant_create_api_token",
+		Message:    "Access tokens are disabled or you aren't allowed to create them",
+		StatusCode: 403,
+		Where:      PluginId,
+	}
+
+	TooManyRequests = &model.AppError{
+		Id:         "too_many_requests",
+		Message:    "Too many requests",
+		StatusCode: 429,
+		Where:      PluginId,
+	}
+
+	ICalTokenNotFound = &model.AppError{
+		Id:         "ical_token_not_found",
+		Message:    "iCal token not found",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
+	CantCreateICalToken = &model.AppError{
+		Id:         "cant_create_ical_token",
+		Message:    "Can't create iCal token",
+		StatusCode: 500,
+		Where:      PluginId,
+	}
+
+	CantRevokeICalToken = &model.AppError{
+		Id:         "cant_revoke_ical_token",
+		Message:    "Can't revoke iCal token",
+		StatusCode: 500,
+		Where:      PluginId,
+	}
+
+	InvalidICalToken = &model.AppError{
+		Id:         "invalid_ical_token",
+		Message:    "Invalid iCal token",
+		StatusCode: 401,
+		Where:      PluginId,
+	}
+
+	TooManyICalTokens = &model.AppError{
+		Id:         "too_many_ical_tokens",
+		Message:    "Too many iCal tokens, revoke one first",
+		StatusCode: 400,
+		Where:      PluginId,
+	}
+
+	SubscriptionNotFound = &model.AppError{
+		Id:         "subscription_not_found",
+		Message:    "Subscription not found",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
+	CantSaveTemplate = &model.AppError{
+		Id:         "cant_save_template",
+		Message:    "Can't save template",
+		StatusCode: 500,
+		Where:      PluginId,
+	}
+
+	CantRemoveTemplate = &model.AppError{
+		Id:         "cant_remove_template",
+		Message:    "Can't remove template",
+		StatusCode: 500,
+		Where:      PluginId,
+	}
+
+	TaskNotFound = &model.AppError{
+		Id:         "task_not_found",
+		Message:    "Task not found",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
+	CantSaveTask = &model.AppError{
+		Id:         "cant_save_task",
+		Message:    "Can't save task",
+		StatusCode: 500,
+		Where:      PluginId,
+	}
+
+	CantRemoveTask = &model.AppError{
+		Id:         "cant_remove_task",
+		Message:    "Can't remove task",
+		StatusCode: 500,
+		Where:      PluginId,
+	}
+
+	ExternalAccountNotFound = &model.AppError{
+		Id:         "external_account_not_found",
+		Message:    "External calendar account not found",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
+	ExternalCalendarUnreachable = &model.AppError{
+		Id:         "external_calendar_unreachable",
+		Message:    "Can't connect to the external calendar",
+		StatusCode: 400,
+		Where:      PluginId,
+	}
+
+	EncryptionKeyNotConfigured = &model.AppError{
+		Id:         "encryption_key_not_configured",
+		Message:    "The encryption key of the plugin isn't configured",
+		StatusCode: 501,
+		Where:      PluginId,
+	}
+
+	CantSaveExternalAccount = &model.AppError{
+		Id:         "cant_save_external_account",
+		Message:    "Can't save external calendar account",
+		StatusCode: 500,
+		Where:      PluginId,
+	}
+
+	ProviderNotFound = &model.AppError{
+		Id:         "provider_not_found",
+		Message:    "Calendar provider not found",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
+	ProviderNotConfigured = &model.AppError{
+		Id:         "provider_not_configured",
+		Message:    "The calendar provider isn't configured",
+		StatusCode: 501,
+		Where:      PluginId,
+	}
+
+	ProviderAccountNotFound = &model.AppError{
+		Id:         "provider_account_not_found",
+		Message:    "Calendar provider account not found",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
+	InvalidOAuthState = &model.AppError{
+		Id:         "invalid_oauth_state",
+		Message:    "Invalid or expired OAuth state",
+		StatusCode: 400,
+		Where:      PluginId,
+	}
+
+	CantConnectProvider = &model.AppError{
+		Id:         "cant_connect_provider",
+		Message:    "Can't connect the calendar provider",
+		StatusCode: 400,
+		Where:      PluginId,
+	}
+
+	InvalidGuest = &model.AppError{
+		Id:         "invalid_guest",
+		Message:    "Invalid guest email address",
+		StatusCode: 400,
+		Where:      PluginId,
+	}
+
+	InvitationRepliesNotConfigured = &model.AppError{
+		Id:         "invitation_replies_not_configured",
+		Message:    "The invitation reply secret of the plugin isn't configured",
+		StatusCode: 501,
+		Where:      PluginId,
+	}
+
+	InvalidInvitationReply = &model.AppError{
+		Id:         "invalid_invitation_reply",
+		Message:    "The message isn't an iCalendar REPLY",
+		StatusCode: 400,
+		Where:      PluginId,
+	}
+
+	GuestNotFound = &model.AppError{
+		Id:         "guest_not_found",
+		Message:    "The sender isn't a guest of the event",
+		StatusCode: 404,
+		Where:      PluginId,
+	}
+
 	CantMakeMigration = &model.AppError{
 		Id:         "cant_make_migration",
 		Message:    "cant_make_migration",
@@ -3,11 +3,11 @@ package main
 import (
 	"encoding/json"
 	sq "github.com/Masterminds/squirrel"
+	ics "github.com/arran4/golang-ical"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/mattermost/mattermost-server/v6/model"
-	"github.com/teambition/rrule-go"
 	"net/http"
 	"sync"
 	"time"
@@ -68,6 +68,28 @@ func (p *Plugin) GetUserChannels(userId string) ([]string, *model.AppError) {
 	return channels, nil
 }
 
+// eventListColumns are the columns of the events listed for a range, without the iCalendar data
+var eventListColumns = []string{
+	"ce.id",
+	"ce.title",
+	"ce.description",
+	"ce.dt_start",
+	"ce.dt_end",
+	"ce.all_day",
+	"ce.timezone",
+	"ce.created",
+	"ce.updated",
+	"ce.owner",
+	"ce.channel",
+	"ce.recurrent",
+	"ce.recurrence",
+	"ce.color",
+	"ce.team",
+	"ce.visibility",
+	"ce.alert",
+	"ce.alert_time",
+}
+
 // GetUserEventsUTC returns user events in UTC timezone
 // start and end are in format EventDateTimeLayout in UTC timezone
 // if we don't have userLocation we can't correct gen dates for recurrent events, it means that we can't return recurrent events correctly
@@ -84,35 +106,19 @@ func (p *Plugin) GetUserEventsUTC(
 			sq.Eq{"ce.owner": userId},
 			sq.NotEq{"ce.visibility": string(VisibilityPrivate)},
 		},
+		// events overlapping the range, all-day events are placed in the user's timezone below
 		sq.Or{
 			sq.And{
-				sq.GtOrEq{"ce.dt_start": start},
-				sq.LtOrEq{"ce.dt_start": end},
+				sq.Lt{"ce.dt_start": end.Add(allDayMargin)},
+				sq.Gt{"ce.dt_end": start.Add(-allDayMargin)},
 			},
-			sq.Eq{"ce.recurrent": true},
+			recurringSince(start.Add(-allDayMargin)),
 		},
 	}
 
 	// Create a new select builder
 	queryBuilder := sq.Select().
-		Columns(
-			"ce.id",
-			"ce.title",
-			"ce.description",
-			"ce.dt_start",
-			"ce.dt_end",
-			"ce.created",
-			"ce.updated",
-			"ce.owner",
-			"ce.channel",
-			"ce.recurrent",
-			"ce.recurrence",
-			"ce.color",
-			"ce.team",
-			"ce.visibility",
-			"ce.alert",
-			"ce.alert_time",
-		).
+		Columns(eventListColumns...).
 		From("calendar_events ce").
 		LeftJoin("calendar_members cm ON ce.id = cm.event").
 		Where(conditions).PlaceholderFormat(p.GetDBPlaceholderFormat())
@@ -171,16 +177,6 @@ func (p *Plugin) GetUserEventsUTC(
 			continue
 		}
 
-		if eventDb.Color == nil {
-			color := DefaultColor
-			eventDb.Color = &color
-		}
-
-		if userLocation != nil {
-			eventDb.Start = eventDb.Start.In(userLocation)
-			eventDb.End = eventDb.End.In(userLocation)
-		}
-
 		if eventDb.Visibility == VisibilityChannel && eventDb.Channel == nil {
 			continue
 		}
@@ -193,45 +189,7 @@ func (p *Plugin) GetUserEventsUTC(
 			continue
 		}
 
-		if eventDb.Recurrent {
-			eventRule, errRrule := rrule.StrToRRule(eventDb.Recurrence)
-			if errRrule != nil {
-				p.API.LogError(errRrule.Error())
-				continue
-			}
-			eventRule.DTStart(eventDb.Start)
-			eventDates := eventRule.Between(
-				time.Date(
-					start.Year(),
-					start.Month(),
-					start.Day(),
-					0,
-					0,
-					0,
-					0,
-					start.Location(),
-				),
-				end, false)
-
-			for _, eventDate := range eventDates {
-				eventTime := eventDb.End.Sub(eventDb.Start)
-				eventDb.Start = time.Date(
-					eventDate.Year(),
-					eventDate.Month(),
-					eventDate.Day(),
-					eventDb.Start.Hour(),
-					eventDb.Start.Minute(),
-					eventDb.Start.Second(),
-					eventDb.Start.Nanosecond(),
-					eventDb.Start.Location(),
-				)
-				eventDb.End = eventDb.Start.Add(eventTime)
-
-				events = append(events, eventDb)
-			}
-		} else {
-			events = append(events, eventDb)
-		}
+		events = append(events, p.eventOccurrences(eventDb, userLocation, start, end)...)
 		addedEvent[eventDb.Id] = true
 
 	}
@@ -239,6 +197,70 @@ func (p *Plugin) GetUserEventsUTC(
 	return events, nil
 }
 
+// eventOccurrences returns the occurrences of the event overlapping the range, in userLocation
+// when it is known. Events without a color get the default one.
+func (p *Plugin) eventOccurrences(eventDb Event, userLocation *time.Location, start, end time.Time) []Event {
+	var occurrences []Event
+
+	if eventDb.Color == nil {
+		color := DefaultColor
+		eventDb.Color = &color
+	}
+
+	if eventDb.AllDay {
+		loc := userLocation
+		if loc == nil {
+			loc = time.UTC
+		}
+		localizeAllDay(&eventDb, loc)
+	} else if userLocation != nil {
+		eventDb.Start = eventDb.Start.In(userLocation)
+		eventDb.End = eventDb.End.In(userLocation)
+	}
+
+	if eventDb.Recurrent {
+		// all-day events recur on the same dates everywhere, the others in their own timezone
+		loc := eventLocation(&eventDb)
+		if eventDb.AllDay {
+			loc = eventDb.Start.Location()
+		}
+		eventTime := eventDb.End.Sub(eventDb.Start)
+		days := allDayDays(&eventDb)
+
+		eventDates, errRrule := p.recurrences.Occurrences(&eventDb, loc, start.Add(-eventTime), end)
+		if errRrule != nil {
+			p.API.LogError(errRrule.Error())
+			return nil
+		}
+
+		for _, eventDate := range eventDates {
+			occurrence := eventDb
+			occurrence.Start = eventDate
+			occurrence.End = eventDate.Add(eventTime)
+			if eventDb.AllDay {
+				// days, not hours, a DST change doesn't shift the end
+				occurrence.Start = eventDate.In(loc)
+				occurrence.End = occurrence.Start.AddDate(0, 0, days)
+			} else if userLocation != nil {
+				occurrence.Start = occurrence.Start.In(userLocation)
+				occurrence.End = occurrence.End.In(userLocation)
+			}
+			if !overlaps(occurrence.Start, occurrence.End.Sub(occurrence.Start), start, end) {
+				continue
+			}
+
+			occurrences = append(occurrences, occurrence)
+		}
+	} else {
+		if !overlaps(eventDb.Start, eventDb.End.Sub(eventDb.Start), start, end) {
+			return nil
+		}
+		occurrences = append(occurrences, eventDb)
+	}
+
+	return occurrences
+}
+
 func (p *Plugin) GetUserLocation(user *model.User) *time.Location {
 	userTimeZone := ""
 
@@ -257,6 +279,58 @@ func (p *Plugin) GetUserLocation(user *model.User) *time.Location {
 	return userLoc
 }
 
+// setEventTimes converts the wall-clock times of a request to UTC, in the timezone of the request
+// if it names a known one and in the user's otherwise, and computes the alert time.
+// All-day events keep their dates only.
+func (p *Plugin) setEventTimes(event *Event, userLoc *time.Location) {
+	if event.AllDay {
+		event.Timezone = ""
+		normalizeAllDay(event)
+		event.AlertTime = allDayAlertTime(event.Start, event.Alert, userLoc)
+		return
+	}
+
+	loc := loadLocation(event.Timezone)
+	if loc == nil {
+		loc = userLoc
+	}
+	event.Timezone = loc.String()
+
+	startDateInLocalTimeZone := time.Date(
+		event.Start.Year(),
+		event.Start.Month(),
+		event.Start.Day(),
+		event.Start.Hour(),
+		event.Start.Minute(),
+		event.Start.Second(),
+		event.Start.Nanosecond(),
+		loc,
+	)
+
+	endDateInLocalTimeZone := time.Date(
+		event.End.Year(),
+		event.End.Month(),
+		event.End.Day(),
+		event.End.Hour(),
+		event.End.Minute(),
+		event.End.Second(),
+		event.End.Nanosecond(),
+		loc,
+	)
+
+	event.Start = startDateInLocalTimeZone.In(time.UTC)
+	event.End = endDateInLocalTimeZone.In(time.UTC)
+
+	if event.Alert != EventAlertNone {
+		alertDuration, ok := EventAlertDurationMap[event.Alert]
+		if !ok {
+			alertDuration = 0
+		}
+		alertTime := event.Start.Add(-1 * alertDuration)
+		event.AlertTime = &alertTime
+	}
+}
+
 func (p *Plugin) GetEvent(w http.ResponseWriter, r *http.Request) {
 	pluginContext := p.FromContext(r.Context())
 	session, err := p.API.GetSession(pluginContext.SessionId)
@@ -288,6 +362,8 @@ func (p *Plugin) GetEvent(w http.ResponseWriter, r *http.Request) {
 			"ce.title",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -299,6 +375,7 @@ func (p *Plugin) GetEvent(w http.ResponseWriter, r *http.Request) {
 			"ce.team",
 			"ce.alert",
 			"ce.alert_time",
+			"ce.ical_data",
 			"cm.member",
 		).
 		From("calendar_events ce").
@@ -351,6 +428,8 @@ func (p *Plugin) GetEvent(w http.ResponseWriter, r *http.Request) {
 		Description: eventDb.Description,
 		Start:       eventDb.Start,
 		End:         eventDb.End,
+		AllDay:      eventDb.AllDay,
+		Timezone:    eventDb.Timezone,
 		Attendees:   members,
 		Created:     eventDb.Created,
 		Updated:     eventDb.Updated,
@@ -362,12 +441,24 @@ func (p *Plugin) GetEvent(w http.ResponseWriter, r *http.Request) {
 		Visibility:  eventDb.Visibility,
 		Alert:       eventDb.Alert,
 		AlertTime:   eventDb.AlertTime,
+		ICalData:    eventDb.ICalData,
 	}
 
+	guests, errGuests := p.GetEventsGuests([]string{event.Id})
+	if errGuests != nil {
+		p.API.LogError(errGuests.Error())
+	}
+	event.Guests = append([]EventGuest{}, guests[event.Id]...)
+
 	userLoc := p.GetUserLocation(user)
 
-	event.Start = event.Start.In(userLoc)
-	event.End = event.End.In(userLoc)
+	event.Version = eventETag(&event)
+	if event.AllDay {
+		localizeAllDay(&event, userLoc)
+	} else {
+		event.Start = event.Start.In(userLoc)
+		event.End = event.End.In(userLoc)
+	}
 
 	apiResponse(w, &event)
 	return
@@ -446,45 +537,41 @@ func (p *Plugin) CreateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if errCreate := p.createEvent(user, &event); errCreate != nil {
+		errorResponse(w, errCreate)
+		return
+	}
+
+	event.Version = eventETag(&event)
+
+	apiResponse(w, &event)
+	return
+}
+
+// createEvent creates the event sent by a client as the user's own
+func (p *Plugin) createEvent(user *model.User, event *Event) *model.AppError {
 	if event.Visibility == VisibilityChannel && event.Channel == nil {
 		p.API.LogError("Channel is required for channel visibility")
-		errorResponse(w, CantCreateEvent)
-		return
+		return CantCreateEvent
 	}
 
 	event.Id = uuid.New().String()
 
-	now := time.Now().UTC()
+	now := time.Now().UTC().Truncate(time.Second)
 	event.Created = now
 	event.Updated = now
 	event.Owner = user.Id
 
 	loc := p.GetUserLocation(user)
 
-	startDateInLocalTimeZone := time.Date(
-		event.Start.Year(),
-		event.Start.Month(),
-		event.Start.Day(),
-		event.Start.Hour(),
-		event.Start.Minute(),
-		event.Start.Second(),
-		event.Start.Nanosecond(),
-		loc,
-	)
+	p.setEventTimes(event, loc)
 
-	endDateInLocalTimeZone := time.Date(
-		event.End.Year(),
-		event.End.Month(),
-		event.End.Day(),
-		event.End.Hour(),
-		event.End.Minute(),
-		event.End.Second(),
-		event.End.Nanosecond(),
-		loc,
-	)
-
-	event.Start = startDateInLocalTimeZone.In(time.UTC)
-	event.End = endDateInLocalTimeZone.In(time.UTC)
+	recurrence, errRecurrence := normalizeRecurrence(event.Recurrence)
+	if errRecurrence != nil {
+		p.API.LogError(errRecurrence.Error())
+		return InvalidRequestParams
+	}
+	event.Recurrence = recurrence
 
 	if event.Recurrence != "" && len(event.Recurrence) > 0 {
 		event.Recurrent = true
@@ -492,15 +579,18 @@ func (p *Plugin) CreateEvent(w http.ResponseWriter, r *http.Request) {
 		event.Recurrent = false
 	}
 
-	if event.Alert != EventAlertNone {
-		alertDuration, ok := EventAlertDurationMap[event.Alert]
-		if !ok {
-			alertDuration = 0
-		}
-		alertTime := event.Start.Add(-1 * alertDuration)
-		event.AlertTime = &alertTime
+	guests, errGuests := normalizeGuests(event.Guests)
+	if errGuests != nil {
+		p.API.LogError(errGuests.Error())
+		return InvalidGuest
 	}
+	event.Guests = guests
+
+	return p.insertEvent(event)
+}
 
+// insertEvent stores a new event with its attendees and records the change for sync
+func (p *Plugin) insertEvent(event *Event) *model.AppError {
 	queryBuilder := sq.Insert("calendar_events").
 		Columns(
 			"id",
@@ -508,12 +598,16 @@ func (p *Plugin) CreateEvent(w http.ResponseWriter, r *http.Request) {
 			"description",
 			"dt_start",
 			"dt_end",
+			"all_day",
+			"timezone",
 			"created",
 			"updated",
 			"owner",
 			"channel",
 			"recurrent",
 			"recurrence",
+			"recurrence_end",
+			"next_notification",
 			"color",
 			"visibility",
 			"team",
@@ -526,12 +620,16 @@ func (p *Plugin) CreateEvent(w http.ResponseWriter, r *http.Request) {
 			event.Description,
 			event.Start,
 			event.End,
+			event.AllDay,
+			event.Timezone,
 			event.Created,
 			event.Updated,
 			event.Owner,
 			event.Channel,
 			event.Recurrent,
 			event.Recurrence,
+			seriesEnd(event),
+			nextNotification(event, time.Now().UTC().Truncate(time.Minute)),
 			event.Color,
 			event.Visibility,
 			event.Team,
@@ -543,15 +641,13 @@ func (p *Plugin) CreateEvent(w http.ResponseWriter, r *http.Request) {
 	querySql, sqlArgs, errBuilder := queryBuilder.ToSql()
 	if errBuilder != nil {
 		p.API.LogError(errBuilder.Error())
-		errorResponse(w, CantCreateEvent)
-		return
+		return CantCreateEvent
 	}
 
 	insertRows, errInsert := p.DB.Queryx(querySql, sqlArgs...)
 	if errInsert != nil {
 		p.API.LogError(errInsert.Error())
-		errorResponse(w, CantCreateEvent)
-		return
+		return CantCreateEvent
 	}
 	insertRows.Close()
 
@@ -565,8 +661,7 @@ func (p *Plugin) CreateEvent(w http.ResponseWriter, r *http.Request) {
 		queryAttendees, queryAttArgs, errAttendees := builderAtt.PlaceholderFormat(p.GetDBPlaceholderFormat()).ToSql()
 		if errAttendees != nil {
 			p.API.LogError(errAttendees.Error())
-			errorResponse(w, CantCreateEvent)
-			return
+			return CantCreateEvent
 		}
 		attRows, errInsertAtt := p.DB.Queryx(queryAttendees, queryAttArgs...)
 		if errInsertAtt == nil {
@@ -577,12 +672,15 @@ func (p *Plugin) CreateEvent(w http.ResponseWriter, r *http.Request) {
 
 	if errInsert != nil {
 		p.API.LogError(errInsert.Error())
-		errorResponse(w, CantCreateEvent)
-		return
+		return CantCreateEvent
 	}
 
-	apiResponse(w, &event)
-	return
+	p.saveEventGuests(event, nil)
+
+	p.RecordEventChange(event.Id, nil)
+	p.enqueueWebhook(WebhookEventCreated, event)
+
+	return nil
 }
 
 func (p *Plugin) RemoveEvent(w http.ResponseWriter, r *http.Request) {
@@ -604,6 +702,10 @@ func (p *Plugin) RemoveEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	previousRecipients, _ := p.GetEventSyncRecipients(eventId)
+	removedEvent := p.webhookRemovedEvent(eventId)
+	cancelledEvent := p.removedEventGuests(eventId)
+
 	deleteBuilder := sq.Delete("calendar_events").
 		Where(sq.Eq{"id": eventId}).
 		PlaceholderFormat(p.GetDBPlaceholderFormat())
@@ -623,6 +725,14 @@ func (p *Plugin) RemoveEvent(w http.ResponseWriter, r *http.Request) {
 	}
 	deleteRows.Close()
 
+	p.RecordEventChange(eventId, previousRecipients)
+	if removedEvent != nil {
+		p.enqueueWebhook(WebhookEventDeleted, removedEvent)
+	}
+	if cancelledEvent != nil {
+		p.enqueueInvitations(cancelledEvent, ics.MethodCancel, cancelledEvent.Guests)
+	}
+
 	apiResponse(w, map[string]interface{}{
 		"success": true,
 	})
@@ -666,30 +776,15 @@ func (p *Plugin) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 
 	loc := p.GetUserLocation(user)
 
-	startDateInLocalTimeZone := time.Date(
-		event.Start.Year(),
-		event.Start.Month(),
-		event.Start.Day(),
-		event.Start.Hour(),
-		event.Start.Minute(),
-		event.Start.Second(),
-		event.Start.Nanosecond(),
-		loc,
-	)
-
-	endDateInLocalTimeZone := time.Date(
-		event.End.Year(),
-		event.End.Month(),
-		event.End.Day(),
-		event.End.Hour(),
-		event.End.Minute(),
-		event.End.Second(),
-		event.End.Nanosecond(),
-		loc,
-	)
+	p.setEventTimes(&event, loc)
 
-	event.Start = startDateInLocalTimeZone.In(time.UTC)
-	event.End = endDateInLocalTimeZone.In(time.UTC)
+	recurrence, errRecurrence := normalizeRecurrence(event.Recurrence)
+	if errRecurrence != nil {
+		p.API.LogError(errRecurrence.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+	event.Recurrence = recurrence
 
 	if event.Recurrence != "" && len(event.Recurrence) > 0 {
 		event.Recurrent = true
@@ -697,16 +792,17 @@ func (p *Plugin) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		event.Recurrent = false
 	}
 
-	if event.Alert != EventAlertNone {
-		alertDuration, ok := EventAlertDurationMap[event.Alert]
-		if !ok {
-			alertDuration = 0
-		}
-		alertTime := event.Start.Add(-1 * alertDuration)
-		event.AlertTime = &alertTime
+	guests, errGuests := normalizeGuests(event.Guests)
+	if errGuests != nil {
+		p.API.LogError(errGuests.Error())
+		errorResponse(w, InvalidGuest)
+		return
 	}
+	event.Guests = guests
+
+	event.Updated = time.Now().UTC().Truncate(time.Second)
 
-	event.Updated = time.Now().UTC()
+	previousRecipients, _ := p.GetEventSyncRecipients(event.Id)
 
 	tx, txError := p.DB.Beginx()
 
@@ -716,19 +812,60 @@ func (p *Plugin) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// lock the row so the version check and the update are atomic
+	currentQueryBuilder := sq.Select(
+		"id", "title", "description", "dt_start", "dt_end", "all_day", "timezone",
+		"created", "updated", "owner", "channel", "recurrent", "recurrence",
+		"color", "team", "visibility", "alert", "alert_time", "ical_data",
+	).
+		From("calendar_events").
+		Where(sq.Eq{"id": event.Id}).
+		Suffix("FOR UPDATE").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	currentSql, currentArgs, _ := currentQueryBuilder.ToSql()
+
+	var current Event
+	if errCurrent := tx.Get(&current, currentSql, currentArgs...); errCurrent != nil {
+		p.API.LogError("cant get calendar event: " + errCurrent.Error())
+		if rollbackError := tx.Rollback(); rollbackError != nil {
+			p.API.LogError(rollbackError.Error())
+		}
+		errorResponse(w, EventNotFound)
+		return
+	}
+
+	// clients that don't send a version keep the last write wins behaviour
+	if event.Version != "" && event.Version != eventETag(&current) {
+		if rollbackError := tx.Rollback(); rollbackError != nil {
+			p.API.LogError(rollbackError.Error())
+		}
+		errorResponse(w, EventVersionConflict)
+		return
+	}
+
+	event.Created = current.Created
+	event.Owner = current.Owner
+	event.Team = current.Team
+	event.ICalData = current.ICalData
+
 	updateFields := map[string]interface{}{
-		"title":       event.Title,
-		"description": event.Description,
-		"dt_start":    event.Start,
-		"dt_end":      event.End,
-		"channel":     event.Channel,
-		"recurrence":  event.Recurrence,
-		"recurrent":   event.Recurrent,
-		"color":       event.Color,
-		"visibility":  event.Visibility,
-		"alert":       event.Alert,
-		"alert_time":  event.AlertTime,
-		"updated":     event.Updated,
+		"title":             event.Title,
+		"description":       event.Description,
+		"dt_start":          event.Start,
+		"dt_end":            event.End,
+		"all_day":           event.AllDay,
+		"timezone":          event.Timezone,
+		"channel":           event.Channel,
+		"recurrence":        event.Recurrence,
+		"recurrent":         event.Recurrent,
+		"recurrence_end":    seriesEnd(&event),
+		"next_notification": nextNotification(&event, time.Now().UTC().Truncate(time.Minute)),
+		"color":             event.Color,
+		"visibility":        event.Visibility,
+		"alert":             event.Alert,
+		"alert_time":        event.AlertTime,
+		"updated":           event.Updated,
 	}
 	updateQueryBuilder := sq.Update("calendar_events").
 		SetMap(updateFields).
@@ -747,6 +884,27 @@ func (p *Plugin) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		rows.Close()
 	}
 
+	// members are re-created below, keep the replies of the ones that stay
+	membersBuilder := sq.Select("event", "member", "partstat").
+		From("calendar_members").
+		Where(sq.Eq{"event": event.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	membersSql, membersArgs, _ := membersBuilder.ToSql()
+
+	var previousMembers []EventMember
+	if errMembers := tx.Select(&previousMembers, membersSql, membersArgs...); errMembers != nil {
+		p.API.LogError(errMembers.Error())
+		if rollbackError := tx.Rollback(); rollbackError != nil {
+			p.API.LogError(rollbackError.Error())
+		}
+		errorResponse(w, CantUpdateEvent)
+		return
+	}
+	partStats := map[string]string{}
+	for _, member := range previousMembers {
+		partStats[member.Member] = member.PartStat
+	}
+
 	deleteBuilder := sq.Delete("calendar_members").Where(sq.Eq{"event": event.Id})
 	deleteSql, deleteArgs, deleteErr := deleteBuilder.PlaceholderFormat(p.GetDBPlaceholderFormat()).ToSql()
 	if deleteErr != nil {
@@ -768,9 +926,13 @@ func (p *Plugin) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(event.Attendees) > 0 {
-		attQueryBuilder := sq.Insert("calendar_members").Columns("event", "member")
+		attQueryBuilder := sq.Insert("calendar_members").Columns("event", "member", "partstat")
 		for _, userId := range event.Attendees {
-			attQueryBuilder = attQueryBuilder.Values(event.Id, userId)
+			partStat, ok := partStats[userId]
+			if !ok {
+				partStat = string(ics.ParticipationStatusNeedsAction)
+			}
+			attQueryBuilder = attQueryBuilder.Values(event.Id, userId, partStat)
 		}
 		attUpdateSql, attArgs, _ := attQueryBuilder.PlaceholderFormat(p.GetDBPlaceholderFormat()).ToSql()
 		rows, errUpdateAtt := tx.Queryx(attUpdateSql, attArgs...)
@@ -795,6 +957,13 @@ func (p *Plugin) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	p.saveEventGuests(&event, &current)
+
+	p.RecordEventChange(event.Id, previousRecipients)
+	p.enqueueWebhook(WebhookEventUpdated, &event)
+
+	event.Version = eventETag(&event)
+
 	apiResponse(w, &event)
 	return
 }
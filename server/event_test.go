@@ -1,6 +1,10 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
 	"github.com/DATA-DOG/go-sqlmock"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
@@ -8,6 +12,7 @@ import (
 	"github.com/mattermost/mattermost-server/v6/plugin"
 	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"regexp"
 	"testing"
 	"time"
@@ -46,10 +51,16 @@ func TestGetUTCEvents(t *testing.T) {
 		},
 		sq.Or{
 			sq.And{
-				sq.GtOrEq{"ce.dt_start": sqlRequestTimeStart},
-				sq.LtOrEq{"ce.dt_start": sqlRequestTimeEnd},
+				sq.Lt{"ce.dt_start": sqlRequestTimeEnd.Add(24 * time.Hour)},
+				sq.Gt{"ce.dt_end": sqlRequestTimeStart.Add(-24 * time.Hour)},
+			},
+			sq.And{
+				sq.Eq{"ce.recurrent": true},
+				sq.Or{
+					sq.Eq{"ce.recurrence_end": nil},
+					sq.GtOrEq{"ce.recurrence_end": sqlRequestTimeStart.Add(-24 * time.Hour)},
+				},
 			},
-			sq.Eq{"ce.recurrent": true},
 		},
 	}
 
@@ -61,6 +72,8 @@ func TestGetUTCEvents(t *testing.T) {
 			"ce.description",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -80,7 +93,7 @@ func TestGetUTCEvents(t *testing.T) {
 	querySql, _, err := queryBuilder.ToSql()
 	expectedQuery := dbMock.ExpectQuery(
 		regexp.QuoteMeta(querySql),
-	).WithArgs(session.UserId, session.UserId, "private", sqlRequestTimeStart, sqlRequestTimeEnd, true)
+	).WithArgs(session.UserId, session.UserId, "private", sqlRequestTimeEnd.Add(24*time.Hour), sqlRequestTimeStart.Add(-24*time.Hour), true, sqlRequestTimeStart.Add(-24*time.Hour))
 
 	sqlEventsRow := sqlmock.NewRows([]string{
 		"id",
@@ -99,6 +112,7 @@ func TestGetUTCEvents(t *testing.T) {
 		"visibility",
 		"alert",
 		"alert_time",
+		"timezone",
 	})
 
 	//	add events to sqlEventsRow
@@ -120,6 +134,7 @@ func TestGetUTCEvents(t *testing.T) {
 		VisibilityPrivate,
 		"",
 		nil,
+		"",
 	)
 	// recurrent event, every monday, tuesday, wednesday
 	sqlEventsRow.AddRow(
@@ -139,6 +154,7 @@ func TestGetUTCEvents(t *testing.T) {
 		VisibilityPrivate,
 		"",
 		nil,
+		"Europe/Berlin",
 	)
 
 	// 2 events with multiple members, should be mapped to 1 event
@@ -159,6 +175,7 @@ func TestGetUTCEvents(t *testing.T) {
 		VisibilityPrivate,
 		"",
 		nil,
+		"",
 	)
 	sqlEventsRow.AddRow(
 		"event-3",
@@ -177,6 +194,7 @@ func TestGetUTCEvents(t *testing.T) {
 		VisibilityPrivate,
 		"",
 		nil,
+		"",
 	)
 
 	// recurrent event, every second monday, event must start 2 week earlier
@@ -197,6 +215,7 @@ func TestGetUTCEvents(t *testing.T) {
 		VisibilityPrivate,
 		"",
 		nil,
+		"Europe/Berlin",
 	)
 
 	// recurrent event, corner case, start 00:00, and repeat every current week day
@@ -217,6 +236,7 @@ func TestGetUTCEvents(t *testing.T) {
 		VisibilityPrivate,
 		"",
 		nil,
+		"Europe/Berlin",
 	)
 	//
 
@@ -317,3 +337,113 @@ func TestGetUTCEvents(t *testing.T) {
 		events[5].End,
 	)
 }
+
+func TestUpdateEvent_VersionConflict(t *testing.T) {
+	assert := assert.New(t)
+
+	api := plugintest.API{}
+	api.On("LogDebug", "Plugin HTTP request", "method", "PUT", "path", "/events", "user-agent", "").Return()
+	api.On("GetSession", "session-id").Return(&model.Session{UserId: "test-user"}, nil)
+	api.On("GetUser", "test-user").Return(&model.User{
+		Id: "test-user",
+		Timezone: map[string]string{
+			"useAutomaticTimezone": "false",
+			"manualTimezone":       "UTC",
+		},
+	}, nil)
+
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	current := Event{
+		Id:         "event-1",
+		Title:      "Changed by someone else",
+		Start:      now,
+		End:        now.Add(time.Hour),
+		Created:    now,
+		Updated:    now.Add(time.Minute),
+		Owner:      "test-user",
+		Visibility: VisibilityPrivate,
+	}
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ce.owner, ce.visibility, ce.channel, ce.team, cm.member FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+	dbMock.ExpectBegin()
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1 FOR UPDATE")).
+		WithArgs("event-1").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "title", "description", "dt_start", "dt_end", "created", "updated", "owner", "channel",
+			"recurrent", "recurrence", "color", "team", "visibility", "alert", "alert_time",
+		}).AddRow(current.Id, current.Title, "", current.Start, current.End, current.Created, current.Updated,
+			current.Owner, nil, false, "", nil, "", "private", "", nil))
+	dbMock.ExpectRollback()
+
+	calPlugin := Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+		DB: sqlx.NewDb(db, "sqlmock"),
+	}
+	calPlugin.router = calPlugin.InitAPI()
+
+	stale := current
+	stale.Title = "Original"
+	stale.Updated = now
+
+	body := strings.NewReader(`{"id":"event-1","title":"Mine","start":"2024-01-15T10:00:00Z","end":"2024-01-15T11:00:00Z","visibility":"private","version":"` + eventETag(&stale) + `"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/events", body)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusConflict, w.Code)
+	assert.Contains(w.Body.String(), "event_version_conflict")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCreateEvent_InvalidRecurrence(t *testing.T) {
+	assert := assert.New(t)
+
+	api := plugintest.API{}
+	api.On("LogDebug", "Plugin HTTP request", "method", "POST", "path", "/events", "user-agent", "").Return()
+	api.On("GetSession", "session-id").Return(&model.Session{UserId: "test-user"}, nil)
+	api.On("GetUser", "test-user").Return(&model.User{
+		Id: "test-user",
+		Timezone: map[string]string{
+			"useAutomaticTimezone": "false",
+			"manualTimezone":       "UTC",
+		},
+	}, nil)
+	api.On("LogError", mock.Anything).Return()
+
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	calPlugin := Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+		DB: sqlx.NewDb(db, "sqlmock"),
+	}
+	calPlugin.router = calPlugin.InitAPI()
+
+	for _, recurrence := range []string{
+		`RRULE:FREQ=SOMETIMES`,
+		`RRULE:FREQ=WEEKLY\nRDATE:tomorrow`,
+		`RRULE:FREQ=WEEKLY\nDTSTART:20240318T090000Z`,
+	} {
+		body := strings.NewReader(`{"title":"Standup","start":"2024-03-18T09:00:00Z","end":"2024-03-18T09:15:00Z","visibility":"private","recurrence":"` + recurrence + `"}`)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/events", body)
+		calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+		assert.Equal(http.StatusBadRequest, w.Code, recurrence)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
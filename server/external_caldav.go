@@ -0,0 +1,774 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	ics "github.com/arran4/golang-ical"
+	"github.com/google/uuid"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+const (
+	// externalSyncInterval is how often the background job syncs an external calendar
+	externalSyncInterval = 5 * time.Minute
+	// externalSyncBatchSize bounds the accounts synced in one tick
+	externalSyncBatchSize = 10
+	externalErrorMaxSize  = 1000
+)
+
+// ExternalAccount is the connection of a user to a calendar collection on an external CalDAV
+// server. The background job syncs it both ways with the events the user owns.
+type ExternalAccount struct {
+	UserId    string     `json:"user_id" db:"user_id"`
+	URL       string     `json:"url" db:"url"`
+	Username  string     `json:"username" db:"username"`
+	Password  string     `json:"-" db:"password"`
+	SyncToken string     `json:"-" db:"sync_token"`
+	CTag      string     `json:"-" db:"ctag"`
+	LastSync  *time.Time `json:"last_sync" db:"last_sync"`
+	LastError string     `json:"last_error" db:"last_error"`
+	Created   time.Time  `json:"created" db:"created"`
+	Updated   time.Time  `json:"updated" db:"updated"`
+}
+
+var externalAccountColumns = []string{
+	"user_id",
+	"url",
+	"username",
+	"password",
+	"sync_token",
+	"ctag",
+	"last_sync",
+	"last_error",
+	"created",
+	"updated",
+}
+
+// externalObject links an object of the external collection to the local event it is synced
+// with. LocalUpdated is the Updated of the event when both sides were last the same, a later
+// one means the event changed here.
+type externalObject struct {
+	UserId         string     `db:"user_id"`
+	Href           string     `db:"href"`
+	UID            string     `db:"uid"`
+	ETag           string     `db:"etag"`
+	Event          string     `db:"event"`
+	RemoteModified *time.Time `db:"remote_modified"`
+	LocalUpdated   time.Time  `db:"local_updated"`
+}
+
+var externalObjectColumns = []string{
+	"user_id",
+	"href",
+	"uid",
+	"etag",
+	"event",
+	"remote_modified",
+	"local_updated",
+}
+
+// getExternalAccount returns the external calendar of the user
+func (p *Plugin) getExternalAccount(userId string) (*ExternalAccount, *model.AppError) {
+	queryBuilder := sq.Select(externalAccountColumns...).
+		From("calendar_external_accounts").
+		Where(sq.Eq{"user_id": userId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	var account ExternalAccount
+	if errSelect := p.DB.Get(&account, querySql, args...); errSelect != nil {
+		if !errors.Is(errSelect, sql.ErrNoRows) {
+			p.API.LogError(errSelect.Error())
+			return nil, SomethingWentWrong
+		}
+		return nil, ExternalAccountNotFound
+	}
+	return &account, nil
+}
+
+func (p *Plugin) saveExternalAccount(account *ExternalAccount, exists bool) error {
+	var querySql string
+	var args []interface{}
+	if exists {
+		querySql, args, _ = sq.Update("calendar_external_accounts").
+			SetMap(map[string]interface{}{
+				"url":        account.URL,
+				"username":   account.Username,
+				"password":   account.Password,
+				"sync_token": account.SyncToken,
+				"ctag":       account.CTag,
+				"last_sync":  account.LastSync,
+				"last_error": account.LastError,
+				"updated":    account.Updated,
+			}).
+			Where(sq.Eq{"user_id": account.UserId}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	} else {
+		querySql, args, _ = sq.Insert("calendar_external_accounts").
+			Columns(externalAccountColumns...).
+			Values(
+				account.UserId,
+				account.URL,
+				account.Username,
+				account.Password,
+				account.SyncToken,
+				account.CTag,
+				account.LastSync,
+				account.LastError,
+				account.Created,
+				account.Updated,
+			).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	}
+
+	_, err := p.DB.Exec(querySql, args...)
+	return err
+}
+
+// removeExternalObjects forgets the objects synced for the user, the local events are kept
+func (p *Plugin) removeExternalObjects(userId string) error {
+	querySql, args, _ := sq.Delete("calendar_external_objects").
+		Where(sq.Eq{"user_id": userId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+	_, err := p.DB.Exec(querySql, args...)
+	return err
+}
+
+func (p *Plugin) getExternalObjects(userId string) ([]externalObject, error) {
+	querySql, args, _ := sq.Select(externalObjectColumns...).
+		From("calendar_external_objects").
+		Where(sq.Eq{"user_id": userId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+
+	objects := []externalObject{}
+	if err := p.DB.Select(&objects, querySql, args...); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (p *Plugin) saveExternalObject(object *externalObject, exists bool) error {
+	var querySql string
+	var args []interface{}
+	if exists {
+		querySql, args, _ = sq.Update("calendar_external_objects").
+			SetMap(map[string]interface{}{
+				"uid":             object.UID,
+				"etag":            object.ETag,
+				"event":           object.Event,
+				"remote_modified": object.RemoteModified,
+				"local_updated":   object.LocalUpdated,
+			}).
+			Where(sq.Eq{"user_id": object.UserId, "href": object.Href}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	} else {
+		querySql, args, _ = sq.Insert("calendar_external_objects").
+			Columns(externalObjectColumns...).
+			Values(
+				object.UserId,
+				object.Href,
+				object.UID,
+				object.ETag,
+				object.Event,
+				object.RemoteModified,
+				object.LocalUpdated,
+			).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	}
+
+	_, err := p.DB.Exec(querySql, args...)
+	return err
+}
+
+func (p *Plugin) removeExternalObject(userId, href string) error {
+	querySql, args, _ := sq.Delete("calendar_external_objects").
+		Where(sq.Eq{"user_id": userId, "href": href}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+	_, err := p.DB.Exec(querySql, args...)
+	return err
+}
+
+// getOwnedEvents returns the events of the user with their members, the ones pushed to the
+// external calendar. The events brought from a calendar provider stay off it, like the private
+// events unless they came from the external calendar itself.
+func (p *Plugin) getOwnedEvents(userId string) ([]Event, error) {
+	querySql, args, _ := sq.Select(
+		"id", "title", "description", "dt_start", "dt_end", "all_day", "timezone",
+		"created", "updated", "owner", "channel", "recurrent", "recurrence",
+		"color", "team", "visibility", "alert", "alert_time", "ical_data",
+	).
+		From("calendar_events").
+		Where(sq.Eq{"owner": userId}).
+		Where("NOT EXISTS (SELECT 1 FROM calendar_provider_events pe WHERE pe.event = calendar_events.id)").
+		Where(sq.Or{
+			sq.NotEq{"visibility": string(VisibilityPrivate)},
+			sq.Expr("EXISTS (SELECT 1 FROM calendar_external_objects eo WHERE eo.event = calendar_events.id AND eo.user_id = ?)", userId),
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+
+	events := []Event{}
+	if err := p.DB.Select(&events, querySql, args...); err != nil {
+		return nil, err
+	}
+	p.AttachEventMembers(events)
+	return events, nil
+}
+
+// externalSync is one sync of an external account: the remote changes are pulled first, then
+// the local ones pushed. A change on both sides goes to the side with the later modification.
+type externalSync struct {
+	plugin  *Plugin
+	account *ExternalAccount
+	client  *caldavClient
+	backend *CalDAVBackend
+	// objects are the synced objects by href
+	objects map[string]*externalObject
+
+	syncToken string
+	ctag      string
+}
+
+// allowedInternalConnections returns the internal hosts and networks the admin allows the requests
+// of the users to reach, ServiceSettings.AllowedUntrustedInternalConnections of Mattermost
+func (p *Plugin) allowedInternalConnections() string {
+	allowed := p.API.GetConfig().ServiceSettings.AllowedUntrustedInternalConnections
+	if allowed == nil {
+		return ""
+	}
+	return *allowed
+}
+
+func (p *Plugin) newExternalSync(account *ExternalAccount) (*externalSync, error) {
+	key, err := p.getConfiguration().encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	password, err := decryptSecret(key, account.Password)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt the password: %w", err)
+	}
+	client, err := newCalDAVClient(account.URL, account.Username, password, p.allowedInternalConnections())
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := p.getExternalObjects(account.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &externalSync{
+		plugin:    p,
+		account:   account,
+		client:    client,
+		backend:   NewCalDAVBackend(p, account.UserId, "", ""),
+		objects:   map[string]*externalObject{},
+		syncToken: account.SyncToken,
+		ctag:      account.CTag,
+	}
+	for i := range objects {
+		s.objects[objects[i].Href] = &objects[i]
+	}
+	return s, nil
+}
+
+// run syncs the account, the sync state is only kept when the whole pull succeeded
+func (s *externalSync) run() error {
+	if err := s.pull(); err != nil {
+		return err
+	}
+	s.account.SyncToken = s.syncToken
+	s.account.CTag = s.ctag
+
+	return s.push()
+}
+
+// remoteChanges returns the objects changed and the hrefs removed on the server since the last
+// sync, with sync-collection when the server supports it and by listing the collection otherwise
+func (s *externalSync) remoteChanges() ([]remoteObject, []string, error) {
+	if s.syncToken != "" {
+		changed, removed, token, err := s.client.syncCollection(s.syncToken)
+		if err == nil {
+			s.syncToken = token
+			return changed, removed, nil
+		}
+		if !errors.Is(err, errSyncTokenInvalid) {
+			return nil, nil, err
+		}
+	}
+
+	collection, err := s.client.properties()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !collection.IsCalendar {
+		return nil, nil, fmt.Errorf("%s isn't a calendar collection", s.account.URL)
+	}
+	s.syncToken = collection.SyncToken
+	if collection.CTag != "" && collection.CTag == s.ctag && s.account.SyncToken == "" {
+		return nil, nil, nil
+	}
+	s.ctag = collection.CTag
+
+	listed, err := s.client.list()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := map[string]bool{}
+	var changed []remoteObject
+	for _, object := range listed {
+		present[object.Href] = true
+		changed = append(changed, object)
+	}
+	var removed []string
+	for href := range s.objects {
+		if !present[href] {
+			removed = append(removed, href)
+		}
+	}
+	return changed, removed, nil
+}
+
+func (s *externalSync) pull() error {
+	changed, removed, err := s.remoteChanges()
+	if err != nil {
+		return err
+	}
+
+	var hrefs []string
+	for _, object := range changed {
+		if synced, ok := s.objects[object.Href]; ok && object.ETag != "" && synced.ETag == object.ETag {
+			continue
+		}
+		hrefs = append(hrefs, object.Href)
+	}
+
+	if len(hrefs) > 0 {
+		fetched, errFetch := s.client.multiget(hrefs)
+		if errFetch != nil {
+			return errFetch
+		}
+		for i := range fetched {
+			if errApply := s.applyRemote(&fetched[i]); errApply != nil {
+				return errApply
+			}
+		}
+	}
+
+	for _, href := range removed {
+		if errRemove := s.applyRemoteRemoval(href); errRemove != nil {
+			return errRemove
+		}
+	}
+	return nil
+}
+
+// applyRemote saves an object of the server as local event, unless the event changed here later
+func (s *externalSync) applyRemote(object *remoteObject) error {
+	cal, err := ics.ParseCalendar(strings.NewReader(object.Data))
+	if err != nil {
+		s.plugin.API.LogWarn("External calendar: can't parse object", "user", s.account.UserId, "href", object.Href, "error", err.Error())
+		return nil
+	}
+	vevent := masterEvent(cal)
+	if vevent == nil {
+		// tasks and journals aren't synced
+		return nil
+	}
+
+	uid := ""
+	if property := vevent.GetProperty(ics.ComponentPropertyUniqueId); property != nil {
+		uid = property.Value
+	}
+	var remoteModified *time.Time
+	modified := s.backend.parseICalTime(vevent.GetProperty(ics.ComponentPropertyLastModified))
+	if modified.IsZero() {
+		modified = s.backend.parseICalTime(vevent.GetProperty(ics.ComponentPropertyDtstamp))
+	}
+	if !modified.IsZero() {
+		modified = modified.UTC().Truncate(time.Second)
+		remoteModified = &modified
+	}
+
+	synced, exists := s.objects[object.Href]
+	var current *Event
+	if exists {
+		current, _ = s.backend.getEventByID(synced.Event)
+		if current != nil && current.Owner != s.account.UserId {
+			current = nil
+		}
+	}
+
+	if current != nil && current.Updated.After(synced.LocalUpdated) &&
+		(remoteModified == nil || !remoteModified.After(current.Updated)) {
+		// changed on both sides and the local change is the later one, push sends it
+		synced.ETag = object.ETag
+		synced.RemoteModified = remoteModified
+		return s.plugin.saveExternalObject(synced, true)
+	}
+
+	eventId := uid
+	if current != nil {
+		eventId = current.Id
+	} else if eventId == "" || s.eventExists(eventId) {
+		eventId = uuid.New().String()
+	}
+
+	event, err := s.backend.icalendarToEvent(cal, eventId)
+	if err != nil {
+		return nil
+	}
+	// the attendees stay in the calendar object, they aren't invited here
+	event.Attendees = nil
+
+	if current != nil {
+		event.Owner = current.Owner
+		event.Created = current.Created
+		previous, _ := s.plugin.GetEventSyncRecipients(event.Id)
+		if err = s.backend.updateEvent(event); err != nil {
+			return err
+		}
+		s.plugin.RecordEventChange(event.Id, previous)
+		s.plugin.enqueueWebhook(WebhookEventUpdated, event)
+	} else {
+		event.Owner = s.account.UserId
+		if err = s.backend.createEvent(event); err != nil {
+			return err
+		}
+		s.plugin.RecordEventChange(event.Id, nil)
+		s.plugin.enqueueWebhook(WebhookEventCreated, event)
+	}
+
+	if !exists {
+		synced = &externalObject{UserId: s.account.UserId, Href: object.Href}
+		s.objects[object.Href] = synced
+	}
+	synced.UID = uid
+	synced.ETag = object.ETag
+	synced.Event = event.Id
+	synced.RemoteModified = remoteModified
+	synced.LocalUpdated = event.Updated
+	return s.plugin.saveExternalObject(synced, exists)
+}
+
+func (s *externalSync) eventExists(eventId string) bool {
+	event, _ := s.backend.getEventByID(eventId)
+	return event != nil
+}
+
+// applyRemoteRemoval deletes the local event of an object removed on the server. An event
+// changed here since the last sync is pushed again instead.
+func (s *externalSync) applyRemoteRemoval(href string) error {
+	synced, ok := s.objects[href]
+	if !ok {
+		return nil
+	}
+
+	current, _ := s.backend.getEventByID(synced.Event)
+	if current != nil && current.Owner == s.account.UserId && !current.Updated.After(synced.LocalUpdated) {
+		if err := s.plugin.removeImportedEvent(current); err != nil {
+			return err
+		}
+	}
+
+	delete(s.objects, href)
+	return s.plugin.removeExternalObject(s.account.UserId, href)
+}
+
+// removeImportedEvent deletes an event removed from the calendar it was synced with
+func (p *Plugin) removeImportedEvent(event *Event) error {
+	previous, _ := p.GetEventSyncRecipients(event.Id)
+	querySql, args, _ := sq.Delete("calendar_events").
+		Where(sq.Eq{"id": event.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+	if _, err := p.DB.Exec(querySql, args...); err != nil {
+		return err
+	}
+	p.RecordEventChange(event.Id, previous)
+	p.enqueueWebhook(WebhookEventDeleted, event)
+	return nil
+}
+
+// push sends the events created, changed or deleted here since the last sync
+func (s *externalSync) push() error {
+	events, err := s.plugin.getOwnedEvents(s.account.UserId)
+	if err != nil {
+		return err
+	}
+
+	byEvent := map[string]*externalObject{}
+	for _, synced := range s.objects {
+		byEvent[synced.Event] = synced
+	}
+
+	owned := map[string]bool{}
+	for i := range events {
+		event := &events[i]
+		owned[event.Id] = true
+
+		synced, exists := byEvent[event.Id]
+		if exists && !event.Updated.After(synced.LocalUpdated) {
+			continue
+		}
+
+		if !exists {
+			synced = &externalObject{
+				UserId: s.account.UserId,
+				Href:   s.client.objectHref(event.Id),
+				UID:    event.Id,
+				Event:  event.Id,
+			}
+		}
+
+		etag, errPut := s.client.put(synced.Href, s.render(event, synced.UID), synced.ETag)
+		if errors.Is(errPut, errRemoteChanged) {
+			// the next pull brings the remote change and decides
+			continue
+		}
+		if errPut != nil {
+			return errPut
+		}
+
+		synced.ETag = etag
+		synced.LocalUpdated = event.Updated
+		if errSave := s.plugin.saveExternalObject(synced, exists); errSave != nil {
+			return errSave
+		}
+		s.objects[synced.Href] = synced
+	}
+
+	// the events deleted here, unless the object changed on the server since
+	for href, synced := range s.objects {
+		if owned[synced.Event] {
+			continue
+		}
+		if errDelete := s.client.delete(href, synced.ETag); errDelete != nil && !errors.Is(errDelete, errRemoteChanged) {
+			return errDelete
+		}
+		delete(s.objects, href)
+		if errRemove := s.plugin.removeExternalObject(s.account.UserId, href); errRemove != nil {
+			return errRemove
+		}
+	}
+	return nil
+}
+
+// render returns the calendar object of an event for the server, with the UID of the object
+func (s *externalSync) render(event *Event, uid string) string {
+	user := s.backend.lookupUser(event.Owner)
+	cal := s.backend.eventToICalendar(event, user)
+	if uid != event.Id {
+		for _, vevent := range cal.Events() {
+			vevent.SetProperty(ics.ComponentPropertyUniqueId, uid)
+		}
+	}
+	return cal.Serialize()
+}
+
+// syncExternalAccounts syncs the external calendars not synced for externalSyncInterval
+func (p *Plugin) syncExternalAccounts(now time.Time) {
+	queryBuilder := sq.Select(externalAccountColumns...).
+		From("calendar_external_accounts").
+		Where(sq.Or{
+			sq.Eq{"last_sync": nil},
+			sq.LtOrEq{"last_sync": now.Add(-externalSyncInterval)},
+		}).
+		OrderBy("last_sync").
+		Limit(externalSyncBatchSize).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	accounts := []ExternalAccount{}
+	if errSelect := p.DB.Select(&accounts, querySql, args...); errSelect != nil {
+		p.API.LogError("syncExternalAccounts: " + errSelect.Error())
+		return
+	}
+
+	for i := range accounts {
+		account := &accounts[i]
+
+		account.LastError = ""
+		sync, errSync := p.newExternalSync(account)
+		if errSync == nil {
+			errSync = sync.run()
+		}
+		if errSync != nil {
+			account.LastError = errSync.Error()
+			if len(account.LastError) > externalErrorMaxSize {
+				account.LastError = account.LastError[:externalErrorMaxSize]
+			}
+			p.API.LogWarn("External calendar sync failed", "user", account.UserId, "error", account.LastError)
+		}
+
+		account.LastSync = &now
+		if errSave := p.saveExternalAccount(account, true); errSave != nil {
+			p.API.LogError("syncExternalAccounts: can't update account: " + errSave.Error())
+		}
+	}
+}
+
+// GetExternalAccount returns the external calendar of the user, without the password
+func (p *Plugin) GetExternalAccount(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	account, accountErr := p.getExternalAccount(user.Id)
+	if accountErr != nil {
+		errorResponse(w, accountErr)
+		return
+	}
+
+	apiResponse(w, account)
+}
+
+type externalAccountRequest struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// ConnectExternalAccount connects the user to a calendar collection of an external server, or
+// changes the connection. The credentials are checked before they are saved.
+func (p *Plugin) ConnectExternalAccount(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	var request externalAccountRequest
+	if errDecode := json.NewDecoder(r.Body).Decode(&request); errDecode != nil {
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+	request.URL = strings.TrimSpace(request.URL)
+
+	key, errKey := p.getConfiguration().encryptionKey()
+	if errKey != nil {
+		errorResponse(w, EncryptionKeyNotConfigured)
+		return
+	}
+
+	current, currentErr := p.getExternalAccount(user.Id)
+	if currentErr != nil && currentErr != ExternalAccountNotFound {
+		errorResponse(w, currentErr)
+		return
+	}
+
+	// an empty password keeps the saved one
+	password := request.Password
+	if password == "" && current != nil {
+		decrypted, errDecrypt := decryptSecret(key, current.Password)
+		if errDecrypt != nil {
+			errorResponse(w, InvalidRequestParams)
+			return
+		}
+		password = decrypted
+	}
+
+	client, errClient := newCalDAVClient(request.URL, request.Username, password, p.allowedInternalConnections())
+	if errClient != nil {
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+	collection, errCollection := client.properties()
+	if errCollection != nil || !collection.IsCalendar {
+		if errCollection != nil {
+			p.API.LogWarn("External calendar: can't connect", "user", user.Id, "error", errCollection.Error())
+		}
+		errorResponse(w, ExternalCalendarUnreachable)
+		return
+	}
+
+	encrypted, errEncrypt := encryptSecret(key, password)
+	if errEncrypt != nil {
+		p.API.LogError(errEncrypt.Error())
+		errorResponse(w, CantSaveExternalAccount)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	account := &ExternalAccount{UserId: user.Id, Created: now}
+	if current != nil {
+		account = current
+	}
+
+	// another calendar starts over, the next tick of the background job syncs it
+	if current == nil || current.URL != request.URL || current.Username != request.Username {
+		account.SyncToken = ""
+		account.CTag = ""
+		account.LastSync = nil
+		if errRemove := p.removeExternalObjects(user.Id); errRemove != nil {
+			p.API.LogError(errRemove.Error())
+			errorResponse(w, CantSaveExternalAccount)
+			return
+		}
+	}
+	account.URL = request.URL
+	account.Username = request.Username
+	account.Password = encrypted
+	account.LastError = ""
+	account.Updated = now
+
+	if errSave := p.saveExternalAccount(account, current != nil); errSave != nil {
+		p.API.LogError(errSave.Error())
+		errorResponse(w, CantSaveExternalAccount)
+		return
+	}
+
+	apiResponse(w, account)
+}
+
+// DisconnectExternalAccount stops syncing the external calendar, the events stay on both sides
+func (p *Plugin) DisconnectExternalAccount(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	if errRemove := p.removeExternalObjects(user.Id); errRemove != nil {
+		p.API.LogError(errRemove.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	querySql, args, _ := sq.Delete("calendar_external_accounts").
+		Where(sq.Eq{"user_id": user.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+	result, errDelete := p.DB.Exec(querySql, args...)
+	if errDelete != nil {
+		p.API.LogError(errDelete.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		errorResponse(w, ExternalAccountNotFound)
+		return
+	}
+
+	apiResponse(w, map[string]interface{}{
+		"success": true,
+	})
+}
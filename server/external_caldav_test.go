@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testExternalEventICal = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Test//EN\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:ext-1\r\n" +
+	"DTSTAMP:20240301T080000Z\r\n" +
+	"LAST-MODIFIED:20240301T080000Z\r\n" +
+	"DTSTART:20240315T090000Z\r\n" +
+	"DTEND:20240315T100000Z\r\n" +
+	"SUMMARY:Dentist\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+var externalObjectRowColumns = []string{"user_id", "href", "uid", "etag", "event", "remote_modified", "local_updated"}
+
+const testEncryptionKey = "test-encryption-key"
+
+func encryptedTestPassword(t *testing.T) string {
+	key, _ := (&configuration{EncryptionKey: testEncryptionKey}).encryptionKey()
+	encrypted, err := encryptSecret(key, "app-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+func expectExternalAccount(t *testing.T, dbMock sqlmock.Sqlmock, server *testCalDAVServer, syncToken string) string {
+	password := encryptedTestPassword(t)
+	created := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_external_accounts WHERE (last_sync IS NULL OR last_sync <= $1) ORDER BY last_sync LIMIT 10")).
+		WillReturnRows(sqlmock.NewRows(externalAccountColumns).
+			AddRow("test-user", server.collectionURL(), "alice", password, syncToken, "", nil, "", created, created))
+	return password
+}
+
+func expectExternalObjects(dbMock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_external_objects WHERE user_id = $1")).
+		WithArgs("test-user").
+		WillReturnRows(rows)
+}
+
+func expectOwnedEvents(dbMock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE owner = $1 "+
+		"AND NOT EXISTS (SELECT 1 FROM calendar_provider_events pe WHERE pe.event = calendar_events.id) "+
+		"AND (visibility <> $2 OR EXISTS (SELECT 1 FROM calendar_external_objects eo WHERE eo.event = calendar_events.id AND eo.user_id = $3))")).
+		WithArgs("test-user", "private", "test-user").
+		WillReturnRows(rows)
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+}
+
+// allowTestCalDAVServer lets the plugin reach the test servers on the loopback
+func allowTestCalDAVServer(api *plugintest.API) {
+	allowed := testAllowedInternal
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{AllowedUntrustedInternalConnections: &allowed}})
+}
+
+func newExternalSyncTestPlugin(t *testing.T) (*Plugin, sqlmock.Sqlmock, func()) {
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	calPlugin.setConfiguration(&configuration{EncryptionKey: testEncryptionKey})
+	allowTestCalDAVServer(calPlugin.API.(*plugintest.API))
+	return calPlugin, dbMock, closeDB
+}
+
+func TestEncryptSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := (&configuration{}).encryptionKey()
+	assert.ErrorIs(err, errEncryptionKeyMissing)
+
+	key, err := (&configuration{EncryptionKey: testEncryptionKey}).encryptionKey()
+	assert.Nil(err)
+	assert.Len(key, 32)
+
+	encrypted, err := encryptSecret(key, "app-password")
+	assert.Nil(err)
+	assert.NotContains(encrypted, "app-password")
+
+	again, _ := encryptSecret(key, "app-password")
+	assert.NotEqual(encrypted, again)
+
+	decrypted, err := decryptSecret(key, encrypted)
+	assert.Nil(err)
+	assert.Equal("app-password", decrypted)
+
+	other, _ := (&configuration{EncryptionKey: "other-key"}).encryptionKey()
+	_, err = decryptSecret(other, encrypted)
+	assert.NotNil(err)
+}
+
+func TestSyncExternalAccounts_PullsRemoteEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newExternalSyncTestPlugin(t)
+	defer closeDB()
+	server := newTestCalDAVServer()
+	defer server.Close()
+	etag := server.store("dentist.ics", testExternalEventICal)
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	password := expectExternalAccount(t, dbMock, server, "")
+	expectExternalObjects(dbMock, sqlmock.NewRows(externalObjectRowColumns))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events WHERE id = $1")).
+		WithArgs("ext-1").
+		WillReturnRows(sqlmock.NewRows(caldavEventColumns))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_events")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	modified := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_external_objects")).
+		WithArgs("test-user", testCollectionPath+"dentist.ics", "ext-1", etag, "ext-1", &modified, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// the pulled event isn't pushed back
+	created := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	expectOwnedEvents(dbMock, sqlmock.NewRows(caldavEventColumns).
+		AddRow("ext-1", "Dentist", "", created, created, created, created, "test-user", nil, false, "", nil, "", "private", "", nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_external_accounts SET")).
+		WithArgs("ctag-1", "", &now, password, "sync-1", sqlmock.AnyArg(), server.collectionURL(), "alice", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.syncExternalAccounts(now)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+	assert.NotContains(strings.Join(server.requests, "\n"), "PUT")
+}
+
+func TestSyncExternalAccounts_PushesLocalEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newExternalSyncTestPlugin(t)
+	defer closeDB()
+	server := newTestCalDAVServer()
+	defer server.Close()
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	updated := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	password := expectExternalAccount(t, dbMock, server, "")
+	expectExternalObjects(dbMock, sqlmock.NewRows(externalObjectRowColumns))
+	expectOwnedEvents(dbMock, sqlmock.NewRows(caldavEventColumns).
+		AddRow("event-1", "Standup", "", updated, updated.Add(time.Hour), updated, updated, "test-user", nil, false, "", nil, "", "team", "", nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_external_objects")).
+		WithArgs("test-user", testCollectionPath+"event-1.ics", "event-1", `"v1"`, "event-1", nil, updated).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_external_accounts SET")).
+		WithArgs("ctag-0", "", &now, password, "sync-0", sqlmock.AnyArg(), server.collectionURL(), "alice", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.syncExternalAccounts(now)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+	object, ok := server.object("event-1.ics")
+	assert.True(ok)
+	assert.Contains(object.data, "UID:event-1")
+	assert.Contains(object.data, "SUMMARY:Standup")
+}
+
+func TestSyncExternalAccounts_LaterLocalChangeWins(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newExternalSyncTestPlugin(t)
+	defer closeDB()
+	server := newTestCalDAVServer()
+	defer server.Close()
+
+	synced := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	server.store("a.ics", testExternalEventICal)
+	// changed on the server at 08:00, the local event at 10:00
+	remoteEtag := server.store("a.ics", strings.Replace(testExternalEventICal, "SUMMARY:Dentist", "SUMMARY:Remote title", 1))
+	updated := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	password := expectExternalAccount(t, dbMock, server, "sync-1")
+	expectExternalObjects(dbMock, sqlmock.NewRows(externalObjectRowColumns).
+		AddRow("test-user", testCollectionPath+"a.ics", "ext-1", `"v1"`, "event-1", synced, synced))
+	expectCalDAVEvent(dbMock, &Event{
+		Id:      "event-1",
+		Title:   "Local title",
+		Start:   updated,
+		End:     updated.Add(time.Hour),
+		Created: synced,
+		Updated: updated,
+		Owner:   "test-user",
+	})
+	modified := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_external_objects SET")).
+		WithArgs(remoteEtag, "event-1", synced, &modified, "ext-1", testCollectionPath+"a.ics", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectOwnedEvents(dbMock, sqlmock.NewRows(caldavEventColumns).
+		AddRow("event-1", "Local title", "", updated, updated.Add(time.Hour), synced, updated, "test-user", nil, false, "", nil, "", "private", "", nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_external_objects SET")).
+		WithArgs(`"v3"`, "event-1", updated, &modified, "ext-1", testCollectionPath+"a.ics", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_external_accounts SET")).
+		WithArgs("", "", &now, password, "sync-2", sqlmock.AnyArg(), server.collectionURL(), "alice", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.syncExternalAccounts(now)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+	object, _ := server.object("a.ics")
+	// the object keeps the UID of the server
+	assert.Contains(object.data, "UID:ext-1")
+	assert.Contains(object.data, "SUMMARY:Local title")
+}
+
+func TestConnectExternalAccount(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestCalDAVServer()
+	defer server.Close()
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, "PUT", "/external/caldav")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{EncryptionKey: testEncryptionKey})
+	allowTestCalDAVServer(api)
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_external_accounts WHERE user_id = $1")).
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows(externalAccountColumns))
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_external_objects WHERE user_id = $1")).
+		WithArgs("test-user").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	var saved string
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_external_accounts")).
+		WithArgs("test-user", server.collectionURL(), "alice", passwordArg{&saved}, "", "", nil, "", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/external/caldav",
+		strings.NewReader(`{"url":"`+server.collectionURL()+`","username":"alice","password":"app-password"}`))
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"url":"`+server.collectionURL()+`"`)
+	assert.NotContains(w.Body.String(), "password")
+	key, _ := calPlugin.getConfiguration().encryptionKey()
+	decrypted, err := decryptSecret(key, saved)
+	assert.Nil(err)
+	assert.Equal("app-password", decrypted)
+	assert.Nil(dbMock.ExpectationsWereMet())
+	api.AssertExpectations(t)
+}
+
+func TestConnectExternalAccount_Unreachable(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestCalDAVServer()
+	defer server.Close()
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, "PUT", "/external/caldav")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{EncryptionKey: testEncryptionKey})
+	allowTestCalDAVServer(api)
+	api.On("LogWarn", "External calendar: can't connect", "user", "test-user", "error", mock.Anything).Return()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_external_accounts WHERE user_id = $1")).
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows(externalAccountColumns))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/external/caldav",
+		strings.NewReader(`{"url":"`+server.collectionURL()+`","username":"alice","password":"wrong"}`))
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestConnectExternalAccount_InternalDestination(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestCalDAVServer()
+	defer server.Close()
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, "PUT", "/external/caldav")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{EncryptionKey: testEncryptionKey})
+	api.On("GetConfig").Return(&model.Config{})
+
+	for _, calendarURL := range []string{server.collectionURL(), "http://169.254.169.254/latest/meta-data/"} {
+		dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_external_accounts WHERE user_id = $1")).
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows(externalAccountColumns))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/external/caldav",
+			strings.NewReader(`{"url":"`+calendarURL+`","username":"alice","password":"app-password"}`))
+		calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+		assert.Equal(http.StatusBadRequest, w.Code, calendarURL)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestConnectExternalAccount_NoEncryptionKey(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, "PUT", "/external/caldav")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/external/caldav",
+		strings.NewReader(`{"url":"https://dav.example.com/calendars/alice/work/","username":"alice","password":"app-password"}`))
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusNotImplemented, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+// passwordArg captures the encrypted password saved for the account
+type passwordArg struct {
+	value *string
+}
+
+func (a passwordArg) Match(value driver.Value) bool {
+	data, ok := value.(string)
+	*a.value = data
+	return ok && data != "" && data != "app-password"
+}
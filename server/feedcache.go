@@ -0,0 +1,166 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// feedCacheTTL bounds how long a feed is served from the cache, its range moves with time and
+	// channel memberships change without event writes
+	feedCacheTTL        = 5 * time.Minute
+	feedCacheMaxEntries = 1000
+	// gzipMinSize is the size from which the feeds are compressed for the clients accepting gzip
+	gzipMinSize = 8 * 1024
+)
+
+// renderedFeed is an iCal feed rendered with its validators
+type renderedFeed struct {
+	body         []byte
+	etag         string
+	lastModified time.Time
+	rendered     time.Time
+}
+
+// feedCache keeps the rendered feeds by user and query until the next event write
+type feedCache struct {
+	lock sync.Mutex
+	// generation changes with every event write, the feeds rendered before are dropped
+	generation uint64
+	feeds      map[string]*renderedFeed
+}
+
+// get returns the feed of the key rendered since the last write and less than feedCacheTTL ago
+func (c *feedCache) get(key string, now time.Time) *renderedFeed {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	feed, ok := c.feeds[key]
+	if !ok {
+		return nil
+	}
+	if now.Sub(feed.rendered) >= feedCacheTTL {
+		delete(c.feeds, key)
+		return nil
+	}
+	return feed
+}
+
+// currentGeneration returns the generation to put the feeds queried from now on
+func (c *feedCache) currentGeneration() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.generation
+}
+
+// put keeps the feed unless an event was written since its events were queried in generation
+func (c *feedCache) put(key string, feed *renderedFeed, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if c.feeds == nil || len(c.feeds) >= feedCacheMaxEntries {
+		c.feeds = map[string]*renderedFeed{}
+	}
+	c.feeds[key] = feed
+}
+
+// invalidate drops every feed, any event write can change the feeds of many users
+func (c *feedCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	c.feeds = nil
+}
+
+// feedValidators returns the weak ETag and the Last-Modified of a feed from the latest update of
+// its events. The count of events changes the ETag when one is deleted, the variant when the
+// query does.
+func feedValidators(events []Event, variant string) (string, time.Time) {
+	var lastModified time.Time
+	for _, event := range events {
+		if event.Updated.After(lastModified) {
+			lastModified = event.Updated
+		}
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(variant))
+	hash.Write([]byte{0})
+	hash.Write([]byte(strconv.FormatInt(lastModified.UnixNano(), 10)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(strconv.Itoa(len(events))))
+
+	return `W/"` + hex.EncodeToString(hash.Sum(nil))[:32] + `"`, lastModified.UTC().Truncate(time.Second)
+}
+
+// notModified reports whether the client has the current representation. If-None-Match is
+// compared weakly and wins over If-Modified-Since (RFC 7232).
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// acceptsGzip reports whether the client accepts gzip content encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding == "gzip" || (strings.HasPrefix(encoding, "gzip;") && !strings.HasSuffix(encoding, "q=0")) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFeed writes a rendered feed, 304 when the client has it already and gzipped when it is
+// large and the client accepts it
+func writeFeed(w http.ResponseWriter, r *http.Request, feed *renderedFeed) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"calendar.ics\"")
+	// clients revalidate the feed every time, with its ETag
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", feed.etag)
+	if !feed.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", feed.lastModified.Format(http.TimeFormat))
+	}
+
+	if notModified(r, feed.etag, feed.lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if len(feed.body) < gzipMinSize || !acceptsGzip(r) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(feed.body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	gzipWriter := gzip.NewWriter(w)
+	_, _ = gzipWriter.Write(feed.body)
+	_ = gzipWriter.Close()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeedValidators(t *testing.T) {
+	assert := assert.New(t)
+
+	updated := time.Date(2024, 3, 20, 9, 30, 15, 500, time.UTC)
+	events := []Event{
+		{Id: "event-1", Updated: updated.Add(-time.Hour)},
+		{Id: "event-2", Updated: updated},
+	}
+
+	etag, lastModified := feedValidators(events, "user:test-user?")
+	assert.True(strings.HasPrefix(etag, `W/"`))
+	assert.Equal(time.Date(2024, 3, 20, 9, 30, 15, 0, time.UTC), lastModified)
+
+	// the same events give the same validators
+	sameEtag, _ := feedValidators(events, "user:test-user?")
+	assert.Equal(etag, sameEtag)
+
+	// a deleted event, another query or an update change the ETag
+	otherEtag, _ := feedValidators(events[1:], "user:test-user?")
+	assert.NotEqual(etag, otherEtag)
+	otherEtag, _ = feedValidators(events, "user:test-user?busy=true")
+	assert.NotEqual(etag, otherEtag)
+	events[0].Updated = updated.Add(time.Second)
+	otherEtag, _ = feedValidators(events, "user:test-user?")
+	assert.NotEqual(etag, otherEtag)
+
+	_, lastModified = feedValidators(nil, "user:test-user?")
+	assert.True(lastModified.IsZero())
+}
+
+func TestNotModified(t *testing.T) {
+	assert := assert.New(t)
+
+	etag := `W/"abcd"`
+	lastModified := time.Date(2024, 3, 20, 9, 30, 0, 0, time.UTC)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.False(notModified(r, etag, lastModified))
+
+	r.Header.Set("If-None-Match", `"other", "abcd"`)
+	assert.True(notModified(r, etag, lastModified))
+	r.Header.Set("If-None-Match", "*")
+	assert.True(notModified(r, etag, lastModified))
+
+	// If-None-Match wins over If-Modified-Since
+	r.Header.Set("If-None-Match", `W/"other"`)
+	r.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+	assert.False(notModified(r, etag, lastModified))
+
+	r.Header.Del("If-None-Match")
+	assert.True(notModified(r, etag, lastModified))
+	assert.False(notModified(r, etag, lastModified.Add(time.Second)))
+	r.Header.Set("If-Modified-Since", "yesterday")
+	assert.False(notModified(r, etag, lastModified))
+}
+
+func TestFeedCache(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UTC()
+	cache := feedCache{}
+	assert.Nil(cache.get("user:test-user?", now))
+
+	feed := &renderedFeed{body: []byte("BEGIN:VCALENDAR"), etag: `W/"abcd"`, rendered: now}
+	cache.put("user:test-user?", feed, cache.currentGeneration())
+	assert.Equal(feed, cache.get("user:test-user?", now))
+	assert.Nil(cache.get("user:test-user?", now.Add(feedCacheTTL)))
+
+	cache.put("user:test-user?", feed, cache.currentGeneration())
+	cache.invalidate()
+	assert.Nil(cache.get("user:test-user?", now))
+
+	// a feed queried before a write isn't kept
+	generation := cache.currentGeneration()
+	cache.invalidate()
+	cache.put("user:test-user?", feed, generation)
+	assert.Nil(cache.get("user:test-user?", now))
+}
+
+func TestWriteFeed_Gzip(t *testing.T) {
+	assert := assert.New(t)
+
+	feed := &renderedFeed{body: bytes.Repeat([]byte("BEGIN:VEVENT\r\nEND:VEVENT\r\n"), gzipMinSize), etag: `W/"abcd"`}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	writeFeed(w, r, feed)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("gzip", w.Header().Get("Content-Encoding"))
+	assert.Less(w.Body.Len(), len(feed.body))
+	reader, err := gzip.NewReader(w.Body)
+	assert.Nil(err)
+	body, err := io.ReadAll(reader)
+	assert.Nil(err)
+	assert.Equal(feed.body, body)
+
+	// small feeds and clients refusing gzip get the plain body
+	w = httptest.NewRecorder()
+	r.Header.Set("Accept-Encoding", "gzip;q=0")
+	writeFeed(w, r, feed)
+	assert.Empty(w.Header().Get("Content-Encoding"))
+	assert.Equal(feed.body, w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	r.Header.Set("Accept-Encoding", "gzip")
+	writeFeed(w, r, &renderedFeed{body: []byte("BEGIN:VCALENDAR"), etag: `W/"abcd"`})
+	assert.Empty(w.Header().Get("Content-Encoding"))
+	assert.Equal("BEGIN:VCALENDAR", w.Body.String())
+}
+
+func TestServeICalFeed_NotModified(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	path := "/ical/feed/" + tokenValue
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+
+	prefix, salt, hash := hashedICalToken(tokenValue)
+	now := time.Now().UTC()
+	expectToken := func() {
+		dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_ical_tokens WHERE token_prefix = $1")).
+			WithArgs(prefix).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "token_prefix", "token_salt", "token_hash", "user_id", "scope", "created"}).
+				AddRow("token-1", prefix, salt, hash, "test-user", ICalTokenScopeFeed, now))
+	}
+	expectToken()
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm ON ce.id = cm.event WHERE")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "dt_start", "dt_end", "created", "updated", "owner"}).
+			AddRow("event-1", "Planning", now, now.Add(time.Hour), now, now, "test-user"))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ChannelId FROM ChannelMembers")).
+		WillReturnRows(sqlmock.NewRows([]string{"ChannelId"}))
+	dbMock.MatchExpectationsInOrder(false)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "SUMMARY:Planning")
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(etag)
+	assert.Equal(now.Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+
+	// the second request is served from the cache, without querying the events
+	expectToken()
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("If-None-Match", etag)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusNotModified, w.Code)
+	assert.Empty(w.Body.String())
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
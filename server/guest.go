@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	ics "github.com/arran4/golang-ical"
+)
+
+// EventGuest is an attendee without a Mattermost account, invited by email (iMIP, RFC 6047)
+type EventGuest struct {
+	Event    string `json:"-" db:"event"`
+	Email    string `json:"email" db:"email"`
+	Name     string `json:"name" db:"name"`
+	PartStat string `json:"status" db:"partstat"`
+}
+
+// normalizeGuests checks the guests of a request. The emails are lower-cased and listed once, the
+// status isn't taken from the request. nil stays nil: the guests of the event are kept.
+func normalizeGuests(guests []EventGuest) ([]EventGuest, error) {
+	if guests == nil {
+		return nil, nil
+	}
+
+	normalized := []EventGuest{}
+	seen := map[string]bool{}
+	for _, guest := range guests {
+		address, err := mail.ParseAddress(strings.TrimSpace(guest.Email))
+		if err != nil {
+			return nil, fmt.Errorf("invalid guest %q: %w", guest.Email, err)
+		}
+
+		email := strings.ToLower(address.Address)
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+
+		name := strings.TrimSpace(guest.Name)
+		if name == "" {
+			name = address.Name
+		}
+		normalized = append(normalized, EventGuest{Email: email, Name: name})
+	}
+	return normalized, nil
+}
+
+// GetEventsGuests returns the guests of the events grouped by event id
+func (p *Plugin) GetEventsGuests(eventIds []string) (map[string][]EventGuest, error) {
+	guests := map[string][]EventGuest{}
+	if len(eventIds) == 0 {
+		return guests, nil
+	}
+
+	queryBuilder := sq.Select("event", "email", "name", "partstat").
+		From("calendar_guests").
+		Where(sq.Eq{"event": eventIds}).
+		OrderBy("email").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("SQL build error: %w", err)
+	}
+
+	var rows []EventGuest
+	if err = p.DB.Select(&rows, querySql, args...); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+
+	for _, row := range rows {
+		guests[row.Event] = append(guests[row.Event], row)
+	}
+
+	return guests, nil
+}
+
+// SyncEventGuests makes the guests of the event match the given ones. New guests get
+// NEEDS-ACTION, the others keep their answer and get the given name.
+func (p *Plugin) SyncEventGuests(eventId string, guests []EventGuest) ([]EventGuest, []EventGuest, error) {
+	current, err := p.GetEventsGuests([]string{eventId})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := map[string]EventGuest{}
+	for _, guest := range current[eventId] {
+		existing[guest.Email] = guest
+	}
+	listed := map[string]bool{}
+	for _, guest := range guests {
+		listed[guest.Email] = true
+	}
+
+	var added, removed, renamed []EventGuest
+	for _, guest := range guests {
+		previous, ok := existing[guest.Email]
+		if !ok {
+			guest.Event = eventId
+			guest.PartStat = string(ics.ParticipationStatusNeedsAction)
+			added = append(added, guest)
+		} else if previous.Name != guest.Name {
+			previous.Name = guest.Name
+			renamed = append(renamed, previous)
+		}
+	}
+	for _, guest := range current[eventId] {
+		if !listed[guest.Email] {
+			removed = append(removed, guest)
+		}
+	}
+
+	if len(removed) > 0 {
+		emails := make([]string, 0, len(removed))
+		for _, guest := range removed {
+			emails = append(emails, guest.Email)
+		}
+
+		deleteSql, deleteArgs, err := sq.Delete("calendar_guests").
+			Where(sq.Eq{"event": eventId, "email": emails}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+		if err != nil {
+			return nil, nil, fmt.Errorf("SQL build error: %w", err)
+		}
+		if _, err = p.DB.Exec(deleteSql, deleteArgs...); err != nil {
+			return nil, nil, fmt.Errorf("delete error: %w", err)
+		}
+	}
+
+	for _, guest := range renamed {
+		updateSql, updateArgs, err := sq.Update("calendar_guests").
+			Set("name", guest.Name).
+			Where(sq.Eq{"event": eventId, "email": guest.Email}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+		if err != nil {
+			return nil, nil, fmt.Errorf("SQL build error: %w", err)
+		}
+		if _, err = p.DB.Exec(updateSql, updateArgs...); err != nil {
+			return nil, nil, fmt.Errorf("update error: %w", err)
+		}
+	}
+
+	if len(added) > 0 {
+		insertBuilder := sq.Insert("calendar_guests").Columns("event", "email", "name", "partstat")
+		for _, guest := range added {
+			insertBuilder = insertBuilder.Values(eventId, guest.Email, guest.Name, guest.PartStat)
+		}
+
+		insertSql, insertArgs, err := insertBuilder.PlaceholderFormat(p.GetDBPlaceholderFormat()).ToSql()
+		if err != nil {
+			return nil, nil, fmt.Errorf("SQL build error: %w", err)
+		}
+		if _, err = p.DB.Exec(insertSql, insertArgs...); err != nil {
+			return nil, nil, fmt.Errorf("insert error: %w", err)
+		}
+	}
+
+	return added, removed, nil
+}
+
+// SetGuestPartStat stores the answer of a guest and touches the event, so the organizer's
+// clients see it on the next sync
+func (p *Plugin) SetGuestPartStat(eventId, email, partStat string) error {
+	updateSql, updateArgs, err := sq.Update("calendar_guests").
+		Set("partstat", partStat).
+		Where(sq.Eq{"event": eventId, "email": email}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("SQL build error: %w", err)
+	}
+
+	result, err := p.DB.Exec(updateSql, updateArgs...)
+	if err != nil {
+		return fmt.Errorf("update error: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("%s is not a guest of event %s", email, eventId)
+	}
+
+	return p.TouchEvent(eventId)
+}
+
+// getStoredEvent returns an event without its attendees and calendar data
+func (p *Plugin) getStoredEvent(eventId string) (*Event, error) {
+	querySql, args, _ := sq.Select(eventListColumns...).
+		From("calendar_events ce").
+		Where(sq.Eq{"ce.id": eventId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+
+	var event Event
+	if err := p.DB.Get(&event, querySql, args...); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// invitationChanged reports whether the attendees have to get the invitation again
+func invitationChanged(previous, event *Event) bool {
+	return !previous.Start.Equal(event.Start) || !previous.End.Equal(event.End) || previous.AllDay != event.AllDay ||
+		previous.Title != event.Title || previous.Recurrence != event.Recurrence
+}
+
+// saveEventGuests stores the guests of a created or updated event and queues their invitations:
+// a REQUEST for the new guests, and for every guest when the event changed, a CANCEL for the
+// removed ones. previous is nil for a new event. Guests is nil when the request didn't list them,
+// the guests of the event are kept.
+func (p *Plugin) saveEventGuests(event *Event, previous *Event) {
+	changed := previous != nil && invitationChanged(previous, event)
+
+	if event.Guests == nil {
+		if !changed || !p.getConfiguration().invitationsEnabled() {
+			return
+		}
+		guests, err := p.GetEventsGuests([]string{event.Id})
+		if err != nil {
+			p.API.LogError("saveEventGuests: " + err.Error())
+			return
+		}
+		event.Guests = guests[event.Id]
+		p.enqueueInvitations(event, ics.MethodRequest, event.Guests)
+		return
+	}
+
+	added, removed, err := p.SyncEventGuests(event.Id, event.Guests)
+	if err != nil {
+		p.API.LogError("saveEventGuests: " + err.Error())
+		return
+	}
+	if previous == nil {
+		event.Guests = append([]EventGuest{}, added...)
+	} else {
+		guests, errGuests := p.GetEventsGuests([]string{event.Id})
+		if errGuests != nil {
+			p.API.LogError("saveEventGuests: " + errGuests.Error())
+			return
+		}
+		event.Guests = append([]EventGuest{}, guests[event.Id]...)
+	}
+	if !p.getConfiguration().invitationsEnabled() {
+		return
+	}
+
+	var recipients []EventGuest
+	for _, guest := range event.Guests {
+		if changed || containsGuest(added, guest.Email) {
+			recipients = append(recipients, guest)
+		}
+	}
+	p.enqueueInvitations(event, ics.MethodRequest, recipients)
+
+	if len(removed) > 0 {
+		cancelled := *event
+		cancelled.Guests = removed
+		p.enqueueInvitations(&cancelled, ics.MethodCancel, removed)
+	}
+}
+
+// removedEventGuests loads an event about to be removed with its guests for the cancellations,
+// nil when there is nobody to send them to
+func (p *Plugin) removedEventGuests(eventId string) *Event {
+	if !p.getConfiguration().invitationsEnabled() {
+		return nil
+	}
+
+	guests, err := p.GetEventsGuests([]string{eventId})
+	if err != nil {
+		p.API.LogError("removedEventGuests: " + err.Error())
+		return nil
+	}
+	if len(guests[eventId]) == 0 {
+		return nil
+	}
+
+	event, err := p.getStoredEvent(eventId)
+	if err != nil {
+		p.API.LogWarn("Can't load the removed event for its guests", "event", eventId, "error", err.Error())
+		return nil
+	}
+	event.Guests = guests[eventId]
+	return event
+}
+
+func containsGuest(guests []EventGuest, email string) bool {
+	for _, guest := range guests {
+		if guest.Email == email {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var eventGuestColumns = []string{"event", "email", "name", "partstat"}
+
+func expectEventGuests(dbMock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT event, email, name, partstat FROM calendar_guests WHERE event IN ($1) ORDER BY email")).
+		WillReturnRows(rows)
+}
+
+func TestNormalizeGuests(t *testing.T) {
+	assert := assert.New(t)
+
+	guests, err := normalizeGuests(nil)
+	assert.Nil(err)
+	assert.Nil(guests)
+
+	guests, err = normalizeGuests([]EventGuest{})
+	assert.Nil(err)
+	assert.Equal([]EventGuest{}, guests)
+
+	guests, err = normalizeGuests([]EventGuest{
+		{Email: " Bob Customer <Bob@Customer.example> ", PartStat: "ACCEPTED"},
+		{Email: "carol@supplier.example", Name: " Carol "},
+		{Email: "BOB@customer.example", Name: "Robert"},
+	})
+	assert.Nil(err)
+	assert.Equal([]EventGuest{
+		{Email: "bob@customer.example", Name: "Bob Customer"},
+		{Email: "carol@supplier.example", Name: "Carol"},
+	}, guests)
+
+	_, err = normalizeGuests([]EventGuest{{Email: "not an address"}})
+	assert.NotNil(err)
+}
+
+func TestSyncEventGuests(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+
+	expectEventGuests(dbMock, sqlmock.NewRows(eventGuestColumns).
+		AddRow("event-1", "bob@customer.example", "Bob", "ACCEPTED").
+		AddRow("event-1", "dave@customer.example", "Dave", "NEEDS-ACTION"))
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_guests WHERE email IN ($1) AND event = $2")).
+		WithArgs("dave@customer.example", "event-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_guests SET name = $1 WHERE email = $2 AND event = $3")).
+		WithArgs("Bob Customer", "bob@customer.example", "event-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_guests (event,email,name,partstat) VALUES ($1,$2,$3,$4)")).
+		WithArgs("event-1", "carol@supplier.example", "Carol", "NEEDS-ACTION").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	added, removed, err := calPlugin.SyncEventGuests("event-1", []EventGuest{
+		{Email: "bob@customer.example", Name: "Bob Customer"},
+		{Email: "carol@supplier.example", Name: "Carol"},
+	})
+	assert.Nil(err)
+	assert.Equal([]EventGuest{{Event: "event-1", Email: "carol@supplier.example", Name: "Carol", PartStat: "NEEDS-ACTION"}}, added)
+	assert.Equal([]EventGuest{{Event: "event-1", Email: "dave@customer.example", Name: "Dave", PartStat: "NEEDS-ACTION"}}, removed)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestSaveEventGuests_WithoutSMTP(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+
+	expectEventGuests(dbMock, sqlmock.NewRows(eventGuestColumns))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_guests")).
+		WithArgs("event-1", "bob@customer.example", "", "NEEDS-ACTION").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	event := &Event{Id: "event-1", Owner: "test-user", Guests: []EventGuest{{Email: "bob@customer.example"}}}
+	calPlugin.saveEventGuests(event, nil)
+
+	// stored, no email is queued
+	assert.Equal([]EventGuest{{Event: "event-1", Email: "bob@customer.example", PartStat: "NEEDS-ACTION"}}, event.Guests)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestSaveEventGuests_Rescheduled(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{SMTPServer: "127.0.0.1", InvitationFromAddress: "calendar@example.com"})
+
+	created := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	previous := &Event{
+		Id:      "event-1",
+		Title:   "Contract review",
+		Start:   time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC),
+		End:     time.Date(2024, 3, 5, 11, 0, 0, 0, time.UTC),
+		Created: created,
+		Owner:   "test-user",
+	}
+	event := *previous
+	event.Start = event.Start.Add(time.Hour)
+	event.End = event.End.Add(time.Hour)
+
+	// the guests aren't listed, they all get the new time
+	expectEventGuests(dbMock, sqlmock.NewRows(eventGuestColumns).
+		AddRow("event-1", "bob@customer.example", "Bob", "ACCEPTED").
+		AddRow("event-1", "carol@supplier.example", "", "DECLINED"))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_guest_messages (id,event_id,email,method,message,status,next_attempt,last_error,created) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9),($10,")).
+		WithArgs(
+			sqlmock.AnyArg(), "event-1", "bob@customer.example", "REQUEST", sqlmock.AnyArg(), "pending", sqlmock.AnyArg(), "", sqlmock.AnyArg(),
+			sqlmock.AnyArg(), "event-1", "carol@supplier.example", "REQUEST", sqlmock.AnyArg(), "pending", sqlmock.AnyArg(), "", sqlmock.AnyArg(),
+		).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	calPlugin.saveEventGuests(&event, previous)
+
+	// only the description changed, nothing is sent
+	unchanged := *previous
+	unchanged.Description = "Draft attached"
+	calPlugin.saveEventGuests(&unchanged, previous)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestSaveEventGuests_AddedAndRemoved(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{SMTPServer: "127.0.0.1", InvitationFromAddress: "calendar@example.com"})
+
+	previous := &Event{
+		Id:      "event-1",
+		Title:   "Contract review",
+		Start:   time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC),
+		End:     time.Date(2024, 3, 5, 11, 0, 0, 0, time.UTC),
+		Created: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC),
+		Owner:   "test-user",
+	}
+	event := *previous
+	event.Guests = []EventGuest{{Email: "bob@customer.example", Name: "Bob"}, {Email: "carol@supplier.example"}}
+
+	expectEventGuests(dbMock, sqlmock.NewRows(eventGuestColumns).
+		AddRow("event-1", "bob@customer.example", "Bob", "ACCEPTED").
+		AddRow("event-1", "dave@customer.example", "", "NEEDS-ACTION"))
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_guests")).
+		WithArgs("dave@customer.example", "event-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_guests")).
+		WithArgs("event-1", "carol@supplier.example", "", "NEEDS-ACTION").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEventGuests(dbMock, sqlmock.NewRows(eventGuestColumns).
+		AddRow("event-1", "bob@customer.example", "Bob", "ACCEPTED").
+		AddRow("event-1", "carol@supplier.example", "", "NEEDS-ACTION"))
+	// the invitation to the new guest, Bob already has it
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_guest_messages")).
+		WithArgs(sqlmock.AnyArg(), "event-1", "carol@supplier.example", "REQUEST", sqlmock.AnyArg(), "pending", sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_guest_messages")).
+		WithArgs(sqlmock.AnyArg(), "event-1", "dave@customer.example", "CANCEL", sqlmock.AnyArg(), "pending", sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.saveEventGuests(&event, previous)
+
+	assert.Len(event.Guests, 2)
+	assert.Equal("ACCEPTED", event.Guests[0].PartStat)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
@@ -2,24 +2,188 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	ics "github.com/arran4/golang-ical"
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost-server/v6/model"
-	"github.com/teambition/rrule-go"
 )
 
-// ICalToken represents a user's iCal subscription token
+// The scopes of the iCal tokens, CalDAV tokens also serve the feed
+const (
+	ICalTokenScopeFeed   = "feed"
+	ICalTokenScopeCalDAV = "caldav"
+)
+
+const (
+	maxICalTokensPerUser = 20
+	maxICalTokenLabel    = 64
+	maxUserAgentSize     = 255
+	maxIPSize            = 64
+
+	// icalTokenPrefixSize is the part of a token stored in clear to look it up
+	icalTokenPrefixSize = 8
+	// icalTokenAccessLogSize is the number of accesses kept per token
+	icalTokenAccessLogSize = 100
+)
+
+// ICalToken represents one of the iCal subscription tokens of a user. The token without a label is
+// the default one managed by /ical/token. Only a salted hash of the token is stored.
 type ICalToken struct {
-	Token         string     `json:"token" db:"token"`
+	Id            string     `json:"id" db:"id"`
+	TokenPrefix   string     `json:"-" db:"token_prefix"`
+	TokenSalt     string     `json:"-" db:"token_salt"`
+	TokenHash     string     `json:"-" db:"token_hash"`
 	UserID        string     `json:"user_id" db:"user_id"`
+	Label         string     `json:"label" db:"label"`
+	Scope         string     `json:"scope" db:"scope"`
+	Expires       *time.Time `json:"expires" db:"expires"`
 	Created       time.Time  `json:"created" db:"created"`
 	LastUsed      *time.Time `json:"last_used" db:"last_used"`
-	CalendarColor *string    `json:"calendar_color" db:"calendar_color"`
+	LastUsedAgent string     `json:"last_used_agent" db:"last_used_agent"`
+	Disabled      *time.Time `json:"disabled" db:"disabled"`
+	CalendarColor *string    `json:"-" db:"calendar_color"`
+}
+
+var icalTokenColumns = []string{
+	"id",
+	"token_prefix",
+	"token_salt",
+	"token_hash",
+	"user_id",
+	"label",
+	"scope",
+	"expires",
+	"created",
+	"last_used",
+	"last_used_agent",
+	"disabled",
+	"calendar_color",
+}
+
+// ICalTokenAccess is a request authenticated by an iCal token
+type ICalTokenAccess struct {
+	Id        string    `json:"id" db:"id"`
+	TokenId   string    `json:"token_id" db:"token_id"`
+	IP        string    `json:"ip" db:"ip"`
+	UserAgent string    `json:"user_agent" db:"user_agent"`
+	Accessed  time.Time `json:"accessed" db:"accessed"`
+}
+
+// hashICalToken returns the hex SHA-256 of the salted token. Tokens are 256 random bits, a slow
+// hash wouldn't make them harder to guess.
+func hashICalToken(salt, token string) string {
+	sum := sha256.Sum256([]byte(salt + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTokenSecret returns the lookup prefix, a new salt and the salted hash of the token
+func newTokenSecret(token string) (prefix, salt, hash string, err error) {
+	saltBytes := make([]byte, 16)
+	if _, err = rand.Read(saltBytes); err != nil {
+		return "", "", "", err
+	}
+	salt = hex.EncodeToString(saltBytes)
+	return token[:icalTokenPrefixSize], salt, hashICalToken(salt, token), nil
+}
+
+// tokenMatches compares the token to the stored hash in constant time
+func tokenMatches(salt, hash, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashICalToken(salt, token)), []byte(hash)) == 1
+}
+
+// setSecret stores the lookup prefix and the salted hash of the token
+func (t *ICalToken) setSecret(token string) error {
+	var err error
+	t.TokenPrefix, t.TokenSalt, t.TokenHash, err = newTokenSecret(token)
+	return err
+}
+
+// matches compares the token to the stored hash in constant time
+func (t *ICalToken) matches(token string) bool {
+	return tokenMatches(t.TokenSalt, t.TokenHash, token)
+}
+
+// inactive reports whether the token wasn't used for the days, never when days is 0
+func (t *ICalToken) inactive(now time.Time, days int) bool {
+	if days <= 0 {
+		return false
+	}
+	lastActivity := t.Created
+	if t.LastUsed != nil {
+		lastActivity = *t.LastUsed
+	}
+	return now.Sub(lastActivity) > time.Duration(days)*24*time.Hour
+}
+
+// trustedProxy reports whether the address is one of the proxies in front of the Mattermost
+// server, listed as addresses or CIDR ranges
+func (c *configuration) trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range strings.Split(c.TrustedProxyIPs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if trusted := net.ParseIP(entry); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIP returns the address of the client. X-Forwarded-For and X-Real-Ip are only read when
+// the request comes from a trusted proxy, anybody could send them otherwise.
+func (c *configuration) requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if c.trustedProxy(net.ParseIP(ip)) {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// the last proxies appended their client, the first address that isn't one of ours is
+			// the client
+			hops := strings.Split(forwarded, ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip = strings.TrimSpace(hops[i])
+				if !c.trustedProxy(net.ParseIP(ip)) {
+					break
+				}
+			}
+		} else if realIP := r.Header.Get("X-Real-Ip"); realIP != "" {
+			ip = strings.TrimSpace(realIP)
+		}
+	}
+	if len(ip) > maxIPSize {
+		ip = ip[:maxIPSize]
+	}
+	return ip
+}
+
+// expired reports whether the token can't be used anymore
+func (t *ICalToken) expired(now time.Time) bool {
+	return t.Expires != nil && !now.Before(*t.Expires)
+}
+
+// allows reports whether the token can be used for the scope
+func (t *ICalToken) allows(scope string) bool {
+	return t.Scope == ICalTokenScopeCalDAV || t.Scope == scope
 }
 
 // ICalTokenResponse is the response format for iCal token API
@@ -30,35 +194,24 @@ type ICalTokenResponse struct {
 	Enabled   bool   `json:"enabled"`
 }
 
-var (
-	ICalTokenNotFound = &model.AppError{
-		Id:         "ical_token_not_found",
-		Message:    "iCal token not found",
-		StatusCode: 404,
-		Where:      PluginId,
-	}
-
-	CantCreateICalToken = &model.AppError{
-		Id:         "cant_create_ical_token",
-		Message:    "Can't create iCal token",
-		StatusCode: 500,
-		Where:      PluginId,
-	}
+// CreateICalTokenRequest is the body of a new named token
+type CreateICalTokenRequest struct {
+	Label   string     `json:"label"`
+	Scope   string     `json:"scope"`
+	Expires *time.Time `json:"expires"`
+}
 
-	CantRevokeICalToken = &model.AppError{
-		Id:         "cant_revoke_ical_token",
-		Message:    "Can't revoke iCal token",
-		StatusCode: 500,
-		Where:      PluginId,
-	}
+// CreatedICalTokenResponse is a new named token, the only time the token is returned
+type CreatedICalTokenResponse struct {
+	ICalToken
+	Token     string `json:"token"`
+	URL       string `json:"url"`
+	CalDAVURL string `json:"caldavUrl,omitempty"`
 
-	InvalidICalToken = &model.AppError{
-		Id:         "invalid_ical_token",
-		Message:    "Invalid iCal token",
-		StatusCode: 401,
-		Where:      PluginId,
-	}
-)
+	// CalDAVServer and Username sign in with the token as app password, out of the URLs
+	CalDAVServer string `json:"caldavServer,omitempty"`
+	Username     string `json:"username,omitempty"`
+}
 
 // generateSecureToken generates a cryptographically secure 64-character hex token
 func generateSecureToken() (string, error) {
@@ -69,7 +222,142 @@ func generateSecureToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// GetICalToken returns the existing iCal token for the authenticated user
+// icalTokenURLs returns the feed URL of the token, and its CalDAV URL for CalDAV tokens
+func (p *Plugin) icalTokenURLs(token, scope string) (string, string) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil || *siteURL == "" {
+		return "", ""
+	}
+
+	icalURL := *siteURL + "/plugins/" + PluginId + "/ical/feed/" + token
+	caldavURL := ""
+	if scope == ICalTokenScopeCalDAV {
+		caldavURL = *siteURL + "/plugins/" + PluginId + "/caldav/" + token + "/"
+	}
+	return icalURL, caldavURL
+}
+
+// authenticateICalToken returns the token of a feed or CalDAV request if it is valid for the
+// scope, and records its use
+func (p *Plugin) authenticateICalToken(token string, r *http.Request, scope string) (*ICalToken, error) {
+	queryBuilder := sq.Select(icalTokenColumns...).
+		From("calendar_ical_tokens").
+		Where(sq.Eq{"token_prefix": token[:icalTokenPrefixSize]}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, sqlErr := queryBuilder.ToSql()
+	if sqlErr != nil {
+		return nil, sqlErr
+	}
+
+	candidates := []ICalToken{}
+	if err := p.DB.Select(&candidates, querySql, args...); err != nil {
+		return nil, err
+	}
+
+	var icalToken *ICalToken
+	for i := range candidates {
+		if candidates[i].matches(token) {
+			icalToken = &candidates[i]
+		}
+	}
+	if icalToken == nil {
+		return nil, errors.New("token not found")
+	}
+
+	now := time.Now().UTC()
+	if icalToken.Disabled != nil {
+		return nil, errors.New("token disabled")
+	}
+	if icalToken.expired(now) {
+		return nil, errors.New("token expired")
+	}
+	if icalToken.inactive(now, p.getConfiguration().ICalTokenInactiveDays) {
+		p.disableICalToken(icalToken.Id, now)
+		return nil, errors.New("token disabled after inactivity")
+	}
+	if !icalToken.allows(scope) {
+		return nil, fmt.Errorf("token scope %s doesn't allow %s", icalToken.Scope, scope)
+	}
+
+	access := ICalTokenAccess{
+		Id:        model.NewId(),
+		TokenId:   icalToken.Id,
+		IP:        p.getConfiguration().requestIP(r),
+		UserAgent: r.UserAgent(),
+		Accessed:  now,
+	}
+	if len(access.UserAgent) > maxUserAgentSize {
+		access.UserAgent = access.UserAgent[:maxUserAgentSize]
+	}
+	go p.recordICalTokenAccess(&access)
+
+	return icalToken, nil
+}
+
+// disableICalToken disables a token that wasn't used for too long
+func (p *Plugin) disableICalToken(tokenId string, now time.Time) {
+	updateBuilder := sq.Update("calendar_ical_tokens").
+		Set("disabled", now).
+		Where(sq.Eq{"id": tokenId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	updateSql, updateArgs, _ := updateBuilder.ToSql()
+
+	if _, errUpdate := p.DB.Exec(updateSql, updateArgs...); errUpdate != nil {
+		p.API.LogError("disableICalToken: " + errUpdate.Error())
+		return
+	}
+	p.API.LogInfo("iCal token disabled after inactivity", "token", tokenId)
+}
+
+// recordICalTokenAccess updates the last use of the token and adds the access to its log, keeping
+// the last icalTokenAccessLogSize
+func (p *Plugin) recordICalTokenAccess(access *ICalTokenAccess) {
+	updateBuilder := sq.Update("calendar_ical_tokens").
+		Set("last_used", access.Accessed).
+		Set("last_used_agent", access.UserAgent).
+		Where(sq.Eq{"id": access.TokenId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	updateSql, updateArgs, _ := updateBuilder.ToSql()
+	_, _ = p.DB.Exec(updateSql, updateArgs...)
+
+	insertBuilder := sq.Insert("calendar_ical_token_access").
+		Columns("id", "token_id", "ip", "user_agent", "accessed").
+		Values(access.Id, access.TokenId, access.IP, access.UserAgent, access.Accessed).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	insertSql, insertArgs, _ := insertBuilder.ToSql()
+	// the access log is best effort, as the last use
+	if _, errInsert := p.DB.Exec(insertSql, insertArgs...); errInsert != nil {
+		return
+	}
+
+	// the oldest access kept
+	oldestBuilder := sq.Select("accessed").
+		From("calendar_ical_token_access").
+		Where(sq.Eq{"token_id": access.TokenId}).
+		OrderBy("accessed DESC").
+		Limit(1).
+		Offset(icalTokenAccessLogSize - 1).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	oldestSql, oldestArgs, _ := oldestBuilder.ToSql()
+
+	var oldest time.Time
+	if errSelect := p.DB.Get(&oldest, oldestSql, oldestArgs...); errSelect != nil {
+		return
+	}
+
+	deleteBuilder := sq.Delete("calendar_ical_token_access").
+		Where(sq.And{
+			sq.Eq{"token_id": access.TokenId},
+			sq.Lt{"accessed": oldest},
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
+	_, _ = p.DB.Exec(deleteSql, deleteArgs...)
+}
+
+// GetICalToken reports whether the authenticated user has a default iCal token. Only its hash is
+// stored, the token and its URLs are returned once by GenerateICalToken.
 func (p *Plugin) GetICalToken(w http.ResponseWriter, r *http.Request) {
 	pluginContext := p.FromContext(r.Context())
 	session, err := p.API.GetSession(pluginContext.SessionId)
@@ -79,9 +367,9 @@ func (p *Plugin) GetICalToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
+	queryBuilder := sq.Select(icalTokenColumns...).
 		From("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(p.GetDBPlaceholderFormat())
 
 	querySql, args, sqlErr := queryBuilder.ToSql()
@@ -101,23 +389,13 @@ func (p *Plugin) GetICalToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
-	icalURL := ""
-	caldavURL := ""
-	if siteURL != nil && *siteURL != "" {
-		icalURL = *siteURL + "/plugins/" + PluginId + "/ical/feed/" + token.Token
-		caldavURL = *siteURL + "/plugins/" + PluginId + "/caldav/" + token.Token + "/"
-	}
-
 	apiResponse(w, &ICalTokenResponse{
-		Token:     token.Token,
-		URL:       icalURL,
-		CalDAVURL: caldavURL,
-		Enabled:   true,
+		Enabled: true,
 	})
 }
 
-// GenerateICalToken creates a new iCal token for the authenticated user
+// GenerateICalToken replaces the default iCal token of the authenticated user, the named tokens
+// are kept
 func (p *Plugin) GenerateICalToken(w http.ResponseWriter, r *http.Request) {
 	pluginContext := p.FromContext(r.Context())
 	session, err := p.API.GetSession(pluginContext.SessionId)
@@ -137,15 +415,27 @@ func (p *Plugin) GenerateICalToken(w http.ResponseWriter, r *http.Request) {
 
 	// Delete existing token if any
 	deleteBuilder := sq.Delete("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(p.GetDBPlaceholderFormat())
 	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
 	_, _ = p.DB.Exec(deleteSql, deleteArgs...)
 
+	token := ICalToken{
+		Id:      model.NewId(),
+		UserID:  session.UserId,
+		Scope:   ICalTokenScopeCalDAV,
+		Created: time.Now().UTC(),
+	}
+	if secretErr := token.setSecret(newToken); secretErr != nil {
+		p.API.LogError("GenerateICalToken: can't hash token: " + secretErr.Error())
+		errorResponse(w, CantCreateICalToken)
+		return
+	}
+
 	// Insert new token
 	insertBuilder := sq.Insert("calendar_ical_tokens").
-		Columns("token", "user_id", "created").
-		Values(newToken, session.UserId, time.Now().UTC()).
+		Columns("id", "token_prefix", "token_salt", "token_hash", "user_id", "scope", "created").
+		Values(token.Id, token.TokenPrefix, token.TokenSalt, token.TokenHash, token.UserID, token.Scope, token.Created).
 		PlaceholderFormat(p.GetDBPlaceholderFormat())
 
 	insertSql, insertArgs, sqlErr := insertBuilder.ToSql()
@@ -162,13 +452,7 @@ func (p *Plugin) GenerateICalToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
-	icalURL := ""
-	caldavURL := ""
-	if siteURL != nil && *siteURL != "" {
-		icalURL = *siteURL + "/plugins/" + PluginId + "/ical/feed/" + newToken
-		caldavURL = *siteURL + "/plugins/" + PluginId + "/caldav/" + newToken + "/"
-	}
+	icalURL, caldavURL := p.icalTokenURLs(newToken, ICalTokenScopeCalDAV)
 
 	apiResponse(w, &ICalTokenResponse{
 		Token:     newToken,
@@ -178,7 +462,7 @@ func (p *Plugin) GenerateICalToken(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// RevokeICalToken removes the iCal token for the authenticated user
+// RevokeICalToken removes the default iCal token for the authenticated user
 func (p *Plugin) RevokeICalToken(w http.ResponseWriter, r *http.Request) {
 	pluginContext := p.FromContext(r.Context())
 	session, err := p.API.GetSession(pluginContext.SessionId)
@@ -189,7 +473,7 @@ func (p *Plugin) RevokeICalToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	deleteBuilder := sq.Delete("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(p.GetDBPlaceholderFormat())
 
 	deleteSql, deleteArgs, sqlErr := deleteBuilder.ToSql()
@@ -211,8 +495,208 @@ func (p *Plugin) RevokeICalToken(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// GetICalTokens returns every iCal token of the authenticated user, without the tokens themselves
+func (p *Plugin) GetICalTokens(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	queryBuilder := sq.Select(icalTokenColumns...).
+		From("calendar_ical_tokens").
+		Where(sq.Eq{"user_id": user.Id}).
+		OrderBy("created").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	tokens := []ICalToken{}
+	if errSelect := p.DB.Select(&tokens, querySql, args...); errSelect != nil {
+		p.API.LogError("GetICalTokens: " + errSelect.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	apiResponse(w, &tokens)
+}
+
+// CreateICalToken creates a named token for one device or app, next to the other tokens
+func (p *Plugin) CreateICalToken(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	var request CreateICalTokenRequest
+	if errDecode := json.NewDecoder(r.Body).Decode(&request); errDecode != nil {
+		p.API.LogError(errDecode.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	if request.Scope == "" {
+		request.Scope = ICalTokenScopeFeed
+	}
+	now := time.Now().UTC()
+	if request.Label == "" || len(request.Label) > maxICalTokenLabel ||
+		(request.Scope != ICalTokenScopeFeed && request.Scope != ICalTokenScopeCalDAV) ||
+		(request.Expires != nil && !request.Expires.After(now)) {
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	countBuilder := sq.Select("COUNT(*)").
+		From("calendar_ical_tokens").
+		Where(sq.Eq{"user_id": user.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	countSql, countArgs, _ := countBuilder.ToSql()
+
+	var count int
+	if errCount := p.DB.Get(&count, countSql, countArgs...); errCount != nil {
+		p.API.LogError("CreateICalToken: " + errCount.Error())
+		errorResponse(w, CantCreateICalToken)
+		return
+	}
+	if count >= maxICalTokensPerUser {
+		errorResponse(w, TooManyICalTokens)
+		return
+	}
+
+	newToken, tokenErr := generateSecureToken()
+	if tokenErr != nil {
+		p.API.LogError("CreateICalToken: can't generate token: " + tokenErr.Error())
+		errorResponse(w, CantCreateICalToken)
+		return
+	}
+
+	token := ICalToken{
+		Id:      model.NewId(),
+		UserID:  user.Id,
+		Label:   request.Label,
+		Scope:   request.Scope,
+		Expires: request.Expires,
+		Created: now,
+	}
+	if token.Expires != nil {
+		expires := token.Expires.UTC()
+		token.Expires = &expires
+	}
+	if secretErr := token.setSecret(newToken); secretErr != nil {
+		p.API.LogError("CreateICalToken: can't hash token: " + secretErr.Error())
+		errorResponse(w, CantCreateICalToken)
+		return
+	}
+
+	insertBuilder := sq.Insert("calendar_ical_tokens").
+		Columns("id", "token_prefix", "token_salt", "token_hash", "user_id", "label", "scope", "expires", "created").
+		Values(token.Id, token.TokenPrefix, token.TokenSalt, token.TokenHash, token.UserID, token.Label, token.Scope, token.Expires, token.Created).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	insertSql, insertArgs, _ := insertBuilder.ToSql()
+
+	if _, insertErr := p.DB.Exec(insertSql, insertArgs...); insertErr != nil {
+		p.API.LogError("CreateICalToken: can't insert token: " + insertErr.Error())
+		errorResponse(w, CantCreateICalToken)
+		return
+	}
+
+	icalURL, caldavURL := p.icalTokenURLs(newToken, token.Scope)
+	response := &CreatedICalTokenResponse{
+		ICalToken: token,
+		Token:     newToken,
+		URL:       icalURL,
+		CalDAVURL: caldavURL,
+	}
+	if caldavURL != "" {
+		response.CalDAVServer = strings.TrimSuffix(caldavURL, newToken+"/")
+		response.Username = user.Username
+	}
+
+	apiResponse(w, response)
+}
+
+// RevokeICalTokenById removes one of the iCal tokens of the authenticated user
+func (p *Plugin) RevokeICalTokenById(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	deleteBuilder := sq.Delete("calendar_ical_tokens").
+		Where(sq.Eq{"id": mux.Vars(r)["tokenId"], "user_id": user.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
+
+	result, deleteErr := p.DB.Exec(deleteSql, deleteArgs...)
+	if deleteErr != nil {
+		p.API.LogError("RevokeICalTokenById: can't delete token: " + deleteErr.Error())
+		errorResponse(w, CantRevokeICalToken)
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		errorResponse(w, ICalTokenNotFound)
+		return
+	}
+
+	accessBuilder := sq.Delete("calendar_ical_token_access").
+		Where(sq.Eq{"token_id": mux.Vars(r)["tokenId"]}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	accessSql, accessArgs, _ := accessBuilder.ToSql()
+	_, _ = p.DB.Exec(accessSql, accessArgs...)
+
+	apiResponse(w, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// GetICalTokenAccess returns the last accesses with one of the iCal tokens of the authenticated user
+func (p *Plugin) GetICalTokenAccess(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+	tokenId := mux.Vars(r)["tokenId"]
+
+	countBuilder := sq.Select("COUNT(*)").
+		From("calendar_ical_tokens").
+		Where(sq.Eq{"id": tokenId, "user_id": user.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	countSql, countArgs, _ := countBuilder.ToSql()
+
+	var count int
+	if errCount := p.DB.Get(&count, countSql, countArgs...); errCount != nil {
+		p.API.LogError("GetICalTokenAccess: " + errCount.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+	if count == 0 {
+		errorResponse(w, ICalTokenNotFound)
+		return
+	}
+
+	queryBuilder := sq.Select("id", "token_id", "ip", "user_agent", "accessed").
+		From("calendar_ical_token_access").
+		Where(sq.Eq{"token_id": tokenId}).
+		OrderBy("accessed DESC").
+		Limit(icalTokenAccessLogSize).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	accesses := []ICalTokenAccess{}
+	if errSelect := p.DB.Select(&accesses, querySql, args...); errSelect != nil {
+		p.API.LogError("GetICalTokenAccess: " + errSelect.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	apiResponse(w, &accesses)
+}
+
 // ServeICalFeed serves the iCal feed for external calendar applications
-// This endpoint is public and authenticated via the token in the URL
+// This endpoint is public and authenticated via the token in the URL, the query parameters of
+// ICalFeedOptions select the events
 func (p *Plugin) ServeICalFeed(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	token := vars["token"]
@@ -222,37 +706,19 @@ func (p *Plugin) ServeICalFeed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Look up the token and get the user ID
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
-		From("calendar_ical_tokens").
-		Where(sq.Eq{"token": token}).
-		PlaceholderFormat(p.GetDBPlaceholderFormat())
-
-	querySql, args, sqlErr := queryBuilder.ToSql()
-	if sqlErr != nil {
-		p.API.LogError("ServeICalFeed: SQL build error: " + sqlErr.Error())
-		errorResponse(w, SomethingWentWrong)
+	options, ok := parseICalFeedOptions(r)
+	if !ok {
+		errorResponse(w, InvalidRequestParams)
 		return
 	}
 
-	var icalToken ICalToken
-	err := p.DB.Get(&icalToken, querySql, args...)
+	icalToken, err := p.authenticateICalToken(token, r, ICalTokenScopeFeed)
 	if err != nil {
-		p.API.LogError("ServeICalFeed: token not found: " + err.Error())
+		p.API.LogError("ServeICalFeed: " + err.Error())
 		errorResponse(w, InvalidICalToken)
 		return
 	}
 
-	// Update last_used timestamp
-	go func() {
-		updateBuilder := sq.Update("calendar_ical_tokens").
-			Set("last_used", time.Now().UTC()).
-			Where(sq.Eq{"token": token}).
-			PlaceholderFormat(p.GetDBPlaceholderFormat())
-		updateSql, updateArgs, _ := updateBuilder.ToSql()
-		_, _ = p.DB.Exec(updateSql, updateArgs...)
-	}()
-
 	// Get user to verify they still exist
 	user, userErr := p.API.GetUser(icalToken.UserID)
 	if userErr != nil {
@@ -261,35 +727,51 @@ func (p *Plugin) ServeICalFeed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get events for the user (past 30 days to future 365 days)
+	// the feed is rendered once until an event is written
 	now := time.Now().UTC()
-	start := now.AddDate(0, -1, 0) // 1 month ago
-	end := now.AddDate(1, 0, 0)    // 1 year from now
+	cacheKey := "user:" + icalToken.UserID + "?" + r.URL.Query().Encode()
+	if feed := p.feedCache.get(cacheKey, now); feed != nil {
+		writeFeed(w, r, feed)
+		return
+	}
+	generation := p.feedCache.currentGeneration()
+
+	// Get events for the user (1 month back to 1 year ahead unless the options tell otherwise)
+	start, end := options.window(now)
 
 	userLoc := p.GetUserLocation(user)
-	events, eventsErr := p.GetUserEventsForICalUTC(icalToken.UserID, userLoc, start, end)
+	events, eventsErr := p.GetUserEventsForICalUTC(icalToken.UserID, userLoc, start, end, options.filters(icalToken.UserID)...)
 	if eventsErr != nil {
 		p.API.LogError("ServeICalFeed: can't get events: " + eventsErr.Error())
 		errorResponse(w, SomethingWentWrong)
 		return
 	}
 
-	// Generate iCalendar content
-	icalContent := p.generateICalendar(events, user)
+	feed := &renderedFeed{rendered: now}
+	feed.etag, feed.lastModified = feedValidators(events, cacheKey)
+	if notModified(r, feed.etag, feed.lastModified) {
+		writeFeed(w, r, feed)
+		return
+	}
 
-	// Set proper headers for iCalendar file
-	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
-	w.Header().Set("Content-Disposition", "attachment; filename=\"calendar.ics\"")
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(icalContent))
+	// Generate iCalendar content, without the organizer when only busy times are published
+	if options.BusyOnly {
+		feed.body = []byte(p.generateICalendar(busyEvents(events), nil))
+	} else {
+		feed.body = []byte(p.generateICalendar(events, user))
+	}
+	p.feedCache.put(cacheKey, feed, generation)
+
+	writeFeed(w, r, feed)
 }
 
-// GetUserEventsForICalUTC returns user events without expanding RRULE (keeps recurrence rules intact)
+// GetUserEventsForICalUTC returns user events without expanding RRULE (keeps recurrence rules intact),
+// the filters narrow them down
 func (p *Plugin) GetUserEventsForICalUTC(
 	userId string,
 	userLocation *time.Location,
 	start, end time.Time,
+	filters ...sq.Sqlizer,
 ) ([]Event, *model.AppError) {
 	var events []Event
 
@@ -304,9 +786,10 @@ func (p *Plugin) GetUserEventsForICalUTC(
 				sq.GtOrEq{"ce.dt_start": start},
 				sq.LtOrEq{"ce.dt_start": end},
 			},
-			sq.Eq{"ce.recurrent": true},
+			recurringSince(start.Add(-allDayMargin)),
 		},
 	}
+	conditions = append(conditions, filters...)
 
 	queryBuilder := sq.Select().
 		Columns(
@@ -315,6 +798,8 @@ func (p *Plugin) GetUserEventsForICalUTC(
 			"ce.description",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -326,6 +811,7 @@ func (p *Plugin) GetUserEventsForICalUTC(
 			"ce.visibility",
 			"ce.alert",
 			"ce.alert_time",
+			"ce.ical_data",
 		).
 		From("calendar_events ce").
 		LeftJoin("calendar_members cm ON ce.id = cm.event").
@@ -396,8 +882,7 @@ func (p *Plugin) generateICalendar(events []Event, user *model.User) string {
 		icsEvent.SetDtStampTime(event.Created)
 		icsEvent.SetCreatedTime(event.Created)
 		icsEvent.SetModifiedAt(event.Created)
-		icsEvent.SetStartAt(event.Start)
-		icsEvent.SetEndAt(event.End)
+		setEventTiming(icsEvent, &event)
 		icsEvent.SetSummary(event.Title)
 
 		if event.Description != "" {
@@ -409,17 +894,11 @@ func (p *Plugin) generateICalendar(events []Event, user *model.User) string {
 			icsEvent.SetOrganizer(user.Email, ics.WithCN(user.GetDisplayName("")))
 		}
 
-		// Add RRULE for recurrent events
+		// Add RRULE, EXRULE, RDATE and EXDATE for recurrent events
 		if event.Recurrent && event.Recurrence != "" {
-			// Parse and validate the RRULE
-			_, rruleErr := rrule.StrToRRule(event.Recurrence)
-			if rruleErr == nil {
-				// Add RRULE property - remove "RRULE:" prefix if present
-				rruleStr := event.Recurrence
-				if len(rruleStr) > 6 && rruleStr[:6] == "RRULE:" {
-					rruleStr = rruleStr[6:]
-				}
-				icsEvent.AddRrule(rruleStr)
+			// Skip recurrences that don't parse
+			if _, recurrenceErr := normalizeRecurrence(event.Recurrence); recurrenceErr == nil {
+				addRecurrenceProperties(&icsEvent.ComponentBase, event.Recurrence)
 			}
 		}
 
@@ -437,6 +916,8 @@ func (p *Plugin) generateICalendar(events []Event, user *model.User) string {
 		icsEvent.SetStatus(ics.ObjectStatusConfirmed)
 	}
 
+	addTimezones(cal)
+
 	return cal.Serialize()
 }
 
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+const (
+	maxICalFeedDays     = 5 * 365
+	maxICalFeedChannels = 50
+
+	// icalBusyTitle replaces the titles of the events of a busy only feed
+	icalBusyTitle = "Busy"
+)
+
+// ICalFeedOptions are the query parameters of an iCal feed
+type ICalFeedOptions struct {
+	// PastDays and FutureDays are the range of the feed around now, one month back to one year
+	// ahead by default
+	PastDays   int
+	FutureDays int
+	// OnlyMine leaves out the channel and team events the user doesn't attend
+	OnlyMine bool
+	// Channels keeps the events of these channels
+	Channels []string
+	// BusyOnly replaces the titles by "Busy" and hides the descriptions, to publish the feed
+	BusyOnly bool
+}
+
+// parseICalFeedOptions reads the options of the feed request, false when one is invalid
+func parseICalFeedOptions(r *http.Request) (*ICalFeedOptions, bool) {
+	query := r.URL.Query()
+	options := &ICalFeedOptions{PastDays: -1, FutureDays: -1}
+
+	for name, days := range map[string]*int{"past_days": &options.PastDays, "future_days": &options.FutureDays} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 || parsed > maxICalFeedDays {
+				return nil, false
+			}
+			*days = parsed
+		}
+	}
+
+	for name, flag := range map[string]*bool{"only_mine": &options.OnlyMine, "busy": &options.BusyOnly} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, false
+			}
+			*flag = parsed
+		}
+	}
+
+	if channels := query.Get("channels"); channels != "" {
+		for _, channelId := range strings.Split(channels, ",") {
+			channelId = strings.TrimSpace(channelId)
+			if !model.IsValidId(channelId) {
+				return nil, false
+			}
+			options.Channels = append(options.Channels, channelId)
+		}
+		if len(options.Channels) > maxICalFeedChannels {
+			return nil, false
+		}
+	}
+
+	return options, true
+}
+
+// window returns the range of the feed around now
+func (o *ICalFeedOptions) window(now time.Time) (time.Time, time.Time) {
+	start := now.AddDate(0, -1, 0)
+	if o.PastDays >= 0 {
+		start = now.AddDate(0, 0, -o.PastDays)
+	}
+	end := now.AddDate(1, 0, 0)
+	if o.FutureDays >= 0 {
+		end = now.AddDate(0, 0, o.FutureDays)
+	}
+	return start, end
+}
+
+// filters returns the conditions of GetUserEventsForICalUTC selecting the events of the options
+func (o *ICalFeedOptions) filters(userId string) []sq.Sqlizer {
+	var filters []sq.Sqlizer
+	if o.OnlyMine {
+		filters = append(filters, sq.Or{
+			sq.Eq{"cm.member": userId},
+			sq.Eq{"ce.owner": userId},
+		})
+	}
+	if len(o.Channels) > 0 {
+		filters = append(filters, sq.Eq{"ce.channel": o.Channels})
+	}
+	return filters
+}
+
+// busyEvents returns the events with nothing but their times and recurrence
+func busyEvents(events []Event) []Event {
+	busy := make([]Event, 0, len(events))
+	for _, event := range events {
+		event.Title = icalBusyTitle
+		event.Description = ""
+		busy = append(busy, event)
+	}
+	return busy
+}
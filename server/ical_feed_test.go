@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseICalFeedOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/ical/feed/token", nil)
+	options, ok := parseICalFeedOptions(r)
+	assert.True(ok)
+	assert.Equal(&ICalFeedOptions{PastDays: -1, FutureDays: -1}, options)
+
+	channelId := "pa5qxfwfgtnwxjbq7z5yh9x3ac"
+	r = httptest.NewRequest(http.MethodGet, "/ical/feed/token?past_days=0&future_days=90&only_mine=true&busy=1&channels="+channelId, nil)
+	options, ok = parseICalFeedOptions(r)
+	assert.True(ok)
+	assert.Equal(&ICalFeedOptions{PastDays: 0, FutureDays: 90, OnlyMine: true, Channels: []string{channelId}, BusyOnly: true}, options)
+
+	for _, query := range []string{
+		"past_days=-1",
+		"future_days=5000",
+		"future_days=year",
+		"busy=sometimes",
+		"channels=town-square",
+	} {
+		r = httptest.NewRequest(http.MethodGet, "/ical/feed/token?"+query, nil)
+		_, ok = parseICalFeedOptions(r)
+		assert.False(ok, query)
+	}
+}
+
+func TestICalFeedOptionsWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+
+	start, end := (&ICalFeedOptions{PastDays: -1, FutureDays: -1}).window(now)
+	assert.Equal(time.Date(2024, 2, 20, 9, 0, 0, 0, time.UTC), start)
+	assert.Equal(time.Date(2025, 3, 20, 9, 0, 0, 0, time.UTC), end)
+
+	start, end = (&ICalFeedOptions{PastDays: 0, FutureDays: 14}).window(now)
+	assert.Equal(now, start)
+	assert.Equal(time.Date(2024, 4, 3, 9, 0, 0, 0, time.UTC), end)
+}
+
+func TestICalFeedOptionsFilters(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty((&ICalFeedOptions{}).filters("test-user"))
+
+	options := &ICalFeedOptions{OnlyMine: true, Channels: []string{"channel-1", "channel-2"}}
+	querySql, args, err := sq.And(options.filters("test-user")).ToSql()
+	assert.Nil(err)
+	assert.Equal("((cm.member = ? OR ce.owner = ?) AND ce.channel IN (?,?))", querySql)
+	assert.Equal([]interface{}{"test-user", "test-user", "channel-1", "channel-2"}, args)
+}
+
+func TestBusyEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	events := []Event{{Id: "event-1", Title: "1:1 with Alice", Description: "Salary review"}}
+	busy := busyEvents(events)
+
+	assert.Equal("Busy", busy[0].Title)
+	assert.Empty(busy[0].Description)
+	assert.Equal("event-1", busy[0].Id)
+	// the events of the caller are left as they were
+	assert.Equal("1:1 with Alice", events[0].Title)
+}
+
+func TestServeICalFeed_BusyOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	path := "/ical/feed/" + tokenValue
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+
+	prefix, salt, hash := hashedICalToken(tokenValue)
+	now := time.Now().UTC()
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_ical_tokens WHERE token_prefix = $1")).
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_prefix", "token_salt", "token_hash", "user_id", "scope", "created"}).
+			AddRow("token-1", prefix, salt, hash, "test-user", ICalTokenScopeFeed, now))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm ON ce.id = cm.event WHERE") +
+		".*" + regexp.QuoteMeta("AND (cm.member = $8 OR ce.owner = $9))")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "dt_start", "dt_end", "created", "owner", "visibility"}).
+			AddRow("event-1", "1:1 with Alice", "Salary review", now, now.Add(time.Hour), now, "test-user", "private"))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ChannelId FROM ChannelMembers")).
+		WillReturnRows(sqlmock.NewRows([]string{"ChannelId"}))
+	dbMock.MatchExpectationsInOrder(false)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path+"?only_mine=true&busy=true", nil)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(body, "SUMMARY:Busy")
+	assert.NotContains(body, "Alice")
+	assert.NotContains(body, "Salary")
+	assert.NotContains(body, "ORGANIZER")
+}
+
+func TestServeICalFeed_InvalidOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	path := "/ical/feed/" + tokenValue
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path+"?future_days=forever", nil)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
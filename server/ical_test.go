@@ -18,6 +18,12 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// hashedICalToken returns the prefix, salt and hash stored for the token
+func hashedICalToken(token string) (string, string, string) {
+	salt := "00112233445566778899aabbccddeeff"
+	return token[:icalTokenPrefixSize], salt, hashICalToken(salt, token)
+}
+
 func TestGenerateSecureToken(t *testing.T) {
 	assert := assert.New(t)
 
@@ -109,14 +115,14 @@ func TestGetICalToken_NotFound(t *testing.T) {
 	dbx := sqlx.NewDb(db, "sqlmock")
 
 	// Mock query for token - return empty result
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
+	queryBuilder := sq.Select(icalTokenColumns...).
 		From("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(sq.Dollar)
 
 	querySql, _, _ := queryBuilder.ToSql()
 	dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(session.UserId).
+		WithArgs("", session.UserId).
 		WillReturnRows(sqlmock.NewRows([]string{"token", "user_id", "created", "last_used", "calendar_color"}))
 
 	calPlugin := Plugin{
@@ -159,14 +165,6 @@ func TestGetICalToken_Found(t *testing.T) {
 	}
 	api.On("GetSession", ctx.SessionId).Return(session, nil)
 
-	siteURL := "https://mattermost.example.com"
-	config := &model.Config{
-		ServiceSettings: model.ServiceSettings{
-			SiteURL: &siteURL,
-		},
-	}
-	api.On("GetConfig").Return(config)
-
 	// DB mocks
 	db, dbMock, err := sqlmock.New()
 	if err != nil {
@@ -178,18 +176,19 @@ func TestGetICalToken_Found(t *testing.T) {
 
 	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
 	createdTime := time.Now().UTC()
+	prefix, salt, hash := hashedICalToken(tokenValue)
 
 	// Mock query for token - return existing token
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
+	queryBuilder := sq.Select(icalTokenColumns...).
 		From("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(sq.Dollar)
 
 	querySql, _, _ := queryBuilder.ToSql()
 	dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(session.UserId).
-		WillReturnRows(sqlmock.NewRows([]string{"token", "user_id", "created", "last_used", "calendar_color"}).
-			AddRow(tokenValue, session.UserId, createdTime, nil, "#1E90FFFF"))
+		WithArgs("", session.UserId).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_prefix", "token_salt", "token_hash", "user_id", "created", "calendar_color"}).
+			AddRow("token-1", prefix, salt, hash, session.UserId, createdTime, "#1E90FFFF"))
 
 	calPlugin := Plugin{
 		MattermostPlugin: plugin.MattermostPlugin{
@@ -213,10 +212,8 @@ func TestGetICalToken_Found(t *testing.T) {
 
 	assert.Equal(http.StatusOK, result.StatusCode)
 
-	expectedURL := siteURL + "/plugins/" + PluginId + "/ical/feed/" + tokenValue
-	expectedCalDAVURL := siteURL + "/plugins/" + PluginId + "/caldav/" + tokenValue + "/"
-	expectedJSON := `{"data":{"token":"` + tokenValue + `","url":"` + expectedURL + `","caldavUrl":"` + expectedCalDAVURL + `","enabled":true}}`
-	assert.JSONEq(expectedJSON, string(bodyBytes))
+	// only the hash of the token is stored, it can't be returned again
+	assert.JSONEq(`{"data":{"enabled":true}}`, string(bodyBytes))
 
 	api.AssertExpectations(t)
 }
@@ -254,16 +251,16 @@ func TestGenerateICalToken(t *testing.T) {
 
 	// Mock delete query (delete existing token)
 	deleteBuilder := sq.Delete("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(sq.Dollar)
 	deleteSql, _, _ := deleteBuilder.ToSql()
 	dbMock.ExpectExec(regexp.QuoteMeta(deleteSql)).
-		WithArgs(session.UserId).
+		WithArgs("", session.UserId).
 		WillReturnResult(sqlmock.NewResult(0, 0))
 
 	// Mock insert query
 	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_ical_tokens")).
-		WithArgs(sqlmock.AnyArg(), session.UserId, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), session.UserId, ICalTokenScopeCalDAV, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	calPlugin := Plugin{
@@ -323,11 +320,11 @@ func TestRevokeICalToken(t *testing.T) {
 
 	// Mock delete query
 	deleteBuilder := sq.Delete("calendar_ical_tokens").
-		Where(sq.Eq{"user_id": session.UserId}).
+		Where(sq.Eq{"user_id": session.UserId, "label": ""}).
 		PlaceholderFormat(sq.Dollar)
 	deleteSql, _, _ := deleteBuilder.ToSql()
 	dbMock.ExpectExec(regexp.QuoteMeta(deleteSql)).
-		WithArgs(session.UserId).
+		WithArgs("", session.UserId).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	calPlugin := Plugin{
@@ -389,7 +386,7 @@ func TestServeICalFeed_TokenNotFound(t *testing.T) {
 
 	api := plugintest.API{}
 	api.On("LogDebug", "Plugin HTTP request", "method", "GET", "path", "/ical/feed/"+tokenValue, "user-agent", "").Return()
-	api.On("LogError", "ServeICalFeed: token not found: sql: no rows in result set").Return()
+	api.On("LogError", "ServeICalFeed: token not found").Return()
 
 	// DB mocks
 	db, dbMock, err := sqlmock.New()
@@ -401,15 +398,15 @@ func TestServeICalFeed_TokenNotFound(t *testing.T) {
 	dbx := sqlx.NewDb(db, "sqlmock")
 
 	// Mock query for token - return empty result
-	queryBuilder := sq.Select("token", "user_id", "created", "last_used", "calendar_color").
+	queryBuilder := sq.Select(icalTokenColumns...).
 		From("calendar_ical_tokens").
-		Where(sq.Eq{"token": tokenValue}).
+		Where(sq.Eq{"token_prefix": tokenValue[:icalTokenPrefixSize]}).
 		PlaceholderFormat(sq.Dollar)
 
 	querySql, _, _ := queryBuilder.ToSql()
 	dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
-		WithArgs(tokenValue).
-		WillReturnRows(sqlmock.NewRows([]string{"token", "user_id", "created", "last_used", "calendar_color"}))
+		WithArgs(tokenValue[:icalTokenPrefixSize]).
+		WillReturnRows(sqlmock.NewRows(icalTokenColumns))
 
 	calPlugin := Plugin{
 		MattermostPlugin: plugin.MattermostPlugin{
@@ -475,6 +472,16 @@ func TestGenerateICalendar(t *testing.T) {
 		},
 	}
 
+	events = append(events, Event{
+		Id:      "event-3",
+		Title:   "Holiday",
+		Start:   time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		End:     time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC),
+		AllDay:  true,
+		Created: now,
+		Owner:   user.Id,
+	})
+
 	icalContent := calPlugin.generateICalendar(events, user)
 
 	// Check iCalendar structure
@@ -503,9 +510,13 @@ func TestGenerateICalendar(t *testing.T) {
 	assert.Contains(icalContent, "ORGANIZER")
 	assert.Contains(icalContent, user.Email)
 
-	// Count events (should have 2)
+	// All-day events use DATE values
+	assert.Contains(icalContent, "DTSTART;VALUE=DATE:20240501")
+	assert.Contains(icalContent, "DTEND;VALUE=DATE:20240503")
+
+	// Count events (should have 3)
 	eventCount := strings.Count(icalContent, "BEGIN:VEVENT")
-	assert.Equal(2, eventCount)
+	assert.Equal(3, eventCount)
 }
 
 func TestGetICalToken_NotAuthorized(t *testing.T) {
@@ -540,3 +551,311 @@ func TestGetICalToken_NotAuthorized(t *testing.T) {
 
 	api.AssertExpectations(t)
 }
+
+func TestCreateICalToken(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/ical/tokens"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, path)
+	defer closeDB()
+	siteURL := "https://mattermost.example.com"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM calendar_ical_tokens WHERE user_id = $1")).
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	expires := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_ical_tokens (id,token_prefix,token_salt,token_hash,user_id,label,scope,expires,created) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "test-user", "Wall display", ICalTokenScopeFeed, &expires, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"label":"Wall display","expires":"2099-01-01T00:00:00Z"}`))
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(body, `"label":"Wall display"`)
+	assert.Contains(body, `"scope":"feed"`)
+	assert.Contains(body, `"url":"`+siteURL+`/plugins/`+PluginId+`/ical/feed/`)
+	// feed tokens can't be used for CalDAV
+	assert.NotContains(body, "caldavUrl")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCreateICalToken_Invalid(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/ical/tokens"
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, path)
+	defer closeDB()
+
+	for _, body := range []string{
+		`{"scope":"feed"}`,
+		`{"label":"Phone","scope":"admin"}`,
+		`{"label":"Phone","expires":"2001-01-01T00:00:00Z"}`,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+		assert.Equal(http.StatusBadRequest, w.Code, body)
+	}
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM calendar_ical_tokens WHERE user_id = $1")).
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(maxICalTokensPerUser))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"label":"Phone","scope":"caldav"}`))
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), "too_many_ical_tokens")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetICalTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/ical/tokens"
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+
+	created := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_ical_tokens WHERE user_id = $1 ORDER BY created")).
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows(icalTokenColumns).
+			AddRow("token-1", "abcd1234", "salt", "secret", "test-user", "", ICalTokenScopeCalDAV, nil, created, created, "DAVx5", nil, nil))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"last_used_agent":"DAVx5"`)
+	assert.NotContains(w.Body.String(), "secret")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRevokeICalTokenById(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/ical/tokens/token-1"
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodDelete, path)
+	defer closeDB()
+
+	deleteSql := regexp.QuoteMeta("DELETE FROM calendar_ical_tokens WHERE id = $1 AND user_id = $2")
+	dbMock.ExpectExec(deleteSql).WithArgs("token-1", "test-user").WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_ical_token_access WHERE token_id = $1")).
+		WithArgs("token-1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	dbMock.ExpectExec(deleteSql).WithArgs("token-1", "test-user").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, code := range []int{http.StatusOK, http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodDelete, path, nil)
+		calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+		assert.Equal(code, w.Code)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestICalTokenSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	var token ICalToken
+	assert.Nil(token.setSecret(tokenValue))
+
+	assert.Equal("abcd1234", token.TokenPrefix)
+	assert.Len(token.TokenSalt, 32)
+	assert.NotContains(token.TokenHash, tokenValue[icalTokenPrefixSize:])
+	assert.True(token.matches(tokenValue))
+	assert.False(token.matches("abcd1234" + tokenValue[icalTokenPrefixSize:len(tokenValue)-1] + "0"))
+
+	// the same token gets another salt and hash
+	var other ICalToken
+	assert.Nil(other.setSecret(tokenValue))
+	assert.NotEqual(token.TokenHash, other.TokenHash)
+	assert.True(other.matches(tokenValue))
+}
+
+func TestICalTokenInactive(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 3, 31, 9, 0, 0, 0, time.UTC)
+	lastUsed := now.AddDate(0, 0, -10)
+	token := ICalToken{Created: now.AddDate(0, 0, -100), LastUsed: &lastUsed}
+
+	assert.False(token.inactive(now, 0))
+	assert.False(token.inactive(now, 30))
+	assert.True(token.inactive(now, 7))
+
+	// tokens never used count from their creation
+	token.LastUsed = nil
+	assert.True(token.inactive(now, 30))
+}
+
+func TestRequestIP(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &configuration{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	assert.Equal("10.0.0.1", config.requestIP(r))
+
+	// the headers are ignored without trusted proxies
+	r.Header.Set("X-Real-Ip", "192.0.2.7")
+	assert.Equal("10.0.0.1", config.requestIP(r))
+	r.Header.Set("X-Forwarded-For", "198.51.100.4, 10.0.0.2")
+	assert.Equal("10.0.0.1", config.requestIP(r))
+
+	config.TrustedProxyIPs = "10.0.0.0/24, 172.16.0.9"
+	assert.Equal("198.51.100.4", config.requestIP(r))
+
+	// the first hop could be made up by the client, the last one our proxy didn't add is used
+	r.Header.Set("X-Forwarded-For", "203.0.113.66, 198.51.100.4, 10.0.0.2")
+	assert.Equal("198.51.100.4", config.requestIP(r))
+
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal("192.0.2.7", config.requestIP(r))
+
+	// a request that doesn't come from a proxy
+	r.RemoteAddr = "192.0.2.99:4321"
+	assert.Equal("192.0.2.99", config.requestIP(r))
+}
+
+func TestAuthenticateICalToken(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{})
+
+	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	prefix, salt, hash := hashedICalToken(tokenValue)
+	selectSql := regexp.QuoteMeta("FROM calendar_ical_tokens WHERE token_prefix = $1")
+	columns := []string{"id", "token_prefix", "token_salt", "token_hash", "user_id", "scope", "created", "expires", "disabled"}
+	now := time.Now().UTC()
+	past := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// another token with the same prefix doesn't match
+	dbMock.ExpectQuery(selectSql).
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("token-0", prefix, salt, hashICalToken(salt, "other"), "other-user", ICalTokenScopeCalDAV, now, nil, nil))
+	dbMock.ExpectQuery(selectSql).
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("token-1", prefix, salt, hash, "test-user", ICalTokenScopeCalDAV, now, past, nil))
+	dbMock.ExpectQuery(selectSql).
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("token-2", prefix, salt, hash, "test-user", ICalTokenScopeFeed, now, nil, nil))
+	dbMock.ExpectQuery(selectSql).
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("token-3", prefix, salt, hash, "test-user", ICalTokenScopeFeed, now, nil, past))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := calPlugin.authenticateICalToken(tokenValue, r, ICalTokenScopeFeed)
+	assert.EqualError(err, "token not found")
+
+	_, err = calPlugin.authenticateICalToken(tokenValue, r, ICalTokenScopeFeed)
+	assert.EqualError(err, "token expired")
+
+	_, err = calPlugin.authenticateICalToken(tokenValue, r, ICalTokenScopeCalDAV)
+	assert.EqualError(err, "token scope feed doesn't allow caldav")
+
+	_, err = calPlugin.authenticateICalToken(tokenValue, r, ICalTokenScopeFeed)
+	assert.EqualError(err, "token disabled")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestAuthenticateICalToken_Inactive(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	api.On("LogInfo", "iCal token disabled after inactivity", "token", "token-1").Return()
+	calPlugin.setConfiguration(&configuration{ICalTokenInactiveDays: 30})
+
+	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	prefix, salt, hash := hashedICalToken(tokenValue)
+	lastUsed := time.Now().UTC().AddDate(0, 0, -31)
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_ical_tokens WHERE token_prefix = $1")).
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_prefix", "token_salt", "token_hash", "user_id", "scope", "created", "last_used"}).
+			AddRow("token-1", prefix, salt, hash, "test-user", ICalTokenScopeCalDAV, lastUsed.AddDate(0, -1, 0), lastUsed))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_ical_tokens SET disabled = $1 WHERE id = $2")).
+		WithArgs(sqlmock.AnyArg(), "token-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := calPlugin.authenticateICalToken(tokenValue, r, ICalTokenScopeCalDAV)
+
+	assert.EqualError(err, "token disabled after inactivity")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRecordICalTokenAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+
+	accessed := time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+	oldest := accessed.Add(-24 * time.Hour)
+	access := &ICalTokenAccess{Id: "access-1", TokenId: "token-1", IP: "192.0.2.7", UserAgent: "DAVx5", Accessed: accessed}
+
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_ical_tokens SET last_used = $1, last_used_agent = $2 WHERE id = $3")).
+		WithArgs(accessed, "DAVx5", "token-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_ical_token_access (id,token_id,ip,user_agent,accessed) VALUES ($1,$2,$3,$4,$5)")).
+		WithArgs("access-1", "token-1", "192.0.2.7", "DAVx5", accessed).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT accessed FROM calendar_ical_token_access WHERE token_id = $1 ORDER BY accessed DESC LIMIT 1 OFFSET 99")).
+		WithArgs("token-1").
+		WillReturnRows(sqlmock.NewRows([]string{"accessed"}).AddRow(oldest))
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_ical_token_access WHERE (token_id = $1 AND accessed < $2)")).
+		WithArgs("token-1", oldest).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.recordICalTokenAccess(access)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetICalTokenAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/ical/tokens/token-1/access"
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+
+	countSql := regexp.QuoteMeta("SELECT COUNT(*) FROM calendar_ical_tokens WHERE id = $1 AND user_id = $2")
+	accessed := time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(countSql).
+		WithArgs("token-1", "test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_ical_token_access WHERE token_id = $1 ORDER BY accessed DESC LIMIT 100")).
+		WithArgs("token-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_id", "ip", "user_agent", "accessed"}).
+			AddRow("access-1", "token-1", "192.0.2.7", "DAVx5", accessed))
+	dbMock.ExpectQuery(countSql).
+		WithArgs("token-1", "test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"ip":"192.0.2.7"`)
+
+	// tokens of other users aren't found
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
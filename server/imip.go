@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	ics "github.com/arran4/golang-ical"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+const (
+	GuestMessagePending = "pending"
+	GuestMessageSent    = "sent"
+	GuestMessageFailed  = "failed"
+
+	// InvitationReplySecretHeader carries the invitation reply secret. Mattermost removes the
+	// Authorization header from the requests to plugins, this one is passed through.
+	InvitationReplySecretHeader = "X-Calendar-Reply-Secret"
+
+	smtpTimeout            = 30 * time.Second
+	invitationReplyMaxBody = 1 << 20
+)
+
+// GuestMessage is an iMIP email to a guest, the rows are the queue of the background job
+type GuestMessage struct {
+	Id          string     `db:"id"`
+	EventId     string     `db:"event_id"`
+	Email       string     `db:"email"`
+	Method      string     `db:"method"`
+	Message     string     `db:"message"`
+	Status      string     `db:"status"`
+	Attempts    int        `db:"attempts"`
+	NextAttempt time.Time  `db:"next_attempt"`
+	LastError   string     `db:"last_error"`
+	Created     time.Time  `db:"created"`
+	Sent        *time.Time `db:"sent"`
+}
+
+var guestMessageColumns = []string{
+	"id",
+	"event_id",
+	"email",
+	"method",
+	"message",
+	"status",
+	"attempts",
+	"next_attempt",
+	"last_error",
+	"created",
+	"sent",
+}
+
+// invitationsEnabled reports whether invitations are emailed to the guests
+func (c *configuration) invitationsEnabled() bool {
+	return strings.TrimSpace(c.SMTPServer) != "" && strings.TrimSpace(c.InvitationFromAddress) != ""
+}
+
+// enqueueInvitations queues the iMIP email of the event to every recipient, the background job
+// sends them. The guests answer to the reply address when it's configured, to the organizer
+// otherwise.
+func (p *Plugin) enqueueInvitations(event *Event, method ics.Method, recipients []EventGuest) {
+	if len(recipients) == 0 {
+		return
+	}
+	config := p.getConfiguration()
+
+	owner, appErr := p.API.GetUser(event.Owner)
+	if appErr != nil {
+		p.API.LogError("enqueueInvitations: " + appErr.Error())
+		return
+	}
+
+	events := []Event{*event}
+	p.AttachEventMembers(events)
+	invitation := &events[0]
+
+	now := time.Now().UTC()
+	organizerEmail := owner.Email
+	if replyAddress := strings.TrimSpace(config.InvitationReplyAddress); replyAddress != "" {
+		organizerEmail = replyAddress
+	}
+
+	cal := NewCalDAVBackend(p, owner.Id, "", "").eventToICalendar(invitation, owner)
+	cal.SetMethod(method)
+	for _, vevent := range cal.Events() {
+		// the clients of the guests apply the message with the highest sequence, later messages
+		// have a higher one
+		vevent.SetSequence(int(now.Sub(invitation.Created) / time.Second))
+		vevent.SetDtStampTime(now)
+		vevent.SetOrganizer(organizerEmail, ics.WithCN(owner.GetDisplayName(model.ShowFullName)))
+		if method == ics.MethodCancel {
+			vevent.SetStatus(ics.ObjectStatusCancelled)
+		}
+		components := vevent.Components[:0]
+		for _, component := range vevent.Components {
+			if _, alarm := component.(*ics.VAlarm); !alarm {
+				components = append(components, component)
+			}
+		}
+		vevent.Components = components
+	}
+	data := cal.Serialize()
+
+	insertBuilder := sq.Insert("calendar_guest_messages").
+		Columns("id", "event_id", "email", "method", "message", "status", "next_attempt", "last_error", "created")
+	for _, recipient := range recipients {
+		message := renderInvitationEmail(config, owner.GetDisplayName(model.ShowFullName), organizerEmail, recipient, invitation, method, data)
+		insertBuilder = insertBuilder.Values(model.NewId(), event.Id, recipient.Email, string(method), message, GuestMessagePending, now, "", now)
+	}
+	insertSql, insertArgs, _ := insertBuilder.PlaceholderFormat(p.GetDBPlaceholderFormat()).ToSql()
+
+	if _, errInsert := p.DB.Exec(insertSql, insertArgs...); errInsert != nil {
+		p.API.LogError("enqueueInvitations: can't queue message: " + errInsert.Error())
+	}
+}
+
+// renderInvitationEmail returns the iMIP message (RFC 6047): a text part and the iTIP object,
+// also attached as invite.ics for the clients that don't read the inline one
+func renderInvitationEmail(config *configuration, organizerName, replyTo string, recipient EventGuest, event *Event, method ics.Method, data string) string {
+	var buffer bytes.Buffer
+	mixed := multipart.NewWriter(&buffer)
+
+	subject := "Invitation: " + event.Title
+	text := fmt.Sprintf("%s invited you to %s.\r\n", organizerName, event.Title)
+	if method == ics.MethodCancel {
+		subject = "Cancelled: " + event.Title
+		text = fmt.Sprintf("%s cancelled %s.\r\n", organizerName, event.Title)
+	}
+	when := event.Start.UTC().Format("Monday, January 2, 2006 15:04 MST")
+	if event.AllDay {
+		when = event.Start.Format("Monday, January 2, 2006")
+	}
+	text += "\r\nWhen: " + when + "\r\n"
+	if event.Description != "" {
+		text += "\r\n" + event.Description + "\r\n"
+	}
+
+	from := mail.Address{Name: organizerName, Address: strings.TrimSpace(config.InvitationFromAddress)}
+	to := mail.Address{Name: recipient.Name, Address: recipient.Email}
+	header := []string{
+		"From: " + from.String(),
+		"To: " + to.String(),
+		"Reply-To: " + (&mail.Address{Name: organizerName, Address: replyTo}).String(),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().UTC().Format(time.RFC1123Z),
+		"Message-ID: <" + model.NewId() + "@" + PluginId + ">",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + mixed.Boundary(),
+	}
+
+	var body bytes.Buffer
+	alternative := multipart.NewWriter(&body)
+	textPart, _ := alternative.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	quoted := quotedprintable.NewWriter(textPart)
+	_, _ = quoted.Write([]byte(text))
+	_ = quoted.Close()
+	calendarPart, _ := alternative.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {fmt.Sprintf("text/calendar; charset=utf-8; method=%s", method)},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	_, _ = calendarPart.Write([]byte(wrapBase64(data)))
+	_ = alternative.Close()
+
+	alternativePart, _ := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	_, _ = alternativePart.Write(body.Bytes())
+	attachment, _ := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {fmt.Sprintf("application/ics; name=invite.ics; method=%s", method)},
+		"Content-Disposition":       {"attachment; filename=invite.ics"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	_, _ = attachment.Write([]byte(wrapBase64(data)))
+	_ = mixed.Close()
+
+	return strings.Join(header, "\r\n") + "\r\n\r\n" + buffer.String()
+}
+
+// wrapBase64 encodes the data in lines of 76 characters (RFC 2045)
+func wrapBase64(data string) string {
+	encoded := base64.StdEncoding.EncodeToString([]byte(data))
+	var lines strings.Builder
+	for len(encoded) > 76 {
+		lines.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	lines.WriteString(encoded + "\r\n")
+	return lines.String()
+}
+
+// sendInvitationEmail sends the message through the configured SMTP server. TLS connects with
+// implicit TLS, STARTTLS upgrades the connection and fails when the server doesn't offer it.
+func sendInvitationEmail(config *configuration, message *GuestMessage) error {
+	port := config.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	host := strings.TrimSpace(config.SMTPServer)
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: host}
+
+	var conn net.Conn
+	var err error
+	if config.SMTPConnectionSecurity == "TLS" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpTimeout}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, smtpTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if config.SMTPConnectionSecurity == "STARTTLS" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("the SMTP server doesn't support STARTTLS")
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if config.SMTPUsername != "" {
+		if err = client.Auth(smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, host)); err != nil {
+			return err
+		}
+	}
+
+	from, err := mail.ParseAddress(config.InvitationFromAddress)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+	if err = client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = client.Rcpt(message.Email); err != nil {
+		return err
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = data.Write([]byte(message.Message)); err != nil {
+		return err
+	}
+	if err = data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// pruneGuestMessages removes the sent and failed invitations older than webhookRetention
+func (p *Plugin) pruneGuestMessages(now time.Time) {
+	deleteSql, deleteArgs, _ := sq.Delete("calendar_guest_messages").
+		Where(sq.And{
+			sq.Eq{"status": []string{GuestMessageSent, GuestMessageFailed}},
+			sq.Lt{"created": now.Add(-webhookRetention)},
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+
+	if _, err := p.DB.Exec(deleteSql, deleteArgs...); err != nil {
+		p.API.LogError("pruneGuestMessages: " + err.Error())
+	}
+}
+
+// deliverGuestMessages sends the invitations that are due, retrying failed ones like the webhooks
+func (p *Plugin) deliverGuestMessages(now time.Time) {
+	config := p.getConfiguration()
+	if !config.invitationsEnabled() {
+		return
+	}
+
+	queryBuilder := sq.Select(guestMessageColumns...).
+		From("calendar_guest_messages").
+		Where(sq.And{
+			sq.Eq{"status": GuestMessagePending},
+			sq.LtOrEq{"next_attempt": now},
+		}).
+		OrderBy("next_attempt").
+		Limit(webhookBatchSize).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	messages := []GuestMessage{}
+	if errSelect := p.DB.Select(&messages, querySql, args...); errSelect != nil {
+		p.API.LogError("deliverGuestMessages: " + errSelect.Error())
+		return
+	}
+
+	for i := range messages {
+		message := &messages[i]
+		if !p.claimQueued("calendar_guest_messages", message.Id, now) {
+			continue
+		}
+		errSend := sendInvitationEmail(config, message)
+
+		message.Attempts++
+		message.LastError = ""
+		if errSend == nil {
+			message.Status = GuestMessageSent
+			sent := time.Now().UTC()
+			message.Sent = &sent
+		} else {
+			message.LastError = errSend.Error()
+			if len(message.LastError) > webhookErrorMaxSize {
+				message.LastError = message.LastError[:webhookErrorMaxSize]
+			}
+			if message.Attempts >= webhookMaxAttempts {
+				message.Status = GuestMessageFailed
+				p.API.LogWarn("Invitation email failed", "message", message.Id, "email", message.Email, "error", message.LastError)
+			} else {
+				message.NextAttempt = now.Add(webhookBackoff(message.Attempts))
+			}
+		}
+
+		updateBuilder := sq.Update("calendar_guest_messages").
+			SetMap(map[string]interface{}{
+				"status":       message.Status,
+				"attempts":     message.Attempts,
+				"next_attempt": message.NextAttempt,
+				"last_error":   message.LastError,
+				"sent":         message.Sent,
+			}).
+			Where(sq.Eq{"id": message.Id}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat())
+		updateSql, updateArgs, _ := updateBuilder.ToSql()
+
+		if _, errUpdate := p.DB.Exec(updateSql, updateArgs...); errUpdate != nil {
+			p.API.LogError("deliverGuestMessages: can't update message: " + errUpdate.Error())
+		}
+	}
+}
+
+// HandleInvitationReply takes the REPLY of a guest, forwarded by the mail server of the reply
+// address. The body is the whole email or only its text/calendar part.
+func (p *Plugin) HandleInvitationReply(w http.ResponseWriter, r *http.Request) {
+	config := p.getConfiguration()
+	if config.InvitationReplySecret == "" {
+		errorResponse(w, InvitationRepliesNotConfigured)
+		return
+	}
+
+	// only from the header, URLs end up in the access logs of the proxies
+	secret := r.Header.Get(InvitationReplySecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(config.InvitationReplySecret)) != 1 {
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	body, errRead := io.ReadAll(io.LimitReader(r.Body, invitationReplyMaxBody))
+	if errRead != nil {
+		errorResponse(w, InvalidInvitationReply)
+		return
+	}
+
+	cal, sender, errParse := parseInvitationReply(r.Header.Get("Content-Type"), body)
+	if errParse != nil {
+		p.API.LogWarn("Invalid invitation reply", "error", errParse.Error())
+		errorResponse(w, InvalidInvitationReply)
+		return
+	}
+
+	method := ""
+	for _, property := range cal.CalendarProperties {
+		if property.IANAToken == string(ics.PropertyMethod) {
+			method = strings.ToUpper(property.Value)
+		}
+	}
+	events := cal.Events()
+	if method != string(ics.MethodReply) || len(events) == 0 || len(events[0].Attendees()) == 0 {
+		errorResponse(w, InvalidInvitationReply)
+		return
+	}
+
+	vevent := events[0]
+	attendee := vevent.Attendees()[0]
+	email := calendarAddressEmail(attendee.Value)
+	partStat := strings.ToUpper(string(attendee.ParticipationStatus()))
+	switch ics.ParticipationStatus(partStat) {
+	case ics.ParticipationStatusAccepted, ics.ParticipationStatusDeclined, ics.ParticipationStatusTentative:
+	default:
+		errorResponse(w, InvalidInvitationReply)
+		return
+	}
+	// a guest only answers for themselves
+	if sender != "" && sender != email {
+		errorResponse(w, GuestNotFound)
+		return
+	}
+
+	event, errEvent := p.getStoredEvent(vevent.Id())
+	if errEvent != nil {
+		errorResponse(w, EventNotFound)
+		return
+	}
+
+	guests, errGuests := p.GetEventsGuests([]string{event.Id})
+	if errGuests != nil {
+		p.API.LogError(errGuests.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+	var guest *EventGuest
+	for i := range guests[event.Id] {
+		if guests[event.Id][i].Email == email {
+			guest = &guests[event.Id][i]
+		}
+	}
+	if guest == nil {
+		errorResponse(w, GuestNotFound)
+		return
+	}
+
+	if errSet := p.SetGuestPartStat(event.Id, email, partStat); errSet != nil {
+		p.API.LogError(errSet.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+	guest.PartStat = partStat
+
+	p.RecordEventChange(event.Id, nil)
+	if errDeliver := p.DeliverScheduleMessage(event.Owner, event.Id, ics.MethodReply, cal.Serialize()); errDeliver != nil {
+		p.API.LogError(errDeliver.Error())
+	}
+	p.notifyInvitationReply(event, guest)
+
+	apiResponse(w, guest)
+}
+
+// notifyInvitationReply tells the organizer the answer of the guest in the bot's DM
+func (p *Plugin) notifyInvitationReply(event *Event, guest *EventGuest) {
+	dChannel, dChannelErr := p.API.GetDirectChannel(event.Owner, p.BotId)
+	if dChannelErr != nil {
+		p.API.LogError(dChannelErr.Error())
+		return
+	}
+
+	name := guest.Email
+	if guest.Name != "" {
+		name = fmt.Sprintf("%s (%s)", guest.Name, guest.Email)
+	}
+	answers := map[string]string{
+		string(ics.ParticipationStatusAccepted):  "accepted",
+		string(ics.ParticipationStatusDeclined):  "declined",
+		string(ics.ParticipationStatusTentative): "tentatively accepted",
+	}
+
+	if _, postErr := p.API.CreatePost(&model.Post{
+		UserId:    p.BotId,
+		ChannelId: dChannel.Id,
+		Message:   fmt.Sprintf(":envelope_with_arrow: **%s** %s *%s*", name, answers[guest.PartStat], event.Title),
+	}); postErr != nil {
+		p.API.LogError(postErr.Error())
+	}
+}
+
+// parseInvitationReply returns the calendar of the reply and the address of its sender, "" when
+// the body is only the calendar
+func parseInvitationReply(contentType string, body []byte) (*ics.Calendar, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "text/calendar" || mediaType == "application/ics" {
+		cal, err := ics.ParseCalendar(bytes.NewReader(body))
+		return cal, "", err
+	}
+
+	message, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	from, err := mail.ParseAddress(message.Header.Get("From"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid sender: %w", err)
+	}
+
+	data, err := findCalendarPart(message.Header.Get("Content-Type"), message.Header.Get("Content-Transfer-Encoding"), message.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	cal, err := ics.ParseCalendar(bytes.NewReader(data))
+	return cal, strings.ToLower(from.Address), err
+}
+
+// findCalendarPart returns the decoded text/calendar part of an email, searching the multipart
+// bodies
+func findCalendarPart(contentType, transferEncoding string, body io.Reader) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+
+	switch {
+	case mediaType == "text/calendar" || mediaType == "application/ics":
+		switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+		case "base64":
+			body = base64.NewDecoder(base64.StdEncoding, body)
+		case "quoted-printable":
+			body = quotedprintable.NewReader(body)
+		}
+		return io.ReadAll(body)
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, errPart := reader.NextRawPart()
+			if errPart == io.EOF {
+				break
+			}
+			if errPart != nil {
+				return nil, errPart
+			}
+			data, errFind := findCalendarPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if errFind == nil {
+				return data, nil
+			}
+		}
+	}
+	return nil, errors.New("no text/calendar part found")
+}
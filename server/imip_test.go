@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	ics "github.com/arran4/golang-ical"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// smtpStandIn is a local SMTP server that accepts every message, except the recipients it rejects
+type smtpStandIn struct {
+	listener net.Listener
+	reject   string
+
+	lock     sync.Mutex
+	auth     []string
+	messages []smtpMessage
+}
+
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+func newSMTPStandIn(t *testing.T, reject string) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	server := &smtpStandIn{listener: listener, reject: reject}
+	go func() {
+		for {
+			conn, errAccept := listener.Accept()
+			if errAccept != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (s *smtpStandIn) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP stand-in")
+	message := smtpMessage{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(command, "AUTH PLAIN"):
+			s.lock.Lock()
+			s.auth = append(s.auth, strings.TrimSpace(line[len("AUTH PLAIN"):]))
+			s.lock.Unlock()
+			reply("235 Authenticated")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			message = smtpMessage{From: strings.Trim(line[len("MAIL FROM:"):], "<>")}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			recipient := strings.Trim(line[len("RCPT TO:"):], "<>")
+			if recipient == s.reject {
+				reply("550 No such user")
+				continue
+			}
+			message.To = append(message.To, recipient)
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, errData := reader.ReadString('\n')
+				if errData != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			message.Data = data.String()
+			s.lock.Lock()
+			s.messages = append(s.messages, message)
+			s.lock.Unlock()
+			reply("250 OK queued")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// messageArg captures the email queued for a guest
+type messageArg struct {
+	value *string
+}
+
+func (a messageArg) Match(value driver.Value) bool {
+	message, ok := value.(string)
+	*a.value = message
+	return ok
+}
+
+func TestInvitationsEnabled(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &configuration{SMTPServer: "smtp.example.com"}
+	assert.False(config.invitationsEnabled())
+
+	config.InvitationFromAddress = "Calendar <calendar@example.com>"
+	assert.True(config.invitationsEnabled())
+}
+
+func TestEnqueueInvitations(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	api.On("GetUser", "owner-id").Return(&model.User{Id: "owner-id", Username: "alice", FirstName: "Alice", LastName: "Smith", Email: "alice@example.com"}, nil)
+	calPlugin.setConfiguration(&configuration{
+		SMTPServer:             "127.0.0.1",
+		InvitationFromAddress:  "calendar@example.com",
+		InvitationReplyAddress: "calendar-replies@example.com",
+	})
+
+	event := &Event{
+		Id:      "event-1",
+		Title:   "Contract review",
+		Start:   time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC),
+		End:     time.Date(2024, 3, 5, 11, 0, 0, 0, time.UTC),
+		Created: time.Now().UTC().Add(-10 * time.Minute),
+		Owner:   "owner-id",
+		Alert:   EventAlert15MinutesBefore,
+		Guests:  []EventGuest{{Email: "bob@customer.example", Name: "Bob Customer", PartStat: "NEEDS-ACTION"}},
+	}
+
+	var message string
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_guest_messages")).
+		WithArgs(sqlmock.AnyArg(), "event-1", "bob@customer.example", "REQUEST", messageArg{&message}, "pending", sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.enqueueInvitations(event, ics.MethodRequest, event.Guests)
+	assert.Nil(dbMock.ExpectationsWereMet())
+
+	assert.Contains(message, `From: "Alice Smith" <calendar@example.com>`)
+	assert.Contains(message, `To: "Bob Customer" <bob@customer.example>`)
+	assert.Contains(message, `Reply-To: "Alice Smith" <calendar-replies@example.com>`)
+	assert.Contains(message, "Subject: Invitation: Contract review")
+	assert.Contains(message, "Content-Type: text/calendar; charset=utf-8; method=REQUEST")
+	assert.Contains(message, "Content-Disposition: attachment; filename=invite.ics")
+
+	// the clients of the guests read the inline part
+	cal, sender, err := parseInvitationReply("message/rfc822", []byte(message))
+	assert.Nil(err)
+	assert.Equal("calendar@example.com", sender)
+	data := cal.Serialize()
+	assert.Contains(data, "METHOD:REQUEST")
+	assert.Contains(data, "ORGANIZER;CN=Alice Smith:mailto:calendar-replies@example.com")
+	assert.Contains(data, "mailto:bob@customer.example")
+	assert.Contains(data, "PARTSTAT=NEEDS-ACTION")
+	assert.NotContains(data, "BEGIN:VALARM")
+
+	sequence, errSequence := strconv.Atoi(cal.Events()[0].GetProperty(ics.ComponentPropertySequence).Value)
+	assert.Nil(errSequence)
+	assert.GreaterOrEqual(sequence, 600)
+}
+
+func TestDeliverGuestMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newSMTPStandIn(t, "nobody@customer.example")
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	api.On("LogWarn", "Invitation email failed", "message", "message-3", "email", "nobody@customer.example", "error", mock.Anything).Return()
+	calPlugin.setConfiguration(&configuration{
+		SMTPServer:            "127.0.0.1",
+		SMTPPort:              server.port(),
+		SMTPUsername:          "calendar",
+		SMTPPassword:          "smtp-password",
+		InvitationFromAddress: "Calendar <calendar@example.com>",
+	})
+
+	message := "Subject: Invitation: Contract review\r\n\r\nBEGIN:VCALENDAR\r\n.leading dot\r\n"
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, event_id, email, method, message, status, attempts, next_attempt, last_error, created, sent FROM calendar_guest_messages WHERE (status = $1 AND next_attempt <= $2) ORDER BY next_attempt LIMIT 50")).
+		WithArgs("pending", now).
+		WillReturnRows(sqlmock.NewRows(guestMessageColumns).
+			AddRow("message-1", "event-1", "bob@customer.example", "REQUEST", message, "pending", 0, now, "", now, nil).
+			AddRow("message-2", "event-1", "nobody@customer.example", "REQUEST", message, "pending", 1, now, "", now, nil).
+			AddRow("message-3", "event-1", "nobody@customer.example", "CANCEL", message, "pending", 5, now, "", now, nil).
+			AddRow("message-4", "event-1", "bob@customer.example", "CANCEL", message, "pending", 0, now, "", now, nil))
+
+	claimSql := regexp.QuoteMeta("UPDATE calendar_guest_messages SET next_attempt = $1 WHERE (id = $2 AND status = $3 AND next_attempt <= $4)")
+	updateSql := regexp.QuoteMeta("UPDATE calendar_guest_messages SET attempts = $1, last_error = $2, next_attempt = $3, sent = $4, status = $5 WHERE id = $6")
+	dbMock.ExpectExec(claimSql).
+		WithArgs(now.Add(webhookClaimLease), "message-1", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(updateSql).
+		WithArgs(1, "", now, sqlmock.AnyArg(), "sent", "message-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// retried a minute later after the second failure
+	dbMock.ExpectExec(claimSql).
+		WithArgs(now.Add(webhookClaimLease), "message-2", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(updateSql).
+		WithArgs(2, containsArg("No such user"), now.Add(time.Minute), nil, "pending", "message-2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(claimSql).
+		WithArgs(now.Add(webhookClaimLease), "message-3", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(updateSql).
+		WithArgs(6, containsArg("No such user"), now, nil, "failed", "message-3").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// already claimed by another server, so it is not sent twice
+	dbMock.ExpectExec(claimSql).
+		WithArgs(now.Add(webhookClaimLease), "message-4", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	calPlugin.deliverGuestMessages(now)
+	assert.Nil(dbMock.ExpectationsWereMet())
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	assert.Len(server.messages, 1)
+	assert.Equal("calendar@example.com", server.messages[0].From)
+	assert.Equal([]string{"bob@customer.example"}, server.messages[0].To)
+	assert.Equal(message, server.messages[0].Data)
+	assert.Len(server.auth, 3)
+}
+
+func TestDeliverGuestMessages_NotConfigured(t *testing.T) {
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+
+	calPlugin.deliverGuestMessages(time.Now())
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPruneGuestMessages(t *testing.T) {
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+
+	now := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_guest_messages WHERE (status IN ($1,$2) AND created < $3)")).
+		WithArgs("sent", "failed", now.Add(-webhookRetention)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	calPlugin.pruneGuestMessages(now)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestParseInvitationReply(t *testing.T) {
+	assert := assert.New(t)
+
+	email, _ := os.ReadFile("testdata/imip/reply.eml")
+	cal, sender, err := parseInvitationReply("message/rfc822", email)
+	assert.Nil(err)
+	assert.Equal("bob@customer.example", sender)
+	assert.Equal("event-1", cal.Events()[0].Id())
+	assert.Equal(ics.ParticipationStatusAccepted, cal.Events()[0].Attendees()[0].ParticipationStatus())
+
+	data, _ := os.ReadFile("testdata/imip/reply.ics")
+	cal, sender, err = parseInvitationReply("text/calendar; method=REPLY", data)
+	assert.Nil(err)
+	assert.Equal("", sender)
+	assert.Equal("event-1", cal.Events()[0].Id())
+
+	_, _, err = parseInvitationReply("message/rfc822", []byte("From: bob@customer.example\r\nContent-Type: text/plain\r\n\r\nSee you there\r\n"))
+	assert.NotNil(err)
+}
+
+func newInvitationReplyTestPlugin(t *testing.T) (*Plugin, *plugintest.API, sqlmock.Sqlmock, func()) {
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/imip/reply")
+	api.On("LogWarn", "Invalid invitation reply", "error", mock.Anything).Return().Maybe()
+	calPlugin.setConfiguration(&configuration{InvitationReplySecret: "reply-secret"})
+	calPlugin.BotId = "bot-id"
+	return calPlugin, api, dbMock, closeDB
+}
+
+func expectReplyEvent(dbMock sqlmock.Sqlmock) {
+	created := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce WHERE ce.id = $1")).
+		WithArgs("event-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "dt_start", "dt_end", "created", "updated", "owner"}).
+			AddRow("event-1", "Contract review", time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC), time.Date(2024, 3, 5, 11, 0, 0, 0, time.UTC), created, created, "test-user"))
+}
+
+func TestHandleInvitationReply(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newInvitationReplyTestPlugin(t)
+	defer closeDB()
+	api.On("GetDirectChannel", "test-user", "bot-id").Return(&model.Channel{Id: "dm-id"}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "dm-id" && post.UserId == "bot-id" &&
+			post.Message == ":envelope_with_arrow: **Bob Customer (bob@customer.example)** accepted *Contract review*"
+	})).Return(&model.Post{}, nil)
+
+	expectReplyEvent(dbMock)
+	expectEventGuests(dbMock, sqlmock.NewRows(eventGuestColumns).
+		AddRow("event-1", "bob@customer.example", "Bob Customer", "NEEDS-ACTION"))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_guests SET partstat = $1 WHERE email = $2 AND event = $3")).
+		WithArgs("ACCEPTED", "bob@customer.example", "event-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET updated = $1 WHERE id = $2")).
+		WithArgs(sqlmock.AnyArg(), "event-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectRecordedChange(dbMock, "event-1", false)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_schedule_messages")).
+		WithArgs(sqlmock.AnyArg(), "test-user", "event-1", "REPLY", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	email, _ := os.ReadFile("testdata/imip/reply.eml")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/imip/reply", strings.NewReader(string(email)))
+	r.Header.Set(InvitationReplySecretHeader, "reply-secret")
+	r.Header.Set("Content-Type", "message/rfc822")
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"data":{"email":"bob@customer.example","name":"Bob Customer","status":"ACCEPTED"}}`, w.Body.String())
+	assert.Nil(dbMock.ExpectationsWereMet())
+	api.AssertCalled(t, "CreatePost", mock.Anything)
+}
+
+func TestHandleInvitationReply_Rejected(t *testing.T) {
+	email, _ := os.ReadFile("testdata/imip/reply.eml")
+	forged := strings.Replace(string(email), "From: Bob Customer <Bob@Customer.example>", "From: mallory@attacker.example", 1)
+	data, _ := os.ReadFile("testdata/imip/reply.ics")
+
+	for name, test := range map[string]struct {
+		secret      string
+		query       string
+		contentType string
+		body        string
+		expectDB    func(sqlmock.Sqlmock)
+		status      int
+	}{
+		"wrong secret": {
+			secret: "guess", contentType: "message/rfc822", body: string(email), status: http.StatusUnauthorized,
+		},
+		"secret in the query": {
+			query: "?secret=reply-secret", contentType: "message/rfc822", body: string(email), status: http.StatusUnauthorized,
+		},
+		"not a calendar": {
+			secret: "reply-secret", contentType: "text/plain", body: "See you there", status: http.StatusBadRequest,
+		},
+		"not a reply": {
+			secret: "reply-secret", contentType: "text/calendar", body: strings.Replace(string(data), "METHOD:REPLY", "METHOD:REQUEST", 1), status: http.StatusBadRequest,
+		},
+		"sender isn't the attendee": {
+			secret: "reply-secret", contentType: "message/rfc822", body: forged, status: http.StatusNotFound,
+		},
+		"attendee isn't a guest": {
+			secret: "reply-secret", contentType: "text/calendar", body: string(data), status: http.StatusNotFound,
+			expectDB: func(dbMock sqlmock.Sqlmock) {
+				expectReplyEvent(dbMock)
+				expectEventGuests(dbMock, sqlmock.NewRows(eventGuestColumns).
+					AddRow("event-1", "carol@supplier.example", "", "NEEDS-ACTION"))
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			calPlugin, _, dbMock, closeDB := newInvitationReplyTestPlugin(t)
+			defer closeDB()
+			if test.expectDB != nil {
+				test.expectDB(dbMock)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/imip/reply"+test.query, strings.NewReader(test.body))
+			if test.secret != "" {
+				r.Header.Set(InvitationReplySecretHeader, test.secret)
+			}
+			r.Header.Set("Content-Type", test.contentType)
+			calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+			assert.Equal(t, test.status, w.Code)
+			assert.Nil(t, dbMock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestHandleInvitationReply_NotConfigured(t *testing.T) {
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/imip/reply")
+	defer closeDB()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/imip/reply", strings.NewReader(""))
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
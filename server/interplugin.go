@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/gorilla/mux"
+)
+
+// PluginIDHeader is set by the Mattermost server on the requests other plugins send with PluginHTTP,
+// and removed from the requests of users
+const PluginIDHeader = "Mattermost-Plugin-ID"
+
+// pluginTargetPrefix marks the webhook deliveries sent to another plugin rather than a URL
+const pluginTargetPrefix = "plugin://"
+
+// PluginSubscription is the path of another plugin notified of the calendar events
+type PluginSubscription struct {
+	PluginId   string     `json:"plugin_id" db:"plugin_id"`
+	Path       string     `json:"path" db:"path"`
+	EventTypes StringList `json:"events" db:"-"`
+	Types      string     `json:"-" db:"event_types"`
+	Created    time.Time  `json:"created" db:"created"`
+}
+
+// subscribed reports whether the plugin is notified of the event type, of all of them when it
+// didn't choose any
+func (s *PluginSubscription) subscribed(eventType WebhookEventType) bool {
+	return len(s.EventTypes) == 0 || contains([]string(s.EventTypes), string(eventType))
+}
+
+// target is the delivery target of the subscription, see sendWebhook
+func (s *PluginSubscription) target() string {
+	return pluginTargetPrefix + s.PluginId + s.Path
+}
+
+// CreatePluginEventRequest is the body of the event another plugin creates on behalf of a user
+type CreatePluginEventRequest struct {
+	UserId string `json:"user_id"`
+	Event  Event  `json:"event"`
+}
+
+// AvailabilityResponse is the busy time of a user, merged and sorted
+type AvailabilityResponse struct {
+	UserId string       `json:"user_id"`
+	Busy   []BusyPeriod `json:"busy"`
+}
+
+// interPluginAllowed reports whether the plugin may use the inter-plugin API. Only the plugins the
+// configuration lists may, none while it is empty.
+func (c *configuration) interPluginAllowed(pluginId string) bool {
+	if pluginId == "" {
+		return false
+	}
+	for _, allowed := range strings.Split(c.InterPluginAllowedIDs, ",") {
+		if strings.TrimSpace(allowed) == pluginId {
+			return true
+		}
+	}
+	return false
+}
+
+// interPluginOnly serves the requests other plugins send through PluginHTTP
+func (p *Plugin) interPluginOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pluginId := r.Header.Get(PluginIDHeader)
+		if pluginId == "" || !p.getConfiguration().interPluginAllowed(pluginId) {
+			errorResponse(w, NotAuthorizedError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadPluginSubscriptions caches the subscriptions of the other plugins, they are read on every change
+func (p *Plugin) loadPluginSubscriptions() error {
+	queryBuilder := sq.Select("plugin_id", "path", "event_types", "created").
+		From("calendar_plugin_subscriptions").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	stored := []PluginSubscription{}
+	if errSelect := p.DB.Select(&stored, querySql, args...); errSelect != nil {
+		return errSelect
+	}
+
+	subscriptions := map[string]PluginSubscription{}
+	for _, subscription := range stored {
+		if subscription.Types != "" {
+			subscription.EventTypes = strings.Split(subscription.Types, ",")
+		}
+		subscriptions[subscription.PluginId] = subscription
+	}
+
+	p.subscriptionsLock.Lock()
+	p.subscriptions = subscriptions
+	p.subscriptionsLock.Unlock()
+	return nil
+}
+
+// pluginSubscriptionTargets returns the delivery targets of the plugins subscribed to the event type,
+// the plugins removed from the allowed ones keep their subscription but aren't notified
+func (p *Plugin) pluginSubscriptionTargets(eventType WebhookEventType) []string {
+	config := p.getConfiguration()
+	p.subscriptionsLock.RLock()
+	defer p.subscriptionsLock.RUnlock()
+
+	var targets []string
+	for _, subscription := range p.subscriptions {
+		if subscription.subscribed(eventType) && config.interPluginAllowed(subscription.PluginId) {
+			targets = append(targets, subscription.target())
+		}
+	}
+	return targets
+}
+
+func (p *Plugin) hasPluginSubscriptions() bool {
+	p.subscriptionsLock.RLock()
+	defer p.subscriptionsLock.RUnlock()
+	return len(p.subscriptions) > 0
+}
+
+// sendPluginNotification delivers a notification to another plugin through PluginHTTP
+func (p *Plugin) sendPluginNotification(delivery *WebhookDelivery) (int, error) {
+	path := "/" + strings.TrimPrefix(delivery.URL, pluginTargetPrefix)
+	request, errRequest := http.NewRequest(http.MethodPost, path, strings.NewReader(delivery.Payload))
+	if errRequest != nil {
+		return 0, errRequest
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Calendar-Event", "event."+delivery.EventType)
+	request.Header.Set("X-Calendar-Delivery", delivery.Id)
+
+	response := p.API.PluginHTTP(request)
+	if response == nil {
+		return 0, errors.New("plugin not reachable")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// maxTimeRange is the longest range the events and the busy time are asked for
+const maxTimeRange = 366 * 24 * time.Hour
+
+// parseTimeRange reads the start and end of the query, RFC 3339 times at most maxTimeRange apart
+func parseTimeRange(r *http.Request) (time.Time, time.Time, bool) {
+	query := r.URL.Query()
+	start, errStart := time.Parse(time.RFC3339, query.Get("start"))
+	end, errEnd := time.Parse(time.RFC3339, query.Get("end"))
+	if errStart != nil || errEnd != nil || !end.After(start) || end.Sub(start) > maxTimeRange {
+		return time.Time{}, time.Time{}, false
+	}
+	return start.UTC(), end.UTC(), true
+}
+
+// InterPluginCreateEvent creates an event on behalf of a user
+func (p *Plugin) InterPluginCreateEvent(w http.ResponseWriter, r *http.Request) {
+	var request CreatePluginEventRequest
+	if errDecode := json.NewDecoder(r.Body).Decode(&request); errDecode != nil {
+		p.API.LogError(errDecode.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	user, err := p.API.GetUser(request.UserId)
+	if err != nil {
+		errorResponse(w, UserNotFound)
+		return
+	}
+
+	event := request.Event
+	if errCreate := p.createEvent(user, &event); errCreate != nil {
+		errorResponse(w, errCreate)
+		return
+	}
+	p.API.LogInfo("Event created by plugin", "plugin", r.Header.Get(PluginIDHeader), "event", event.Id, "user", user.Id)
+
+	event.Version = eventETag(&event)
+	apiResponse(w, &event)
+}
+
+// InterPluginGetEvents returns the events a user sees between start and end
+func (p *Plugin) InterPluginGetEvents(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user_id")
+	start, end, ok := parseTimeRange(r)
+	if userId == "" || !ok {
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	events, eventsErr := p.GetUserEventsUTC(userId, time.UTC, start, end)
+	if eventsErr != nil {
+		errorResponse(w, eventsErr)
+		return
+	}
+
+	apiResponse(w, &events)
+}
+
+// GetAvailability returns the busy time of a user between start and end
+func (p *Plugin) GetAvailability(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user_id")
+	start, end, ok := parseTimeRange(r)
+	if userId == "" || !ok {
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	periods, periodsErr := p.GetUserBusyPeriods(userId, start, end)
+	if periodsErr != nil {
+		errorResponse(w, periodsErr)
+		return
+	}
+
+	apiResponse(w, &AvailabilityResponse{
+		UserId: userId,
+		Busy:   mergeBusyPeriods(periods),
+	})
+}
+
+// InterPluginGetSubscription returns the subscription of the calling plugin
+func (p *Plugin) InterPluginGetSubscription(w http.ResponseWriter, r *http.Request) {
+	p.subscriptionsLock.RLock()
+	subscription, ok := p.subscriptions[r.Header.Get(PluginIDHeader)]
+	p.subscriptionsLock.RUnlock()
+
+	if !ok {
+		errorResponse(w, SubscriptionNotFound)
+		return
+	}
+	apiResponse(w, &subscription)
+}
+
+// InterPluginSubscribe notifies the calling plugin of the calendar events, replacing its subscription
+func (p *Plugin) InterPluginSubscribe(w http.ResponseWriter, r *http.Request) {
+	var subscription PluginSubscription
+	if errDecode := json.NewDecoder(r.Body).Decode(&subscription); errDecode != nil {
+		p.API.LogError(errDecode.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	if !strings.HasPrefix(subscription.Path, "/") || len(subscription.Path) > 255 {
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+	for _, eventType := range subscription.EventTypes {
+		switch WebhookEventType(eventType) {
+		case WebhookEventCreated, WebhookEventUpdated, WebhookEventDeleted, WebhookEventStarted, WebhookEventReminder:
+		default:
+			errorResponse(w, InvalidRequestParams)
+			return
+		}
+	}
+
+	subscription.PluginId = r.Header.Get(PluginIDHeader)
+	subscription.Types = strings.Join(subscription.EventTypes, ",")
+	subscription.Created = time.Now().UTC().Truncate(time.Second)
+
+	deleteBuilder := sq.Delete("calendar_plugin_subscriptions").
+		Where(sq.Eq{"plugin_id": subscription.PluginId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
+	_, _ = p.DB.Exec(deleteSql, deleteArgs...)
+
+	insertBuilder := sq.Insert("calendar_plugin_subscriptions").
+		Columns("plugin_id", "path", "event_types", "created").
+		Values(subscription.PluginId, subscription.Path, subscription.Types, subscription.Created).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	insertSql, insertArgs, _ := insertBuilder.ToSql()
+
+	if _, errInsert := p.DB.Exec(insertSql, insertArgs...); errInsert != nil {
+		p.API.LogError("InterPluginSubscribe: can't save subscription: " + errInsert.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	p.subscriptionsLock.Lock()
+	if p.subscriptions == nil {
+		p.subscriptions = map[string]PluginSubscription{}
+	}
+	p.subscriptions[subscription.PluginId] = subscription
+	p.subscriptionsLock.Unlock()
+
+	apiResponse(w, &subscription)
+}
+
+// InterPluginUnsubscribe stops the notifications of the calling plugin
+func (p *Plugin) InterPluginUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	pluginId := r.Header.Get(PluginIDHeader)
+
+	deleteBuilder := sq.Delete("calendar_plugin_subscriptions").
+		Where(sq.Eq{"plugin_id": pluginId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
+
+	if _, errDelete := p.DB.Exec(deleteSql, deleteArgs...); errDelete != nil {
+		p.API.LogError("InterPluginUnsubscribe: can't remove subscription: " + errDelete.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	p.subscriptionsLock.Lock()
+	delete(p.subscriptions, pluginId)
+	p.subscriptionsLock.Unlock()
+
+	apiResponse(w, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// initInterPluginAPI routes the API of the other plugins, see the client package
+func (p *Plugin) initInterPluginAPI(r *mux.Router) {
+	s := r.PathPrefix("/interplugin").Subrouter()
+	s.Use(p.interPluginOnly)
+	s.HandleFunc("/events", p.InterPluginCreateEvent).Methods("POST")
+	s.HandleFunc("/events", p.InterPluginGetEvents).Methods("GET")
+	s.HandleFunc("/availability", p.GetAvailability).Methods("GET")
+	s.HandleFunc("/subscription", p.InterPluginGetSubscription).Methods("GET")
+	s.HandleFunc("/subscription", p.InterPluginSubscribe).Methods("PUT")
+	s.HandleFunc("/subscription", p.InterPluginUnsubscribe).Methods("DELETE")
+}
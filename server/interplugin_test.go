@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestInterPlugin_NotAuthorized(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/interplugin/subscription"
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{InterPluginAllowedIDs: "com.example.standup"})
+
+	for pluginId, code := range map[string]int{
+		"":                    http.StatusUnauthorized,
+		"com.example.other":   http.StatusUnauthorized,
+		"com.example.standup": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if pluginId != "" {
+			r.Header.Set(PluginIDHeader, pluginId)
+		}
+		calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+		assert.Equal(code, w.Code, pluginId)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestInterPluginCreateEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/interplugin/events"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, path)
+	defer closeDB()
+	api.On("LogInfo", "Event created by plugin", "plugin", "com.example.standup", "event", mock.Anything, "user", "test-user").Return()
+	calPlugin.setConfiguration(&configuration{InterPluginAllowedIDs: "com.example.standup"})
+
+	// 10:00 in Berlin is 09:00 UTC
+	start := time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("INSERT INTO calendar_events")).
+		WithArgs(sqlmock.AnyArg(), "Standup", "", start, start.Add(15*time.Minute), false, "Europe/Berlin",
+			sqlmock.AnyArg(), sqlmock.AnyArg(), "test-user", nil, false, "", nil, nil, nil, sqlmock.AnyArg(), "", sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{}))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ce.owner, ce.visibility, ce.channel, ce.team, cm.member FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(
+		`{"user_id":"test-user","event":{"title":"Standup","start":"2024-03-20T10:00:00Z","end":"2024-03-20T10:15:00Z"}}`))
+	r.Header.Set(PluginIDHeader, "com.example.standup")
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"owner":"test-user"`)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestInterPluginSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/interplugin/subscription"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPut, path)
+	defer closeDB()
+	api.On("LogDebug", "Plugin HTTP request", "method", http.MethodDelete, "path", path, "user-agent", "").Return()
+	calPlugin.setConfiguration(&configuration{InterPluginAllowedIDs: "com.example.standup"})
+
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_plugin_subscriptions WHERE plugin_id = $1")).
+		WithArgs("com.example.standup").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_plugin_subscriptions (plugin_id,path,event_types,created) VALUES ($1,$2,$3,$4)")).
+		WithArgs("com.example.standup", "/calendar/notify", "created,deleted", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, path, strings.NewReader(`{"path":"/calendar/notify","events":["created","deleted"]}`))
+	r.Header.Set(PluginIDHeader, "com.example.standup")
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(calPlugin.hasPluginSubscriptions())
+	assert.Equal([]string{"plugin://com.example.standup/calendar/notify"}, calPlugin.pluginSubscriptionTargets(WebhookEventDeleted))
+	assert.Empty(calPlugin.pluginSubscriptionTargets(WebhookEventUpdated))
+
+	// removed from the allowed plugins
+	calPlugin.setConfiguration(&configuration{InterPluginAllowedIDs: "com.example.oncall"})
+	assert.Empty(calPlugin.pluginSubscriptionTargets(WebhookEventDeleted))
+	calPlugin.setConfiguration(&configuration{InterPluginAllowedIDs: "com.example.standup"})
+
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_plugin_subscriptions WHERE plugin_id = $1")).
+		WithArgs("com.example.standup").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodDelete, path, nil)
+	r.Header.Set(PluginIDHeader, "com.example.standup")
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.False(calPlugin.hasPluginSubscriptions())
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestInterPluginSubscribe_InvalidEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/interplugin/subscription"
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPut, path)
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{InterPluginAllowedIDs: "com.example.standup"})
+
+	for _, body := range []string{
+		`{"path":"calendar/notify"}`,
+		`{"path":"/calendar/notify","events":["moved"]}`,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		r.Header.Set(PluginIDHeader, "com.example.standup")
+		calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+		assert.Equal(http.StatusBadRequest, w.Code, body)
+	}
+	assert.False(calPlugin.hasPluginSubscriptions())
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetAvailability_InvalidRange(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/interplugin/availability"
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{InterPluginAllowedIDs: "com.example.standup"})
+
+	for name, query := range map[string]string{
+		"end before start":   "start=2024-03-20T10:00:00Z&end=2024-03-20T09:00:00Z",
+		"longer than a year": "start=2024-03-20T00:00:00Z&end=2025-03-22T00:00:00Z",
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path+"?user_id=test-user&"+query, nil)
+		r.Header.Set(PluginIDHeader, "com.example.standup")
+		calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+		assert.Equal(http.StatusBadRequest, w.Code, name)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestMergeBusyPeriods(t *testing.T) {
+	assert := assert.New(t)
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 20, hour, minute, 0, 0, time.UTC)
+	}
+	merged := mergeBusyPeriods([]BusyPeriod{
+		{Start: at(13, 0), End: at(14, 0)},
+		{Start: at(9, 0), End: at(10, 0)},
+		{Start: at(9, 30), End: at(11, 0)},
+		{Start: at(11, 0), End: at(11, 30)},
+	})
+	assert.Equal([]BusyPeriod{
+		{Start: at(9, 0), End: at(11, 30)},
+		{Start: at(13, 0), End: at(14, 0)},
+	}, merged)
+}
+
+func TestDeliverWebhooks_Plugin(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{InterPluginAllowedIDs: "com.example.standup"})
+	calPlugin.subscriptions = map[string]PluginSubscription{
+		"com.example.standup": {PluginId: "com.example.standup", Path: "/calendar/notify"},
+	}
+
+	payload := `{"type":"event.created","timestamp":"2024-03-01T09:00:00Z","event":{"id":"event-1"}}`
+	api.On("PluginHTTP", mock.MatchedBy(func(r *http.Request) bool {
+		return r.Method == http.MethodPost &&
+			r.URL.Path == "/com.example.standup/calendar/notify" &&
+			r.Header.Get("X-Calendar-Event") == "event.created" &&
+			r.Header.Get("X-Calendar-Delivery") == "delivery-1"
+	})).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))})
+
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_webhook_deliveries WHERE (status = $1 AND next_attempt <= $2)")).
+		WithArgs("pending", now).
+		WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns).
+			AddRow("delivery-1", "plugin://com.example.standup/calendar/notify", "created", "event-1", payload, "pending", 0, now, 0, "", now, nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_webhook_deliveries SET next_attempt = $1 WHERE (id = $2 AND status = $3 AND next_attempt <= $4)")).
+		WithArgs(now.Add(webhookClaimLease), "delivery-1", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_webhook_deliveries SET attempts = $1, delivered = $2, last_error = $3, next_attempt = $4, response_code = $5, status = $6 WHERE id = $7")).
+		WithArgs(1, sqlmock.AnyArg(), "", now, 200, "delivered", "delivery-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.deliverWebhooks(now)
+
+	api.AssertExpectations(t)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestInterPluginAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	// no plugin may until the admin lists them
+	config := &configuration{}
+	assert.False(config.interPluginAllowed("com.example.standup"))
+
+	config.InterPluginAllowedIDs = "com.example.standup, com.example.oncall"
+	assert.True(config.interPluginAllowed("com.example.oncall"))
+	assert.False(config.interPluginAllowed("com.example.other"))
+	assert.False(config.interPluginAllowed(""))
+}
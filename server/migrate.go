@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
@@ -201,6 +202,226 @@ func (m *Migrator) migrateLegacyRecurrentEvents() *model.AppError {
 	return nil
 }
 
+// migrateEventTimezones anchors the timed events saved before the zone was stored in the
+// timezone of their owner. Their series end is cleared to be computed again in that zone.
+func (m *Migrator) migrateEventTimezones() *model.AppError {
+	queryBuilder := sq.Select("owner").
+		Distinct().
+		From("calendar_events").
+		Where(sq.And{
+			sq.Eq{"timezone": ""},
+			sq.Eq{"all_day": false},
+		}).
+		PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var owners []string
+	if errSelect := m.DB.Select(&owners, querySql, argsSql...); errSelect != nil {
+		m.plugin.API.LogError(errSelect.Error())
+		return CantMakeMigration
+	}
+
+	for _, owner := range owners {
+		user, appErr := m.plugin.API.GetUser(owner)
+		if appErr != nil {
+			// tried again on the next activation
+			m.plugin.API.LogError(appErr.Error())
+			continue
+		}
+
+		updateQueryBuilder := sq.Update("calendar_events").
+			Set("timezone", m.plugin.GetUserLocation(user).String()).
+			Set("recurrence_end", nil).
+			Where(sq.And{
+				sq.Eq{"owner": owner},
+				sq.Eq{"timezone": ""},
+				sq.Eq{"all_day": false},
+			}).
+			PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+		updateQuerySql, updateArgsSql, _ := updateQueryBuilder.ToSql()
+
+		if _, errUpdate := m.DB.Exec(updateQuerySql, updateArgsSql...); errUpdate != nil {
+			m.plugin.API.LogError(errUpdate.Error())
+			return CantMakeMigration
+		}
+	}
+
+	return nil
+}
+
+// migrateRecurrenceEnds stores the series end of the recurring events saved before it was stored,
+// only rules with UNTIL or COUNT end
+func (m *Migrator) migrateRecurrenceEnds() *model.AppError {
+	queryBuilder := sq.Select().
+		Columns("id", "dt_start", "dt_end", "all_day", "timezone", "recurrent", "recurrence").
+		From("calendar_events").
+		Where(sq.And{
+			sq.Eq{"recurrent": true},
+			sq.Eq{"recurrence_end": nil},
+			sq.Or{
+				sq.Like{"recurrence": "%UNTIL=%"},
+				sq.Like{"recurrence": "%COUNT=%"},
+			},
+		}).
+		PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var events []Event
+	if errSelect := m.DB.Select(&events, querySql, argsSql...); errSelect != nil {
+		m.plugin.API.LogError(errSelect.Error())
+		return CantMakeMigration
+	}
+
+	for _, event := range events {
+		end := seriesEnd(&event)
+		if end == nil {
+			continue
+		}
+
+		updateQueryBuilder := sq.Update("calendar_events").
+			Set("recurrence_end", end).
+			Where(sq.Eq{"id": event.Id}).
+			PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+		updateQuerySql, updateArgsSql, _ := updateQueryBuilder.ToSql()
+
+		if _, errUpdate := m.DB.Exec(updateQuerySql, updateArgsSql...); errUpdate != nil {
+			m.plugin.API.LogError(errUpdate.Error())
+		}
+	}
+
+	return nil
+}
+
+// migrateNextNotifications stores when the timed recurring events saved before it was stored are
+// checked by the reminders next
+func (m *Migrator) migrateNextNotifications() *model.AppError {
+	now := time.Now().UTC().Truncate(time.Minute)
+	queryBuilder := sq.Select().
+		Columns("id", "dt_start", "dt_end", "all_day", "timezone", "recurrent", "recurrence", "alert").
+		From("calendar_events").
+		Where(sq.And{
+			sq.Eq{"recurrent": true},
+			sq.Eq{"all_day": false},
+			sq.Eq{"next_notification": nil},
+			sq.Or{
+				sq.Eq{"recurrence_end": nil},
+				sq.GtOrEq{"recurrence_end": now},
+			},
+		}).
+		PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var events []Event
+	if errSelect := m.DB.Select(&events, querySql, argsSql...); errSelect != nil {
+		m.plugin.API.LogError(errSelect.Error())
+		return CantMakeMigration
+	}
+
+	for _, event := range events {
+		next := nextNotification(&event, now)
+		if next == nil {
+			continue
+		}
+
+		updateQueryBuilder := sq.Update("calendar_events").
+			Set("next_notification", next).
+			Where(sq.Eq{"id": event.Id}).
+			PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+		updateQuerySql, updateArgsSql, _ := updateQueryBuilder.ToSql()
+
+		if _, errUpdate := m.DB.Exec(updateQuerySql, updateArgsSql...); errUpdate != nil {
+			m.plugin.API.LogError(errUpdate.Error())
+		}
+	}
+
+	return nil
+}
+
+// migrateICalTokenHashes replaces the iCal tokens saved in clear by their salted hashes
+func (m *Migrator) migrateICalTokenHashes() *model.AppError {
+	queryBuilder := sq.Select("id", "token").
+		From("calendar_ical_tokens").
+		Where(sq.NotEq{"token": nil}).
+		PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var tokens []struct {
+		Id    string `db:"id"`
+		Token string `db:"token"`
+	}
+	if errSelect := m.DB.Select(&tokens, querySql, argsSql...); errSelect != nil {
+		m.plugin.API.LogError(errSelect.Error())
+		return CantMakeMigration
+	}
+
+	for _, token := range tokens {
+		var hashed ICalToken
+		if errSecret := hashed.setSecret(token.Token); errSecret != nil {
+			m.plugin.API.LogError(errSecret.Error())
+			return CantMakeMigration
+		}
+
+		updateQueryBuilder := sq.Update("calendar_ical_tokens").
+			Set("token_prefix", hashed.TokenPrefix).
+			Set("token_salt", hashed.TokenSalt).
+			Set("token_hash", hashed.TokenHash).
+			Set("token", nil).
+			Where(sq.Eq{"id": token.Id}).
+			PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+		updateQuerySql, updateArgsSql, _ := updateQueryBuilder.ToSql()
+
+		if _, errUpdate := m.DB.Exec(updateQuerySql, updateArgsSql...); errUpdate != nil {
+			m.plugin.API.LogError(errUpdate.Error())
+			return CantMakeMigration
+		}
+	}
+
+	return nil
+}
+
+// migrateChannelICalTokenHashes replaces the channel iCal tokens saved in clear by their salted
+// hashes
+func (m *Migrator) migrateChannelICalTokenHashes() *model.AppError {
+	queryBuilder := sq.Select("channel_id", "token").
+		From("calendar_channel_ical_tokens").
+		Where(sq.NotEq{"token": nil}).
+		PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var tokens []struct {
+		ChannelID string `db:"channel_id"`
+		Token     string `db:"token"`
+	}
+	if errSelect := m.DB.Select(&tokens, querySql, argsSql...); errSelect != nil {
+		m.plugin.API.LogError(errSelect.Error())
+		return CantMakeMigration
+	}
+
+	for _, token := range tokens {
+		var hashed ChannelICalToken
+		if errSecret := hashed.setSecret(token.Token); errSecret != nil {
+			m.plugin.API.LogError(errSecret.Error())
+			return CantMakeMigration
+		}
+
+		updateQueryBuilder := sq.Update("calendar_channel_ical_tokens").
+			Set("token_prefix", hashed.TokenPrefix).
+			Set("token_salt", hashed.TokenSalt).
+			Set("token_hash", hashed.TokenHash).
+			Set("token", nil).
+			Where(sq.Eq{"channel_id": token.ChannelID}).
+			PlaceholderFormat(m.plugin.GetDBPlaceholderFormat())
+		updateQuerySql, updateArgsSql, _ := updateQueryBuilder.ToSql()
+
+		if _, errUpdate := m.DB.Exec(updateQuerySql, updateArgsSql...); errUpdate != nil {
+			m.plugin.API.LogError(errUpdate.Error())
+			return CantMakeMigration
+		}
+	}
+
+	return nil
+}
+
 func newMigrator(db *sqlx.DB, plugin *Plugin) *Migrator {
 	return &Migrator{
 		DB:     db,
@@ -4,10 +4,13 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/mattermost/mattermost-server/v6/plugin"
 	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestMigrateLegacy(t *testing.T) {
@@ -86,3 +89,223 @@ func TestMigrateLegacy(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestMigrateRecurrenceEnds(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	dbx := sqlx.NewDb(db, "sqlmock")
+
+	api := plugintest.API{}
+	pluginT := &Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+	}
+
+	migrator := Migrator{
+		plugin: pluginT,
+		DB:     dbx,
+	}
+
+	queryBuilder := sq.Select().
+		Columns("id", "dt_start", "dt_end", "all_day", "timezone", "recurrent", "recurrence").
+		From("calendar_events").
+		Where(sq.And{
+			sq.Eq{"recurrent": true},
+			sq.Eq{"recurrence_end": nil},
+			sq.Or{
+				sq.Like{"recurrence": "%UNTIL=%"},
+				sq.Like{"recurrence": "%COUNT=%"},
+			},
+		}).
+		PlaceholderFormat(sq.Dollar)
+	querySql, _, _ := queryBuilder.ToSql()
+
+	start := time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta(querySql)).
+		WithArgs(true, "%UNTIL=%", "%COUNT=%").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "dt_start", "dt_end", "all_day", "timezone", "recurrent", "recurrence"}).
+			AddRow("count", start, start.Add(time.Hour), false, "Europe/Berlin", true, "RRULE:FREQ=WEEKLY;COUNT=3").
+			AddRow("invalid", start, start.Add(time.Hour), false, "", true, "RRULE:FREQ=SOMETIMES;COUNT=3"))
+
+	updateQueryBuilder := sq.Update("calendar_events").
+		Set("recurrence_end", start).
+		Where(sq.Eq{"id": "count"}).
+		PlaceholderFormat(sq.Dollar)
+	updateQuerySql, _, _ := updateQueryBuilder.ToSql()
+	dbMock.ExpectExec(regexp.QuoteMeta(updateQuerySql)).
+		WithArgs(time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC), "count").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if appErr := migrator.migrateRecurrenceEnds(); appErr != nil {
+		t.Errorf("unexpected error: %s", appErr.Error())
+	}
+
+	if err := dbMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrateEventTimezones(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	dbx := sqlx.NewDb(db, "sqlmock")
+
+	api := plugintest.API{}
+	api.On("GetUser", "berlin-user").Return(&model.User{
+		Id:       "berlin-user",
+		Timezone: map[string]string{"useAutomaticTimezone": "true", "automaticTimezone": "Europe/Berlin"},
+	}, nil)
+	api.On("GetUser", "unknown-user").Return(nil, &model.AppError{Message: "not found"})
+	api.On("LogError", mock.Anything).Return()
+	pluginT := &Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+	}
+
+	migrator := Migrator{
+		plugin: pluginT,
+		DB:     dbx,
+	}
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT DISTINCT owner FROM calendar_events WHERE (timezone = $1 AND all_day = $2)")).
+		WithArgs("", false).
+		WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow("berlin-user").AddRow("unknown-user"))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET timezone = $1, recurrence_end = $2 WHERE (owner = $3 AND timezone = $4 AND all_day = $5)")).
+		WithArgs("Europe/Berlin", nil, "berlin-user", "", false).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	if appErr := migrator.migrateEventTimezones(); appErr != nil {
+		t.Errorf("unexpected error: %s", appErr.Error())
+	}
+
+	if err := dbMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	api.AssertExpectations(t)
+}
+
+func TestMigrateNextNotifications(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	dbx := sqlx.NewDb(db, "sqlmock")
+
+	api := plugintest.API{}
+	pluginT := &Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+	}
+
+	migrator := Migrator{
+		plugin: pluginT,
+		DB:     dbx,
+	}
+
+	start := time.Now().UTC().Truncate(time.Minute).Add(48 * time.Hour)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, dt_start, dt_end, all_day, timezone, recurrent, recurrence, alert FROM calendar_events WHERE (recurrent = $1 AND all_day = $2 AND next_notification IS NULL AND (recurrence_end IS NULL OR recurrence_end >= $3))")).
+		WithArgs(true, false, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "dt_start", "dt_end", "all_day", "timezone", "recurrent", "recurrence", "alert"}).
+			AddRow("daily", start, start.Add(time.Hour), false, "Europe/Berlin", true, "RRULE:FREQ=DAILY", "5_minutes_before").
+			AddRow("invalid", start, start.Add(time.Hour), false, "", true, "RRULE:FREQ=SOMETIMES", ""))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET next_notification = $1 WHERE id = $2")).
+		WithArgs(start.Add(-5*time.Minute), "daily").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if appErr := migrator.migrateNextNotifications(); appErr != nil {
+		t.Errorf("unexpected error: %s", appErr.Error())
+	}
+
+	if err := dbMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrateICalTokenHashes(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	dbx := sqlx.NewDb(db, "sqlmock")
+
+	api := plugintest.API{}
+	pluginT := &Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+	}
+
+	migrator := Migrator{
+		plugin: pluginT,
+		DB:     dbx,
+	}
+
+	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, token FROM calendar_ical_tokens WHERE token IS NOT NULL")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token"}).AddRow("token-1", tokenValue))
+
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_ical_tokens SET token_prefix = $1, token_salt = $2, token_hash = $3, token = $4 WHERE id = $5")).
+		WithArgs("abcd1234", sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "token-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if appErr := migrator.migrateICalTokenHashes(); appErr != nil {
+		t.Errorf("unexpected error: %s", appErr.Error())
+	}
+
+	if err := dbMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrateChannelICalTokenHashes(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	dbx := sqlx.NewDb(db, "sqlmock")
+
+	api := plugintest.API{}
+	pluginT := &Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+	}
+
+	migrator := Migrator{
+		plugin: pluginT,
+		DB:     dbx,
+	}
+
+	tokenValue := "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT channel_id, token FROM calendar_channel_ical_tokens WHERE token IS NOT NULL")).
+		WillReturnRows(sqlmock.NewRows([]string{"channel_id", "token"}).AddRow("channel-1", tokenValue))
+
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_channel_ical_tokens SET token_prefix = $1, token_salt = $2, token_hash = $3, token = $4 WHERE channel_id = $5")).
+		WithArgs("abcd1234", sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "channel-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if appErr := migrator.migrateChannelICalTokenHashes(); appErr != nil {
+		t.Errorf("unexpected error: %s", appErr.Error())
+	}
+
+	if err := dbMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS calendar_sync_changes (
+    id       BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id  VARCHAR(26) NOT NULL DEFAULT '',
+    event_id VARCHAR(50) NOT NULL,
+    deleted  BOOLEAN NOT NULL DEFAULT FALSE,
+    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_calendar_sync_changes_user (user_id, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS calendar_schedule_messages;
+ALTER TABLE calendar_members DROP COLUMN partstat;
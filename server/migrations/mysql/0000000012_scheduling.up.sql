@@ -0,0 +1,11 @@
+ALTER TABLE calendar_members ADD COLUMN partstat VARCHAR(20) NOT NULL DEFAULT 'NEEDS-ACTION';
+
+CREATE TABLE IF NOT EXISTS calendar_schedule_messages (
+    id       VARCHAR(26) NOT NULL PRIMARY KEY,
+    user_id  VARCHAR(26) NOT NULL,
+    event_id VARCHAR(50) NOT NULL,
+    method   VARCHAR(16) NOT NULL,
+    data     MEDIUMTEXT NOT NULL,
+    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_calendar_schedule_messages_user (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
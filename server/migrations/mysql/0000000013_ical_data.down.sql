@@ -0,0 +1 @@
+ALTER TABLE calendar_events DROP COLUMN ical_data;
@@ -0,0 +1 @@
+ALTER TABLE calendar_events ADD COLUMN ical_data MEDIUMTEXT NULL;
@@ -0,0 +1 @@
+ALTER TABLE calendar_events DROP COLUMN all_day;
@@ -0,0 +1 @@
+ALTER TABLE calendar_events ADD COLUMN all_day BOOLEAN NOT NULL DEFAULT false;
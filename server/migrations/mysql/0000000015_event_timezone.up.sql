@@ -0,0 +1 @@
+ALTER TABLE calendar_events ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE calendar_events ADD recurrence_end TIMESTAMP NULL DEFAULT NULL;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS calendar_event_templates (
+    id          VARCHAR(36) NOT NULL PRIMARY KEY,
+    name        VARCHAR(100) NOT NULL,
+    owner       VARCHAR(26) NOT NULL,
+    team        VARCHAR(26) NOT NULL DEFAULT '',
+    title       VARCHAR(255) NOT NULL DEFAULT '',
+    description TEXT NOT NULL,
+    duration    INTEGER NOT NULL DEFAULT 30,
+    attendees   TEXT NOT NULL,
+    channel     VARCHAR(26) NULL DEFAULT NULL,
+    visibility  VARCHAR(16) NOT NULL DEFAULT 'private',
+    color       VARCHAR(16) NULL DEFAULT NULL,
+    alert       VARCHAR(32) NOT NULL DEFAULT '',
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_calendar_event_templates_owner (owner),
+    KEY idx_calendar_event_templates_team (team)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS calendar_channel_ical_tokens (
+    token      VARCHAR(64) NOT NULL PRIMARY KEY,
+    channel_id VARCHAR(26) NOT NULL,
+    created_by VARCHAR(26) NOT NULL,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used  TIMESTAMP NULL,
+    UNIQUE KEY unique_channel (channel_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
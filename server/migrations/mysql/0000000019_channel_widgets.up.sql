@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS calendar_channel_widgets (
+    channel_id   VARCHAR(26) NOT NULL PRIMARY KEY,
+    enabled      BOOLEAN NOT NULL DEFAULT TRUE,
+    horizon_days INT NOT NULL DEFAULT 7,
+    event_count  INT NOT NULL DEFAULT 5,
+    timezone     VARCHAR(64) NOT NULL DEFAULT '',
+    post_id      VARCHAR(26) NOT NULL DEFAULT '',
+    message      TEXT NOT NULL,
+    updated_by   VARCHAR(26) NOT NULL,
+    updated      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
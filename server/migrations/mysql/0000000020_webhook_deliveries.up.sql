@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS calendar_webhook_deliveries (
+    id            VARCHAR(26) NOT NULL PRIMARY KEY,
+    url           TEXT NOT NULL,
+    event_type    VARCHAR(32) NOT NULL,
+    event_id      VARCHAR(50) NOT NULL,
+    payload       MEDIUMTEXT NOT NULL,
+    status        VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts      INT NOT NULL DEFAULT 0,
+    next_attempt  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    response_code INT NOT NULL DEFAULT 0,
+    last_error    TEXT NOT NULL,
+    created       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered     TIMESTAMP NULL,
+    KEY idx_calendar_webhook_deliveries_pending (status, next_attempt)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS calendar_api_tokens (
+    token_id    VARCHAR(26) NOT NULL PRIMARY KEY,
+    user_id     VARCHAR(26) NOT NULL,
+    created_by  VARCHAR(26) NOT NULL,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    scopes      VARCHAR(255) NOT NULL DEFAULT '[]',
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_calendar_api_tokens_created_by (created_by)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,10 @@
+DELETE t FROM calendar_ical_tokens t JOIN calendar_ical_tokens n ON t.user_id = n.user_id AND (t.created < n.created OR (t.created = n.created AND t.token < n.token));
+ALTER TABLE calendar_ical_tokens
+    DROP INDEX idx_calendar_ical_tokens_id,
+    ADD UNIQUE KEY unique_user (user_id),
+    DROP INDEX idx_calendar_ical_tokens_user,
+    DROP COLUMN last_used_agent,
+    DROP COLUMN expires,
+    DROP COLUMN scope,
+    DROP COLUMN label,
+    DROP COLUMN id;
@@ -0,0 +1,10 @@
+ALTER TABLE calendar_ical_tokens
+    ADD COLUMN id VARCHAR(26) NULL,
+    ADD COLUMN label VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN scope VARCHAR(16) NOT NULL DEFAULT 'caldav',
+    ADD COLUMN expires TIMESTAMP NULL,
+    ADD COLUMN last_used_agent VARCHAR(255) NOT NULL DEFAULT '',
+    ADD KEY idx_calendar_ical_tokens_user (user_id),
+    DROP INDEX unique_user;
+UPDATE calendar_ical_tokens SET id = LEFT(MD5(token), 26) WHERE id IS NULL;
+ALTER TABLE calendar_ical_tokens ADD UNIQUE KEY idx_calendar_ical_tokens_id (id);
@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS calendar_ical_token_access;
+-- hashed tokens can't be restored
+DELETE FROM calendar_ical_tokens WHERE token IS NULL;
+ALTER TABLE calendar_ical_tokens
+    DROP PRIMARY KEY,
+    DROP INDEX idx_calendar_ical_tokens_prefix,
+    MODIFY token VARCHAR(64) NOT NULL,
+    ADD PRIMARY KEY (token),
+    ADD UNIQUE KEY idx_calendar_ical_tokens_id (id),
+    DROP COLUMN disabled,
+    DROP COLUMN token_hash,
+    DROP COLUMN token_salt,
+    DROP COLUMN token_prefix;
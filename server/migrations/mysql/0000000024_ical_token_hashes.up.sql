@@ -0,0 +1,20 @@
+ALTER TABLE calendar_ical_tokens
+    ADD COLUMN token_prefix VARCHAR(8) NOT NULL DEFAULT '',
+    ADD COLUMN token_salt VARCHAR(32) NOT NULL DEFAULT '',
+    ADD COLUMN token_hash VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN disabled TIMESTAMP NULL,
+    DROP PRIMARY KEY,
+    MODIFY token VARCHAR(64) NULL,
+    MODIFY id VARCHAR(26) NOT NULL,
+    DROP INDEX idx_calendar_ical_tokens_id,
+    ADD PRIMARY KEY (id),
+    ADD KEY idx_calendar_ical_tokens_prefix (token_prefix);
+
+CREATE TABLE IF NOT EXISTS calendar_ical_token_access (
+    id         VARCHAR(26) NOT NULL PRIMARY KEY,
+    token_id   VARCHAR(26) NOT NULL,
+    ip         VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    accessed   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_calendar_ical_token_access_token (token_id, accessed)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
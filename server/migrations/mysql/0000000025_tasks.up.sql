@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS calendar_tasks (
+    id          VARCHAR(255) NOT NULL PRIMARY KEY,
+    title       VARCHAR(255) NOT NULL DEFAULT '',
+    description TEXT NOT NULL,
+    due         TIMESTAMP NULL DEFAULT NULL,
+    status      VARCHAR(16) NOT NULL DEFAULT 'NEEDS-ACTION',
+    priority    INTEGER NOT NULL DEFAULT 0,
+    completed   TIMESTAMP NULL DEFAULT NULL,
+    owner       VARCHAR(26) NOT NULL,
+    assignee    VARCHAR(26) NOT NULL,
+    ical_data   MEDIUMTEXT NULL,
+    reminded    TIMESTAMP NULL DEFAULT NULL,
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_calendar_tasks_owner (owner),
+    KEY idx_calendar_tasks_assignee (assignee),
+    KEY idx_calendar_tasks_due (due)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
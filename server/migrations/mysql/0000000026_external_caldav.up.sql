@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS calendar_external_accounts (
+    user_id    VARCHAR(26) NOT NULL PRIMARY KEY,
+    url        VARCHAR(1024) NOT NULL,
+    username   VARCHAR(255) NOT NULL DEFAULT '',
+    password   TEXT NOT NULL,
+    sync_token VARCHAR(1024) NOT NULL DEFAULT '',
+    ctag       VARCHAR(1024) NOT NULL DEFAULT '',
+    last_sync  TIMESTAMP NULL DEFAULT NULL,
+    last_error VARCHAR(1000) NOT NULL DEFAULT '',
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_calendar_external_accounts_last_sync (last_sync)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS calendar_external_objects (
+    user_id         VARCHAR(26) NOT NULL,
+    href            VARCHAR(700) NOT NULL,
+    uid             VARCHAR(255) NOT NULL,
+    etag            VARCHAR(255) NOT NULL DEFAULT '',
+    event           VARCHAR(255) NOT NULL,
+    remote_modified TIMESTAMP NULL DEFAULT NULL,
+    local_updated   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, href),
+    KEY idx_calendar_external_objects_event (event)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS calendar_provider_accounts (
+    user_id       VARCHAR(26) NOT NULL,
+    provider      VARCHAR(20) NOT NULL,
+    access_token  TEXT NOT NULL,
+    refresh_token TEXT NOT NULL,
+    token_expiry  TIMESTAMP NULL DEFAULT NULL,
+    sync_cursor   TEXT NOT NULL,
+    last_sync     TIMESTAMP NULL DEFAULT NULL,
+    last_error    VARCHAR(1000) NOT NULL DEFAULT '',
+    created       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, provider),
+    KEY idx_calendar_provider_accounts_last_sync (last_sync)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS calendar_provider_events (
+    user_id        VARCHAR(26) NOT NULL,
+    provider       VARCHAR(20) NOT NULL,
+    remote_id      VARCHAR(512) NOT NULL,
+    event          VARCHAR(255) NOT NULL,
+    remote_updated TIMESTAMP NULL DEFAULT NULL,
+    PRIMARY KEY (user_id, provider, remote_id),
+    KEY idx_calendar_provider_events_event (event)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS calendar_guests (
+    event    VARCHAR(50) NOT NULL,
+    email    VARCHAR(320) NOT NULL,
+    name     VARCHAR(255) NOT NULL DEFAULT '',
+    partstat VARCHAR(20) NOT NULL DEFAULT 'NEEDS-ACTION',
+    PRIMARY KEY (event, email)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS calendar_guest_messages (
+    id           VARCHAR(26) NOT NULL PRIMARY KEY,
+    event_id     VARCHAR(50) NOT NULL,
+    email        VARCHAR(320) NOT NULL,
+    method       VARCHAR(16) NOT NULL,
+    message      MEDIUMTEXT NOT NULL,
+    status       VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts     INT NOT NULL DEFAULT 0,
+    next_attempt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error   TEXT NOT NULL,
+    created      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent         TIMESTAMP NULL,
+    KEY idx_calendar_guest_messages_pending (status, next_attempt)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,10 @@
+-- hashed tokens can't be restored
+DELETE FROM calendar_channel_ical_tokens WHERE token IS NULL;
+ALTER TABLE calendar_channel_ical_tokens
+    DROP PRIMARY KEY,
+    DROP INDEX idx_calendar_channel_ical_tokens_prefix,
+    MODIFY token VARCHAR(64) NOT NULL,
+    ADD PRIMARY KEY (token),
+    DROP COLUMN token_hash,
+    DROP COLUMN token_salt,
+    DROP COLUMN token_prefix;
@@ -0,0 +1,8 @@
+ALTER TABLE calendar_channel_ical_tokens
+    ADD COLUMN token_prefix VARCHAR(8) NOT NULL DEFAULT '',
+    ADD COLUMN token_salt VARCHAR(32) NOT NULL DEFAULT '',
+    ADD COLUMN token_hash VARCHAR(64) NOT NULL DEFAULT '',
+    DROP PRIMARY KEY,
+    MODIFY token VARCHAR(64) NULL,
+    ADD PRIMARY KEY (channel_id),
+    ADD KEY idx_calendar_channel_ical_tokens_prefix (token_prefix);
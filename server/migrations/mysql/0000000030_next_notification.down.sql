@@ -0,0 +1 @@
+ALTER TABLE calendar_events DROP KEY idx_calendar_events_next_notification, DROP COLUMN next_notification;
@@ -0,0 +1 @@
+ALTER TABLE calendar_events ADD next_notification TIMESTAMP NULL DEFAULT NULL, ADD KEY idx_calendar_events_next_notification (next_notification);
@@ -0,0 +1,2 @@
+-- the changes of channel and team events were recorded for every user, the clients sync again from scratch
+DELETE FROM calendar_sync_changes WHERE id < (SELECT newest FROM (SELECT MAX(id) AS newest FROM calendar_sync_changes) AS changes);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS calendar_sync_changes (
+    id       BIGSERIAL PRIMARY KEY,
+    user_id  VARCHAR(26) NOT NULL DEFAULT '',
+    event_id VARCHAR NOT NULL,
+    deleted  BOOLEAN NOT NULL DEFAULT false,
+    created  TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_sync_changes_user ON calendar_sync_changes (user_id, id);
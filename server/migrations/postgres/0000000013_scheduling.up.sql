@@ -0,0 +1,11 @@
+ALTER TABLE calendar_members ADD COLUMN IF NOT EXISTS partstat VARCHAR(20) NOT NULL DEFAULT 'NEEDS-ACTION';
+
+CREATE TABLE IF NOT EXISTS calendar_schedule_messages (
+    id       VARCHAR(26) PRIMARY KEY,
+    user_id  VARCHAR(26) NOT NULL,
+    event_id VARCHAR NOT NULL,
+    method   VARCHAR(16) NOT NULL,
+    data     TEXT NOT NULL,
+    created  TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_schedule_messages_user ON calendar_schedule_messages (user_id);
@@ -0,0 +1 @@
+ALTER TABLE calendar_events ADD COLUMN IF NOT EXISTS ical_data TEXT;
@@ -0,0 +1 @@
+ALTER TABLE calendar_events ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE calendar_events ADD COLUMN IF NOT EXISTS recurrence_end timestamp DEFAULT NULL;
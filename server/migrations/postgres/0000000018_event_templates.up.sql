@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS calendar_event_templates (
+    id          VARCHAR(36) PRIMARY KEY,
+    name        VARCHAR(100) NOT NULL,
+    owner       VARCHAR(26) NOT NULL,
+    team        VARCHAR(26) NOT NULL DEFAULT '',
+    title       VARCHAR NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    duration    INTEGER NOT NULL DEFAULT 30,
+    attendees   TEXT NOT NULL DEFAULT '[]',
+    channel     VARCHAR(26) DEFAULT NULL,
+    visibility  VARCHAR(16) NOT NULL DEFAULT 'private',
+    color       VARCHAR(16) DEFAULT NULL,
+    alert       VARCHAR(32) NOT NULL DEFAULT '',
+    created     TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated     TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_event_templates_owner ON calendar_event_templates (owner);
+CREATE INDEX IF NOT EXISTS idx_calendar_event_templates_team ON calendar_event_templates (team);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS calendar_channel_ical_tokens;
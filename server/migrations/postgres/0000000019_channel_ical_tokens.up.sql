@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS calendar_channel_ical_tokens (
+    token      VARCHAR(64) PRIMARY KEY,
+    channel_id VARCHAR(26) NOT NULL UNIQUE,
+    created_by VARCHAR(26) NOT NULL,
+    created    TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_used  TIMESTAMP
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS calendar_channel_widgets (
+    channel_id   VARCHAR(26) PRIMARY KEY,
+    enabled      BOOLEAN NOT NULL DEFAULT TRUE,
+    horizon_days INTEGER NOT NULL DEFAULT 7,
+    event_count  INTEGER NOT NULL DEFAULT 5,
+    timezone     VARCHAR(64) NOT NULL DEFAULT '',
+    post_id      VARCHAR(26) NOT NULL DEFAULT '',
+    message      TEXT NOT NULL DEFAULT '',
+    updated_by   VARCHAR(26) NOT NULL,
+    updated      TIMESTAMP NOT NULL DEFAULT NOW()
+);
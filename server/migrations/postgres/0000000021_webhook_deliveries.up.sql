@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS calendar_webhook_deliveries (
+    id            VARCHAR(26) PRIMARY KEY,
+    url           TEXT NOT NULL,
+    event_type    VARCHAR(32) NOT NULL,
+    event_id      VARCHAR NOT NULL,
+    payload       TEXT NOT NULL,
+    status        VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts      INTEGER NOT NULL DEFAULT 0,
+    next_attempt  TIMESTAMP NOT NULL DEFAULT NOW(),
+    response_code INTEGER NOT NULL DEFAULT 0,
+    last_error    TEXT NOT NULL DEFAULT '',
+    created       TIMESTAMP NOT NULL DEFAULT NOW(),
+    delivered     TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_webhook_deliveries_pending ON calendar_webhook_deliveries (status, next_attempt);
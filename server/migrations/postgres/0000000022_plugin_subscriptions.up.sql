@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS calendar_plugin_subscriptions (
+    plugin_id   VARCHAR(190) PRIMARY KEY,
+    path        VARCHAR(255) NOT NULL,
+    event_types VARCHAR(255) NOT NULL DEFAULT '',
+    created     TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS calendar_api_tokens (
+    token_id    VARCHAR(26) PRIMARY KEY,
+    user_id     VARCHAR(26) NOT NULL,
+    created_by  VARCHAR(26) NOT NULL,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    scopes      VARCHAR(255) NOT NULL DEFAULT '[]',
+    created     TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_calendar_api_tokens_created_by ON calendar_api_tokens (created_by);
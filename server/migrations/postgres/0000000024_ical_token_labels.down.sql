@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_calendar_ical_tokens_user;
+DROP INDEX IF EXISTS idx_calendar_ical_tokens_id;
+DELETE FROM calendar_ical_tokens t USING calendar_ical_tokens n WHERE t.user_id = n.user_id AND (t.created < n.created OR (t.created = n.created AND t.token < n.token));
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS last_used_agent;
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS expires;
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS scope;
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS label;
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS id;
+ALTER TABLE calendar_ical_tokens ADD CONSTRAINT calendar_ical_tokens_user_id_key UNIQUE (user_id);
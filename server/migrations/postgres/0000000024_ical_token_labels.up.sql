@@ -0,0 +1,10 @@
+ALTER TABLE calendar_ical_tokens DROP CONSTRAINT IF EXISTS calendar_ical_tokens_user_id_key;
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS id VARCHAR(26);
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS label VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS scope VARCHAR(16) NOT NULL DEFAULT 'caldav';
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS expires TIMESTAMP;
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS last_used_agent VARCHAR(255) NOT NULL DEFAULT '';
+UPDATE calendar_ical_tokens SET id = SUBSTRING(MD5(token), 1, 26) WHERE id IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_calendar_ical_tokens_id ON calendar_ical_tokens (id);
+CREATE INDEX IF NOT EXISTS idx_calendar_ical_tokens_user ON calendar_ical_tokens (user_id);
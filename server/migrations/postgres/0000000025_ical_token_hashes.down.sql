@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS calendar_ical_token_access;
+DROP INDEX IF EXISTS idx_calendar_ical_tokens_prefix;
+-- hashed tokens can't be restored
+DELETE FROM calendar_ical_tokens WHERE token IS NULL;
+ALTER TABLE calendar_ical_tokens DROP CONSTRAINT IF EXISTS calendar_ical_tokens_pkey;
+ALTER TABLE calendar_ical_tokens ALTER COLUMN token SET NOT NULL;
+ALTER TABLE calendar_ical_tokens ADD PRIMARY KEY (token);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_calendar_ical_tokens_id ON calendar_ical_tokens (id);
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS disabled;
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS token_hash;
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS token_salt;
+ALTER TABLE calendar_ical_tokens DROP COLUMN IF EXISTS token_prefix;
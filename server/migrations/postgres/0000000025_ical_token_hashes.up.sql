@@ -0,0 +1,21 @@
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS token_prefix VARCHAR(8) NOT NULL DEFAULT '';
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS token_salt VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE calendar_ical_tokens ADD COLUMN IF NOT EXISTS disabled TIMESTAMP;
+ALTER TABLE calendar_ical_tokens DROP CONSTRAINT IF EXISTS calendar_ical_tokens_pkey;
+ALTER TABLE calendar_ical_tokens ALTER COLUMN token DROP NOT NULL;
+ALTER TABLE calendar_ical_tokens ALTER COLUMN id SET NOT NULL;
+ALTER TABLE calendar_ical_tokens ADD PRIMARY KEY (id);
+DROP INDEX IF EXISTS idx_calendar_ical_tokens_id;
+
+CREATE INDEX IF NOT EXISTS idx_calendar_ical_tokens_prefix ON calendar_ical_tokens (token_prefix);
+
+CREATE TABLE IF NOT EXISTS calendar_ical_token_access (
+    id         VARCHAR(26) PRIMARY KEY,
+    token_id   VARCHAR(26) NOT NULL,
+    ip         VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    accessed   TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_calendar_ical_token_access_token ON calendar_ical_token_access (token_id, accessed);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS calendar_tasks (
+    id          VARCHAR PRIMARY KEY,
+    title       VARCHAR NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    due         TIMESTAMP DEFAULT NULL,
+    status      VARCHAR(16) NOT NULL DEFAULT 'NEEDS-ACTION',
+    priority    INTEGER NOT NULL DEFAULT 0,
+    completed   TIMESTAMP DEFAULT NULL,
+    owner       VARCHAR(26) NOT NULL,
+    assignee    VARCHAR(26) NOT NULL,
+    ical_data   TEXT DEFAULT NULL,
+    reminded    TIMESTAMP DEFAULT NULL,
+    created     TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated     TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_tasks_owner ON calendar_tasks (owner);
+CREATE INDEX IF NOT EXISTS idx_calendar_tasks_assignee ON calendar_tasks (assignee);
+CREATE INDEX IF NOT EXISTS idx_calendar_tasks_due ON calendar_tasks (due);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS calendar_external_objects;
+DROP TABLE IF EXISTS calendar_external_accounts;
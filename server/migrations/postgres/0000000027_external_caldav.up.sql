@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS calendar_external_accounts (
+    user_id    VARCHAR(26) PRIMARY KEY,
+    url        VARCHAR(1024) NOT NULL,
+    username   VARCHAR(255) NOT NULL DEFAULT '',
+    password   TEXT NOT NULL DEFAULT '',
+    sync_token VARCHAR(1024) NOT NULL DEFAULT '',
+    ctag       VARCHAR(1024) NOT NULL DEFAULT '',
+    last_sync  TIMESTAMP DEFAULT NULL,
+    last_error VARCHAR(1000) NOT NULL DEFAULT '',
+    created    TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated    TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_external_accounts_last_sync ON calendar_external_accounts (last_sync);
+
+CREATE TABLE IF NOT EXISTS calendar_external_objects (
+    user_id         VARCHAR(26) NOT NULL,
+    href            VARCHAR(1024) NOT NULL,
+    uid             VARCHAR(255) NOT NULL,
+    etag            VARCHAR(255) NOT NULL DEFAULT '',
+    event           VARCHAR(255) NOT NULL,
+    remote_modified TIMESTAMP DEFAULT NULL,
+    local_updated   TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, href)
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_external_objects_event ON calendar_external_objects (event);
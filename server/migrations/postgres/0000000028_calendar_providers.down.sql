@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS calendar_provider_events;
+DROP TABLE IF EXISTS calendar_provider_accounts;
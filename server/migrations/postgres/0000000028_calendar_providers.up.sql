@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS calendar_provider_accounts (
+    user_id       VARCHAR(26) NOT NULL,
+    provider      VARCHAR(20) NOT NULL,
+    access_token  TEXT NOT NULL DEFAULT '',
+    refresh_token TEXT NOT NULL DEFAULT '',
+    token_expiry  TIMESTAMP DEFAULT NULL,
+    sync_cursor   TEXT NOT NULL DEFAULT '',
+    last_sync     TIMESTAMP DEFAULT NULL,
+    last_error    VARCHAR(1000) NOT NULL DEFAULT '',
+    created       TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated       TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, provider)
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_provider_accounts_last_sync ON calendar_provider_accounts (last_sync);
+
+CREATE TABLE IF NOT EXISTS calendar_provider_events (
+    user_id        VARCHAR(26) NOT NULL,
+    provider       VARCHAR(20) NOT NULL,
+    remote_id      VARCHAR(512) NOT NULL,
+    event          VARCHAR(255) NOT NULL,
+    remote_updated TIMESTAMP DEFAULT NULL,
+    PRIMARY KEY (user_id, provider, remote_id)
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_provider_events_event ON calendar_provider_events (event);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS calendar_guest_messages;
+DROP TABLE IF EXISTS calendar_guests;
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS calendar_guests (
+    event    VARCHAR NOT NULL REFERENCES calendar_events(id) ON DELETE CASCADE,
+    email    VARCHAR(320) NOT NULL,
+    name     VARCHAR(255) NOT NULL DEFAULT '',
+    partstat VARCHAR(20) NOT NULL DEFAULT 'NEEDS-ACTION',
+    PRIMARY KEY (event, email)
+);
+
+CREATE TABLE IF NOT EXISTS calendar_guest_messages (
+    id           VARCHAR(26) PRIMARY KEY,
+    event_id     VARCHAR NOT NULL,
+    email        VARCHAR(320) NOT NULL,
+    method       VARCHAR(16) NOT NULL,
+    message      TEXT NOT NULL,
+    status       VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts     INTEGER NOT NULL DEFAULT 0,
+    next_attempt TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error   TEXT NOT NULL DEFAULT '',
+    created      TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent         TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_calendar_guest_messages_pending ON calendar_guest_messages (status, next_attempt);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_calendar_channel_ical_tokens_prefix;
+-- hashed tokens can't be restored
+DELETE FROM calendar_channel_ical_tokens WHERE token IS NULL;
+ALTER TABLE calendar_channel_ical_tokens DROP CONSTRAINT IF EXISTS calendar_channel_ical_tokens_pkey;
+ALTER TABLE calendar_channel_ical_tokens ALTER COLUMN token SET NOT NULL;
+ALTER TABLE calendar_channel_ical_tokens ADD PRIMARY KEY (token);
+ALTER TABLE calendar_channel_ical_tokens DROP COLUMN IF EXISTS token_hash;
+ALTER TABLE calendar_channel_ical_tokens DROP COLUMN IF EXISTS token_salt;
+ALTER TABLE calendar_channel_ical_tokens DROP COLUMN IF EXISTS token_prefix;
@@ -0,0 +1,8 @@
+ALTER TABLE calendar_channel_ical_tokens ADD COLUMN IF NOT EXISTS token_prefix VARCHAR(8) NOT NULL DEFAULT '';
+ALTER TABLE calendar_channel_ical_tokens ADD COLUMN IF NOT EXISTS token_salt VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE calendar_channel_ical_tokens ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE calendar_channel_ical_tokens DROP CONSTRAINT IF EXISTS calendar_channel_ical_tokens_pkey;
+ALTER TABLE calendar_channel_ical_tokens ALTER COLUMN token DROP NOT NULL;
+ALTER TABLE calendar_channel_ical_tokens ADD PRIMARY KEY (channel_id);
+
+CREATE INDEX IF NOT EXISTS idx_calendar_channel_ical_tokens_prefix ON calendar_channel_ical_tokens (token_prefix);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_calendar_events_next_notification;
+ALTER TABLE calendar_events DROP COLUMN IF EXISTS next_notification;
@@ -0,0 +1,2 @@
+ALTER TABLE calendar_events ADD COLUMN IF NOT EXISTS next_notification timestamp DEFAULT NULL;
+CREATE INDEX IF NOT EXISTS idx_calendar_events_next_notification ON calendar_events (next_notification);
@@ -0,0 +1,2 @@
+-- the changes recorded for channels and teams aren't read before, the clients sync again from scratch
+DELETE FROM calendar_sync_changes WHERE id < (SELECT MAX(id) FROM calendar_sync_changes);
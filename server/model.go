@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -127,7 +128,10 @@ type Event struct {
 	Description string          `json:"description" db:"description"`
 	Start       time.Time       `json:"start" db:"dt_start"`
 	End         time.Time       `json:"end" db:"dt_end"`
+	AllDay      bool            `json:"allDay" db:"all_day"`
+	Timezone    string          `json:"timezone" db:"timezone"`
 	Attendees   []string        `json:"attendees"`
+	Guests      []EventGuest    `json:"guests,omitempty" db:"-"`
 	Created     time.Time       `json:"created" db:"created"`
 	Updated     time.Time       `json:"updated" db:"updated"`
 	Owner       string          `json:"owner" db:"owner"`
@@ -140,6 +144,11 @@ type Event struct {
 	Visibility  EventVisibility `json:"visibility" db:"visibility"`
 	Alert       EventAlert      `json:"alert" db:"alert"`
 	AlertTime   *time.Time      `json:"alertTime" db:"alert_time"`
+	Version     string          `json:"version,omitempty" db:"-"`
+	// ICalData is the calendar object a CalDAV client stored, kept for the properties the plugin doesn't map
+	ICalData *string `json:"-" db:"ical_data"`
+	// AttendeeStatus is the iCalendar PARTSTAT of every attendee
+	AttendeeStatus map[string]string `json:"-" db:"-"`
 }
 
 type UserSettings struct {
@@ -150,3 +159,88 @@ type UserSettings struct {
 	BusinessDays          []int  `json:"businessDays"`
 	HideNonWorkingDays    bool   `json:"hideNonWorkingDays" db:"hide_non_working_days"`
 }
+
+// StringList is a list of strings stored as a JSON array
+type StringList []string
+
+func (l *StringList) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	case []byte:
+		return json.Unmarshal(v, l)
+	default:
+		return fmt.Errorf("StringList must be a string or []byte, got %T", value)
+	}
+}
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]string(l))
+	return string(data), err
+}
+
+// EventTemplate is a saved event a user instantiates with /cal create --template.
+// Templates with a team are shared with its members, the others are personal.
+type EventTemplate struct {
+	Id          string          `json:"id" db:"id"`
+	Name        string          `json:"name" db:"name"`
+	Owner       string          `json:"owner" db:"owner"`
+	Team        string          `json:"team" db:"team"`
+	Title       string          `json:"title" db:"title"`
+	Description string          `json:"description" db:"description"`
+	Duration    int             `json:"duration" db:"duration"`
+	Attendees   StringList      `json:"attendees" db:"attendees"`
+	Channel     *string         `json:"channel" db:"channel"`
+	Visibility  EventVisibility `json:"visibility" db:"visibility"`
+	Color       *string         `json:"color" db:"color"`
+	Alert       EventAlert      `json:"alert" db:"alert"`
+	Created     time.Time       `json:"created" db:"created"`
+	Updated     time.Time       `json:"updated" db:"updated"`
+}
+
+// TaskStatus is the STATUS of a VTODO (RFC 5545 3.8.1.11)
+type TaskStatus string
+
+const (
+	TaskStatusNeedsAction TaskStatus = "NEEDS-ACTION"
+	TaskStatusInProcess   TaskStatus = "IN-PROCESS"
+	TaskStatusCompleted   TaskStatus = "COMPLETED"
+	TaskStatusCancelled   TaskStatus = "CANCELLED"
+)
+
+func (s TaskStatus) IsValid() bool {
+	switch s {
+	case TaskStatusNeedsAction, TaskStatusInProcess, TaskStatusCompleted, TaskStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// IsOpen reports whether the task is still to be done
+func (s TaskStatus) IsOpen() bool {
+	return s == TaskStatusNeedsAction || s == TaskStatusInProcess
+}
+
+// Task is a to-do of its owner, done by the assignee. It is the VTODO of the CalDAV tasks
+// collection. Priority is 0 when undefined, then 1 (highest) to 9 (lowest).
+type Task struct {
+	Id          string     `json:"id" db:"id"`
+	Title       string     `json:"title" db:"title"`
+	Description string     `json:"description" db:"description"`
+	Due         *time.Time `json:"due" db:"due"`
+	Status      TaskStatus `json:"status" db:"status"`
+	Priority    int        `json:"priority" db:"priority"`
+	Completed   *time.Time `json:"completed" db:"completed"`
+	Owner       string     `json:"owner" db:"owner"`
+	Assignee    string     `json:"assignee" db:"assignee"`
+	ICalData    *string    `json:"-" db:"ical_data"`
+	Reminded    *time.Time `json:"-" db:"reminded"`
+	Created     time.Time  `json:"created" db:"created"`
+	Updated     time.Time  `json:"updated" db:"updated"`
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var providerHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// providerEndpoint are the URLs of a calendar provider, replaced by local servers in tests
+type providerEndpoint struct {
+	AuthURL  string
+	TokenURL string
+	APIURL   string
+}
+
+// oauthClient is the OAuth 2.0 authorization code flow of a provider app (RFC 6749)
+type oauthClient struct {
+	clientID     string
+	clientSecret string
+	endpoint     providerEndpoint
+	scopes       []string
+	// authParams are added to the authorization URL, like the offline access of Google
+	authParams map[string]string
+}
+
+// oauthToken is a token response, the expiry is computed from expires_in when it is received
+type oauthToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int       `json:"expires_in"`
+	Expiry       time.Time `json:"-"`
+}
+
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// authCodeURL returns the URL the user is sent to for consent
+func (c *oauthClient) authCodeURL(state, redirectURL string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", c.clientID)
+	query.Set("redirect_uri", redirectURL)
+	query.Set("scope", strings.Join(c.scopes, " "))
+	query.Set("state", state)
+	for name, value := range c.authParams {
+		query.Set(name, value)
+	}
+
+	separator := "?"
+	if strings.Contains(c.endpoint.AuthURL, "?") {
+		separator = "&"
+	}
+	return c.endpoint.AuthURL + separator + query.Encode()
+}
+
+// exchange trades the authorization code of the callback for a token
+func (c *oauthClient) exchange(code, redirectURL string, now time.Time) (*oauthToken, error) {
+	return c.token(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	}, now)
+}
+
+// refresh returns a new access token. Providers that don't rotate the refresh token leave it out
+// of the response, the current one is kept then.
+func (c *oauthClient) refresh(refreshToken string, now time.Time) (*oauthToken, error) {
+	token, err := c.token(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"scope":         {strings.Join(c.scopes, " ")},
+	}, now)
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	return token, nil
+}
+
+func (c *oauthClient) token(form url.Values, now time.Time) (*oauthToken, error) {
+	form.Set("client_id", c.clientID)
+	form.Set("client_secret", c.clientSecret)
+
+	request, err := http.NewRequest(http.MethodPost, c.endpoint.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	response, err := providerHTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		var failure oauthError
+		if json.Unmarshal(body, &failure) == nil && failure.Error != "" {
+			return nil, fmt.Errorf("token request failed: %s %s", failure.Error, failure.Description)
+		}
+		return nil, fmt.Errorf("token request failed: %s", response.Status)
+	}
+
+	var token oauthToken
+	if err = json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response without access token")
+	}
+	if token.ExpiresIn > 0 {
+		token.Expiry = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return &token, nil
+}
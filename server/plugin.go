@@ -28,6 +28,19 @@ type Plugin struct {
 
 	router *mux.Router
 
+	// recurrences expands the recurring events, caching their parsed rules
+	recurrences *RecurrenceExpander
+
+	// subscriptions are the notifications other plugins subscribed to, by plugin id
+	subscriptionsLock sync.RWMutex
+	subscriptions     map[string]PluginSubscription
+
+	// rateLimiter counts the requests of the API tokens
+	rateLimiter rateLimiter
+
+	// feedCache keeps the rendered iCal feeds until the next event write
+	feedCache feedCache
+
 	DB    *sqlx.DB
 	BotId string
 }
@@ -65,6 +78,7 @@ func (p *Plugin) OnActivate() error {
 
 	db := initDb(*config.SqlSettings.DriverName, *config.SqlSettings.DataSource)
 	p.SetDB(db)
+	p.recurrences = NewRecurrenceExpander()
 
 	migrator := newMigrator(db, p)
 	if errMigrate := migrator.migrate(); errMigrate != nil {
@@ -75,6 +89,30 @@ func (p *Plugin) OnActivate() error {
 		return errMigrate
 	}
 
+	if errMigrate := migrator.migrateEventTimezones(); errMigrate != nil {
+		return errMigrate
+	}
+
+	if errMigrate := migrator.migrateRecurrenceEnds(); errMigrate != nil {
+		return errMigrate
+	}
+
+	if errMigrate := migrator.migrateNextNotifications(); errMigrate != nil {
+		return errMigrate
+	}
+
+	if errMigrate := migrator.migrateICalTokenHashes(); errMigrate != nil {
+		return errMigrate
+	}
+
+	if errMigrate := migrator.migrateChannelICalTokenHashes(); errMigrate != nil {
+		return errMigrate
+	}
+
+	if errLoad := p.loadPluginSubscriptions(); errLoad != nil {
+		p.API.LogError("Can't load the plugin subscriptions: " + errLoad.Error())
+	}
+
 	command, err := p.createCalCommand()
 	if err != nil {
 		return err
@@ -104,10 +104,16 @@ func TestGetEvents(t *testing.T) {
 		},
 		sq.Or{
 			sq.And{
-				sq.GtOrEq{"ce.dt_start": sqlTimeStart},
-				sq.LtOrEq{"ce.dt_start": sqlTimeEnd},
+				sq.Lt{"ce.dt_start": sqlTimeEnd.Add(24 * time.Hour)},
+				sq.Gt{"ce.dt_end": sqlTimeStart.Add(-24 * time.Hour)},
+			},
+			sq.And{
+				sq.Eq{"ce.recurrent": true},
+				sq.Or{
+					sq.Eq{"ce.recurrence_end": nil},
+					sq.GtOrEq{"ce.recurrence_end": sqlTimeStart.Add(-24 * time.Hour)},
+				},
 			},
-			sq.Eq{"ce.recurrent": true},
 		},
 	}
 
@@ -118,6 +124,8 @@ func TestGetEvents(t *testing.T) {
 			"ce.description",
 			"ce.dt_start",
 			"ce.dt_end",
+			"ce.all_day",
+			"ce.timezone",
 			"ce.created",
 			"ce.updated",
 			"ce.owner",
@@ -136,7 +144,7 @@ func TestGetEvents(t *testing.T) {
 
 	expectedQuerySql, _, err := queryBuilder.ToSql()
 	expectedQuery := dbMock.ExpectQuery(regexp.QuoteMeta(expectedQuerySql)).
-		WithArgs(session.UserId, session.UserId, "private", sqlTimeStart, sqlTimeEnd, true)
+		WithArgs(session.UserId, session.UserId, "private", sqlTimeEnd.Add(24*time.Hour), sqlTimeStart.Add(-24*time.Hour), true, sqlTimeStart.Add(-24*time.Hour))
 
 	eventsRow := sqlmock.NewRows([]string{
 		"id",
@@ -155,13 +163,14 @@ func TestGetEvents(t *testing.T) {
 		"visibility",
 		"alert",
 		"alert_time",
+		"timezone",
 	},
 	).AddRow("event-1", "test event 1", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
-		sqlTimeEnd, "owner_id", "channel-id", false, "", nil, "team1", "private", "", nil).AddRow("event-2", "test event 2", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
-		sqlTimeEnd, "owner_id", "channel-id", false, "", "#D0D0D0", "team1", "private", "", nil).AddRow("event-3", "test event 3", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
-		sqlTimeEnd, "owner_id", "channel-id", true, "RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE", "#D0D0D0", "team1", "private", "", nil).AddRow("event-3", "test event 3 another user", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
-		sqlTimeEnd, "owner_id", "channel-id", true, "RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE", "#D0D0D0", "team1", "private", "", nil).AddRow("event-3", "test event 3 another user", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
-		sqlTimeEnd, "owner_id", "channel-id", true, "RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE", "#D0D0D0", "team1", "private", "", nil)
+		sqlTimeEnd, "owner_id", "channel-id", false, "", nil, "team1", "private", "", nil, "").AddRow("event-2", "test event 2", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
+		sqlTimeEnd, "owner_id", "channel-id", false, "", "#D0D0D0", "team1", "private", "", nil, "").AddRow("event-3", "test event 3", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
+		sqlTimeEnd, "owner_id", "channel-id", true, "RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE", "#D0D0D0", "team1", "private", "", nil, "Europe/Moscow").AddRow("event-3", "test event 3 another user", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
+		sqlTimeEnd, "owner_id", "channel-id", true, "RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE", "#D0D0D0", "team1", "private", "", nil, "Europe/Moscow").AddRow("event-3", "test event 3 another user", "", sqlTimeStart, sqlTimeEnd, sqlTimeEnd,
+		sqlTimeEnd, "owner_id", "channel-id", true, "RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE", "#D0D0D0", "team1", "private", "", nil, "Europe/Moscow")
 
 	expectedQuery.WillReturnRows(eventsRow)
 
@@ -187,28 +196,28 @@ func TestGetEvents(t *testing.T) {
 	assert.Nil(err)
 
 	expectedResponse := `{"data":[{"id":"event-1","title":"test event 1","description":"",
-						"start":"2023-02-27T00:00:00+03:00","end":"2023-03-06T00:00:00+03:00",
+						"start":"2023-02-27T00:00:00+03:00","end":"2023-03-06T00:00:00+03:00","allDay":false,"timezone":"",
 						"attendees":null,"created":"2023-03-05T21:00:00Z","updated":"2023-03-05T21:00:00Z",
 						"owner":"owner_id","team":"team1",
 						"channel":"channel-id","recurrence":"","color":"#D0D0D0","visibility":"private","alert":"",
 						"alertTime":null},{"id":"event-2","title":"test event 2","description":"",
-						"start":"2023-02-27T00:00:00+03:00","end":"2023-03-06T00:00:00+03:00","attendees":null,
+						"start":"2023-02-27T00:00:00+03:00","end":"2023-03-06T00:00:00+03:00","allDay":false,"timezone":"","attendees":null,
 						"created":"2023-03-05T21:00:00Z","updated":"2023-03-05T21:00:00Z",
 						"owner":"owner_id","team":"team1","channel":"channel-id",
 						"recurrence":"","color":"#D0D0D0","visibility":"private","alert":"","alertTime":null},
 						{"id":"event-3","title":"test event 3","description":"","start":"2023-02-27T00:00:00+03:00",
-						"end":"2023-03-06T00:00:00+03:00","attendees":null,"created":"2023-03-05T21:00:00Z",
+						"end":"2023-03-06T00:00:00+03:00","allDay":false,"timezone":"Europe/Moscow","attendees":null,"created":"2023-03-05T21:00:00Z",
 						"updated":"2023-03-05T21:00:00Z",
 						"owner":"owner_id","team":"team1","channel":"channel-id",
 						"recurrence":"RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE","color":"#D0D0D0",
 						"visibility":"private","alert":"","alertTime":null},{"id":"event-3","title":"test event 3",
-						"description":"","start":"2023-02-28T00:00:00+03:00","end":"2023-03-07T00:00:00+03:00",
+						"description":"","start":"2023-02-28T00:00:00+03:00","end":"2023-03-07T00:00:00+03:00","allDay":false,"timezone":"Europe/Moscow",
 						"attendees":null,"created":"2023-03-05T21:00:00Z","updated":"2023-03-05T21:00:00Z",
 						"owner":"owner_id","team":"team1",
 						"channel":"channel-id","recurrence":"RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE",
 						"color":"#D0D0D0","visibility":"private","alert":"","alertTime":null},{"id":"event-3",
 						"title":"test event 3","description":"","start":"2023-03-01T00:00:00+03:00",
-						"end":"2023-03-08T00:00:00+03:00","attendees":null,"created":"2023-03-05T21:00:00Z",
+						"end":"2023-03-08T00:00:00+03:00","allDay":false,"timezone":"Europe/Moscow","attendees":null,"created":"2023-03-05T21:00:00Z",
 						"updated":"2023-03-05T21:00:00Z",
 						"owner":"owner_id","team":"team1","channel":"channel-id",
 						"recurrence":"RRULE:FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,TU,WE","color":"#D0D0D0",
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+const (
+	ProviderGoogle    = "google"
+	ProviderMicrosoft = "microsoft"
+
+	// providerSyncInterval is how often the background job polls a provider account
+	providerSyncInterval = 5 * time.Minute
+	// providerSyncBatchSize bounds the accounts polled in one tick
+	providerSyncBatchSize = 10
+	// providerStateTTL is how long the user has to give consent
+	providerStateTTL = 10 * time.Minute
+	// providerTokenMargin refreshes the access tokens expiring sooner
+	providerTokenMargin = time.Minute
+)
+
+// errCursorExpired is returned when the provider doesn't accept the sync token or delta link
+// anymore, every event has to be listed again
+var errCursorExpired = errors.New("sync cursor expired")
+
+var providerNames = []string{ProviderGoogle, ProviderMicrosoft}
+
+// calendarProvider is a calendar service the events of a user are pulled from. The user connects
+// it with OAuth, then the background job polls it for the changes since the last sync.
+type calendarProvider interface {
+	// oauth returns the OAuth client of the app registered with the provider
+	oauth() *oauthClient
+	// changes returns the events changed and removed since the cursor, every event without a
+	// cursor, and the cursor of the next sync
+	changes(accessToken, cursor string, now time.Time) (*providerChanges, error)
+}
+
+// providerEvent is an event of a provider calendar, its times are UTC
+type providerEvent struct {
+	Id          string
+	Title       string
+	Description string
+	Start       time.Time
+	End         time.Time
+	AllDay      bool
+	Timezone    string
+	// Recurrence are the RRULE, EXRULE, RDATE and EXDATE lines of a series
+	Recurrence []string
+	Updated    *time.Time
+}
+
+type providerChanges struct {
+	Events  []providerEvent
+	Removed []string
+	Cursor  string
+}
+
+// ProviderAccount is the connection of a user to a provider, its tokens are encrypted
+type ProviderAccount struct {
+	UserId       string     `json:"user_id" db:"user_id"`
+	Provider     string     `json:"provider" db:"provider"`
+	AccessToken  string     `json:"-" db:"access_token"`
+	RefreshToken string     `json:"-" db:"refresh_token"`
+	TokenExpiry  *time.Time `json:"-" db:"token_expiry"`
+	SyncCursor   string     `json:"-" db:"sync_cursor"`
+	LastSync     *time.Time `json:"last_sync" db:"last_sync"`
+	LastError    string     `json:"last_error" db:"last_error"`
+	Created      time.Time  `json:"created" db:"created"`
+	Updated      time.Time  `json:"updated" db:"updated"`
+}
+
+var providerAccountColumns = []string{
+	"user_id",
+	"provider",
+	"access_token",
+	"refresh_token",
+	"token_expiry",
+	"sync_cursor",
+	"last_sync",
+	"last_error",
+	"created",
+	"updated",
+}
+
+// providerEventLink links an event of the provider to the local event it was imported as
+type providerEventLink struct {
+	UserId        string     `db:"user_id"`
+	Provider      string     `db:"provider"`
+	RemoteId      string     `db:"remote_id"`
+	Event         string     `db:"event"`
+	RemoteUpdated *time.Time `db:"remote_updated"`
+}
+
+var providerEventLinkColumns = []string{"user_id", "provider", "remote_id", "event", "remote_updated"}
+
+// ProviderStatus is a provider as listed for the user
+type ProviderStatus struct {
+	Provider   string     `json:"provider"`
+	Configured bool       `json:"configured"`
+	Connected  bool       `json:"connected"`
+	LastSync   *time.Time `json:"last_sync"`
+	LastError  string     `json:"last_error"`
+}
+
+// calendarProvider returns the provider of the name, nil when it is unknown or its app isn't
+// configured
+func (p *Plugin) calendarProvider(name string) calendarProvider {
+	config := p.getConfiguration()
+	switch name {
+	case ProviderGoogle:
+		if config.GoogleClientID == "" {
+			return nil
+		}
+		return newGoogleProvider(config.GoogleClientID, config.GoogleClientSecret)
+	case ProviderMicrosoft:
+		if config.MicrosoftClientID == "" {
+			return nil
+		}
+		return newMicrosoftProvider(config.MicrosoftClientID, config.MicrosoftClientSecret, config.MicrosoftTenant)
+	}
+	return nil
+}
+
+// providerSiteURL returns the site URL without trailing slash, empty when it isn't configured
+func (p *Plugin) providerSiteURL() string {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		return ""
+	}
+	return strings.TrimSuffix(*siteURL, "/")
+}
+
+// providerRedirectURL returns the callback of the provider registered with its app
+func (p *Plugin) providerRedirectURL(name string) string {
+	siteURL := p.providerSiteURL()
+	if siteURL == "" {
+		return ""
+	}
+	return siteURL + "/plugins/" + PluginId + "/providers/" + name + "/callback"
+}
+
+// providerState returns the OAuth state of a connection, it is sealed with the encryption key so
+// the callback can check whom and which provider it was made for
+func providerState(key []byte, userId, provider string, now time.Time) (string, error) {
+	expiry := strconv.FormatInt(now.Add(providerStateTTL).Unix(), 10)
+	return encryptSecret(key, userId+" "+provider+" "+expiry)
+}
+
+func checkProviderState(key []byte, state, userId, provider string, now time.Time) bool {
+	opened, err := decryptSecret(key, state)
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(opened)
+	if len(fields) != 3 || fields[0] != userId || fields[1] != provider {
+		return false
+	}
+	expiry, err := strconv.ParseInt(fields[2], 10, 64)
+	return err == nil && now.Unix() <= expiry
+}
+
+// setToken stores a token received from the provider encrypted
+func (a *ProviderAccount) setToken(key []byte, token *oauthToken) error {
+	accessToken, err := encryptSecret(key, token.AccessToken)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := encryptSecret(key, token.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	a.AccessToken = accessToken
+	a.RefreshToken = refreshToken
+	a.TokenExpiry = nil
+	if !token.Expiry.IsZero() {
+		expiry := token.Expiry.UTC().Truncate(time.Second)
+		a.TokenExpiry = &expiry
+	}
+	return nil
+}
+
+func (p *Plugin) getProviderAccount(userId, provider string) (*ProviderAccount, *model.AppError) {
+	queryBuilder := sq.Select(providerAccountColumns...).
+		From("calendar_provider_accounts").
+		Where(sq.Eq{"user_id": userId, "provider": provider}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	var account ProviderAccount
+	if errSelect := p.DB.Get(&account, querySql, args...); errSelect != nil {
+		if !errors.Is(errSelect, sql.ErrNoRows) {
+			p.API.LogError(errSelect.Error())
+			return nil, SomethingWentWrong
+		}
+		return nil, ProviderAccountNotFound
+	}
+	return &account, nil
+}
+
+func (p *Plugin) saveProviderAccount(account *ProviderAccount, exists bool) error {
+	var querySql string
+	var args []interface{}
+	if exists {
+		querySql, args, _ = sq.Update("calendar_provider_accounts").
+			SetMap(map[string]interface{}{
+				"access_token":  account.AccessToken,
+				"refresh_token": account.RefreshToken,
+				"token_expiry":  account.TokenExpiry,
+				"sync_cursor":   account.SyncCursor,
+				"last_sync":     account.LastSync,
+				"last_error":    account.LastError,
+				"updated":       account.Updated,
+			}).
+			Where(sq.Eq{"user_id": account.UserId, "provider": account.Provider}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	} else {
+		querySql, args, _ = sq.Insert("calendar_provider_accounts").
+			Columns(providerAccountColumns...).
+			Values(
+				account.UserId,
+				account.Provider,
+				account.AccessToken,
+				account.RefreshToken,
+				account.TokenExpiry,
+				account.SyncCursor,
+				account.LastSync,
+				account.LastError,
+				account.Created,
+				account.Updated,
+			).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	}
+
+	_, err := p.DB.Exec(querySql, args...)
+	return err
+}
+
+func (p *Plugin) getProviderEventLinks(userId, provider string) ([]providerEventLink, error) {
+	querySql, args, _ := sq.Select(providerEventLinkColumns...).
+		From("calendar_provider_events").
+		Where(sq.Eq{"user_id": userId, "provider": provider}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+
+	links := []providerEventLink{}
+	if err := p.DB.Select(&links, querySql, args...); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (p *Plugin) saveProviderEventLink(link *providerEventLink, exists bool) error {
+	var querySql string
+	var args []interface{}
+	if exists {
+		querySql, args, _ = sq.Update("calendar_provider_events").
+			SetMap(map[string]interface{}{
+				"event":          link.Event,
+				"remote_updated": link.RemoteUpdated,
+			}).
+			Where(sq.Eq{"user_id": link.UserId, "provider": link.Provider, "remote_id": link.RemoteId}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	} else {
+		querySql, args, _ = sq.Insert("calendar_provider_events").
+			Columns(providerEventLinkColumns...).
+			Values(link.UserId, link.Provider, link.RemoteId, link.Event, link.RemoteUpdated).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	}
+
+	_, err := p.DB.Exec(querySql, args...)
+	return err
+}
+
+func (p *Plugin) removeProviderEventLink(link *providerEventLink) error {
+	querySql, args, _ := sq.Delete("calendar_provider_events").
+		Where(sq.Eq{"user_id": link.UserId, "provider": link.Provider, "remote_id": link.RemoteId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+	_, err := p.DB.Exec(querySql, args...)
+	return err
+}
+
+// providerAccessToken returns the access token of the account, refreshed when it is about to
+// expire. The refreshed token is saved with the account after the sync.
+func (p *Plugin) providerAccessToken(provider calendarProvider, account *ProviderAccount, key []byte, now time.Time) (string, error) {
+	accessToken, err := decryptSecret(key, account.AccessToken)
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt the access token: %w", err)
+	}
+	if account.TokenExpiry == nil || account.TokenExpiry.After(now.Add(providerTokenMargin)) {
+		return accessToken, nil
+	}
+
+	refreshToken, err := decryptSecret(key, account.RefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt the refresh token: %w", err)
+	}
+	if refreshToken == "" {
+		return "", errors.New("the access token expired, the calendar has to be connected again")
+	}
+
+	token, err := provider.oauth().refresh(refreshToken, now)
+	if err != nil {
+		return "", err
+	}
+	if err = account.setToken(key, token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// syncProviderAccount pulls the changes of the provider since the last sync. An expired cursor
+// lists every event again, the events that weren't listed are removed then.
+func (p *Plugin) syncProviderAccount(account *ProviderAccount, now time.Time) error {
+	provider := p.calendarProvider(account.Provider)
+	if provider == nil {
+		return fmt.Errorf("%s isn't configured", account.Provider)
+	}
+	key, err := p.getConfiguration().encryptionKey()
+	if err != nil {
+		return err
+	}
+
+	accessToken, err := p.providerAccessToken(provider, account, key, now)
+	if err != nil {
+		return err
+	}
+
+	full := account.SyncCursor == ""
+	changes, err := provider.changes(accessToken, account.SyncCursor, now)
+	if errors.Is(err, errCursorExpired) {
+		full = true
+		changes, err = provider.changes(accessToken, "", now)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = p.applyProviderChanges(account, changes, full); err != nil {
+		return err
+	}
+	account.SyncCursor = changes.Cursor
+	return nil
+}
+
+func (p *Plugin) applyProviderChanges(account *ProviderAccount, changes *providerChanges, full bool) error {
+	links, err := p.getProviderEventLinks(account.UserId, account.Provider)
+	if err != nil {
+		return err
+	}
+	byRemote := map[string]*providerEventLink{}
+	for i := range links {
+		byRemote[links[i].RemoteId] = &links[i]
+	}
+
+	backend := NewCalDAVBackend(p, account.UserId, "", "")
+	listed := map[string]bool{}
+	for i := range changes.Events {
+		listed[changes.Events[i].Id] = true
+		if err = p.applyProviderEvent(backend, account, &changes.Events[i], byRemote); err != nil {
+			return err
+		}
+	}
+
+	removed := changes.Removed
+	if full {
+		for remoteId := range byRemote {
+			if !listed[remoteId] {
+				removed = append(removed, remoteId)
+			}
+		}
+	}
+	for _, remoteId := range removed {
+		link, ok := byRemote[remoteId]
+		if !ok {
+			continue
+		}
+		if current, _ := backend.getEventByID(link.Event); current != nil && current.Owner == account.UserId {
+			if err = p.removeImportedEvent(current); err != nil {
+				return err
+			}
+		}
+		if err = p.removeProviderEventLink(link); err != nil {
+			return err
+		}
+		delete(byRemote, remoteId)
+	}
+	return nil
+}
+
+// applyProviderEvent creates or updates the local copy of an event of the provider
+func (p *Plugin) applyProviderEvent(backend *CalDAVBackend, account *ProviderAccount, remote *providerEvent, byRemote map[string]*providerEventLink) error {
+	link, exists := byRemote[remote.Id]
+	var current *Event
+	if exists {
+		current, _ = backend.getEventByID(link.Event)
+		if current != nil && current.Owner != account.UserId {
+			current = nil
+		}
+	}
+	if current != nil && link.RemoteUpdated != nil && remote.Updated != nil && !remote.Updated.After(*link.RemoteUpdated) {
+		return nil
+	}
+
+	event := &Event{
+		Title:       remote.Title,
+		Description: remote.Description,
+		Start:       remote.Start,
+		End:         remote.End,
+		AllDay:      remote.AllDay,
+		Timezone:    remote.Timezone,
+		Owner:       account.UserId,
+		Visibility:  VisibilityPrivate,
+	}
+	if event.AllDay {
+		normalizeAllDay(event)
+	} else if loadLocation(event.Timezone) == nil {
+		event.Timezone = time.UTC.String()
+	}
+	if len(remote.Recurrence) > 0 {
+		if recurrence, errRecurrence := normalizeRecurrence(strings.Join(remote.Recurrence, "\n")); errRecurrence == nil && recurrence != "" {
+			event.Recurrence = recurrence
+			event.Recurrent = true
+		}
+	}
+
+	if current != nil {
+		// the alert and color chosen here are kept
+		event.Id = current.Id
+		event.Created = current.Created
+		event.Team = current.Team
+		event.Color = current.Color
+		event.Alert = current.Alert
+		if event.Alert != EventAlertNone && !event.AllDay {
+			alertTime := event.Start.Add(-1 * EventAlertDurationMap[event.Alert])
+			event.AlertTime = &alertTime
+		} else if event.Alert != EventAlertNone {
+			event.AlertTime = current.AlertTime
+		}
+
+		previous, _ := p.GetEventSyncRecipients(event.Id)
+		if err := backend.updateEvent(event); err != nil {
+			return err
+		}
+		p.RecordEventChange(event.Id, previous)
+		p.enqueueWebhook(WebhookEventUpdated, event)
+	} else {
+		event.Id = uuid.New().String()
+		if err := backend.createEvent(event); err != nil {
+			return err
+		}
+		p.RecordEventChange(event.Id, nil)
+		p.enqueueWebhook(WebhookEventCreated, event)
+	}
+
+	if !exists {
+		link = &providerEventLink{UserId: account.UserId, Provider: account.Provider, RemoteId: remote.Id}
+		byRemote[remote.Id] = link
+	}
+	link.Event = event.Id
+	link.RemoteUpdated = remote.Updated
+	return p.saveProviderEventLink(link, exists)
+}
+
+// syncProviderAccounts polls the provider accounts not synced for providerSyncInterval
+func (p *Plugin) syncProviderAccounts(now time.Time) {
+	queryBuilder := sq.Select(providerAccountColumns...).
+		From("calendar_provider_accounts").
+		Where(sq.Or{
+			sq.Eq{"last_sync": nil},
+			sq.LtOrEq{"last_sync": now.Add(-providerSyncInterval)},
+		}).
+		OrderBy("last_sync").
+		Limit(providerSyncBatchSize).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	accounts := []ProviderAccount{}
+	if errSelect := p.DB.Select(&accounts, querySql, args...); errSelect != nil {
+		p.API.LogError("syncProviderAccounts: " + errSelect.Error())
+		return
+	}
+
+	for i := range accounts {
+		account := &accounts[i]
+
+		account.LastError = ""
+		if errSync := p.syncProviderAccount(account, now); errSync != nil {
+			account.LastError = errSync.Error()
+			if len(account.LastError) > externalErrorMaxSize {
+				account.LastError = account.LastError[:externalErrorMaxSize]
+			}
+			p.API.LogWarn("Calendar provider sync failed", "user", account.UserId, "provider", account.Provider, "error", account.LastError)
+		}
+
+		account.LastSync = &now
+		if errSave := p.saveProviderAccount(account, true); errSave != nil {
+			p.API.LogError("syncProviderAccounts: can't update account: " + errSave.Error())
+		}
+	}
+}
+
+// GetProviders lists the providers with the connection of the user
+func (p *Plugin) GetProviders(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	statuses := make([]ProviderStatus, 0, len(providerNames))
+	for _, name := range providerNames {
+		status := ProviderStatus{
+			Provider:   name,
+			Configured: p.calendarProvider(name) != nil,
+		}
+		account, accountErr := p.getProviderAccount(user.Id, name)
+		if accountErr != nil && accountErr != ProviderAccountNotFound {
+			errorResponse(w, accountErr)
+			return
+		}
+		if account != nil {
+			status.Connected = true
+			status.LastSync = account.LastSync
+			status.LastError = account.LastError
+		}
+		statuses = append(statuses, status)
+	}
+
+	apiResponse(w, statuses)
+}
+
+// ConnectProvider returns the URL the user gives the plugin access to the calendar at
+func (p *Plugin) ConnectProvider(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	name := mux.Vars(r)["provider"]
+	if !contains(providerNames, name) {
+		errorResponse(w, ProviderNotFound)
+		return
+	}
+	provider := p.calendarProvider(name)
+	redirectURL := p.providerRedirectURL(name)
+	if provider == nil || redirectURL == "" {
+		errorResponse(w, ProviderNotConfigured)
+		return
+	}
+	key, errKey := p.getConfiguration().encryptionKey()
+	if errKey != nil {
+		errorResponse(w, EncryptionKeyNotConfigured)
+		return
+	}
+
+	state, errState := providerState(key, user.Id, name, time.Now())
+	if errState != nil {
+		p.API.LogError(errState.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	apiResponse(w, map[string]interface{}{
+		"url": provider.oauth().authCodeURL(state, redirectURL),
+	})
+}
+
+// ProviderCallback completes the connection when the provider sends the user back. The events are
+// imported by the next tick of the background job.
+func (p *Plugin) ProviderCallback(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	name := mux.Vars(r)["provider"]
+	if !contains(providerNames, name) {
+		errorResponse(w, ProviderNotFound)
+		return
+	}
+	provider := p.calendarProvider(name)
+	redirectURL := p.providerRedirectURL(name)
+	if provider == nil || redirectURL == "" {
+		errorResponse(w, ProviderNotConfigured)
+		return
+	}
+	key, errKey := p.getConfiguration().encryptionKey()
+	if errKey != nil {
+		errorResponse(w, EncryptionKeyNotConfigured)
+		return
+	}
+
+	query := r.URL.Query()
+	now := time.Now().UTC().Truncate(time.Second)
+	if !checkProviderState(key, query.Get("state"), user.Id, name, now) {
+		errorResponse(w, InvalidOAuthState)
+		return
+	}
+	if query.Get("error") != "" || query.Get("code") == "" {
+		errorResponse(w, CantConnectProvider)
+		return
+	}
+
+	token, errToken := provider.oauth().exchange(query.Get("code"), redirectURL, now)
+	if errToken != nil {
+		p.API.LogWarn("Calendar provider: can't exchange code", "user", user.Id, "provider", name, "error", errToken.Error())
+		errorResponse(w, CantConnectProvider)
+		return
+	}
+
+	current, currentErr := p.getProviderAccount(user.Id, name)
+	if currentErr != nil && currentErr != ProviderAccountNotFound {
+		errorResponse(w, currentErr)
+		return
+	}
+	account := &ProviderAccount{UserId: user.Id, Provider: name, Created: now}
+	if current != nil {
+		account = current
+	}
+	if errSet := account.setToken(key, token); errSet != nil {
+		p.API.LogError(errSet.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+	// it may be another account of the provider, the first sync lists every event and removes
+	// the events imported before that aren't listed
+	account.SyncCursor = ""
+	account.LastSync = nil
+	account.LastError = ""
+	account.Updated = now
+
+	if errSave := p.saveProviderAccount(account, current != nil); errSave != nil {
+		p.API.LogError(errSave.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	http.Redirect(w, r, p.providerSiteURL()+"/", http.StatusFound)
+}
+
+// DisconnectProvider stops the sync with the provider and removes the events imported from it
+func (p *Plugin) DisconnectProvider(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	name := mux.Vars(r)["provider"]
+	if !contains(providerNames, name) {
+		errorResponse(w, ProviderNotFound)
+		return
+	}
+	if _, accountErr := p.getProviderAccount(user.Id, name); accountErr != nil {
+		errorResponse(w, accountErr)
+		return
+	}
+
+	links, errLinks := p.getProviderEventLinks(user.Id, name)
+	if errLinks != nil {
+		p.API.LogError(errLinks.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+	backend := NewCalDAVBackend(p, user.Id, "", "")
+	for i := range links {
+		if current, _ := backend.getEventByID(links[i].Event); current != nil && current.Owner == user.Id {
+			if errRemove := p.removeImportedEvent(current); errRemove != nil {
+				p.API.LogError(errRemove.Error())
+				errorResponse(w, SomethingWentWrong)
+				return
+			}
+		}
+	}
+
+	for _, table := range []string{"calendar_provider_events", "calendar_provider_accounts"} {
+		querySql, args, _ := sq.Delete(table).
+			Where(sq.Eq{"user_id": user.Id, "provider": name}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+		if _, errDelete := p.DB.Exec(querySql, args...); errDelete != nil {
+			p.API.LogError(errDelete.Error())
+			errorResponse(w, SomethingWentWrong)
+			return
+		}
+	}
+
+	apiResponse(w, map[string]interface{}{
+		"success": true,
+	})
+}
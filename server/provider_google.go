@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// googleEndpoint are the Google OAuth and Calendar API URLs
+var googleEndpoint = providerEndpoint{
+	AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+	TokenURL: "https://oauth2.googleapis.com/token",
+	APIURL:   "https://www.googleapis.com/calendar/v3",
+}
+
+const googleCalendarScope = "https://www.googleapis.com/auth/calendar.readonly"
+
+// googleProvider pulls the primary calendar of a Google account with the sync tokens of the
+// events list (https://developers.google.com/calendar/api/guides/sync)
+type googleProvider struct {
+	client *oauthClient
+}
+
+type googleEventTime struct {
+	Date     string `json:"date"`
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
+type googleEvent struct {
+	Id               string          `json:"id"`
+	Status           string          `json:"status"`
+	Summary          string          `json:"summary"`
+	Description      string          `json:"description"`
+	Start            googleEventTime `json:"start"`
+	End              googleEventTime `json:"end"`
+	Recurrence       []string        `json:"recurrence"`
+	RecurringEventId string          `json:"recurringEventId"`
+	Updated          string          `json:"updated"`
+}
+
+type googleEventList struct {
+	Items         []googleEvent `json:"items"`
+	NextPageToken string        `json:"nextPageToken"`
+	NextSyncToken string        `json:"nextSyncToken"`
+}
+
+func newGoogleProvider(clientID, clientSecret string) *googleProvider {
+	return &googleProvider{
+		client: &oauthClient{
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			endpoint:     googleEndpoint,
+			scopes:       []string{googleCalendarScope},
+			// a refresh token is only given with offline access, consent asks for it again
+			authParams: map[string]string{
+				"access_type": "offline",
+				"prompt":      "consent",
+			},
+		},
+	}
+}
+
+func (g *googleProvider) oauth() *oauthClient {
+	return g.client
+}
+
+// changes pages through the events list. Without a sync token every event is listed, the
+// cancelled ones are left out, with it the cancelled ones are the removed events.
+func (g *googleProvider) changes(accessToken, cursor string, now time.Time) (*providerChanges, error) {
+	changes := &providerChanges{}
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("maxResults", "250")
+		if cursor != "" {
+			query.Set("syncToken", cursor)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		var list googleEventList
+		if err := g.get(accessToken, "/calendars/primary/events?"+query.Encode(), &list); err != nil {
+			return nil, err
+		}
+
+		for i := range list.Items {
+			item := &list.Items[i]
+			// changes of a single occurrence aren't imported, the series is
+			if item.RecurringEventId != "" {
+				continue
+			}
+			if item.Status == "cancelled" {
+				changes.Removed = append(changes.Removed, item.Id)
+				continue
+			}
+			event, err := item.providerEvent()
+			if err != nil {
+				return nil, err
+			}
+			changes.Events = append(changes.Events, *event)
+		}
+
+		if list.NextPageToken == "" {
+			changes.Cursor = list.NextSyncToken
+			return changes, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+func (g *googleProvider) get(accessToken, path string, result interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, g.client.endpoint.APIURL+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set("Accept", "application/json")
+
+	response, err := providerHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, caldavClientMaxBody))
+	if err != nil {
+		return err
+	}
+	switch {
+	case response.StatusCode == http.StatusGone:
+		return errCursorExpired
+	case response.StatusCode != http.StatusOK:
+		return fmt.Errorf("Google Calendar: unexpected status %s", response.Status)
+	}
+
+	if err = json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("Google Calendar: invalid response: %w", err)
+	}
+	return nil
+}
+
+func (e *googleEvent) providerEvent() (*providerEvent, error) {
+	event := &providerEvent{
+		Id:          e.Id,
+		Title:       e.Summary,
+		Description: e.Description,
+		Timezone:    e.Start.TimeZone,
+		Recurrence:  e.Recurrence,
+	}
+
+	var err error
+	if e.Start.Date != "" {
+		event.AllDay = true
+		if event.Start, err = time.Parse("2006-01-02", e.Start.Date); err != nil {
+			return nil, fmt.Errorf("Google Calendar: invalid start of %s: %w", e.Id, err)
+		}
+		if event.End, err = time.Parse("2006-01-02", e.End.Date); err != nil {
+			event.End = event.Start.AddDate(0, 0, 1)
+		}
+	} else {
+		if event.Start, err = time.Parse(time.RFC3339, e.Start.DateTime); err != nil {
+			return nil, fmt.Errorf("Google Calendar: invalid start of %s: %w", e.Id, err)
+		}
+		if event.End, err = time.Parse(time.RFC3339, e.End.DateTime); err != nil {
+			event.End = event.Start
+		}
+		event.Start = event.Start.UTC()
+		event.End = event.End.UTC()
+	}
+
+	if updated, errUpdated := time.Parse(time.RFC3339, e.Updated); errUpdated == nil {
+		updated = updated.UTC()
+		event.Updated = &updated
+	}
+	return event, nil
+}
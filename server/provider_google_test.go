@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newGoogleTestProvider(t *testing.T) (*googleProvider, *providerTestServer) {
+	server := newProviderTestServer(t, "google", func(r *http.Request) (int, string) {
+		if r.Header.Get("Authorization") != "Bearer ya29.a0AfB_byC-access" || r.URL.Path != "/calendar/v3/calendars/primary/events" {
+			return http.StatusUnauthorized, ""
+		}
+		query := r.URL.Query()
+		switch {
+		case query.Get("syncToken") == "expired":
+			return http.StatusGone, "sync_token_expired.json"
+		case query.Get("syncToken") == "CPDAlvWDx70CEPDAlvWDx70CGAU=":
+			return http.StatusOK, "events_incremental.json"
+		case query.Get("pageToken") == "CigKGjBiN2Q4cDZ2NjA":
+			return http.StatusOK, "events_full_2.json"
+		case query.Get("syncToken") == "" && query.Get("pageToken") == "":
+			return http.StatusOK, "events_full_1.json"
+		}
+		return http.StatusBadRequest, ""
+	})
+
+	provider := newGoogleProvider("client-id", "client-secret")
+	provider.client.endpoint = server.endpoint("/calendar/v3")
+	return provider, server
+}
+
+func TestGoogleProvider_FullSync(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server := newGoogleTestProvider(t)
+	defer server.Close()
+
+	changes, err := provider.changes("ya29.a0AfB_byC-access", "", time.Now())
+	assert.Nil(err)
+	assert.Equal("CPDAlvWDx70CEPDAlvWDx70CGAU=", changes.Cursor)
+	assert.Empty(changes.Removed)
+	// the moved occurrence of the standup isn't imported
+	assert.Len(changes.Events, 3)
+
+	planning := changes.Events[0]
+	assert.Equal("0b7d8p6v60rc3rk1uv7l4m5c2b", planning.Id)
+	assert.Equal("Quarterly planning", planning.Title)
+	assert.Equal("Room 4.12", planning.Description)
+	assert.Equal(time.Date(2024, 3, 15, 9, 0, 0, 0, time.UTC), planning.Start)
+	assert.Equal(time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC), planning.End)
+	assert.Equal("Europe/Berlin", planning.Timezone)
+	assert.False(planning.AllDay)
+	assert.Equal(time.Date(2024, 2, 28, 16, 4, 33, 86000000, time.UTC), *planning.Updated)
+
+	standup := changes.Events[1]
+	assert.Equal("Team standup", standup.Title)
+	assert.Equal([]string{"RRULE:FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR"}, standup.Recurrence)
+
+	offsite := changes.Events[2]
+	assert.Equal("Company offsite", offsite.Title)
+	assert.True(offsite.AllDay)
+	assert.Equal(time.Date(2024, 4, 10, 0, 0, 0, 0, time.UTC), offsite.Start)
+	assert.Equal(time.Date(2024, 4, 12, 0, 0, 0, 0, time.UTC), offsite.End)
+}
+
+func TestGoogleProvider_IncrementalSync(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server := newGoogleTestProvider(t)
+	defer server.Close()
+
+	changes, err := provider.changes("ya29.a0AfB_byC-access", "CPDAlvWDx70CEPDAlvWDx70CGAU=", time.Now())
+	assert.Nil(err)
+	assert.Equal("CKCbrLqEx70CEKCbrLqEx70CGAU=", changes.Cursor)
+	assert.Len(changes.Events, 1)
+	assert.Equal(time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC), changes.Events[0].Start)
+	assert.Equal("Room 5.01", changes.Events[0].Description)
+	assert.Equal([]string{"6h9k2m0q3c1e8a4s7d5f0g2j4l"}, changes.Removed)
+}
+
+func TestGoogleProvider_Errors(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server := newGoogleTestProvider(t)
+	defer server.Close()
+
+	_, err := provider.changes("ya29.a0AfB_byC-access", "expired", time.Now())
+	assert.ErrorIs(err, errCursorExpired)
+
+	_, err = provider.changes("revoked", "", time.Now())
+	assert.EqualError(err, "Google Calendar: unexpected status 401 Unauthorized")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// microsoftEndpoint are the Microsoft identity platform and Graph URLs, common is replaced by the
+// configured tenant
+var microsoftEndpoint = providerEndpoint{
+	AuthURL:  "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+	TokenURL: "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+	APIURL:   "https://graph.microsoft.com/v1.0",
+}
+
+const (
+	// microsoftSyncPast and microsoftSyncFuture are the window of the calendar view, Graph only
+	// tracks the changes of the occurrences in a fixed range
+	microsoftSyncPast   = 30 * 24 * time.Hour
+	microsoftSyncFuture = 365 * 24 * time.Hour
+
+	microsoftDateTimeLayout = "2006-01-02T15:04:05.9999999"
+)
+
+// microsoftProvider pulls the default calendar of a Microsoft 365 account with the delta query of
+// its calendar view (https://learn.microsoft.com/graph/delta-query-events). The series are
+// expanded, every occurrence is an event.
+type microsoftProvider struct {
+	client *oauthClient
+}
+
+type microsoftDateTime struct {
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
+type microsoftEvent struct {
+	Id                    string            `json:"id"`
+	Subject               string            `json:"subject"`
+	BodyPreview           string            `json:"bodyPreview"`
+	Start                 microsoftDateTime `json:"start"`
+	End                   microsoftDateTime `json:"end"`
+	IsAllDay              bool              `json:"isAllDay"`
+	IsCancelled           bool              `json:"isCancelled"`
+	OriginalStartTimeZone string            `json:"originalStartTimeZone"`
+	LastModifiedDateTime  string            `json:"lastModifiedDateTime"`
+	Removed               *struct {
+		Reason string `json:"reason"`
+	} `json:"@removed"`
+}
+
+type microsoftDelta struct {
+	Value     []microsoftEvent `json:"value"`
+	NextLink  string           `json:"@odata.nextLink"`
+	DeltaLink string           `json:"@odata.deltaLink"`
+}
+
+type microsoftError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newMicrosoftProvider(clientID, clientSecret, tenant string) *microsoftProvider {
+	endpoint := microsoftEndpoint
+	if tenant = strings.TrimSpace(tenant); tenant != "" {
+		endpoint.AuthURL = strings.Replace(endpoint.AuthURL, "/common/", "/"+url.PathEscape(tenant)+"/", 1)
+		endpoint.TokenURL = strings.Replace(endpoint.TokenURL, "/common/", "/"+url.PathEscape(tenant)+"/", 1)
+	}
+
+	return &microsoftProvider{
+		client: &oauthClient{
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			endpoint:     endpoint,
+			scopes:       []string{"offline_access", "Calendars.Read"},
+			authParams: map[string]string{
+				"response_mode": "query",
+			},
+		},
+	}
+}
+
+func (m *microsoftProvider) oauth() *oauthClient {
+	return m.client
+}
+
+// changes follows the next links of the delta query up to its delta link, the cursor of the next
+// sync. Without a cursor the delta query starts over for the window around now.
+func (m *microsoftProvider) changes(accessToken, cursor string, now time.Time) (*providerChanges, error) {
+	link := cursor
+	if link == "" {
+		query := url.Values{}
+		query.Set("startDateTime", now.Add(-microsoftSyncPast).UTC().Format(time.RFC3339))
+		query.Set("endDateTime", now.Add(microsoftSyncFuture).UTC().Format(time.RFC3339))
+		link = m.client.endpoint.APIURL + "/me/calendarView/delta?" + query.Encode()
+	}
+
+	changes := &providerChanges{}
+	for {
+		var delta microsoftDelta
+		if err := m.get(accessToken, link, &delta); err != nil {
+			return nil, err
+		}
+
+		for i := range delta.Value {
+			item := &delta.Value[i]
+			if item.Removed != nil || item.IsCancelled {
+				changes.Removed = append(changes.Removed, item.Id)
+				continue
+			}
+			event, err := item.providerEvent()
+			if err != nil {
+				return nil, err
+			}
+			changes.Events = append(changes.Events, *event)
+		}
+
+		if delta.NextLink == "" {
+			changes.Cursor = delta.DeltaLink
+			return changes, nil
+		}
+		link = delta.NextLink
+	}
+}
+
+func (m *microsoftProvider) get(accessToken, link string, result interface{}) error {
+	// the links of the responses are only followed to Graph, the access token is sent with them
+	if !strings.HasPrefix(link, m.client.endpoint.APIURL+"/") {
+		return fmt.Errorf("Microsoft Graph: unexpected link %s", link)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Prefer", `odata.maxpagesize=100, outlook.timezone="UTC"`)
+
+	response, err := providerHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, caldavClientMaxBody))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode == http.StatusGone {
+		return errCursorExpired
+	}
+	if response.StatusCode != http.StatusOK {
+		var failure microsoftError
+		if json.Unmarshal(body, &failure) == nil && failure.Error.Code == "syncStateNotFound" {
+			return errCursorExpired
+		}
+		return fmt.Errorf("Microsoft Graph: unexpected status %s", response.Status)
+	}
+
+	if err = json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("Microsoft Graph: invalid response: %w", err)
+	}
+	return nil
+}
+
+func (e *microsoftEvent) providerEvent() (*providerEvent, error) {
+	parse := microsoftTime
+	if e.IsAllDay {
+		parse = microsoftDate
+	}
+	start, err := parse(e.Start)
+	if err != nil {
+		return nil, fmt.Errorf("Microsoft Graph: invalid start of %s: %w", e.Id, err)
+	}
+	end, err := parse(e.End)
+	if err != nil {
+		end = start
+	}
+
+	event := &providerEvent{
+		Id:          e.Id,
+		Title:       e.Subject,
+		Description: e.BodyPreview,
+		Start:       start,
+		End:         end,
+		AllDay:      e.IsAllDay,
+	}
+	// Outlook names most zones the Windows way, like "W. Europe Standard Time"
+	zone := e.OriginalStartTimeZone
+	if name, ok := windowsTimezones[zone]; ok {
+		zone = name
+	}
+	if loadLocation(zone) != nil {
+		event.Timezone = zone
+	}
+
+	if updated, errUpdated := time.Parse(time.RFC3339, e.LastModifiedDateTime); errUpdated == nil {
+		updated = updated.UTC()
+		event.Updated = &updated
+	}
+	return event, nil
+}
+
+// microsoftTime parses a Graph dateTimeTimeZone, UTC unless the zone is an IANA name
+func microsoftTime(value microsoftDateTime) (time.Time, error) {
+	loc := time.UTC
+	if zone := loadLocation(value.TimeZone); zone != nil {
+		loc = zone
+	}
+	t, err := time.ParseInLocation(microsoftDateTimeLayout, value.DateTime, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// microsoftDate returns the date of an all-day event, midnight in the zone of the event
+func microsoftDate(value microsoftDateTime) (time.Time, error) {
+	if len(value.DateTime) < len("2006-01-02") {
+		return time.Time{}, fmt.Errorf("invalid date %q", value.DateTime)
+	}
+	return time.Parse("2006-01-02", value.DateTime[:len("2006-01-02")])
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMicrosoftTestProvider(t *testing.T) (*microsoftProvider, *providerTestServer) {
+	server := newProviderTestServer(t, "microsoft", func(r *http.Request) (int, string) {
+		if r.Header.Get("Authorization") != "Bearer eyJ0eXAiOiJKV1QiLCJub25jZSI6-access" || r.URL.Path != "/v1.0/me/calendarView/delta" {
+			return http.StatusUnauthorized, ""
+		}
+		if r.Header.Get("Prefer") != `odata.maxpagesize=100, outlook.timezone="UTC"` {
+			return http.StatusBadRequest, ""
+		}
+		query := r.URL.Query()
+		switch {
+		case query.Get("$deltatoken") == "expired":
+			return http.StatusBadRequest, "sync_state_not_found.json"
+		case query.Get("$deltatoken") == "R0usmci39OQxqJrxK4":
+			return http.StatusOK, "delta_incremental.json"
+		case query.Get("$skiptoken") == "R0usmcCM996atia_s":
+			return http.StatusOK, "delta_2.json"
+		case query.Get("startDateTime") == "2024-01-31T12:00:00Z" && query.Get("endDateTime") == "2025-03-01T12:00:00Z":
+			return http.StatusOK, "delta_1.json"
+		}
+		return http.StatusBadRequest, ""
+	})
+
+	provider := newMicrosoftProvider("client-id", "client-secret", "")
+	provider.client.endpoint = server.endpoint("/v1.0")
+	return provider, server
+}
+
+func TestNewMicrosoftProvider_Tenant(t *testing.T) {
+	assert := assert.New(t)
+
+	provider := newMicrosoftProvider("client-id", "client-secret", "contoso.onmicrosoft.com")
+	assert.Equal("https://login.microsoftonline.com/contoso.onmicrosoft.com/oauth2/v2.0/authorize", provider.client.endpoint.AuthURL)
+	assert.Equal("https://login.microsoftonline.com/contoso.onmicrosoft.com/oauth2/v2.0/token", provider.client.endpoint.TokenURL)
+
+	authURL, _ := url.Parse(provider.oauth().authCodeURL("state-1", "https://chat.example.com/callback"))
+	assert.Equal("offline_access Calendars.Read", authURL.Query().Get("scope"))
+	assert.Equal("query", authURL.Query().Get("response_mode"))
+
+	provider = newMicrosoftProvider("client-id", "client-secret", " ")
+	assert.Equal(microsoftEndpoint, provider.client.endpoint)
+}
+
+func TestMicrosoftProvider_FullSync(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server := newMicrosoftTestProvider(t)
+	defer server.Close()
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	changes, err := provider.changes("eyJ0eXAiOiJKV1QiLCJub25jZSI6-access", "", now)
+	assert.Nil(err)
+	assert.Equal(server.URL+"/v1.0/me/calendarView/delta?$deltatoken=R0usmci39OQxqJrxK4", changes.Cursor)
+	assert.Empty(changes.Removed)
+	assert.Len(changes.Events, 2)
+
+	call := changes.Events[0]
+	assert.Equal("AAMkAGI2TGuLAAA=", call.Id)
+	assert.Equal("Customer call", call.Title)
+	assert.Equal("Agenda: renewal", call.Description)
+	assert.Equal(time.Date(2024, 3, 15, 9, 0, 0, 0, time.UTC), call.Start)
+	assert.Equal(time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC), call.End)
+	assert.Equal("Europe/Berlin", call.Timezone)
+	assert.Equal(time.Date(2024, 2, 28, 16, 4, 33, 86846200, time.UTC), *call.Updated)
+
+	offsite := changes.Events[1]
+	assert.True(offsite.AllDay)
+	assert.Equal(time.Date(2024, 4, 10, 0, 0, 0, 0, time.UTC), offsite.Start)
+	assert.Equal(time.Date(2024, 4, 12, 0, 0, 0, 0, time.UTC), offsite.End)
+}
+
+func TestMicrosoftProvider_IncrementalSync(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server := newMicrosoftTestProvider(t)
+	defer server.Close()
+
+	changes, err := provider.changes("eyJ0eXAiOiJKV1QiLCJub25jZSI6-access", server.URL+"/v1.0/me/calendarView/delta?$deltatoken=R0usmci39OQxqJrxK4", time.Now())
+	assert.Nil(err)
+	assert.Equal(server.URL+"/v1.0/me/calendarView/delta?$deltatoken=R0usmcMDNGg0J1E", changes.Cursor)
+	assert.Len(changes.Events, 1)
+	assert.Equal(time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC), changes.Events[0].Start)
+	assert.Equal([]string{"AAMkAGI2TGuMAAA="}, changes.Removed)
+}
+
+func TestMicrosoftProvider_Errors(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server := newMicrosoftTestProvider(t)
+	defer server.Close()
+
+	_, err := provider.changes("eyJ0eXAiOiJKV1QiLCJub25jZSI6-access", server.URL+"/v1.0/me/calendarView/delta?$deltatoken=expired", time.Now())
+	assert.ErrorIs(err, errCursorExpired)
+
+	// the access token is only sent to Graph
+	_, err = provider.changes("eyJ0eXAiOiJKV1QiLCJub25jZSI6-access", "https://attacker.example.com/v1.0/me/calendarView/delta", time.Now())
+	assert.EqualError(err, "Microsoft Graph: unexpected link https://attacker.example.com/v1.0/me/calendarView/delta")
+	assert.Len(server.requests, 1)
+}
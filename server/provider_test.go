@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+)
+
+// providerTestServer replays the responses recorded from a provider API in testdata/providers.
+// route picks the status and the file of a request, the links to the provider in the files point
+// to the test server.
+type providerTestServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	forms    []url.Values
+}
+
+func newProviderTestServer(t *testing.T, dir string, route func(r *http.Request) (int, string)) *providerTestServer {
+	s := &providerTestServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.forms = append(s.forms, r.PostForm)
+		s.mu.Unlock()
+
+		status, name := route(r)
+		if name == "" {
+			w.WriteHeader(status)
+			return
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", "providers", dir, name))
+		if err != nil {
+			t.Errorf("can't read %s: %s", name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body := strings.NewReplacer(
+			"https://graph.microsoft.com", s.URL,
+			"https://www.googleapis.com", s.URL,
+		).Replace(string(data))
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	return s
+}
+
+func (s *providerTestServer) endpoint(apiPath string) providerEndpoint {
+	return providerEndpoint{
+		AuthURL:  s.URL + "/authorize",
+		TokenURL: s.URL + "/token",
+		APIURL:   s.URL + apiPath,
+	}
+}
+
+// tokenForm returns the form of the last token request
+func (s *providerTestServer) tokenForm() url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.requests) - 1; i >= 0; i-- {
+		if s.requests[i].URL.Path == "/token" {
+			return s.forms[i]
+		}
+	}
+	return nil
+}
+
+func TestOAuthClient(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newProviderTestServer(t, "google", func(r *http.Request) (int, string) {
+		if r.PostForm.Get("code") == "denied" {
+			return http.StatusBadRequest, "token_error.json"
+		}
+		return http.StatusOK, "token.json"
+	})
+	defer server.Close()
+
+	client := &oauthClient{
+		clientID:     "client-id",
+		clientSecret: "client-secret",
+		endpoint:     server.endpoint("/calendar/v3"),
+		scopes:       []string{googleCalendarScope},
+		authParams:   map[string]string{"access_type": "offline"},
+	}
+
+	authURL, err := url.Parse(client.authCodeURL("state-1", "https://chat.example.com/callback"))
+	assert.Nil(err)
+	assert.Equal("/authorize", authURL.Path)
+	assert.Equal("code", authURL.Query().Get("response_type"))
+	assert.Equal("client-id", authURL.Query().Get("client_id"))
+	assert.Equal("https://chat.example.com/callback", authURL.Query().Get("redirect_uri"))
+	assert.Equal(googleCalendarScope, authURL.Query().Get("scope"))
+	assert.Equal("state-1", authURL.Query().Get("state"))
+	assert.Equal("offline", authURL.Query().Get("access_type"))
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	token, err := client.exchange("code-1", "https://chat.example.com/callback", now)
+	assert.Nil(err)
+	assert.Equal("ya29.a0AfB_byC-access", token.AccessToken)
+	assert.Equal("1//0gA-refresh", token.RefreshToken)
+	assert.Equal(now.Add(3599*time.Second), token.Expiry)
+	form := server.tokenForm()
+	assert.Equal("authorization_code", form.Get("grant_type"))
+	assert.Equal("code-1", form.Get("code"))
+	assert.Equal("client-secret", form.Get("client_secret"))
+
+	_, err = client.exchange("denied", "https://chat.example.com/callback", now)
+	assert.EqualError(err, "token request failed: invalid_grant Bad Request")
+
+	token, err = client.refresh("1//0gA-refresh", now)
+	assert.Nil(err)
+	assert.Equal("refresh_token", server.tokenForm().Get("grant_type"))
+	assert.Equal("1//0gA-refresh", server.tokenForm().Get("refresh_token"))
+	assert.Equal("ya29.a0AfB_byC-access", token.AccessToken)
+}
+
+func TestOAuthClient_RefreshKeepsRefreshToken(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newProviderTestServer(t, "google", func(r *http.Request) (int, string) {
+		return http.StatusOK, "token_refreshed.json"
+	})
+	defer server.Close()
+
+	client := newGoogleProvider("client-id", "client-secret").oauth()
+	client.endpoint = server.endpoint("/calendar/v3")
+
+	token, err := client.refresh("1//0gA-refresh", time.Now())
+	assert.Nil(err)
+	assert.Equal("ya29.a0AfB_byC-refreshed", token.AccessToken)
+	assert.Equal("1//0gA-refresh", token.RefreshToken)
+}
+
+func TestProviderState(t *testing.T) {
+	assert := assert.New(t)
+
+	key, _ := (&configuration{EncryptionKey: testEncryptionKey}).encryptionKey()
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	state, err := providerState(key, "test-user", ProviderGoogle, now)
+	assert.Nil(err)
+
+	assert.True(checkProviderState(key, state, "test-user", ProviderGoogle, now.Add(time.Minute)))
+	assert.False(checkProviderState(key, state, "other-user", ProviderGoogle, now))
+	assert.False(checkProviderState(key, state, "test-user", ProviderMicrosoft, now))
+	assert.False(checkProviderState(key, state, "test-user", ProviderGoogle, now.Add(providerStateTTL+time.Second)))
+	assert.False(checkProviderState(key, "test-user google 9999999999", "test-user", ProviderGoogle, now))
+
+	other, _ := (&configuration{EncryptionKey: "other-key"}).encryptionKey()
+	assert.False(checkProviderState(other, state, "test-user", ProviderGoogle, now))
+}
+
+func newProviderTestPlugin(t *testing.T, method, path string, config *configuration) (*Plugin, *plugintest.API, sqlmock.Sqlmock, func()) {
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, method, path)
+	siteURL := "https://chat.example.com"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}}).Maybe()
+	calPlugin.setConfiguration(config)
+	return calPlugin, api, dbMock, closeDB
+}
+
+func TestConnectProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, _, closeDB := newProviderTestPlugin(t, "POST", "/providers/google/connect", &configuration{
+		EncryptionKey:  testEncryptionKey,
+		GoogleClientID: "client-id",
+	})
+	defer closeDB()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/providers/google/connect", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	var response struct {
+		Data struct {
+			URL string `json:"url"`
+		} `json:"data"`
+	}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+	authURL, err := url.Parse(response.Data.URL)
+	assert.Nil(err)
+	assert.Equal("accounts.google.com", authURL.Host)
+	assert.Equal("https://chat.example.com/plugins/com.dmkir.calendar/providers/google/callback", authURL.Query().Get("redirect_uri"))
+	key, _ := calPlugin.getConfiguration().encryptionKey()
+	assert.True(checkProviderState(key, authURL.Query().Get("state"), "test-user", ProviderGoogle, time.Now()))
+}
+
+func TestConnectProvider_NotConfigured(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/providers/microsoft/connect", http.StatusNotImplemented},
+		{"/providers/yahoo/connect", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			calPlugin, _, _, closeDB := newProviderTestPlugin(t, "POST", tt.path, &configuration{
+				EncryptionKey:  testEncryptionKey,
+				GoogleClientID: "client-id",
+			})
+			defer closeDB()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", tt.path, nil)
+			calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestProviderCallback(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newProviderTestServer(t, "google", func(r *http.Request) (int, string) {
+		return http.StatusOK, "token.json"
+	})
+	defer server.Close()
+	previous := googleEndpoint
+	googleEndpoint = server.endpoint("/calendar/v3")
+	defer func() { googleEndpoint = previous }()
+
+	calPlugin, _, dbMock, closeDB := newProviderTestPlugin(t, "GET", "/providers/google/callback", &configuration{
+		EncryptionKey:      testEncryptionKey,
+		GoogleClientID:     "client-id",
+		GoogleClientSecret: "client-secret",
+	})
+	defer closeDB()
+	key, _ := calPlugin.getConfiguration().encryptionKey()
+	state, _ := providerState(key, "test-user", ProviderGoogle, time.Now())
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_provider_accounts WHERE provider = $1 AND user_id = $2")).
+		WithArgs(ProviderGoogle, "test-user").
+		WillReturnRows(sqlmock.NewRows(providerAccountColumns))
+	var accessToken string
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_provider_accounts")).
+		WithArgs("test-user", ProviderGoogle, passwordArg{&accessToken}, sqlmock.AnyArg(), sqlmock.AnyArg(), "", nil, "", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/providers/google/callback?code=code-1&state="+url.QueryEscape(state), nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusFound, w.Code)
+	assert.Equal("https://chat.example.com/", w.Header().Get("Location"))
+	assert.Equal("https://chat.example.com/plugins/com.dmkir.calendar/providers/google/callback", server.tokenForm().Get("redirect_uri"))
+	decrypted, err := decryptSecret(key, accessToken)
+	assert.Nil(err)
+	assert.Equal("ya29.a0AfB_byC-access", decrypted)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestProviderCallback_InvalidState(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newProviderTestPlugin(t, "GET", "/providers/google/callback", &configuration{
+		EncryptionKey:  testEncryptionKey,
+		GoogleClientID: "client-id",
+	})
+	defer closeDB()
+	key, _ := calPlugin.getConfiguration().encryptionKey()
+	state, _ := providerState(key, "other-user", ProviderGoogle, time.Now())
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/providers/google/callback?code=code-1&state="+url.QueryEscape(state), nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func expectSyncRecipients(dbMock sqlmock.Sqlmock, present bool) {
+	rows := sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"})
+	if present {
+		rows.AddRow("test-user", "private", nil, "", nil)
+	}
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm")).
+		WillReturnRows(rows)
+}
+
+// expectRecordedChange expects the sync log of an event of the test user, changed or deleted
+func expectRecordedChange(dbMock sqlmock.Sqlmock, eventId interface{}, deleted bool) {
+	expectSyncRecipients(dbMock, !deleted)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes")).
+		WithArgs("test-user", eventId, deleted).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func expectImportedEventRemoved(dbMock sqlmock.Sqlmock, eventId string) {
+	expectSyncRecipients(dbMock, true)
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_events WHERE id = $1")).
+		WithArgs(eventId).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectRecordedChange(dbMock, eventId, true)
+}
+
+func TestSyncProviderAccounts_RefreshesAndApplies(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newProviderTestServer(t, "google", func(r *http.Request) (int, string) {
+		if r.URL.Path == "/token" {
+			return http.StatusOK, "token_refreshed.json"
+		}
+		if r.Header.Get("Authorization") != "Bearer ya29.a0AfB_byC-refreshed" {
+			return http.StatusUnauthorized, ""
+		}
+		return http.StatusOK, "events_incremental.json"
+	})
+	defer server.Close()
+	previous := googleEndpoint
+	googleEndpoint = server.endpoint("/calendar/v3")
+	defer func() { googleEndpoint = previous }()
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, GoogleClientID: "client-id"})
+	key, _ := calPlugin.getConfiguration().encryptionKey()
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	accessToken, _ := encryptSecret(key, "ya29.a0AfB_byC-expired")
+	refreshToken, _ := encryptSecret(key, "1//0gA-refresh")
+	expired := now.Add(-time.Minute)
+	synced := now.Add(-10 * time.Minute)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_provider_accounts WHERE (last_sync IS NULL OR last_sync <= $1) ORDER BY last_sync LIMIT 10")).
+		WillReturnRows(sqlmock.NewRows(providerAccountColumns).
+			AddRow("test-user", ProviderGoogle, accessToken, refreshToken, expired, "CPDAlvWDx70CEPDAlvWDx70CGAU=", synced, "", synced, synced))
+
+	imported := time.Date(2024, 2, 28, 16, 4, 33, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_provider_events WHERE provider = $1 AND user_id = $2")).
+		WithArgs(ProviderGoogle, "test-user").
+		WillReturnRows(sqlmock.NewRows(providerEventLinkColumns).
+			AddRow("test-user", ProviderGoogle, "0b7d8p6v60rc3rk1uv7l4m5c2b", "event-1", imported).
+			AddRow("test-user", ProviderGoogle, "6h9k2m0q3c1e8a4s7d5f0g2j4l", "event-2", imported))
+
+	// the planning moved
+	created := time.Date(2024, 2, 20, 10, 0, 0, 0, time.UTC)
+	expectCalDAVEvent(dbMock, &Event{Id: "event-1", Title: "Quarterly planning", Start: created, End: created, Created: created, Updated: created, Owner: "test-user"})
+	expectSyncRecipients(dbMock, true)
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_events SET")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectRecordedChange(dbMock, "event-1", false)
+	updated := time.Date(2024, 3, 2, 9, 14, 51, 377000000, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_provider_events SET event = $1, remote_updated = $2 WHERE provider = $3 AND remote_id = $4 AND user_id = $5")).
+		WithArgs("event-1", &updated, ProviderGoogle, "0b7d8p6v60rc3rk1uv7l4m5c2b", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// the offsite was cancelled
+	expectCalDAVEvent(dbMock, &Event{Id: "event-2", Title: "Company offsite", Start: created, End: created, Created: created, Updated: created, Owner: "test-user"})
+	expectImportedEventRemoved(dbMock, "event-2")
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_provider_events WHERE provider = $1 AND remote_id = $2 AND user_id = $3")).
+		WithArgs(ProviderGoogle, "6h9k2m0q3c1e8a4s7d5f0g2j4l", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var savedToken string
+	expiry := now.Add(3599 * time.Second)
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_provider_accounts SET")).
+		WithArgs(passwordArg{&savedToken}, "", &now, sqlmock.AnyArg(), "CKCbrLqEx70CEKCbrLqEx70CGAU=", &expiry, sqlmock.AnyArg(), ProviderGoogle, "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.syncProviderAccounts(now)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+	decrypted, _ := decryptSecret(key, savedToken)
+	assert.Equal("ya29.a0AfB_byC-refreshed", decrypted)
+	assert.Equal("1//0gA-refresh", server.tokenForm().Get("refresh_token"))
+}
+
+func TestSyncProviderAccounts_ImportsAfterExpiredCursor(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newProviderTestServer(t, "microsoft", func(r *http.Request) (int, string) {
+		switch {
+		case r.URL.Query().Get("$deltatoken") == "expired":
+			return http.StatusGone, "sync_state_not_found.json"
+		case r.URL.Query().Get("$skiptoken") != "":
+			return http.StatusOK, "delta_2.json"
+		case r.URL.Query().Get("startDateTime") != "":
+			return http.StatusOK, "delta_1.json"
+		}
+		return http.StatusNotFound, ""
+	})
+	defer server.Close()
+	previous := microsoftEndpoint
+	microsoftEndpoint = server.endpoint("/v1.0")
+	defer func() { microsoftEndpoint = previous }()
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, MicrosoftClientID: "client-id"})
+	key, _ := calPlugin.getConfiguration().encryptionKey()
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	accessToken, _ := encryptSecret(key, "eyJ0eXAiOiJKV1QiLCJub25jZSI6-access")
+	refreshToken, _ := encryptSecret(key, "0.AXEA-refresh")
+	expiry := now.Add(time.Hour)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_provider_accounts WHERE")).
+		WillReturnRows(sqlmock.NewRows(providerAccountColumns).
+			AddRow("test-user", ProviderMicrosoft, accessToken, refreshToken, expiry, server.URL+"/v1.0/me/calendarView/delta?$deltatoken=expired", nil, "", now, now))
+
+	// an event imported before, it isn't listed anymore
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_provider_events WHERE provider = $1 AND user_id = $2")).
+		WillReturnRows(sqlmock.NewRows(providerEventLinkColumns).
+			AddRow("test-user", ProviderMicrosoft, "AAMkAGI2TGuKAAA=", "event-0", now))
+
+	call := time.Date(2024, 3, 15, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_events")).
+		WithArgs(sqlmock.AnyArg(), "Customer call", "Agenda: renewal", call, call.Add(time.Hour), false, "Europe/Berlin",
+			sqlmock.AnyArg(), sqlmock.AnyArg(), "test-user", sqlmock.AnyArg(), false, "", sqlmock.AnyArg(), nil,
+			sqlmock.AnyArg(), VisibilityPrivate, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectRecordedChange(dbMock, sqlmock.AnyArg(), false)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_provider_events")).
+		WithArgs("test-user", ProviderMicrosoft, "AAMkAGI2TGuLAAA=", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	offsite := time.Date(2024, 4, 10, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_events")).
+		WithArgs(sqlmock.AnyArg(), "Company offsite", "", offsite, offsite.AddDate(0, 0, 2), true, "Europe/Berlin",
+			sqlmock.AnyArg(), sqlmock.AnyArg(), "test-user", sqlmock.AnyArg(), false, "", sqlmock.AnyArg(), nil,
+			sqlmock.AnyArg(), VisibilityPrivate, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectRecordedChange(dbMock, sqlmock.AnyArg(), false)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_provider_events")).
+		WithArgs("test-user", ProviderMicrosoft, "AAMkAGI2TGuMAAA=", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	expectCalDAVEvent(dbMock, &Event{Id: "event-0", Title: "Old", Start: now, End: now, Created: now, Updated: now, Owner: "test-user"})
+	expectImportedEventRemoved(dbMock, "event-0")
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_provider_events")).
+		WithArgs(ProviderMicrosoft, "AAMkAGI2TGuKAAA=", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_provider_accounts SET")).
+		WithArgs(accessToken, "", &now, refreshToken, server.URL+"/v1.0/me/calendarView/delta?$deltatoken=R0usmci39OQxqJrxK4", &expiry, sqlmock.AnyArg(), ProviderMicrosoft, "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.syncProviderAccounts(now)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestSyncProviderAccounts_NotConfigured(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{EncryptionKey: testEncryptionKey})
+	api := calPlugin.API.(*plugintest.API)
+	api.On("LogWarn", "Calendar provider sync failed", "user", "test-user", "provider", ProviderGoogle, "error", "google isn't configured").Return()
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_provider_accounts WHERE")).
+		WillReturnRows(sqlmock.NewRows(providerAccountColumns).
+			AddRow("test-user", ProviderGoogle, "", "", nil, "cursor", nil, "", now, now))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_provider_accounts SET")).
+		WithArgs("", "google isn't configured", &now, "", "cursor", nil, sqlmock.AnyArg(), ProviderGoogle, "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	calPlugin.syncProviderAccounts(now)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+	api.AssertCalled(t, "LogWarn", "Calendar provider sync failed", "user", "test-user", "provider", ProviderGoogle, "error", "google isn't configured")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// maxCachedRecurrences bounds the rules a RecurrenceExpander keeps, the cache starts over when it is full
+const maxCachedRecurrences = 10000
+
+// RecurrenceExpander expands recurring events into their occurrences. The REST API, the slash
+// commands, CalDAV scheduling and the notifications share one, so the rule of an event is parsed
+// once and reused until the event is updated.
+type RecurrenceExpander struct {
+	lock  sync.RWMutex
+	rules map[string]*cachedRecurrence
+}
+
+// cachedRecurrence is a parsed recurrence and what it was parsed from
+type cachedRecurrence struct {
+	// lock serializes the expansions, iterating a rule writes to it
+	lock       sync.Mutex
+	updated    time.Time
+	recurrence string
+	start      time.Time
+	location   string
+	rule       *recurrenceSet
+}
+
+func NewRecurrenceExpander() *RecurrenceExpander {
+	return &RecurrenceExpander{
+		rules: map[string]*cachedRecurrence{},
+	}
+}
+
+// matches reports whether the rule was parsed from the current version of the event
+func (c *cachedRecurrence) matches(event *Event, loc *time.Location) bool {
+	return c.updated.Equal(event.Updated) &&
+		c.recurrence == event.Recurrence &&
+		c.start.Equal(event.Start) &&
+		c.location == loc.String()
+}
+
+// cached returns the cached rule of the event, parsing it on a miss.
+// A nil expander and events without id aren't cached.
+func (e *RecurrenceExpander) cached(event *Event, loc *time.Location) (*cachedRecurrence, error) {
+	if e != nil && event.Id != "" {
+		e.lock.RLock()
+		cached, ok := e.rules[event.Id]
+		e.lock.RUnlock()
+		if ok && cached.matches(event, loc) {
+			return cached, nil
+		}
+	}
+
+	rule, err := parseRecurrence(event, loc)
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedRecurrence{
+		updated:    event.Updated,
+		recurrence: event.Recurrence,
+		start:      event.Start,
+		location:   loc.String(),
+		rule:       rule,
+	}
+
+	if e != nil && event.Id != "" {
+		e.lock.Lock()
+		if len(e.rules) >= maxCachedRecurrences {
+			e.rules = map[string]*cachedRecurrence{}
+		}
+		e.rules[event.Id] = cached
+		e.lock.Unlock()
+	}
+
+	return cached, nil
+}
+
+// Occurrences returns the starts of the occurrences between rangeStart and rangeEnd, inclusive, in UTC.
+// The rule is expanded in loc, so every occurrence keeps the wall-clock time of the first one across DST changes.
+func (e *RecurrenceExpander) Occurrences(event *Event, loc *time.Location, rangeStart, rangeEnd time.Time) ([]time.Time, error) {
+	cached, err := e.cached(event, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	cached.lock.Lock()
+	occurrences := cached.rule.Between(rangeStart.In(loc), rangeEnd.In(loc), true)
+	cached.lock.Unlock()
+
+	for i := range occurrences {
+		occurrences[i] = occurrences[i].UTC()
+	}
+	return occurrences, nil
+}
+
+// seriesEnd returns when the last occurrence of a recurring event ends, nil for series with a rule
+// without UNTIL or COUNT and for events that don't recur
+func seriesEnd(event *Event) *time.Time {
+	if !event.Recurrent || event.Recurrence == "" {
+		return nil
+	}
+
+	// all-day dates are expanded as they are stored, at midnight UTC
+	loc := time.UTC
+	if !event.AllDay {
+		loc = eventLocation(event)
+	}
+	set, err := parseRecurrence(event, loc)
+	if err != nil {
+		return nil
+	}
+	last, ok := set.last()
+	if !ok {
+		return nil
+	}
+
+	end := event.End.UTC()
+	if !last.IsZero() {
+		if event.AllDay {
+			end = last.AddDate(0, 0, allDayDays(event)).UTC()
+		} else {
+			end = last.Add(event.End.Sub(event.Start)).UTC()
+		}
+	}
+	return &end
+}
+
+// nextNotification returns the first start or alert at or after the time of an occurrence of a
+// timed recurring event, when the reminders check it again. Nil for the other events and the series
+// without one, all-day events are checked by date.
+func nextNotification(event *Event, since time.Time) *time.Time {
+	if !event.Recurrent || event.AllDay || event.Recurrence == "" {
+		return nil
+	}
+
+	set, err := parseRecurrence(event, eventLocation(event))
+	if err != nil {
+		return nil
+	}
+
+	var next *time.Time
+	if start, ok := set.first(since); ok {
+		start = start.UTC()
+		next = &start
+	}
+	if alertDuration := EventAlertDurationMap[event.Alert]; alertDuration > 0 {
+		if start, ok := set.first(since.Add(alertDuration)); ok {
+			alert := start.Add(-alertDuration).UTC()
+			if next == nil || alert.Before(*next) {
+				next = &alert
+			}
+		}
+	}
+	return next
+}
+
+// recurringSince selects the recurring events whose series doesn't end before the time
+func recurringSince(since time.Time) sq.And {
+	return sq.And{
+		sq.Eq{"ce.recurrent": true},
+		sq.Or{
+			sq.Eq{"ce.recurrence_end": nil},
+			sq.GtOrEq{"ce.recurrence_end": since},
+		},
+	}
+}
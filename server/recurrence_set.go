@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/teambition/rrule-go"
+)
+
+// The recurrence of an event is stored as iCalendar content lines, one per line:
+//
+//	RRULE:FREQ=WEEKLY;BYDAY=MO
+//	RRULE:FREQ=MONTHLY;BYMONTHDAY=1
+//	RDATE;TZID=Europe/Berlin:20240320T100000
+//	EXDATE:20240325T090000Z
+//
+// so recurrences imported from other calendars keep their RRULEs, EXRULEs, RDATEs and EXDATEs.
+
+// recurrenceProperties are the properties a recurrence is made of
+var recurrenceProperties = []ics.ComponentProperty{
+	ics.ComponentPropertyRrule,
+	ics.ComponentPropertyExrule,
+	ics.ComponentPropertyRdate,
+	ics.ComponentPropertyExdate,
+}
+
+// recurrenceLine is a content line of a stored recurrence
+type recurrenceLine struct {
+	name   ics.ComponentProperty
+	params map[string]string
+	value  string
+}
+
+// parseRecurrenceLine parses a content line, a bare rule like FREQ=DAILY is an RRULE
+func parseRecurrenceLine(line string) (recurrenceLine, error) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return recurrenceLine{name: ics.ComponentPropertyRrule, value: line}, nil
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	parsed := recurrenceLine{
+		name:  ics.ComponentProperty(strings.ToUpper(parts[0])),
+		value: line[colon+1:],
+	}
+	known := false
+	for _, property := range recurrenceProperties {
+		known = known || parsed.name == property
+	}
+	if !known {
+		return parsed, fmt.Errorf("unsupported recurrence property %q", parts[0])
+	}
+
+	for _, param := range parts[1:] {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return parsed, fmt.Errorf("invalid parameter %q", param)
+		}
+		if parsed.params == nil {
+			parsed.params = map[string]string{}
+		}
+		parsed.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return parsed, nil
+}
+
+// String formats the line with its parameters in a stable order
+func (l recurrenceLine) String() string {
+	keys := make([]string, 0, len(l.params))
+	for key := range l.params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	builder.WriteString(string(l.name))
+	for _, key := range keys {
+		builder.WriteString(";" + key + "=" + l.params[key])
+	}
+	builder.WriteString(":" + l.value)
+	return builder.String()
+}
+
+// splitRecurrence returns the content lines of a stored recurrence
+func splitRecurrence(recurrence string) ([]recurrenceLine, error) {
+	var lines []recurrenceLine
+	for _, line := range strings.Split(strings.ReplaceAll(recurrence, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parsed, err := parseRecurrenceLine(line)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, parsed)
+	}
+	return lines, nil
+}
+
+// normalizeRecurrence validates a recurrence sent by a client and formats it the way it is stored
+func normalizeRecurrence(recurrence string) (string, error) {
+	lines, err := splitRecurrence(recurrence)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range lines {
+		switch line.name {
+		case ics.ComponentPropertyRrule, ics.ComponentPropertyExrule:
+			if _, err := rrule.StrToROption(line.value); err != nil {
+				return "", err
+			}
+		default:
+			if _, err := line.dates(time.Time{}); err != nil {
+				return "", err
+			}
+		}
+	}
+	return joinRecurrence(lines), nil
+}
+
+// componentRecurrenceLines returns the recurrence properties of a component
+func componentRecurrenceLines(component *ics.ComponentBase) []recurrenceLine {
+	var lines []recurrenceLine
+	for _, property := range component.Properties {
+		line := recurrenceLine{name: ics.ComponentProperty(strings.ToUpper(property.IANAToken)), value: property.Value}
+		known := false
+		for _, name := range recurrenceProperties {
+			known = known || line.name == name
+		}
+		if !known {
+			continue
+		}
+		for key, values := range property.ICalParameters {
+			// rules are RECUR values anyway
+			if strings.EqualFold(key, string(ics.ParameterValue)) && len(values) == 1 && values[0] == string(ics.ValueDataTypeRecur) {
+				continue
+			}
+			if len(values) > 0 {
+				if line.params == nil {
+					line.params = map[string]string{}
+				}
+				line.params[strings.ToUpper(key)] = values[0]
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// joinRecurrence formats content lines the way a recurrence is stored
+func joinRecurrence(lines []recurrenceLine) string {
+	formatted := make([]string, 0, len(lines))
+	for _, line := range lines {
+		formatted = append(formatted, line.String())
+	}
+	return strings.Join(formatted, "\n")
+}
+
+// addRecurrenceProperties writes a stored recurrence as properties of the component
+func addRecurrenceProperties(component *ics.ComponentBase, recurrence string) {
+	lines, err := splitRecurrence(recurrence)
+	if err != nil {
+		return
+	}
+	for _, line := range lines {
+		var params []ics.PropertyParameter
+		for key, value := range line.params {
+			params = append(params, &ics.KeyValues{Key: key, Value: []string{value}})
+		}
+		component.AddProperty(line.name, line.value, params...)
+	}
+	markRecurValues(component)
+}
+
+// markRecurValues types the EXRULEs as RECUR, the serializer escapes the semicolons of
+// the text values it assumes for properties it doesn't know
+func markRecurValues(component *ics.ComponentBase) {
+	for i := range component.Properties {
+		property := &component.Properties[i]
+		if !strings.EqualFold(property.IANAToken, string(ics.ComponentPropertyExrule)) {
+			continue
+		}
+		if property.ICalParameters == nil {
+			property.ICalParameters = map[string][]string{}
+		}
+		property.ICalParameters[string(ics.ParameterValue)] = []string{string(ics.ValueDataTypeRecur)}
+	}
+}
+
+// dates parses the values of an RDATE or EXDATE. DATE values take the time of day of start,
+// local times are in the TZID or the location of start.
+func (l recurrenceLine) dates(start time.Time) ([]time.Time, error) {
+	loc := start.Location()
+	if tzid, ok := l.params[string(ics.ParameterTzid)]; ok {
+		if tzidLoc := loadLocation(tzid); tzidLoc != nil {
+			loc = tzidLoc
+		}
+	}
+
+	var dates []time.Time
+	dateOnly := l.params[string(ics.ParameterValue)] == "DATE"
+	for _, value := range strings.Split(l.value, ",") {
+		// a PERIOD starts the occurrence
+		value, _, _ = strings.Cut(strings.TrimSpace(value), "/")
+
+		switch {
+		case dateOnly || len(value) == len(iCalDateLayout):
+			date, err := time.Parse(iCalDateLayout, value)
+			if err != nil {
+				return nil, err
+			}
+			dates = append(dates, time.Date(date.Year(), date.Month(), date.Day(),
+				start.Hour(), start.Minute(), start.Second(), 0, start.Location()))
+		case strings.HasSuffix(value, "Z"):
+			date, err := time.Parse(iCalDateTimeLayout, value)
+			if err != nil {
+				return nil, err
+			}
+			dates = append(dates, date)
+		default:
+			date, err := time.ParseInLocation(iCalLocalDateTimeLayout, value, loc)
+			if err != nil {
+				return nil, err
+			}
+			dates = append(dates, date)
+		}
+	}
+	return dates, nil
+}
+
+// recurrenceSet is the recurrence of an event, the occurrences of its RRULEs and RDATEs
+// without those of its EXRULEs and EXDATEs (RFC 5545 3.8.5)
+type recurrenceSet struct {
+	rrules  []*rrule.RRule
+	exrules []*rrule.RRule
+	rdates  []time.Time
+	exdates []time.Time
+}
+
+// parseRecurrence parses the recurrence of the event, starting at its first occurrence in loc
+func parseRecurrence(event *Event, loc *time.Location) (*recurrenceSet, error) {
+	lines, err := splitRecurrence(event.Recurrence)
+	if err != nil {
+		return nil, err
+	}
+
+	start := event.Start.In(loc)
+	set := &recurrenceSet{}
+	for _, line := range lines {
+		switch line.name {
+		case ics.ComponentPropertyRrule, ics.ComponentPropertyExrule:
+			option, err := rrule.StrToROptionInLocation(line.value, loc)
+			if err != nil {
+				return nil, err
+			}
+			option.Dtstart = start
+			rule, err := rrule.NewRRule(*option)
+			if err != nil {
+				return nil, err
+			}
+			if line.name == ics.ComponentPropertyRrule {
+				set.rrules = append(set.rrules, rule)
+			} else {
+				set.exrules = append(set.exrules, rule)
+			}
+		default:
+			dates, err := line.dates(start)
+			if err != nil {
+				return nil, err
+			}
+			if line.name == ics.ComponentPropertyRdate {
+				set.rdates = append(set.rdates, dates...)
+			} else {
+				set.exdates = append(set.exdates, dates...)
+			}
+		}
+	}
+	return set, nil
+}
+
+// excluded reports whether an EXDATE or EXRULE removes the occurrence
+func (s *recurrenceSet) excluded(occurrence time.Time) bool {
+	for _, exdate := range s.exdates {
+		if exdate.Equal(occurrence) {
+			return true
+		}
+	}
+	for _, exrule := range s.exrules {
+		if exrule.After(occurrence, true).Equal(occurrence) {
+			return true
+		}
+	}
+	return false
+}
+
+// Between returns the occurrences between after and before, in order
+func (s *recurrenceSet) Between(after, before time.Time, inc bool) []time.Time {
+	var candidates []time.Time
+	for _, rule := range s.rrules {
+		candidates = append(candidates, rule.Between(after, before, inc)...)
+	}
+	for _, rdate := range s.rdates {
+		if (rdate.After(after) && rdate.Before(before)) || (inc && (rdate.Equal(after) || rdate.Equal(before))) {
+			candidates = append(candidates, rdate)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+
+	occurrences := candidates[:0]
+	for i, candidate := range candidates {
+		if i > 0 && candidate.Equal(candidates[i-1]) || s.excluded(candidate) {
+			continue
+		}
+		occurrences = append(occurrences, candidate)
+	}
+	return occurrences
+}
+
+// maxSkippedOccurrences bounds the excluded occurrences first skips, a rule excluded by an EXRULE
+// as a whole would be iterated to its end
+const maxSkippedOccurrences = 1000
+
+// first returns the first occurrence at or after the time, false when there is none
+func (s *recurrenceSet) first(since time.Time) (time.Time, bool) {
+	var first time.Time
+	found := false
+	for _, rule := range s.rrules {
+		candidate := rule.After(since, true)
+		for i := 0; !candidate.IsZero() && s.excluded(candidate); i++ {
+			if i == maxSkippedOccurrences {
+				candidate = time.Time{}
+				break
+			}
+			candidate = rule.After(candidate, false)
+		}
+		if !candidate.IsZero() && (!found || candidate.Before(first)) {
+			first, found = candidate, true
+		}
+	}
+	for _, rdate := range s.rdates {
+		if !rdate.Before(since) && !s.excluded(rdate) && (!found || rdate.Before(first)) {
+			first, found = rdate, true
+		}
+	}
+	return first, found
+}
+
+// last returns the last occurrence, false when the series doesn't end.
+// Exclusions are ignored, the series doesn't end later than the result.
+func (s *recurrenceSet) last() (time.Time, bool) {
+	var last time.Time
+	for _, rule := range s.rrules {
+		if rule.OrigOptions.Count == 0 && rule.OrigOptions.Until.IsZero() {
+			return time.Time{}, false
+		}
+		next := rule.Iterator()
+		for occurrence, ok := next(); ok; occurrence, ok = next() {
+			if occurrence.After(last) {
+				last = occurrence
+			}
+		}
+	}
+	for _, rdate := range s.rdates {
+		if rdate.After(last) {
+			last = rdate
+		}
+	}
+	return last, true
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesEnd(t *testing.T) {
+	assert := assert.New(t)
+
+	// Monday 10:00 in Berlin, the last occurrence is after the clocks go forward
+	start := time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)
+	event := &Event{
+		Start:      start,
+		End:        start.Add(time.Hour),
+		Timezone:   "Europe/Berlin",
+		Recurrent:  true,
+		Recurrence: "RRULE:FREQ=WEEKLY;COUNT=3",
+	}
+	assert.Equal(time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC), *seriesEnd(event))
+
+	event.Recurrence = "RRULE:FREQ=DAILY;UNTIL=20240320T235959Z"
+	assert.Equal(time.Date(2024, 3, 20, 10, 0, 0, 0, time.UTC), *seriesEnd(event))
+
+	// no occurrence, the series ends with the first instance
+	event.Recurrence = "RRULE:FREQ=DAILY;UNTIL=20240301T000000Z"
+	assert.Equal(start.Add(time.Hour), *seriesEnd(event))
+
+	event.Recurrence = "RRULE:FREQ=WEEKLY"
+	assert.Nil(seriesEnd(event))
+
+	event.Recurrence = "RRULE:FREQ=SOMETIMES;COUNT=2"
+	assert.Nil(seriesEnd(event))
+
+	event.Recurrent = false
+	event.Recurrence = "RRULE:FREQ=WEEKLY;COUNT=3"
+	assert.Nil(seriesEnd(event))
+
+	// all-day events end at midnight UTC after the last date
+	allDay := &Event{
+		Start:      time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC),
+		End:        time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC),
+		AllDay:     true,
+		Recurrent:  true,
+		Recurrence: "RRULE:FREQ=WEEKLY;COUNT=2",
+	}
+	assert.Equal(time.Date(2024, 3, 27, 0, 0, 0, 0, time.UTC), *seriesEnd(allDay))
+
+	// an RDATE after the last rule occurrence extends the series, one with an endless rule doesn't end
+	event.Recurrent = true
+	event.Recurrence = "RRULE:FREQ=WEEKLY;COUNT=3\nRDATE:20240410T090000Z"
+	assert.Equal(time.Date(2024, 4, 10, 10, 0, 0, 0, time.UTC), *seriesEnd(event))
+	event.Recurrence = "RDATE;TZID=Europe/Berlin:20240320T100000,20240322T100000"
+	assert.Equal(time.Date(2024, 3, 22, 10, 0, 0, 0, time.UTC), *seriesEnd(event))
+	event.Recurrence = "RRULE:FREQ=WEEKLY\nRDATE:20240410T090000Z"
+	assert.Nil(seriesEnd(event))
+}
+
+func TestNextNotification(t *testing.T) {
+	assert := assert.New(t)
+
+	// Monday 10:00 in Berlin, 09:00 UTC in winter and 08:00 UTC after the clocks go forward
+	start := time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)
+	event := &Event{
+		Start:      start,
+		End:        start.Add(time.Hour),
+		Timezone:   "Europe/Berlin",
+		Recurrent:  true,
+		Recurrence: "RRULE:FREQ=WEEKLY;COUNT=3",
+	}
+	assert.Equal(start, *nextNotification(event, start))
+	assert.Equal(time.Date(2024, 4, 1, 8, 0, 0, 0, time.UTC), *nextNotification(event, start.Add(7*24*time.Hour+time.Minute)))
+	assert.Nil(nextNotification(event, time.Date(2024, 4, 1, 8, 1, 0, 0, time.UTC)))
+
+	// the alert comes first, an excluded occurrence is skipped
+	event.Alert = EventAlert15MinutesBefore
+	event.Recurrence = "RRULE:FREQ=WEEKLY\nEXDATE:20240325T090000Z"
+	assert.Equal(start.Add(-15*time.Minute), *nextNotification(event, start.Add(-time.Hour)))
+	assert.Equal(start, *nextNotification(event, start.Add(-14*time.Minute)))
+	assert.Equal(time.Date(2024, 4, 1, 7, 45, 0, 0, time.UTC), *nextNotification(event, start.Add(time.Minute)))
+
+	// all-day events and the events that don't recur aren't checked by it
+	event.AllDay = true
+	assert.Nil(nextNotification(event, start))
+	event.AllDay = false
+	event.Recurrent = false
+	assert.Nil(nextNotification(event, start))
+}
+
+func TestRecurrenceSet(t *testing.T) {
+	assert := assert.New(t)
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	// Monday 10:00 in Berlin
+	start := time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)
+	event := &Event{
+		Start:     start,
+		End:       start.Add(time.Hour),
+		Timezone:  "Europe/Berlin",
+		Recurrent: true,
+		Recurrence: strings.Join([]string{
+			"RRULE:FREQ=WEEKLY;BYDAY=MO",
+			"RRULE:FREQ=MONTHLY;BYMONTHDAY=1",
+			"EXRULE:FREQ=MONTHLY;BYDAY=1MO",
+			"RDATE;TZID=Europe/Berlin:20240320T150000",
+			"RDATE;VALUE=DATE:20240321,20240318",
+			"EXDATE:20240325T090000Z",
+		}, "\n"),
+	}
+
+	occurrences, err := NewRecurrenceExpander().Occurrences(event, berlin, start, time.Date(2024, 4, 16, 0, 0, 0, 0, time.UTC))
+	assert.NoError(err)
+	assert.Equal([]time.Time{
+		// the RDATE on the first occurrence isn't repeated
+		time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 20, 14, 0, 0, 0, time.UTC),
+		// a DATE takes the time of day of the event
+		time.Date(2024, 3, 21, 9, 0, 0, 0, time.UTC),
+		// 25 March is an EXDATE, 1 April is the first Monday of the month and an EXRULE occurrence
+		time.Date(2024, 4, 8, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, 4, 15, 8, 0, 0, 0, time.UTC),
+	}, occurrences)
+
+	occurrences, err = NewRecurrenceExpander().Occurrences(event, berlin, start, time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC))
+	assert.NoError(err)
+	assert.Contains(occurrences, time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+
+	// legacy recurrences are a single rule with or without the RRULE prefix
+	event.Recurrence = "FREQ=DAILY;COUNT=2"
+	occurrences, err = NewRecurrenceExpander().Occurrences(event, berlin, start, start.AddDate(0, 0, 7))
+	assert.NoError(err)
+	assert.Len(occurrences, 2)
+}
+
+func TestNormalizeRecurrence(t *testing.T) {
+	assert := assert.New(t)
+
+	normalized, err := normalizeRecurrence("FREQ=WEEKLY\r\n\nexdate;tzid=\"Europe/Berlin\":20240325T100000\nRDATE;VALUE=DATE:20240321")
+	assert.NoError(err)
+	assert.Equal("RRULE:FREQ=WEEKLY\nEXDATE;TZID=Europe/Berlin:20240325T100000\nRDATE;VALUE=DATE:20240321", normalized)
+
+	normalized, err = normalizeRecurrence("")
+	assert.NoError(err)
+	assert.Empty(normalized)
+
+	for _, invalid := range []string{
+		"RRULE:FREQ=SOMETIMES",
+		"EXRULE:COUNT=2",
+		"RDATE:20240321T25",
+		"EXDATE;VALUE=DATE:20240321T100000",
+		"SUMMARY:Standup",
+		"RDATE;TZID:20240321T100000",
+	} {
+		_, err := normalizeRecurrence(invalid)
+		assert.Error(err, invalid)
+	}
+}
+
+func TestGenerateICalendarRecurrenceSet(t *testing.T) {
+	assert := assert.New(t)
+
+	events := []Event{
+		{
+			Id:         "standup",
+			Title:      "Standup",
+			Start:      time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC),
+			End:        time.Date(2024, 3, 18, 9, 15, 0, 0, time.UTC),
+			Timezone:   "Europe/Berlin",
+			Recurrent:  true,
+			Recurrence: "RRULE:FREQ=WEEKLY;BYDAY=MO\nRDATE;TZID=Europe/Berlin:20240320T150000\nEXDATE:20240325T090000Z",
+		},
+		{
+			Id:         "invalid",
+			Title:      "Invalid",
+			Start:      time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC),
+			End:        time.Date(2024, 3, 18, 9, 15, 0, 0, time.UTC),
+			Recurrent:  true,
+			Recurrence: "RRULE:FREQ=SOMETIMES\nRDATE:20240320T150000Z",
+		},
+	}
+
+	calPlugin := Plugin{}
+	output := calPlugin.generateICalendar(events, nil)
+
+	assert.Contains(output, "RRULE:FREQ=WEEKLY;BYDAY=MO\r\n")
+	assert.Contains(output, "RDATE;TZID=Europe/Berlin:20240320T150000\r\n")
+	assert.Contains(output, "EXDATE:20240325T090000Z\r\n")
+	assert.NotContains(output, "FREQ=SOMETIMES")
+	assert.NotContains(output, "RDATE:20240320T150000Z")
+
+	// clients read back the same recurrence
+	cal, err := ics.ParseCalendar(strings.NewReader(output))
+	assert.NoError(err)
+	backend := &CalDAVBackend{}
+	assert.Equal(events[0].Recurrence, backend.recurrenceLines(&cal.Events()[0].ComponentBase))
+}
+
+func TestCalDAVRecurrenceSet(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin := &Plugin{}
+	backend := NewCalDAVBackend(calPlugin, "user-123", "test-token", "#1E90FFFF")
+
+	cal, err := ics.ParseCalendar(strings.NewReader(strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Test//EN",
+		"BEGIN:VEVENT",
+		"UID:standup",
+		"DTSTAMP:20240301T000000Z",
+		"DTSTART;TZID=Europe/Berlin:20240318T100000",
+		"DTEND;TZID=Europe/Berlin:20240318T101500",
+		"SUMMARY:Standup",
+		"RRULE:FREQ=WEEKLY;BYDAY=MO",
+		"RRULE:FREQ=MONTHLY;BYMONTHDAY=1",
+		"EXRULE:FREQ=MONTHLY;BYDAY=1MO",
+		"RDATE;VALUE=DATE:20240321",
+		"EXDATE;TZID=Europe/Berlin:20240325T100000",
+		"END:VEVENT",
+		"END:VCALENDAR",
+		"",
+	}, "\r\n")))
+	assert.NoError(err)
+
+	event, err := backend.icalendarToEvent(cal, "standup")
+	assert.NoError(err)
+	assert.True(event.Recurrent)
+	assert.Equal(strings.Join([]string{
+		"RRULE:FREQ=WEEKLY;BYDAY=MO",
+		"RRULE:FREQ=MONTHLY;BYMONTHDAY=1",
+		"EXRULE:FREQ=MONTHLY;BYDAY=1MO",
+		"RDATE;VALUE=DATE:20240321",
+		"EXDATE;TZID=Europe/Berlin:20240325T100000",
+	}, "\n"), event.Recurrence)
+
+	// the whole set is written back, the EXRULE unescaped
+	output := backend.eventToICalendarString(event, nil)
+	assert.Contains(output, "EXRULE;VALUE=RECUR:FREQ=MONTHLY;BYDAY=1MO\r\n")
+	written, err := ics.ParseCalendar(strings.NewReader(output))
+	assert.NoError(err)
+	assert.Equal(event.Recurrence, backend.recurrenceLines(&written.Events()[0].ComponentBase))
+
+	event.ICalData = nil
+	output = backend.eventToICalendarString(event, nil)
+	written, err = ics.ParseCalendar(strings.NewReader(output))
+	assert.NoError(err)
+	assert.Equal(event.Recurrence, backend.recurrenceLines(&written.Events()[0].ComponentBase))
+
+	// an update replaces the stored set
+	stored := cal.Serialize()
+	event.ICalData = &stored
+	event.Recurrence = "RRULE:FREQ=WEEKLY;BYDAY=MO\nEXDATE:20240401T080000Z"
+	output = backend.eventToICalendarString(event, nil)
+	assert.Contains(output, "RRULE:FREQ=WEEKLY;BYDAY=MO\r\n")
+	assert.Contains(output, "EXDATE:20240401T080000Z\r\n")
+	assert.NotContains(output, "BYMONTHDAY")
+	assert.NotContains(output, "EXRULE")
+	assert.NotContains(output, "RDATE")
+}
+
+func TestRecurrenceExpanderCache(t *testing.T) {
+	assert := assert.New(t)
+
+	expander := NewRecurrenceExpander()
+	start := time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)
+	event := &Event{
+		Id:         "weekly",
+		Start:      start,
+		End:        start.Add(time.Hour),
+		Updated:    start,
+		Recurrent:  true,
+		Recurrence: "RRULE:FREQ=WEEKLY",
+	}
+	rangeEnd := start.AddDate(0, 0, 14)
+
+	occurrences, err := expander.Occurrences(event, time.UTC, start, rangeEnd)
+	assert.NoError(err)
+	assert.Len(occurrences, 3)
+	cached := expander.rules["weekly"]
+	assert.NotNil(cached)
+
+	// the parsed rule is reused while the event is unchanged
+	_, err = expander.Occurrences(event, time.UTC, start, rangeEnd)
+	assert.NoError(err)
+	assert.Same(cached, expander.rules["weekly"])
+
+	// an update parses the new rule
+	event.Updated = start.Add(time.Minute)
+	event.Recurrence = "RRULE:FREQ=DAILY"
+	occurrences, err = expander.Occurrences(event, time.UTC, start, rangeEnd)
+	assert.NoError(err)
+	assert.Len(occurrences, 15)
+	assert.NotSame(cached, expander.rules["weekly"])
+
+	// so does another zone
+	cached = expander.rules["weekly"]
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	_, err = expander.Occurrences(event, berlin, start, rangeEnd)
+	assert.NoError(err)
+	assert.NotSame(cached, expander.rules["weekly"])
+
+	// invalid rules aren't cached
+	_, err = expander.Occurrences(&Event{Id: "invalid", Recurrence: "RRULE:FREQ=SOMETIMES"}, time.UTC, start, rangeEnd)
+	assert.Error(err)
+	assert.NotContains(expander.rules, "invalid")
+
+	// a nil expander expands without caching
+	var uncached *RecurrenceExpander
+	occurrences, err = uncached.Occurrences(event, time.UTC, start, rangeEnd)
+	assert.NoError(err)
+	assert.Len(occurrences, 15)
+}
+
+func TestRecurrenceExpanderBounded(t *testing.T) {
+	assert := assert.New(t)
+
+	expander := NewRecurrenceExpander()
+	start := time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)
+	for i := 0; i <= maxCachedRecurrences; i++ {
+		event := &Event{Id: fmt.Sprintf("event-%d", i), Start: start, Recurrence: "RRULE:FREQ=WEEKLY"}
+		_, err := expander.Occurrences(event, time.UTC, start, start)
+		assert.NoError(err)
+	}
+	assert.Len(expander.rules, 1)
+}
+
+// benchmarkEvents returns recurring events like a team calendar has them
+func benchmarkEvents(count int) []Event {
+	rules := []string{
+		"RRULE:FREQ=WEEKLY;BYDAY=MO,WE,FR",
+		"RRULE:FREQ=DAILY;INTERVAL=2",
+		"RRULE:FREQ=MONTHLY;BYDAY=1TU",
+		"RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=TH",
+	}
+	start := time.Date(2023, 1, 2, 9, 0, 0, 0, time.UTC)
+
+	events := make([]Event, count)
+	for i := range events {
+		events[i] = Event{
+			Id:         fmt.Sprintf("event-%d", i),
+			Start:      start.Add(time.Duration(i) * time.Hour),
+			End:        start.Add(time.Duration(i)*time.Hour + 30*time.Minute),
+			Updated:    start,
+			Timezone:   "Europe/Berlin",
+			Recurrent:  true,
+			Recurrence: rules[i%len(rules)],
+		}
+	}
+	return events
+}
+
+func benchmarkOccurrences(b *testing.B, expander *RecurrenceExpander) {
+	events := benchmarkEvents(500)
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	rangeStart := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rangeEnd := rangeStart.AddDate(0, 1, 0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range events {
+			if _, err := expander.Occurrences(&events[j], berlin, rangeStart, rangeEnd); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRecurrenceOccurrencesUncached(b *testing.B) {
+	benchmarkOccurrences(b, nil)
+}
+
+func BenchmarkRecurrenceOccurrencesCached(b *testing.B) {
+	benchmarkOccurrences(b, NewRecurrenceExpander())
+}
+
+func BenchmarkSeriesEnd(b *testing.B) {
+	event := &Event{
+		Start:      time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+		End:        time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+		Timezone:   "Europe/Berlin",
+		Recurrent:  true,
+		Recurrence: "RRULE:FREQ=DAILY;COUNT=365",
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		seriesEnd(event)
+	}
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/mattermost/mattermost-server/v6/model"
 )
 
 type UserScheduleEvent struct {
@@ -15,6 +19,85 @@ type UserScheduleEvent struct {
 	Duration int32     `json:"duration"`
 }
 
+// BusyPeriod is a time a user is busy in an event they own or attend and haven't declined
+type BusyPeriod struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// GetUserBusyPeriods returns the busy time of the user between start and end, clipped to the range
+// and in the order of the events
+func (p *Plugin) GetUserBusyPeriods(userId string, start, end time.Time) ([]BusyPeriod, *model.AppError) {
+	events, appErr := p.GetUserEventsForICalUTC(userId, nil, start, end)
+	if appErr != nil {
+		return nil, appErr
+	}
+	p.AttachEventMembers(events)
+
+	var periods []BusyPeriod
+	for _, event := range events {
+		status := event.AttendeeStatus[userId]
+		if event.Owner != userId && (status == "" || status == string(ics.ParticipationStatusDeclined)) {
+			continue
+		}
+
+		// the first instance is always busy, all-day dates recur as they are stored
+		duration := event.End.Sub(event.Start)
+		occurrences := []time.Time{event.Start}
+		if event.Recurrent {
+			loc := time.UTC
+			if !event.AllDay {
+				loc = eventLocation(&event)
+			}
+			expanded, errRrule := p.recurrences.Occurrences(&event, loc, start.Add(-duration), end)
+			if errRrule != nil {
+				p.API.LogWarn("CalDAV: invalid recurrence", "event", event.Id, "error", errRrule.Error())
+			}
+			for _, occurrence := range expanded {
+				if !occurrence.Equal(event.Start) {
+					occurrences = append(occurrences, occurrence)
+				}
+			}
+		}
+
+		for _, occurrence := range occurrences {
+			if !overlaps(occurrence, duration, start, end) {
+				continue
+			}
+			busyStart, busyEnd := occurrence, occurrence.Add(duration)
+			if busyStart.Before(start) {
+				busyStart = start
+			}
+			if busyEnd.After(end) {
+				busyEnd = end
+			}
+			periods = append(periods, BusyPeriod{Start: busyStart, End: busyEnd})
+		}
+	}
+	return periods, nil
+}
+
+// mergeBusyPeriods sorts the periods and joins those overlapping or touching
+func mergeBusyPeriods(periods []BusyPeriod) []BusyPeriod {
+	sorted := append([]BusyPeriod{}, periods...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	merged := []BusyPeriod{}
+	for _, period := range sorted {
+		last := len(merged) - 1
+		if last >= 0 && !period.Start.After(merged[last].End) {
+			if period.End.After(merged[last].End) {
+				merged[last].End = period.End
+			}
+			continue
+		}
+		merged = append(merged, period)
+	}
+	return merged
+}
+
 type GetScheduleResponse struct {
 	Users          map[string][]UserScheduleEvent `json:"users"`
 	AvailableTimes []string                       `json:"available_times"`
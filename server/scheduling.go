@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	ics "github.com/arran4/golang-ical"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// EventMember is an attendee of an event with its iCalendar participation status
+type EventMember struct {
+	Event    string `db:"event"`
+	Member   string `db:"member"`
+	PartStat string `db:"partstat"`
+}
+
+// ScheduleMessage is an iTIP message waiting in a user's CalDAV scheduling inbox (RFC 6638 2.2)
+type ScheduleMessage struct {
+	Id      string    `db:"id"`
+	UserId  string    `db:"user_id"`
+	EventId string    `db:"event_id"`
+	Method  string    `db:"method"`
+	Data    string    `db:"data"`
+	Created time.Time `db:"created"`
+}
+
+// GetEventsMembers returns the members of the events grouped by event id
+func (p *Plugin) GetEventsMembers(eventIds []string) (map[string][]EventMember, error) {
+	members := map[string][]EventMember{}
+	if len(eventIds) == 0 {
+		return members, nil
+	}
+
+	queryBuilder := sq.Select("event", "member", "partstat").
+		From("calendar_members").
+		Where(sq.Eq{"event": eventIds}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("SQL build error: %w", err)
+	}
+
+	var rows []EventMember
+	if err = p.DB.Select(&rows, querySql, args...); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+
+	for _, row := range rows {
+		members[row.Event] = append(members[row.Event], row)
+	}
+
+	return members, nil
+}
+
+// AttachEventMembers fills Attendees and AttendeeStatus of the events.
+// Errors are logged, the events are left without attendees.
+func (p *Plugin) AttachEventMembers(events []Event) {
+	eventIds := make([]string, 0, len(events))
+	for _, event := range events {
+		eventIds = append(eventIds, event.Id)
+	}
+
+	members, err := p.GetEventsMembers(eventIds)
+	if err != nil {
+		p.API.LogError("AttachEventMembers: " + err.Error())
+		return
+	}
+
+	for i := range events {
+		events[i].Attendees = nil
+		events[i].AttendeeStatus = map[string]string{}
+		for _, member := range members[events[i].Id] {
+			events[i].Attendees = append(events[i].Attendees, member.Member)
+			events[i].AttendeeStatus[member.Member] = member.PartStat
+		}
+	}
+}
+
+// SyncEventMembers makes the members of the event match the given attendees.
+// New attendees get NEEDS-ACTION, the status of the remaining ones is kept.
+func (p *Plugin) SyncEventMembers(eventId string, attendees []string) ([]string, []string, error) {
+	current, err := p.GetEventsMembers([]string{eventId})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var existing []string
+	for _, member := range current[eventId] {
+		existing = append(existing, member.Member)
+	}
+
+	var added, removed []string
+	for _, userId := range attendees {
+		if !contains(existing, userId) && !contains(added, userId) {
+			added = append(added, userId)
+		}
+	}
+	for _, userId := range existing {
+		if !contains(attendees, userId) {
+			removed = append(removed, userId)
+		}
+	}
+
+	if len(removed) > 0 {
+		deleteBuilder := sq.Delete("calendar_members").
+			Where(sq.Eq{"event": eventId, "member": removed}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+		deleteSql, deleteArgs, err := deleteBuilder.ToSql()
+		if err != nil {
+			return nil, nil, fmt.Errorf("SQL build error: %w", err)
+		}
+		if _, err = p.DB.Exec(deleteSql, deleteArgs...); err != nil {
+			return nil, nil, fmt.Errorf("delete error: %w", err)
+		}
+	}
+
+	if len(added) > 0 {
+		insertBuilder := sq.Insert("calendar_members").Columns("event", "member", "partstat")
+		for _, userId := range added {
+			insertBuilder = insertBuilder.Values(eventId, userId, string(ics.ParticipationStatusNeedsAction))
+		}
+
+		insertSql, insertArgs, err := insertBuilder.PlaceholderFormat(p.GetDBPlaceholderFormat()).ToSql()
+		if err != nil {
+			return nil, nil, fmt.Errorf("SQL build error: %w", err)
+		}
+		if _, err = p.DB.Exec(insertSql, insertArgs...); err != nil {
+			return nil, nil, fmt.Errorf("insert error: %w", err)
+		}
+	}
+
+	return added, removed, nil
+}
+
+// SetMemberPartStat stores the attendee's reply and touches the event, so the organizer's
+// clients see the new status on the next sync
+func (p *Plugin) SetMemberPartStat(eventId, member, partStat string) error {
+	updateBuilder := sq.Update("calendar_members").
+		Set("partstat", partStat).
+		Set("accepted", partStat == string(ics.ParticipationStatusAccepted)).
+		Where(sq.Eq{"event": eventId, "member": member}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	updateSql, updateArgs, err := updateBuilder.ToSql()
+	if err != nil {
+		return fmt.Errorf("SQL build error: %w", err)
+	}
+
+	result, err := p.DB.Exec(updateSql, updateArgs...)
+	if err != nil {
+		return fmt.Errorf("update error: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("%s is not a member of event %s", member, eventId)
+	}
+
+	return p.TouchEvent(eventId)
+}
+
+// TouchEvent bumps the Updated time of the event, changing its ETag
+func (p *Plugin) TouchEvent(eventId string) error {
+	touchBuilder := sq.Update("calendar_events").
+		Set("updated", time.Now().UTC().Truncate(time.Second)).
+		Where(sq.Eq{"id": eventId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	touchSql, touchArgs, err := touchBuilder.ToSql()
+	if err != nil {
+		return fmt.Errorf("SQL build error: %w", err)
+	}
+	if _, err = p.DB.Exec(touchSql, touchArgs...); err != nil {
+		return fmt.Errorf("update error: %w", err)
+	}
+	p.feedCache.invalidate()
+
+	return nil
+}
+
+// DeliverScheduleMessage puts an iTIP message into the user's scheduling inbox
+func (p *Plugin) DeliverScheduleMessage(userId, eventId string, method ics.Method, data string) error {
+	insertBuilder := sq.Insert("calendar_schedule_messages").
+		Columns("id", "user_id", "event_id", "method", "data", "created").
+		Values(model.NewId(), userId, eventId, string(method), data, time.Now().UTC()).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	insertSql, insertArgs, err := insertBuilder.ToSql()
+	if err != nil {
+		return fmt.Errorf("SQL build error: %w", err)
+	}
+
+	if _, err = p.DB.Exec(insertSql, insertArgs...); err != nil {
+		return fmt.Errorf("insert error: %w", err)
+	}
+
+	return nil
+}
+
+// GetScheduleMessages returns the messages in the user's scheduling inbox, oldest first
+func (p *Plugin) GetScheduleMessages(userId string) ([]ScheduleMessage, error) {
+	queryBuilder := sq.Select("id", "user_id", "event_id", "method", "data", "created").
+		From("calendar_schedule_messages").
+		Where(sq.Eq{"user_id": userId}).
+		OrderBy("created").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("SQL build error: %w", err)
+	}
+
+	var messages []ScheduleMessage
+	if err = p.DB.Select(&messages, querySql, args...); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+
+	return messages, nil
+}
+
+// DeleteScheduleMessage removes a processed message from the user's scheduling inbox
+func (p *Plugin) DeleteScheduleMessage(userId, messageId string) (bool, error) {
+	deleteBuilder := sq.Delete("calendar_schedule_messages").
+		Where(sq.Eq{"id": messageId, "user_id": userId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	deleteSql, deleteArgs, err := deleteBuilder.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("SQL build error: %w", err)
+	}
+
+	result, err := p.DB.Exec(deleteSql, deleteArgs...)
+	if err != nil {
+		return false, fmt.Errorf("delete error: %w", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// calendarAddressEmail returns the email of a mailto: calendar user address, "" for other URIs
+func calendarAddressEmail(address string) string {
+	address = strings.TrimSpace(address)
+	if len(address) < len("mailto:") || !strings.EqualFold(address[:len("mailto:")], "mailto:") {
+		return ""
+	}
+	return strings.ToLower(address[len("mailto:"):])
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// ChannelICalToken is the token of the iCal feed of a channel's calendar. The feed stops working
+// when the member who created it leaves the channel. Only a salted hash of the token is stored.
+type ChannelICalToken struct {
+	TokenPrefix string     `json:"-" db:"token_prefix"`
+	TokenSalt   string     `json:"-" db:"token_salt"`
+	TokenHash   string     `json:"-" db:"token_hash"`
+	ChannelID   string     `json:"channel_id" db:"channel_id"`
+	CreatedBy   string     `json:"created_by" db:"created_by"`
+	Created     time.Time  `json:"created" db:"created"`
+	LastUsed    *time.Time `json:"last_used" db:"last_used"`
+}
+
+var channelICalTokenColumns = []string{
+	"token_prefix",
+	"token_salt",
+	"token_hash",
+	"channel_id",
+	"created_by",
+	"created",
+	"last_used",
+}
+
+// setSecret stores the lookup prefix and the salted hash of the token
+func (t *ChannelICalToken) setSecret(token string) error {
+	var err error
+	t.TokenPrefix, t.TokenSalt, t.TokenHash, err = newTokenSecret(token)
+	return err
+}
+
+// matches compares the token to the stored hash in constant time
+func (t *ChannelICalToken) matches(token string) bool {
+	return tokenMatches(t.TokenSalt, t.TokenHash, token)
+}
+
+// channelCalendar selects the events shared with the members of the channel
+func channelCalendar(channelId string) sq.Eq {
+	return sq.Eq{"ce.channel": channelId, "ce.visibility": string(VisibilityChannel)}
+}
+
+// teamCalendar selects the events shared with the members of the team
+func teamCalendar(teamId string) sq.Eq {
+	return sq.Eq{"ce.team": teamId, "ce.visibility": string(VisibilityTeam)}
+}
+
+// querySharedEvents returns the events of a shared calendar overlapping the range and the recurring
+// ones that may, without expanding them
+func (p *Plugin) querySharedEvents(calendar sq.Sqlizer, start, end time.Time) ([]Event, *model.AppError) {
+	queryBuilder := sq.Select(eventListColumns...).
+		From("calendar_events ce").
+		Where(sq.And{
+			calendar,
+			sq.Or{
+				sq.And{
+					sq.Lt{"ce.dt_start": end.Add(allDayMargin)},
+					sq.Gt{"ce.dt_end": start.Add(-allDayMargin)},
+				},
+				recurringSince(start.Add(-allDayMargin)),
+			},
+		}).
+		OrderBy("ce.dt_start").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, err := queryBuilder.ToSql()
+	if err != nil {
+		p.API.LogError(err.Error())
+		return nil, SomethingWentWrong
+	}
+
+	events := []Event{}
+	if errSelect := p.DB.Select(&events, querySql, args...); errSelect != nil {
+		p.API.LogError(errSelect.Error())
+		return nil, SomethingWentWrong
+	}
+
+	return events, nil
+}
+
+// GetSharedEventsUTC returns the occurrences of the events of a shared calendar in the range, sorted by start
+func (p *Plugin) GetSharedEventsUTC(
+	calendar sq.Sqlizer,
+	userLocation *time.Location,
+	start, end time.Time,
+) ([]Event, *model.AppError) {
+	stored, err := p.querySharedEvents(calendar, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []Event{}
+	for _, event := range stored {
+		events = append(events, p.eventOccurrences(event, userLocation, start, end)...)
+	}
+	sortEvents(events)
+
+	return events, nil
+}
+
+// sortEvents orders events by their start
+func sortEvents(events []Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+}
+
+func (p *Plugin) GetChannelEvents(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	channelId := mux.Vars(r)["channelId"]
+	if _, err := p.API.GetChannelMember(channelId, user.Id); err != nil {
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	p.sharedEventsResponse(w, r, user, channelCalendar(channelId))
+}
+
+func (p *Plugin) GetTeamEvents(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	teamId := mux.Vars(r)["teamId"]
+	if _, err := p.API.GetTeamMember(teamId, user.Id); err != nil {
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	p.sharedEventsResponse(w, r, user, teamCalendar(teamId))
+}
+
+// sessionUser returns the user of the request's session
+func (p *Plugin) sessionUser(r *http.Request) (*model.User, *model.AppError) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError("can't get session")
+		return nil, NotAuthorizedError
+	}
+
+	user, err := p.API.GetUser(session.UserId)
+	if err != nil {
+		p.API.LogError("can't get user")
+		return nil, UserNotFound
+	}
+
+	return user, nil
+}
+
+// sharedEventsResponse writes the events of a shared calendar between the start and end of the query,
+// given like those of GetEvents
+func (p *Plugin) sharedEventsResponse(w http.ResponseWriter, r *http.Request, user *model.User, calendar sq.Sqlizer) {
+	query := r.URL.Query()
+	userLoc := p.GetUserLocation(user)
+
+	start, errStart := time.ParseInLocation(EventDateTimeLayout, query.Get("start"), userLoc)
+	end, errEnd := time.ParseInLocation(EventDateTimeLayout, query.Get("end"), userLoc)
+	if errStart != nil || errEnd != nil || !end.After(start) {
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	events, eventsErr := p.GetSharedEventsUTC(calendar, userLoc, start.In(time.UTC), end.In(time.UTC))
+	if eventsErr != nil {
+		errorResponse(w, eventsErr)
+		return
+	}
+
+	apiResponse(w, &events)
+}
+
+// channelICalTokenResponse returns the token of the channel, disabled when there is none
+func (p *Plugin) channelICalTokenResponse(token string) *ICalTokenResponse {
+	if token == "" {
+		return &ICalTokenResponse{Enabled: false}
+	}
+
+	icalURL := ""
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL != nil && *siteURL != "" {
+		icalURL = *siteURL + "/plugins/" + PluginId + "/ical/channel/" + token
+	}
+
+	return &ICalTokenResponse{
+		Token:   token,
+		URL:     icalURL,
+		Enabled: true,
+	}
+}
+
+// GetChannelICalToken reports whether the channel has an iCal token. Only its hash is stored, the
+// token and its URL are returned once by GenerateChannelICalToken.
+func (p *Plugin) GetChannelICalToken(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	channelId := mux.Vars(r)["channelId"]
+	if _, err := p.API.GetChannelMember(channelId, user.Id); err != nil {
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	queryBuilder := sq.Select("channel_id").
+		From("calendar_channel_ical_tokens").
+		Where(sq.Eq{"channel_id": channelId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	var tokenChannelId string
+	if errSelect := p.DB.Get(&tokenChannelId, querySql, args...); errSelect != nil {
+		apiResponse(w, p.channelICalTokenResponse(""))
+		return
+	}
+
+	apiResponse(w, &ICalTokenResponse{Enabled: true})
+}
+
+// GenerateChannelICalToken creates a new iCal token for the channel, replacing the existing one
+func (p *Plugin) GenerateChannelICalToken(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	channelId := mux.Vars(r)["channelId"]
+	if _, err := p.API.GetChannelMember(channelId, user.Id); err != nil {
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	newToken, tokenErr := generateSecureToken()
+	if tokenErr != nil {
+		p.API.LogError("GenerateChannelICalToken: can't generate token: " + tokenErr.Error())
+		errorResponse(w, CantCreateICalToken)
+		return
+	}
+
+	deleteBuilder := sq.Delete("calendar_channel_ical_tokens").
+		Where(sq.Eq{"channel_id": channelId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
+	_, _ = p.DB.Exec(deleteSql, deleteArgs...)
+
+	channelToken := ChannelICalToken{
+		ChannelID: channelId,
+		CreatedBy: user.Id,
+		Created:   time.Now().UTC(),
+	}
+	if secretErr := channelToken.setSecret(newToken); secretErr != nil {
+		p.API.LogError("GenerateChannelICalToken: can't hash token: " + secretErr.Error())
+		errorResponse(w, CantCreateICalToken)
+		return
+	}
+
+	insertBuilder := sq.Insert("calendar_channel_ical_tokens").
+		Columns("token_prefix", "token_salt", "token_hash", "channel_id", "created_by", "created").
+		Values(channelToken.TokenPrefix, channelToken.TokenSalt, channelToken.TokenHash, channelToken.ChannelID, channelToken.CreatedBy, channelToken.Created).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	insertSql, insertArgs, _ := insertBuilder.ToSql()
+
+	if _, insertErr := p.DB.Exec(insertSql, insertArgs...); insertErr != nil {
+		p.API.LogError("GenerateChannelICalToken: can't insert token: " + insertErr.Error())
+		errorResponse(w, CantCreateICalToken)
+		return
+	}
+
+	apiResponse(w, p.channelICalTokenResponse(newToken))
+}
+
+// RevokeChannelICalToken removes the iCal token of the channel
+func (p *Plugin) RevokeChannelICalToken(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+
+	channelId := mux.Vars(r)["channelId"]
+	if _, err := p.API.GetChannelMember(channelId, user.Id); err != nil {
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	deleteBuilder := sq.Delete("calendar_channel_ical_tokens").
+		Where(sq.Eq{"channel_id": channelId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	deleteSql, deleteArgs, _ := deleteBuilder.ToSql()
+
+	if _, deleteErr := p.DB.Exec(deleteSql, deleteArgs...); deleteErr != nil {
+		p.API.LogError("RevokeChannelICalToken: can't delete token: " + deleteErr.Error())
+		errorResponse(w, CantRevokeICalToken)
+		return
+	}
+
+	apiResponse(w, p.channelICalTokenResponse(""))
+}
+
+// ServeChannelICalFeed serves the iCal feed of a channel's calendar, authenticated by the token in the URL
+func (p *Plugin) ServeChannelICalFeed(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	if len(token) != 64 {
+		errorResponse(w, InvalidICalToken)
+		return
+	}
+
+	queryBuilder := sq.Select(channelICalTokenColumns...).
+		From("calendar_channel_ical_tokens").
+		Where(sq.Eq{"token_prefix": token[:icalTokenPrefixSize]}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	candidates := []ChannelICalToken{}
+	if errSelect := p.DB.Select(&candidates, querySql, args...); errSelect != nil {
+		p.API.LogError("ServeChannelICalFeed: can't get tokens: " + errSelect.Error())
+		errorResponse(w, InvalidICalToken)
+		return
+	}
+
+	var channelToken *ChannelICalToken
+	for i := range candidates {
+		if candidates[i].matches(token) {
+			channelToken = &candidates[i]
+		}
+	}
+	if channelToken == nil {
+		errorResponse(w, InvalidICalToken)
+		return
+	}
+
+	if _, err := p.API.GetChannelMember(channelToken.ChannelID, channelToken.CreatedBy); err != nil {
+		p.API.LogError("ServeChannelICalFeed: the token's creator left the channel", "channel", channelToken.ChannelID)
+		errorResponse(w, InvalidICalToken)
+		return
+	}
+
+	go func() {
+		updateBuilder := sq.Update("calendar_channel_ical_tokens").
+			Set("last_used", time.Now().UTC()).
+			Where(sq.Eq{"channel_id": channelToken.ChannelID}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat())
+		updateSql, updateArgs, _ := updateBuilder.ToSql()
+		_, _ = p.DB.Exec(updateSql, updateArgs...)
+	}()
+
+	now := time.Now().UTC()
+	cacheKey := "channel:" + channelToken.ChannelID
+	if feed := p.feedCache.get(cacheKey, now); feed != nil {
+		writeFeed(w, r, feed)
+		return
+	}
+	generation := p.feedCache.currentGeneration()
+
+	// the same range as the user feeds, recurring events keep their rules
+	events, eventsErr := p.querySharedEvents(channelCalendar(channelToken.ChannelID), now.AddDate(0, -1, 0), now.AddDate(1, 0, 0))
+	if eventsErr != nil {
+		errorResponse(w, eventsErr)
+		return
+	}
+
+	feed := &renderedFeed{rendered: now}
+	feed.etag, feed.lastModified = feedValidators(events, cacheKey)
+	feed.body = []byte(p.generateICalendar(events, nil))
+	p.feedCache.put(cacheKey, feed, generation)
+
+	writeFeed(w, r, feed)
+}
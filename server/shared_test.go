@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var sharedEventColumns = []string{
+	"id", "title", "description", "dt_start", "dt_end", "all_day", "timezone", "created", "updated", "owner",
+	"channel", "recurrent", "recurrence", "color", "team", "visibility", "alert", "alert_time",
+}
+
+func TestGetChannelEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/channels/channel-1/events"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	api.On("GetChannelMember", "channel-1", "test-user").Return(&model.ChannelMember{}, nil)
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	channel := "channel-1"
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce WHERE (ce.channel = $1 AND ce.visibility = $2 AND (")).
+		WithArgs("channel-1", "channel", sqlmock.AnyArg(), sqlmock.AnyArg(), true, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(sharedEventColumns).
+			AddRow("event-2", "Release", "", time.Date(2024, 3, 12, 9, 0, 0, 0, time.UTC), time.Date(2024, 3, 12, 10, 0, 0, 0, time.UTC),
+				false, "", now, now, "other-user", &channel, false, "", nil, "", "channel", "", nil).
+			AddRow("event-1", "Standup", "", time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC), time.Date(2024, 3, 4, 8, 15, 0, 0, time.UTC),
+				false, "", now, now, "other-user", &channel, true, "FREQ=WEEKLY;COUNT=2", nil, "", "channel", "", nil))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path+"?start=2024-03-01T00:00:00&end=2024-04-01T00:00:00", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Equal(2, strings.Count(body, `"title":"Standup"`))
+	// the occurrences are sorted by start
+	assert.Less(strings.LastIndex(body, `"title":"Standup"`), strings.Index(body, `"title":"Release"`))
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetChannelEvents_NotMember(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/channels/channel-1/events"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	api.On("GetChannelMember", "channel-1", "test-user").Return(nil, model.NewAppError("GetChannelMember", "not found", nil, "", http.StatusNotFound))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path+"?start=2024-03-01T00:00:00&end=2024-04-01T00:00:00", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetTeamEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/teams/team-1/events"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	api.On("GetTeamMember", "team-1", "test-user").Return(&model.TeamMember{}, nil)
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce WHERE (ce.team = $1 AND ce.visibility = $2 AND (")).
+		WithArgs("team-1", "team", sqlmock.AnyArg(), sqlmock.AnyArg(), true, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(sharedEventColumns))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path+"?start=2024-03-01T00:00:00&end=2024-04-01T00:00:00", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[]}`, strings.TrimSpace(w.Body.String()))
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetTeamEvents_InvalidRange(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/teams/team-1/events"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	api.On("GetTeamMember", "team-1", "test-user").Return(&model.TeamMember{}, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path+"?start=2024-04-01T00:00:00&end=2024-03-01T00:00:00", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGenerateChannelICalToken(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/channels/channel-1/ical/token"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, path)
+	defer closeDB()
+	api.On("GetChannelMember", "channel-1", "test-user").Return(&model.ChannelMember{}, nil)
+	siteURL := "https://chat.example.com"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_channel_ical_tokens WHERE channel_id = $1")).
+		WithArgs("channel-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_channel_ical_tokens (token_prefix,token_salt,token_hash,channel_id,created_by,created) VALUES ($1,$2,$3,$4,$5,$6)")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "channel-1", "test-user", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"enabled":true`)
+	assert.Contains(w.Body.String(), `"url":"https://chat.example.com/plugins/`+PluginId+`/ical/channel/`)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+// expectedChannelICalToken returns the stored row of the token of channel-1 created by creator
+func expectedChannelICalToken(t *testing.T, token string, created time.Time) *sqlmock.Rows {
+	var stored ChannelICalToken
+	if err := stored.setSecret(token); err != nil {
+		t.Fatal(err)
+	}
+	return sqlmock.NewRows(channelICalTokenColumns).
+		AddRow(stored.TokenPrefix, stored.TokenSalt, stored.TokenHash, "channel-1", "creator", created, nil)
+}
+
+func TestServeChannelICalFeed(t *testing.T) {
+	assert := assert.New(t)
+
+	token := strings.Repeat("ab", 32)
+	path := "/ical/channel/" + token
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	api.On("GetChannelMember", "channel-1", "creator").Return(&model.ChannelMember{}, nil)
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	channel := "channel-1"
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT token_prefix, token_salt, token_hash, channel_id, created_by, created, last_used FROM calendar_channel_ical_tokens WHERE token_prefix = $1")).
+		WithArgs(token[:icalTokenPrefixSize]).
+		WillReturnRows(expectedChannelICalToken(t, token, now))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_channel_ical_tokens SET last_used = $1 WHERE channel_id = $2")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce WHERE (ce.channel = $1 AND ce.visibility = $2 AND (")).
+		WithArgs("channel-1", "channel", sqlmock.AnyArg(), sqlmock.AnyArg(), true, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(sharedEventColumns).
+			AddRow("event-1", "Release", "", time.Now().UTC(), time.Now().UTC().Add(time.Hour),
+				false, "", now, now, "other-user", &channel, false, "", nil, "", "channel", "", nil))
+	dbMock.MatchExpectationsInOrder(false)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("text/calendar; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(w.Body.String(), "SUMMARY:Release")
+}
+
+func TestServeChannelICalFeed_CreatorLeft(t *testing.T) {
+	assert := assert.New(t)
+
+	token := strings.Repeat("ab", 32)
+	path := "/ical/channel/" + token
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	api.On("GetChannelMember", "channel-1", "creator").Return(nil, model.NewAppError("GetChannelMember", "not found", nil, "", http.StatusNotFound))
+	api.On("LogError", mock.Anything, "channel", "channel-1").Return()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_channel_ical_tokens WHERE token_prefix = $1")).
+		WithArgs(token[:icalTokenPrefixSize]).
+		WillReturnRows(expectedChannelICalToken(t, token, time.Now()))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestServeChannelICalFeed_WrongToken(t *testing.T) {
+	assert := assert.New(t)
+
+	token := strings.Repeat("ab", 32)
+	path := "/ical/channel/" + token
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+
+	// same prefix, another token
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_channel_ical_tokens WHERE token_prefix = $1")).
+		WithArgs(token[:icalTokenPrefixSize]).
+		WillReturnRows(expectedChannelICalToken(t, token[:icalTokenPrefixSize]+strings.Repeat("cd", 28), time.Now()))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{}, w, r)
+
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestExecuteChannelCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/")
+	defer closeDB()
+	calPlugin.BotId = "bot-id"
+	api.On("GetChannelMember", "channel-1", "test-user").Return(&model.ChannelMember{}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.UserId == "bot-id" && post.ChannelId == "channel-1" &&
+			strings.Contains(post.Message, "(Europe/Berlin)") && strings.Contains(post.Message, "|Release|")
+	})).Return(&model.Post{}, nil)
+
+	start := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Hour)
+	channel := "channel-1"
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce WHERE (ce.channel = $1 AND ce.visibility = $2 AND (")).
+		WithArgs("channel-1", "channel", sqlmock.AnyArg(), sqlmock.AnyArg(), true, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(sharedEventColumns).
+			AddRow("event-1", "Release", "", start, start.Add(time.Hour),
+				false, "", start, start, "other-user", &channel, false, "", nil, "", "channel", "", nil))
+
+	response, appErr := calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+		Command:   "/cal channel",
+		UserId:    "test-user",
+		ChannelId: "channel-1",
+	})
+	assert.Nil(appErr)
+	assert.NotNil(response)
+	api.AssertCalled(t, "CreatePost", mock.Anything)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestExecuteChannelCommand_NotMember(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, _, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/")
+	defer closeDB()
+	api.On("GetChannelMember", "channel-1", "test-user").Return(nil, model.NewAppError("GetChannelMember", "not found", nil, "", http.StatusNotFound))
+
+	_, appErr := calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+		Command:   "/cal channel",
+		UserId:    "test-user",
+		ChannelId: "channel-1",
+	})
+	assert.Equal(NotAuthorizedError, appErr)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// syncTokenPrefix makes sync tokens valid URIs as required by RFC 6578.
+const syncTokenPrefix = "urn:com.dmkir.calendar:sync:"
+
+const (
+	// syncChangesRetention is how long the change log is kept, clients that didn't sync for
+	// longer get a DAV:valid-sync-token error and start over
+	syncChangesRetention  = 90 * 24 * time.Hour
+	syncChangesPruneEvery = time.Hour
+)
+
+// SyncChange is a single row of the per-user calendar change log
+type SyncChange struct {
+	Id      int64  `db:"id"`
+	EventId string `db:"event_id"`
+	Deleted bool   `db:"deleted"`
+}
+
+// formatSyncToken converts a change log position to a DAV:sync-token value
+func formatSyncToken(position int64) string {
+	return syncTokenPrefix + strconv.FormatInt(position, 10)
+}
+
+// parseSyncToken converts a DAV:sync-token value back to a change log position
+func parseSyncToken(token string) (int64, bool) {
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, syncTokenPrefix) {
+		return 0, false
+	}
+
+	position, err := strconv.ParseInt(strings.TrimPrefix(token, syncTokenPrefix), 10, 64)
+	if err != nil || position < 0 {
+		return 0, false
+	}
+
+	return position, true
+}
+
+// GetEventSyncRecipients returns the user_id of the change log rows of the event: the owner,
+// the attendees and the channel or the team the event is visible to, whose members read the
+// rows with syncAudience. A missing event has no recipients.
+func (p *Plugin) GetEventSyncRecipients(eventId string) ([]string, error) {
+	queryBuilder := sq.Select("ce.owner", "ce.visibility", "ce.channel", "ce.team", "cm.member").
+		From("calendar_events ce").
+		LeftJoin("calendar_members cm ON ce.id = cm.event").
+		Where(sq.Eq{"ce.id": eventId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("SQL build error: %w", err)
+	}
+
+	rows, err := p.DB.Queryx(querySql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	defer rows.Close()
+
+	var recipients []string
+	for rows.Next() {
+		var owner string
+		var visibility EventVisibility
+		var channel *string
+		var team string
+		var member *string
+
+		if err = rows.Scan(&owner, &visibility, &channel, &team, &member); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+
+		if !contains(recipients, owner) {
+			recipients = append(recipients, owner)
+		}
+		audience := ""
+		if visibility == VisibilityChannel && channel != nil {
+			audience = *channel
+		} else if visibility == VisibilityTeam {
+			audience = team
+		}
+		if audience != "" && !contains(recipients, audience) {
+			recipients = append(recipients, audience)
+		}
+		if member != nil && !contains(recipients, *member) {
+			recipients = append(recipients, *member)
+		}
+	}
+
+	return recipients, nil
+}
+
+// RecordEventChange appends the event to the change log of every user that could see it
+// before the change (previous) or can see it now. Users that lost access get a deletion
+// entry, so their clients drop the event on the next sync-collection REPORT.
+// Errors are only logged: the event itself is already saved.
+func (p *Plugin) RecordEventChange(eventId string, previous []string) {
+	p.feedCache.invalidate()
+
+	current, err := p.GetEventSyncRecipients(eventId)
+	if err != nil {
+		p.API.LogError("RecordEventChange: can't get recipients: " + err.Error())
+		return
+	}
+
+	// deletions go first: when a user reads both a deleted channel or team row and a
+	// personal row, the latest row for the event wins
+	var removed []string
+	for _, userId := range previous {
+		if !contains(current, userId) {
+			removed = append(removed, userId)
+		}
+	}
+
+	if err = p.insertSyncChanges(eventId, removed, true); err != nil {
+		p.API.LogError("RecordEventChange: can't record deletion: " + err.Error())
+	}
+
+	if err = p.insertSyncChanges(eventId, current, false); err != nil {
+		p.API.LogError("RecordEventChange: can't record change: " + err.Error())
+	}
+}
+
+func (p *Plugin) insertSyncChanges(eventId string, users []string, deleted bool) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	insertBuilder := sq.Insert("calendar_sync_changes").
+		Columns("user_id", "event_id", "deleted")
+	for _, userId := range users {
+		insertBuilder = insertBuilder.Values(userId, eventId, deleted)
+	}
+
+	insertSql, insertArgs, err := insertBuilder.PlaceholderFormat(p.GetDBPlaceholderFormat()).ToSql()
+	if err != nil {
+		return fmt.Errorf("SQL build error: %w", err)
+	}
+
+	if _, err = p.DB.Exec(insertSql, insertArgs...); err != nil {
+		return fmt.Errorf("insert error: %w", err)
+	}
+
+	return nil
+}
+
+// syncAudience matches the change log rows the user reads: their own and those of their
+// channels and teams
+func syncAudience(userId string) sq.Sqlizer {
+	return sq.Or{
+		sq.Eq{"user_id": userId},
+		sq.Expr("user_id IN (SELECT ChannelId FROM ChannelMembers WHERE UserId = ?)", userId),
+		sq.Expr("user_id IN (SELECT TeamId FROM TeamMembers WHERE UserId = ? AND DeleteAt = 0)", userId),
+	}
+}
+
+// GetUserSyncPosition returns the latest change log position visible to the user.
+// It is used both as CS:getctag and as DAV:sync-token of the calendar collection.
+func (p *Plugin) GetUserSyncPosition(userId string) (int64, error) {
+	_, position, err := p.GetUserSyncRange(userId)
+	return position, err
+}
+
+// GetUserSyncRange returns the position the kept change log starts after and the latest
+// position visible to the user. Tokens before start may have missed pruned changes.
+// The position is never before start, so a user whose changes were all pruned still gets
+// a token that stays valid.
+func (p *Plugin) GetUserSyncRange(userId string) (int64, int64, error) {
+	queryBuilder := sq.Select("COALESCE(MAX(id), 0)").
+		From("calendar_sync_changes").
+		Where(syncAudience(userId)).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return 0, 0, fmt.Errorf("SQL build error: %w", err)
+	}
+
+	var position int64
+	if err = p.DB.Get(&position, querySql, args...); err != nil {
+		return 0, 0, fmt.Errorf("select error: %w", err)
+	}
+
+	startSql, _, err := sq.Select("COALESCE(MIN(id), 1) - 1").
+		From("calendar_sync_changes").
+		ToSql()
+	if err != nil {
+		return 0, 0, fmt.Errorf("SQL build error: %w", err)
+	}
+
+	var start int64
+	if err = p.DB.Get(&start, startSql); err != nil {
+		return 0, 0, fmt.Errorf("select error: %w", err)
+	}
+
+	if position < start {
+		position = start
+	}
+	return start, position, nil
+}
+
+// pruneSyncChanges removes the changes older than syncChangesRetention. The newest change is
+// always kept, the log never starts over from position 0.
+func (p *Plugin) pruneSyncChanges(now time.Time) {
+	newestSql, _, _ := sq.Select("COALESCE(MAX(id), 0)").From("calendar_sync_changes").ToSql()
+
+	var newest int64
+	if err := p.DB.Get(&newest, newestSql); err != nil {
+		p.API.LogError("pruneSyncChanges: " + err.Error())
+		return
+	}
+
+	deleteSql, deleteArgs, _ := sq.Delete("calendar_sync_changes").
+		Where(sq.And{
+			sq.Lt{"created": now.Add(-syncChangesRetention)},
+			sq.Lt{"id": newest},
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+
+	if _, err := p.DB.Exec(deleteSql, deleteArgs...); err != nil {
+		p.API.LogError("pruneSyncChanges: " + err.Error())
+	}
+}
+
+// GetUserSyncChanges returns the latest change of every event changed after the position,
+// ordered by change log position.
+func (p *Plugin) GetUserSyncChanges(userId string, since int64) ([]SyncChange, error) {
+	queryBuilder := sq.Select("id", "event_id", "deleted").
+		From("calendar_sync_changes").
+		Where(sq.And{
+			syncAudience(userId),
+			sq.Gt{"id": since},
+		}).
+		OrderBy("id").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+
+	querySql, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("SQL build error: %w", err)
+	}
+
+	var rows []SyncChange
+	if err = p.DB.Select(&rows, querySql, args...); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+
+	latest := map[string]int{}
+	var changes []SyncChange
+	for _, row := range rows {
+		if ind, ok := latest[row.EventId]; ok {
+			changes[ind] = row
+			continue
+		}
+		latest[row.EventId] = len(changes)
+		changes = append(changes, row)
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// Request bodies recorded from real clients
+const (
+	appleInitialSyncCollectionBody = `<?xml version="1.0" encoding="UTF-8"?>
+<A:sync-collection xmlns:A="DAV:">
+  <A:sync-token/>
+  <A:sync-level>1</A:sync-level>
+  <A:prop>
+    <A:getetag/>
+    <A:getcontenttype/>
+  </A:prop>
+</A:sync-collection>`
+
+	thunderbirdSyncCollectionBody = `<?xml version="1.0" encoding="UTF-8"?>
+<sync-collection xmlns="DAV:" xmlns:cs="http://calendarserver.org/ns/" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <sync-token>urn:com.dmkir.calendar:sync:3</sync-token>
+  <sync-level>1</sync-level>
+  <prop>
+    <getcontenttype/>
+    <getetag/>
+  </prop>
+</sync-collection>`
+)
+
+var syncEventColumns = []string{
+	"id", "title", "description", "dt_start", "dt_end", "created", "updated", "owner", "channel",
+	"recurrent", "recurrence", "color", "team", "visibility", "alert", "alert_time",
+}
+
+func newSyncTestPlugin(t *testing.T) (*Plugin, sqlmock.Sqlmock, func()) {
+	api := &plugintest.API{}
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything).Return().Maybe()
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return().Maybe()
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return().Maybe()
+	api.On("GetUser", "test-user").Return(&model.User{
+		Id:       "test-user",
+		Username: "testuser",
+		Email:    "test@example.com",
+		Timezone: map[string]string{
+			"useAutomaticTimezone": "false",
+			"manualTimezone":       "UTC",
+		},
+	}, nil)
+	api.On("GetTeamsForUser", "test-user").Return([]*model.Team{}, nil).Maybe()
+
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	calPlugin := &Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: api,
+		},
+		DB: sqlx.NewDb(db, "sqlmock"),
+	}
+
+	return calPlugin, dbMock, func() { db.Close() }
+}
+
+func expectCollectionEvents(dbMock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm ON ce.id = cm.event")).
+		WillReturnRows(rows)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ChannelId FROM ChannelMembers")).
+		WillReturnRows(sqlmock.NewRows([]string{"ChannelId"}))
+	expectEventMembers(dbMock, sqlmock.NewRows(eventMemberColumns))
+}
+
+var eventMemberColumns = []string{"event", "member", "partstat"}
+
+func expectEventMembers(dbMock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT event, member, partstat FROM calendar_members WHERE event IN")).
+		WillReturnRows(rows)
+}
+
+func TestParseSyncToken(t *testing.T) {
+	assert := assert.New(t)
+
+	position, ok := parseSyncToken(formatSyncToken(42))
+	assert.True(ok)
+	assert.Equal(int64(42), position)
+
+	_, ok = parseSyncToken("42")
+	assert.False(ok)
+
+	_, ok = parseSyncToken(syncTokenPrefix + "abc")
+	assert.False(ok)
+
+	_, ok = parseSyncToken(syncTokenPrefix + "-1")
+	assert.False(ok)
+}
+
+func TestReportRequest_SyncCollection(t *testing.T) {
+	assert := assert.New(t)
+
+	var request reportRequest
+	assert.Nil(xml.Unmarshal([]byte(thunderbirdSyncCollectionBody), &request))
+	assert.Equal(xml.Name{Space: nsDAV, Local: "sync-collection"}, request.XMLName)
+	assert.Equal("urn:com.dmkir.calendar:sync:3", strings.TrimSpace(request.SyncToken))
+	assert.Contains(request.propNames(), propGetETag)
+}
+
+func TestCalDAVBackend_SyncCollection_Initial(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM calendar_sync_changes WHERE (user_id = $1 "+
+		"OR user_id IN (SELECT ChannelId FROM ChannelMembers WHERE UserId = $2) "+
+		"OR user_id IN (SELECT TeamId FROM TeamMembers WHERE UserId = $3 AND DeleteAt = 0))")).
+		WithArgs("test-user", "test-user", "test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(7))
+	expectSyncStart(dbMock, 0)
+
+	now := time.Now().UTC()
+	expectCollectionEvents(dbMock, sqlmock.NewRows(syncEventColumns).
+		AddRow("event-1", "first", "", now, now.Add(time.Hour), now, now, "test-user", nil, false, "", nil, "", "private", "", nil).
+		AddRow("event-2", "second", "", now, now.Add(time.Hour), now, now, "test-user", nil, false, "", nil, "", "private", "", nil))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/caldav/token/calendar/", strings.NewReader(appleInitialSyncCollectionBody))
+	backend.ServeHTTP(w, r)
+
+	result := w.Result()
+	defer result.Body.Close()
+	bodyBytes, _ := io.ReadAll(result.Body)
+	body := string(bodyBytes)
+
+	assert.Equal(http.StatusMultiStatus, result.StatusCode)
+	assert.Contains(body, "/calendar/event-1.ics")
+	assert.Contains(body, "/calendar/event-2.ics")
+	assert.NotContains(body, "404 Not Found")
+	assert.Contains(body, "<d:sync-token>urn:com.dmkir.calendar:sync:7</d:sync-token>")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_SyncCollection_Incremental(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM calendar_sync_changes")).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(6))
+	expectSyncStart(dbMock, 0)
+
+	now := time.Now().UTC()
+	expectCollectionEvents(dbMock, sqlmock.NewRows(syncEventColumns).
+		AddRow("event-1", "first", "", now, now.Add(time.Hour), now, now, "test-user", nil, false, "", nil, "", "private", "", nil).
+		AddRow("event-untouched", "untouched", "", now, now.Add(time.Hour), now, now, "test-user", nil, false, "", nil, "", "private", "", nil))
+
+	// event-2 was updated and then deleted, event-3 is no longer visible to the user
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, event_id, deleted FROM calendar_sync_changes WHERE ((user_id = $1 "+
+		"OR user_id IN (SELECT ChannelId FROM ChannelMembers WHERE UserId = $2) "+
+		"OR user_id IN (SELECT TeamId FROM TeamMembers WHERE UserId = $3 AND DeleteAt = 0)) AND id > $4) ORDER BY id")).
+		WithArgs("test-user", "test-user", "test-user", int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_id", "deleted"}).
+			AddRow(4, "event-2", false).
+			AddRow(5, "event-1", false).
+			AddRow(6, "event-2", true).
+			AddRow(6, "event-3", false))
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/caldav/token/calendar/", strings.NewReader(thunderbirdSyncCollectionBody))
+	backend.ServeHTTP(w, r)
+
+	result := w.Result()
+	defer result.Body.Close()
+	bodyBytes, _ := io.ReadAll(result.Body)
+	body := string(bodyBytes)
+
+	assert.Equal(http.StatusMultiStatus, result.StatusCode)
+	assert.Contains(body, "/calendar/event-1.ics</d:href>\n    <d:propstat>")
+	assert.Contains(body, "/calendar/event-2.ics</d:href>\n    <d:status>HTTP/1.1 404 Not Found</d:status>")
+	assert.Contains(body, "/calendar/event-3.ics</d:href>\n    <d:status>HTTP/1.1 404 Not Found</d:status>")
+	assert.NotContains(body, "event-untouched")
+	assert.Contains(body, "<d:sync-token>urn:com.dmkir.calendar:sync:6</d:sync-token>")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCalDAVBackend_SyncCollection_InvalidToken(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	// client token is ahead of the change log, e.g. the log was recreated
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM calendar_sync_changes")).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(2))
+	expectSyncStart(dbMock, 0)
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/caldav/token/calendar/", strings.NewReader(thunderbirdSyncCollectionBody))
+	backend.ServeHTTP(w, r)
+
+	result := w.Result()
+	defer result.Body.Close()
+	bodyBytes, _ := io.ReadAll(result.Body)
+
+	assert.Equal(http.StatusForbidden, result.StatusCode)
+	assert.Contains(string(bodyBytes), "<d:valid-sync-token/>")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+// expectSyncStart expects the query of the position the kept change log starts after
+func expectSyncStart(dbMock sqlmock.Sqlmock, start int64) {
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MIN(id), 1) - 1 FROM calendar_sync_changes")).
+		WillReturnRows(sqlmock.NewRows([]string{"start"}).AddRow(start))
+}
+
+func TestCalDAVBackend_SyncCollection_PrunedToken(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	// the changes up to 5 were pruned, the client's token 3 may have missed some
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM calendar_sync_changes")).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(9))
+	expectSyncStart(dbMock, 5)
+
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("REPORT", "/caldav/token/calendar/", strings.NewReader(thunderbirdSyncCollectionBody))
+	backend.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Contains(w.Body.String(), "<d:valid-sync-token/>")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetUserSyncPosition_AfterPruning(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	// every change of the user was pruned
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM calendar_sync_changes")).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(0))
+	expectSyncStart(dbMock, 5)
+
+	position, err := calPlugin.GetUserSyncPosition("test-user")
+	assert.Nil(err)
+	assert.Equal(int64(5), position)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestPruneSyncChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	now := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM calendar_sync_changes")).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(42))
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_sync_changes WHERE (created < $1 AND id < $2)")).
+		WithArgs(now.Add(-syncChangesRetention), int64(42)).
+		WillReturnResult(sqlmock.NewResult(0, 30))
+
+	calPlugin.pruneSyncChanges(now)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRecordEventChange(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	// event of team-1 became private and attendee-2 was removed
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ce.owner, ce.visibility, ce.channel, ce.team, cm.member FROM calendar_events ce LEFT JOIN calendar_members cm ON ce.id = cm.event WHERE ce.id = $1")).
+		WithArgs("event-1").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).
+			AddRow("test-user", "private", nil, "", "attendee-1"))
+
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes (user_id,event_id,deleted) VALUES ($1,$2,$3),($4,$5,$6)")).
+		WithArgs("team-1", "event-1", true, "attendee-2", "event-1", true).
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes (user_id,event_id,deleted) VALUES ($1,$2,$3),($4,$5,$6)")).
+		WithArgs("test-user", "event-1", false, "attendee-1", "event-1", false).
+		WillReturnResult(sqlmock.NewResult(4, 2))
+
+	calPlugin.RecordEventChange("event-1", []string{"test-user", "team-1", "attendee-1", "attendee-2"})
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRecordEventChange_Deleted(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm")).
+		WithArgs("event-1").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}))
+
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes (user_id,event_id,deleted) VALUES ($1,$2,$3),($4,$5,$6)")).
+		WithArgs("test-user", "event-1", true, "attendee-1", "event-1", true).
+		WillReturnResult(sqlmock.NewResult(2, 2))
+
+	calPlugin.RecordEventChange("event-1", []string{"test-user", "attendee-1"})
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetEventSyncRecipients(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+
+	for visibility, expected := range map[string][]string{
+		"private": {"test-user", "attendee-1"},
+		"channel": {"test-user", "channel-1", "attendee-1"},
+		"team":    {"test-user", "team-1", "attendee-1"},
+	} {
+		dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce LEFT JOIN calendar_members cm")).
+			WithArgs("event-1").
+			WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).
+				AddRow("test-user", visibility, "channel-1", "team-1", "attendee-1"))
+
+		// the changes of channel and team events are only read by their members
+		recipients, err := calPlugin.GetEventSyncRecipients("event-1")
+		assert.Nil(err)
+		assert.Equal(expected, recipients, visibility)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxTaskTitleSize = 255
+	// taskReminderWindow is how late a due task is still reminded of, tasks synced with a due date
+	// long past aren't
+	taskReminderWindow = time.Hour
+)
+
+var taskColumns = []string{
+	"id",
+	"title",
+	"description",
+	"due",
+	"status",
+	"priority",
+	"completed",
+	"owner",
+	"assignee",
+	"ical_data",
+	"reminded",
+	"created",
+	"updated",
+}
+
+// normalizeTaskStatus keeps the status and the completion time in line: a completed task has
+// its completion time, the others have none
+func normalizeTaskStatus(task *Task, now time.Time) {
+	if task.Status == "" {
+		task.Status = TaskStatusNeedsAction
+	}
+	if task.Status == TaskStatusCompleted {
+		if task.Completed == nil {
+			task.Completed = &now
+		}
+		return
+	}
+	task.Completed = nil
+}
+
+// validateTask checks a task sent by the user, the owner is already set
+func (p *Plugin) validateTask(task *Task) *model.AppError {
+	task.Title = strings.TrimSpace(task.Title)
+	if task.Title == "" || len(task.Title) > maxTaskTitleSize {
+		return InvalidRequestParams
+	}
+	if task.Status != "" && !task.Status.IsValid() {
+		return InvalidRequestParams
+	}
+	if task.Priority < 0 || task.Priority > 9 {
+		return InvalidRequestParams
+	}
+
+	if task.Assignee == "" {
+		task.Assignee = task.Owner
+	}
+	if task.Assignee != task.Owner {
+		if _, err := p.API.GetUser(task.Assignee); err != nil {
+			return UserNotFound
+		}
+	}
+
+	normalizeTaskStatus(task, time.Now().UTC().Truncate(time.Second))
+	return nil
+}
+
+// GetTask returns the task if the user owns it or is its assignee
+func (p *Plugin) GetTask(userId, taskId string) (*Task, *model.AppError) {
+	queryBuilder := sq.Select(taskColumns...).
+		From("calendar_tasks").
+		Where(sq.And{
+			sq.Eq{"id": taskId},
+			sq.Or{sq.Eq{"owner": userId}, sq.Eq{"assignee": userId}},
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var task Task
+	if errSelect := p.DB.Get(&task, querySql, argsSql...); errSelect != nil {
+		if !errors.Is(errSelect, sql.ErrNoRows) {
+			p.API.LogError(errSelect.Error())
+			return nil, SomethingWentWrong
+		}
+		return nil, TaskNotFound
+	}
+	return &task, nil
+}
+
+// GetUserTasks returns the tasks the user owns or is assigned, by due date. The closed ones are
+// left out unless all is set.
+func (p *Plugin) GetUserTasks(userId string, all bool) ([]Task, *model.AppError) {
+	conditions := sq.And{sq.Or{sq.Eq{"owner": userId}, sq.Eq{"assignee": userId}}}
+	if !all {
+		conditions = append(conditions, sq.Eq{"status": []TaskStatus{TaskStatusNeedsAction, TaskStatusInProcess}})
+	}
+
+	queryBuilder := sq.Select(taskColumns...).
+		From("calendar_tasks").
+		Where(conditions).
+		// the tasks without a due date come last
+		OrderBy("due IS NULL", "due", "created").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	tasks := []Task{}
+	if errSelect := p.DB.Select(&tasks, querySql, argsSql...); errSelect != nil {
+		p.API.LogError(errSelect.Error())
+		return nil, SomethingWentWrong
+	}
+	return tasks, nil
+}
+
+// insertTask saves a new task
+func (p *Plugin) insertTask(task *Task) *model.AppError {
+	queryBuilder := sq.Insert("calendar_tasks").
+		Columns(taskColumns...).
+		Values(
+			task.Id,
+			task.Title,
+			task.Description,
+			task.Due,
+			task.Status,
+			task.Priority,
+			task.Completed,
+			task.Owner,
+			task.Assignee,
+			task.ICalData,
+			task.Reminded,
+			task.Created,
+			task.Updated,
+		).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	if _, errInsert := p.DB.Exec(querySql, argsSql...); errInsert != nil {
+		p.API.LogError(errInsert.Error())
+		return CantSaveTask
+	}
+	return nil
+}
+
+// updateTask saves the changes of a task, the reminder is sent again when the due date moves
+func (p *Plugin) updateTask(task *Task, previous *Task) *model.AppError {
+	if !sameTime(task.Due, previous.Due) {
+		task.Reminded = nil
+	}
+
+	queryBuilder := sq.Update("calendar_tasks").
+		SetMap(map[string]interface{}{
+			"title":       task.Title,
+			"description": task.Description,
+			"due":         task.Due,
+			"status":      task.Status,
+			"priority":    task.Priority,
+			"completed":   task.Completed,
+			"assignee":    task.Assignee,
+			"ical_data":   task.ICalData,
+			"reminded":    task.Reminded,
+			"updated":     task.Updated,
+		}).
+		Where(sq.Eq{"id": task.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	if _, errUpdate := p.DB.Exec(querySql, argsSql...); errUpdate != nil {
+		p.API.LogError(errUpdate.Error())
+		return CantSaveTask
+	}
+	return nil
+}
+
+// applyTaskChanges merges the task sent by the user into the current one. The owner changes
+// everything, the assignee only the status.
+func applyTaskChanges(current *Task, changed *Task, userId string) *Task {
+	task := *current
+	if current.Owner == userId {
+		task.Title = changed.Title
+		task.Description = changed.Description
+		task.Due = changed.Due
+		task.Priority = changed.Priority
+		task.Assignee = changed.Assignee
+		task.ICalData = changed.ICalData
+	}
+	if task.Status != changed.Status {
+		task.Completed = nil
+	}
+	task.Status = changed.Status
+	if changed.Completed != nil {
+		task.Completed = changed.Completed
+	}
+	task.Updated = time.Now().UTC().Truncate(time.Second)
+	return &task
+}
+
+// removeTask deletes a task of the user
+func (p *Plugin) removeTask(userId, taskId string) *model.AppError {
+	queryBuilder := sq.Delete("calendar_tasks").
+		Where(sq.Eq{"id": taskId, "owner": userId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	result, errDelete := p.DB.Exec(querySql, argsSql...)
+	if errDelete != nil {
+		p.API.LogError(errDelete.Error())
+		return CantRemoveTask
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		return TaskNotFound
+	}
+	return nil
+}
+
+// sameTime reports whether two optional times are equal
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
+
+func (p *Plugin) GetTasks(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError("can't get session")
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	all := false
+	if value := r.URL.Query().Get("all"); value != "" {
+		parsed, errParse := strconv.ParseBool(value)
+		if errParse != nil {
+			errorResponse(w, InvalidRequestParams)
+			return
+		}
+		all = parsed
+	}
+
+	tasks, tasksErr := p.GetUserTasks(session.UserId, all)
+	if tasksErr != nil {
+		errorResponse(w, tasksErr)
+		return
+	}
+
+	apiResponse(w, &tasks)
+}
+
+func (p *Plugin) GetTaskById(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError("can't get session")
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	task, taskErr := p.GetTask(session.UserId, mux.Vars(r)["taskId"])
+	if taskErr != nil {
+		errorResponse(w, taskErr)
+		return
+	}
+
+	apiResponse(w, task)
+}
+
+func (p *Plugin) CreateTask(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError(err.Error())
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	var task Task
+	if errDecode := json.NewDecoder(r.Body).Decode(&task); errDecode != nil {
+		p.API.LogError(errDecode.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	task.Owner = session.UserId
+	if validateErr := p.validateTask(&task); validateErr != nil {
+		errorResponse(w, validateErr)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	task.Id = uuid.New().String()
+	task.ICalData = nil
+	task.Reminded = nil
+	task.Created = now
+	task.Updated = now
+
+	if insertErr := p.insertTask(&task); insertErr != nil {
+		errorResponse(w, insertErr)
+		return
+	}
+
+	apiResponse(w, &task)
+}
+
+func (p *Plugin) UpdateTask(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError(err.Error())
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	var changed Task
+	if errDecode := json.NewDecoder(r.Body).Decode(&changed); errDecode != nil {
+		p.API.LogError(errDecode.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	current, taskErr := p.GetTask(session.UserId, changed.Id)
+	if taskErr != nil {
+		errorResponse(w, taskErr)
+		return
+	}
+
+	// the fields the plugin stores win over the calendar object of the client
+	changed.ICalData = current.ICalData
+	task := applyTaskChanges(current, &changed, session.UserId)
+	if validateErr := p.validateTask(task); validateErr != nil {
+		errorResponse(w, validateErr)
+		return
+	}
+
+	if updateErr := p.updateTask(task, current); updateErr != nil {
+		errorResponse(w, updateErr)
+		return
+	}
+
+	apiResponse(w, task)
+}
+
+func (p *Plugin) RemoveTask(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError("can't get session")
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	if removeErr := p.removeTask(session.UserId, mux.Vars(r)["taskId"]); removeErr != nil {
+		errorResponse(w, removeErr)
+		return
+	}
+
+	apiResponse(w, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// remindDueTasks sends the assignees of the open tasks due by now a direct message, once per
+// due date
+func (p *Plugin) remindDueTasks(now time.Time) {
+	queryBuilder := sq.Select(taskColumns...).
+		From("calendar_tasks").
+		Where(sq.And{
+			sq.LtOrEq{"due": now},
+			sq.Gt{"due": now.Add(-taskReminderWindow)},
+			sq.Eq{"reminded": nil},
+			sq.Eq{"status": []TaskStatus{TaskStatusNeedsAction, TaskStatusInProcess}},
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var tasks []Task
+	if errSelect := p.DB.Select(&tasks, querySql, argsSql...); errSelect != nil {
+		p.API.LogError("remindDueTasks: " + errSelect.Error())
+		return
+	}
+
+	for i := range tasks {
+		task := &tasks[i]
+
+		// marked first, a failing post isn't sent again every tick
+		updateBuilder := sq.Update("calendar_tasks").
+			Set("reminded", task.Due).
+			Where(sq.Eq{"id": task.Id}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat())
+		updateSql, updateArgs, _ := updateBuilder.ToSql()
+		if _, errUpdate := p.DB.Exec(updateSql, updateArgs...); errUpdate != nil {
+			p.API.LogError("remindDueTasks: " + errUpdate.Error())
+			continue
+		}
+
+		dChannel, dChannelErr := p.API.GetDirectChannel(task.Assignee, p.BotId)
+		if dChannelErr != nil {
+			p.API.LogError(dChannelErr.Error())
+			continue
+		}
+
+		message := fmt.Sprintf(":white_check_mark: **Task due** *%s*", task.Title)
+		if task.Description != "" {
+			message += fmt.Sprintf("\n**description:**\n%s", task.Description)
+		}
+		if _, postErr := p.API.CreatePost(&model.Post{
+			UserId:    p.BotId,
+			ChannelId: dChannel.Id,
+			Message:   message,
+		}); postErr != nil {
+			p.API.LogError(postErr.Error())
+		}
+	}
+}
+
+// executeTodoCommand manages the tasks of the user:
+// /cal todo [list] | add "<title>" [YYYY-MM-DD] [HH:MM] | done <n> | remove <n>
+// The numbers are the positions in the list of open tasks.
+func (p *Plugin) executeTodoCommand(
+	c *plugin.Context,
+	args *model.CommandArgs,
+) (*model.CommandResponse, *model.AppError) {
+	usage := "Usage: `/cal todo [list | add \"<title>\" [YYYY-MM-DD] [HH:MM] | done <n> | remove <n>]`"
+
+	user, appErr := p.API.GetUser(args.UserId)
+	if appErr != nil {
+		return nil, NotAuthorizedError
+	}
+	userLoc := p.GetUserLocation(user)
+
+	split := splitCommandArgs(args.Command)
+	action := "list"
+	if len(split) > 2 {
+		action = split[2]
+	}
+
+	switch action {
+	case "list":
+		tasks, tasksErr := p.GetUserTasks(user.Id, false)
+		if tasksErr != nil {
+			return nil, tasksErr
+		}
+		return ephemeralResponse(formatTaskList(tasks, userLoc)), nil
+	case "add":
+		if len(split) < 4 {
+			return ephemeralResponse(usage), nil
+		}
+
+		// an unquoted title runs until the date or the time
+		titleEnd := 4
+		for titleEnd < len(split) && !isCommandStart(split[titleEnd]) {
+			titleEnd++
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		task := Task{
+			Id:      uuid.New().String(),
+			Title:   strings.Join(split[3:titleEnd], " "),
+			Owner:   user.Id,
+			Created: now,
+			Updated: now,
+		}
+		if titleEnd < len(split) {
+			due, ok := parseCommandStart(split[titleEnd:], now, userLoc)
+			if !ok {
+				return ephemeralResponse(usage), nil
+			}
+			due = due.UTC()
+			task.Due = &due
+		}
+		if validateErr := p.validateTask(&task); validateErr != nil {
+			return ephemeralResponse(usage), nil
+		}
+		if insertErr := p.insertTask(&task); insertErr != nil {
+			return nil, insertErr
+		}
+
+		if task.Due != nil {
+			return ephemeralResponse(fmt.Sprintf("Added **%s**, due %s.", task.Title,
+				task.Due.In(userLoc).Format(EventDateLayout+" "+BusinessTimeLayout))), nil
+		}
+		return ephemeralResponse(fmt.Sprintf("Added **%s**.", task.Title)), nil
+	case "done", "remove":
+		if len(split) != 4 {
+			return ephemeralResponse(usage), nil
+		}
+
+		tasks, tasksErr := p.GetUserTasks(user.Id, false)
+		if tasksErr != nil {
+			return nil, tasksErr
+		}
+		position, errParse := strconv.Atoi(split[3])
+		if errParse != nil || position < 1 || position > len(tasks) {
+			return ephemeralResponse(fmt.Sprintf("Task %s not found, `/cal todo list` shows the numbers.", split[3])), nil
+		}
+		current := &tasks[position-1]
+
+		if action == "remove" {
+			if current.Owner != user.Id {
+				return ephemeralResponse(fmt.Sprintf("Only the owner can remove **%s**.", current.Title)), nil
+			}
+			if removeErr := p.removeTask(user.Id, current.Id); removeErr != nil {
+				return nil, removeErr
+			}
+			return ephemeralResponse(fmt.Sprintf("Removed **%s**.", current.Title)), nil
+		}
+
+		changed := *current
+		changed.Status = TaskStatusCompleted
+		task := applyTaskChanges(current, &changed, user.Id)
+		normalizeTaskStatus(task, task.Updated)
+		if updateErr := p.updateTask(task, current); updateErr != nil {
+			return nil, updateErr
+		}
+		return ephemeralResponse(fmt.Sprintf("Completed **%s**.", task.Title)), nil
+	default:
+		return ephemeralResponse(usage), nil
+	}
+}
+
+// formatTaskList formats the open tasks as a numbered table
+func formatTaskList(tasks []Task, loc *time.Location) string {
+	if len(tasks) == 0 {
+		return "No open tasks."
+	}
+
+	message := "| # | task | due | status |\n| - | ---- | --- | ------ |\n"
+	for i, task := range tasks {
+		due := ""
+		if task.Due != nil {
+			due = task.Due.In(loc).Format(EventDateLayout + " " + BusinessTimeLayout)
+		}
+		message += fmt.Sprintf("|%d|%s|%s|%s|\n", i+1, task.Title, due, strings.ToLower(string(task.Status)))
+	}
+	return message
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var taskRowColumns = []string{"id", "title", "description", "due", "status", "priority", "completed", "owner", "assignee", "ical_data", "reminded", "created", "updated"}
+
+func TestApplyTaskChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	due := time.Date(2024, 3, 20, 17, 0, 0, 0, time.UTC)
+	completed := time.Date(2024, 3, 19, 12, 0, 0, 0, time.UTC)
+	current := &Task{
+		Id:       "task-1",
+		Title:    "Write the report",
+		Due:      &due,
+		Status:   TaskStatusNeedsAction,
+		Priority: 5,
+		Owner:    "test-user",
+		Assignee: "alice-id",
+	}
+	changed := &Task{
+		Id:        "task-1",
+		Title:     "Renamed",
+		Status:    TaskStatusCompleted,
+		Priority:  1,
+		Completed: &completed,
+		Assignee:  "bob-id",
+	}
+
+	// the assignee only changes the status
+	task := applyTaskChanges(current, changed, "alice-id")
+	assert.Equal("Write the report", task.Title)
+	assert.Equal(&due, task.Due)
+	assert.Equal(5, task.Priority)
+	assert.Equal("alice-id", task.Assignee)
+	assert.Equal(TaskStatusCompleted, task.Status)
+	assert.Equal(&completed, task.Completed)
+	assert.Equal("test-user", task.Owner)
+
+	task = applyTaskChanges(current, changed, "test-user")
+	assert.Equal("Renamed", task.Title)
+	assert.Nil(task.Due)
+	assert.Equal(1, task.Priority)
+	assert.Equal("bob-id", task.Assignee)
+
+	// reopening a task clears its completion
+	task.Completed = &completed
+	reopened := *task
+	reopened.Status = TaskStatusInProcess
+	reopened.Completed = nil
+	task = applyTaskChanges(task, &reopened, "test-user")
+	assert.Equal(TaskStatusInProcess, task.Status)
+	assert.Nil(task.Completed)
+}
+
+func TestNormalizeTaskStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+	task := &Task{}
+	normalizeTaskStatus(task, now)
+	assert.Equal(TaskStatusNeedsAction, task.Status)
+	assert.Nil(task.Completed)
+
+	task.Status = TaskStatusCompleted
+	normalizeTaskStatus(task, now)
+	assert.Equal(&now, task.Completed)
+
+	task.Status = TaskStatusCancelled
+	normalizeTaskStatus(task, now)
+	assert.Nil(task.Completed)
+}
+
+func TestCreateTask(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/tasks")
+	defer closeDB()
+	api.On("GetUser", "alice-id").Return(&model.User{Id: "alice-id"}, nil)
+
+	due := time.Date(2024, 3, 20, 17, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_tasks (id,title,description,due,status,priority,completed,owner,assignee,ical_data,reminded,created,updated) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)")).
+		WithArgs(sqlmock.AnyArg(), "Write the report", "", due, TaskStatusNeedsAction, 3, nil, "test-user", "alice-id",
+			nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body := strings.NewReader(`{"title":" Write the report ","due":"2024-03-20T17:00:00Z","priority":3,"assignee":"alice-id"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/tasks", body)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"title":"Write the report"`)
+	assert.Contains(w.Body.String(), `"status":"NEEDS-ACTION"`)
+	assert.NotContains(w.Body.String(), "ical_data")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCreateTask_Invalid(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/tasks")
+	defer closeDB()
+	api.On("GetUser", "nobody").Return(nil, &model.AppError{Message: "not found"})
+
+	for body, code := range map[string]int{
+		`{"title":""}`:                           http.StatusBadRequest,
+		`{"title":"Report","status":"DONE"}`:     http.StatusBadRequest,
+		`{"title":"Report","priority":10}`:       http.StatusBadRequest,
+		`{"title":"Report","assignee":"nobody"}`: http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/tasks", strings.NewReader(body))
+		calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+		assert.Equal(code, w.Code, body)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestUpdateTask_Assignee(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPut, "/tasks")
+	defer closeDB()
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_tasks WHERE (id = $1 AND (owner = $2 OR assignee = $3))")).
+		WithArgs("task-1", "test-user", "test-user").
+		WillReturnRows(sqlmock.NewRows(taskRowColumns).
+			AddRow("task-1", "Review the slides", "", nil, "NEEDS-ACTION", 0, nil, "other-user", "test-user", nil, nil, now, now))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_tasks SET")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body := strings.NewReader(`{"id":"task-1","title":"Skip the slides","status":"COMPLETED"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/tasks", body)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"title":"Review the slides"`)
+	assert.Contains(w.Body.String(), `"status":"COMPLETED"`)
+	assert.Contains(w.Body.String(), `"completed":"`)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRemoveTask_NotOwner(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodDelete, "/tasks/task-1")
+	defer closeDB()
+
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_tasks WHERE id = $1 AND owner = $2")).
+		WithArgs("task-1", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, "/tasks/task-1", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRemindDueTasks(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, dbMock, closeDB := newSyncTestPlugin(t)
+	defer closeDB()
+	calPlugin.BotId = "bot-id"
+	api := calPlugin.API.(*plugintest.API)
+
+	now := time.Date(2024, 3, 20, 17, 0, 10, 0, time.UTC)
+	due := time.Date(2024, 3, 20, 17, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_tasks WHERE (due <= $1 AND due > $2 AND reminded IS NULL AND status IN ($3,$4))")).
+		WithArgs(now, now.Add(-taskReminderWindow), TaskStatusNeedsAction, TaskStatusInProcess).
+		WillReturnRows(sqlmock.NewRows(taskRowColumns).
+			AddRow("task-1", "Write the report", "For the board", due, "NEEDS-ACTION", 0, nil, "other-user", "test-user", nil, nil, due, due))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_tasks SET reminded = $1 WHERE id = $2")).
+		WithArgs(due, "task-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	api.On("GetDirectChannel", "test-user", "bot-id").Return(&model.Channel{Id: "dm-1"}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "dm-1" && post.UserId == "bot-id" &&
+			post.Message == ":white_check_mark: **Task due** *Write the report*\n**description:**\nFor the board"
+	})).Return(&model.Post{}, nil)
+
+	calPlugin.remindDueTasks(now)
+
+	api.AssertCalled(t, "GetDirectChannel", "test-user", "bot-id")
+	api.AssertNumberOfCalls(t, "CreatePost", 1)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestExecuteTodoCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/")
+	defer closeDB()
+
+	// 17:00 in Berlin is 16:00 UTC
+	due := time.Date(2024, 3, 20, 16, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_tasks")).
+		WithArgs(sqlmock.AnyArg(), "Write the report", "", due, TaskStatusNeedsAction, 0, nil, "test-user", "test-user",
+			nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	response, appErr := calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+		Command: `/cal todo add "Write the report" 2024-03-20 17:00`,
+		UserId:  "test-user",
+	})
+	assert.Nil(appErr)
+	assert.Equal(model.CommandResponseTypeEphemeral, response.ResponseType)
+	assert.Equal("Added **Write the report**, due 2024-03-20 17:00.", response.Text)
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	expectOpenTasks := func() {
+		dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_tasks WHERE ((owner = $1 OR assignee = $2) AND status IN ($3,$4)) ORDER BY due IS NULL, due, created")).
+			WithArgs("test-user", "test-user", TaskStatusNeedsAction, TaskStatusInProcess).
+			WillReturnRows(sqlmock.NewRows(taskRowColumns).
+				AddRow("task-1", "Write the report", "", due, "NEEDS-ACTION", 0, nil, "test-user", "test-user", nil, nil, now, now).
+				AddRow("task-2", "Review the slides", "", nil, "IN-PROCESS", 0, nil, "other-user", "test-user", nil, nil, now, now))
+	}
+
+	expectOpenTasks()
+	response, appErr = calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: `/cal todo`, UserId: "test-user"})
+	assert.Nil(appErr)
+	assert.Equal("| # | task | due | status |\n| - | ---- | --- | ------ |\n"+
+		"|1|Write the report|2024-03-20 17:00|needs-action|\n"+
+		"|2|Review the slides||in-process|\n", response.Text)
+
+	expectOpenTasks()
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_tasks SET")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	response, appErr = calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: `/cal todo done 2`, UserId: "test-user"})
+	assert.Nil(appErr)
+	assert.Equal("Completed **Review the slides**.", response.Text)
+
+	// only the owner removes a task
+	expectOpenTasks()
+	response, appErr = calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: `/cal todo remove 2`, UserId: "test-user"})
+	assert.Nil(appErr)
+	assert.Equal("Only the owner can remove **Review the slides**.", response.Text)
+
+	expectOpenTasks()
+	response, appErr = calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: `/cal todo done 3`, UserId: "test-user"})
+	assert.Nil(appErr)
+	assert.Equal("Task 3 not found, `/cal todo list` shows the numbers.", response.Text)
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// DefaultTemplateDuration is the duration in minutes of events from templates without one
+const DefaultTemplateDuration = 30
+
+var templateColumns = []string{
+	"id",
+	"name",
+	"owner",
+	"team",
+	"title",
+	"description",
+	"duration",
+	"attendees",
+	"channel",
+	"visibility",
+	"color",
+	"alert",
+	"created",
+	"updated",
+}
+
+// expandTemplateTitle fills the placeholders of a template title: {date} and {time} of the start
+// in the user's timezone and {user}, the username of the user creating the event
+func expandTemplateTitle(template *EventTemplate, user *model.User, start time.Time) string {
+	if template.Title == "" {
+		return template.Name
+	}
+	return strings.NewReplacer(
+		"{date}", start.Format(EventDateLayout),
+		"{time}", start.Format(BusinessTimeLayout),
+		"{user}", user.Username,
+	).Replace(template.Title)
+}
+
+// instantiateTemplate builds the event of a template starting at start, a wall-clock time in loc
+func instantiateTemplate(template *EventTemplate, user *model.User, start time.Time, loc *time.Location) Event {
+	duration := template.Duration
+	if duration <= 0 {
+		duration = DefaultTemplateDuration
+	}
+
+	return Event{
+		Title:       expandTemplateTitle(template, user, start.In(loc)),
+		Description: template.Description,
+		Start:       start,
+		End:         start.Add(time.Duration(duration) * time.Minute),
+		Timezone:    loc.String(),
+		Attendees:   append([]string{}, template.Attendees...),
+		Team:        template.Team,
+		Channel:     template.Channel,
+		Visibility:  template.Visibility,
+		Color:       template.Color,
+		Alert:       template.Alert,
+	}
+}
+
+// validateTemplate checks a template sent by the user, team templates can only be shared with the user's teams
+// and channel templates with their channels
+func (p *Plugin) validateTemplate(user *model.User, template *EventTemplate) *model.AppError {
+	template.Name = strings.TrimSpace(template.Name)
+	if template.Name == "" || len(template.Name) > 100 || template.Duration < 0 {
+		return InvalidRequestParams
+	}
+	if template.Duration == 0 {
+		template.Duration = DefaultTemplateDuration
+	}
+	if template.Visibility == "" {
+		template.Visibility = VisibilityPrivate
+	}
+	if template.Visibility == VisibilityChannel && template.Channel == nil {
+		p.API.LogError("Channel is required for channel visibility")
+		return InvalidRequestParams
+	}
+
+	if template.Team != "" {
+		teams, teamsErr := p.GetUserTeams(user.Id)
+		if teamsErr != nil {
+			return teamsErr
+		}
+		if !contains(teams, template.Team) {
+			return NotAuthorizedError
+		}
+	}
+
+	if template.Channel != nil && *template.Channel != "" {
+		if _, memberErr := p.API.GetChannelMember(*template.Channel, user.Id); memberErr != nil {
+			return NotAuthorizedError
+		}
+	}
+
+	return nil
+}
+
+// getTemplate returns the template if the user may see it, their own and those of their teams
+func (p *Plugin) getTemplate(user *model.User, templateId string) (*EventTemplate, *model.AppError) {
+	queryBuilder := sq.Select(templateColumns...).
+		From("calendar_event_templates").
+		Where(sq.Eq{"id": templateId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var template EventTemplate
+	if errSelect := p.DB.Get(&template, querySql, argsSql...); errSelect != nil {
+		if !errors.Is(errSelect, sql.ErrNoRows) {
+			p.API.LogError(errSelect.Error())
+		}
+		return nil, TemplateNotFound
+	}
+
+	if template.Owner != user.Id {
+		teams, teamsErr := p.GetUserTeams(user.Id)
+		if teamsErr != nil {
+			return nil, teamsErr
+		}
+		if template.Team == "" || !contains(teams, template.Team) {
+			return nil, TemplateNotFound
+		}
+	}
+
+	return &template, nil
+}
+
+// findTemplate returns the template with the name, ignoring case. The user's own templates
+// take precedence over those of the team.
+func (p *Plugin) findTemplate(userId, teamId, name string) (*EventTemplate, *model.AppError) {
+	visible := sq.Or{sq.Eq{"owner": userId}}
+	if teamId != "" {
+		visible = append(visible, sq.Eq{"team": teamId})
+	}
+
+	queryBuilder := sq.Select(templateColumns...).
+		From("calendar_event_templates").
+		Where(sq.And{
+			sq.Expr("LOWER(name) = ?", strings.ToLower(strings.TrimSpace(name))),
+			visible,
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	var templates []EventTemplate
+	if errSelect := p.DB.Select(&templates, querySql, argsSql...); errSelect != nil {
+		p.API.LogError(errSelect.Error())
+		return nil, SomethingWentWrong
+	}
+
+	var found *EventTemplate
+	for i := range templates {
+		if templates[i].Owner == userId && templates[i].Team == "" {
+			return &templates[i], nil
+		}
+		if found == nil {
+			found = &templates[i]
+		}
+	}
+	if found == nil {
+		return nil, TemplateNotFound
+	}
+	return found, nil
+}
+
+func (p *Plugin) GetTemplates(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError("can't get session")
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	teams, teamsErr := p.GetUserTeams(session.UserId)
+	if teamsErr != nil {
+		errorResponse(w, teamsErr)
+		return
+	}
+
+	visible := sq.Or{sq.Eq{"owner": session.UserId}}
+	if len(teams) > 0 {
+		visible = append(visible, sq.Eq{"team": teams})
+	}
+
+	queryBuilder := sq.Select(templateColumns...).
+		From("calendar_event_templates").
+		Where(visible).
+		OrderBy("name").
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	templates := []EventTemplate{}
+	if errSelect := p.DB.Select(&templates, querySql, argsSql...); errSelect != nil {
+		p.API.LogError(errSelect.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	apiResponse(w, &templates)
+}
+
+func (p *Plugin) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError("can't get session")
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	user, err := p.API.GetUser(session.UserId)
+	if err != nil {
+		p.API.LogError("can't get user")
+		errorResponse(w, UserNotFound)
+		return
+	}
+
+	template, templateErr := p.getTemplate(user, mux.Vars(r)["templateId"])
+	if templateErr != nil {
+		errorResponse(w, templateErr)
+		return
+	}
+
+	apiResponse(w, template)
+}
+
+func (p *Plugin) CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError(err.Error())
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	user, err := p.API.GetUser(session.UserId)
+	if err != nil {
+		p.API.LogError(err.Error())
+		errorResponse(w, UserNotFound)
+		return
+	}
+
+	var template EventTemplate
+	if errDecode := json.NewDecoder(r.Body).Decode(&template); errDecode != nil {
+		p.API.LogError(errDecode.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	if validateErr := p.validateTemplate(user, &template); validateErr != nil {
+		errorResponse(w, validateErr)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	template.Id = uuid.New().String()
+	template.Owner = user.Id
+	template.Created = now
+	template.Updated = now
+
+	queryBuilder := sq.Insert("calendar_event_templates").
+		Columns(templateColumns...).
+		Values(
+			template.Id,
+			template.Name,
+			template.Owner,
+			template.Team,
+			template.Title,
+			template.Description,
+			template.Duration,
+			template.Attendees,
+			template.Channel,
+			template.Visibility,
+			template.Color,
+			template.Alert,
+			template.Created,
+			template.Updated,
+		).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	if _, errInsert := p.DB.Exec(querySql, argsSql...); errInsert != nil {
+		p.API.LogError(errInsert.Error())
+		errorResponse(w, CantSaveTemplate)
+		return
+	}
+
+	apiResponse(w, &template)
+}
+
+func (p *Plugin) UpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError(err.Error())
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	user, err := p.API.GetUser(session.UserId)
+	if err != nil {
+		p.API.LogError(err.Error())
+		errorResponse(w, UserNotFound)
+		return
+	}
+
+	var template EventTemplate
+	if errDecode := json.NewDecoder(r.Body).Decode(&template); errDecode != nil {
+		p.API.LogError(errDecode.Error())
+		errorResponse(w, InvalidRequestParams)
+		return
+	}
+
+	current, templateErr := p.getTemplate(user, template.Id)
+	if templateErr != nil {
+		errorResponse(w, templateErr)
+		return
+	}
+	// team members use a team template, its owner changes it
+	if current.Owner != user.Id {
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	if validateErr := p.validateTemplate(user, &template); validateErr != nil {
+		errorResponse(w, validateErr)
+		return
+	}
+
+	template.Owner = current.Owner
+	template.Created = current.Created
+	template.Updated = time.Now().UTC().Truncate(time.Second)
+
+	queryBuilder := sq.Update("calendar_event_templates").
+		SetMap(map[string]interface{}{
+			"name":        template.Name,
+			"team":        template.Team,
+			"title":       template.Title,
+			"description": template.Description,
+			"duration":    template.Duration,
+			"attendees":   template.Attendees,
+			"channel":     template.Channel,
+			"visibility":  template.Visibility,
+			"color":       template.Color,
+			"alert":       template.Alert,
+			"updated":     template.Updated,
+		}).
+		Where(sq.Eq{"id": template.Id}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	if _, errUpdate := p.DB.Exec(querySql, argsSql...); errUpdate != nil {
+		p.API.LogError(errUpdate.Error())
+		errorResponse(w, CantSaveTemplate)
+		return
+	}
+
+	apiResponse(w, &template)
+}
+
+func (p *Plugin) RemoveTemplate(w http.ResponseWriter, r *http.Request) {
+	pluginContext := p.FromContext(r.Context())
+	session, err := p.API.GetSession(pluginContext.SessionId)
+	if err != nil {
+		p.API.LogError("can't get session")
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	queryBuilder := sq.Delete("calendar_event_templates").
+		Where(sq.Eq{"id": mux.Vars(r)["templateId"], "owner": session.UserId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, argsSql, _ := queryBuilder.ToSql()
+
+	result, errDelete := p.DB.Exec(querySql, argsSql...)
+	if errDelete != nil {
+		p.API.LogError(errDelete.Error())
+		errorResponse(w, CantRemoveTemplate)
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		errorResponse(w, TemplateNotFound)
+		return
+	}
+
+	apiResponse(w, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var templateRowColumns = []string{
+	"id", "name", "owner", "team", "title", "description", "duration", "attendees",
+	"channel", "visibility", "color", "alert", "created", "updated",
+}
+
+func newTemplateTestPlugin(t *testing.T, method, path string) (*Plugin, *plugintest.API, sqlmock.Sqlmock, func()) {
+	api := &plugintest.API{}
+	api.On("LogDebug", "Plugin HTTP request", "method", method, "path", path, "user-agent", "").Return().Maybe()
+	api.On("GetSession", "session-id").Return(&model.Session{UserId: "test-user"}, nil).Maybe()
+	api.On("GetUser", "test-user").Return(&model.User{
+		Id:       "test-user",
+		Username: "alice",
+		Timezone: map[string]string{
+			"useAutomaticTimezone": "false",
+			"manualTimezone":       "Europe/Berlin",
+		},
+	}, nil).Maybe()
+	api.On("GetTeamsForUser", "test-user").Return([]*model.Team{{Id: "team-1"}}, nil).Maybe()
+	api.On("LogError", mock.Anything).Return().Maybe()
+
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	calPlugin := &Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: api,
+		},
+		DB: sqlx.NewDb(db, "sqlmock"),
+	}
+	calPlugin.router = calPlugin.InitAPI()
+
+	return calPlugin, api, dbMock, func() { db.Close() }
+}
+
+func TestInstantiateTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	channel := "channel-1"
+	template := &EventTemplate{
+		Name:        "Postmortem",
+		Title:       "Incident postmortem {date} ({user})",
+		Description: "## Timeline",
+		Duration:    45,
+		Attendees:   StringList{"user-1", "user-2"},
+		Channel:     &channel,
+		Visibility:  VisibilityChannel,
+		Alert:       EventAlert15MinutesBefore,
+	}
+	start := time.Date(2024, 3, 18, 0, 30, 0, 0, berlin)
+
+	event := instantiateTemplate(template, &model.User{Id: "test-user", Username: "alice"}, start, berlin)
+	assert.Equal("Incident postmortem 2024-03-18 (alice)", event.Title)
+	assert.Equal("## Timeline", event.Description)
+	assert.Equal(start, event.Start)
+	assert.Equal(start.Add(45*time.Minute), event.End)
+	assert.Equal("Europe/Berlin", event.Timezone)
+	assert.Equal([]string{"user-1", "user-2"}, event.Attendees)
+	assert.Equal(&channel, event.Channel)
+	assert.Equal(VisibilityChannel, event.Visibility)
+	assert.Equal(EventAlert15MinutesBefore, event.Alert)
+
+	// the name stands in for a missing title, the default duration for a missing one
+	event = instantiateTemplate(&EventTemplate{Name: "1:1"}, &model.User{}, start, berlin)
+	assert.Equal("1:1", event.Title)
+	assert.Equal(start.Add(DefaultTemplateDuration*time.Minute), event.End)
+}
+
+func TestSplitCommandArgs(t *testing.T) {
+	assert.Equal(t,
+		[]string{"/cal", "create", "--template", "Incident postmortem", "14:00"},
+		splitCommandArgs(`/cal create  --template "Incident postmortem" 14:00`),
+	)
+	assert.Equal(t, []string{"/cal", "create", ""}, splitCommandArgs(`/cal create ""`))
+}
+
+func TestParseCommandStart(t *testing.T) {
+	assert := assert.New(t)
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	now := time.Date(2024, 3, 18, 9, 20, 0, 0, berlin)
+
+	start, ok := parseCommandStart(nil, now, berlin)
+	assert.True(ok)
+	assert.Equal(time.Date(2024, 3, 18, 10, 0, 0, 0, berlin), start)
+
+	start, ok = parseCommandStart([]string{"14:30"}, now, berlin)
+	assert.True(ok)
+	assert.Equal(time.Date(2024, 3, 18, 14, 30, 0, 0, berlin), start)
+
+	start, ok = parseCommandStart([]string{"2024-03-20", "08:00"}, now, berlin)
+	assert.True(ok)
+	assert.Equal(time.Date(2024, 3, 20, 8, 0, 0, 0, berlin), start)
+
+	start, ok = parseCommandStart(nil, time.Date(2024, 3, 18, 23, 10, 0, 0, berlin), berlin)
+	assert.True(ok)
+	assert.Equal(time.Date(2024, 3, 19, 0, 0, 0, 0, berlin), start)
+
+	_, ok = parseCommandStart([]string{"tomorrow"}, now, berlin)
+	assert.False(ok)
+}
+
+func TestCreateTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/templates")
+	defer closeDB()
+
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_event_templates (id,name,owner,team,title,description,duration,attendees,channel,visibility,color,alert,created,updated) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)")).
+		WithArgs(sqlmock.AnyArg(), "1:1", "test-user", "team-1", "1:1 with {user}", "", 30, `["user-2"]`,
+			nil, VisibilityTeam, nil, EventAlert5MinutesBefore, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body := strings.NewReader(`{"name":" 1:1 ","team":"team-1","title":"1:1 with {user}","attendees":["user-2"],"visibility":"team","alert":"5_minutes_before"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/templates", body)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"name":"1:1"`)
+	assert.Contains(w.Body.String(), `"duration":30`)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestCreateTemplate_Invalid(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/templates")
+	defer closeDB()
+	api.On("GetChannelMember", "someone-elses", "test-user").Return(nil, &model.AppError{Message: "not a member"})
+
+	for body, code := range map[string]int{
+		`{"name":""}`:                                                     http.StatusBadRequest,
+		`{"name":"1:1","duration":-5}`:                                    http.StatusBadRequest,
+		`{"name":"1:1","visibility":"channel"}`:                           http.StatusBadRequest,
+		`{"name":"1:1","team":"someone-elses"}`:                           http.StatusUnauthorized,
+		`{"name":"1:1","visibility":"channel","channel":"someone-elses"}`: http.StatusUnauthorized,
+		`{"name":"1:1","alert":"when_it_starts"}`:                         http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/templates", strings.NewReader(body))
+		calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+		assert.Equal(code, w.Code, body)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestUpdateTemplate_TeamMember(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPut, "/templates")
+	defer closeDB()
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, name, owner, team, title, description, duration, attendees, channel, visibility, color, alert, created, updated FROM calendar_event_templates WHERE id = $1")).
+		WithArgs("template-1").
+		WillReturnRows(sqlmock.NewRows(templateRowColumns).
+			AddRow("template-1", "Postmortem", "other-user", "team-1", "", "", 60, "[]", nil, "team", nil, "", now, now))
+
+	body := strings.NewReader(`{"id":"template-1","name":"Mine now"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/templates", body)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	// team members see the template but only its owner changes it
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/templates")
+	defer closeDB()
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, name, owner, team, title, description, duration, attendees, channel, visibility, color, alert, created, updated FROM calendar_event_templates WHERE (owner = $1 OR team IN ($2)) ORDER BY name")).
+		WithArgs("test-user", "team-1").
+		WillReturnRows(sqlmock.NewRows(templateRowColumns).
+			AddRow("template-1", "1:1", "test-user", "", "", "", 30, `["user-2"]`, nil, "private", nil, "", now, now).
+			AddRow("template-2", "Postmortem", "other-user", "team-1", "", "", 60, "[]", nil, "team", nil, "", now, now))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/templates", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"attendees":["user-2"]`)
+	assert.Contains(w.Body.String(), `"id":"template-2"`)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRemoveTemplate_NotOwner(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodDelete, "/templates/template-1")
+	defer closeDB()
+
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_event_templates WHERE id = $1 AND owner = $2")).
+		WithArgs("template-1", "test-user").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, "/templates/template-1", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestExecuteCreateCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/")
+	defer closeDB()
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, name, owner, team, title, description, duration, attendees, channel, visibility, color, alert, created, updated FROM calendar_event_templates WHERE (LOWER(name) = $1 AND (owner = $2 OR team = $3))")).
+		WithArgs("incident postmortem", "test-user", "team-1").
+		WillReturnRows(sqlmock.NewRows(templateRowColumns).
+			AddRow("template-2", "Incident postmortem", "other-user", "team-1", "Postmortem {date}", "## Timeline", 60, `["user-2"]`, nil, "channel", nil, "15_minutes_before", now, now).
+			AddRow("template-1", "Incident postmortem", "test-user", "", "My postmortem", "", 30, "[]", nil, "private", nil, "", now, now))
+
+	// the user's own template wins, 14:00 in Berlin is 13:00 UTC
+	start := time.Date(2024, 3, 20, 13, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("INSERT INTO calendar_events")).
+		WithArgs(sqlmock.AnyArg(), "My postmortem", "", start, start.Add(30*time.Minute), false, "Europe/Berlin",
+			sqlmock.AnyArg(), sqlmock.AnyArg(), "test-user", nil, false, "", nil, nil, nil, VisibilityPrivate, "team-1", EventAlertNone, nil).
+		WillReturnRows(sqlmock.NewRows([]string{}))
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ce.owner, ce.visibility, ce.channel, ce.team, cm.member FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_sync_changes")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	response, appErr := calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+		Command:   `/cal create --template Incident Postmortem 2024-03-20 14:00`,
+		UserId:    "test-user",
+		TeamId:    "team-1",
+		ChannelId: "channel-1",
+	})
+	assert.Nil(appErr)
+	assert.Equal(model.CommandResponseTypeEphemeral, response.ResponseType)
+	assert.Equal("Created **My postmortem** at 2024-03-20 14:00 - 14:30.", response.Text)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestExecuteCreateCommand_Usage(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/")
+	defer closeDB()
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_event_templates")).
+		WillReturnRows(sqlmock.NewRows(templateRowColumns))
+
+	for command, text := range map[string]string{
+		`/cal create`:     "Usage: `/cal create --template <name> [YYYY-MM-DD] [HH:MM]`",
+		`/cal create 1:1`: "Usage: `/cal create --template <name> [YYYY-MM-DD] [HH:MM]`",
+		`/cal create --template "1:1" 14:00 someday`: "Usage: `/cal create --template <name> [YYYY-MM-DD] [HH:MM]`",
+		`/cal create --template "Retro"`:             `Template "Retro" not found.`,
+	} {
+		response, appErr := calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: command, UserId: "test-user"})
+		assert.Nil(appErr, command)
+		assert.Equal(text, response.Text, command)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// locations caches the zones loaded by name, time.LoadLocation reads the zone database every time
+var locations sync.Map
+
+// loadLocation returns the IANA zone with the name, nil if the name is empty or unknown
+func loadLocation(name string) *time.Location {
+	if name == "" {
+		return nil
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location)
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil
+	}
+	locations.Store(name, loc)
+	return loc
+}
+
+// isUTC reports whether the zone is UTC
+func isUTC(loc *time.Location) bool {
+	return loc == time.UTC || loc.String() == "UTC"
+}
+
+// eventLocation returns the zone the event's times are anchored in, UTC for the events without one
+// like the all-day events, whose dates are the same everywhere
+func eventLocation(event *Event) *time.Location {
+	if loc := loadLocation(event.Timezone); loc != nil {
+		return loc
+	}
+	return time.UTC
+}
+
+var weekdayCodes = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// zoneTransitions returns the instants the UTC offset of the zone changes during the year
+func zoneTransitions(loc *time.Location, year int) []time.Time {
+	var transitions []time.Time
+
+	day := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := day.AddDate(1, 0, 0)
+	_, offset := day.In(loc).Zone()
+
+	for day.Before(end) {
+		next := day.Add(24 * time.Hour)
+		if _, nextOffset := next.In(loc).Zone(); nextOffset != offset {
+			// offsets change on minute boundaries
+			low, high := 0, 24*60
+			for high-low > 1 {
+				middle := (low + high) / 2
+				if _, middleOffset := day.Add(time.Duration(middle) * time.Minute).In(loc).Zone(); middleOffset == offset {
+					low = middle
+				} else {
+					high = middle
+				}
+			}
+			transitions = append(transitions, day.Add(time.Duration(high)*time.Minute))
+			offset = nextOffset
+		}
+		day = next
+	}
+
+	return transitions
+}
+
+// nthWeekday returns the n-th weekday of the month, counted from the end when n is negative
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	if n < 0 {
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+		return last.AddDate(0, 0, -((int(last.Weekday())-int(weekday)+7)%7 + (-n-1)*7))
+	}
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return first.AddDate(0, 0, (int(weekday)-int(first.Weekday())+7)%7+(n-1)*7)
+}
+
+// formatUTCOffset formats an offset in seconds as a UTC-OFFSET value such as +0100 or -0330
+func formatUTCOffset(offset int) string {
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	value := fmt.Sprintf("%c%02d%02d", sign, offset/3600, offset/60%60)
+	if offset%60 != 0 {
+		value += fmt.Sprintf("%02d", offset%60)
+	}
+	return value
+}
+
+// setObservance writes the properties of a STANDARD or DAYLIGHT observance
+func setObservance(base *ics.ComponentBase, onset string, offsetFrom, offsetTo int, name, rule string) {
+	base.SetProperty(ics.ComponentPropertyDtStart, onset)
+	base.SetProperty(componentPropertyTzOffsetFrom, formatUTCOffset(offsetFrom))
+	base.SetProperty(componentPropertyTzOffsetTo, formatUTCOffset(offsetTo))
+	if name != "" {
+		base.SetProperty(componentPropertyTzName, name)
+	}
+	if rule != "" {
+		base.SetProperty(ics.ComponentPropertyRrule, rule)
+	}
+}
+
+// newVTimezone describes an IANA zone by the offset changes of the year, repeating every year
+// on the same weekday of the month the way the DST rules of most zones do
+func newVTimezone(loc *time.Location, year int) *ics.VTimezone {
+	vtimezone := ics.NewTimezone(loc.String())
+
+	transitions := zoneTransitions(loc, year)
+	if len(transitions) == 0 {
+		name, offset := time.Date(year, time.January, 1, 0, 0, 0, 0, loc).Zone()
+		standard := &ics.Standard{}
+		setObservance(&standard.ComponentBase, "19700101T000000", offset, offset, name, "")
+		vtimezone.Components = append(vtimezone.Components, standard)
+		return vtimezone
+	}
+
+	for _, transition := range transitions {
+		_, offsetFrom := transition.Add(-time.Minute).In(loc).Zone()
+		name, offsetTo := transition.In(loc).Zone()
+
+		// the onset is the wall-clock time before the change
+		onset := transition.Add(time.Duration(offsetFrom) * time.Second)
+		n := (onset.Day()-1)/7 + 1
+		if onset.Day()+7 > time.Date(year, onset.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day() {
+			n = -1
+		}
+		first := nthWeekday(1970, onset.Month(), onset.Weekday(), n)
+		first = time.Date(first.Year(), first.Month(), first.Day(), onset.Hour(), onset.Minute(), onset.Second(), 0, time.UTC)
+		rule := fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%d%s", onset.Month(), n, weekdayCodes[onset.Weekday()])
+
+		if transition.In(loc).IsDST() {
+			daylight := &ics.Daylight{}
+			setObservance(&daylight.ComponentBase, first.Format(iCalLocalDateTimeLayout), offsetFrom, offsetTo, name, rule)
+			vtimezone.Components = append(vtimezone.Components, daylight)
+		} else {
+			standard := &ics.Standard{}
+			setObservance(&standard.ComponentBase, first.Format(iCalLocalDateTimeLayout), offsetFrom, offsetTo, name, rule)
+			vtimezone.Components = append(vtimezone.Components, standard)
+		}
+	}
+
+	return vtimezone
+}
+
+// addTimezones adds a VTIMEZONE for every IANA TZID the events use that the calendar doesn't define,
+// calendars must define every TZID they use (RFC 5545 3.6.5)
+func addTimezones(cal *ics.Calendar) {
+	defined := map[string]bool{}
+	for _, vtimezone := range cal.Timezones() {
+		if tzid := vtimezone.GetProperty(ics.ComponentPropertyTzid); tzid != nil {
+			defined[tzid.Value] = true
+		}
+	}
+
+	var timezones []ics.Component
+	for _, vevent := range cal.Events() {
+		for _, property := range vevent.Properties {
+			tzid := property.ICalParameters[string(ics.ParameterTzid)]
+			if len(tzid) == 0 || defined[tzid[0]] {
+				continue
+			}
+			loc := loadLocation(tzid[0])
+			if loc == nil {
+				continue
+			}
+
+			year := time.Now().Year()
+			if local, err := time.Parse(iCalLocalDateTimeLayout, property.Value); err == nil {
+				year = local.Year()
+			}
+			defined[tzid[0]] = true
+			timezones = append(timezones, newVTimezone(loc, year))
+		}
+	}
+
+	if len(timezones) > 0 {
+		cal.Components = append(timezones, cal.Components...)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	ics "github.com/arran4/golang-ical"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRecurrenceOccurrencesAcrossDST(t *testing.T) {
+	assert := assert.New(t)
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+
+	// Monday 10:00 in Berlin, the clocks go forward on March 31 2024
+	event := &Event{
+		Start:      time.Date(2024, 3, 18, 10, 0, 0, 0, berlin),
+		Recurrence: "RRULE:FREQ=WEEKLY",
+	}
+
+	occurrences, err := NewRecurrenceExpander().Occurrences(event, berlin, time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 8, 23, 0, 0, 0, time.UTC))
+	assert.NoError(err)
+	assert.Equal([]time.Time{
+		time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 25, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 4, 1, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, 4, 8, 8, 0, 0, 0, time.UTC),
+	}, occurrences)
+
+	// the clocks go back on November 3 2024 in New York
+	newYork, _ := time.LoadLocation("America/New_York")
+	event = &Event{
+		Start:      time.Date(2024, 11, 1, 9, 30, 0, 0, newYork),
+		Recurrence: "RRULE:FREQ=DAILY;COUNT=3",
+	}
+	occurrences, err = NewRecurrenceExpander().Occurrences(event, newYork, event.Start, event.Start.AddDate(0, 0, 5))
+	assert.NoError(err)
+	assert.Equal([]time.Time{
+		time.Date(2024, 11, 1, 13, 30, 0, 0, time.UTC),
+		time.Date(2024, 11, 2, 13, 30, 0, 0, time.UTC),
+		time.Date(2024, 11, 3, 14, 30, 0, 0, time.UTC),
+	}, occurrences)
+
+	_, err = NewRecurrenceExpander().Occurrences(&Event{Start: event.Start, Recurrence: "RRULE:FREQ=SOMETIMES"}, newYork, event.Start, event.Start)
+	assert.Error(err)
+}
+
+func TestEventLocation(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Europe/Berlin", eventLocation(&Event{Timezone: "Europe/Berlin"}).String())
+	assert.Equal(time.UTC, eventLocation(&Event{}))
+	assert.Equal(time.UTC, eventLocation(&Event{Timezone: "Mars/Olympus_Mons"}))
+}
+
+func TestNewVTimezone(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{
+			name: "Europe/Berlin",
+			expected: []string{
+				"BEGIN:DAYLIGHT", "DTSTART:19700329T020000", "TZOFFSETFROM:+0100", "TZOFFSETTO:+0200", "TZNAME:CEST",
+				"RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU",
+				"BEGIN:STANDARD", "DTSTART:19701025T030000", "TZOFFSETFROM:+0200", "TZOFFSETTO:+0100", "TZNAME:CET",
+				"RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU",
+			},
+		},
+		{
+			name: "America/New_York",
+			expected: []string{
+				"DTSTART:19700308T020000", "TZOFFSETFROM:-0500", "TZOFFSETTO:-0400", "RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=2SU",
+				"DTSTART:19701101T020000", "TZOFFSETFROM:-0400", "TZOFFSETTO:-0500", "RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=1SU",
+			},
+		},
+		{
+			name:     "Asia/Tokyo",
+			expected: []string{"BEGIN:STANDARD", "DTSTART:19700101T000000", "TZOFFSETFROM:+0900", "TZOFFSETTO:+0900", "TZNAME:JST"},
+		},
+	}
+
+	for _, test := range tests {
+		loc, err := time.LoadLocation(test.name)
+		assert.NoError(err)
+
+		serialized := newVTimezone(loc, 2024).Serialize()
+		assert.Contains(serialized, "TZID:"+test.name, test.name)
+		for _, line := range test.expected {
+			assert.Contains(serialized, line+"\r\n", test.name)
+		}
+		if test.name == "Asia/Tokyo" {
+			assert.NotContains(serialized, "DAYLIGHT")
+			assert.NotContains(serialized, "RRULE")
+		}
+	}
+}
+
+func TestNewVTimezoneRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	// the generated definitions convert like the zone database on both sides of the changes
+	for _, name := range []string{"Europe/Berlin", "America/New_York", "Australia/Sydney", "Asia/Kolkata"} {
+		loc, _ := time.LoadLocation(name)
+		timezone := parseVTimezone(newVTimezone(loc, 2024))
+
+		for _, month := range []time.Month{time.January, time.March, time.April, time.July, time.October, time.November, time.December} {
+			local := time.Date(2025, month, 15, 10, 0, 0, 0, time.UTC)
+			expected := time.Date(2025, month, 15, 10, 0, 0, 0, loc).UTC()
+			assert.Equal(expected, timezone.toUTC(local), "%s in %s", name, month)
+		}
+	}
+}
+
+func TestFormatUTCOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("+0000", formatUTCOffset(0))
+	assert.Equal("+0530", formatUTCOffset(5*3600+30*60))
+	assert.Equal("-0330", formatUTCOffset(-(3*3600 + 30*60)))
+	assert.Equal("+011530", formatUTCOffset(3600+15*60+30))
+}
+
+func TestGenerateICalendarTimezone(t *testing.T) {
+	assert := assert.New(t)
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	events := []Event{
+		{
+			Id:         "weekly",
+			Title:      "Weekly",
+			Start:      time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC),
+			End:        time.Date(2024, 3, 18, 10, 0, 0, 0, time.UTC),
+			Timezone:   berlin.String(),
+			Recurrent:  true,
+			Recurrence: "RRULE:FREQ=WEEKLY",
+		},
+		{
+			Id:       "utc",
+			Title:    "UTC",
+			Start:    time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC),
+			End:      time.Date(2024, 3, 18, 10, 0, 0, 0, time.UTC),
+			Timezone: "UTC",
+		},
+	}
+
+	calPlugin := Plugin{}
+	output := calPlugin.generateICalendar(events, nil)
+
+	assert.Contains(output, "DTSTART;TZID=Europe/Berlin:20240318T100000\r\n")
+	assert.Contains(output, "DTEND;TZID=Europe/Berlin:20240318T110000\r\n")
+	assert.Contains(output, "DTSTART:20240318T090000Z\r\n")
+	assert.Equal(1, strings.Count(output, "BEGIN:VTIMEZONE"))
+	assert.Contains(output, "TZID:Europe/Berlin\r\n")
+	assert.Less(strings.Index(output, "BEGIN:VTIMEZONE"), strings.Index(output, "BEGIN:VEVENT"))
+
+	// clients parse the output back to the same instants
+	cal, err := ics.ParseCalendar(strings.NewReader(output))
+	assert.NoError(err)
+	backend := &CalDAVBackend{}
+	backend.loadTimezones(cal)
+	for _, vevent := range cal.Events() {
+		dtstart := vevent.GetProperty(ics.ComponentPropertyDtStart)
+		assert.Equal(time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC), backend.parseICalTime(dtstart))
+	}
+}
+
+func TestCalDAVEventTimezone(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, _, closeDB := newScheduleTestPlugin(t)
+	defer closeDB()
+	api.On("LogWarn", "Unknown timezone", "tzid", "Custom Zone").Maybe()
+	backend := NewCalDAVBackend(calPlugin, "test-user", "token", "#1E90FFFF")
+
+	tests := []struct {
+		name     string
+		dtstart  string
+		timezone string
+	}{
+		{"iana", "DTSTART;TZID=Europe/Berlin:20240318T100000", "Europe/Berlin"},
+		{"windows", "DTSTART;TZID=W. Europe Standard Time:20240318T100000", "Europe/Berlin"},
+		{"prefixed", "DTSTART;TZID=/mozilla.org/20050126_1/America/New_York:20240318T100000", "America/New_York"},
+		{"utc", "DTSTART:20240318T100000Z", "UTC"},
+		{"floating", "DTSTART:20240318T100000", "UTC"},
+		{"unknown", "DTSTART;TZID=Custom Zone:20240318T100000", "UTC"},
+		{"date", "DTSTART;VALUE=DATE:20240318", ""},
+	}
+
+	for _, test := range tests {
+		input := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Test//EN\r\nBEGIN:VEVENT\r\nUID:tz\r\n" +
+			test.dtstart + "\r\nSUMMARY:Timezone\r\nRRULE:FREQ=WEEKLY\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+		cal, err := ics.ParseCalendar(strings.NewReader(input))
+		assert.NoError(err, test.name)
+
+		event, err := backend.icalendarToEvent(cal, "tz")
+		assert.NoError(err, test.name)
+		assert.Equal(test.timezone, event.Timezone, test.name)
+	}
+}
+
+func TestGetUserEventsUTCAcrossDST(t *testing.T) {
+	assert := assert.New(t)
+
+	api := plugintest.API{}
+	api.On("GetTeamsForUser", "test-user").Return([]*model.Team{}, nil)
+
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbMock.MatchExpectationsInOrder(false)
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ChannelId FROM ChannelMembers")).
+		WillReturnRows(sqlmock.NewRows([]string{"channelid"}))
+
+	// both start on Monday March 25 2024 at 10:00 in Berlin, before the clocks go forward
+	start := time.Date(2024, 3, 25, 9, 0, 0, 0, time.UTC)
+	columns := []string{"id", "title", "dt_start", "dt_end", "all_day", "timezone", "owner", "visibility", "recurrent", "recurrence", "alert"}
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("berlin", "Berlin", start, start.Add(time.Hour), false, "Europe/Berlin", "test-user", "private", true, "RRULE:FREQ=WEEKLY", "").
+			// saved before the zone was stored, it is expanded in the viewer's zone
+			AddRow("legacy", "Legacy", start, start.Add(time.Hour), false, "", "test-user", "private", true, "RRULE:FREQ=WEEKLY", ""))
+
+	calPlugin := Plugin{
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+		DB: sqlx.NewDb(db, "sqlmock"),
+	}
+
+	rangeStart := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	events, appErr := calPlugin.GetUserEventsUTC("test-user", time.UTC, rangeStart, rangeStart.AddDate(0, 0, 1))
+	assert.Nil(appErr)
+
+	byId := map[string]Event{}
+	for _, event := range events {
+		byId[event.Id] = event
+	}
+	assert.Len(byId, 2)
+	assert.Equal(time.Date(2024, 4, 1, 8, 0, 0, 0, time.UTC), byId["berlin"].Start)
+	assert.Equal(time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC), byId["berlin"].End)
+	assert.Equal(time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC), byId["legacy"].Start)
+}
+
+func TestProcessRecurrentEventAcrossDST(t *testing.T) {
+	botId := "bot-id"
+	channelId := "channel-id"
+	api := plugintest.API{}
+
+	pluginT := &Plugin{
+		BotId: botId,
+		MattermostPlugin: plugin.MattermostPlugin{
+			API: &api,
+		},
+	}
+
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	pluginT.SetDB(sqlx.NewDb(db, "sqlmock"))
+
+	api.On("PublishWebSocketEvent", wsEventOccur, mock.Anything, mock.Anything).Return()
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == channelId
+	})).Return(nil, nil).Once()
+
+	// Monday 10:00 in Berlin, 09:00 UTC before the clocks go forward on March 31 2024
+	start := time.Date(2024, 3, 25, 9, 0, 0, 0, time.UTC)
+	columns := []string{"id", "title", "dt_start", "dt_end", "all_day", "timezone", "owner", "channel", "member", "recurrent", "recurrence", "alert", "alert_time"}
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).
+			AddRow("weekly", "Weekly", start, start.Add(time.Hour), false, "Europe/Berlin", "owner-id", channelId, nil, true, "RRULE:FREQ=WEEKLY", "", nil)
+	}
+
+	background := &Background{plugin: pluginT}
+
+	// 10:00 in Berlin is 08:00 UTC in summer
+	summerTick := time.Date(2024, 4, 1, 8, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce")).WillReturnRows(rows())
+	dbMock.ExpectQuery(regexp.QuoteMeta("UPDATE calendar_events SET processed = $1 WHERE id = $2")).
+		WithArgs(summerTick, "weekly").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	// and notified again next week at the same time of day
+	nextSql := regexp.QuoteMeta("UPDATE calendar_events SET next_notification = $1 WHERE id = $2")
+	dbMock.ExpectExec(nextSql).
+		WithArgs(summerTick.AddDate(0, 0, 7), "weekly").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	background.process(summerTick)
+
+	// the winter time of day is an hour late now
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce")).WillReturnRows(rows())
+	dbMock.ExpectExec(nextSql).
+		WithArgs(summerTick.AddDate(0, 0, 7), "weekly").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	background.process(summerTick.Add(time.Hour))
+
+	if err := dbMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	api.AssertExpectations(t)
+}
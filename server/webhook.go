@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// WebhookEventType is the calendar change a webhook is sent for
+type WebhookEventType string
+
+const (
+	WebhookEventCreated  WebhookEventType = "created"
+	WebhookEventUpdated  WebhookEventType = "updated"
+	WebhookEventDeleted  WebhookEventType = "deleted"
+	WebhookEventStarted  WebhookEventType = "started"
+	WebhookEventReminder WebhookEventType = "reminder"
+)
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+
+	// WebhookSignatureHeader carries the hex HMAC-SHA256 of the body, keyed by the webhook secret
+	WebhookSignatureHeader = "X-Calendar-Signature"
+
+	webhookMaxAttempts  = 6
+	webhookRetryBase    = 30 * time.Second
+	webhookBatchSize    = 50
+	webhookLogPageSize  = 50
+	webhookErrorMaxSize = 1000
+
+	// webhookClaimLease is how long a claimed row is left to the server sending it, well above the
+	// send timeouts so that a row is only picked up again if that server went away mid-send
+	webhookClaimLease = 5 * time.Minute
+
+	// webhookRetention is how long delivered and failed deliveries are kept in the log
+	webhookRetention = 30 * 24 * time.Hour
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookPayload is the JSON body POSTed to the webhook URLs
+type WebhookPayload struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Event     *Event    `json:"event"`
+}
+
+// WebhookDelivery is a webhook to send or sent, the rows are both the queue of the background job
+// and the delivery log
+type WebhookDelivery struct {
+	Id           string     `json:"id" db:"id"`
+	URL          string     `json:"url" db:"url"`
+	EventType    string     `json:"event_type" db:"event_type"`
+	EventId      string     `json:"event_id" db:"event_id"`
+	Payload      string     `json:"-" db:"payload"`
+	Status       string     `json:"status" db:"status"`
+	Attempts     int        `json:"attempts" db:"attempts"`
+	NextAttempt  time.Time  `json:"next_attempt" db:"next_attempt"`
+	ResponseCode int        `json:"response_code" db:"response_code"`
+	LastError    string     `json:"last_error" db:"last_error"`
+	Created      time.Time  `json:"created" db:"created"`
+	Delivered    *time.Time `json:"delivered" db:"delivered"`
+}
+
+var webhookDeliveryColumns = []string{
+	"id",
+	"url",
+	"event_type",
+	"event_id",
+	"payload",
+	"status",
+	"attempts",
+	"next_attempt",
+	"response_code",
+	"last_error",
+	"created",
+	"delivered",
+}
+
+// webhookURLs returns the configured URLs, one per line
+func (c *configuration) webhookURLs() []string {
+	var urls []string
+	for _, line := range strings.FieldsFunc(c.WebhookURLs, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if url := strings.TrimSpace(line); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// webhookSubscribed reports whether webhooks are sent for the event type, all of them when the
+// configuration doesn't list any
+func (c *configuration) webhookSubscribed(eventType WebhookEventType) bool {
+	if len(c.webhookURLs()) == 0 {
+		return false
+	}
+	if strings.TrimSpace(c.WebhookEvents) == "" {
+		return true
+	}
+	for _, subscribed := range strings.Split(c.WebhookEvents, ",") {
+		if WebhookEventType(strings.TrimSpace(subscribed)) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhook returns the signature of the body sent in WebhookSignatureHeader
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns the delay before the next attempt of a delivery that failed attempts times
+func webhookBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return webhookRetryBase << (attempts - 1)
+}
+
+// webhookTargets returns the URLs and the plugins the event type is sent to
+func (p *Plugin) webhookTargets(eventType WebhookEventType) []string {
+	var targets []string
+	if config := p.getConfiguration(); config.webhookSubscribed(eventType) {
+		targets = append(targets, config.webhookURLs()...)
+	}
+	return append(targets, p.pluginSubscriptionTargets(eventType)...)
+}
+
+// enqueueWebhook queues a delivery of the event to every webhook URL and subscribed plugin, the
+// background job sends them
+func (p *Plugin) enqueueWebhook(eventType WebhookEventType, event *Event) {
+	targets := p.webhookTargets(eventType)
+	if len(targets) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	payload, errMarshal := json.Marshal(&WebhookPayload{
+		Type:      "event." + string(eventType),
+		Timestamp: now,
+		Event:     event,
+	})
+	if errMarshal != nil {
+		p.API.LogError("enqueueWebhook: can't marshal payload: " + errMarshal.Error())
+		return
+	}
+
+	insertBuilder := sq.Insert("calendar_webhook_deliveries").
+		Columns("id", "url", "event_type", "event_id", "payload", "status", "next_attempt", "last_error", "created")
+	for _, target := range targets {
+		insertBuilder = insertBuilder.Values(model.NewId(), target, string(eventType), event.Id, string(payload), WebhookDeliveryPending, now, "", now)
+	}
+	insertSql, insertArgs, _ := insertBuilder.PlaceholderFormat(p.GetDBPlaceholderFormat()).ToSql()
+
+	if _, errInsert := p.DB.Exec(insertSql, insertArgs...); errInsert != nil {
+		p.API.LogError("enqueueWebhook: can't queue delivery: " + errInsert.Error())
+	}
+}
+
+// webhookRemovedEvent loads an event about to be removed for its deleted webhook, nil when the
+// webhook isn't sent
+func (p *Plugin) webhookRemovedEvent(eventId string) *Event {
+	if len(p.webhookTargets(WebhookEventDeleted)) == 0 {
+		return nil
+	}
+
+	queryBuilder := sq.Select(eventListColumns...).
+		From("calendar_events ce").
+		Where(sq.Eq{"ce.id": eventId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	event := Event{Id: eventId}
+	if errSelect := p.DB.Get(&event, querySql, args...); errSelect != nil {
+		p.API.LogWarn("Can't load the removed event for webhooks", "event", eventId, "error", errSelect.Error())
+	}
+	return &event
+}
+
+// sendWebhook POSTs the delivery, a non-2xx response is an error
+func (p *Plugin) sendWebhook(delivery *WebhookDelivery) (int, error) {
+	if strings.HasPrefix(delivery.URL, pluginTargetPrefix) {
+		return p.sendPluginNotification(delivery)
+	}
+
+	body := []byte(delivery.Payload)
+	request, errRequest := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if errRequest != nil {
+		return 0, errRequest
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", PluginId)
+	request.Header.Set("X-Calendar-Event", "event."+delivery.EventType)
+	request.Header.Set("X-Calendar-Delivery", delivery.Id)
+	request.Header.Set(WebhookSignatureHeader, signWebhook(p.getConfiguration().WebhookSecret, body))
+
+	response, errDo := webhookClient.Do(request)
+	if errDo != nil {
+		return 0, errDo
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// pruneWebhookDeliveries removes the delivered and failed deliveries older than webhookRetention
+func (p *Plugin) pruneWebhookDeliveries(now time.Time) {
+	deleteSql, deleteArgs, _ := sq.Delete("calendar_webhook_deliveries").
+		Where(sq.And{
+			sq.Eq{"status": []string{WebhookDeliveryDelivered, WebhookDeliveryFailed}},
+			sq.Lt{"created": now.Add(-webhookRetention)},
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat()).
+		ToSql()
+
+	if _, err := p.DB.Exec(deleteSql, deleteArgs...); err != nil {
+		p.API.LogError("pruneWebhookDeliveries: " + err.Error())
+	}
+}
+
+// claimQueued leases a pending row of a delivery queue to this server by moving its next attempt
+// past the lease, so that the other servers and the next ticks skip it while it is being sent
+func (p *Plugin) claimQueued(table, id string, now time.Time) bool {
+	updateBuilder := sq.Update(table).
+		Set("next_attempt", now.Add(webhookClaimLease)).
+		Where(sq.And{
+			sq.Eq{"id": id},
+			sq.Eq{"status": WebhookDeliveryPending},
+			sq.LtOrEq{"next_attempt": now},
+		}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	updateSql, args, _ := updateBuilder.ToSql()
+
+	result, errUpdate := p.DB.Exec(updateSql, args...)
+	if errUpdate != nil {
+		p.API.LogError("claimQueued: " + errUpdate.Error())
+		return false
+	}
+	claimed, errRows := result.RowsAffected()
+	return errRows == nil && claimed == 1
+}
+
+// deliverWebhooks sends the deliveries that are due, retrying failed ones with exponential backoff
+// until webhookMaxAttempts
+func (p *Plugin) deliverWebhooks(now time.Time) {
+	if len(p.getConfiguration().webhookURLs()) == 0 && !p.hasPluginSubscriptions() {
+		return
+	}
+
+	queryBuilder := sq.Select(webhookDeliveryColumns...).
+		From("calendar_webhook_deliveries").
+		Where(sq.And{
+			sq.Eq{"status": WebhookDeliveryPending},
+			sq.LtOrEq{"next_attempt": now},
+		}).
+		OrderBy("next_attempt").
+		Limit(webhookBatchSize).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	deliveries := []WebhookDelivery{}
+	if errSelect := p.DB.Select(&deliveries, querySql, args...); errSelect != nil {
+		p.API.LogError("deliverWebhooks: " + errSelect.Error())
+		return
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		if !p.claimQueued("calendar_webhook_deliveries", delivery.Id, now) {
+			continue
+		}
+		responseCode, errSend := p.sendWebhook(delivery)
+
+		delivery.Attempts++
+		delivery.ResponseCode = responseCode
+		delivery.LastError = ""
+		if errSend == nil {
+			delivery.Status = WebhookDeliveryDelivered
+			delivered := time.Now().UTC()
+			delivery.Delivered = &delivered
+		} else {
+			delivery.LastError = errSend.Error()
+			if len(delivery.LastError) > webhookErrorMaxSize {
+				delivery.LastError = delivery.LastError[:webhookErrorMaxSize]
+			}
+			if delivery.Attempts >= webhookMaxAttempts {
+				delivery.Status = WebhookDeliveryFailed
+				p.API.LogWarn("Webhook delivery failed", "delivery", delivery.Id, "url", delivery.URL, "error", delivery.LastError)
+			} else {
+				delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+			}
+		}
+
+		updateBuilder := sq.Update("calendar_webhook_deliveries").
+			SetMap(map[string]interface{}{
+				"status":        delivery.Status,
+				"attempts":      delivery.Attempts,
+				"next_attempt":  delivery.NextAttempt,
+				"response_code": delivery.ResponseCode,
+				"last_error":    delivery.LastError,
+				"delivered":     delivery.Delivered,
+			}).
+			Where(sq.Eq{"id": delivery.Id}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat())
+		updateSql, updateArgs, _ := updateBuilder.ToSql()
+
+		if _, errUpdate := p.DB.Exec(updateSql, updateArgs...); errUpdate != nil {
+			p.API.LogError("deliverWebhooks: can't update delivery: " + errUpdate.Error())
+		}
+	}
+}
+
+// GetWebhookDeliveries returns the delivery log, newest first, to system admins
+func (p *Plugin) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	user, appErr := p.sessionUser(r)
+	if appErr != nil {
+		errorResponse(w, appErr)
+		return
+	}
+	if !p.API.HasPermissionTo(user.Id, model.PermissionManageSystem) {
+		errorResponse(w, NotAuthorizedError)
+		return
+	}
+
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 0 {
+		page = 0
+	}
+
+	queryBuilder := sq.Select(webhookDeliveryColumns...).
+		From("calendar_webhook_deliveries").
+		OrderBy("created DESC").
+		Limit(webhookLogPageSize).
+		Offset(uint64(page * webhookLogPageSize)).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	if status := query.Get("status"); status != "" {
+		queryBuilder = queryBuilder.Where(sq.Eq{"status": status})
+	}
+	querySql, args, _ := queryBuilder.ToSql()
+
+	deliveries := []WebhookDelivery{}
+	if errSelect := p.DB.Select(&deliveries, querySql, args...); errSelect != nil {
+		p.API.LogError(errSelect.Error())
+		errorResponse(w, SomethingWentWrong)
+		return
+	}
+
+	apiResponse(w, &deliveries)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWebhookSubscribed(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &configuration{}
+	assert.False(config.webhookSubscribed(WebhookEventCreated))
+
+	config.WebhookURLs = " https://a.example.com/hook \n\nhttps://b.example.com/hook"
+	assert.Equal([]string{"https://a.example.com/hook", "https://b.example.com/hook"}, config.webhookURLs())
+	assert.True(config.webhookSubscribed(WebhookEventCreated))
+	assert.True(config.webhookSubscribed(WebhookEventReminder))
+
+	config.WebhookEvents = "created, deleted"
+	assert.True(config.webhookSubscribed(WebhookEventDeleted))
+	assert.False(config.webhookSubscribed(WebhookEventUpdated))
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(30*time.Second, webhookBackoff(1))
+	assert.Equal(time.Minute, webhookBackoff(2))
+	assert.Equal(8*time.Minute, webhookBackoff(5))
+}
+
+func TestEnqueueWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{
+		WebhookURLs:   "https://a.example.com/hook\nhttps://b.example.com/hook",
+		WebhookEvents: "created",
+	})
+
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_webhook_deliveries (id,url,event_type,event_id,payload,status,next_attempt,last_error,created) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9),($10,")).
+		WithArgs(
+			sqlmock.AnyArg(), "https://a.example.com/hook", "created", "event-1", sqlmock.AnyArg(), "pending", sqlmock.AnyArg(), "", sqlmock.AnyArg(),
+			sqlmock.AnyArg(), "https://b.example.com/hook", "created", "event-1", sqlmock.AnyArg(), "pending", sqlmock.AnyArg(), "", sqlmock.AnyArg(),
+		).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	calPlugin.enqueueWebhook(WebhookEventCreated, &Event{Id: "event-1", Title: "Deploy"})
+	// not subscribed
+	calPlugin.enqueueWebhook(WebhookEventUpdated, &Event{Id: "event-1", Title: "Deploy"})
+
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := `{"type":"event.created","timestamp":"2024-03-01T09:00:00Z","event":{"id":"event-1"}}`
+	received := make(chan *http.Request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(payload, string(body))
+		assert.Equal(signWebhook("secret", body), r.Header.Get(WebhookSignatureHeader))
+		received <- r
+	}))
+	defer receiver.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	api.On("LogWarn", "Webhook delivery failed", "delivery", "delivery-3", "url", failing.URL, "error", mock.Anything).Return()
+	calPlugin.setConfiguration(&configuration{
+		WebhookURLs:   receiver.URL + "\n" + failing.URL,
+		WebhookSecret: "secret",
+	})
+
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT id, url, event_type, event_id, payload, status, attempts, next_attempt, response_code, last_error, created, delivered FROM calendar_webhook_deliveries WHERE (status = $1 AND next_attempt <= $2) ORDER BY next_attempt LIMIT 50")).
+		WithArgs("pending", now).
+		WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns).
+			AddRow("delivery-1", receiver.URL, "created", "event-1", payload, "pending", 0, now, 0, "", now, nil).
+			AddRow("delivery-2", failing.URL, "created", "event-1", payload, "pending", 1, now, 502, "", now, nil).
+			AddRow("delivery-3", failing.URL, "created", "event-1", payload, "pending", 5, now, 502, "", now, nil).
+			AddRow("delivery-4", receiver.URL, "created", "event-1", payload, "pending", 0, now, 0, "", now, nil))
+
+	claimSql := regexp.QuoteMeta("UPDATE calendar_webhook_deliveries SET next_attempt = $1 WHERE (id = $2 AND status = $3 AND next_attempt <= $4)")
+	updateSql := regexp.QuoteMeta("UPDATE calendar_webhook_deliveries SET attempts = $1, delivered = $2, last_error = $3, next_attempt = $4, response_code = $5, status = $6 WHERE id = $7")
+	dbMock.ExpectExec(claimSql).
+		WithArgs(now.Add(webhookClaimLease), "delivery-1", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(updateSql).
+		WithArgs(1, sqlmock.AnyArg(), "", now, 200, "delivered", "delivery-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// retried a minute later after the second failure
+	dbMock.ExpectExec(claimSql).
+		WithArgs(now.Add(webhookClaimLease), "delivery-2", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(updateSql).
+		WithArgs(2, nil, "unexpected status 502 Bad Gateway", now.Add(time.Minute), 502, "pending", "delivery-2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(claimSql).
+		WithArgs(now.Add(webhookClaimLease), "delivery-3", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(updateSql).
+		WithArgs(6, nil, "unexpected status 502 Bad Gateway", now, 502, "failed", "delivery-3").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// already claimed by another server, so it is not sent twice
+	dbMock.ExpectExec(claimSql).
+		WithArgs(now.Add(webhookClaimLease), "delivery-4", "pending", now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	calPlugin.deliverWebhooks(now)
+
+	request := <-received
+	assert.Equal("event.created", request.Header.Get("X-Calendar-Event"))
+	assert.Equal("delivery-1", request.Header.Get("X-Calendar-Delivery"))
+	assert.Equal("application/json", request.Header.Get("Content-Type"))
+	assert.Len(received, 0)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestPruneWebhookDeliveries(t *testing.T) {
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+
+	now := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM calendar_webhook_deliveries WHERE (status IN ($1,$2) AND created < $3)")).
+		WithArgs("delivered", "failed", now.Add(-webhookRetention)).
+		WillReturnResult(sqlmock.NewResult(0, 12))
+
+	calPlugin.pruneWebhookDeliveries(now)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestRemoveEvent_Webhook(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/events/event-1"
+	calPlugin, _, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodDelete, path)
+	defer closeDB()
+	calPlugin.setConfiguration(&configuration{WebhookURLs: "https://a.example.com/hook"})
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT ce.owner, ce.visibility, ce.channel, ce.team, cm.member FROM calendar_events ce")).
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "visibility", "channel", "team", "member"}).AddRow("test-user", "private", nil, "", nil))
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce WHERE ce.id = $1")).
+		WithArgs("event-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow("event-1", "Deploy"))
+	dbMock.ExpectQuery(regexp.QuoteMeta("DELETE FROM calendar_events WHERE id = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{}))
+
+	var payload sentPayload
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_webhook_deliveries")).
+		WithArgs(sqlmock.AnyArg(), "https://a.example.com/hook", "deleted", "event-1", payloadArg{&payload}, "pending", sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("event.deleted", payload.Type)
+	assert.Equal("Deploy", payload.Event.Title)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+// sentPayload is the part of a webhook payload the tests check
+type sentPayload struct {
+	Type  string `json:"type"`
+	Event struct {
+		Id    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"event"`
+}
+
+// payloadArg decodes the webhook payload argument of a query
+type payloadArg struct {
+	payload *sentPayload
+}
+
+func (a payloadArg) Match(value driver.Value) bool {
+	data, ok := value.(string)
+	return ok && json.Unmarshal([]byte(data), a.payload) == nil
+}
+
+func TestGetWebhookDeliveries_NotAdmin(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/webhooks/deliveries"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	api.On("HasPermissionTo", "test-user", model.PermissionManageSystem).Return(false)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestGetWebhookDeliveries(t *testing.T) {
+	assert := assert.New(t)
+
+	path := "/webhooks/deliveries"
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, path)
+	defer closeDB()
+	api.On("HasPermissionTo", "test-user", model.PermissionManageSystem).Return(true)
+
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_webhook_deliveries WHERE status = $1 ORDER BY created DESC LIMIT 50 OFFSET 50")).
+		WithArgs("failed").
+		WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns).
+			AddRow("delivery-1", "https://a.example.com/hook", "created", "event-1", "{}", "failed", 6, now, 502, "unexpected status 502 Bad Gateway", now, nil))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path+"?status=failed&page=1", nil)
+	calPlugin.ServeHTTP(&plugin.Context{SessionId: "session-id"}, w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"status":"failed"`)
+	assert.NotContains(w.Body.String(), `"payload"`)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
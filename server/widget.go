@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+)
+
+const (
+	// DefaultWidgetHorizonDays is how far ahead the widget of a channel looks by default
+	DefaultWidgetHorizonDays = 7
+	// DefaultWidgetEventCount is how many events the widget of a channel lists by default
+	DefaultWidgetEventCount = 5
+
+	maxWidgetHorizonDays = 90
+	maxWidgetEventCount  = 25
+)
+
+// ChannelWidget is the "Upcoming events" post pinned in a channel by the bot. The background job
+// edits it whenever the events of the channel in its horizon change or pass.
+type ChannelWidget struct {
+	ChannelID   string    `json:"channel_id" db:"channel_id"`
+	Enabled     bool      `json:"enabled" db:"enabled"`
+	HorizonDays int       `json:"horizon_days" db:"horizon_days"`
+	EventCount  int       `json:"event_count" db:"event_count"`
+	Timezone    string    `json:"timezone" db:"timezone"`
+	PostID      string    `json:"post_id" db:"post_id"`
+	Message     string    `json:"-" db:"message"`
+	UpdatedBy   string    `json:"updated_by" db:"updated_by"`
+	Updated     time.Time `json:"updated" db:"updated"`
+}
+
+var widgetColumns = []string{
+	"channel_id",
+	"enabled",
+	"horizon_days",
+	"event_count",
+	"timezone",
+	"post_id",
+	"message",
+	"updated_by",
+	"updated",
+}
+
+// getChannelWidget returns the widget of the channel, nil when it was never configured
+func (p *Plugin) getChannelWidget(channelId string) (*ChannelWidget, *model.AppError) {
+	queryBuilder := sq.Select(widgetColumns...).
+		From("calendar_channel_widgets").
+		Where(sq.Eq{"channel_id": channelId}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	widgets := []ChannelWidget{}
+	if errSelect := p.DB.Select(&widgets, querySql, args...); errSelect != nil {
+		p.API.LogError(errSelect.Error())
+		return nil, SomethingWentWrong
+	}
+	if len(widgets) == 0 {
+		return nil, nil
+	}
+	return &widgets[0], nil
+}
+
+// saveChannelWidget stores the widget, inserting it unless it exists
+func (p *Plugin) saveChannelWidget(widget *ChannelWidget, exists bool) error {
+	var querySql string
+	var args []interface{}
+	if exists {
+		querySql, args, _ = sq.Update("calendar_channel_widgets").
+			SetMap(map[string]interface{}{
+				"enabled":      widget.Enabled,
+				"horizon_days": widget.HorizonDays,
+				"event_count":  widget.EventCount,
+				"timezone":     widget.Timezone,
+				"post_id":      widget.PostID,
+				"message":      widget.Message,
+				"updated_by":   widget.UpdatedBy,
+				"updated":      widget.Updated,
+			}).
+			Where(sq.Eq{"channel_id": widget.ChannelID}).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	} else {
+		querySql, args, _ = sq.Insert("calendar_channel_widgets").
+			Columns(widgetColumns...).
+			Values(
+				widget.ChannelID,
+				widget.Enabled,
+				widget.HorizonDays,
+				widget.EventCount,
+				widget.Timezone,
+				widget.PostID,
+				widget.Message,
+				widget.UpdatedBy,
+				widget.Updated,
+			).
+			PlaceholderFormat(p.GetDBPlaceholderFormat()).
+			ToSql()
+	}
+
+	_, err := p.DB.Exec(querySql, args...)
+	return err
+}
+
+// formatWidgetMessage renders the events of the widget, at most EventCount of them
+func formatWidgetMessage(widget *ChannelWidget, events []Event, loc *time.Location) string {
+	message := "#### :calendar: Upcoming events\n"
+	if len(events) == 0 {
+		message += fmt.Sprintf("No events in the next %d days.\n", widget.HorizonDays)
+	} else {
+		message += "| time | title |\n| -----| ------|\n"
+		for i, event := range events {
+			if i == widget.EventCount {
+				break
+			}
+			event.Start = event.Start.In(loc)
+			event.End = event.End.In(loc)
+			message += fmt.Sprintf("|%s|%s|\n", formatEventTime(event), event.Title)
+		}
+		if more := len(events) - widget.EventCount; more > 0 {
+			message += fmt.Sprintf("\nand %d more\n", more)
+		}
+	}
+	return message + fmt.Sprintf("\n_Next %d days, times in %s._", widget.HorizonDays, loc.String())
+}
+
+// refreshChannelWidget brings the post of the widget up to date, posting and pinning it when it is
+// missing. It reports whether the widget changed and has to be saved.
+func (p *Plugin) refreshChannelWidget(widget *ChannelWidget, now time.Time) (bool, *model.AppError) {
+	loc, errLoc := time.LoadLocation(widget.Timezone)
+	if errLoc != nil {
+		loc = time.UTC
+	}
+
+	events, eventsErr := p.GetSharedEventsUTC(
+		channelCalendar(widget.ChannelID),
+		loc,
+		now,
+		now.AddDate(0, 0, widget.HorizonDays),
+	)
+	if eventsErr != nil {
+		return false, eventsErr
+	}
+
+	message := formatWidgetMessage(widget, events, loc)
+	if widget.PostID != "" && message == widget.Message {
+		return false, nil
+	}
+
+	if widget.PostID != "" {
+		// the post may have been deleted by a member, it is posted again then
+		if post, postErr := p.API.GetPost(widget.PostID); postErr == nil && post.DeleteAt == 0 {
+			post.Message = message
+			if _, updateErr := p.API.UpdatePost(post); updateErr != nil {
+				return false, updateErr
+			}
+			widget.Message = message
+			return true, nil
+		}
+	}
+
+	post, createErr := p.API.CreatePost(&model.Post{
+		UserId:    p.BotId,
+		ChannelId: widget.ChannelID,
+		Message:   message,
+		IsPinned:  true,
+	})
+	if createErr != nil {
+		return false, createErr
+	}
+	widget.PostID = post.Id
+	widget.Message = message
+	return true, nil
+}
+
+// refreshChannelWidgets brings the widgets of all channels up to date
+func (p *Plugin) refreshChannelWidgets(now time.Time) {
+	queryBuilder := sq.Select(widgetColumns...).
+		From("calendar_channel_widgets").
+		Where(sq.Eq{"enabled": true}).
+		PlaceholderFormat(p.GetDBPlaceholderFormat())
+	querySql, args, _ := queryBuilder.ToSql()
+
+	widgets := []ChannelWidget{}
+	if errSelect := p.DB.Select(&widgets, querySql, args...); errSelect != nil {
+		p.API.LogError(errSelect.Error())
+		return
+	}
+
+	for i := range widgets {
+		changed, refreshErr := p.refreshChannelWidget(&widgets[i], now)
+		if refreshErr != nil {
+			p.API.LogError("refreshChannelWidgets: " + refreshErr.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if saveErr := p.saveChannelWidget(&widgets[i], true); saveErr != nil {
+			p.API.LogError("refreshChannelWidgets: can't save widget: " + saveErr.Error())
+		}
+	}
+}
+
+// executeChannelWidgetCommand configures the widget of the channel:
+// /cal channel-widget [on | off] [--days N] [--count N]
+func (p *Plugin) executeChannelWidgetCommand(
+	c *plugin.Context,
+	args *model.CommandArgs,
+) (*model.CommandResponse, *model.AppError) {
+	usage := fmt.Sprintf(
+		"Usage: `/cal channel-widget [on | off] [--days 1-%d] [--count 1-%d]`",
+		maxWidgetHorizonDays,
+		maxWidgetEventCount,
+	)
+
+	user, appErr := p.API.GetUser(args.UserId)
+	if appErr != nil {
+		return nil, NotAuthorizedError
+	}
+	if _, memberErr := p.API.GetChannelMember(args.ChannelId, user.Id); memberErr != nil {
+		return nil, NotAuthorizedError
+	}
+
+	widget, widgetErr := p.getChannelWidget(args.ChannelId)
+	if widgetErr != nil {
+		return nil, widgetErr
+	}
+	exists := widget != nil
+	if !exists {
+		widget = &ChannelWidget{
+			ChannelID:   args.ChannelId,
+			HorizonDays: DefaultWidgetHorizonDays,
+			EventCount:  DefaultWidgetEventCount,
+		}
+	}
+
+	split := strings.Fields(args.Command)[2:]
+	if len(split) == 0 {
+		return ephemeralResponse(widgetStatus(widget)), nil
+	}
+
+	enabled := widget.Enabled
+	for i := 0; i < len(split); i++ {
+		switch split[i] {
+		case "on":
+			enabled = true
+		case "off":
+			enabled = false
+		case "--days", "--count":
+			if i+1 == len(split) {
+				return ephemeralResponse(usage), nil
+			}
+			value, errValue := strconv.Atoi(split[i+1])
+			if split[i] == "--days" && errValue == nil && value >= 1 && value <= maxWidgetHorizonDays {
+				widget.HorizonDays = value
+			} else if split[i] == "--count" && errValue == nil && value >= 1 && value <= maxWidgetEventCount {
+				widget.EventCount = value
+			} else {
+				return ephemeralResponse(usage), nil
+			}
+			i++
+		default:
+			return ephemeralResponse(usage), nil
+		}
+	}
+
+	widget.UpdatedBy = user.Id
+	widget.Updated = time.Now().UTC().Truncate(time.Second)
+
+	if enabled {
+		widget.Enabled = true
+		widget.Timezone = p.GetUserLocation(user).String()
+		// the settings may change the message, it is rendered again
+		widget.Message = ""
+		if _, refreshErr := p.refreshChannelWidget(widget, time.Now().UTC()); refreshErr != nil {
+			return nil, refreshErr
+		}
+	} else {
+		if widget.PostID != "" {
+			if deleteErr := p.API.DeletePost(widget.PostID); deleteErr != nil {
+				p.API.LogWarn("Can't delete the widget post", "post", widget.PostID, "error", deleteErr.Error())
+			}
+		}
+		widget.Enabled = false
+		widget.PostID = ""
+		widget.Message = ""
+	}
+
+	if saveErr := p.saveChannelWidget(widget, exists); saveErr != nil {
+		p.API.LogError("executeChannelWidgetCommand: can't save widget: " + saveErr.Error())
+		return nil, SomethingWentWrong
+	}
+
+	return ephemeralResponse(widgetStatus(widget)), nil
+}
+
+// widgetStatus describes the settings of the widget
+func widgetStatus(widget *ChannelWidget) string {
+	if !widget.Enabled {
+		return "The upcoming events widget of this channel is off."
+	}
+	return fmt.Sprintf(
+		"The upcoming events widget of this channel is on: up to %d events of the next %d days.",
+		widget.EventCount,
+		widget.HorizonDays,
+	)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFormatWidgetMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	widget := &ChannelWidget{HorizonDays: 7, EventCount: 2}
+	start := time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Title: "Standup", Start: start, End: start.Add(15 * time.Minute)},
+		{Title: "Retro", Start: start.Add(24 * time.Hour), End: start.Add(25 * time.Hour)},
+		{Title: "Release", Start: start.Add(48 * time.Hour), End: start.Add(49 * time.Hour)},
+	}
+
+	assert.Equal(
+		"#### :calendar: Upcoming events\n"+
+			"| time | title |\n| -----| ------|\n"+
+			"|2024-03-04T09:00:00|Standup|\n"+
+			"|2024-03-05T09:00:00|Retro|\n"+
+			"\nand 1 more\n"+
+			"\n_Next 7 days, times in Europe/Berlin._",
+		formatWidgetMessage(widget, events, berlin),
+	)
+	assert.Equal(
+		"#### :calendar: Upcoming events\nNo events in the next 7 days.\n\n_Next 7 days, times in UTC._",
+		formatWidgetMessage(widget, nil, time.UTC),
+	)
+}
+
+func expectWidgetEvents(dbMock sqlmock.Sqlmock, titles ...string) {
+	rows := sqlmock.NewRows(sharedEventColumns)
+	channel := "channel-1"
+	start := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Hour)
+	for _, title := range titles {
+		rows.AddRow("event-"+title, title, "", start, start.Add(time.Hour),
+			false, "", start, start, "other-user", &channel, false, "", nil, "", "channel", "", nil)
+	}
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce WHERE (ce.channel = $1 AND ce.visibility = $2 AND (")).
+		WithArgs("channel-1", "channel", sqlmock.AnyArg(), sqlmock.AnyArg(), true, sqlmock.AnyArg()).
+		WillReturnRows(rows)
+}
+
+func TestRefreshChannelWidgets(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	calPlugin.BotId = "bot-id"
+
+	now := time.Now().UTC()
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT channel_id, enabled, horizon_days, event_count, timezone, post_id, message, updated_by, updated FROM calendar_channel_widgets WHERE enabled = $1")).
+		WithArgs(true).
+		WillReturnRows(sqlmock.NewRows(widgetColumns).
+			AddRow("channel-1", true, 7, 5, "Europe/Berlin", "post-1", "old message", "test-user", now))
+	expectWidgetEvents(dbMock, "Release")
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_channel_widgets SET enabled = $1, event_count = $2, horizon_days = $3, message = $4, post_id = $5, timezone = $6, updated = $7, updated_by = $8 WHERE channel_id = $9")).
+		WithArgs(true, 5, 7, sqlmock.AnyArg(), "post-1", "Europe/Berlin", sqlmock.AnyArg(), "test-user", "channel-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	api.On("GetPost", "post-1").Return(&model.Post{Id: "post-1", ChannelId: "channel-1", IsPinned: true}, nil)
+	api.On("UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.Id == "post-1" && post.IsPinned && strings.Contains(post.Message, "|Release|")
+	})).Return(&model.Post{}, nil)
+
+	calPlugin.refreshChannelWidgets(now)
+
+	api.AssertNotCalled(t, "CreatePost", mock.Anything)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRefreshChannelWidget_Unchanged(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+
+	widget := &ChannelWidget{ChannelID: "channel-1", Enabled: true, HorizonDays: 7, EventCount: 5, Timezone: "UTC", PostID: "post-1"}
+	widget.Message = formatWidgetMessage(widget, nil, time.UTC)
+	expectWidgetEvents(dbMock)
+
+	changed, appErr := calPlugin.refreshChannelWidget(widget, time.Now().UTC())
+	assert.Nil(appErr)
+	assert.False(changed)
+	api.AssertNotCalled(t, "GetPost", mock.Anything)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRefreshChannelWidget_PostDeleted(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+	calPlugin.BotId = "bot-id"
+
+	widget := &ChannelWidget{ChannelID: "channel-1", Enabled: true, HorizonDays: 7, EventCount: 5, Timezone: "UTC", PostID: "post-1"}
+	expectWidgetEvents(dbMock, "Release")
+	api.On("GetPost", "post-1").Return(nil, model.NewAppError("GetPost", "not found", nil, "", http.StatusNotFound))
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.UserId == "bot-id" && post.ChannelId == "channel-1" && post.IsPinned
+	})).Return(&model.Post{Id: "post-2"}, nil)
+
+	changed, appErr := calPlugin.refreshChannelWidget(widget, time.Now().UTC())
+	assert.Nil(appErr)
+	assert.True(changed)
+	assert.Equal("post-2", widget.PostID)
+	assert.Contains(widget.Message, "|Release|")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestExecuteChannelWidgetCommand_On(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/")
+	defer closeDB()
+	calPlugin.BotId = "bot-id"
+	api.On("GetChannelMember", "channel-1", "test-user").Return(&model.ChannelMember{}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.IsPinned && strings.Contains(post.Message, "_Next 14 days, times in Europe/Berlin._")
+	})).Return(&model.Post{Id: "post-1"}, nil)
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_channel_widgets WHERE channel_id = $1")).
+		WithArgs("channel-1").
+		WillReturnRows(sqlmock.NewRows(widgetColumns))
+	expectWidgetEvents(dbMock)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO calendar_channel_widgets (channel_id,enabled,horizon_days,event_count,timezone,post_id,message,updated_by,updated) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)")).
+		WithArgs("channel-1", true, 14, 3, "Europe/Berlin", "post-1", sqlmock.AnyArg(), "test-user", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	response, appErr := calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+		Command:   "/cal channel-widget on --days 14 --count 3",
+		UserId:    "test-user",
+		ChannelId: "channel-1",
+	})
+	assert.Nil(appErr)
+	assert.Equal("The upcoming events widget of this channel is on: up to 3 events of the next 14 days.", response.Text)
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestExecuteChannelWidgetCommand_Off(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/")
+	defer closeDB()
+	api.On("GetChannelMember", "channel-1", "test-user").Return(&model.ChannelMember{}, nil)
+	api.On("DeletePost", "post-1").Return(nil)
+
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_channel_widgets WHERE channel_id = $1")).
+		WithArgs("channel-1").
+		WillReturnRows(sqlmock.NewRows(widgetColumns).
+			AddRow("channel-1", true, 7, 5, "UTC", "post-1", "message", "test-user", time.Now()))
+	dbMock.ExpectExec(regexp.QuoteMeta("UPDATE calendar_channel_widgets SET")).
+		WithArgs(false, 5, 7, "", "", "UTC", sqlmock.AnyArg(), "test-user", "channel-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	response, appErr := calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+		Command:   "/cal channel-widget off",
+		UserId:    "test-user",
+		ChannelId: "channel-1",
+	})
+	assert.Nil(appErr)
+	assert.Equal("The upcoming events widget of this channel is off.", response.Text)
+	api.AssertCalled(t, "DeletePost", "post-1")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestExecuteChannelWidgetCommand_Usage(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodPost, "/")
+	defer closeDB()
+	api.On("GetChannelMember", "channel-1", "test-user").Return(&model.ChannelMember{}, nil)
+
+	for command, text := range map[string]string{
+		"/cal channel-widget":             "The upcoming events widget of this channel is off.",
+		"/cal channel-widget on --days":   "Usage: `/cal channel-widget [on | off] [--days 1-90] [--count 1-25]`",
+		"/cal channel-widget --count 100": "Usage: `/cal channel-widget [on | off] [--days 1-90] [--count 1-25]`",
+		"/cal channel-widget maybe":       "Usage: `/cal channel-widget [on | off] [--days 1-90] [--count 1-25]`",
+	} {
+		dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_channel_widgets WHERE channel_id = $1")).
+			WillReturnRows(sqlmock.NewRows(widgetColumns))
+
+		response, appErr := calPlugin.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    "test-user",
+			ChannelId: "channel-1",
+		})
+		assert.Nil(appErr, command)
+		assert.Equal(text, response.Text, command)
+	}
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
+
+func TestRefreshChannelWidget_PrivateEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	calPlugin, api, dbMock, closeDB := newTemplateTestPlugin(t, http.MethodGet, "/")
+	defer closeDB()
+
+	// a private event of a member has the channel set too, only the channel visible events are asked for
+	channel := "channel-1"
+	start := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Hour)
+	rows := sqlmock.NewRows(sharedEventColumns).
+		AddRow("event-1", "Release", "", start, start.Add(time.Hour),
+			false, "", start, start, "other-user", &channel, false, "", nil, "", "channel", "", nil)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM calendar_events ce WHERE (ce.channel = $1 AND ce.visibility = $2 AND (")).
+		WithArgs("channel-1", string(VisibilityChannel), sqlmock.AnyArg(), sqlmock.AnyArg(), true, sqlmock.AnyArg()).
+		WillReturnRows(rows)
+	api.On("GetPost", "post-1").Return(&model.Post{Id: "post-1", ChannelId: "channel-1", IsPinned: true}, nil)
+	api.On("UpdatePost", mock.Anything).Return(&model.Post{}, nil)
+
+	widget := &ChannelWidget{ChannelID: "channel-1", Enabled: true, HorizonDays: 7, EventCount: 5, Timezone: "UTC", PostID: "post-1"}
+	changed, appErr := calPlugin.refreshChannelWidget(widget, time.Now().UTC())
+	assert.Nil(appErr)
+	assert.True(changed)
+	assert.Contains(widget.Message, "|Release|")
+	assert.Nil(dbMock.ExpectationsWereMet())
+}
@@ -119,51 +119,63 @@ const ICalSettings = () => {
 
             {tokenData?.enabled ? (
                 <div className='ical-settings-enabled'>
-                    <Text
-                        size={200}
-                        weight='semibold'
-                    >
-                        {'iCal Feed URL (read-only):'}
-                    </Text>
-                    <div className='ical-url-container'>
-                        <Input
-                            readOnly={true}
-                            value={tokenData.url || ''}
-                            className='ical-url-input'
-                        />
-                        <Button
-                            appearance='subtle'
-                            icon={copiedIcal ? <Checkmark20Regular/> : <Copy20Regular/>}
-                            onClick={handleCopyIcal}
-                            title='Copy iCal URL'
-                        />
-                    </div>
-                    <Text
-                        size={200}
-                        weight='semibold'
-                        style={{marginTop: '12px'}}
-                    >
-                        {'CalDAV URL (read/write sync):'}
-                    </Text>
-                    <div className='ical-url-container'>
-                        <Input
-                            readOnly={true}
-                            value={tokenData.caldavUrl || ''}
-                            className='ical-url-input'
-                        />
-                        <Button
-                            appearance='subtle'
-                            icon={copiedCaldav ? <Checkmark20Regular/> : <Copy20Regular/>}
-                            onClick={handleCopyCaldav}
-                            title='Copy CalDAV URL'
-                        />
-                    </div>
+                    {tokenData.url ? (
+                        <>
+                            <Text size={200}>
+                                {'Copy the URLs now, they are only shown once.'}
+                            </Text>
+                            <Text
+                                size={200}
+                                weight='semibold'
+                            >
+                                {'iCal Feed URL (read-only):'}
+                            </Text>
+                            <div className='ical-url-container'>
+                                <Input
+                                    readOnly={true}
+                                    value={tokenData.url}
+                                    className='ical-url-input'
+                                />
+                                <Button
+                                    appearance='subtle'
+                                    icon={copiedIcal ? <Checkmark20Regular/> : <Copy20Regular/>}
+                                    onClick={handleCopyIcal}
+                                    title='Copy iCal URL'
+                                />
+                            </div>
+                            <Text
+                                size={200}
+                                weight='semibold'
+                                style={{marginTop: '12px'}}
+                            >
+                                {'CalDAV URL (read/write sync):'}
+                            </Text>
+                            <div className='ical-url-container'>
+                                <Input
+                                    readOnly={true}
+                                    value={tokenData.caldavUrl || ''}
+                                    className='ical-url-input'
+                                />
+                                <Button
+                                    appearance='subtle'
+                                    icon={copiedCaldav ? <Checkmark20Regular/> : <Copy20Regular/>}
+                                    onClick={handleCopyCaldav}
+                                    title='Copy CalDAV URL'
+                                />
+                            </div>
+                        </>
+                    ) : (
+                        <Text size={200}>
+                            {'The feed is enabled. Its URLs were shown once, when it was enabled, and can\'t be shown again. To connect another app, create a separate labeled token for it with the iCal tokens API: regenerating this one disconnects every app that uses it.'}
+                        </Text>
+                    )}
                     <div className='ical-actions'>
                         <Button
                             appearance='subtle'
                             icon={<ArrowSync20Regular/>}
                             onClick={handleRegenerate}
                             disabled={actionLoading}
+                            title='Replaces the token, the apps that use it are disconnected'
                         >
                             {'Regenerate'}
                         </Button>